@@ -0,0 +1,245 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// aggregateSpecs implements flag.Value for "sum,avg=colA,colB" (repeatable): each function is
+// computed over each column.
+type aggregateSpecs []aggregateSpec
+
+type aggregateSpec struct {
+	fn, column string
+}
+
+func (a *aggregateSpecs) String() string {
+	parts := make([]string, len(*a))
+	for i, s := range *a {
+		parts[i] = s.key()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (a *aggregateSpecs) Set(v string) error {
+	fns, cols, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("expected functions=columns, e.g. sum,avg=Amount, got %q", v)
+	}
+	if len(splitCSV(fns)) == 0 || len(splitCSV(cols)) == 0 {
+		return fmt.Errorf("no functions or columns in %q", v)
+	}
+	for _, fn := range splitCSV(fns) {
+		switch fn {
+		case "sum", "avg", "min", "max":
+		default:
+			return fmt.Errorf("unknown aggregate %q (want sum, avg, min or max)", fn)
+		}
+		for _, col := range splitCSV(cols) {
+			*a = append(*a, aggregateSpec{fn: fn, column: col})
+		}
+	}
+	return nil
+}
+
+// key is the name of the aggregate in the summary line, e.g. sum(Amount).
+func (s aggregateSpec) key() string { return s.fn + "(" + s.column + ")" }
+
+// columnAggregate accumulates one column's non-null values. Integers, decimals and timespans are
+// summed exactly; reals as float64. Values are read through encode.Row, so a row costs no
+// allocations unless the column is decimal.
+type columnAggregate struct {
+	typ   types.Column
+	n     int64
+	isum  int64           // ints, longs and timespans, while the sum fits
+	sum   decimal.Decimal // decimals, and what didn't fit in isum
+	fsum  float64
+	ints  extremes[int64] // ints, longs and timespans
+	reals extremes[float64]
+	decs  extremes[decimal.Decimal]
+	times extremes[time.Time]
+}
+
+// extremes tracks the smallest and largest value seen.
+type extremes[T any] struct {
+	set      bool
+	min, max T
+}
+
+func (e *extremes[T]) add(v T, less func(a, b T) bool) {
+	switch {
+	case !e.set:
+		e.min, e.max, e.set = v, v, true
+	case less(v, e.min):
+		e.min = v
+	case less(e.max, v):
+		e.max = v
+	}
+}
+
+// get returns the min, or the max.
+func (e extremes[T]) get(min bool) T {
+	if min {
+		return e.min
+	}
+	return e.max
+}
+
+func (c *columnAggregate) add(r encode.Row, col int) {
+	switch c.typ {
+	case types.Int, types.Long:
+		n, ok := r.Long(col)
+		if !ok {
+			return
+		}
+		c.addInt(n)
+	case types.Timespan:
+		d, ok := r.Timespan(col)
+		if !ok {
+			return
+		}
+		c.addInt(int64(d))
+	case types.Real:
+		f, ok := r.Real(col)
+		if !ok {
+			return
+		}
+		c.fsum += f
+		c.reals.add(f, cmp.Less[float64])
+	case types.Decimal:
+		d, ok := r.Decimal(col)
+		if !ok {
+			return
+		}
+		c.sum = c.sum.Add(d)
+		c.decs.add(d, decimal.Decimal.LessThan)
+	case types.DateTime:
+		t, ok := r.DateTime(col)
+		if !ok {
+			return
+		}
+		c.times.add(t, time.Time.Before)
+	default:
+		return
+	}
+	c.n++
+}
+
+func (c *columnAggregate) addInt(n int64) {
+	if s := c.isum + n; (c.isum^s)&(n^s) < 0 {
+		// The sum would overflow: move it to the decimal one.
+		c.sum, c.isum = c.sum.Add(decimal.NewFromInt(c.isum)), n
+	} else {
+		c.isum = s
+	}
+	c.ints.add(n, cmp.Less[int64])
+}
+
+func (c *columnAggregate) result(fn string) string {
+	if c.n == 0 {
+		if fn == "sum" {
+			return "0"
+		}
+		return "null"
+	}
+	if fn == "min" || fn == "max" {
+		return c.extreme(fn == "min")
+	}
+	fsum, sum := c.fsum, c.sum.Add(decimal.NewFromInt(c.isum))
+	if fn == "avg" {
+		fsum, sum = fsum/float64(c.n), sum.Div(decimal.NewFromInt(c.n))
+	}
+	switch c.typ {
+	case types.Real:
+		return strconv.FormatFloat(fsum, 'g', -1, 64)
+	case types.Timespan:
+		return time.Duration(sum.IntPart()).String()
+	}
+	return sum.String()
+}
+
+// extreme formats the column's min, or its max.
+func (c *columnAggregate) extreme(min bool) string {
+	switch c.typ {
+	case types.Real:
+		return strconv.FormatFloat(c.reals.get(min), 'g', -1, 64)
+	case types.Decimal:
+		return c.decs.get(min).String()
+	case types.DateTime:
+		return c.times.get(min).UTC().Format(time.RFC3339Nano)
+	case types.Timespan:
+		return time.Duration(c.ints.get(min)).String()
+	}
+	return strconv.FormatInt(c.ints.get(min), 10)
+}
+
+// aggregatingEncoder computes --aggregate over the first primary result table on its way to the
+// wrapped Encoder.
+type aggregatingEncoder struct {
+	encode.Encoder
+	specs   aggregateSpecs
+	table   *encode.Table
+	columns map[int]*columnAggregate // by column index
+	byName  map[string]*columnAggregate
+}
+
+func (a *aggregatingEncoder) Begin(t *encode.Table) error {
+	if a.table == nil && t.Kind == "PrimaryResult" {
+		a.table, a.columns, a.byName = t, map[int]*columnAggregate{}, map[string]*columnAggregate{}
+		for _, s := range a.specs {
+			i := -1
+			for j, c := range t.Columns {
+				if c.Name() == s.column {
+					i = j
+				}
+			}
+			if i < 0 {
+				return fmt.Errorf("--aggregate column %q not found in table %s", s.column, t.Name)
+			}
+			typ := t.Columns[i].Type()
+			switch typ {
+			case types.Int, types.Long, types.Real, types.Decimal, types.Timespan:
+			case types.DateTime:
+				if s.fn == "sum" || s.fn == "avg" {
+					return fmt.Errorf("--aggregate: %s of datetime column %q", s.fn, s.column)
+				}
+			default:
+				return fmt.Errorf("--aggregate: column %q is %s, not numeric", s.column, typ)
+			}
+			if a.columns[i] == nil {
+				a.columns[i] = &columnAggregate{typ: typ}
+				a.byName[s.column] = a.columns[i]
+			}
+		}
+	}
+	return a.Encoder.Begin(t)
+}
+
+func (a *aggregatingEncoder) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if t == a.table {
+		row := encode.RowAt(vals)
+		for i, c := range a.columns {
+			c.add(row, i)
+		}
+	}
+	return a.Encoder.WriteRow(t, index, vals)
+}
+
+// addTo adds the aggregates to the summary line, in flag order.
+func (a *aggregatingEncoder) addTo(s *runSummary) {
+	if a.table == nil {
+		return
+	}
+	for _, spec := range a.specs {
+		s.add(spec.key(), a.byName[spec.column].result(spec.fn))
+	}
+}
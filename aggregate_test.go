@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestAggregateSpecs(t *testing.T) {
+	tests := []struct {
+		flags []string
+		want  string
+		err   string
+	}{
+		{flags: []string{"sum,avg=Amount,Count"}, want: "sum(Amount),sum(Count),avg(Amount),avg(Count)"},
+		{flags: []string{"max=Took", " min = When "}, want: "max(Took),min(When)"},
+		{flags: []string{"sum"}, err: "expected functions=columns"},
+		{flags: []string{"sum="}, err: "no functions or columns"},
+		{flags: []string{"median=Amount"}, err: `unknown aggregate "median"`},
+	}
+	for _, tt := range tests {
+		var specs aggregateSpecs
+		var err error
+		for _, f := range tt.flags {
+			if err = specs.Set(f); err != nil {
+				break
+			}
+		}
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.flags, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || specs.String() != tt.want {
+			t.Errorf("%q: %s (%v), want %s", tt.flags, specs.String(), err, tt.want)
+		}
+	}
+}
+
+func TestAggregatingEncoder(t *testing.T) {
+	var specs aggregateSpecs
+	for _, f := range []string{"sum,avg,min,max=Count,Amount,Price,Took", "min,max=When"} {
+		if err := specs.Set(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	csv, _ := encode.New("csv", &buf, encode.Options{})
+	a := &aggregatingEncoder{Encoder: csv, specs: specs}
+	table := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+		testColumn{0, "Count", types.Long}, testColumn{1, "Amount", types.Real}, testColumn{2, "Price", types.Decimal},
+		testColumn{3, "Took", types.Timespan}, testColumn{4, "When", types.DateTime}}}
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	rows := []value.Values{
+		{value.NewLong(math.MaxInt64), value.NewReal(1.5), value.NewDecimal(decimal.RequireFromString("0.1")), value.NewTimespan(time.Second), value.NewDateTime(day)},
+		{value.NewLong(math.MaxInt64), value.NewReal(-0.5), value.NewDecimal(decimal.RequireFromString("0.2")), value.NewTimespan(3 * time.Second), value.NewDateTime(day.Add(-time.Hour))},
+		{value.NewNullLong(), value.NewNullReal(), value.NewNullDecimal(), value.NewNullTimespan(), value.NewNullDateTime()},
+		{value.NewLong(-2), value.NewReal(2), value.NewDecimal(decimal.RequireFromString("-0.3")), value.NewTimespan(2 * time.Second), value.NewDateTime(day.Add(time.Minute))},
+	}
+	if err := a.Begin(table); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rows {
+		if err := a.WriteRow(table, i, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first primary result is aggregated.
+	other := &encode.Table{Name: "PrimaryResult_1", Kind: "PrimaryResult", Columns: table.Columns}
+	a.Begin(other)
+	a.WriteRow(other, 0, rows[0])
+	if err := a.End(); err != nil {
+		t.Fatal(err)
+	}
+	var s runSummary
+	a.addTo(&s)
+	want := []string{
+		// Two MaxInt64 overflow int64, so the sum continues exactly in a decimal.
+		"sum(Count)=18446744073709551612", "sum(Amount)=3", "sum(Price)=0", "sum(Took)=6s",
+		"avg(Count)=6148914691236517204", "avg(Amount)=1", "avg(Price)=0", "avg(Took)=2s",
+		"min(Count)=-2", "min(Amount)=-0.5", "min(Price)=-0.3", "min(Took)=1s",
+		"max(Count)=9223372036854775807", "max(Amount)=2", "max(Price)=0.2", "max(Took)=3s",
+		"min(When)=2024-05-31T23:00:00Z", "max(When)=2024-06-01T00:01:00Z",
+	}
+	if strings.Join(s.fields, " ") != strings.Join(want, " ") {
+		t.Errorf("summary:\n%s\nwant:\n%s", strings.Join(s.fields, "\n"), strings.Join(want, "\n"))
+	}
+	if !strings.HasPrefix(buf.String(), "Count,Amount,Price,Took,When\r\n9223372036854775807,1.5,0.1,") {
+		t.Errorf("rows weren't passed through:\n%s", buf.String())
+	}
+}
+
+func TestAggregatingEncoderEmpty(t *testing.T) {
+	var specs aggregateSpecs
+	specs.Set("sum,avg,max=Count")
+	csv, _ := encode.New("csv", &bytes.Buffer{}, encode.Options{})
+	a := &aggregatingEncoder{Encoder: csv, specs: specs}
+	table := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{testColumn{0, "Count", types.Int}}}
+	a.Begin(table)
+	a.WriteRow(table, 0, value.Values{value.NewNullInt()})
+	var s runSummary
+	a.addTo(&s)
+	if got := strings.Join(s.fields, " "); got != "sum(Count)=0 avg(Count)=null max(Count)=null" {
+		t.Errorf("summary %s", got)
+	}
+}
+
+func TestAggregatingEncoderColumns(t *testing.T) {
+	table := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+		testColumn{0, "State", types.String}, testColumn{1, "When", types.DateTime}}}
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"sum=Nope", `--aggregate column "Nope" not found in table PrimaryResult`},
+		{"max=State", `--aggregate: column "State" is string, not numeric`},
+		{"avg=When", `--aggregate: avg of datetime column "When"`},
+		{"min,max=When", ""},
+	}
+	for _, tt := range tests {
+		var specs aggregateSpecs
+		specs.Set(tt.spec)
+		csv, _ := encode.New("csv", &bytes.Buffer{}, encode.Options{})
+		err := (&aggregatingEncoder{Encoder: csv, specs: specs}).Begin(table)
+		if (tt.err == "") != (err == nil) || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.spec, err, tt.err)
+		}
+	}
+}
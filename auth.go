@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// refreshingCredential wraps a token credential for long-running modes (tail, serve, scheduled runs).
+// It caches one token per scope set, refreshes it ahead of expiry in the background and logs/counts
+// refresh failures, so an expiring login shows up as a warning instead of a burst of 401s mid-stream.
+type refreshingCredential struct {
+	cred   azcore.TokenCredential
+	margin time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+
+	refreshes atomic.Int64
+	failures  atomic.Int64
+}
+
+type cachedToken struct {
+	opts policy.TokenRequestOptions
+	tok  azcore.AccessToken
+}
+
+// tokenRefresh is the refreshingCredential over the --auth provider's credential that clients
+// and streaming requests get their tokens from, once startTokenRefresh turned it on; nil until then.
+var tokenRefresh *refreshingCredential
+
+// startTokenRefresh is for long-running modes (serve, serve-metrics, daemon, tail, watch,
+// queue-worker, ingest-events, ingest --stdin): from then on, newClient and clusterToken use one
+// refreshingCredential, which renews tokens in the background until ctx ends.
+// KUSTO_TOKEN_REFRESH_MARGIN sets how long before expiry a token is renewed (default 5m). A
+// provider that only works through the SDK is left as it is, with a warning.
+func startTokenRefresh(ctx context.Context) {
+	p, ok := currentAuth.(credentialProvider)
+	if !ok {
+		log.Printf("WARN auth: %s doesn't provide a credential to refresh ahead of expiry; the SDK renews its tokens when they expire", currentAuth.Name())
+		return
+	}
+	cred, err := p.Credential()
+	if err != nil {
+		return // newClient fails with the same error
+	}
+	tokenRefresh = newRefreshingCredential(cred, getDurationEnv("KUSTO_TOKEN_REFRESH_MARGIN", 5*time.Minute))
+	go tokenRefresh.Run(ctx)
+}
+
+func newRefreshingCredential(cred azcore.TokenCredential, margin time.Duration) *refreshingCredential {
+	return &refreshingCredential{cred: cred, margin: margin, tokens: map[string]*cachedToken{}}
+}
+
+// GetToken implements azcore.TokenCredential. A cached token is served until it is within the
+// refresh margin; if renewal fails while the old token is still valid, the old token is kept.
+func (c *refreshingCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	key := tokenKey(opts)
+	c.mu.Lock()
+	ct, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok && time.Until(ct.tok.ExpiresOn) > c.margin {
+		return ct.tok, nil
+	}
+	tok, err := c.refresh(ctx, key, opts)
+	if err != nil {
+		if ok && time.Now().Before(ct.tok.ExpiresOn) {
+			return ct.tok, nil
+		}
+		return azcore.AccessToken{}, err
+	}
+	return tok, nil
+}
+
+// Run refreshes cached tokens ahead of expiry until ctx is cancelled.
+func (c *refreshingCredential) Run(ctx context.Context) {
+	interval := c.margin / 4
+	if interval <= 0 || interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		due := make(map[string]policy.TokenRequestOptions)
+		for key, ct := range c.tokens {
+			if time.Until(ct.tok.ExpiresOn) <= c.margin {
+				due[key] = ct.opts
+			}
+		}
+		c.mu.Unlock()
+		for key, opts := range due {
+			rctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			_, _ = c.refresh(rctx, key, opts)
+			cancel()
+		}
+	}
+}
+
+// Stats reports how many refreshes were attempted and how many failed, and when the first of the
+// cached tokens expires (zero with none cached).
+func (c *refreshingCredential) Stats() (refreshes, failures int64, expiry time.Time) {
+	c.mu.Lock()
+	for _, ct := range c.tokens {
+		if expiry.IsZero() || ct.tok.ExpiresOn.Before(expiry) {
+			expiry = ct.tok.ExpiresOn
+		}
+	}
+	c.mu.Unlock()
+	return c.refreshes.Load(), c.failures.Load(), expiry
+}
+
+// tokenMetrics are the series of the token refresh, for the /metrics of serve and serve-metrics,
+// with their help added to help; none before startTokenRefresh.
+func tokenMetrics(help map[string]string) []*metricsSeries {
+	if tokenRefresh == nil {
+		return nil
+	}
+	refreshes, failures, expiry := tokenRefresh.Stats()
+	help["kusto_token_refreshes"] = "Tokens acquired or renewed since the start."
+	help["kusto_token_refresh_failures"] = "Token acquisitions or renewals that failed since the start."
+	series := []*metricsSeries{
+		{name: "kusto_token_refreshes", value: float64(refreshes)},
+		{name: "kusto_token_refresh_failures", value: float64(failures)},
+	}
+	if !expiry.IsZero() {
+		help["kusto_token_expiry_timestamp_seconds"] = "When the first of the cached tokens expires, in Unix time."
+		series = append(series, &metricsSeries{name: "kusto_token_expiry_timestamp_seconds", value: float64(expiry.Unix())})
+	}
+	return series
+}
+
+func (c *refreshingCredential) refresh(ctx context.Context, key string, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.refreshes.Add(1)
+	tok, err := c.cred.GetToken(ctx, opts)
+	if err != nil {
+		c.failures.Add(1)
+		c.mu.Lock()
+		ct, ok := c.tokens[key]
+		c.mu.Unlock()
+		if ok {
+			log.Printf("WARN auth: token refresh failed (current token expires in %s): %v", time.Until(ct.tok.ExpiresOn).Round(time.Second), err)
+		} else {
+			log.Printf("WARN auth: token acquisition failed: %v", err)
+		}
+		return azcore.AccessToken{}, err
+	}
+	c.mu.Lock()
+	c.tokens[key] = &cachedToken{opts: opts, tok: tok}
+	c.mu.Unlock()
+	return tok, nil
+}
+
+func tokenKey(opts policy.TokenRequestOptions) string {
+	return strings.Join(opts.Scopes, " ") + "|" + opts.TenantID + "|" + opts.Claims
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// countingCredential hands out tokens that expire after ttl, named by how many it handed out.
+type countingCredential struct {
+	ttl   time.Duration
+	calls int
+	err   error
+}
+
+func (c *countingCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	if c.err != nil {
+		return azcore.AccessToken{}, c.err
+	}
+	return azcore.AccessToken{Token: strings.Repeat("t", c.calls), ExpiresOn: time.Now().Add(c.ttl)}, nil
+}
+
+func TestRefreshingCredential(t *testing.T) {
+	scope := policy.TokenRequestOptions{Scopes: []string{"https://kusto.example/.default"}}
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		failAfter bool // the second acquisition fails
+		want      string
+		calls     int
+		failures  int64
+	}{
+		{name: "cached while far from expiry", ttl: time.Hour, want: "t", calls: 1},
+		{name: "renewed within the margin", ttl: 2 * time.Minute, want: "tt", calls: 2},
+		{name: "old token kept when renewal fails", ttl: 2 * time.Minute, failAfter: true, want: "t", calls: 2, failures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred := &countingCredential{ttl: tt.ttl}
+			c := newRefreshingCredential(cred, 5*time.Minute)
+			if _, err := c.GetToken(context.Background(), scope); err != nil {
+				t.Fatal(err)
+			}
+			if tt.failAfter {
+				cred.err = errors.New("AADSTS700082: the refresh token has expired")
+			}
+			tok, err := c.GetToken(context.Background(), scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.Token != tt.want || cred.calls != tt.calls {
+				t.Errorf("token %q after %d acquisitions, want %q after %d", tok.Token, cred.calls, tt.want, tt.calls)
+			}
+			if _, failures, expiry := c.Stats(); failures != tt.failures || expiry.IsZero() {
+				t.Errorf("%d failures, expiry %v", failures, expiry)
+			}
+		})
+	}
+}
+
+func TestStartTokenRefresh(t *testing.T) {
+	t.Setenv("KUSTO_ACCESS_TOKEN", "tok")
+	defer func(p authProvider, r *refreshingCredential) { currentAuth, tokenRefresh = p, r }(currentAuth, tokenRefresh)
+	currentAuth = tokenAuth{}
+	tokenRefresh = nil
+	if m := tokenMetrics(map[string]string{}); m != nil {
+		t.Errorf("metrics before the refresh started: %v", m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startTokenRefresh(ctx)
+	for i := 0; i < 2; i++ {
+		if tok, err := clusterToken(ctx, "https://help.kusto.windows.net"); err != nil || tok != "tok" {
+			t.Fatalf("token %q: %v", tok, err)
+		}
+	}
+	help := map[string]string{}
+	exp := string(metricsExposition(tokenMetrics(help), help, false))
+	for _, want := range []string{"kusto_token_refreshes 1\n", "kusto_token_refresh_failures 0\n", "# TYPE kusto_token_expiry_timestamp_seconds gauge\n"} {
+		if !strings.Contains(exp, want) {
+			t.Errorf("metrics lack %q:\n%s", want, exp)
+		}
+	}
+	if _, err := newKCSB("https://help.kusto.windows.net"); err != nil {
+		t.Error(err)
+	}
+}
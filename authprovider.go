@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// authProvider is one way of authenticating to the cluster. Apply configures a connection string
+// builder for it; Diagnose checks the provider's local prerequisites (environment, files, CLIs)
+// without contacting anything and returns the problems found, for probe suggestions.
+//
+// New credential types, such as an internal token broker, are a small implementation passed to
+// registerAuthProvider from an init function; --auth (or KUSTO_AUTH) selects one by Name.
+type authProvider interface {
+	Name() string
+	Apply(kcsb *azkustodata.ConnectionStringBuilder) (*azkustodata.ConnectionStringBuilder, error)
+	Diagnose() []string
+}
+
+var authProviders = map[string]authProvider{}
+
+func registerAuthProvider(p authProvider) {
+	if _, dup := authProviders[p.Name()]; dup {
+		panic("auth provider registered twice: " + p.Name())
+	}
+	authProviders[p.Name()] = p
+}
+
+func authNames() []string {
+	names := make([]string, 0, len(authProviders))
+	for n := range authProviders {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// currentAuth is the provider selected with --auth; every client of the run uses it.
+var currentAuth authProvider = defaultAuth{}
+
+func selectAuth(name string) error {
+	p, ok := authProviders[name]
+	if !ok {
+		return fmt.Errorf("unknown --auth %q (want one of %s)", name, strings.Join(authNames(), ", "))
+	}
+	currentAuth = p
+	return nil
+}
+
+// newKCSB returns a connection string builder for cluster authenticated with the selected provider.
+func newKCSB(cluster string) (*azkustodata.ConnectionStringBuilder, error) {
+	if tokenRefresh != nil {
+		return azkustodata.NewConnectionStringBuilder(cluster).WithTokenCredential(tokenRefresh), nil
+	}
+	kcsb, err := currentAuth.Apply(azkustodata.NewConnectionStringBuilder(cluster))
+	if err != nil {
+		return nil, fmt.Errorf("auth %s: %w", currentAuth.Name(), err)
+	}
+	return kcsb, nil
+}
+
+// credentialProvider is implemented by providers that can also hand out their token credential,
+// for the few calls made to the cluster without the SDK (streaming ingestion). Providers without
+// it only work through the SDK.
+type credentialProvider interface {
+	Credential() (azcore.TokenCredential, error)
+}
+
+// clusterToken returns a bearer token for cluster from the selected provider.
+func clusterToken(ctx context.Context, cluster string) (string, error) {
+	var cred azcore.TokenCredential = tokenRefresh
+	if tokenRefresh == nil {
+		p, ok := currentAuth.(credentialProvider)
+		if !ok {
+			return "", fmt.Errorf("auth %s doesn't provide tokens outside the SDK", currentAuth.Name())
+		}
+		var err error
+		if cred, err = p.Credential(); err != nil {
+			return "", fmt.Errorf("auth %s: %w", currentAuth.Name(), err)
+		}
+	}
+	tok, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{strings.TrimRight(cluster, "/") + "/.default"}})
+	if err != nil {
+		return "", fmt.Errorf("auth %s: %w", currentAuth.Name(), err)
+	}
+	return tok.Token, nil
+}
+
+// newClient creates a Kusto client for cluster with the selected provider. Its HTTP calls go
+// through transfer, which applies --compress and counts the bytes received.
+func newClient(cluster string) (*azkustodata.Client, error) {
+	kcsb, err := newKCSB(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return azkustodata.New(kcsb, azkustodata.WithHttpClient(transfer.client()))
+}
+
+func init() {
+	registerAuthProvider(defaultAuth{})
+	registerAuthProvider(azCLIAuth{})
+	registerAuthProvider(managedIdentityAuth{})
+	registerAuthProvider(appSecretAuth{})
+	registerAuthProvider(workloadIdentityAuth{})
+	registerAuthProvider(tokenAuth{})
+}
+
+// missingEnv lists the variables among names that are not set.
+func missingEnv(names ...string) []string {
+	var problems []string
+	for _, n := range names {
+		if os.Getenv(n) == "" {
+			problems = append(problems, n+" is not set")
+		}
+	}
+	return problems
+}
+
+// defaultAuth is DefaultAzureCredential: environment, workload identity, managed identity, then
+// the Azure CLI and developer tools, whichever works first.
+type defaultAuth struct{}
+
+func (defaultAuth) Name() string { return "default" }
+
+func (defaultAuth) Apply(k *azkustodata.ConnectionStringBuilder) (*azkustodata.ConnectionStringBuilder, error) {
+	return k.WithDefaultAzureCredential(), nil
+}
+
+func (defaultAuth) Credential() (azcore.TokenCredential, error) {
+	return azidentity.NewDefaultAzureCredential(nil)
+}
+
+func (defaultAuth) Diagnose() []string {
+	if os.Getenv("AZURE_CLIENT_ID") != "" || os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" || os.Getenv("IDENTITY_ENDPOINT") != "" {
+		return nil
+	}
+	if _, err := exec.LookPath("az"); err != nil {
+		return []string{"no AZURE_* credentials in the environment, no managed identity endpoint and no az CLI on PATH"}
+	}
+	return nil
+}
+
+// azCLIAuth uses the account logged in with "az login".
+type azCLIAuth struct{}
+
+func (azCLIAuth) Name() string { return "azcli" }
+
+func (azCLIAuth) Apply(k *azkustodata.ConnectionStringBuilder) (*azkustodata.ConnectionStringBuilder, error) {
+	return k.WithAzCli(), nil
+}
+
+func (azCLIAuth) Credential() (azcore.TokenCredential, error) {
+	return azidentity.NewAzureCLICredential(nil)
+}
+
+func (azCLIAuth) Diagnose() []string {
+	if _, err := exec.LookPath("az"); err != nil {
+		return []string{"az CLI not found on PATH"}
+	}
+	if err := exec.Command("az", "account", "show", "--output", "none").Run(); err != nil {
+		return []string{"az account show failed: run 'az login'"}
+	}
+	return nil
+}
+
+// managedIdentityAuth uses the VM/App Service managed identity; AZURE_CLIENT_ID selects a
+// user-assigned identity.
+type managedIdentityAuth struct{}
+
+func (managedIdentityAuth) Name() string { return "msi" }
+
+func (managedIdentityAuth) Apply(k *azkustodata.ConnectionStringBuilder) (*azkustodata.ConnectionStringBuilder, error) {
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		return k.WithUserAssignedIdentityClientId(id), nil
+	}
+	return k.WithSystemManagedIdentity(), nil
+}
+
+func (managedIdentityAuth) Credential() (azcore.TokenCredential, error) {
+	opts := &azidentity.ManagedIdentityCredentialOptions{}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		opts.ID = azidentity.ClientID(id)
+	}
+	return azidentity.NewManagedIdentityCredential(opts)
+}
+
+// Diagnose has nothing to check: Azure VMs expose the identity endpoint without any local setup.
+func (managedIdentityAuth) Diagnose() []string { return nil }
+
+// appSecretAuth is a service principal with a client secret.
+type appSecretAuth struct{}
+
+func (appSecretAuth) Name() string { return "app-secret" }
+
+func (appSecretAuth) Apply(k *azkustodata.ConnectionStringBuilder) (*azkustodata.ConnectionStringBuilder, error) {
+	if p := missingEnv("AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID"); len(p) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(p, ", "))
+	}
+	return k.WithAadAppKey(os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET"), os.Getenv("AZURE_TENANT_ID")), nil
+}
+
+func (appSecretAuth) Credential() (azcore.TokenCredential, error) {
+	if p := missingEnv("AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID"); len(p) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(p, ", "))
+	}
+	return azidentity.NewClientSecretCredential(os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET"), nil)
+}
+
+func (appSecretAuth) Diagnose() []string {
+	return missingEnv("AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID")
+}
+
+// workloadIdentityAuth is Kubernetes workload identity (a federated service account token).
+type workloadIdentityAuth struct{}
+
+func (workloadIdentityAuth) Name() string { return "workload-identity" }
+
+func (workloadIdentityAuth) Apply(k *azkustodata.ConnectionStringBuilder) (*azkustodata.ConnectionStringBuilder, error) {
+	if p := missingEnv("AZURE_CLIENT_ID", "AZURE_FEDERATED_TOKEN_FILE", "AZURE_TENANT_ID"); len(p) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(p, ", "))
+	}
+	return k.WithKubernetesWorkloadIdentity(os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_FEDERATED_TOKEN_FILE"), os.Getenv("AZURE_TENANT_ID")), nil
+}
+
+func (workloadIdentityAuth) Credential() (azcore.TokenCredential, error) {
+	if p := missingEnv("AZURE_CLIENT_ID", "AZURE_FEDERATED_TOKEN_FILE", "AZURE_TENANT_ID"); len(p) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(p, ", "))
+	}
+	return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+		ClientID: os.Getenv("AZURE_CLIENT_ID"), TenantID: os.Getenv("AZURE_TENANT_ID"), TokenFilePath: os.Getenv("AZURE_FEDERATED_TOKEN_FILE"),
+	})
+}
+
+func (workloadIdentityAuth) Diagnose() []string {
+	problems := missingEnv("AZURE_CLIENT_ID", "AZURE_FEDERATED_TOKEN_FILE", "AZURE_TENANT_ID")
+	if f := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); f != "" {
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, "federated token file: "+err.Error())
+		}
+	}
+	return problems
+}
+
+// tokenAuth sends a bearer token obtained elsewhere (KUSTO_ACCESS_TOKEN). The token is not
+// refreshed, so it only suits short runs.
+type tokenAuth struct{}
+
+func (tokenAuth) Name() string { return "token" }
+
+func (tokenAuth) Apply(k *azkustodata.ConnectionStringBuilder) (*azkustodata.ConnectionStringBuilder, error) {
+	tok := os.Getenv("KUSTO_ACCESS_TOKEN")
+	if tok == "" {
+		return nil, fmt.Errorf("KUSTO_ACCESS_TOKEN is not set")
+	}
+	return k.WithAadUserToken(tok), nil
+}
+
+func (tokenAuth) Credential() (azcore.TokenCredential, error) {
+	tok := os.Getenv("KUSTO_ACCESS_TOKEN")
+	if tok == "" {
+		return nil, fmt.Errorf("KUSTO_ACCESS_TOKEN is not set")
+	}
+	return staticToken(tok), nil
+}
+
+func (tokenAuth) Diagnose() []string { return missingEnv("KUSTO_ACCESS_TOKEN") }
+
+// staticToken is a token credential that always returns the same token.
+type staticToken string
+
+func (t staticToken) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: string(t), ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+)
+
+// benchAPIs are the SDK's ways of retrieving a result. Each reads the whole result, every row of
+// every table, the way a caller using that API would.
+var benchAPIs = []struct {
+	name string
+	run  func(ctx context.Context, client *azkustodata.Client, database string, q *kql.Builder) (rows int64, err error)
+}{
+	{"query", benchQuery},
+	{"iterative", benchIterative},
+	{"json", benchJSON},
+}
+
+// benchResult is what one API's runs measured. Rows is -1 for QueryToJson, which returns the
+// result as text.
+type benchResult struct {
+	API     string          `json:"api"`
+	Rows    int64           `json:"rows"`
+	Latency []time.Duration `json:"latency_ns"`
+	Allocs  []uint64        `json:"allocs"`
+	Bytes   []uint64        `json:"alloc_bytes"`
+	Failed  int             `json:"failed"`
+	Error   string          `json:"error,omitempty"` // the last failure
+	PeakRSS int64           `json:"peak_rss_bytes,omitempty"`
+}
+
+// runBench implements "bench client [cluster-name]": it runs the same query through Query
+// (the whole result buffered), IterativeQuery (tables and rows streamed) and QueryToJson (the
+// raw JSON), --runs times each after --warmup unmeasured runs, and compares their latency, heap
+// allocations and peak RSS.
+//
+// Each API runs in a child process of its own (this command with --api), so one API's heap
+// doesn't inflate the next one's RSS and the process's peak RSS is that API's. Allocations count
+// everything the process allocates during a run, the SDK's background goroutines included.
+// --json prints the measurements for comparing runs against different SDK versions.
+func runBench(args []string, globalTimeouts *timeoutFlags) {
+	if len(args) == 0 || args[0] != "client" {
+		log.Fatalf("usage: bench client [--query <kql>] [--runs 5] [--warmup 1] [--json] [cluster-name]")
+	}
+	fs := flag.NewFlagSet("bench client", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database the query runs in")
+	queryText := fs.String("query", getenv("KUSTO_QUERY", "range x from 1 to 100000 step 1 | extend s = strcat('row-', x), d = now()"), "query every API runs")
+	runs := fs.Int("runs", 5, "measured runs per API")
+	warmup := fs.Int("warmup", 1, "unmeasured runs per API first, which take the connection and token setup")
+	api := fs.String("api", "", "run only this API ("+benchNames()+") in this process and print its measurements as JSON")
+	asJSON := fs.Bool("json", false, "print the measurements as JSON")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args[1:])))
+	if *runs <= 0 || *warmup < 0 {
+		log.Fatalf("bench client: --runs must be positive and --warmup not negative")
+	}
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 5*time.Minute)
+
+	if *api != "" {
+		res, err := benchInProcess(*api, cluster, *database, *queryText, *runs, *warmup, timeouts)
+		if err != nil {
+			log.Fatalf("bench client: %v", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(res)
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("bench client: %v", err)
+	}
+	var results []*benchResult
+	for _, a := range benchAPIs {
+		fmt.Fprintf(os.Stderr, "BENCH %s: %d runs\n", a.name, *warmup+*runs)
+		cmd := exec.Command(self, append(os.Args[1:], "--api", a.name)...)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("bench client: %s: %v", a.name, err)
+		}
+		res := &benchResult{}
+		if err := json.Unmarshal(out.Bytes(), res); err != nil {
+			log.Fatalf("bench client: %s: %v", a.name, err)
+		}
+		res.PeakRSS = peakRSS(cmd.ProcessState)
+		results = append(results, res)
+	}
+
+	if *asJSON {
+		b, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	fmt.Printf("Client API benchmark on %s/%s, %d runs each\n", cluster, *database, *runs)
+	printSection(os.Stdout, benchSection(results))
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Printf("! %s: %d failed runs, last: %s\n", r.API, r.Failed, r.Error)
+		}
+	}
+}
+
+// benchInProcess measures one API in this process.
+func benchInProcess(api, cluster, database, queryText string, runs, warmup int, timeouts timeoutConfig) (*benchResult, error) {
+	var run func(context.Context, *azkustodata.Client, string, *kql.Builder) (int64, error)
+	for _, a := range benchAPIs {
+		if a.name == api {
+			run = a.run
+		}
+	}
+	if run == nil {
+		return nil, fmt.Errorf("unknown --api %q (want one of %s)", api, benchNames())
+	}
+	client, err := newClient(cluster)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+
+	res := &benchResult{API: api}
+	var before, after runtime.MemStats
+	for i := 0; i < warmup+runs; i++ {
+		ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		rows, err := run(ctx, client, database, (&kql.Builder{}).AddUnsafe(queryText))
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+		cancel()
+		if err != nil {
+			res.Failed++
+			res.Error = errText(err)
+			continue
+		}
+		if i < warmup {
+			continue
+		}
+		res.Rows = rows
+		res.Latency = append(res.Latency, elapsed)
+		res.Allocs = append(res.Allocs, after.Mallocs-before.Mallocs)
+		res.Bytes = append(res.Bytes, after.TotalAlloc-before.TotalAlloc)
+	}
+	return res, nil
+}
+
+func benchQuery(ctx context.Context, client *azkustodata.Client, database string, q *kql.Builder) (int64, error) {
+	ds, err := client.Query(ctx, database, q)
+	if err != nil {
+		return 0, err
+	}
+	var rows int64
+	for _, t := range ds.Tables() {
+		for _, row := range t.Rows() {
+			_ = row.Values()
+			if t.IsPrimaryResult() {
+				rows++
+			}
+		}
+	}
+	return rows, nil
+}
+
+func benchIterative(ctx context.Context, client *azkustodata.Client, database string, q *kql.Builder) (int64, error) {
+	ds, err := client.IterativeQuery(ctx, database, q)
+	if err != nil {
+		return 0, err
+	}
+	defer ds.Close()
+	var rows int64
+	for tr := range ds.Tables() {
+		if tr.Err() != nil {
+			return rows, tr.Err()
+		}
+		t := tr.Table()
+		for rr := range t.Rows() {
+			if rr.Err() != nil {
+				return rows, rr.Err()
+			}
+			_ = rr.Row().Values()
+			if t.IsPrimaryResult() {
+				rows++
+			}
+		}
+	}
+	return rows, nil
+}
+
+func benchJSON(ctx context.Context, client *azkustodata.Client, database string, q *kql.Builder) (int64, error) {
+	_, err := client.QueryToJson(ctx, database, q)
+	return -1, err
+}
+
+// benchSection lays the results out as a table, one API per row. Allocations are medians.
+func benchSection(results []*benchResult) reportSection {
+	sec := reportSection{Title: "Results", Columns: []string{"API", "ROWS", "P50", "P95", "MAX", "ALLOCS/RUN", "ALLOCATED/RUN", "PEAK RSS"}}
+	for _, r := range results {
+		if len(r.Latency) == 0 {
+			sec.Rows = append(sec.Rows, []string{r.API, "-", "-", "-", "-", "-", "-", "-"})
+			continue
+		}
+		lat := latencies{d: r.Latency}
+		rows, rss := "-", "-"
+		if r.Rows >= 0 {
+			rows = strconv.FormatInt(r.Rows, 10)
+		}
+		if r.PeakRSS > 0 {
+			rss = formatBytes(r.PeakRSS)
+		}
+		sec.Rows = append(sec.Rows, []string{r.API, rows,
+			reportCell(lat.pct(0.5)), reportCell(lat.pct(0.95)), reportCell(lat.pct(1)),
+			strconv.FormatUint(medianUint(r.Allocs), 10), formatBytes(int64(medianUint(r.Bytes))), rss})
+	}
+	return sec
+}
+
+func medianUint(v []uint64) uint64 {
+	s := append([]uint64(nil), v...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[len(s)/2]
+}
+
+func benchNames() string {
+	names := make([]string, len(benchAPIs))
+	for i, a := range benchAPIs {
+		names[i] = a.name
+	}
+	return strings.Join(names, "|")
+}
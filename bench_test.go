@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+)
+
+func TestBenchAPIs(t *testing.T) {
+	_, client := newFakeKusto(t, func(db, csl string) *fakeTable {
+		if csl == "fail" {
+			return nil
+		}
+		return &fakeTable{cols: []string{"x:long", "s:string"}, rows: [][]interface{}{{1, "row-1"}, {2, "row-2"}, {3, "row-3"}}}
+	})
+	for _, a := range benchAPIs {
+		t.Run(a.name, func(t *testing.T) {
+			rows, err := a.run(context.Background(), client, "Samples", kql.New("range x from 1 to 3 step 1"))
+			want := int64(3)
+			if a.name == "json" {
+				want = -1
+			}
+			if err != nil || rows != want {
+				t.Errorf("%d rows (%v), want %d", rows, err, want)
+			}
+			if _, err := a.run(context.Background(), client, "Samples", kql.New("fail")); err == nil {
+				t.Error("a failed query passed")
+			}
+		})
+	}
+}
+
+func TestBenchSection(t *testing.T) {
+	ms := time.Millisecond
+	results := []*benchResult{
+		{API: "query", Rows: 100000, Latency: []time.Duration{30 * ms, 10 * ms, 20 * ms}, Allocs: []uint64{900, 100, 500},
+			Bytes: []uint64{3 << 20, 1 << 20, 2 << 20}, PeakRSS: 64 << 20},
+		{API: "json", Rows: -1, Latency: []time.Duration{5 * ms}, Allocs: []uint64{7}, Bytes: []uint64{512}},
+		{API: "iterative", Failed: 3, Error: "timeout"},
+	}
+	var got []string
+	for _, r := range benchSection(results).Rows {
+		got = append(got, strings.Join(r, " "))
+	}
+	want := []string{
+		"query 100000 20ms 30ms 30ms 500 2.0 MiB 64.0 MiB",
+		"json - 5ms 5ms 5ms 7 512 B -",
+		"iterative - - - - - - -",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if benchNames() != "query|iterative|json" {
+		t.Errorf("benchNames() = %s", benchNames())
+	}
+}
+
+func TestBenchInProcessUnknownAPI(t *testing.T) {
+	if _, err := benchInProcess("rest", "https://help.kusto.windows.net", "Samples", "print 1", 1, 0, timeoutConfig{}); err == nil ||
+		!strings.Contains(err.Error(), "want one of query|iterative|json") {
+		t.Errorf("unknown API: %v", err)
+	}
+}
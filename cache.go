@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resultCache keeps the output of recent queries under the user cache directory, so a dashboard
+// refreshing the same query within --cache gets the stored bytes instead of another cluster
+// round trip. An entry is the formatted output (<key>.out) plus what the run printed about it
+// (<key>.json): a hit reproduces stdout, the result fields of the summary and the profile.
+type resultCache struct {
+	dir      string
+	maxBytes int64 // larger outputs are not cached
+}
+
+// cacheEntry is the metadata stored next to a cached output.
+type cacheEntry struct {
+	Key      string    `json:"key"`
+	Cluster  string    `json:"cluster"`
+	Database string    `json:"database"`
+	Query    string    `json:"query"`
+	Format   string    `json:"format"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	Bytes    int64     `json:"bytes"`
+	Summary  []string  `json:"summary,omitempty"` // k=v fields describing the result (rows, hash, aggregates, page)
+	Profile  string    `json:"profile,omitempty"` // the --profile table as printed
+}
+
+func newResultCache() *resultCache {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return &resultCache{
+		dir:      filepath.Join(dir, "kusto-example", "results"),
+		maxBytes: getInt64Env("KUSTO_RESULT_CACHE_MAX_BYTES", 256<<20),
+	}
+}
+
+// cacheKey hashes everything that shapes a run's output: where it runs, the final query text
+// and the output options, each as a "name=value" part.
+func cacheKey(cluster, database, query string, options ...string) string {
+	h := sha256.New()
+	for _, p := range append([]string{"cluster=" + strings.ToLower(strings.TrimRight(cluster, "/")), "database=" + database, "query=" + query}, options...) {
+		fmt.Fprintf(h, "%d:%s\n", len(p), p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *resultCache) path(key, ext string) string { return filepath.Join(c.dir, key+ext) }
+
+// lookup returns the unexpired entry for key, or nil.
+func (c *resultCache) lookup(key string) *cacheEntry {
+	e, err := c.load(c.path(key, ".json"))
+	if err != nil || time.Now().After(e.Expires) {
+		return nil
+	}
+	if fi, err := os.Stat(c.path(key, ".out")); err != nil || fi.Size() != e.Bytes {
+		return nil
+	}
+	return e
+}
+
+func (c *resultCache) load(path string) (*cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid cache entry %s: %v", path, err)
+	}
+	return &e, nil
+}
+
+// replay copies a cached output to w.
+func (c *resultCache) replay(e *cacheEntry, w io.Writer) error {
+	f, err := os.Open(c.path(e.Key, ".out"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// entries returns all entries, newest first.
+func (c *resultCache) entries() ([]*cacheEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []*cacheEntry
+	for _, p := range paths {
+		if e, err := c.load(p); err == nil {
+			out = append(out, e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out, nil
+}
+
+func (c *resultCache) remove(key string) {
+	os.Remove(c.path(key, ".json"))
+	os.Remove(c.path(key, ".out"))
+}
+
+// cacheTee passes output through to w and copies it to a temporary file, which commit turns
+// into a cache entry once the run has succeeded. Output beyond the cache's size limit stops the
+// copy, and the run is not cached.
+type cacheTee struct {
+	w        io.Writer
+	cache    *resultCache
+	tmp      *os.File
+	n        int64
+	tooLarge bool
+}
+
+func (c *resultCache) tee(w io.Writer) *cacheTee { return &cacheTee{w: w, cache: c} }
+
+// open creates the temporary file on the first write, so runs that never write (cache hits,
+// failures before the query) leave nothing behind.
+func (t *cacheTee) open() error {
+	if t.tmp != nil {
+		return nil
+	}
+	if err := os.MkdirAll(t.cache.dir, 0o755); err != nil {
+		return err
+	}
+	var err error
+	t.tmp, err = os.CreateTemp(t.cache.dir, ".tmp-*")
+	return err
+}
+
+func (t *cacheTee) Write(p []byte) (int, error) {
+	if !t.tooLarge {
+		if t.n+int64(len(p)) > t.cache.maxBytes || t.open() != nil {
+			t.tooLarge = true
+		} else if _, err := t.tmp.Write(p); err != nil {
+			t.tooLarge = true // a cache problem must not fail the run
+		}
+		t.n += int64(len(p))
+	}
+	return t.w.Write(p)
+}
+
+// commit stores the copied output as e (whose Key is set) and reports whether it did.
+func (t *cacheTee) commit(e *cacheEntry) bool {
+	if t.open() != nil {
+		return false
+	}
+	defer t.discard()
+	if t.tooLarge || t.tmp.Close() != nil {
+		return false
+	}
+	e.Bytes = t.n
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return false
+	}
+	if os.Rename(t.tmp.Name(), t.cache.path(e.Key, ".out")) != nil {
+		return false
+	}
+	if os.WriteFile(t.cache.path(e.Key, ".json"), append(data, '\n'), 0o644) != nil {
+		t.cache.remove(e.Key)
+		return false
+	}
+	return true
+}
+
+// discard drops the copy; after commit it is a no-op.
+func (t *cacheTee) discard() {
+	if t.tmp != nil {
+		t.tmp.Close()
+		os.Remove(t.tmp.Name())
+	}
+}
+
+// runCache implements "cache list|clear [key-prefix...]".
+//
+// list prints the entries, newest first. clear removes all entries, those whose key starts with
+// one of the given prefixes, or with --expired only the expired ones.
+func runCache(args []string) {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "clear") {
+		log.Fatalf("usage: cache list|clear [--expired] [key-prefix...]")
+	}
+	mode := args[0]
+	fs := flag.NewFlagSet("cache "+mode, flag.ExitOnError)
+	expired := fs.Bool("expired", false, "clear: remove only expired entries")
+	prefixes := parseArgs(fs, args[1:])
+	c := newResultCache()
+	entries, err := c.entries()
+	if err != nil {
+		log.Fatalf("cache %s: %v", mode, err)
+	}
+	now := time.Now()
+
+	if mode == "list" {
+		sec := reportSection{
+			Title:   fmt.Sprintf("Result cache %s (%d entries)", c.dir, len(entries)),
+			Columns: []string{"Key", "Created", "Expires", "Size", "Database", "Format", "Query"},
+		}
+		for _, e := range entries {
+			expires := e.Expires.Sub(now).Round(time.Second).String()
+			if now.After(e.Expires) {
+				expires = "expired"
+			}
+			sec.Rows = append(sec.Rows, []string{e.Key[:12], e.Created.Local().Format("2006-01-02 15:04:05"), expires,
+				formatBytes(e.Bytes), e.Database, e.Format, profileCell(e.Query)})
+		}
+		printSection(os.Stdout, sec)
+		return
+	}
+
+	removed, size := 0, int64(0)
+	for _, e := range entries {
+		if *expired && !now.After(e.Expires) {
+			continue
+		}
+		if len(prefixes) > 0 && !hasAnyPrefix(e.Key, prefixes) {
+			continue
+		}
+		c.remove(e.Key)
+		removed++
+		size += e.Bytes
+	}
+	if len(prefixes) == 0 {
+		// Copies left by runs that failed mid-query.
+		tmps, _ := filepath.Glob(filepath.Join(c.dir, ".tmp-*"))
+		for _, p := range tmps {
+			if fi, err := os.Stat(p); err == nil && now.Sub(fi.ModTime()) > time.Hour {
+				os.Remove(p)
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "CACHE cleared %d entries (%s)\n", removed, formatBytes(size))
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	c := &resultCache{dir: t.TempDir(), maxBytes: 64}
+	key := cacheKey("https://c.kusto.windows.net/", "db", "T | take 1", "format=ndjson")
+	if key != cacheKey("https://C.kusto.windows.net", "db", "T | take 1", "format=ndjson") {
+		t.Error("key depends on the cluster URL's case or trailing slash")
+	}
+	if key == cacheKey("https://c.kusto.windows.net", "db", "T | take 1", "format=csv") {
+		t.Error("key ignores the format")
+	}
+	if c.lookup(key) != nil {
+		t.Fatal("hit in an empty cache")
+	}
+
+	var out bytes.Buffer
+	tee := c.tee(&out)
+	tee.Write([]byte(`{"a":1}` + "\n"))
+	tee.Write([]byte(`{"a":2}` + "\n"))
+	now := time.Now()
+	if !tee.commit(&cacheEntry{Key: key, Created: now, Expires: now.Add(time.Minute), Summary: []string{"rows=2"}}) {
+		t.Fatal("commit failed")
+	}
+	e := c.lookup(key)
+	if e == nil || e.Bytes != int64(out.Len()) || strings.Join(e.Summary, " ") != "rows=2" {
+		t.Fatalf("lookup = %+v", e)
+	}
+	var replayed bytes.Buffer
+	if err := c.replay(e, &replayed); err != nil || replayed.String() != out.String() {
+		t.Fatalf("replay = %q, %v; want %q", replayed.String(), err, out.String())
+	}
+
+	// Expired entries miss; outputs over the limit are passed through but not stored.
+	expiredKey := cacheKey("c", "db", "old")
+	tee = c.tee(&bytes.Buffer{})
+	tee.commit(&cacheEntry{Key: expiredKey, Created: now.Add(-time.Hour), Expires: now.Add(-time.Minute)})
+	if c.lookup(expiredKey) != nil {
+		t.Error("hit on an expired entry")
+	}
+	out.Reset()
+	tee = c.tee(&out)
+	tee.Write(bytes.Repeat([]byte("x"), 65))
+	if out.Len() != 65 || tee.commit(&cacheEntry{Key: cacheKey("c", "db", "big"), Expires: now.Add(time.Minute)}) {
+		t.Error("output over maxBytes was cached or not passed through")
+	}
+	if entries, _ := c.entries(); len(entries) != 2 || entries[0].Key != key {
+		t.Errorf("entries = %d, want the live and the expired one, newest first", len(entries))
+	}
+}
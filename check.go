@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/rowexpr"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// Exit statuses of check, one per kind of failure, so a cron job or a Kubernetes probe can tell
+// them apart. Bad arguments exit with 1, like other subcommands.
+const (
+	exitCheckQuery = 2 // the query failed or timed out, or its result couldn't be checked
+	exitCheckRows  = 3 // --expect-rows didn't hold
+	exitCheckValue = 4 // an --expect-value didn't hold in some row
+	exitCheckEmpty = 5 // --expect-empty, and the query returned rows
+)
+
+// rowCountExpectation is --expect-rows: a comparison of the row count with a number, such as >0,
+// <=10 or 3 (for ==3).
+type rowCountExpectation struct {
+	op string
+	n  int64
+}
+
+var rowCountComparison = regexp.MustCompile(`^(<=|>=|==|!=|<|>|=)?\s*(.*)$`)
+
+func parseRowCountExpectation(s string) (*rowCountExpectation, error) {
+	m := rowCountComparison.FindStringSubmatch(strings.TrimSpace(s))
+	n, err := strconv.ParseInt(strings.TrimSpace(m[2]), 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("want a comparison with a row count, such as >0 or <=10, got %q", s)
+	}
+	op := m[1]
+	if op == "" || op == "=" {
+		op = "=="
+	}
+	return &rowCountExpectation{op: op, n: n}, nil
+}
+
+func (e *rowCountExpectation) String() string { return fmt.Sprintf("rows %s %d", e.op, e.n) }
+
+func (e *rowCountExpectation) holds(rows int64) bool {
+	switch e.op {
+	case "<":
+		return rows < e.n
+	case "<=":
+		return rows <= e.n
+	case ">":
+		return rows > e.n
+	case ">=":
+		return rows >= e.n
+	case "!=":
+		return rows != e.n
+	}
+	return rows == e.n
+}
+
+// valueExpectation is one --expect-value: Column op value, such as Count<=5 or State!='TEXAS',
+// which every row of the result must satisfy. It is evaluated as the --filter expression
+// .["Column"] op value, so values compare as --filter compares them.
+type valueExpectation struct {
+	text   string
+	column string
+	expr   *rowexpr.Expr
+}
+
+var valueComparison = regexp.MustCompile(`^\s*(.*?)\s*(<=|>=|==|!=|<|>|=)\s*(.*?)\s*$`)
+
+func parseValueExpectation(s string) (*valueExpectation, error) {
+	m := valueComparison.FindStringSubmatch(s)
+	if m == nil || m[1] == "" || m[3] == "" {
+		return nil, fmt.Errorf("want Column op value, such as Count<=5, got %q", s)
+	}
+	column, op, lit := m[1], m[2], m[3]
+	if strings.HasPrefix(column, "['") && strings.HasSuffix(column, "']") {
+		column = column[2 : len(column)-2]
+	}
+	if op == "=" {
+		op = "=="
+	}
+	// Numbers, true, false, null and double-quoted strings are taken as they are; anything else,
+	// such as 'TEXAS' or 2024-03-01, is a string.
+	if _, err := strconv.ParseFloat(lit, 64); err != nil && lit != "true" && lit != "false" && lit != "null" && !strings.HasPrefix(lit, `"`) {
+		if len(lit) >= 2 && lit[0] == '\'' && lit[len(lit)-1] == '\'' {
+			lit = lit[1 : len(lit)-1]
+		}
+		b, _ := json.Marshal(lit)
+		lit = string(b)
+	}
+	name, _ := json.Marshal(column)
+	expr, err := rowexpr.Parse(fmt.Sprintf(".[%s] %s %s", name, op, lit))
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", s, err)
+	}
+	return &valueExpectation{text: strings.TrimSpace(s), column: column, expr: expr}, nil
+}
+
+// valueExpectations is the repeatable --expect-value flag.
+type valueExpectations []*valueExpectation
+
+func (v *valueExpectations) String() string {
+	texts := make([]string, len(*v))
+	for i, e := range *v {
+		texts[i] = e.text
+	}
+	return strings.Join(texts, ",")
+}
+
+func (v *valueExpectations) Set(s string) error {
+	e, err := parseValueExpectation(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, e)
+	return nil
+}
+
+// checkCollector counts the rows of the query's first primary result and checks each one against
+// the value expectations, keeping the first row each fails in. Rows aren't kept.
+type checkCollector struct {
+	values []*valueExpectation
+	table  *encode.Table
+	rows   int64
+	failed map[*valueExpectation]string // the first failing row, as "row 2: Count = 7"
+}
+
+func (c *checkCollector) Begin(t *encode.Table) error {
+	if c.table != nil {
+		return nil
+	}
+	c.table = t
+	for _, e := range c.values {
+		found := false
+		for _, col := range t.Columns {
+			found = found || col.Name() == e.column
+		}
+		if !found {
+			return fmt.Errorf("--expect-value %s: the result has no column %s", e.text, e.column)
+		}
+	}
+	return nil
+}
+
+func (c *checkCollector) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if t != c.table {
+		return nil
+	}
+	c.rows++
+	if len(c.values) == 0 {
+		return nil
+	}
+	row := rowMap(t, index, vals)
+	for _, e := range c.values {
+		if _, done := c.failed[e]; !done && !e.expr.Match(row) {
+			b, _ := json.Marshal(row[e.column])
+			c.failed[e] = fmt.Sprintf("row %d: %s = %s", c.rows, e.column, b)
+		}
+	}
+	return nil
+}
+
+func (c *checkCollector) End() error { return nil }
+
+// checker runs a query once and tests its result against the expectations.
+type checker struct {
+	query    string
+	database string
+	rows     *rowCountExpectation // nil: any number
+	empty    bool
+	values   []*valueExpectation
+	run      func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error
+}
+
+// check runs the query and writes a FAIL line to w for each expectation that didn't hold, or one
+// OK line, and returns the exit status: 0 when they all held, otherwise the status of the first
+// that didn't.
+func (c *checker) check(ctx context.Context, w io.Writer) int {
+	col := &checkCollector{values: c.values, failed: map[*valueExpectation]string{}}
+	start := time.Now()
+	if err := c.run(ctx, c.database, (&kql.Builder{}).AddUnsafe(c.query), encode.PrimaryOnly{Encoder: col}); err != nil {
+		fmt.Fprintf(w, "FAIL check: query: %s\n", errText(err))
+		return exitCheckQuery
+	}
+	took := time.Since(start).Round(time.Millisecond)
+	status := 0
+	fail := func(code int, format string, args ...interface{}) {
+		fmt.Fprintf(w, "FAIL check: "+format+"\n", args...)
+		if status == 0 {
+			status = code
+		}
+	}
+	if c.rows != nil && !c.rows.holds(col.rows) {
+		fail(exitCheckRows, "expected %s, got %d", c.rows, col.rows)
+	}
+	if c.empty && col.rows > 0 {
+		fail(exitCheckEmpty, "expected no rows, got %d", col.rows)
+	}
+	for _, e := range c.values {
+		switch {
+		case col.rows == 0:
+			fail(exitCheckValue, "expected %s, but there are no rows", e.text)
+		case col.failed[e] != "":
+			fail(exitCheckValue, "expected %s, got %s", e.text, col.failed[e])
+		}
+	}
+	if status == 0 {
+		held := []string{fmt.Sprintf("%d rows", col.rows)}
+		if c.rows != nil {
+			held = append(held, c.rows.String())
+		}
+		for _, e := range c.values {
+			held = append(held, e.text)
+		}
+		fmt.Fprintf(w, "OK check (%s): %s\n", took, strings.Join(held, ", "))
+	}
+	return status
+}
+
+// runCheck implements "check [cluster]": it runs --query once and exits with 0 if its result
+// meets every expectation, and otherwise with a status per failed kind (see exitCheckQuery), for
+// health checks from cron or Kubernetes probes. It is probe's data step with the query and the
+// condition up to the caller.
+func runCheck(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	queryText := fs.String("query", os.Getenv("KUSTO_QUERY"), "query to check (default KUSTO_QUERY)")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database the query runs in")
+	expectRows := fs.String("expect-rows", "", "the row count compared with a number, e.g. '>0', '<=10' or '3'")
+	expectEmpty := fs.Bool("expect-empty", false, "the query returns no rows")
+	var values valueExpectations
+	fs.Var(&values, "expect-value", "Column op value every row satisfies, e.g. 'Count<=5' or \"State!='TEXAS'\" (repeatable)")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	query := strings.TrimRight(strings.TrimSpace(*queryText), ";")
+	c := &checker{query: query, database: *database, empty: *expectEmpty, values: values}
+	if *expectRows != "" {
+		var err error
+		if c.rows, err = parseRowCountExpectation(*expectRows); err != nil {
+			log.Fatalf("check: --expect-rows: %v", err)
+		}
+	}
+	switch {
+	case query == "":
+		log.Fatalf("check: --query (or KUSTO_QUERY) is required")
+	case c.rows == nil && !c.empty && len(c.values) == 0:
+		log.Fatalf("check: nothing to check; set --expect-rows, --expect-value or --expect-empty")
+	}
+
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	globalRequest.checkServerTimeout(timeouts, callQuery)
+	c.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		id, opts := globalRequest.callOptions("check")
+		_, err := stream.Query(ctx, client, database, q, enc, opts...)
+		return withRequestID(err, id)
+	}
+	ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+	status := c.check(ctx, os.Stdout)
+	cancel()
+	client.Close()
+	os.Exit(status)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestParseRowCountExpectation(t *testing.T) {
+	for s, want := range map[string]string{">0": "rows > 0", "<= 10": "rows <= 10", "3": "rows == 3", "=0": "rows == 0", "!=2": "rows != 2"} {
+		e, err := parseRowCountExpectation(s)
+		if err != nil || e.String() != want {
+			t.Errorf("parseRowCountExpectation(%q) = %v, %v", s, e, err)
+		}
+	}
+	for _, s := range []string{"", ">", "lots", ">-1", "~5"} {
+		if _, err := parseRowCountExpectation(s); err == nil {
+			t.Errorf("parseRowCountExpectation(%q): no error", s)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+		query.NewColumn(0, "State", types.String), query.NewColumn(1, "Count", types.Long)}}
+	var rows []value.Values
+	var queryErr error
+	run := func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		if queryErr != nil {
+			return queryErr
+		}
+		if err := enc.Begin(tbl); err != nil {
+			return err
+		}
+		for i, r := range rows {
+			if err := enc.WriteRow(tbl, i, r); err != nil {
+				return err
+			}
+		}
+		return enc.End()
+	}
+	check := func(c *checker, flags ...string) (int, string) {
+		t.Helper()
+		for _, f := range flags {
+			name, val, _ := strings.Cut(f, "=")
+			switch name {
+			case "rows":
+				e, err := parseRowCountExpectation(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.rows = e
+			case "value":
+				e, err := parseValueExpectation(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.values = append(c.values, e)
+			}
+		}
+		c.run = run
+		var out strings.Builder
+		return c.check(context.Background(), &out), out.String()
+	}
+
+	rows = []value.Values{{value.NewString("TEXAS"), value.NewLong(3)}, {value.NewString("OHIO"), value.NewLong(7)}}
+	if status, out := check(&checker{}, "rows=>0", "value=Count<=10", "value=State!='IOWA'"); status != 0 ||
+		!strings.Contains(out, "2 rows, rows > 0, Count<=10, State!='IOWA'") {
+		t.Errorf("passing: %d %s", status, out)
+	}
+	if status, out := check(&checker{}, "value=Count<=5"); status != exitCheckValue || !strings.Contains(out, "expected Count<=5, got row 2: Count = 7") {
+		t.Errorf("value: %d %s", status, out)
+	}
+	// Every failure is reported; the status is the first one's.
+	if status, out := check(&checker{empty: true}, "rows=1", "value=State=TEXAS"); status != exitCheckRows ||
+		!strings.Contains(out, "expected rows == 1, got 2") || !strings.Contains(out, "expected no rows, got 2") || !strings.Contains(out, `got row 2: State = "OHIO"`) {
+		t.Errorf("several: %d %s", status, out)
+	}
+	if status, _ := check(&checker{}, "value=Nope>1"); status != exitCheckQuery {
+		t.Errorf("missing column: %d", status)
+	}
+
+	rows = nil
+	if status, _ := check(&checker{empty: true}); status != 0 {
+		t.Errorf("empty: %d", status)
+	}
+	if status, out := check(&checker{}, "value=Count<=5"); status != exitCheckValue || !strings.Contains(out, "no rows") {
+		t.Errorf("value without rows: %d %s", status, out)
+	}
+	queryErr = errors.New("Request timed out")
+	if status, out := check(&checker{empty: true}); status != exitCheckQuery || !strings.Contains(out, "FAIL check: query: Request timed out") {
+		t.Errorf("query error: %d %s", status, out)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// confirmGate is the safety check every subcommand that changes a cluster goes through before
+// it sends anything. Destructive operations ask y/N unless --yes is given. Clusters listed in
+// KUSTO_PROTECTED_CLUSTERS are stricter: any change to them needs the cluster's name typed
+// back, with or without --yes, so a script pointed at production by mistake stops there.
+type confirmGate struct {
+	yes         bool
+	protected   []string // cluster names or URIs
+	interactive bool     // stdin is a terminal
+	in          *bufio.Reader
+	out         io.Writer
+}
+
+// gate is the process's confirmation gate, set up by main from --yes.
+var gate = newConfirmGate(false)
+
+func newConfirmGate(yes bool) *confirmGate {
+	return &confirmGate{
+		yes:         yes,
+		protected:   splitCSV(os.Getenv("KUSTO_PROTECTED_CLUSTERS")),
+		interactive: stdinIsTerminal(),
+		in:          bufio.NewReader(os.Stdin),
+		out:         os.Stderr,
+	}
+}
+
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// clusterName returns the cluster's name, the first label of its host, e.g. "mycluster" for
+// https://mycluster.eastus.kusto.windows.net.
+func clusterName(cluster string) string {
+	host := cluster
+	if u, err := url.Parse(cluster); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	name, _, _ := strings.Cut(host, ".")
+	return strings.ToLower(name)
+}
+
+// isProtected reports whether cluster matches an entry of KUSTO_PROTECTED_CLUSTERS, by name or
+// by URI.
+func (g *confirmGate) isProtected(cluster string) bool {
+	name := clusterName(cluster)
+	for _, p := range g.protected {
+		if strings.EqualFold(strings.TrimRight(p, "/"), strings.TrimRight(cluster, "/")) || clusterName(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// needed reports whether confirm would ask.
+func (g *confirmGate) needed(cluster string, destructive bool) bool {
+	return g.isProtected(cluster) || (destructive && !g.yes)
+}
+
+// confirm asks before action runs against cluster. destructive says whether action deletes or
+// overwrites data; other changes only need confirming on protected clusters. It returns an error
+// if the answer is no, or if an answer is needed and stdin isn't a terminal.
+func (g *confirmGate) confirm(cluster, action string, destructive bool) error {
+	if !g.needed(cluster, destructive) {
+		return nil
+	}
+	protected := g.isProtected(cluster)
+	name := clusterName(cluster)
+	if !g.interactive {
+		if protected {
+			return fmt.Errorf("%s is a protected cluster: to %s, run at a terminal and type its name", name, action)
+		}
+		return fmt.Errorf("refusing to %s without confirmation; pass --yes", action)
+	}
+	if protected {
+		answer := g.ask(fmt.Sprintf("%s is a protected cluster (KUSTO_PROTECTED_CLUSTERS). Type its name to %s: ", name, action))
+		if !strings.EqualFold(answer, name) {
+			return fmt.Errorf("cancelled: %q is not %q", answer, name)
+		}
+		return nil
+	}
+	return g.yesNo(fmt.Sprintf("%s on %s?", strings.ToUpper(action[:1])+action[1:], name))
+}
+
+// yesNo asks a y/N question and returns an error unless the answer is yes.
+func (g *confirmGate) yesNo(question string) error {
+	if a := strings.ToLower(g.ask(question + " [y/N] ")); a != "y" && a != "yes" {
+		return fmt.Errorf("cancelled")
+	}
+	return nil
+}
+
+func (g *confirmGate) ask(prompt string) string {
+	fmt.Fprint(g.out, prompt)
+	answer, _ := g.in.ReadString('\n')
+	return strings.TrimSpace(answer)
+}
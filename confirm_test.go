@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testGate(yes, interactive bool, input string, protected ...string) *confirmGate {
+	return &confirmGate{yes: yes, protected: protected, interactive: interactive, in: bufio.NewReader(strings.NewReader(input)), out: io.Discard}
+}
+
+func TestConfirmGate(t *testing.T) {
+	const cluster = "https://prod1.eastus.kusto.windows.net"
+	for _, c := range []struct {
+		name        string
+		gate        *confirmGate
+		destructive bool
+		ok          bool
+	}{
+		{"change, unprotected", testGate(false, false, ""), false, true},
+		{"destructive, --yes", testGate(true, false, ""), true, true},
+		{"destructive, no terminal", testGate(false, false, ""), true, false},
+		{"destructive, answered y", testGate(false, true, "y\n"), true, true},
+		{"destructive, answered n", testGate(false, true, "n\n"), true, false},
+		{"protected by name, --yes", testGate(true, false, "", "PROD1"), false, false},
+		{"protected by URI, name typed", testGate(true, true, "prod1\n", cluster+"/"), false, true},
+		{"protected, y typed", testGate(false, true, "y\n", "prod1"), true, false},
+		{"other cluster protected", testGate(false, false, "", "prod2"), false, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.gate.confirm(cluster, "drop table T", c.destructive)
+			if (err == nil) != c.ok {
+				t.Errorf("confirm = %v, want ok=%v", err, c.ok)
+			}
+		})
+	}
+}
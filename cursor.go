@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/kqlquote"
+	"github.com/harche/kusto-example/pkg/sink"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// cursorState is a named database cursor: the query it reads and the position after the last
+// row delivered. It is stored as cursors/<name>.json in the state location.
+type cursorState struct {
+	Name     string    `json:"name"`
+	Cluster  string    `json:"cluster"`
+	Database string    `json:"database"`
+	Query    string    `json:"query"`
+	Cursor   string    `json:"cursor"` // "" before the first advance of a --from-start cursor
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Advances int       `json:"advances"`
+	Rows     int64     `json:"rows"` // primary result rows delivered so far
+}
+
+// runCursor implements "cursor create|advance|show <name> [cluster-name]".
+//
+// create records the query and the database's current cursor (or none with --from-start, so
+// the first advance reads everything). advance writes the rows ingested since the stored cursor
+// in --format to stdout, bounded by the cursor current at the start of the run, and stores that
+// cursor only after the output is complete: a failed run re-delivers the same rows next time.
+// show prints the stored state.
+//
+// The query must be a table reference optionally followed by row filters and projections;
+// cursor_after needs the table's IngestionTime policy.
+func runCursor(args []string, globalTimeouts *timeoutFlags) {
+	if len(args) == 0 || (args[0] != "create" && args[0] != "advance" && args[0] != "show") {
+		log.Fatalf("usage: cursor create|advance|show <name> [--query <kql>] [--state <dir|gs://|s3://>] [cluster-name]")
+	}
+	mode := args[0]
+	fs := flag.NewFlagSet("cursor "+mode, flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	state := fs.String("state", getenv("KUSTO_STATE", defaultStateDir()), "where cursor state is kept: a directory, gs://bucket/prefix or s3://bucket/prefix")
+	queryText := fs.String("query", os.Getenv("KUSTO_QUERY"), "table query the cursor reads (create only; default KUSTO_QUERY)")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database (create only)")
+	fromStart := fs.Bool("from-start", false, "create: start before the first row instead of at the current cursor")
+	format := fs.String("format", getenv("KUSTO_FORMAT", "ndjson"), "advance: output format: "+strings.Join(encode.Names(), "|"))
+	leaseContainer := fs.String("lease", os.Getenv("KUSTO_LEASE_CONTAINER"), "advance: take a blob lease in this container first (https://<account>.blob.core.windows.net/<container>[/<prefix>]), so of several replicas only one advances")
+	pos := parseArgs(fs, args[1:])
+	if len(pos) == 0 {
+		log.Fatalf("cursor %s: a cursor name is required", mode)
+	}
+	name := pos[0]
+	store, prefix, err := sink.OpenStore(&sink.Config{Opts: sink.Opts{}}, *state, true)
+	if err != nil {
+		log.Fatalf("cursor %s: --state %v", mode, err)
+	}
+	if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	key := prefix + "cursors/" + name + ".json"
+
+	if mode == "show" {
+		c, err := loadCursor(store, key)
+		if err != nil {
+			log.Fatalf("cursor show: %v", err)
+		}
+		b, _ := json.MarshalIndent(c, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+
+	// With --lease, replicas advancing the same cursor elect a leader; the others stand by.
+	runCtx := context.Background()
+	if mode == "advance" && *leaseContainer != "" {
+		lc, err := newBlobContainer("--lease", *leaseContainer)
+		if err != nil {
+			log.Fatalf("cursor advance: %v", err)
+		}
+		blob := "leases/cursor-" + name
+		if lc.prefix != "" {
+			blob = lc.prefix + "/" + blob
+		}
+		lease, leaderCtx, err := acquireLease(runCtx, lc, blob)
+		if errors.Is(err, errLeaseHeld) {
+			fmt.Fprintf(os.Stderr, "CURSOR %s: standing by, another replica holds %s\n", name, lc.blobURL(blob))
+			return
+		}
+		if err != nil {
+			log.Fatalf("cursor advance: --lease: %v", err)
+		}
+		defer lease.release(context.Background())
+		runCtx = leaderCtx
+	}
+
+	var c *cursorState
+	cluster := ""
+	if mode == "create" {
+		if strings.TrimSpace(*queryText) == "" {
+			log.Fatalf("cursor create: --query (or KUSTO_QUERY) is required")
+		}
+		cluster = resolveClusterURL(firstArg(pos[1:]))
+		c = &cursorState{Name: name, Cluster: cluster, Database: *database, Query: strings.TrimRight(strings.TrimSpace(*queryText), ";")}
+	} else {
+		if c, err = loadCursor(store, key); err != nil {
+			log.Fatalf("cursor advance: %v", err)
+		}
+		cluster = c.Cluster
+		if len(pos) > 1 {
+			cluster = resolveClusterURL(pos[1])
+		}
+	}
+
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+
+	ctx, cancel := timeouts.callContext(runCtx, callQuery)
+	current, err := currentCursor(ctx, client, c.Database)
+	cancel()
+	if err != nil {
+		log.Fatalf("cursor %s: cursor_current(): %s", mode, errText(err))
+	}
+
+	if mode == "create" {
+		now := time.Now().UTC()
+		c.Created, c.Updated = now, now
+		if !*fromStart {
+			c.Cursor = current
+		}
+		b, _ := json.MarshalIndent(c, "", "  ")
+		if err := store.PutIfAbsent(key, append(b, '\n')); errors.Is(err, sink.ErrExists) {
+			log.Fatalf("cursor create: cursor %s already exists", name)
+		} else if err != nil {
+			log.Fatalf("cursor create: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "CURSOR %s: created at %q\n", name, c.Cursor)
+		return
+	}
+
+	if current == c.Cursor {
+		fmt.Fprintf(os.Stderr, "CURSOR %s: no new rows since %q\n", name, c.Cursor)
+		return
+	}
+	out, err := encode.New(*format, os.Stdout, encode.Options{})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	ctx, cancel = timeouts.callContext(runCtx, callQuery)
+	defer cancel()
+	rows, err := stream.Query(ctx, client, c.Database, (&kql.Builder{}).AddUnsafe(cursorQuery(c.Query, c.Cursor, current)), out)
+	if err != nil {
+		log.Fatalf("cursor advance: %s", errText(err))
+	}
+	if runCtx.Err() != nil {
+		log.Fatalf("cursor advance: the lease was lost during the run; not saving the cursor, so the leader delivers these rows again")
+	}
+	c.Cursor, c.Updated = current, time.Now().UTC()
+	c.Advances++
+	c.Rows += rows
+	if err := saveCursor(store, key, c); err != nil {
+		log.Fatalf("cursor advance: rows were written but the cursor was not saved (they will be delivered again): %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "CURSOR %s: advanced to %q (%d rows)\n", name, current, rows)
+}
+
+// cursorQuery bounds the query to rows ingested after from (if any) and at or before to, so the
+// rows read match the cursor stored afterwards even while ingestion continues.
+func cursorQuery(query, from, to string) string {
+	filter := "cursor_before_or_at(" + kqlquote.String(to) + ")"
+	if from != "" {
+		filter = "cursor_after(" + kqlquote.String(from) + ") and " + filter
+	}
+	return query + "\n| where " + filter
+}
+
+func currentCursor(ctx context.Context, client *azkustodata.Client, database string) (string, error) {
+	ds, err := client.IterativeQuery(ctx, database, kql.New("print cursor_current()"))
+	if err != nil {
+		return "", err
+	}
+	defer ds.Close()
+	for tr := range ds.Tables() {
+		if tr.Err() != nil {
+			return "", tr.Err()
+		}
+		t := tr.Table()
+		for rr := range t.Rows() {
+			if rr.Err() != nil {
+				return "", rr.Err()
+			}
+			if t.Kind() == "PrimaryResult" && len(rr.Row().Values()) > 0 {
+				return fmt.Sprint(encode.PlainValue(rr.Row().Values()[0])), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no result")
+}
+
+func loadCursor(store sink.Store, key string) (*cursorState, error) {
+	b, err := store.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("no cursor at %s (create it with 'cursor create'): %v", key, err)
+	}
+	var c cursorState
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor state %s: %v", key, err)
+	}
+	return &c, nil
+}
+
+func saveCursor(store sink.Store, key string, c *cursorState) error {
+	b, _ := json.MarshalIndent(c, "", "  ")
+	w, err := store.Create(key, "json")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// defaultStateDir is where subcommands keep state when KUSTO_STATE is not set.
+func defaultStateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".kusto-state"
+	}
+	return filepath.Join(dir, "kusto-example")
+}
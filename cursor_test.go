@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/sink"
+)
+
+func TestCursorQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{name: "first advance from the start", to: "638500000000000000",
+			want: "Events | where Level == 'Error'\n| where cursor_before_or_at(\"638500000000000000\")"},
+		{name: "next advance", from: "638500000000000000", to: "638500000000000123",
+			want: "Events | where Level == 'Error'\n| where cursor_after(\"638500000000000000\") and cursor_before_or_at(\"638500000000000123\")"},
+		{name: "quotes in a cursor", from: `a"b`, to: "c",
+			want: "Events | where Level == 'Error'\n| where cursor_after(\"a\\\"b\") and cursor_before_or_at(\"c\")"},
+	}
+	for _, tt := range tests {
+		if got := cursorQuery("Events | where Level == 'Error'", tt.from, tt.to); got != tt.want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCursorState(t *testing.T) {
+	store, _, err := sink.OpenStore(&sink.Config{Opts: sink.Opts{}}, t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "cursors/errors.json"
+	if _, err := loadCursor(store, key); err == nil || !strings.Contains(err.Error(), "cursor create") {
+		t.Errorf("missing cursor: %v", err)
+	}
+	c := &cursorState{Name: "errors", Cluster: "https://help.kusto.windows.net", Database: "Samples", Query: "Events",
+		Cursor: "638500000000000000", Created: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), Advances: 2, Rows: 40}
+	if err := saveCursor(store, key, c); err != nil {
+		t.Fatal(err)
+	}
+	c.Cursor, c.Advances, c.Rows = "638500000000000123", 3, 45
+	if err := saveCursor(store, key, c); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadCursor(store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *c {
+		t.Errorf("loaded %+v, want %+v", got, c)
+	}
+	if err := store.PutIfAbsent("cursors/bad.json", []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCursor(store, "cursors/bad.json"); err == nil || !strings.Contains(err.Error(), "invalid cursor state") {
+		t.Errorf("bad cursor: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/rowframe"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// daemonRequest is the query a thin client sends the daemon, as the JSON of a request frame.
+// Query already holds the declare statement of Params, as query does for --param. The rest are
+// the client's request properties (see requestFlags), which go over the daemon's own.
+type daemonRequest struct {
+	Database      string       `json:"database"`
+	Query         string       `json:"query"`
+	Params        []queryParam `json:"params,omitempty"`
+	RequestID     string       `json:"request_id"`
+	Timeout       string       `json:"timeout"`
+	NoTruncation  bool         `json:"no_truncation,omitempty"`
+	ServerTimeout string       `json:"server_timeout,omitempty"`
+	App           string       `json:"app,omitempty"`
+	User          string       `json:"user,omitempty"`
+	Options       []string     `json:"options,omitempty"` // key=value, as --option takes them
+
+	// LargeQueryBytes is the client's --large-query-bytes, 0 with --yes: the daemon runs the
+	// large-query guard, which needs a signed-in client, and refuses what it would ask about.
+	LargeQueryBytes int64 `json:"large_query_bytes,omitempty"`
+}
+
+// withProperties returns req carrying the request properties of r. Options go as the text
+// --option took, so the daemon reads back the same bools, integers and strings.
+func (req daemonRequest) withProperties(r *requestFlags) daemonRequest {
+	req.NoTruncation, req.App, req.User = r.noTruncation, r.app, r.user
+	if r.serverTimeout > 0 {
+		req.ServerTimeout = r.serverTimeout.String()
+	}
+	for _, k := range r.options.keys() {
+		req.Options = append(req.Options, fmt.Sprintf("%s=%v", k, r.options[k]))
+	}
+	return req
+}
+
+// properties returns base, the daemon's request properties, with req's over them and req's
+// client request ID.
+func (req daemonRequest) properties(base *requestFlags) (*requestFlags, error) {
+	r := &requestFlags{noTruncation: base.noTruncation || req.NoTruncation, serverTimeout: base.serverTimeout,
+		app: base.app, user: base.user, requestID: req.RequestID, options: requestOptions{}}
+	for k, v := range base.options {
+		r.options[k] = v
+	}
+	for _, kv := range req.Options {
+		if err := r.options.Set(kv); err != nil {
+			return nil, fmt.Errorf("option %v", err)
+		}
+	}
+	if req.ServerTimeout != "" {
+		t, err := time.ParseDuration(req.ServerTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("server timeout: %v", err)
+		}
+		r.serverTimeout = t
+	}
+	if req.App != "" {
+		r.app = req.App
+	}
+	if req.User != "" {
+		r.user = req.User
+	}
+	return r, nil
+}
+
+// defaultDaemonSocket is where daemon listens and query --daemon connects when KUSTO_DAEMON isn't
+// set.
+func defaultDaemonSocket() string {
+	return filepath.Join(defaultStateDir(), "daemon.sock")
+}
+
+// daemon answers the queries of thin clients on a unix socket with one warm client, so a query
+// skips the process start, sign-in and TLS handshake it would otherwise pay for. A connection
+// carries one query: a request frame in, its result back as row frames (see package rowframe).
+type daemon struct {
+	timeout time.Duration
+	props   *requestFlags // the daemon's own, under each request's
+	run     func(ctx context.Context, req daemonRequest, props *requestFlags, params *kql.Parameters, enc encode.Encoder) (int64, error)
+}
+
+// serveConn answers the query on conn. A client that hangs up cancels its query.
+func (d *daemon) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := rowframe.NewWriter(conn)
+	typ, payload, err := rowframe.ReadFrame(r, nil)
+	if err != nil {
+		return
+	}
+	var req daemonRequest
+	if typ != rowframe.Request {
+		err = fmt.Errorf("expected a request frame, got %q", typ)
+	} else if err = json.Unmarshal(payload, &req); err != nil {
+		err = fmt.Errorf("request: %v", err)
+	}
+	timeout := d.timeout
+	if err == nil && req.Timeout != "" {
+		var t time.Duration
+		if t, err = time.ParseDuration(req.Timeout); err != nil {
+			err = fmt.Errorf("request: %v", err)
+		} else if t > 0 {
+			timeout = min(timeout, t)
+		}
+	}
+	var props *requestFlags
+	if err == nil {
+		if props, err = req.properties(d.props); err != nil {
+			err = fmt.Errorf("request: %v", err)
+		}
+	}
+	var params *kql.Parameters
+	if err == nil && len(req.Params) > 0 {
+		params = kql.NewParameters()
+		for _, p := range req.Params {
+			if _, err = p.bind(params); err != nil {
+				err = fmt.Errorf("parameter %v", err)
+				break
+			}
+		}
+	}
+	if err != nil {
+		w.Fail(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		// The client sends nothing after its request: a read returning means it hung up.
+		r.ReadByte()
+		cancel()
+	}()
+	start := time.Now()
+	rows, err := d.run(ctx, req, props, params, w)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL daemon query on %s after %d rows: %s\n", req.Database, rows, errText(withRequestID(err, req.RequestID)))
+		w.Fail(errors.New(errText(err)))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "OK daemon query on %s (%dms): %d rows\n", req.Database, time.Since(start).Milliseconds(), rows)
+}
+
+// listenDaemon listens on the unix socket at path, readable by the user only, since whoever
+// connects runs queries as the daemon's identity. A socket left by a daemon that is gone is
+// replaced; one a daemon still answers on is an error.
+func listenDaemon(path string) (net.Listener, error) {
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// daemonQuery runs req through the daemon at socket and replays its result into enc, returning
+// the number of rows.
+func daemonQuery(ctx context.Context, socket string, req daemonRequest, enc encode.Encoder) (int64, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return 0, fmt.Errorf("no daemon on %s (start one with 'daemon'): %w", socket, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	payload, _ := json.Marshal(req)
+	if err := rowframe.WriteFrame(conn, rowframe.Request, payload); err != nil {
+		return 0, fmt.Errorf("daemon %s: %w", socket, err)
+	}
+	rows, err := rowframe.Copy(bufio.NewReader(conn), enc)
+	if err != nil && ctx.Err() != nil {
+		return rows, ctx.Err()
+	}
+	return rows, err
+}
+
+// runDaemon implements "daemon [cluster]": it keeps a client signed in to the cluster and answers
+// the queries of "query --daemon" on a unix socket.
+func runDaemon(args []string, globalTimeouts *timeoutFlags, guard *queryGuard) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	socket := fs.String("socket", getenv("KUSTO_DAEMON", defaultDaemonSocket()), "unix socket to listen on")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+
+	// The daemon's stdin isn't its clients', so the guard refuses instead of asking.
+	gate.interactive = false
+	startTokenRefresh(context.Background())
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	globalRequest.checkServerTimeout(timeouts, callQuery)
+	d := &daemon{timeout: timeouts.forCall(callQuery), props: globalRequest}
+	d.run = func(ctx context.Context, req daemonRequest, props *requestFlags, params *kql.Parameters, enc encode.Encoder) (int64, error) {
+		if req.LargeQueryBytes > 0 {
+			g := &queryGuard{threshold: req.LargeQueryBytes, ttl: guard.ttl}
+			guardCtx, guardCancel := timeouts.callContext(ctx, callMgmt)
+			err := g.check(guardCtx, client, cluster, req.Database, req.Query)
+			guardCancel()
+			if err != nil {
+				return 0, err
+			}
+		}
+		_, opts := props.callOptions("daemon")
+		if params != nil {
+			opts = append(opts, azkustodata.QueryParameters(params))
+		}
+		return stream.Query(ctx, client, req.Database, (&kql.Builder{}).AddUnsafe(req.Query), enc, opts...)
+	}
+	l, err := listenDaemon(*socket)
+	if err != nil {
+		log.Fatalf("daemon: %v", err)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		l.Close() // removes the socket
+	}()
+	fmt.Fprintf(os.Stderr, "DAEMON listening on %s for %s\n", *socket, cluster)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Fatalf("daemon: %v", err)
+		}
+		go d.serveConn(conn)
+	}
+}
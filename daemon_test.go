@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/rowframe"
+)
+
+func TestDaemon(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "d.sock")
+	l, err := listenDaemon(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode: %v %v", fi.Mode(), err)
+	}
+	if _, err := listenDaemon(socket); err == nil || !strings.Contains(err.Error(), "already listening") {
+		t.Errorf("second daemon: %v", err)
+	}
+
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+		query.NewColumn(0, "State", types.String), query.NewColumn(1, "Events", types.Long)}}
+	var got daemonRequest
+	var gotProps *requestFlags
+	var gotParams string
+	cancelled := make(chan bool, 1)
+	d := &daemon{timeout: time.Minute, props: &requestFlags{app: "daemon", options: requestOptions{"query_datascope": "all", "request_readonly": true}}}
+	d.run = func(ctx context.Context, req daemonRequest, props *requestFlags, params *kql.Parameters, enc encode.Encoder) (int64, error) {
+		got, gotProps = req, props
+		if params != nil {
+			gotParams = params.ToDeclarationString()
+		}
+		switch req.Query {
+		case "Missing":
+			return 0, errors.New("Semantic error: 'Missing' could not be resolved")
+		case "Slow":
+			enc.Begin(tbl)
+			<-ctx.Done()
+			cancelled <- true
+			return 0, ctx.Err()
+		}
+		enc.Begin(tbl)
+		enc.WriteRow(tbl, 0, value.Values{value.NewString("TEXAS"), value.NewLong(3)})
+		enc.WriteRow(tbl, 1, value.Values{value.NewString("OHIO"), value.NewNullLong()})
+		return 2, enc.End()
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serveConn(conn)
+		}
+	}()
+
+	var out bytes.Buffer
+	enc, _ := encode.New("csv", &out, encode.Options{})
+	req := daemonRequest{Database: "Samples", Query: "declare query_parameters(state:string);\nStormEvents", Params: []queryParam{{Name: "state", Value: "TEXAS"}},
+		RequestID: "kusto-example.query;1", Timeout: "30s", LargeQueryBytes: 1 << 40}.withProperties(&requestFlags{noTruncation: true, serverTimeout: 90 * time.Minute, user: "ann",
+		options: requestOptions{"maxmemoryconsumptionperiterator": int64(68719476736), "query_datascope": "hotcache"}})
+	rows, err := daemonQuery(context.Background(), socket, req, enc)
+	if err != nil || rows != 2 || out.String() != "State,Events\r\nTEXAS,3\r\nOHIO,\r\n" {
+		t.Errorf("%d rows, %v:\n%s", rows, err, out.String())
+	}
+	if got.Database != "Samples" || got.RequestID != "kusto-example.query;1" || got.Timeout != "30s" || got.LargeQueryBytes != 1<<40 || gotParams != "declare query_parameters(state:string);" {
+		t.Errorf("the daemon got %+v with %q", got, gotParams)
+	}
+	// The client's request properties go over the daemon's.
+	if p := gotProps; !p.noTruncation || p.serverTimeout != 90*time.Minute || p.app != "daemon" || p.user != "ann" || p.requestID != "kusto-example.query;1" ||
+		p.options.String() != "maxmemoryconsumptionperiterator=68719476736,query_datascope=hotcache,request_readonly=true" || p.options["maxmemoryconsumptionperiterator"] != int64(68719476736) {
+		t.Errorf("request properties: %+v", p)
+	}
+
+	var remote *rowframe.RemoteError
+	if _, err := daemonQuery(context.Background(), socket, daemonRequest{Query: "Missing"}, enc); !errors.As(err, &remote) || !strings.Contains(err.Error(), "'Missing'") {
+		t.Errorf("failed query: %v", err)
+	}
+	if _, err := daemonQuery(context.Background(), socket, daemonRequest{Query: "T", Timeout: "soon"}, enc); err == nil || !strings.Contains(err.Error(), "soon") {
+		t.Errorf("bad timeout: %v", err)
+	}
+	if _, err := daemonQuery(context.Background(), socket, daemonRequest{Query: "T", ServerTimeout: "an hour"}, enc); err == nil || !strings.Contains(err.Error(), "server timeout") {
+		t.Errorf("bad server timeout: %v", err)
+	}
+	if _, err := daemonQuery(context.Background(), socket, daemonRequest{Query: "T", Params: []queryParam{{Name: "bad name", Value: "1"}}}, enc); err == nil || !strings.Contains(err.Error(), "parameter") {
+		t.Errorf("bad parameter: %v", err)
+	}
+
+	// A client that gives up cancels the daemon's query.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := daemonQuery(ctx, socket, daemonRequest{Query: "Slow"}, enc); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timed out: %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("the daemon's query wasn't cancelled")
+	}
+
+	l.Close()
+	if _, err := daemonQuery(context.Background(), socket, req, enc); err == nil || !strings.Contains(err.Error(), "no daemon") {
+		t.Errorf("no daemon: %v", err)
+	}
+	// A socket left behind is replaced.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l2, err := listenDaemon(socket)
+	if err != nil {
+		t.Errorf("stale socket: %v", err)
+	} else {
+		l2.Close()
+	}
+}
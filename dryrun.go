@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/classify"
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// validateQuery checks query on the cluster without running it (--dry-run). The query is sent
+// followed by | getschema, which the cluster answers from its semantic analysis without reading
+// any data, so a syntax error, an unknown table or column or a type mismatch fails as the real
+// run would, while a valid query costs next to nothing. It returns the result's columns as
+// "name: type".
+func validateQuery(ctx context.Context, client *azkustodata.Client, database, query string, opts ...azkustodata.QueryOption) ([]string, error) {
+	text := strings.TrimRight(query, " \t\r\n;") + "\n| getschema"
+	opts = append(opts, azkustodata.RequestReadonly())
+	ds, err := client.IterativeQuery(ctx, database, (&kql.Builder{}).AddUnsafe(text), opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	var cols []string
+	for tr := range ds.Tables() {
+		if tr.Err() != nil {
+			return nil, tr.Err()
+		}
+		t := tr.Table()
+		name, typ := -1, -1
+		for i, c := range t.Columns() {
+			switch c.Name() {
+			case "ColumnName":
+				name = i
+			case "ColumnType":
+				typ = i
+			}
+		}
+		for rr := range t.Rows() {
+			if rr.Err() != nil {
+				return nil, rr.Err()
+			}
+			if t.Kind() != "PrimaryResult" || name < 0 || typ < 0 {
+				continue
+			}
+			vals := rr.Row().Values()
+			cols = append(cols, fmt.Sprintf("%v: %v", encode.PlainValue(vals[name]), encode.PlainValue(vals[typ])))
+		}
+	}
+	return cols, nil
+}
+
+// runDryRun validates the query and prints the result's columns, or the error and where in the
+// query it is, exiting non-zero. prefix is the text sent ahead of query (parameter declarations,
+// the session prelude, inline data), which the cluster counts in its line numbers.
+func runDryRun(client *azkustodata.Client, database, prefix, query string, timeouts timeoutConfig, opts []azkustodata.QueryOption) {
+	ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+	start := time.Now()
+	cols, err := validateQuery(ctx, client, database, prefix+query, opts...)
+	cancel()
+	if err != nil {
+		fmt.Printf("FAIL dry-run (%dms): validation failed: %s\n", time.Since(start).Milliseconds(), errText(err))
+		printQueryPosition(os.Stdout, prefix, query, err)
+		printRunbook(os.Stdout, "query", err)
+		os.Exit(1)
+	}
+	okTimed("dry-run", time.Since(start), fmt.Sprintf("the query is valid and returns %d columns (not run)", len(cols)))
+	for _, c := range cols {
+		fmt.Printf("  %s\n", c)
+	}
+}
+
+// printQueryPosition prints the line of the query an error points at, with a caret under the
+// position, numbering lines from the start of query rather than of everything sent. Errors in
+// the prefix are shown with their line in it.
+func printQueryPosition(w io.Writer, prefix, query string, err error) {
+	line, pos, ok := classify.Position(err)
+	sent := strings.Split(prefix+query, "\n")
+	if !ok || line < 1 || line > len(sent) {
+		return
+	}
+	text := []rune(sent[line-1])
+	where, n := "query", line-strings.Count(prefix, "\n")
+	if n == 1 {
+		// The query's first line may follow the end of the prefix on the same line.
+		head := prefix[strings.LastIndexByte(prefix, '\n')+1:]
+		if pos < len([]rune(head)) {
+			where, n = "prelude", line
+		}
+	}
+	if n < 1 {
+		where, n = "prelude", line
+	}
+	if pos > len(text) {
+		pos = len(text)
+	}
+	col := pos
+	if where == "query" && n == 1 {
+		col -= len([]rune(prefix[strings.LastIndexByte(prefix, '\n')+1:]))
+	}
+	// Keep tabs under tabs so the caret lines up however the terminal expands them.
+	caret := []rune(strings.Repeat(" ", pos))
+	for i, r := range text[:pos] {
+		if r == '\t' {
+			caret[i] = '\t'
+		}
+	}
+	fmt.Fprintf(w, "  at %s line %d, column %d:\n    %s\n    %s^\n", where, n, col+1, string(text), string(caret))
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPrintQueryPosition(t *testing.T) {
+	prefix := "declare query_parameters(state:string);\n"
+	query := "StormEvents\n| where\tStat == state"
+	var buf bytes.Buffer
+	printQueryPosition(&buf, prefix, query, errors.New("Failed to resolve scalar expression named 'Stat' [line:position=3:8]"))
+	want := "  at query line 2, column 9:\n    | where\tStat == state\n           \t^\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%q\nwant:\n%q", buf.String(), want)
+	}
+
+	buf.Reset()
+	printQueryPosition(&buf, prefix, query, errors.New("Syntax error [line:position=1:8]"))
+	if want := "  at prelude line 1, column 9:\n"; !bytes.HasPrefix(buf.Bytes(), []byte(want)) {
+		t.Errorf("an error in the prefix: got %q", buf.String())
+	}
+}
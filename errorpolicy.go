@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Error policies for subcommands that run a batch of steps (probe steps, report sections, plan
+// commands). Whatever the policy, the run exits non-zero if any step failed; the policy only
+// decides how many steps run first.
+const (
+	policyFailFast  = "fail-fast" // stop at the first failure
+	policyContinue  = "continue"  // run every step, then report all failures
+	policyThreshold = "threshold" // threshold=N: keep going until more than N steps failed
+)
+
+// errorPolicy implements flag.Value for "fail-fast", "continue" or "threshold=N". The zero
+// value is unset.
+type errorPolicy struct {
+	mode string
+	max  int
+}
+
+func (p *errorPolicy) String() string {
+	if p.mode == policyThreshold {
+		return fmt.Sprintf("%s=%d", policyThreshold, p.max)
+	}
+	return p.mode
+}
+
+func (p *errorPolicy) Set(s string) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == policyFailFast || s == policyContinue:
+		*p = errorPolicy{mode: s}
+	case strings.HasPrefix(s, policyThreshold+"="):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, policyThreshold+"="))
+		if err != nil || n < 0 {
+			return fmt.Errorf("threshold wants a failure count, got %q", s)
+		}
+		*p = errorPolicy{mode: policyThreshold, max: n}
+	default:
+		return fmt.Errorf("unknown error policy %q (want fail-fast, continue or threshold=N)", s)
+	}
+	return nil
+}
+
+// maxFailures is the number of failed steps after which a batch stops; 0 means never.
+func (p errorPolicy) maxFailures() int {
+	switch p.mode {
+	case policyContinue:
+		return 0
+	case policyThreshold:
+		return p.max + 1
+	}
+	return 1
+}
+
+func registerErrorPolicyFlag(fs *flag.FlagSet) *errorPolicy {
+	p := &errorPolicy{}
+	fs.Var(p, "error-policy", "when a step of a batch fails: fail-fast|continue|threshold=N (stop once more than N steps failed)")
+	return p
+}
+
+// globalErrorPolicy is the --error-policy given before the subcommand.
+var globalErrorPolicy = &errorPolicy{}
+
+// resolveErrorPolicy picks the subcommand's --error-policy, then the global one, then
+// KUSTO_ERROR_POLICY, then the subcommand's default.
+func resolveErrorPolicy(sub *errorPolicy, def string) errorPolicy {
+	var p errorPolicy
+	if v := strings.TrimSpace(os.Getenv("KUSTO_ERROR_POLICY")); v != "" {
+		if err := p.Set(v); err != nil {
+			fmt.Fprintf(os.Stderr, "ignoring KUSTO_ERROR_POLICY: %v\n", err)
+		}
+	}
+	for _, f := range []*errorPolicy{globalErrorPolicy, sub} {
+		if f != nil && f.mode != "" {
+			p = *f
+		}
+	}
+	if p.mode == "" {
+		p.Set(def)
+	}
+	return p
+}
+
+// batch counts the outcomes of a subcommand's steps under an error policy, for the summary line
+// every batch subcommand ends with.
+type batch struct {
+	name     string
+	policy   errorPolicy
+	steps    int // how many steps the batch has; 0 if that isn't known up front
+	ok       int
+	failures []string
+	errs     []error // by failure, for runbooks
+}
+
+func newBatch(name string, policy errorPolicy, steps int) *batch {
+	return &batch{name: name, policy: policy, steps: steps}
+}
+
+// done records the outcome of a step and reports whether the policy stops the batch.
+func (b *batch) done(step string, err error) (stop bool) {
+	if err == nil {
+		b.ok++
+		return false
+	}
+	b.failures = append(b.failures, step+": "+errText(err))
+	b.errs = append(b.errs, err)
+	max := b.policy.maxFailures()
+	return max > 0 && len(b.failures) >= max
+}
+
+// err returns nil if every step that ran passed.
+func (b *batch) err() error {
+	if len(b.failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d steps failed", len(b.failures), b.total())
+}
+
+func (b *batch) total() int {
+	if b.steps == 0 {
+		return b.ok + len(b.failures)
+	}
+	return b.steps
+}
+
+// printFailures prints a FAIL line per failed step, for subcommands that don't report steps as
+// they run.
+func (b *batch) printFailures(w io.Writer) {
+	for i, f := range b.failures {
+		fmt.Fprintf(w, "FAIL %s\n", f)
+		step, _, _ := strings.Cut(f, ": ")
+		printRunbook(w, step, b.errs[i])
+	}
+}
+
+// summary prints the batch's SUMMARY line. Steps that neither passed nor failed were skipped,
+// by a dependency or by the policy stopping the batch; without a known step count, skipped
+// steps aren't counted.
+func (b *batch) summary(w io.Writer) {
+	var s runSummary
+	s.add("batch", b.name)
+	s.add("policy", b.policy.String())
+	s.add("steps", b.total())
+	s.add("ok", b.ok)
+	s.add("failed", len(b.failures))
+	if b.steps > 0 {
+		s.add("skipped", b.steps-b.ok-len(b.failures))
+	}
+	s.print(w)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestErrorPolicy(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want int // maxFailures; -1 for a parse error
+	}{
+		{"fail-fast", 1},
+		{"continue", 0},
+		{"threshold=0", 1},
+		{"threshold=3", 4},
+		{"threshold=-1", -1},
+		{"threshold", -1},
+		{"ignore", -1},
+	} {
+		var p errorPolicy
+		err := p.Set(c.in)
+		if c.want < 0 {
+			if err == nil {
+				t.Errorf("Set(%q) accepted", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q): %v", c.in, err)
+			continue
+		}
+		if got := p.maxFailures(); got != c.want {
+			t.Errorf("Set(%q).maxFailures() = %d, want %d", c.in, got, c.want)
+		}
+		if p.String() != c.in {
+			t.Errorf("Set(%q).String() = %q", c.in, p.String())
+		}
+	}
+}
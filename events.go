@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// eventPrinter returns an event handler for --events that writes each progress event to w as
+// one JSON line, e.g. {"event":"rows_emitted","time":"...","data":{"table":"PrimaryResult","n":1000,"total":3000}}.
+func eventPrinter(w io.Writer) func(stream.Event) {
+	var mu sync.Mutex
+	return func(e stream.Event) {
+		var runbook string
+		if f, ok := e.(stream.Failed); ok {
+			runbook = runbooks.url(f.Err)
+		}
+		b, err := json.Marshal(struct {
+			Event   string       `json:"event"`
+			Time    time.Time    `json:"time"`
+			Data    stream.Event `json:"data"`
+			Runbook string       `json:"runbook,omitempty"` // see KUSTO_RUNBOOKS
+		}{e.Name(), time.Now().UTC(), e, runbook})
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintln(w, string(b))
+	}
+}
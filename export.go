@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// exportCheckpoint is the progress of a paged export, kept next to --out while it runs: the
+// query and page size it is for, and how far --out is complete. It is written after each page
+// and removed once the export is done.
+type exportCheckpoint struct {
+	Cluster  string    `json:"cluster"`
+	Database string    `json:"database"`
+	Query    string    `json:"query"`
+	Format   string    `json:"format"`
+	PageSize int       `json:"page_size"`
+	Cursor   string    `json:"cursor,omitempty"` // with --pin-cursor, the cursor every page reads up to
+	NextPage int       `json:"next_page"`
+	Rows     int64     `json:"rows"`
+	Bytes    int64     `json:"bytes"` // the length of --out after the last complete page
+	Updated  time.Time `json:"updated"`
+}
+
+// exportFormats are the formats a page can be appended in: one line per row.
+var exportFormats = map[string]bool{"csv": true, "ndjson": true, "ndjson-typed": true}
+
+// pagedExport writes a query's result to a local file a page at a time, keeping a checkpoint so
+// an interrupted export resumes at the page it was writing.
+type pagedExport struct {
+	out        string
+	checkpoint string
+	cp         exportCheckpoint
+	timeouts   timeoutConfig
+	run        func(ctx context.Context, query string, enc encode.Encoder) (int64, error)
+}
+
+// resume loads the checkpoint, if there is one. It must be for the same export: a checkpoint of
+// another query, database, format or page size is an error, not something to overwrite.
+func (e *pagedExport) resume() (bool, error) {
+	data, err := os.ReadFile(e.checkpoint)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var cp exportCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return false, fmt.Errorf("invalid checkpoint %s: %v", e.checkpoint, err)
+	}
+	if cp.Database != e.cp.Database || cp.Query != e.cp.Query || cp.Format != e.cp.Format || cp.PageSize != e.cp.PageSize {
+		return false, fmt.Errorf("checkpoint %s is for another export (%s, page size %d, %s); remove it or pass --restart", e.checkpoint, cp.Database, cp.PageSize, cp.Format)
+	}
+	e.cp = cp
+	return true, nil
+}
+
+// export writes the pages from e.cp.NextPage on, until a page comes back short.
+func (e *pagedExport) export(ctx context.Context) error {
+	f, err := os.OpenFile(e.out, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Whatever follows the last complete page is a page that was cut short; it is written again.
+	if st, err := f.Stat(); err != nil {
+		return err
+	} else if st.Size() < e.cp.Bytes {
+		return fmt.Errorf("%s has %d bytes, but the checkpoint says %d were written; remove the checkpoint to start over", e.out, st.Size(), e.cp.Bytes)
+	}
+	if err := f.Truncate(e.cp.Bytes); err != nil {
+		return err
+	}
+	if _, err := f.Seek(e.cp.Bytes, io.SeekStart); err != nil {
+		return err
+	}
+	query := e.cp.Query
+	if e.cp.Cursor != "" {
+		query = cursorQuery(query, "", e.cp.Cursor)
+	}
+	for {
+		page := e.cp.NextPage
+		paged, _, err := pageQuery(query, e.cp.PageSize, page)
+		if err != nil {
+			return err
+		}
+		var w io.Writer = f
+		if page > 1 && e.cp.Format == "csv" {
+			w = &skipFirstLine{w: f}
+		}
+		enc, err := encode.New(e.cp.Format, w, encode.Options{})
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		callCtx, cancel := e.timeouts.callContext(ctx, callQuery)
+		rows, err := e.run(callCtx, paged, encode.PrimaryOnly{Encoder: enc})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("page %d: %w", page, err)
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if e.cp.Bytes, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		e.cp.Rows += rows
+		e.cp.NextPage++
+		e.cp.Updated = time.Now().UTC()
+		fmt.Fprintf(os.Stderr, "PAGE %d (%dms): %d rows, %d in total\n", page, time.Since(start).Milliseconds(), rows, e.cp.Rows)
+		if rows < int64(e.cp.PageSize) {
+			if err := os.Remove(e.checkpoint); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		if err := e.save(); err != nil {
+			return fmt.Errorf("checkpoint: %w", err)
+		}
+	}
+}
+
+// save replaces the checkpoint file in one rename, so a crash leaves the old one or the new one.
+func (e *pagedExport) save() error {
+	b, _ := json.MarshalIndent(e.cp, "", "  ")
+	tmp := e.checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.checkpoint)
+}
+
+// skipFirstLine drops everything up to and including the first line break: the CSV header of
+// every page after the first.
+type skipFirstLine struct {
+	w    io.Writer
+	done bool
+}
+
+func (s *skipFirstLine) Write(p []byte) (int, error) {
+	n := len(p)
+	if !s.done {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			return n, nil
+		}
+		s.done, p = true, p[i+1:]
+	}
+	if _, err := s.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// runExport implements "export --out <file> [cluster]": the query's primary result written to a
+// local file, and with --paged a page at a time with a checkpoint to resume from.
+func runExport(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	queryText := fs.String("query", os.Getenv("KUSTO_QUERY"), "query to export (default KUSTO_QUERY)")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database the query runs in")
+	out := fs.String("out", "", "local file to write")
+	format := fs.String("format", "csv", "output format: csv|ndjson|ndjson-typed")
+	paged := fs.Bool("paged", false, "fetch the result a page at a time, keeping a checkpoint to resume an interrupted export from")
+	pageSize := fs.Int("page-size", 100000, "with --paged: rows per page")
+	checkpoint := fs.String("checkpoint", "", "with --paged: checkpoint file (default <out>.checkpoint.json)")
+	restart := fs.Bool("restart", false, "with --paged: ignore an existing checkpoint and start over")
+	pinCursor := fs.Bool("pin-cursor", false, "with --paged: read every page up to the database cursor current at the start, so rows ingested meanwhile don't shift the pages (needs a table query and the IngestionTime policy)")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	query := strings.TrimRight(strings.TrimSpace(*queryText), ";")
+	switch {
+	case query == "":
+		log.Fatalf("export: --query (or KUSTO_QUERY) is required")
+	case *out == "" || strings.Contains(*out, "://"):
+		log.Fatalf("export: --out must be a local file, which pages are appended to")
+	case !exportFormats[*format]:
+		log.Fatalf("export: --format must be csv, ndjson or ndjson-typed, whose pages can be appended")
+	case *pageSize < 1:
+		log.Fatalf("export: --page-size must be at least 1")
+	}
+	if *checkpoint == "" {
+		*checkpoint = *out + ".checkpoint.json"
+	}
+
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	globalRequest.checkServerTimeout(timeouts, callQuery)
+	run := func(ctx context.Context, query string, enc encode.Encoder) (int64, error) {
+		id, opts := globalRequest.callOptions("export")
+		rows, err := stream.Query(ctx, client, *database, (&kql.Builder{}).AddUnsafe(query), enc, opts...)
+		return rows, withRequestID(err, id)
+	}
+
+	if !*paged {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("export: %v", err)
+		}
+		enc, err := encode.New(*format, f, encode.Options{})
+		if err != nil {
+			log.Fatalf("export: %v", err)
+		}
+		ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+		defer cancel()
+		rows, err := run(ctx, query, encode.PrimaryOnly{Encoder: enc})
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			log.Fatalf("export: %s", errText(err))
+		}
+		fmt.Fprintf(os.Stderr, "EXPORT %s: %d rows\n", *out, rows)
+		return
+	}
+
+	e := &pagedExport{out: *out, checkpoint: *checkpoint, timeouts: timeouts, run: run,
+		cp: exportCheckpoint{Cluster: cluster, Database: *database, Query: query, Format: *format, PageSize: *pageSize, NextPage: 1}}
+	resumed := false
+	if !*restart {
+		if resumed, err = e.resume(); err != nil {
+			log.Fatalf("export: %v", err)
+		}
+	}
+	if resumed {
+		fmt.Fprintf(os.Stderr, "EXPORT %s: resuming at page %d after %d rows\n", *out, e.cp.NextPage, e.cp.Rows)
+	} else {
+		if _, ordered, _ := pageQuery(query, *pageSize, 1); !ordered {
+			fmt.Fprintln(os.Stderr, "WARN export --paged: the query has no final order by/sort by/top, so pages may overlap or skip rows")
+		}
+		if *pinCursor {
+			ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+			e.cp.Cursor, err = currentCursor(ctx, client, *database)
+			cancel()
+			if err != nil {
+				log.Fatalf("export: cursor_current(): %s", errText(err))
+			}
+		}
+		if err := e.save(); err != nil {
+			log.Fatalf("export: checkpoint: %v", err)
+		}
+	}
+	if err := e.export(context.Background()); err != nil {
+		log.Fatalf("export: %s (the checkpoint %s resumes at page %d)", errText(err), e.checkpoint, e.cp.NextPage)
+	}
+	fmt.Fprintf(os.Stderr, "EXPORT %s: %d rows in %d pages\n", *out, e.cp.Rows, e.cp.NextPage-1)
+}
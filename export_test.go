@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestPagedExport(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "storms.csv")
+	const total = 25
+	failPage := 3
+	var queries []string
+	run := func(ctx context.Context, q string, enc encode.Encoder) (int64, error) {
+		queries = append(queries, q)
+		var first, last int
+		if _, err := fmt.Sscanf(q[strings.Index(q, "between ("):], "between (%d .. %d)", &first, &last); err != nil {
+			t.Fatalf("page query %q: %v", q, err)
+		}
+		tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "n", types.Long)}}
+		if err := enc.Begin(tbl); err != nil {
+			return 0, err
+		}
+		var rows int64
+		for n := first; n <= last && n <= total; n++ {
+			if n == first+2 && first/10+1 == failPage {
+				enc.End() // the rows so far reach the file before the failure
+				return rows, errors.New("connection reset")
+			}
+			if err := enc.WriteRow(tbl, int(rows), value.Values{value.NewLong(int64(n))}); err != nil {
+				return rows, err
+			}
+			rows++
+		}
+		return rows, enc.End()
+	}
+	newExport := func() *pagedExport {
+		return &pagedExport{out: out, checkpoint: out + ".checkpoint.json", timeouts: resolveTimeouts(nil, nil, time.Minute), run: run,
+			cp: exportCheckpoint{Database: "db", Query: "StormEvents | order by EventId", Format: "csv", PageSize: 10, NextPage: 1}}
+	}
+
+	e := newExport()
+	if resumed, err := e.resume(); err != nil || resumed {
+		t.Fatalf("first run resumed: %v %v", resumed, err)
+	}
+	if err := e.export(context.Background()); err == nil || !strings.Contains(err.Error(), "page 3") {
+		t.Fatalf("export = %v, want a failure on page 3", err)
+	}
+
+	failPage = 0
+	e = newExport()
+	if resumed, err := e.resume(); err != nil || !resumed || e.cp.NextPage != 3 || e.cp.Rows != 20 {
+		t.Fatalf("resume: %v %v %+v", resumed, err, e.cp)
+	}
+	queries = nil
+	if err := e.export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 || !strings.Contains(queries[0], "between (21 .. 30)") {
+		t.Errorf("resumed with %q", queries)
+	}
+	want := "n\r\n"
+	for n := 1; n <= total; n++ {
+		want += fmt.Sprintf("%d\r\n", n)
+	}
+	if got, _ := os.ReadFile(out); string(got) != want {
+		t.Errorf("%s:\n%q\nwant:\n%q", out, got, want)
+	}
+	if _, err := os.Stat(e.checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left behind: %v", err)
+	}
+
+	// A checkpoint of another export isn't taken over.
+	e.cp.NextPage = 2
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+	other := newExport()
+	other.cp.PageSize = 50
+	if _, err := other.resume(); err == nil || !strings.Contains(err.Error(), "another export") {
+		t.Errorf("resume of another export: %v", err)
+	}
+}
+
+func TestSkipFirstLine(t *testing.T) {
+	var b strings.Builder
+	w := &skipFirstLine{w: &b}
+	for _, s := range []string{"col", "umn\r", "\n1\r\n", "2\r\n"} {
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if b.String() != "1\r\n2\r\n" {
+		t.Errorf("got %q", b.String())
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// externalSampleRows is how many rows of an --external-data file column types are inferred from.
+// Values the inferred type can't hold come back as nulls, so pin types ("Name:type") when the
+// head of the file isn't representative.
+const externalSampleRows = 1000
+
+// maxExternalBytes is the largest file one Put Blob request accepts.
+const maxExternalBytes = 5000 << 20
+
+// sasVersion is the storage service version the SAS tokens are signed for.
+const sasVersion = "2021-08-06"
+
+// scratchContainer is the blob container --external-data uploads to, from KUSTO_SCRATCH_CONTAINER
+// (https://<account>.blob.core.windows.net/<container>[/<prefix>]). With AZURE_STORAGE_KEY it
+// signs with the account key; otherwise it signs in with DefaultAzureCredential, which needs
+// Storage Blob Data Contributor on the container, and mints user delegation SAS tokens.
+type scratchContainer struct {
+	base      string // https://<account>.blob.core.windows.net
+	account   string
+	container string
+	prefix    string
+	key       []byte
+	cred      azcore.TokenCredential
+	delegated *userDelegationKey
+	client    *http.Client
+}
+
+func newScratchContainer(location string) (*scratchContainer, error) {
+	return newBlobContainer("KUSTO_SCRATCH_CONTAINER", location)
+}
+
+// newBlobContainer opens a container given by setting (a flag or variable name, for errors).
+func newBlobContainer(setting, location string) (*scratchContainer, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%s %q: expected https://<account>.blob.core.windows.net/<container>[/<prefix>]", setting, location)
+	}
+	container, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if container == "" {
+		return nil, fmt.Errorf("%s %q: no container", setting, location)
+	}
+	s := &scratchContainer{
+		base:      "https://" + u.Host,
+		account:   strings.Split(u.Hostname(), ".")[0],
+		container: container,
+		prefix:    prefix,
+		client:    &http.Client{},
+	}
+	if k := os.Getenv("AZURE_STORAGE_KEY"); k != "" {
+		if s.key, err = base64.StdEncoding.DecodeString(k); err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY is not base64: %v", err)
+		}
+		return s, nil
+	}
+	if s.cred, err = azidentity.NewDefaultAzureCredential(nil); err != nil {
+		return nil, fmt.Errorf("%s: %v (or set AZURE_STORAGE_KEY)", setting, err)
+	}
+	return s, nil
+}
+
+// newBlobName names a fresh blob under the prefix, unique per run.
+func (s *scratchContainer) newBlobName(path string) string {
+	var r [4]byte
+	rand.Read(r[:])
+	name := fmt.Sprintf("externaldata/%s-%s/%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(r[:]), filepath.Base(path))
+	if s.prefix != "" {
+		name = s.prefix + "/" + name
+	}
+	return name
+}
+
+func (s *scratchContainer) blobURL(name string) string {
+	segs := strings.Split(name, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return s.base + "/" + url.PathEscape(s.container) + "/" + strings.Join(segs, "/")
+}
+
+// upload writes the file as a block blob in a single request.
+func (s *scratchContainer) upload(ctx context.Context, name string, f *os.File, size int64, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.blobURL(name), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("Content-Type", contentType)
+	return s.do(req, name, "cw")
+}
+
+// remove deletes a blob; --external-data calls it once the query is done.
+func (s *scratchContainer) remove(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.blobURL(name), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, name, "d")
+}
+
+// do authorizes req (a SAS with perms under the account key, a bearer token otherwise) and sends
+// it. A non-2xx answer is a *blobError.
+func (s *scratchContainer) do(req *http.Request, name, perms string) error {
+	req.Header.Set("x-ms-version", sasVersion)
+	if s.key != nil {
+		now := time.Now().UTC()
+		sas, err := s.sas(req.Context(), name, perms, now.Add(-5*time.Minute), now.Add(15*time.Minute))
+		if err != nil {
+			return err
+		}
+		if req.URL.RawQuery != "" {
+			sas = req.URL.RawQuery + "&" + sas
+		}
+		req.URL.RawQuery = sas
+	} else {
+		tok, err := s.cred.GetToken(req.Context(), policy.TokenRequestOptions{Scopes: []string{"https://storage.azure.com/.default"}})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok.Token)
+	}
+	_, err := sendStorage(s.client, req, s.blobURL(name))
+	return err
+}
+
+// sendStorage sends a request to a storage service and returns the answer's body. A non-2xx
+// answer is a *blobError naming target, the resource without its SAS.
+func sendStorage(client *http.Client, req *http.Request, target string) ([]byte, error) {
+	data, _, err := sendStorageHeader(client, req, target)
+	return data, err
+}
+
+// sendStorageHeader is sendStorage, also returning the answer's headers.
+func sendStorageHeader(client *http.Client, req *http.Request, target string) ([]byte, http.Header, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, nil, &blobError{Status: resp.StatusCode, Code: resp.Header.Get("x-ms-error-code"),
+			msg: fmt.Sprintf("%s %s: %s %s", req.Method, target, resp.Status, strings.TrimSpace(string(msg)))}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return data, resp.Header, err
+}
+
+// blobError is a non-2xx answer from a storage service (blobs, queues or tables).
+type blobError struct {
+	Status int
+	Code   string // x-ms-error-code, e.g. LeaseAlreadyPresent
+	msg    string
+}
+
+func (e *blobError) Error() string { return e.msg }
+
+// sas mints a SAS query string for one blob, valid from start to expiry and limited to perms.
+func (s *scratchContainer) sas(ctx context.Context, name, perms string, start, expiry time.Time) (string, error) {
+	const layout = "2006-01-02T15:04:05Z"
+	st, se := start.UTC().Format(layout), expiry.UTC().Format(layout)
+	resource := "/blob/" + s.account + "/" + s.container + "/" + name
+	v := url.Values{"sv": {sasVersion}, "sr": {"b"}, "sp": {perms}, "st": {st}, "se": {se}, "spr": {"https"}}
+	var toSign []string
+	key := s.key
+	if key == nil {
+		k, err := s.delegationKey(ctx, start, expiry)
+		if err != nil {
+			return "", err
+		}
+		if key, err = base64.StdEncoding.DecodeString(k.Value); err != nil {
+			return "", fmt.Errorf("user delegation key: %v", err)
+		}
+		v.Set("skoid", k.SignedOid)
+		v.Set("sktid", k.SignedTid)
+		v.Set("skt", k.SignedStart)
+		v.Set("ske", k.SignedExpiry)
+		v.Set("sks", k.SignedService)
+		v.Set("skv", k.SignedVersion)
+		toSign = []string{perms, st, se, resource, k.SignedOid, k.SignedTid, k.SignedStart, k.SignedExpiry,
+			k.SignedService, k.SignedVersion, "", "", "", "", "https", sasVersion, "b", "", "", "", "", "", "", ""}
+	} else {
+		toSign = []string{perms, st, se, resource, "", "", "https", sasVersion, "b", "", "", "", "", "", "", ""}
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(strings.Join(toSign, "\n")))
+	v.Set("sig", base64.StdEncoding.EncodeToString(m.Sum(nil)))
+	return v.Encode(), nil
+}
+
+type userDelegationKey struct {
+	SignedOid     string
+	SignedTid     string
+	SignedStart   string
+	SignedExpiry  string
+	SignedService string
+	SignedVersion string
+	Value         string
+}
+
+// delegationKey fetches a user delegation key covering start to expiry. A key is kept while it
+// covers the expiry asked for, and is fetched to last a day longer where the service's 7 day
+// limit allows, so a long run signing blob after blob doesn't fetch one per SAS.
+func (s *scratchContainer) delegationKey(ctx context.Context, start, expiry time.Time) (*userDelegationKey, error) {
+	if s.delegated != nil {
+		if until, err := time.Parse(time.RFC3339, s.delegated.SignedExpiry); err == nil && !until.Before(expiry) {
+			return s.delegated, nil
+		}
+	}
+	if longer := expiry.Add(24 * time.Hour); !longer.After(start.Add(7 * 24 * time.Hour)) {
+		expiry = longer
+	}
+	body := fmt.Sprintf("<?xml version=\"1.0\" encoding=\"utf-8\"?><KeyInfo><Start>%s</Start><Expiry>%s</Expiry></KeyInfo>",
+		start.UTC().Format("2006-01-02T15:04:05Z"), expiry.UTC().Format("2006-01-02T15:04:05Z"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/?restype=service&comp=userdelegationkey", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	tok, err := s.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://storage.azure.com/.default"}})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.Token)
+	req.Header.Set("x-ms-version", sasVersion)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("user delegation key: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var k userDelegationKey
+	if err := xml.NewDecoder(bytes.NewReader(data)).Decode(&k); err != nil {
+		return nil, fmt.Errorf("user delegation key: %v", err)
+	}
+	s.delegated = &k
+	return &k, nil
+}
+
+// externalDataTable uploads a CSV or TSV file to the scratch container and returns a let
+// statement binding it as name through externaldata(), with a read-only SAS valid for ttl, and
+// the blob's name so the caller can remove it after the query. Column names and types come from
+// columnSchema over the first externalSampleRows rows.
+func externalDataTable(ctx context.Context, s *scratchContainer, path, name string, ttl time.Duration) (let, blob string, err error) {
+	f, r, header, err := openDelimited(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if fi.Size() > maxExternalBytes {
+		return "", "", fmt.Errorf("%s is %s; --external-data is limited to %s, ingest larger files into a table", path, formatBytes(fi.Size()), formatBytes(maxExternalBytes))
+	}
+	rows, err := readDelimited(path, r, externalSampleRows)
+	if err != nil {
+		return "", "", err
+	}
+	names, typs, err := columnSchema(path, header, rows)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+
+	format, ctype := delimitedFormat(path), "text/csv"
+	if format == "tsv" {
+		ctype = "text/tab-separated-values"
+	}
+	blob = s.newBlobName(path)
+	if err := s.upload(ctx, blob, f, fi.Size(), ctype); err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	sas, err := s.sas(ctx, blob, "r", now.Add(-5*time.Minute), now.Add(ttl))
+	if err != nil {
+		return "", blob, err
+	}
+	return externalDataLet(name, names, typs, format, s.blobURL(blob)+"?"+sas), blob, nil
+}
+
+// externalDataLet renders the let statement. The URL is an obfuscated string literal (h"...") so
+// the SAS stays out of the cluster's query logs.
+func externalDataLet(name string, names, typs []string, format, url string) string {
+	cols := make([]string, len(names))
+	for i := range names {
+		cols[i] = kqlquote.Ident(names[i]) + ":" + typs[i]
+	}
+	return fmt.Sprintf("let %s = externaldata(%s) [h%s] with (format=%s, ignoreFirstRecord=true);\n",
+		kqlquote.Ident(name), strings.Join(cols, ", "), kqlquote.String(url), kqlquote.String(format))
+}
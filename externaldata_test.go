@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExternalDataLet(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "regions.csv")
+	if err := os.WriteFile(path, []byte("Region,Weight,Code:string\nwest,1.5,01\neast,2,02\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, r, header, err := openDelimited(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := readDelimited(path, r, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("read %d rows, want 1", len(rows))
+	}
+	names, typs, err := columnSchema(path, header, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := externalDataLet("Regions", names, typs, delimitedFormat(path), "https://acct.blob.core.windows.net/scratch/x.csv?sig=a%2Bb")
+	want := `let ['Regions'] = externaldata(['Region']:string, ['Weight']:real, ['Code']:string) [h"https://acct.blob.core.windows.net/scratch/x.csv?sig=a%2Bb"] with (format="csv", ignoreFirstRecord=true);` + "\n"
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestScratchContainerSAS(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+	s, err := newScratchContainer("https://acct.blob.core.windows.net/scratch/team/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.account != "acct" || s.container != "scratch" || s.prefix != "team" {
+		t.Fatalf("parsed %+v", s)
+	}
+	blob := s.newBlobName("/tmp/my data.csv")
+	if !strings.HasPrefix(blob, "team/externaldata/") || !strings.HasSuffix(blob, "/my data.csv") {
+		t.Errorf("blob name %q", blob)
+	}
+	if u := s.blobURL(blob); !strings.HasSuffix(u, "/my%20data.csv") {
+		t.Errorf("blob URL %q", u)
+	}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	sas, err := s.sas(context.Background(), blob, "r", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := url.ParseQuery(sas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"sp": "r", "sr": "b", "spr": "https", "st": "2026-01-02T03:04:05Z", "se": "2026-01-02T04:04:05Z"} {
+		if v.Get(k) != want {
+			t.Errorf("%s = %q, want %q", k, v.Get(k), want)
+		}
+	}
+	if v.Get("sig") == "" || v.Get("skoid") != "" {
+		t.Errorf("account-key SAS %q", sas)
+	}
+	if _, err := newScratchContainer("acct/scratch"); err == nil {
+		t.Error("accepted a location without https://")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// The columns a fan-out run (--clusters, --databases) puts in front of every table, holding
+// where the row came from.
+const (
+	clusterField  = "_cluster"
+	databaseField = "_database"
+)
+
+// clusterTarget is one cluster of a --clusters run.
+type clusterTarget struct {
+	url    string
+	client *azkustodata.Client
+}
+
+// openClusters creates a client for each cluster of a comma-separated --clusters list of names
+// (in eastus, as for probe) or URIs. On error the clients already created are closed.
+func openClusters(list string) ([]clusterTarget, error) {
+	var targets []clusterTarget
+	seen := map[string]bool{}
+	for _, name := range splitCSV(list) {
+		url := name
+		if !strings.Contains(name, "://") {
+			url = resolveClusterURL(name)
+		}
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+		client, err := newClient(url)
+		if err != nil {
+			closeClusters(targets)
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		targets = append(targets, clusterTarget{url: url, client: client})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("--clusters lists no clusters")
+	}
+	return targets, nil
+}
+
+func closeClusters(targets []clusterTarget) {
+	for _, c := range targets {
+		c.client.Close()
+	}
+}
+
+// fanOutTarget is one query of a fan-out run: a database on a cluster. err is set instead of
+// database when the cluster's databases couldn't be listed; the target then counts as failed.
+type fanOutTarget struct {
+	cluster  string
+	client   *azkustodata.Client
+	database string
+	err      error
+}
+
+// fanOutTargets pairs every cluster with the databases to query on it: database when list is
+// empty, else the comma-separated --databases list. Entries with *, ? or [ are patterns, matched
+// against each cluster's .show databases.
+func fanOutTargets(clusters []clusterTarget, database, list string, timeouts timeoutConfig) ([]fanOutTarget, error) {
+	names := []string{database}
+	if list != "" {
+		if names = splitCSV(list); len(names) == 0 {
+			return nil, fmt.Errorf("--databases lists no databases")
+		}
+		for _, n := range names {
+			if _, err := path.Match(n, ""); err != nil {
+				return nil, fmt.Errorf("--databases %q: %v", n, err)
+			}
+		}
+	}
+	var targets []fanOutTarget
+	for _, c := range clusters {
+		dbs, err := resolveDatabases(c, names, timeouts)
+		if err != nil {
+			targets = append(targets, fanOutTarget{cluster: c.url, client: c.client, err: fmt.Errorf(".show databases: %w", err)})
+			continue
+		}
+		for _, db := range dbs {
+			targets = append(targets, fanOutTarget{cluster: c.url, client: c.client, database: db})
+		}
+	}
+	return targets, nil
+}
+
+// resolveDatabases expands the patterns among names with the cluster's databases, in the order
+// given, dropping duplicates. .show databases only runs when there is a pattern.
+func resolveDatabases(c clusterTarget, names []string, timeouts timeoutConfig) ([]string, error) {
+	var all []string
+	var out []string
+	seen := map[string]bool{}
+	for _, n := range names {
+		if !strings.ContainsAny(n, "*?[") {
+			if !seen[n] {
+				seen[n] = true
+				out = append(out, n)
+			}
+			continue
+		}
+		if all == nil {
+			var err error
+			if all, err = showDatabases(c.client, timeouts); err != nil {
+				return nil, err
+			}
+		}
+		matched := false
+		for _, db := range all {
+			if ok, _ := path.Match(n, db); ok {
+				matched = true
+				if !seen[db] {
+					seen[db] = true
+					out = append(out, db)
+				}
+			}
+		}
+		if !matched {
+			fmt.Fprintf(os.Stderr, "WARN --databases: no database on %s matches %q\n", c.url, n)
+		}
+	}
+	return out, nil
+}
+
+// showDatabases lists the databases of a cluster the caller can see, sorted.
+func showDatabases(client *azkustodata.Client, timeouts timeoutConfig) ([]string, error) {
+	ctx, cancel := timeouts.callContext(context.Background(), callMgmt)
+	defer cancel()
+	ds, err := client.Mgmt(ctx, "NetDefaultDB", kql.New(".show databases"))
+	if err != nil {
+		return nil, err
+	}
+	all := []string{} // not nil, so an empty cluster isn't listed again
+	if tables := ds.Tables(); len(tables) > 0 {
+		for _, row := range tables[0].Rows() {
+			if v, err := row.ValueByName("DatabaseName"); err == nil {
+				all = append(all, fmt.Sprint(encode.PlainValue(v)))
+			}
+		}
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+// queryFanOut runs query against every target, at most workers at a time. Each target's result
+// is held in memory until its query has finished and is then written to out with fields (some
+// of _cluster and _database) in front; a table with the same name and columns as the one written
+// before it continues that table, so the targets' rows of one query end up together. A failed
+// target doesn't stop the others unless policy says so: its rows are dropped, an OK line is
+// printed per target as it finishes and the failures are listed at the end. out is ended either
+// way, so the rows of the targets that answered are kept.
+func queryFanOut(targets []fanOutTarget, fields []string, workers int, policy errorPolicy, out encode.Encoder, query func(t fanOutTarget, enc encode.Encoder) (int64, error)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	merge := &fanOutMerge{out: out}
+	b := newBatch("fan-out", policy, len(targets))
+	var mu sync.Mutex // guards b and stop
+	stop := false
+	next := make(chan fanOutTarget)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(targets); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range next {
+				start := time.Now()
+				var rows int64
+				err := t.err
+				if err == nil {
+					rows, err = query(t, &fanOutBuffer{fields: fields, tags: t.tags(fields), merge: merge})
+				}
+				d := time.Since(start)
+				step := t.step(fields)
+				mu.Lock()
+				if err == nil {
+					fmt.Fprintf(os.Stderr, "OK %s (%dms): %d rows\n", step, d.Milliseconds(), rows)
+				}
+				if b.done(step, err) {
+					stop = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, t := range targets {
+		mu.Lock()
+		stopped := stop
+		mu.Unlock()
+		if stopped {
+			break
+		}
+		next <- t
+	}
+	close(next)
+	wg.Wait()
+
+	err := out.End()
+	b.printFailures(os.Stderr)
+	b.summary(os.Stderr)
+	if err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return b.err()
+}
+
+// tags returns the values of fields for the target's rows.
+func (t fanOutTarget) tags(fields []string) value.Values {
+	tags := make(value.Values, len(fields))
+	for i, f := range fields {
+		if f == clusterField {
+			tags[i] = value.NewString(t.cluster)
+		} else {
+			tags[i] = value.NewString(t.database)
+		}
+	}
+	return tags
+}
+
+// step names the target in status lines: "cluster <url>", "database <db>" or both.
+func (t fanOutTarget) step(fields []string) string {
+	var parts []string
+	for _, f := range fields {
+		switch {
+		case f == clusterField:
+			parts = append(parts, "cluster "+t.cluster)
+		case t.err == nil:
+			parts = append(parts, "database "+t.database)
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "cluster "+t.cluster) // a --databases run whose listing failed
+	}
+	return strings.Join(parts, " ")
+}
+
+// fanOutBuffer is the encoder a target's query writes to: it keeps the tables with the fields
+// added, and hands them to the merge when the result is complete.
+type fanOutBuffer struct {
+	fields []string
+	tags   value.Values
+	merge  *fanOutMerge
+	tables []*fanOutTable
+}
+
+type fanOutTable struct {
+	table *encode.Table
+	rows  []value.Values
+}
+
+func (b *fanOutBuffer) Begin(t *encode.Table) error {
+	cols := make([]query.Column, 0, len(b.fields)+len(t.Columns))
+	for i, f := range b.fields {
+		cols = append(cols, query.NewColumn(i, f, types.String))
+	}
+	for i, c := range t.Columns {
+		cols = append(cols, query.NewColumn(len(b.fields)+i, c.Name(), c.Type()))
+	}
+	b.tables = append(b.tables, &fanOutTable{table: &encode.Table{Name: t.Name, Kind: t.Kind, Columns: cols}})
+	return nil
+}
+
+func (b *fanOutBuffer) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	ft := b.tables[len(b.tables)-1]
+	row := make(value.Values, 0, len(b.tags)+len(vals))
+	ft.rows = append(ft.rows, append(append(row, b.tags...), vals...))
+	return nil
+}
+
+func (b *fanOutBuffer) End() error {
+	err := b.merge.write(b.tables)
+	b.tables = nil
+	return err
+}
+
+// fanOutMerge writes the results of the targets to the shared encoder, one at a time.
+type fanOutMerge struct {
+	mu   sync.Mutex
+	out  encode.Encoder
+	last *encode.Table // the table out is writing
+	rows int           // rows written to last so far
+}
+
+func (m *fanOutMerge) write(tables []*fanOutTable) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ft := range tables {
+		if m.last == nil || !sameTable(m.last, ft.table) {
+			if err := m.out.Begin(ft.table); err != nil {
+				return err
+			}
+			m.last, m.rows = ft.table, 0
+		}
+		for _, vals := range ft.rows {
+			if err := m.out.WriteRow(m.last, m.rows, vals); err != nil {
+				return err
+			}
+			m.rows++
+		}
+	}
+	return nil
+}
+
+// sameTable reports whether a and b have the same name, kind and columns.
+func sameTable(a, b *encode.Table) bool {
+	if a.Name != b.Name || a.Kind != b.Kind || len(a.Columns) != len(b.Columns) {
+		return false
+	}
+	for i, c := range a.Columns {
+		if c.Name() != b.Columns[i].Name() || c.Type() != b.Columns[i].Type() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestQueryFanOut(t *testing.T) {
+	var buf bytes.Buffer
+	out, err := encode.New("csv", &buf, encode.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := []fanOutTarget{
+		{cluster: "https://a", database: "t1"}, {cluster: "https://a", database: "t2"},
+		{cluster: "https://b", database: "t1"}, {cluster: "https://c", err: errors.New("forbidden")},
+	}
+	table := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{testColumn{0, "State", types.String}}}
+	err = queryFanOut(targets, []string{clusterField, databaseField}, 2, errorPolicy{mode: policyContinue}, out, func(ft fanOutTarget, enc encode.Encoder) (int64, error) {
+		if ft.cluster == "https://b" {
+			return 0, errors.New("unreachable")
+		}
+		enc.Begin(table)
+		enc.WriteRow(table, 0, value.Values{value.NewString("TX")})
+		enc.WriteRow(table, 1, value.Values{value.NewString("OK")})
+		return 2, enc.End()
+	})
+	if err == nil || !strings.Contains(err.Error(), "2 of 4") {
+		t.Fatalf("err = %v, want 2 of 4 steps failed", err)
+	}
+
+	// The answering targets' rows land in one table, tagged; the failed ones have none.
+	lines := strings.Fields(buf.String())
+	if len(lines) != 5 || lines[0] != "_cluster,_database,State" {
+		t.Fatalf("output:\n%s", buf.String())
+	}
+	got := map[string]int{}
+	for _, l := range lines[1:] {
+		i := strings.LastIndexByte(l, ',')
+		got[l[:i]]++
+	}
+	if got["https://a,t1"] != 2 || got["https://a,t2"] != 2 || len(got) != 2 {
+		t.Errorf("rows per target = %v", got)
+	}
+}
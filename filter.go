@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/rowexpr"
+)
+
+// filteringEncoder applies --filter and --columns to primary result tables on the client, on
+// the way to the wrapped Encoder: rows the filter is false for are dropped, and the rest keep
+// only the listed columns, in list order. A --columns entry is a column name, or a column name
+// followed by a path into a dynamic column (Payload.user.id, Tags[0]), which becomes a dynamic
+// column named after the entry holding just that part of the document. Kept rows are numbered
+// from 0 again. Other tables pass through unchanged.
+type filteringEncoder struct {
+	encode.Encoder
+	filter  *rowexpr.Expr // nil: keep every row
+	columns []string      // nil: keep every column
+	tables  map[*encode.Table]*filteredTable
+	dropped int64
+}
+
+type filteredTable struct {
+	out  *encode.Table
+	cols []projection // nil: every column
+	kept int
+}
+
+// projection is one output column: input column col, or the value at path in it.
+type projection struct {
+	col  int
+	path rowexpr.Path
+}
+
+func newFilteringEncoder(out encode.Encoder, filter *rowexpr.Expr, columns []string) *filteringEncoder {
+	return &filteringEncoder{Encoder: out, filter: filter, columns: columns, tables: map[*encode.Table]*filteredTable{}}
+}
+
+func (f *filteringEncoder) Begin(t *encode.Table) error {
+	if t.Kind != "PrimaryResult" {
+		return f.Encoder.Begin(t)
+	}
+	ft := &filteredTable{out: t}
+	if f.columns != nil {
+		var err error
+		if ft.cols, err = projectColumns(t.Columns, f.columns); err != nil {
+			return err
+		}
+		cols := make([]query.Column, len(ft.cols))
+		for i, p := range ft.cols {
+			c := t.Columns[p.col]
+			if p.path == nil {
+				cols[i] = query.NewColumn(i, c.Name(), c.Type())
+			} else {
+				cols[i] = query.NewColumn(i, f.columns[i], types.Dynamic)
+			}
+		}
+		ft.out = &encode.Table{Name: t.Name, Kind: t.Kind, Columns: cols}
+	}
+	f.tables[t] = ft
+	return f.Encoder.Begin(ft.out)
+}
+
+func (f *filteringEncoder) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	ft := f.tables[t]
+	if ft == nil {
+		return f.Encoder.WriteRow(t, index, vals)
+	}
+	if f.filter != nil && !f.filter.Match(rowMap(t, index, vals)) {
+		f.dropped++
+		return nil
+	}
+	if ft.cols != nil {
+		out := make(value.Values, len(ft.cols))
+		for i, p := range ft.cols {
+			if p.path == nil {
+				if p.col < len(vals) {
+					out[i] = vals[p.col]
+				}
+				continue
+			}
+			out[i] = dynamicAt(vals, p)
+		}
+		vals = out
+	}
+	index = ft.kept
+	ft.kept++
+	return f.Encoder.WriteRow(ft.out, index, vals)
+}
+
+// addTo adds how many rows the filter dropped to the run summary.
+func (f *filteringEncoder) addTo(s *runSummary) {
+	if f.filter != nil {
+		s.add("filtered_out", f.dropped)
+	}
+}
+
+// projectColumns resolves --columns entries against a table's columns. An entry that isn't a
+// column name is a path into the dynamic column its longest matching name prefix names.
+func projectColumns(cols []query.Column, entries []string) ([]projection, error) {
+	out := make([]projection, 0, len(entries))
+	for _, e := range entries {
+		best := -1
+		for i, c := range cols {
+			name := c.Name()
+			if name == e {
+				best = i
+				break
+			}
+			if strings.HasPrefix(e, name) && (e[len(name)] == '.' || e[len(name)] == '[') && (best < 0 || len(name) > len(cols[best].Name())) {
+				best = i
+			}
+		}
+		if best < 0 {
+			names := make([]string, len(cols))
+			for i, c := range cols {
+				names[i] = c.Name()
+			}
+			return nil, fmt.Errorf("--columns: no column %q (have %s)", e, strings.Join(names, ", "))
+		}
+		p := projection{col: best}
+		if rest := e[len(cols[best].Name()):]; rest != "" {
+			if cols[best].Type() != types.Dynamic {
+				return nil, fmt.Errorf("--columns %s: %s is %s, not dynamic", e, cols[best].Name(), cols[best].Type())
+			}
+			if rest[0] == '[' {
+				rest = "." + rest
+			}
+			path, err := rowexpr.ParsePath(rest)
+			if err != nil {
+				return nil, fmt.Errorf("--columns %s: %v", e, err)
+			}
+			p.path = path
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// rowMap is the row as the filter sees it: RowObject's keys, with plain Go values for every
+// column and dynamic columns decoded.
+func rowMap(t *encode.Table, index int, vals value.Values) map[string]interface{} {
+	obj := encode.RowObject(t, index, vals)
+	for i, c := range t.Columns {
+		if i < len(vals) && c.Type() != types.Dynamic {
+			obj[c.Name()] = encode.PlainValue(vals[i])
+		}
+	}
+	return obj
+}
+
+// dynamicAt is the part of the row's dynamic column at the projection's path, null if the column
+// is null, not JSON, or has nothing there.
+func dynamicAt(vals value.Values, p projection) value.Kusto {
+	raw, ok := encode.RowAt(vals).Dynamic(p.col)
+	if !ok {
+		return value.NewNullDynamic()
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc interface{}
+	if dec.Decode(&doc) != nil {
+		return value.NewNullDynamic()
+	}
+	v, ok := p.path.Lookup(doc)
+	if !ok {
+		return value.NewNullDynamic()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return value.NewNullDynamic()
+	}
+	return value.NewDynamic(b)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/rowexpr"
+)
+
+func TestFilteringEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	csv, err := encode.New("csv", &buf, encode.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := rowexpr.Parse(`.Payload.size > 100 and .State != "OHIO"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFilteringEncoder(csv, filter, []string{"Payload.user.id", "State", "Payload.tags[0]"})
+	table := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+		testColumn{0, "State", types.String}, testColumn{1, "Payload", types.Dynamic}, testColumn{2, "Count", types.Long}}}
+	rows := []value.Values{
+		{value.NewString("TEXAS"), value.NewDynamic([]byte(`{"size":500,"user":{"id":7},"tags":["a","b"]}`)), value.NewLong(1)},
+		{value.NewString("OHIO"), value.NewDynamic([]byte(`{"size":500,"user":{"id":8}}`)), value.NewLong(2)},
+		{value.NewString("UTAH"), value.NewDynamic([]byte(`{"size":50}`)), value.NewLong(3)},
+		{value.NewString("IOWA"), value.NewDynamic([]byte(`{"size":101,"user":{}}`)), value.NewLong(4)},
+	}
+	if err := f.Begin(table); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rows {
+		if err := f.WriteRow(table, i, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.End(); err != nil {
+		t.Fatal(err)
+	}
+	want := "Payload.user.id,State,Payload.tags[0]\r\n7,TEXAS,\"\"\"a\"\"\"\r\n,IOWA,\r\n"
+	if buf.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if f.dropped != 2 {
+		t.Errorf("dropped %d rows, want 2", f.dropped)
+	}
+
+	if _, err := projectColumns(table.Columns, []string{"Count.x"}); err == nil {
+		t.Error("a path into a long column was accepted")
+	}
+	if _, err := projectColumns(table.Columns, []string{"Nope"}); err == nil {
+		t.Error("an unknown column was accepted")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// groupWriter implements --group-by: instead of one object per row it emits one document per
+// distinct value of the key column, with the remaining columns of its rows nested under "rows":
+//
+//	{"State":"TEXAS","_table":"PrimaryResult","count":2,"rows":[{"EventType":"Hail"},{"EventType":"Flood"}]}
+//
+// By default groups are buffered and emitted in first-seen order at the end. With sorted set the
+// result must be ordered by the key, and each group is emitted as soon as the key changes, so
+// memory stays bounded to one group. Only primary result tables are grouped; others are skipped.
+type groupWriter struct {
+	w      io.Writer
+	key    string
+	sorted bool
+	array  bool // emit a JSON array (--format json) instead of one document per line
+	pretty bool
+
+	keyIdx int
+	active bool
+	cur    *groupDoc
+	order  []*groupDoc
+	groups map[string]*groupDoc
+	n      int
+}
+
+type groupDoc struct {
+	id    string
+	key   interface{}
+	table string
+	rows  []map[string]interface{}
+}
+
+func newGroupWriter(w io.Writer, key string, sorted bool, format string, pretty bool) (*groupWriter, error) {
+	if format != "ndjson" && format != "json" {
+		return nil, fmt.Errorf("--group-by supports --format ndjson or json, not %q", format)
+	}
+	return &groupWriter{w: w, key: key, sorted: sorted, array: format == "json", pretty: pretty, groups: map[string]*groupDoc{}}, nil
+}
+
+func (g *groupWriter) Begin(t *encode.Table) error {
+	if g.sorted && g.cur != nil {
+		if err := g.emit(g.cur); err != nil {
+			return err
+		}
+		g.cur = nil
+	}
+	g.active = t.Kind == "PrimaryResult"
+	if !g.active {
+		return nil
+	}
+	g.keyIdx = -1
+	for i, c := range t.Columns {
+		if c.Name() == g.key {
+			g.keyIdx = i
+		}
+	}
+	if g.keyIdx < 0 {
+		return fmt.Errorf("--group-by column %q not found in table %s", g.key, t.Name)
+	}
+	return nil
+}
+
+func (g *groupWriter) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if !g.active {
+		return nil
+	}
+	obj := encode.RowObject(t, index, vals)
+	keyVal := obj[g.key]
+	for _, k := range []string{g.key, "_table", "_kind", "_rowIndex"} {
+		delete(obj, k)
+	}
+	var id string
+	if g.keyIdx < len(vals) {
+		if s, ok := canonicalValue(encode.PlainValue(vals[g.keyIdx])); ok {
+			id = "v:" + s
+		}
+	}
+	id = t.Name + "\x00" + id
+
+	if g.sorted {
+		if g.cur != nil && g.cur.id != id {
+			if err := g.emit(g.cur); err != nil {
+				return err
+			}
+			g.cur = nil
+		}
+		if g.cur == nil {
+			g.cur = &groupDoc{id: id, key: keyVal, table: t.Name}
+		}
+		g.cur.rows = append(g.cur.rows, obj)
+		return nil
+	}
+	doc, ok := g.groups[id]
+	if !ok {
+		doc = &groupDoc{id: id, key: keyVal, table: t.Name}
+		g.groups[id] = doc
+		g.order = append(g.order, doc)
+	}
+	doc.rows = append(doc.rows, obj)
+	return nil
+}
+
+func (g *groupWriter) End() error {
+	if g.cur != nil {
+		if err := g.emit(g.cur); err != nil {
+			return err
+		}
+	}
+	for _, doc := range g.order {
+		if err := g.emit(doc); err != nil {
+			return err
+		}
+	}
+	if g.array {
+		end := "\n]\n"
+		if g.n == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(g.w, end)
+		return err
+	}
+	return nil
+}
+
+func (g *groupWriter) emit(doc *groupDoc) error {
+	out := map[string]interface{}{
+		g.key:    doc.key,
+		"_table": doc.table,
+		"count":  len(doc.rows),
+		"rows":   doc.rows,
+	}
+	var enc []byte
+	var err error
+	if g.array && g.pretty {
+		enc, err = json.MarshalIndent(out, "  ", "  ")
+	} else {
+		enc, err = json.Marshal(out)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal group as JSON: %w", err)
+	}
+	g.n++
+	if !g.array {
+		_, err = fmt.Fprintln(g.w, string(enc))
+		return err
+	}
+	sep := ",\n  "
+	if g.n == 1 {
+		sep = "[\n  "
+	}
+	if _, err := io.WriteString(g.w, sep); err != nil {
+		return err
+	}
+	_, err = g.w.Write(enc)
+	return err
+}
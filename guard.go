@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// tableStats is the size of one table as reported by .show tables details.
+type tableStats struct {
+	Name          string `json:"name"`
+	Rows          int64  `json:"rows"`
+	ExtentBytes   int64  `json:"extentBytes"`   // compressed data plus indexes, what a full scan reads
+	OriginalBytes int64  `json:"originalBytes"` // size of the data as ingested
+}
+
+type statsCache struct {
+	Fetched time.Time    `json:"fetched"`
+	Tables  []tableStats `json:"tables"`
+}
+
+// queryGuard holds the --yes/--large-query-bytes settings of the large-query check.
+type queryGuard struct {
+	yes       bool
+	threshold int64
+	ttl       time.Duration
+}
+
+// bytes is the threshold the check applies, 0 when it doesn't run.
+func (g *queryGuard) bytes() int64 {
+	if g.yes {
+		return 0
+	}
+	return max(g.threshold, 0)
+}
+
+// check estimates what the query scans and asks for confirmation when it reads large tables
+// without a time filter. Stats come from a per-database cache refreshed every ttl; when they
+// can't be fetched the query runs unchecked.
+func (g *queryGuard) check(ctx context.Context, client *azkustodata.Client, cluster, database, query string) error {
+	if g.yes || g.threshold <= 0 {
+		return nil
+	}
+	stats, err := loadTableStats(ctx, client, cluster, database, g.ttl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARN large-query guard: no table stats (%v); not checking\n", err)
+		return nil
+	}
+	big, est := largeScan(query, stats, g.threshold)
+	if len(big) == 0 {
+		return nil
+	}
+	for _, t := range big {
+		fmt.Fprintf(os.Stderr, "GUARD %s: %s (%d rows) with no time filter\n", t.Name, formatBytes(t.ExtentBytes), t.Rows)
+	}
+	fmt.Fprintf(os.Stderr, "GUARD estimated scan: %s\n", formatBytes(est))
+	if !gate.interactive {
+		return fmt.Errorf("refusing a full scan of %s; add a time filter or pass --yes", formatBytes(est))
+	}
+	return gate.yesNo("Run anyway?")
+}
+
+// largeScan returns the tables of at least threshold bytes that the query reads in full, and
+// their summed size. It is lexical: a where clause using ago(), now(), datetime(), between or
+// startof/endof counts as a time filter, and queries that only take or count rows are cheap.
+func largeScan(query string, stats []tableStats, threshold int64) ([]tableStats, int64) {
+	stmts := kqlSplit(query, ';')
+	if len(stmts) == 0 {
+		return nil, 0
+	}
+	for _, stmt := range stmts {
+		for _, stage := range kqlSplit(stmt, '|') {
+			if op, _, _ := strings.Cut(stage, " "); op != "where" && op != "filter" {
+				continue
+			}
+			s := strings.ToLower(stage)
+			for _, f := range []string{"ago(", "now(", "datetime(", "between", "startof", "endof"} {
+				if strings.Contains(s, f) {
+					return nil, 0
+				}
+			}
+		}
+	}
+	stages := kqlSplit(stmts[len(stmts)-1], '|')
+	if len(stages) > 1 {
+		switch op, _, _ := strings.Cut(stages[1], " "); op {
+		case "take", "limit", "count", "getschema":
+			return nil, 0
+		}
+	}
+	idents := kqlIdents(query)
+	var big []tableStats
+	var est int64
+	for _, t := range stats {
+		if idents[t.Name] && t.ExtentBytes >= threshold {
+			big = append(big, t)
+			est += t.ExtentBytes
+		}
+	}
+	return big, est
+}
+
+// kqlIdents returns the identifiers in KQL text, outside string literals and comments.
+func kqlIdents(text string) map[string]bool {
+	ids := map[string]bool{}
+	// No separator: kqlSplit only drops the comments.
+	for _, part := range kqlSplit(text, 0) {
+		part = stripKQLStrings(part, ids)
+		for _, f := range strings.FieldsFunc(part, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		}) {
+			ids[f] = true
+		}
+	}
+	return ids
+}
+
+// stripKQLStrings blanks out string literals, verbatim and multi-line ones included (see
+// kqlStringEnd). Bracketed names such as ['My Table'] are added to ids instead.
+func stripKQLStrings(s string, ids map[string]bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		j := kqlStringEnd(s, i)
+		if j == i {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i > 0 && s[i-1] == '[' {
+			lit, name := s[i:j], strings.Trim(s[i:j], `"'`)
+			if v, err := kqlquote.Unquote(lit); err == nil {
+				name = v
+			} else if lit[0] == '@' {
+				q := lit[1:2]
+				name = strings.ReplaceAll(strings.TrimSuffix(lit[2:], q), q+q, q)
+			}
+			ids[name] = true
+		}
+		b.WriteByte(' ')
+		i = j - 1
+	}
+	return b.String()
+}
+
+// loadTableStats returns the database's table sizes from the cache, refreshing it with
+// .show tables details once it is older than ttl.
+func loadTableStats(ctx context.Context, client *azkustodata.Client, cluster, database string, ttl time.Duration) ([]tableStats, error) {
+	path := statsCachePath(cluster, database)
+	var cache statsCache
+	if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &cache) == nil && time.Since(cache.Fetched) < ttl {
+		return cache.Tables, nil
+	}
+	ds, err := client.Mgmt(ctx, database, kql.New(".show tables details"))
+	if err != nil {
+		return nil, err
+	}
+	cache = statsCache{Fetched: time.Now().UTC()}
+	if tables := ds.Tables(); len(tables) > 0 {
+		for _, row := range tables[0].Rows() {
+			var s tableStats
+			if v, err := row.ValueByName("TableName"); err == nil {
+				s.Name = fmt.Sprint(encode.PlainValue(v))
+			}
+			s.Rows = statsNumber(row.ValueByName("TotalRowCount"))
+			s.ExtentBytes = statsNumber(row.ValueByName("TotalExtentSize"))
+			s.OriginalBytes = statsNumber(row.ValueByName("TotalOriginalSize"))
+			cache.Tables = append(cache.Tables, s)
+		}
+	}
+	sort.Slice(cache.Tables, func(i, j int) bool { return cache.Tables[i].Name < cache.Tables[j].Name })
+	if data, err := json.MarshalIndent(cache, "", "  "); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+			os.WriteFile(path, data, 0o644)
+		}
+	}
+	return cache.Tables, nil
+}
+
+func statsNumber(v value.Kusto, err error) int64 {
+	if err != nil {
+		return 0
+	}
+	switch x := encode.PlainValue(v).(type) {
+	case int32:
+		return int64(x)
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	}
+	return 0
+}
+
+// statsCachePath is the cache file for one cluster/database under the user cache directory.
+func statsCachePath(cluster, database string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimRight(cluster, "/")) + "\n" + database))
+	return filepath.Join(dir, "kusto-example", "stats-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// formatBytes renders a size with binary units, e.g. 1.5 TiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+func TestLargeScan(t *testing.T) {
+	stats := []tableStats{
+		{Name: "StormEvents", Rows: 1e9, ExtentBytes: 2 << 40},
+		{Name: "Logs", Rows: 5e9, ExtentBytes: 8 << 40},
+		{Name: "States", Rows: 50, ExtentBytes: 4 << 10},
+	}
+	tests := []struct {
+		query string
+		want  string // names of the large tables scanned
+	}{
+		{"StormEvents | summarize count() by State", "StormEvents"},
+		{"StormEvents | join (Logs) on Id | lookup States on State", "StormEvents Logs"},
+		{"StormEvents | where StartTime > ago(1d) | summarize count()", ""},
+		{"StormEvents | where StartTime between (datetime(2024-01-01) .. datetime(2024-02-01))", ""},
+		{"let recent = Logs | where Timestamp > now(-1h); recent | join StormEvents on Id", ""},
+		{"StormEvents | take 10", ""},
+		{"StormEvents | count", ""},
+		{"States | summarize by State", ""},
+		// Names in strings and comments aren't tables the query reads.
+		{`States | where Name == "StormEvents" // Logs`, ""},
+		{"['StormEvents'] | project State", "StormEvents"},
+		// ago() outside a where clause isn't a time filter.
+		{"StormEvents | extend age = ago(1d)", "StormEvents"},
+	}
+	for _, tt := range tests {
+		big, est := largeScan(tt.query, stats, 1<<40)
+		var names []string
+		var sum int64
+		for _, b := range big {
+			names = append(names, b.Name)
+			sum += b.ExtentBytes
+		}
+		if strings.Join(names, " ") != tt.want || est != sum {
+			t.Errorf("largeScan(%q) = %v (%d bytes), want %s", tt.query, names, est, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+		{3 << 40, "3.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+// TestQueryGuard runs the check against cached stats, so it needs no cluster.
+func TestQueryGuard(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	const cluster, database = "https://help.kusto.windows.net", "Samples"
+	cache, _ := json.Marshal(statsCache{Fetched: time.Now(), Tables: []tableStats{{Name: "StormEvents", Rows: 1e9, ExtentBytes: 2 << 40}}})
+	path := statsCachePath(cluster, database)
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, cache, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(g *confirmGate) { gate = g }(gate)
+	const scan = "StormEvents | summarize count() by State"
+	tests := []struct {
+		name  string
+		guard queryGuard
+		gate  *confirmGate
+		query string
+		err   string
+	}{
+		{name: "filtered", guard: queryGuard{threshold: 1 << 40, ttl: time.Hour}, gate: testGate(false, false, ""), query: "StormEvents | where StartTime > ago(1h)"},
+		{name: "--yes", guard: queryGuard{yes: true, threshold: 1 << 40, ttl: time.Hour}, gate: testGate(false, false, ""), query: scan},
+		{name: "guard off", guard: queryGuard{ttl: time.Hour}, gate: testGate(false, false, ""), query: scan},
+		{name: "not interactive", guard: queryGuard{threshold: 1 << 40, ttl: time.Hour}, gate: testGate(false, false, ""), query: scan, err: "refusing a full scan of 2.0 TiB"},
+		{name: "confirmed", guard: queryGuard{threshold: 1 << 40, ttl: time.Hour}, gate: testGate(false, true, "y\n"), query: scan},
+		{name: "declined", guard: queryGuard{threshold: 1 << 40, ttl: time.Hour}, gate: testGate(false, true, "\n"), query: scan, err: "cancelled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate = tt.gate
+			err := tt.guard.check(context.Background(), nil, cluster, database, tt.query)
+			if (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	// What --daemon hands the daemon's guard: nothing to check with --yes or with the guard off.
+	for g, want := range map[queryGuard]int64{{threshold: 1 << 40}: 1 << 40, {yes: true, threshold: 1 << 40}: 0, {threshold: -1}: 0} {
+		if got := g.bytes(); got != want {
+			t.Errorf("%+v: %d, want %d", g, got, want)
+		}
+	}
+}
+
+// FuzzKQLIdents checks that a bracketed name is found by kqlIdents whatever it contains, and that
+// a string literal never leaks identifiers into the guard's view of the query.
+func FuzzKQLIdents(f *testing.F) {
+	for _, s := range []string{"T", "My Table", "it's", `a\b`, "x'] | take 1 //", "line\nbreak", "\xff"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		ids := kqlIdents("Events | join (" + kqlquote.Ident(s) + ") on Id")
+		if !ids[s] {
+			t.Fatalf("kqlIdents missed %s: %v", kqlquote.Ident(s), ids)
+		}
+		ids = kqlIdents("Events | where Message == " + kqlquote.String(s) + " | take 1")
+		for _, want := range []string{"Events", "where", "Message", "take", "1"} {
+			delete(ids, want)
+		}
+		if len(ids) != 0 {
+			t.Fatalf("string literal %s leaked identifiers: %v", kqlquote.String(s), ids)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// resultHasher computes a deterministic SHA-256 over a result table. Columns are hashed in name
+// order (so reordering a project doesn't change the hash) and every value is reduced to a canonical
+// text form per Kusto type: UTC RFC 3339 datetimes, nanosecond timespans, shortest-form reals and
+// dynamic JSON re-encoded with sorted keys. Rows are hashed in result order, so queries meant for
+// reproducibility checks should end with an explicit sort.
+type resultHasher struct {
+	h     hash.Hash
+	order []int // column indexes in name order
+	rows  int
+}
+
+func newResultHasher(cols []query.Column) *resultHasher {
+	rh := &resultHasher{h: sha256.New(), order: make([]int, len(cols))}
+	for i := range cols {
+		rh.order[i] = i
+	}
+	sort.SliceStable(rh.order, func(a, b int) bool { return cols[rh.order[a]].Name() < cols[rh.order[b]].Name() })
+	for _, i := range rh.order {
+		rh.write(cols[i].Name())
+		rh.write(string(cols[i].Type()))
+	}
+	return rh
+}
+
+func (rh *resultHasher) addRow(vals value.Values) {
+	rh.rows++
+	rh.h.Write([]byte{0x1e})
+	for _, i := range rh.order {
+		if i >= len(vals) {
+			rh.h.Write([]byte{0})
+			continue
+		}
+		s, ok := canonicalValue(encode.PlainValue(vals[i]))
+		if !ok {
+			rh.h.Write([]byte{0})
+			continue
+		}
+		rh.h.Write([]byte{1})
+		rh.write(s)
+	}
+}
+
+// sum returns the hash as "sha256:<hex>".
+func (rh *resultHasher) sum() string {
+	return "sha256:" + hex.EncodeToString(rh.h.Sum(nil))
+}
+
+// write adds a length-prefixed string so that adjacent values can't run together.
+func (rh *resultHasher) write(s string) {
+	var n [binary.MaxVarintLen64]byte
+	rh.h.Write(n[:binary.PutUvarint(n[:], uint64(len(s)))])
+	rh.h.Write([]byte(s))
+}
+
+// hashingEncoder hashes the first primary result table on its way to the wrapped Encoder.
+type hashingEncoder struct {
+	encode.Encoder
+	hasher *resultHasher
+	table  *encode.Table
+}
+
+func (h *hashingEncoder) Begin(t *encode.Table) error {
+	if h.hasher == nil && t.Kind == "PrimaryResult" {
+		h.hasher, h.table = newResultHasher(t.Columns), t
+	}
+	return h.Encoder.Begin(t)
+}
+
+func (h *hashingEncoder) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if t == h.table {
+		h.hasher.addRow(vals)
+	}
+	return h.Encoder.WriteRow(t, index, vals)
+}
+
+// canonicalValue renders a plain value in its canonical text form; ok is false for nulls.
+func canonicalValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case nil:
+		return "", false
+	case bool:
+		return strconv.FormatBool(x), true
+	case int32:
+		return strconv.FormatInt(int64(x), 10), true
+	case int64:
+		return strconv.FormatInt(x, 10), true
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64), true
+	case decimal.Decimal:
+		return x.String(), true
+	case string:
+		return x, true
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano), true
+	case time.Duration:
+		return strconv.FormatInt(int64(x), 10), true
+	case uuid.UUID:
+		return strings.ToLower(x.String()), true
+	case []byte:
+		var any interface{}
+		dec := json.NewDecoder(bytes.NewReader(x))
+		dec.UseNumber()
+		if err := dec.Decode(&any); err != nil {
+			return string(x), true
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			// Trailing data after the first value: not JSON, hash it verbatim.
+			return string(x), true
+		}
+		b, err := json.Marshal(any)
+		if err != nil {
+			return string(x), true
+		}
+		return string(b), true
+	default:
+		return fmt.Sprint(x), true
+	}
+}
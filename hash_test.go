@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+// FuzzCanonicalDynamic checks that canonicalising a dynamic value is idempotent, so equal JSON
+// always hashes equally, and that text which isn't a single JSON value is hashed verbatim.
+func FuzzCanonicalDynamic(f *testing.F) {
+	for _, s := range []string{`{"b":1,"a":2}`, `[1, 2]`, `12345678901234567890`, `1 x`, `{"a":`, "\xff", `"\xff"`, ``} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c, ok := canonicalValue(b)
+		if !ok {
+			t.Fatalf("canonicalValue(%q) reported null", b)
+		}
+		again, _ := canonicalValue([]byte(c))
+		if again != c {
+			t.Fatalf("canonicalValue is not idempotent for %q: %q then %q", b, c, again)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// watchdogFlags configure the heartbeat file and the stall watchdog of long-running modes.
+type watchdogFlags struct {
+	file     string
+	interval time.Duration
+	stall    time.Duration
+}
+
+// globalWatchdog holds the global flags; modes start their heartbeat with startHeartbeat.
+var globalWatchdog = &watchdogFlags{}
+
+func registerWatchdogFlags(fs *flag.FlagSet) *watchdogFlags {
+	w := &watchdogFlags{}
+	fs.StringVar(&w.file, "heartbeat-file", os.Getenv("KUSTO_HEARTBEAT_FILE"), "long-running modes: rewrite this JSON file with the run's state every --heartbeat-interval")
+	fs.DurationVar(&w.interval, "heartbeat-interval", getDurationEnv("KUSTO_HEARTBEAT_INTERVAL", 10*time.Second), "how often the heartbeat file is written")
+	fs.DurationVar(&w.stall, "watchdog", getDurationEnv("KUSTO_WATCHDOG", 0), "long-running modes: exit with status 3 when nothing has progressed for this long (0 disables)")
+	return w
+}
+
+// heartbeatStatus is the content of the heartbeat file.
+type heartbeatStatus struct {
+	PID        int       `json:"pid"`
+	Mode       string    `json:"mode"`
+	State      string    `json:"state"` // running, done, failed or stalled
+	Time       time.Time `json:"time"`
+	Started    time.Time `json:"started"`
+	LastOp     string    `json:"last_op,omitempty"` // the last operation that succeeded
+	LastOpAt   time.Time `json:"last_op_at,omitempty"`
+	StallAfter string    `json:"stall_after,omitempty"`
+}
+
+// heartbeat lets an external supervisor see that an unattended run is alive: it rewrites the
+// heartbeat file every interval with the state and the last operation that succeeded, and its
+// watchdog ends the process when the mode's loop has not moved for the stall threshold, so a
+// wedged run is restarted instead of hanging forever. A nil *heartbeat does nothing, so modes
+// call it unconditionally.
+type heartbeat struct {
+	cfg      watchdogFlags
+	mu       sync.Mutex
+	st       heartbeatStatus
+	progress time.Time // last time the mode's loop moved, successfully or not
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// startHeartbeat starts the heartbeat of a mode, or returns nil when neither --heartbeat-file nor
+// --watchdog is set.
+func startHeartbeat(mode string) *heartbeat {
+	cfg := *globalWatchdog
+	if cfg.file == "" && cfg.stall <= 0 {
+		return nil
+	}
+	if cfg.interval <= 0 {
+		cfg.interval = 10 * time.Second
+	}
+	if cfg.stall > 0 && cfg.interval > cfg.stall/2 {
+		cfg.interval = cfg.stall / 2 // check often enough to notice a stall on time
+	}
+	now := time.Now().UTC()
+	h := &heartbeat{cfg: cfg, progress: now, done: make(chan struct{}),
+		st: heartbeatStatus{PID: os.Getpid(), Mode: mode, State: "running", Started: now, LastOpAt: now}}
+	if cfg.stall > 0 {
+		h.st.StallAfter = cfg.stall.String()
+	}
+	h.write()
+	h.wg.Add(1)
+	go h.loop()
+	return h
+}
+
+func (h *heartbeat) loop() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-t.C:
+			h.mu.Lock()
+			idle := time.Since(h.progress)
+			if h.cfg.stall > 0 && idle > h.cfg.stall {
+				h.st.State = "stalled"
+				h.mu.Unlock()
+				h.write()
+				fmt.Fprintf(os.Stderr, "FAIL watchdog: no progress for %s (last: %s at %s); exiting\n",
+					idle.Round(time.Second), h.st.LastOp, h.st.LastOpAt.Format(time.RFC3339))
+				os.Exit(3)
+			}
+			h.mu.Unlock()
+			h.write()
+		}
+	}
+}
+
+// beat records that op succeeded, which resets the watchdog.
+func (h *heartbeat) beat(op string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.st.LastOp, h.st.LastOpAt = op, time.Now().UTC()
+	h.progress = h.st.LastOpAt
+	h.mu.Unlock()
+}
+
+// moved resets the watchdog without recording a success, for operations that completed but
+// failed: a run whose queries fail is degraded, not stalled.
+func (h *heartbeat) moved() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.progress = time.Now().UTC()
+	h.mu.Unlock()
+}
+
+// observe is a stream event handler that beats on each step of a query.
+func (h *heartbeat) observe(e stream.Event) {
+	switch e := e.(type) {
+	case stream.RowsEmitted:
+		h.beat(fmt.Sprintf("%s: %s (%d rows)", e.Name(), e.Table, e.Total))
+	case stream.TableStarted:
+		h.beat(e.Name() + ": " + e.Table)
+	case stream.Completed:
+		h.beat(e.Name())
+	}
+}
+
+// stop ends the heartbeat with a final state, done or failed.
+func (h *heartbeat) stop(state string) {
+	if h == nil {
+		return
+	}
+	close(h.done)
+	h.wg.Wait()
+	h.mu.Lock()
+	h.st.State = state
+	h.mu.Unlock()
+	h.write()
+}
+
+// write replaces the heartbeat file atomically, so a supervisor never reads half of it.
+func (h *heartbeat) write() {
+	if h.cfg.file == "" {
+		return
+	}
+	h.mu.Lock()
+	h.st.Time = time.Now().UTC()
+	data, _ := json.MarshalIndent(h.st, "", "  ")
+	h.mu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(h.cfg.file), ".heartbeat-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARN heartbeat: %v\n", err)
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.cfg.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Fprintf(os.Stderr, "WARN heartbeat: %v\n", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+func TestHeartbeat(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "heartbeat.json")
+	saved := *globalWatchdog
+	defer func() { *globalWatchdog = saved }()
+	*globalWatchdog = watchdogFlags{file: file, interval: time.Hour}
+
+	read := func() heartbeatStatus {
+		t.Helper()
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st heartbeatStatus
+		if err := json.Unmarshal(data, &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	h := startHeartbeat("query")
+	if st := read(); st.State != "running" || st.Mode != "query" || st.PID != os.Getpid() {
+		t.Fatalf("initial heartbeat = %+v", st)
+	}
+	h.observe(stream.RowsEmitted{Table: "PrimaryResult", N: 10, Total: 30})
+	h.moved()
+	h.stop("done")
+	st := read()
+	if st.State != "done" || st.LastOp != "rows_emitted: PrimaryResult (30 rows)" {
+		t.Errorf("final heartbeat = %+v", st)
+	}
+	if m, _ := filepath.Glob(filepath.Join(filepath.Dir(file), ".heartbeat-*")); len(m) != 0 {
+		t.Errorf("temporary files left: %v", m)
+	}
+
+	*globalWatchdog = watchdogFlags{}
+	off := startHeartbeat("query")
+	if off != nil {
+		t.Fatalf("heartbeat started without --heartbeat-file or --watchdog")
+	}
+	off.beat("x") // a disabled heartbeat is a no-op
+	off.stop("done")
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustoingest"
+	"github.com/google/uuid"
+)
+
+// ingestTag returns a deterministic ingest-by tag for an append. The same command inputs always
+// produce the same tag, so re-running with ingestIfNotExists skips data that already landed.
+func ingestTag(prefix string, parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return prefix + "-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// idempotentWith returns the `with (...)` clause that tags the new extents with ingest-by:<tag>
+// and skips the ingestion if an extent with that tag already exists.
+func idempotentWith(tag string) string {
+	t := strings.ReplaceAll(tag, "'", "")
+	t = strings.ReplaceAll(t, `"`, "")
+	return fmt.Sprintf(`with (tags='["ingest-by:%s"]', ingestIfNotExists='["%s"]')`, t, t)
+}
+
+// streamingIngestLimit is the largest payload streaming ingestion takes, before compression.
+const streamingIngestLimit = 4 << 20
+
+// ingestFormats maps file extensions to ingestion data formats. .json files may hold an array
+// or pretty-printed objects, so they go in as multijson; .jsonl and .ndjson have one object per
+// line.
+var ingestFormats = map[string]string{
+	".csv":    "csv",
+	".tsv":    "tsv",
+	".tab":    "tsv",
+	".json":   "multijson",
+	".jsonl":  "json",
+	".ndjson": "json",
+}
+
+// ingestFormat is the format of a file or blob by its extension, ahead of a .gz or .zip one for
+// a blob (queued ingestion decompresses by the blob's name), or "" if it can't tell.
+func ingestFormat(name string, compressed bool) string {
+	name = strings.ToLower(name)
+	if compressed {
+		name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zip")
+	}
+	return ingestFormats[filepath.Ext(name)]
+}
+
+// ingestMappingKind is the kind of ingestion mapping a format takes, or "" for an unknown format.
+func ingestMappingKind(format string) string {
+	switch format {
+	case "csv", "tsv":
+		return "Csv"
+	case "json", "multijson":
+		return "Json"
+	}
+	return ""
+}
+
+// ingestOptions are the ingestion properties that don't depend on the data.
+type ingestOptions struct {
+	format  string
+	mapping string
+	header  bool // ignoreFirstRecord
+	flush   bool
+}
+
+// ingestDataFormats are the SDK's data formats by their names here.
+var ingestDataFormats = map[string]azkustoingest.DataFormat{
+	"csv":       azkustoingest.CSV,
+	"tsv":       azkustoingest.TSV,
+	"json":      azkustoingest.JSON,
+	"multijson": azkustoingest.MultiJSON,
+}
+
+// fileOptions are the azkustoingest options of one queued ingestion into database.table of size
+// bytes uncompressed, tagged ingest-by:<tag> with ingestIfNotExists. With follow set its status
+// is reported to the status table, which is what Result.Wait reads.
+func (o ingestOptions) fileOptions(database, table, tag string, size int64, follow bool) []azkustoingest.FileOption {
+	format := ingestDataFormats[o.format]
+	opts := []azkustoingest.FileOption{
+		azkustoingest.Database(database),
+		azkustoingest.Table(table),
+		azkustoingest.FileFormat(format),
+		azkustoingest.RawDataSize(size),
+		azkustoingest.Tags([]string{"ingest-by:" + tag}),
+		azkustoingest.IfNotExists(fmt.Sprintf(`["%s"]`, tag)),
+	}
+	if o.mapping != "" {
+		opts = append(opts, azkustoingest.IngestionMappingRef(o.mapping, format))
+	}
+	if o.header {
+		opts = append(opts, azkustoingest.IgnoreFirstRecord())
+	}
+	if o.flush {
+		opts = append(opts, azkustoingest.FlushImmediately())
+	}
+	if follow {
+		opts = append(opts, azkustoingest.ReportResultToTable())
+	}
+	return opts
+}
+
+// newIngestor is the queued ingestion client of a cluster's data management endpoint (see
+// ingestURL). The SDK loads the endpoint's ingestion resources when they are first needed, and
+// loads them again as they age.
+func newIngestor(cluster string, client *http.Client) (*azkustoingest.Ingestion, error) {
+	kcsb, err := newKCSB(ingestURL(cluster))
+	if err != nil {
+		return nil, err
+	}
+	return azkustoingest.New(kcsb, azkustoingest.WithoutEndpointCorrection(), azkustoingest.WithHttpClient(client))
+}
+
+// runIngest implements "ingest <file> --table <table> [cluster-name]": queued ingestion of a
+// local CSV, TSV or JSON file, or with --blob of a blob already in storage.
+//
+// It queues the file with the SDK's azkustoingest client of the cluster's data management
+// endpoint (ingest-<cluster>), which uploads it, compressed, to one of the endpoint's temporary
+// storage containers and posts its ingestion to the aggregation queue. A blob isn't copied: the
+// ingestion points at it, with a read SAS (see blobSigner). The ingestion is tagged
+// ingest-by:<tag> with ingestIfNotExists, where the tag is derived from the file's contents or
+// the blob's URL, so ingesting the same data twice doesn't duplicate its rows. Unless --wait is
+// 0 it then follows the ingestion's status in the status table until it succeeds or fails, and
+// exits with a status per outcome (see ingestExitCode); queued ingestion is batched, so that can
+// take as long as the table's batching policy allows.
+//
+// With --streaming, files up to streamingIngestLimit are sent with streamIngest instead, and
+// are queryable when the command returns; larger files are queued as usual.
+//
+// Local files larger than --chunk-size are queued as chunks of whole records instead, compressed
+// and uploaded --parallel at a time, with a checkpoint to resume from (see chunkedIngest).
+func runIngest(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database to ingest into")
+	table := fs.String("table", "", "table to ingest into (required)")
+	format := fs.String("format", "", "data format: csv|tsv|json|multijson (default from the file extension)")
+	mapping := fs.String("mapping", "", "name of an ingestion mapping defined on the table (.create table ... ingestion csv|json mapping)")
+	header := fs.Bool("ignore-first-record", false, "csv/tsv: skip the file's header line")
+	flush := fs.Bool("flush", false, "ingest right away instead of batching with other ingestions (costly for small files)")
+	tag := fs.String("ingest-tag", getenv("KUSTO_INGEST_TAG", ""), "ingest-by tag for the new extents (default: derived from the database, table and file contents)")
+	wait := fs.Duration("wait", 10*time.Minute, "how long to follow the ingestion's status (0: return once it is queued)")
+	streaming := fs.Bool("streaming", false, "use streaming ingestion for files up to 4 MiB, queuing larger ones (the table needs the streaming ingestion policy)")
+	blob := fs.String("blob", "", "ingest this blob instead of a local file: https://<account>.blob.core.windows.net/<container>/<path>[?<sas>]")
+	createTable := fs.Bool("create-table", true, "if --table doesn't exist, infer its schema from the file's first rows and create it, once confirmed (local files without --mapping)")
+	schemaSample := fs.Int("schema-sample", 1000, "with --create-table: rows read to infer the schema")
+	chunkSize := byteSize(defaultIngestChunkSize)
+	fs.Var(&chunkSize, "chunk-size", "local files larger than this are split into chunks of whole records of up to this size, compressed and queued in parallel (0: never split)")
+	parallel := fs.Int("parallel", 4, "chunks uploaded at a time")
+	checkpoint := fs.String("checkpoint", "", "chunked ingestion progress file, to resume from (default <file>.ingest.json)")
+	restart := fs.Bool("restart", false, "ignore an existing --checkpoint and start over")
+	validateOnly := fs.Bool("validate-only", false, "check the file against the table's schema and --mapping and estimate its rows and size, without uploading it")
+	validateErrors := fs.Int("validate-errors", 10, "with --validate-only: problems listed")
+	stdin := fs.Bool("stdin", false, "ingest records from stdin as they arrive, in batches, until it ends (needs --format)")
+	batchSize := byteSize(0)
+	fs.Var(&batchSize, "batch-size", "with --stdin: largest batch sent at a time (default 1 MiB with --streaming, where 4 MiB is the most, else 100 MiB)")
+	batchWait := fs.Duration("batch-wait", 0, "with --stdin: longest a record waits for its batch to fill (default 5s with --streaming, else 1m)")
+	retries := fs.Int("retries", 5, "with --stdin: sends of a batch again after throttling or a transient failure")
+	pos := parseArgs(fs, args)
+	if *stdin && *table != "" {
+		switch {
+		case *blob != "" || *validateOnly:
+			log.Fatalf("ingest: --stdin reads records from a pipe; it can't be combined with --blob or --validate-only")
+		case *format == "":
+			log.Fatalf("ingest: --stdin needs --format (csv|tsv|json|multijson)")
+		case ingestMappingKind(*format) == "":
+			log.Fatalf("ingest: unknown --format %q (csv|tsv|json|multijson)", *format)
+		case *retries < 0:
+			log.Fatalf("ingest: --retries can't be negative")
+		}
+		if batchSize == 0 {
+			batchSize = 100 << 20
+			if *streaming {
+				batchSize = 1 << 20
+			}
+		}
+		if *batchWait <= 0 {
+			*batchWait = time.Minute
+			if *streaming {
+				*batchWait = 5 * time.Second
+			}
+		}
+		if *streaming && int64(batchSize) > streamingIngestLimit {
+			log.Fatalf("ingest: with --streaming, --batch-size can be at most %s", formatBytes(streamingIngestLimit))
+		} else if int64(batchSize) > maxExternalBytes {
+			log.Fatalf("ingest: --batch-size can be at most %s, what one upload takes", formatBytes(maxExternalBytes))
+		}
+		cluster := resolveClusterURL(firstArg(pos))
+		how := "queue"
+		if *streaming {
+			how = "stream"
+		}
+		if err := gate.confirm(cluster, fmt.Sprintf("%s stdin into %s.%s in batches of up to %s", how, *database, *table, formatBytes(int64(batchSize))), false); err != nil {
+			log.Fatalf("ingest: %v", err)
+		}
+		// The pipe may stay open for hours; every batch reuses one credential and its cached token.
+		startTokenRefresh(context.Background())
+		in := &stdinIngest{cluster: cluster, database: *database, table: *table, format: *format, mapping: *mapping,
+			header: *header && ingestMappingKind(*format) == "Csv", streaming: *streaming, flush: *flush,
+			batch: int64(batchSize), wait: *batchWait, retries: *retries, timeouts: resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)}
+		os.Exit(in.run())
+	}
+	if (len(pos) == 0 && *blob == "") || *table == "" {
+		log.Fatalf("usage: ingest <file>|--blob <url>|--stdin --table <table> [--mapping <name>] [--format csv|tsv|json|multijson] [cluster-name]")
+	}
+	path := stripSAS(*blob)
+	if *blob == "" {
+		path, pos = pos[0], pos[1:]
+	} else if *streaming {
+		log.Fatalf("ingest: --streaming sends local files; a --blob is always queued")
+	} else if *validateOnly {
+		log.Fatalf("ingest: --validate-only checks local files; it can't read a --blob")
+	}
+	cluster := resolveClusterURL(firstArg(pos))
+	if *format == "" {
+		*format = ingestFormat(path, *blob != "")
+		if *format == "" {
+			log.Fatalf("ingest: can't tell the format of %s; set --format", path)
+		}
+	}
+	mappingKind := ingestMappingKind(*format)
+	if mappingKind == "" {
+		log.Fatalf("ingest: unknown --format %q (csv|tsv|json|multijson)", *format)
+	}
+	switch {
+	case int64(chunkSize) > maxExternalBytes:
+		log.Fatalf("ingest: --chunk-size can be at most %s, what one upload takes", formatBytes(maxExternalBytes))
+	case *parallel < 1:
+		log.Fatalf("ingest: --parallel must be at least 1")
+	}
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+
+	var f *os.File
+	var size int64
+	var sum string
+	if *blob == "" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			log.Fatalf("ingest: %v", err)
+		}
+		defer f.Close()
+		h := sha256.New()
+		if size, err = io.Copy(h, f); err != nil {
+			log.Fatalf("ingest: reading %s: %v", path, err)
+		}
+		if size > maxExternalBytes && chunkSize == 0 {
+			log.Fatalf("ingest: %s is %s; files up to %s can be uploaded in one request, set --chunk-size to split it", path, formatBytes(size), formatBytes(maxExternalBytes))
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		if *tag == "" {
+			*tag = ingestTag("ingest", *database, *table, sum)
+		}
+	} else if *tag == "" {
+		*tag = ingestTag("ingest", *database, *table, path)
+	}
+	if *validateOnly {
+		ok, err := validateIngest(cluster, *database, *table, *mapping, *format, *header, f, size, *validateErrors, timeouts)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "FAIL validate %s: %s\n", path, errText(err))
+			os.Exit(1)
+		case !ok:
+			fmt.Fprintf(os.Stderr, "FAIL validate %s: some rows wouldn't ingest as they are; nothing was uploaded\n", path)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "OK validate %s: every row would ingest into %s.%s; nothing was uploaded\n", path, *database, *table)
+		return
+	}
+	if *createTable && *blob == "" && *mapping == "" {
+		if err := createInferredTable(cluster, *database, *table, f, *format, *header, *schemaSample, timeouts); err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s\n", path, errText(err))
+			os.Exit(1)
+		}
+	}
+	stream := *streaming && size <= streamingIngestLimit
+	if *streaming && !stream {
+		fmt.Fprintf(os.Stderr, "INGEST %s is %s, over the %s streaming limit; queuing it\n", path, formatBytes(size), formatBytes(streamingIngestLimit))
+	}
+	chunked := *blob == "" && !stream && chunkSize > 0 && size > int64(chunkSize)
+	action := fmt.Sprintf("queue %s (%s) for ingestion into %s.%s (ingest-by:%s)", path, formatBytes(size), *database, *table, *tag)
+	if *blob != "" {
+		action = fmt.Sprintf("queue %s for ingestion into %s.%s (ingest-by:%s)", path, *database, *table, *tag)
+	}
+	if chunked {
+		action = fmt.Sprintf("queue %s (%s) for ingestion into %s.%s in chunks of up to %s", path, formatBytes(size), *database, *table, formatBytes(int64(chunkSize)))
+	}
+	if stream {
+		action = fmt.Sprintf("stream %s (%s) into %s.%s", path, formatBytes(size), *database, *table)
+	}
+	if err := gate.confirm(cluster, action, false); err != nil {
+		log.Fatalf("ingest: %v", err)
+	}
+	if stream {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("ingest: %v", err)
+		}
+		if *header && mappingKind == "Csv" {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				data = data[i+1:]
+			} else {
+				data = nil
+			}
+		}
+		ctx, cancel := timeouts.callContext(context.Background(), callIngest)
+		defer cancel()
+		start := time.Now()
+		if err := streamIngest(ctx, transfer.client(), cluster, *database, *table, *format, *mapping, data); err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s\n", path, errText(err))
+			printRunbook(os.Stderr, "ingest", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "OK ingest %s: streamed into %s.%s in %s\n", path, *database, *table, time.Since(start).Round(time.Millisecond))
+		return
+	}
+
+	ingestor, err := newIngestor(cluster, transfer.client())
+	if err != nil {
+		log.Fatalf("failed creating Kusto ingest client: %v", err)
+	}
+	defer ingestor.Close()
+
+	opts := ingestOptions{format: *format, mapping: *mapping, header: *header, flush: *flush}
+	if chunked {
+		if *checkpoint == "" {
+			*checkpoint = path + ".ingest.json"
+		}
+		c := &chunkedIngest{path: path, format: *format, header: *header && mappingKind == "Csv", checkpoint: *checkpoint, parallel: *parallel,
+			wait: *wait, timeouts: timeouts,
+			cp: ingestChunkCheckpoint{Database: *database, Table: *table, SHA256: sum, ChunkSize: int64(chunkSize), Tag: *tag}}
+		c.queue = func(ctx context.Context, file, tag string, size int64) (ingestResult, error) {
+			return ingestor.FromFile(ctx, file, opts.fileOptions(*database, *table, tag, size, *wait > 0)...)
+		}
+		if !*restart {
+			resumed, err := c.resume()
+			if err != nil {
+				log.Fatalf("ingest: %v", err)
+			}
+			if resumed {
+				landed := 0
+				for _, ch := range c.cp.Chunks {
+					if ch.landed() {
+						landed++
+					}
+				}
+				fmt.Fprintf(os.Stderr, "INGEST %s: resuming with %d of %d chunks landed (checkpoint %s)\n", path, landed, len(c.cp.Chunks), *checkpoint)
+			}
+		}
+		os.Exit(c.run(f))
+	}
+	ctx, cancel := timeouts.callContext(context.Background(), callIngest)
+	defer cancel()
+	source := path
+	if *blob != "" {
+		source, err = newBlobSigner().source(ctx, *blob)
+	}
+	var res *azkustoingest.Result
+	if err == nil {
+		res, err = ingestor.FromFile(ctx, source, opts.fileOptions(*database, *table, *tag, size, *wait > 0)...)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s\n", path, errText(err))
+		printRunbook(os.Stderr, "ingest", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "INGEST %s: queued for %s.%s (ingest-by:%s)\n", path, *database, *table, *tag)
+	if *wait <= 0 {
+		fmt.Println(*tag)
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), *wait)
+	defer cancel()
+	st, err := followIngest(ctx, res, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: no final status after %s: %v\n", path, time.Since(start).Round(time.Second), err)
+		os.Exit(exitIngestTimeout)
+	}
+	elapsed := time.Since(start).Round(time.Second)
+	switch st.Status {
+	case "Succeeded":
+		fmt.Fprintf(os.Stderr, "OK ingest %s: succeeded in %s\n", path, elapsed)
+	case "Skipped":
+		fmt.Fprintf(os.Stderr, "SKIPPED ingest %s: already ingested (ingest-by:%s)\n", path, *tag)
+	default:
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s after %s: %s\n", path, st.Status, elapsed, st.describe())
+	}
+	os.Exit(ingestExitCode(st.Status))
+}
+
+// createInferredTable creates database.table from the schema of f's first rows, unless the table
+// already exists. The schema is printed first and needs confirming: it is a guess from a sample,
+// and a wrong column type is easier to fix now than after the data is in.
+func createInferredTable(cluster, database, table string, f *os.File, format string, header bool, sample int, timeouts timeoutConfig) error {
+	client, err := newClient(cluster)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := timeouts.callContext(context.Background(), callMgmt)
+	exists, err := tableExists(ctx, client, database, table)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("looking for table %s: %w", table, err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cols, rows, err := inferSchema(f, format, header, sample)
+	if err != nil {
+		return fmt.Errorf("table %s doesn't exist, and its schema can't be inferred: %v", table, err)
+	}
+	command := createTableCommand(table, cols)
+	printSchema(os.Stderr, table, cols, rows)
+	fmt.Fprintf(os.Stderr, "  %s\n", command)
+	// Not destructive, but asked like it: the schema is a guess to look over.
+	if err := gate.confirm(cluster, fmt.Sprintf("create table %s.%s with this schema", database, table), true); err != nil {
+		return err
+	}
+	ctx, cancel = timeouts.callContext(context.Background(), callMgmt)
+	defer cancel()
+	if _, err := client.Mgmt(ctx, database, (&kql.Builder{}).AddUnsafe(command)); err != nil {
+		return fmt.Errorf("%s: %w", command, err)
+	}
+	fmt.Fprintf(os.Stderr, "CREATED table %s.%s with %d columns\n", database, table, len(cols))
+	return nil
+}
+
+// Exit statuses of ingest --wait by the ingestion's final state, so a pipeline can tell whether
+// its data landed. Errors before the file is queued exit with 1, like other subcommands.
+const (
+	exitIngestFailed  = 4 // Failed: nothing was ingested
+	exitIngestPartial = 5 // PartiallySucceeded: some records were dropped
+	exitIngestTimeout = 6 // still pending (or unreadable) when --wait ran out
+	exitIngestSkipped = 7 // Skipped: ingestIfNotExists found the tag, the data is already there
+)
+
+// ingestExitCode maps an ingestion's final status to the process's exit status.
+func ingestExitCode(status string) int {
+	switch status {
+	case "Succeeded":
+		return 0
+	case "PartiallySucceeded":
+		return exitIngestPartial
+	case "Skipped":
+		return exitIngestSkipped
+	}
+	return exitIngestFailed
+}
+
+// streamFormats are the streamFormat names of the ingestion data formats.
+var streamFormats = map[string]string{"csv": "Csv", "tsv": "Tsv", "json": "Json", "multijson": "MultiJson"}
+
+// streamIngest ingests data into a table with streaming ingestion: one request to the cluster
+// itself, which has the rows queryable within seconds instead of after a batching period. The
+// ingestion isn't tagged, so unlike queued ingestion a repeated run adds the rows again.
+func streamIngest(ctx context.Context, client *http.Client, cluster, database, table, format, mapping string, data []byte) error {
+	tok, err := clusterToken(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(data)
+	zw.Close()
+	q := url.Values{"streamFormat": {streamFormats[format]}}
+	if mapping != "" {
+		q.Set("mappingName", mapping)
+	}
+	u := fmt.Sprintf("%s/v1/rest/ingest/%s/%s?%s", strings.TrimRight(cluster, "/"), url.PathEscape(database), url.PathEscape(table), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("x-ms-client-request-id", "kusto-example.ingest;"+uuid.NewString())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 16<<10))
+	var e struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"@message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(msg, &e) == nil && e.Error.Message != "" {
+		return &streamIngestError{Status: resp.StatusCode, msg: fmt.Sprintf("streaming ingestion: %s: %s (%s)", resp.Status, e.Error.Message, e.Error.Code)}
+	}
+	return &streamIngestError{Status: resp.StatusCode, msg: fmt.Sprintf("streaming ingestion: %s: %s", resp.Status, strings.TrimSpace(string(msg)))}
+}
+
+// streamIngestError is a non-2xx answer to a streaming ingestion.
+type streamIngestError struct {
+	Status int
+	msg    string
+}
+
+func (e *streamIngestError) Error() string { return e.msg }
+
+// ingestURL is the data management endpoint of a cluster: https://ingest-<cluster>, or
+// KUSTO_INGEST_URI.
+func ingestURL(cluster string) string {
+	if v := strings.TrimSpace(os.Getenv("KUSTO_INGEST_URI")); v != "" {
+		return v
+	}
+	return strings.Replace(cluster, "://", "://ingest-", 1)
+}
+
+// ingestStatus is an ingestion's final status: Succeeded, PartiallySucceeded, Failed or Skipped
+// (ingestIfNotExists found the tag).
+type ingestStatus struct {
+	Status        string
+	ErrorCode     string
+	FailureStatus string // Permanent, Transient or Exhausted (retries)
+	Details       string
+}
+
+// describe is the failure's code, whether retrying may help, and its details.
+func (st *ingestStatus) describe() string {
+	var parts []string
+	if st.ErrorCode != "" && st.ErrorCode != "Unknown" {
+		parts = append(parts, st.ErrorCode)
+	}
+	if st.FailureStatus != "" && st.FailureStatus != "Unknown" {
+		parts = append(parts, "("+strings.ToLower(st.FailureStatus)+")")
+	}
+	if st.Details != "" {
+		parts = append(parts, st.Details)
+	}
+	if len(parts) == 0 {
+		return "no details"
+	}
+	return strings.Join(parts, " ")
+}
+
+// ingestResult is what a queued ingestion's status is followed with: *azkustoingest.Result, whose
+// Wait sends nothing once the ingestion succeeds, and its status record otherwise.
+type ingestResult interface {
+	Wait(ctx context.Context) <-chan error
+}
+
+// followIngest waits until the ingestion is no longer Pending, printing how long it has waited
+// every minute. It fails if ctx ends first, or the status table can't be read.
+func followIngest(ctx context.Context, r ingestResult, name string) (*ingestStatus, error) {
+	done := r.Wait(ctx)
+	start := time.Now()
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-done:
+			st := ingestOutcome(err)
+			switch azkustoingest.StatusCode(st.Status) {
+			case azkustoingest.StatusRetrievalCanceled:
+				return nil, ctx.Err()
+			case azkustoingest.StatusRetrievalFailed:
+				return nil, fmt.Errorf("reading status: %s", st.describe())
+			}
+			return st, nil
+		case <-tick.C:
+			fmt.Fprintf(os.Stderr, "INGEST %s: pending after %s\n", name, time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+// ingestOutcome is the final status of an ingestion from what its Result.Wait sent.
+func ingestOutcome(err error) *ingestStatus {
+	if err == nil {
+		return &ingestStatus{Status: "Succeeded"}
+	}
+	status, serr := azkustoingest.GetIngestionStatus(err)
+	if serr != nil {
+		return &ingestStatus{Status: "Failed", Details: errText(err)}
+	}
+	st := &ingestStatus{Status: string(status)}
+	st.ErrorCode, _ = azkustoingest.GetErrorCode(err)
+	failure, _ := azkustoingest.GetIngestionFailureStatus(err)
+	st.FailureStatus = string(failure)
+	return st
+}
+
+// ingestBlobSASTTL is how long the read SAS an ingestion gets for a blob lasts: long enough for
+// batching and the service's retries.
+const ingestBlobSASTTL = 24 * time.Hour
+
+// blobSigner gives the ingestion service read access to blobs in your storage. A blob URL with a
+// SAS is passed on as is; for one without, it mints a read SAS valid for ingestBlobSASTTL the way
+// --external-data does, with AZURE_STORAGE_KEY or a user delegation key. Containers are opened
+// once and kept, so a long run reuses its delegation key.
+type blobSigner struct {
+	containers map[string]*scratchContainer // by https://<account>.blob.core.windows.net/<container>
+}
+
+func newBlobSigner() *blobSigner { return &blobSigner{containers: map[string]*scratchContainer{}} }
+
+// source is the blob's URL for an ingestion message. A Data Lake (dfs) URL, as Data Lake events
+// carry, is turned into the blob endpoint's.
+func (b *blobSigner) source(ctx context.Context, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("blob %q: expected https://<account>.blob.core.windows.net/<container>/<path>", stripSAS(uri))
+	}
+	u.Host = strings.Replace(u.Host, ".dfs.", ".blob.", 1)
+	if u.RawQuery != "" {
+		return u.String(), nil
+	}
+	container, name, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if container == "" || name == "" {
+		return "", fmt.Errorf("blob %q: no container or blob name", uri)
+	}
+	key := "https://" + u.Host + "/" + container
+	s := b.containers[key]
+	if s == nil {
+		if s, err = newBlobContainer("blob", key); err != nil {
+			return "", err
+		}
+		b.containers[key] = s
+	}
+	now := time.Now()
+	sas, err := s.sas(ctx, name, "r", now.Add(-5*time.Minute), now.Add(ingestBlobSASTTL))
+	if err != nil {
+		return "", err
+	}
+	return s.blobURL(name) + "?" + sas, nil
+}
+
+// withSASPath appends a path to a storage URI that carries a SAS, keeping the SAS.
+func withSASPath(uri, path string) string {
+	base, sas, _ := strings.Cut(uri, "?")
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	out := strings.TrimRight(base, "/") + "/" + strings.Join(segs, "/")
+	if sas != "" {
+		out += "?" + sas
+	}
+	return out
+}
+
+// stripSAS drops a URI's query string, which holds the SAS, for messages.
+func stripSAS(uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
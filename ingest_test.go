@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustoingest"
+)
+
+// fakeIngestService is a cluster's data management endpoint and the storage its ingestion
+// resources point at, over TLS as the SDK requires: it answers the resources and identity token,
+// keeps uploaded blobs, put together from their blocks when they come in blocks, and keeps status
+// records and the ingestion messages queued.
+type fakeIngestService struct {
+	srv      *httptest.Server
+	mu       sync.Mutex
+	blocks   map[string][]byte // by blob path and block id
+	blobs    map[string][]byte // by path
+	records  map[string]map[string]interface{}
+	messages []ingestMessage
+}
+
+// ingestMessage is the part of a queued ingestion's message the tests look at.
+type ingestMessage struct {
+	BlobPath         string
+	DatabaseName     string
+	TableName        string
+	RawDataSize      int64
+	FlushImmediately bool
+	Status           struct{ PartitionKey string } `json:"IngestionStatusInTable"`
+	Properties       map[string]interface{}        `json:"AdditionalProperties"`
+}
+
+// newFakeIngestService starts the service, and points newIngestor at it with a bearer token.
+func newFakeIngestService(t *testing.T) *fakeIngestService {
+	t.Helper()
+	f := &fakeIngestService{blocks: map[string][]byte{}, blobs: map[string][]byte{}, records: map[string]map[string]interface{}{}}
+	f.srv = httptest.NewTLSServer(f)
+	t.Cleanup(f.srv.Close)
+	t.Setenv("KUSTO_INGEST_URI", f.srv.URL)
+	t.Setenv("KUSTO_ACCESS_TOKEN", "tok")
+	prev := currentAuth
+	currentAuth = tokenAuth{}
+	t.Cleanup(func() { currentAuth = prev })
+	return f
+}
+
+func (f *fakeIngestService) ingestor(t *testing.T) *azkustoingest.Ingestion {
+	t.Helper()
+	ingestor, err := newIngestor("https://unused.kusto.windows.net", f.srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ingestor.Close() })
+	return ingestor
+}
+
+// blob is the data of an ingestion message's blob, decompressed.
+func (f *fakeIngestService) blob(t *testing.T, m ingestMessage) string {
+	t.Helper()
+	u, _ := url.Parse(m.BlobPath)
+	f.mu.Lock()
+	data, ok := f.blobs[u.Path]
+	f.mu.Unlock()
+	if !ok || !strings.HasSuffix(u.Path, ".gz") {
+		t.Fatalf("blob %s: uploaded %v", u.Path, ok)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(zr)
+	return string(b)
+}
+
+func (f *fakeIngestService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	q := r.URL.Query()
+	switch {
+	case r.URL.Path == "/v1/rest/mgmt":
+		var req struct {
+			CSL string `json:"csl"`
+		}
+		json.Unmarshal(body, &req)
+		table := `{"TableName":"Table_0","Columns":[{"ColumnName":"AuthorizationContext","ColumnType":"string"}],"Rows":[["token"]]}`
+		if req.CSL == ".get ingestion resources" {
+			table = fmt.Sprintf(`{"TableName":"Table_0","Columns":[{"ColumnName":"ResourceTypeName","ColumnType":"string"},{"ColumnName":"StorageRoot","ColumnType":"string"}],
+				"Rows":[["SecuredReadyForAggregationQueue","%[1]s/queue?sig=s"],["TempStorage","%[1]s/temp?sig=s"],["IngestionsStatusTable","%[1]s/status?sig=s"]]}`, f.srv.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"Tables":[%s]}`, table)
+	case q.Get("sig") != "s":
+		http.Error(w, "bad SAS", http.StatusForbidden)
+	case strings.HasPrefix(r.URL.Path, "/temp/") && q.Get("comp") == "block":
+		f.blocks[r.URL.Path+"/"+q.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, "/temp/") && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		xml.Unmarshal(body, &list)
+		var blob []byte
+		for _, id := range list.Latest {
+			blob = append(blob, f.blocks[r.URL.Path+"/"+id]...)
+		}
+		f.blobs[r.URL.Path] = blob
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, "/temp/") && r.Method == http.MethodPut:
+		f.blobs[r.URL.Path] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/status" && r.Method == http.MethodPost:
+		var rec map[string]interface{}
+		json.Unmarshal(body, &rec)
+		f.records[rec["PartitionKey"].(string)] = rec
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/queue/messages":
+		var m struct{ MessageText string }
+		xml.Unmarshal(body, &m)
+		data, _ := base64.StdEncoding.DecodeString(m.MessageText)
+		var msg ingestMessage
+		json.Unmarshal(data, &msg)
+		f.messages = append(f.messages, msg)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><QueueMessagesList><QueueMessage><MessageId>m</MessageId><PopReceipt>r</PopReceipt></QueueMessage></QueueMessagesList>`)
+	default:
+		http.Error(w, "", http.StatusNotFound)
+	}
+}
+
+func TestQueuedIngestion(t *testing.T) {
+	svc := newFakeIngestService(t)
+	ingestor := svc.ingestor(t)
+	path := filepath.Join(t.TempDir(), "storm events.csv")
+	os.WriteFile(path, []byte("State,N\na,1\nb,2\n"), 0o644)
+
+	opts := ingestOptions{format: "csv", mapping: "m", header: true, flush: true}
+	res, err := ingestor.FromFile(context.Background(), path, opts.fileOptions("db", "T", "ingest-1", 16, true)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.messages) != 1 {
+		t.Fatalf("%d messages queued", len(svc.messages))
+	}
+	m := svc.messages[0]
+	if got := svc.blob(t, m); got != "State,N\na,1\nb,2\n" {
+		t.Errorf("uploaded %q", got)
+	}
+	if m.DatabaseName != "db" || m.TableName != "T" || m.RawDataSize != 16 || !m.FlushImmediately {
+		t.Errorf("message %+v", m)
+	}
+	for k, want := range map[string]interface{}{
+		"authorizationContext":      "token",
+		"format":                    "csv",
+		"ingestionMappingReference": "m",
+		"ingestionMappingType":      "Csv",
+		"ignoreFirstRecord":         true,
+		"tags":                      `["ingest-by:ingest-1"]`,
+		"ingestIfNotExists":         `["ingest-1"]`,
+	} {
+		if m.Properties[k] != want {
+			t.Errorf("%s: %v, want %v", k, m.Properties[k], want)
+		}
+	}
+	if rec := svc.records[m.Status.PartitionKey]; rec == nil || rec["Status"] != "Pending" {
+		t.Errorf("status record %v of %+v", rec, m.Status)
+	}
+
+	// Following it stops with the context, before the status is read.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if st, err := followIngest(ctx, res, path); err != context.Canceled {
+		t.Errorf("follow: %+v, %v", st, err)
+	}
+
+	// Without following, nothing needs a status record.
+	if _, err := ingestor.FromFile(context.Background(), path, ingestOptions{format: "tsv"}.fileOptions("db", "T", "ingest-2", 16, false)...); err != nil {
+		t.Fatal(err)
+	}
+	if m := svc.messages[1]; m.Status.PartitionKey != "" || len(svc.records) != 1 || m.Properties["format"] != "tsv" || m.Properties["ignoreFirstRecord"] != false {
+		t.Errorf("message %+v, %d status records", m, len(svc.records))
+	}
+}
+
+// doneResult is an ingestion whose Wait sends err, nil for one that succeeded.
+type doneResult struct{ err error }
+
+func (r doneResult) Wait(context.Context) <-chan error {
+	ch := make(chan error, 1)
+	if r.err != nil {
+		ch <- r.err
+	}
+	close(ch)
+	return ch
+}
+
+func TestFollowIngest(t *testing.T) {
+	st, err := followIngest(context.Background(), doneResult{}, "f")
+	if err != nil || st.Status != "Succeeded" {
+		t.Errorf("succeeded: %+v, %v", st, err)
+	}
+	st, err = followIngest(context.Background(), doneResult{errors.New("upload: 403 Forbidden")}, "f")
+	if err != nil || st.Status != "Failed" || st.describe() != "upload: 403 Forbidden" {
+		t.Errorf("failed: %+v, %v", st, err)
+	}
+}
+
+func TestStreamIngest(t *testing.T) {
+	t.Setenv("KUSTO_ACCESS_TOKEN", "tok")
+	defer func(p authProvider) { currentAuth = p }(currentAuth)
+	currentAuth = tokenAuth{}
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" || r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v1/rest/ingest/db/Events" || r.URL.Query().Get("streamFormat") != "Json" || r.URL.Query().Get("mappingName") != "m" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":{"code":"BadRequest","@message":"unexpected `+r.URL.String()+`"}}`)
+			return
+		}
+		zr, _ := gzip.NewReader(r.Body)
+		data, _ := io.ReadAll(zr)
+		got = string(data)
+	}))
+	defer srv.Close()
+
+	if err := streamIngest(context.Background(), srv.Client(), srv.URL, "db", "Events", "json", "m", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got != `{"a":1}` {
+		t.Errorf("ingested %q", got)
+	}
+	err := streamIngest(context.Background(), srv.Client(), srv.URL, "db", "Events", "csv", "", []byte("a,1"))
+	if err == nil || !strings.Contains(err.Error(), "(BadRequest)") {
+		t.Errorf("error %v, want the service's message", err)
+	}
+
+	// ingest --stdin streams through the run's transfer, so --max-bandwidth and
+	// --transfer-stats cover it.
+	defer func(t *httpTransfer) { transfer = t }(transfer)
+	transfer = &httpTransfer{}
+	in := &stdinIngest{cluster: srv.URL, database: "db", table: "Events", format: "json", mapping: "m", timeouts: timeoutConfig{def: time.Minute}}
+	if err := in.stream(1, []byte(`{"a":2}`)); err != nil || got != `{"a":2}` {
+		t.Errorf("stream: %v, ingested %q", err, got)
+	}
+	if transfer.encodings["identity"] != 1 {
+		t.Errorf("the transfer saw %v", transfer.encodings)
+	}
+}
+
+func TestIngestExitCode(t *testing.T) {
+	for status, want := range map[string]int{
+		"Succeeded":          0,
+		"Failed":             exitIngestFailed,
+		"PartiallySucceeded": exitIngestPartial,
+		"Skipped":            exitIngestSkipped,
+		"Queued":             exitIngestFailed,
+	} {
+		if got := ingestExitCode(status); got != want {
+			t.Errorf("ingestExitCode(%q) = %d, want %d", status, got, want)
+		}
+	}
+	st := &ingestStatus{Status: "Failed", ErrorCode: "BadRequest_InvalidMapping", FailureStatus: "Permanent", Details: "mapping m not found"}
+	if got := st.describe(); got != "BadRequest_InvalidMapping (permanent) mapping m not found" {
+		t.Errorf("describe() = %q", got)
+	}
+	if got := (&ingestStatus{Status: "Failed", ErrorCode: "Unknown", FailureStatus: "Unknown"}).describe(); got != "no details" {
+		t.Errorf("describe() = %q", got)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultIngestChunkSize is --chunk-size: files larger than this are ingested in chunks of up to
+// this much data, uncompressed, which is about what one ingestion handles best.
+const defaultIngestChunkSize = 1 << 30
+
+// recordSplitter reads a file a record at a time, so it can be cut into chunks without splitting
+// one: a line of json, a CSV or TSV record (which may span lines inside quotes), or an object of
+// multijson, which is written on a line of its own so a chunk is a valid multijson file even when
+// the file was one big array.
+type recordSplitter struct {
+	next   func() ([]byte, error)
+	header []byte // csv/tsv with ignoreFirstRecord: the first record, repeated at the top of every chunk
+	held   []byte // a record read but not written, because it didn't fit in the last chunk
+}
+
+func newRecordSplitter(r io.Reader, format string, header bool) (*recordSplitter, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	s := &recordSplitter{}
+	switch format {
+	case "multijson":
+		dec := json.NewDecoder(br)
+		if first, err := firstNonSpace(br); err == nil && first == '[' {
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+		}
+		n := 0
+		s.next = func() ([]byte, error) {
+			if !dec.More() {
+				return nil, io.EOF
+			}
+			n++
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("record %d: %w", n, err)
+			}
+			return append(raw, '\n'), nil
+		}
+	case "json":
+		s.next = func() ([]byte, error) { return readLine(br) }
+	default:
+		// A record ends at the line break after an even number of quotes; "" inside a quoted field
+		// counts twice, so it keeps the parity.
+		s.next = func() ([]byte, error) {
+			rec, err := readLine(br)
+			for err == nil && bytes.Count(rec, []byte{'"'})%2 == 1 {
+				var more []byte
+				if more, err = readLine(br); err == io.EOF {
+					return rec, nil
+				}
+				rec = append(rec, more...)
+			}
+			return rec, err
+		}
+		if header {
+			h, err := s.next()
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			s.header = h
+		}
+	}
+	return s, nil
+}
+
+// readLine is the next line with its line break, added if the file's last line has none, or
+// io.EOF after the last.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadBytes('\n')
+	if len(line) > 0 {
+		if line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+		return line, nil
+	}
+	return nil, err
+}
+
+// chunk writes whole records to w, with the header first, until the next one would take it past
+// limit bytes; a record larger than limit makes a chunk of its own. It returns the records and
+// bytes written, and io.EOF once there are none left.
+func (s *recordSplitter) chunk(w io.Writer, limit int64) (records, size int64, err error) {
+	rec := s.held
+	s.held = nil
+	if rec == nil {
+		if rec, err = s.next(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(s.header) > 0 {
+		if _, err := w.Write(s.header); err != nil {
+			return 0, 0, err
+		}
+		size = int64(len(s.header))
+	}
+	for {
+		if _, err := w.Write(rec); err != nil {
+			return records, size, err
+		}
+		records++
+		size += int64(len(rec))
+		if rec, err = s.next(); err == io.EOF {
+			return records, size, nil
+		} else if err != nil {
+			return records, size, err
+		}
+		if size+int64(len(rec)) > limit {
+			s.held = rec
+			return records, size, nil
+		}
+	}
+}
+
+// ingestChunkCheckpoint is the progress of a chunked ingestion, kept next to the file: which file
+// and chunk size it is for, and what became of each chunk queued. It is written whenever a chunk
+// is queued or reaches a final status, and removed once every chunk has landed.
+type ingestChunkCheckpoint struct {
+	Database  string             `json:"database"`
+	Table     string             `json:"table"`
+	SHA256    string             `json:"sha256"`
+	ChunkSize int64              `json:"chunk_size"`
+	Tag       string             `json:"tag"`
+	Chunks    []ingestChunkState `json:"chunks"`
+	Updated   time.Time          `json:"updated"`
+}
+
+// ingestChunkState is one chunk's entry in the checkpoint.
+type ingestChunkState struct {
+	Bytes   int64  `json:"bytes"`
+	Records int64  `json:"records"`
+	Tag     string `json:"tag"`
+	Status  string `json:"status,omitempty"`  // "" until queued, then Pending, then its final status
+	Details string `json:"details,omitempty"` // why it failed
+}
+
+// landed reports whether the chunk's data is in the table, so a resumed run skips it.
+func (c *ingestChunkState) landed() bool {
+	switch c.Status {
+	case "Succeeded", "PartiallySucceeded", "Skipped":
+		return true
+	}
+	return false
+}
+
+// chunkedIngest ingests a large local file as chunks of whole records, each written to a
+// temporary file and queued as an ingestion of its own, --parallel at a time, and then follows all
+// of their statuses. Every chunk has its own ingest-by tag, derived from the file's tag, the chunk
+// size and its number, so queuing a chunk again after a failure can't duplicate its rows; the
+// checkpoint saves a resumed run from uploading again the chunks that landed. A chunk an earlier
+// run left pending is queued again, since only the run that queued an ingestion can follow it;
+// once either one lands, the other is skipped.
+type chunkedIngest struct {
+	path       string
+	format     string
+	header     bool
+	checkpoint string
+	parallel   int
+	wait       time.Duration
+	timeouts   timeoutConfig
+	queue      func(ctx context.Context, file, tag string, size int64) (ingestResult, error) // file is a chunk's temporary file
+
+	mu      sync.Mutex
+	cp      ingestChunkCheckpoint
+	pending map[int]ingestResult // chunks queued by this run, to follow
+}
+
+// resume loads the checkpoint, if there is one. It must be for the same file, table and chunk
+// size: a checkpoint of anything else is an error, not something to overwrite.
+func (c *chunkedIngest) resume() (bool, error) {
+	data, err := os.ReadFile(c.checkpoint)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var cp ingestChunkCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return false, fmt.Errorf("invalid checkpoint %s: %v", c.checkpoint, err)
+	}
+	if cp.Database != c.cp.Database || cp.Table != c.cp.Table || cp.SHA256 != c.cp.SHA256 || cp.ChunkSize != c.cp.ChunkSize || cp.Tag != c.cp.Tag {
+		return false, fmt.Errorf("checkpoint %s is for another ingestion (%s.%s, chunk size %s); remove it or pass --restart", c.checkpoint, cp.Database, cp.Table, formatBytes(cp.ChunkSize))
+	}
+	c.cp = cp
+	return true, nil
+}
+
+// save replaces the checkpoint file in one rename, so a crash leaves the old one or the new one.
+// The caller holds mu.
+func (c *chunkedIngest) save() error {
+	c.cp.Updated = time.Now().UTC()
+	b, _ := json.MarshalIndent(c.cp, "", "  ")
+	tmp := c.checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.checkpoint)
+}
+
+// update changes chunk i's entry and saves the checkpoint.
+func (c *chunkedIngest) update(i int, change func(*ingestChunkState)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	change(&c.cp.Chunks[i])
+	if err := c.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN ingest %s: checkpoint: %v\n", c.path, err)
+	}
+}
+
+// chunkJob is a chunk written to a temporary file, ready to queue.
+type chunkJob struct {
+	index int
+	file  string
+}
+
+// run splits the file, queues the chunks that haven't landed, and with a --wait follows every one
+// it queued to its final status. It returns the process's exit status.
+func (c *chunkedIngest) run(f *os.File) int {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: %v\n", c.path, err)
+		return 1
+	}
+	splitter, err := newRecordSplitter(f, c.format, c.header)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: %v\n", c.path, err)
+		return 1
+	}
+	c.pending = map[int]ingestResult{}
+	jobs := make(chan chunkJob)
+	var splitErr error
+	go func() {
+		defer close(jobs)
+		splitErr = c.split(splitter, jobs)
+	}()
+
+	var uploads sync.WaitGroup
+	var failedUploads int
+	var failedMu sync.Mutex
+	for w := 0; w < c.parallel; w++ {
+		uploads.Add(1)
+		go func() {
+			defer uploads.Done()
+			for job := range jobs {
+				if err := c.upload(job); err != nil {
+					failedMu.Lock()
+					failedUploads++
+					failedMu.Unlock()
+					fmt.Fprintf(os.Stderr, "FAIL ingest %s: chunk %d: %s\n", c.path, job.index+1, errText(err))
+				}
+			}
+		}()
+	}
+	uploads.Wait()
+	if splitErr != nil {
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: splitting: %v\n", c.path, splitErr)
+		return 1
+	}
+
+	if c.wait <= 0 {
+		fmt.Fprintf(os.Stderr, "INGEST %s: %d chunks, %d queued and not followed; the same command again queues any that didn't land\n", c.path, len(c.cp.Chunks), len(c.pending))
+		if failedUploads > 0 {
+			return 1
+		}
+		return 0
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.wait)
+	defer cancel()
+	var follows sync.WaitGroup
+	for i, res := range c.pending {
+		follows.Add(1)
+		go func(i int, res ingestResult) {
+			defer follows.Done()
+			name := fmt.Sprintf("%s chunk %d", c.path, i+1)
+			st, err := followIngest(ctx, res, name)
+			if err != nil {
+				return
+			}
+			c.update(i, func(s *ingestChunkState) {
+				s.Status, s.Details = st.Status, ""
+				if st.Status != "Succeeded" && st.Status != "Skipped" {
+					s.Details = st.describe()
+				}
+			})
+			c.mu.Lock()
+			chunk := c.cp.Chunks[i]
+			c.mu.Unlock()
+			switch st.Status {
+			case "Succeeded":
+				fmt.Fprintf(os.Stderr, "OK ingest %s: succeeded\n", name)
+			case "Skipped":
+				fmt.Fprintf(os.Stderr, "SKIPPED ingest %s: already ingested (ingest-by:%s)\n", name, chunk.Tag)
+			case "PartiallySucceeded":
+				fmt.Fprintf(os.Stderr, "WARN ingest %s: partially succeeded: %s\n", name, chunk.Details)
+			default:
+				fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s: %s\n", name, st.Status, chunk.Details)
+			}
+		}(i, res)
+	}
+	follows.Wait()
+	return c.summary(failedUploads, time.Since(start).Round(time.Second))
+}
+
+// split cuts the file into chunks. Those that landed are read past; the rest are written to
+// temporary files for the uploaders, named after the file and the chunk's number.
+func (c *chunkedIngest) split(s *recordSplitter, jobs chan<- chunkJob) error {
+	ext := filepath.Ext(c.path)
+	base := strings.TrimSuffix(filepath.Base(c.path), ext)
+	for i := 0; ; i++ {
+		known := i < len(c.cp.Chunks)
+		if known && c.cp.Chunks[i].landed() {
+			records, size, err := s.chunk(io.Discard, c.cp.ChunkSize)
+			if err != nil {
+				return err
+			}
+			if size != c.cp.Chunks[i].Bytes || records != c.cp.Chunks[i].Records {
+				return fmt.Errorf("chunk %d has %d bytes now, but the checkpoint says %d; remove it or pass --restart", i+1, size, c.cp.Chunks[i].Bytes)
+			}
+			continue
+		}
+		tmp, err := os.CreateTemp("", fmt.Sprintf("%s.part%04d.*%s", base, i+1, ext))
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriterSize(tmp, 1<<20)
+		records, size, err := s.chunk(bw, c.cp.ChunkSize)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		c.mu.Lock()
+		if !known {
+			c.cp.Chunks = append(c.cp.Chunks, ingestChunkState{Tag: ingestTag(c.cp.Tag, strconv.FormatInt(c.cp.ChunkSize, 10), strconv.Itoa(i))})
+		}
+		c.cp.Chunks[i].Bytes, c.cp.Chunks[i].Records = size, records
+		c.mu.Unlock()
+		jobs <- chunkJob{index: i, file: tmp.Name()}
+	}
+}
+
+// upload queues one chunk, which the SDK uploads compressed, and removes its temporary file.
+func (c *chunkedIngest) upload(job chunkJob) error {
+	defer os.Remove(job.file)
+	c.mu.Lock()
+	chunk := c.cp.Chunks[job.index]
+	c.mu.Unlock()
+	ctx, cancel := c.timeouts.callContext(context.Background(), callIngest)
+	defer cancel()
+	res, err := c.queue(ctx, job.file, chunk.Tag, chunk.Bytes)
+	if err != nil {
+		return err
+	}
+	c.update(job.index, func(s *ingestChunkState) {
+		s.Status, s.Details = "Pending", ""
+		c.pending[job.index] = res
+	})
+	fmt.Fprintf(os.Stderr, "INGEST %s: queued chunk %d (%s, %d records) (ingest-by:%s)\n", c.path, job.index+1, formatBytes(chunk.Bytes), chunk.Records, chunk.Tag)
+	return nil
+}
+
+// summary prints the chunks by status and returns the exit status: that of a single ingestion with
+// the worst outcome among the chunks (see ingestExitCode), or 1 if some weren't even queued. The
+// checkpoint is removed once every chunk has landed.
+func (c *chunkedIngest) summary(failedUploads int, elapsed time.Duration) int {
+	counts := map[string]int{}
+	var records int64
+	for _, s := range c.cp.Chunks {
+		status := s.Status
+		if status == "" {
+			status = "not queued"
+		}
+		counts[status]++
+		records += s.Records
+	}
+	var parts []string
+	for _, status := range []string{"Succeeded", "Skipped", "PartiallySucceeded", "Failed", "Pending", "not queued"} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], strings.ToLower(status)))
+		}
+	}
+	desc := fmt.Sprintf("%d chunks of %d records in %s: %s", len(c.cp.Chunks), records, elapsed, strings.Join(parts, ", "))
+	failed := len(c.cp.Chunks) - counts["Succeeded"] - counts["Skipped"] - counts["PartiallySucceeded"]
+	if failed == 0 && failedUploads == 0 {
+		if err := os.Remove(c.checkpoint); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "WARN ingest %s: %v\n", c.path, err)
+		}
+	}
+	switch {
+	case failedUploads > 0 || counts["not queued"] > 0:
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s; run the same command again to retry the rest (checkpoint %s)\n", c.path, desc, c.checkpoint)
+		return 1
+	case counts["Failed"] > 0:
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s; run the same command again to retry the failed chunks (checkpoint %s)\n", c.path, desc, c.checkpoint)
+		return exitIngestFailed
+	case counts["Pending"] > 0:
+		fmt.Fprintf(os.Stderr, "FAIL ingest %s: %s; run the same command again to queue and follow them again (checkpoint %s)\n", c.path, desc, c.checkpoint)
+		return exitIngestTimeout
+	case counts["PartiallySucceeded"] > 0:
+		fmt.Fprintf(os.Stderr, "WARN ingest %s: %s\n", c.path, desc)
+		return exitIngestPartial
+	case counts["Skipped"] == len(c.cp.Chunks):
+		fmt.Fprintf(os.Stderr, "SKIPPED ingest %s: %s\n", c.path, desc)
+		return exitIngestSkipped
+	}
+	fmt.Fprintf(os.Stderr, "OK ingest %s: %s\n", c.path, desc)
+	return 0
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func splitAll(t *testing.T, data, format string, header bool, limit int64) []string {
+	t.Helper()
+	s, err := newRecordSplitter(strings.NewReader(data), format, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []string
+	for {
+		var b strings.Builder
+		_, size, err := s.chunk(&b, limit)
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(b.Len()) != size {
+			t.Errorf("chunk of %d bytes reported as %d", b.Len(), size)
+		}
+		chunks = append(chunks, b.String())
+	}
+}
+
+func TestRecordSplitter(t *testing.T) {
+	// The header starts every chunk, and a quoted line break doesn't end a record.
+	csv := "State,Note\nTEXAS,\"a\nb\"\nOHIO,\"say \"\"hi\"\"\"\nIOWA,c"
+	got := splitAll(t, csv, "csv", true, 25)
+	want := []string{"State,Note\nTEXAS,\"a\nb\"\n", "State,Note\nOHIO,\"say \"\"hi\"\"\"\n", "State,Note\nIOWA,c\n"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("csv: %q", got)
+	}
+	if got := splitAll(t, csv, "csv", true, 1000); len(got) != 1 || got[0] != csv+"\n" {
+		t.Errorf("csv in one chunk: %q", got)
+	}
+
+	if got := splitAll(t, "{\"a\":1}\n{\"a\":2}\n{\"a\":3}\n", "json", false, 16); len(got) != 2 || got[0] != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Errorf("json: %q", got)
+	}
+
+	// multijson objects come out one per line, out of their array.
+	got = splitAll(t, "[\n  {\"a\": 1},\n  {\"a\": [2,\n 3]}\n]\n", "multijson", false, 14)
+	if strings.Join(got, "|") != "{\"a\": 1}\n|{\"a\": [2,\n 3]}\n" {
+		t.Errorf("multijson: %q", got)
+	}
+	if got := splitAll(t, "{\"a\":1} {\"a\":2}", "multijson", false, 100); len(got) != 1 || got[0] != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Errorf("multijson stream: %q", got)
+	}
+}
+
+func TestChunkedIngest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.csv")
+	var data strings.Builder
+	data.WriteString("Id,Name\n")
+	for i := 0; i < 10; i++ {
+		data.WriteString("1,abcdef\n")
+	}
+	os.WriteFile(path, []byte(data.String()), 0o644)
+
+	var mu sync.Mutex
+	uploaded := map[string]string{} // by tag
+	failPart := "part0002"
+	calls := 0
+	queue := func(ctx context.Context, file, tag string, size int64) (ingestResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		name := filepath.Base(file)
+		if strings.Contains(name, failPart) {
+			return nil, errors.New("upload: 503 ServerBusy")
+		}
+		if !strings.HasPrefix(name, "events.part") || !strings.HasSuffix(name, ".csv") {
+			t.Errorf("chunk file %s", name)
+		}
+		b, _ := os.ReadFile(file)
+		if int64(len(b)) != size {
+			t.Errorf("%s: size %d for %d bytes", name, size, len(b))
+		}
+		uploaded[tag] = string(b)
+		return doneResult{}, nil
+	}
+	newIngest := func(resume bool) *chunkedIngest {
+		c := &chunkedIngest{path: path, format: "csv", header: true, checkpoint: path + ".ingest.json", parallel: 2, wait: time.Minute,
+			timeouts: resolveTimeouts(nil, nil, time.Minute), queue: queue,
+			cp: ingestChunkCheckpoint{Database: "db", Table: "T", SHA256: "x", ChunkSize: 40, Tag: "ingest-t"}}
+		if resume {
+			if _, err := c.resume(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return c
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+
+	// Chunk 2 fails to upload; the others land, and the checkpoint is kept.
+	if status := newIngest(true).run(f); status != 1 {
+		t.Errorf("first run: status %d", status)
+	}
+	if len(uploaded) != 3 {
+		t.Fatalf("%d chunks uploaded", len(uploaded))
+	}
+	for _, chunk := range uploaded {
+		if !strings.HasPrefix(chunk, "Id,Name\n1,abcdef\n") || len(chunk) > 40 {
+			t.Errorf("chunk %q", chunk)
+		}
+	}
+	if _, err := os.Stat(path + ".ingest.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same command again uploads chunk 2, and chunk 1 as if the first run had stopped before
+	// it landed: a pending chunk can only be followed by the run that queued it. Then the
+	// checkpoint is removed.
+	failPart = "none"
+	before := len(uploaded)
+	c := newIngest(true)
+	c.cp.Chunks[0].Status = "Pending"
+	if status := c.run(f); status != 0 {
+		t.Errorf("second run: status %d", status)
+	}
+	if len(uploaded) != before+1 || calls != 6 {
+		t.Errorf("second run uploaded %d chunks, %d queued in all", len(uploaded)-before, calls)
+	}
+	var rows []string
+	for _, chunk := range uploaded {
+		rows = append(rows, strings.Split(strings.TrimSuffix(chunk, "\n"), "\n")[1:]...)
+	}
+	if len(rows) != 10 || len(c.cp.Chunks) != 4 {
+		t.Errorf("%d rows in %d chunks", len(rows), len(c.cp.Chunks))
+	}
+	if _, err := os.Stat(path + ".ingest.json"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left: %v", err)
+	}
+
+	// A checkpoint of another chunk size isn't overwritten.
+	c.mu.Lock()
+	c.cp.ChunkSize = 80
+	c.save()
+	c.mu.Unlock()
+	if _, err := newIngest(false).resume(); err == nil || !strings.Contains(err.Error(), "another ingestion") {
+		t.Errorf("other checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustoingest"
+)
+
+// ingestRoutes implements flag.Value for "pattern=table[:mapping]" (repeatable): blobs whose
+// <container>/<path> matches pattern are ingested into table, with the named ingestion mapping.
+// A pattern is matched a path segment at a time with path.Match, so * doesn't cross a /, and a
+// ** segment matches any number of segments. The pattern ends at the last =, so it can hold
+// hive-style segments such as date=*.
+type ingestRoutes []ingestRoute
+
+type ingestRoute struct {
+	pattern, table, mapping string
+}
+
+func (r *ingestRoutes) String() string {
+	parts := make([]string, len(*r))
+	for i, route := range *r {
+		parts[i] = route.pattern + "=" + route.table
+		if route.mapping != "" {
+			parts[i] += ":" + route.mapping
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r *ingestRoutes) Set(v string) error {
+	i := strings.LastIndexByte(v, '=')
+	if i <= 0 {
+		return fmt.Errorf("expected pattern=table[:mapping], e.g. landing/sales/**/*.csv=Sales, got %q", v)
+	}
+	route := ingestRoute{pattern: v[:i]}
+	route.table, route.mapping, _ = strings.Cut(v[i+1:], ":")
+	if route.table == "" {
+		return fmt.Errorf("no table in %q", v)
+	}
+	for _, seg := range strings.Split(route.pattern, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("pattern %q: %v", route.pattern, err)
+		}
+	}
+	*r = append(*r, route)
+	return nil
+}
+
+// match returns the first route whose pattern matches name.
+func (r ingestRoutes) match(name string) (ingestRoute, bool) {
+	for _, route := range r {
+		if matchSegments(strings.Split(route.pattern, "/"), strings.Split(name, "/")) {
+			return route, true
+		}
+	}
+	return ingestRoute{}, false
+}
+
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// blobEvent is the part of a storage event ingest-events reads, in the Event Grid schema
+// (eventType) or the CloudEvents one (type).
+type blobEvent struct {
+	ID        string `json:"id"`
+	EventType string `json:"eventType"`
+	Type      string `json:"type"`
+	Data      struct {
+		API           string `json:"api"`
+		URL           string `json:"url"`
+		ETag          string `json:"eTag"`
+		ContentLength int64  `json:"contentLength"`
+	} `json:"data"`
+}
+
+func (e *blobEvent) kind() string {
+	if e.EventType != "" {
+		return e.EventType
+	}
+	return e.Type
+}
+
+// parseBlobEvents decodes a message's text: one event or an array of them, as JSON or
+// base64-encoded JSON. An error means the message can never succeed.
+func parseBlobEvents(text string) ([]blobEvent, error) {
+	data := bytes.TrimSpace([]byte(text))
+	if len(data) > 0 && data[0] != '{' && data[0] != '[' {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("neither JSON nor base64: %v", err)
+		}
+		data = bytes.TrimSpace(decoded)
+	}
+	var events []blobEvent
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &events); err != nil {
+			return nil, fmt.Errorf("not an event array: %v", err)
+		}
+	} else {
+		var e blobEvent
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("not an event: %v", err)
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		return nil, errors.New("no events")
+	}
+	return events, nil
+}
+
+// blobIngester queues the ingestion of the blobs named by the blob-created events it takes off a
+// queue, each into the table of the first route its path matches. Events for other blobs, and
+// other events, are skipped; a message is deleted once its blobs are queued. The ingestions are
+// tagged from the blob's URL and ETag, so an event delivered twice doesn't ingest its blob twice,
+// while a blob written again with new contents is ingested again.
+type blobIngester struct {
+	queueConsumer // its timeouts' ingest bounds queuing a blob
+	routes        ingestRoutes
+	database      string
+	opts          ingestOptions // format "": from each blob's extension
+	signer        *blobSigner
+	ingestor      azkustoingest.Ingestor
+}
+
+// blobIngestion is an event's blob, routed to a table.
+type blobIngestion struct {
+	event *blobEvent
+	route ingestRoute
+	opts  ingestOptions
+	tag   string
+}
+
+// route decides what to do with an event: ingest its blob, skip it (why says why), or neither,
+// returning an error, when the blob can never be ingested.
+func (b *blobIngester) route(e *blobEvent) (in *blobIngestion, why string, err error) {
+	if e.kind() != "Microsoft.Storage.BlobCreated" {
+		return nil, "a " + e.kind() + " event", nil
+	}
+	u, perr := url.Parse(e.Data.URL)
+	if perr != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, "", fmt.Errorf("event %s: bad blob URL %q", e.ID, e.Data.URL)
+	}
+	if e.Data.ContentLength == 0 {
+		// Data Lake sends one for the empty file CreateFile makes, and another once it is flushed.
+		return nil, "empty (" + e.Data.API + ")", nil
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	route, ok := b.routes.match(name)
+	if !ok {
+		return nil, "no --route matches " + name, nil
+	}
+	in = &blobIngestion{event: e, route: route, opts: b.opts}
+	in.opts.mapping = route.mapping
+	if in.opts.format == "" {
+		if in.opts.format = ingestFormat(name, true); in.opts.format == "" {
+			return nil, "", fmt.Errorf("event %s: can't tell the format of %s; set --format", e.ID, name)
+		}
+	}
+	in.tag = ingestTag("ingest", b.database, route.table, stripSAS(e.Data.URL), e.Data.ETag)
+	return in, "", nil
+}
+
+// ingest queues the ingestion of the blob.
+func (b *blobIngester) ingest(ctx context.Context, in *blobIngestion) error {
+	source, err := b.signer.source(ctx, in.event.Data.URL)
+	if err != nil {
+		return err
+	}
+	_, err = b.ingestor.FromFile(ctx, source, in.opts.fileOptions(b.database, in.route.table, in.tag, in.event.Data.ContentLength, false)...)
+	return err
+}
+
+// handle processes one received message.
+func (b *blobIngester) handle(ctx context.Context, m *queueMessage) {
+	events, err := parseBlobEvents(m.Text)
+	var todo []*blobIngestion
+	for i := 0; err == nil && i < len(events); i++ {
+		e := &events[i]
+		var in *blobIngestion
+		var why string
+		if in, why, err = b.route(e); in == nil && err == nil {
+			fmt.Fprintf(os.Stderr, "SKIPPED event %s: %s: %s\n", e.ID, stripSAS(e.Data.URL), why)
+		} else if in != nil {
+			todo = append(todo, in)
+		}
+	}
+	if err == nil && len(todo) > 0 {
+		err = b.exhausted(m)
+	}
+	if err != nil {
+		b.reject(ctx, m, err)
+		return
+	}
+	stop := b.keepHidden(ctx, m)
+	for _, in := range todo {
+		ictx, cancel := b.timeouts.callContext(ctx, callIngest)
+		err := b.ingest(ictx, in)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL event %s: queuing %s: %s; attempt %d of %d, retrying in %s\n",
+				in.event.ID, stripSAS(in.event.Data.URL), errText(err), m.DequeueCount, b.maxDequeue, b.retryDelay)
+			stop()
+			b.retry(ctx, m, "event "+in.event.ID)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "INGEST %s: queued for %s.%s (ingest-by:%s)\n", stripSAS(in.event.Data.URL), b.database, in.route.table, in.tag)
+	}
+	stop()
+	b.done(ctx, m, "message "+m.ID)
+}
+
+// runIngestEvents implements "ingest-events --queue <url> --route <pattern>=<table> [cluster-name]":
+// it takes the blob-created events an Event Grid subscription delivers to a storage queue and
+// queues each matching blob for ingestion as ingest --blob does, making a landing container a
+// feed for tables. It polls until interrupted, or with --drain until the queue is empty. It
+// doesn't follow the ingestions; their outcomes are in .show ingestion failures.
+func runIngestEvents(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("ingest-events", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	queueURL := fs.String("queue", os.Getenv("KUSTO_EVENT_QUEUE"), "queue the Event Grid subscription delivers to: https://<account>.queue.core.windows.net/<queue>[?<sas>]")
+	poisonURL := fs.String("poison-queue", "", "queue events that can't be ingested are moved to (default: the queue's name plus -poison)")
+	var routes ingestRoutes
+	fs.Var(&routes, "route", "ingest blobs whose <container>/<path> matches the pattern into the table, e.g. landing/sales/**/*.csv=Sales:Sales_csv (repeatable; the first match wins)")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database to ingest into")
+	format := fs.String("format", "", "data format: csv|tsv|json|multijson (default from each blob's extension, ahead of .gz or .zip)")
+	header := fs.Bool("ignore-first-record", false, "csv/tsv: skip each blob's header line")
+	flush := fs.Bool("flush", false, "ingest right away instead of batching with other ingestions (costly for small blobs)")
+	visibility := fs.Duration("visibility", 5*time.Minute, "how long a received event stays hidden from other consumers; extended while it is handled")
+	poll := fs.Duration("poll", 10*time.Second, "how long to wait before looking again when the queue is empty")
+	retryDelay := fs.Duration("retry-delay", time.Minute, "how long an event that failed waits before it is retried")
+	maxDequeue := fs.Int("max-dequeue", 5, "move an event to the poison queue once it has been received more than this many times")
+	drain := fs.Bool("drain", false, "exit once the queue is empty instead of polling")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	if *queueURL == "" || len(routes) == 0 {
+		log.Fatalf("ingest-events: --queue (or KUSTO_EVENT_QUEUE) and at least one --route are required")
+	}
+	if *visibility < 2*time.Second || *visibility > 7*24*time.Hour || *poll <= 0 || *retryDelay < 0 || *maxDequeue < 1 {
+		log.Fatalf("ingest-events: --visibility must be between 2s and 7 days, --poll positive, --retry-delay not negative and --max-dequeue at least 1")
+	}
+	if *format != "" && ingestMappingKind(*format) == "" {
+		log.Fatalf("ingest-events: unknown --format %q (csv|tsv|json|multijson)", *format)
+	}
+	queue, err := newStorageQueue("--queue", *queueURL)
+	if err != nil {
+		log.Fatalf("ingest-events: %v", err)
+	}
+	poison := queue.sibling("-poison")
+	if *poisonURL != "" {
+		if poison, err = newStorageQueue("--poison-queue", *poisonURL); err != nil {
+			log.Fatalf("ingest-events: %v", err)
+		}
+	}
+	if err := gate.confirm(cluster, fmt.Sprintf("queue blobs matching %s for ingestion into %s", routes.String(), *database), false); err != nil {
+		log.Fatalf("ingest-events: %v", err)
+	}
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+
+	startTokenRefresh(context.Background())
+	ingestor, err := newIngestor(cluster, transfer.client())
+	if err != nil {
+		log.Fatalf("failed creating Kusto ingest client: %v", err)
+	}
+	defer ingestor.Close()
+	b := &blobIngester{
+		queueConsumer: queueConsumer{queue: queue, poison: poison, visibility: *visibility, retryDelay: *retryDelay, maxDequeue: *maxDequeue, timeouts: timeouts},
+		routes:        routes,
+		database:      *database,
+		opts:          ingestOptions{format: *format, header: *header, flush: *flush},
+		signer:        newBlobSigner(),
+		ingestor:      ingestor,
+	}
+
+	fmt.Fprintf(os.Stderr, "QUEUE listening on %s, ingesting into %s by %s\n", stripSAS(queue.url), *database, routes.String())
+	b.consume(*poll, *drain, b.handle)
+}
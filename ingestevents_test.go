@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestRoutes(t *testing.T) {
+	var routes ingestRoutes
+	for _, v := range []string{"landing/sales/**/*.csv.gz=Sales:Sales_csv", "landing/events/date=*/*=Events"} {
+		if err := routes.Set(v); err != nil {
+			t.Fatalf("%s: %v", v, err)
+		}
+	}
+	for name, want := range map[string]string{
+		"landing/sales/2024/03/01/a.csv.gz": "Sales",
+		"landing/sales/a.csv.gz":            "Sales",
+		"landing/sales/2024/a.csv":          "",
+		"landing/events/date=2024-03-01/x":  "Events",
+		"landing/events/x":                  "",
+	} {
+		if got, _ := routes.match(name); got.table != want {
+			t.Errorf("%s: routed to %q, want %q", name, got.table, want)
+		}
+	}
+	for _, v := range []string{"Sales", "a/*.csv=", "a/[.csv=T"} {
+		if err := routes.Set(v); err == nil {
+			t.Errorf("%s: accepted", v)
+		}
+	}
+}
+
+func TestBlobIngester(t *testing.T) {
+	events := &fakeRequestQueue{messages: map[string]*queueMessage{}, blobs: map[string]string{}, hidden: map[string]string{}}
+	esrv := httptest.NewServer(events)
+	defer esrv.Close()
+	storage := newFakeIngestService(t)
+
+	queue := &storageQueue{url: esrv.URL + "/requests?sig=s", client: esrv.Client()}
+	var routes ingestRoutes
+	routes.Set("landing/sales/**=Sales:Sales_csv")
+	signer := newBlobSigner()
+	signer.containers["https://acct.blob.core.windows.net/landing"] = &scratchContainer{
+		base: "https://acct.blob.core.windows.net", account: "acct", container: "landing", key: []byte("secret")}
+	b := &blobIngester{
+		queueConsumer: queueConsumer{
+			queue:      queue,
+			poison:     queue.sibling("-poison"),
+			visibility: time.Minute,
+			retryDelay: time.Minute,
+			maxDequeue: 3,
+			timeouts:   resolveTimeouts(nil, nil, time.Minute),
+		},
+		routes:   routes,
+		database: "db",
+		signer:   signer,
+		ingestor: storage.ingestor(t),
+	}
+	receive := func(id, text string) *queueMessage {
+		m := &queueMessage{ID: id, PopReceipt: "r0-" + id, DequeueCount: 1, Text: text}
+		events.messages[id] = &queueMessage{ID: id, PopReceipt: m.PopReceipt}
+		return m
+	}
+	ctx := context.Background()
+
+	created := `{"id":"e1","eventType":"Microsoft.Storage.BlobCreated","subject":"/blobServices/default/containers/landing/blobs/sales/2024/a.csv.gz",
+		"data":{"api":"PutBlob","url":"https://acct.blob.core.windows.net/landing/sales/2024/a.csv.gz","eTag":"0x1","contentLength":120}}`
+	b.handle(ctx, receive("m1", created))
+	if len(storage.messages) != 1 {
+		t.Fatalf("%d ingestions queued, want 1", len(storage.messages))
+	}
+	q := storage.messages[0]
+	if !strings.HasPrefix(q.BlobPath, "https://acct.blob.core.windows.net/landing/sales/2024/a.csv.gz?") || !strings.Contains(q.BlobPath, "sp=r") {
+		t.Errorf("blob path %s, want the blob with a read SAS", q.BlobPath)
+	}
+	if q.TableName != "Sales" || q.RawDataSize != 120 || q.Properties["format"] != "csv" || q.Properties["ingestionMappingReference"] != "Sales_csv" ||
+		q.Properties["tags"] != `["ingest-by:`+ingestTag("ingest", "db", "Sales", "https://acct.blob.core.windows.net/landing/sales/2024/a.csv.gz", "0x1")+`"]` {
+		t.Errorf("ingestion %+v", q)
+	}
+	if _, ok := events.messages["m1"]; ok {
+		t.Error("the message of a queued blob was not deleted")
+	}
+
+	// A CloudEvents array, base64-encoded, with a blob no route matches and a deletion.
+	other := `[{"id":"e2","type":"Microsoft.Storage.BlobCreated","data":{"url":"https://acct.blob.core.windows.net/landing/hr/b.csv","contentLength":5}},
+		{"id":"e3","type":"Microsoft.Storage.BlobDeleted","data":{"url":"https://acct.blob.core.windows.net/landing/sales/c.csv"}}]`
+	b.handle(ctx, receive("m2", base64.StdEncoding.EncodeToString([]byte(other))))
+	if len(storage.messages) != 1 || len(events.poisoned) != 0 {
+		t.Errorf("skipped events: %d ingestions, %d poisoned", len(storage.messages), len(events.poisoned))
+	}
+	if _, ok := events.messages["m2"]; ok {
+		t.Error("a message with only skipped events was not deleted")
+	}
+
+	parquet := strings.ReplaceAll(created, "a.csv.gz", "a.parquet")
+	b.handle(ctx, receive("m3", parquet))
+	b.handle(ctx, receive("m4", "not an event"))
+	if len(events.poisoned) != 2 || len(storage.messages) != 1 {
+		t.Errorf("poisoned %d messages, want the blob of unknown format and the garbage", len(events.poisoned))
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/google/uuid"
+
+	"github.com/harche/kusto-example/pkg/classify"
+)
+
+// stdinBatcher ingests records as they arrive on a pipe, in batches: a batch is sent once the next
+// record would take it past limit bytes, once its first record has waited wait, or when the input
+// ends. Batches are sent one at a time, and records are read ahead only a few at a time, so a
+// cluster slower than the pipe holds up the program writing to it rather than filling memory.
+type stdinBatcher struct {
+	limit   int64
+	wait    time.Duration
+	retries int           // sends of a batch that failed with a transient error, after the first
+	backoff time.Duration // before the first retry, doubled for each next one up to maxStdinBackoff
+	send    func(batch int, data []byte) error
+
+	batches     int
+	records     int64
+	bytes       int64
+	interrupted bool
+}
+
+// maxStdinBackoff bounds the wait between two sends of a batch.
+const maxStdinBackoff = 30 * time.Second
+
+// run reads the records of s until they end or stop fires, and sends them in batches. The records
+// of a batch that still fails after its retries are lost, and run returns the error; a pipeline
+// that can't afford that should write its records to a file and ingest the file.
+func (b *stdinBatcher) run(s *recordSplitter, stop <-chan os.Signal) error {
+	records := make(chan []byte, 64)
+	var readErr error
+	go func() {
+		defer close(records)
+		for {
+			rec, err := s.next()
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+			if len(bytes.TrimSpace(rec)) > 0 {
+				records <- rec
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	var n int64
+	timer := time.NewTimer(b.wait)
+	timer.Stop()
+	flush := func() error {
+		timer.Stop()
+		if n == 0 {
+			return nil
+		}
+		err := b.flush(buf.Bytes(), n)
+		buf.Reset()
+		n = 0
+		return err
+	}
+	for {
+		select {
+		case rec, ok := <-records:
+			if !ok {
+				if err := flush(); err != nil {
+					return err
+				}
+				return readErr
+			}
+			if int64(len(rec)) > b.limit {
+				tooLarge := fmt.Errorf("record %d is %s, over the %s a batch takes", b.records+n+1, formatBytes(int64(len(rec))), formatBytes(b.limit))
+				if err := flush(); err != nil {
+					return err
+				}
+				return tooLarge
+			}
+			if int64(buf.Len()+len(rec)) > b.limit {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if n == 0 {
+				timer.Reset(b.wait)
+			}
+			buf.Write(rec)
+			n++
+		case <-timer.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-stop:
+			b.interrupted = true
+			return flush()
+		}
+	}
+}
+
+// flush sends one batch of n records, again after a transient error, up to b.retries times.
+func (b *stdinBatcher) flush(data []byte, n int64) error {
+	b.batches++
+	delay := b.backoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := b.send(b.batches, data)
+		if err == nil {
+			b.records += n
+			b.bytes += int64(len(data))
+			fmt.Fprintf(os.Stderr, "BATCH %d (%dms): %d records, %s; %d in total\n", b.batches, time.Since(start).Milliseconds(), n, formatBytes(int64(len(data))), b.records)
+			return nil
+		}
+		if attempt == b.retries || !transientIngestError(err) {
+			return fmt.Errorf("batch %d (%d records): %w", b.batches, n, err)
+		}
+		fmt.Fprintf(os.Stderr, "WARN ingest stdin: batch %d: %s; retrying in %s\n", b.batches, errText(err), delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxStdinBackoff {
+			delay = maxStdinBackoff
+		}
+	}
+}
+
+// transientIngestError reports whether sending a batch again may succeed: the cluster or storage
+// was throttling or answered with a server error, or the request didn't get through.
+func transientIngestError(err error) bool {
+	var sErr *streamIngestError
+	if errors.As(err, &sErr) {
+		return sErr.Status == http.StatusTooManyRequests || sErr.Status >= 500
+	}
+	var bErr *blobError
+	if errors.As(err, &bErr) {
+		return bErr.Status == http.StatusTooManyRequests || bErr.Status >= 500
+	}
+	var rErr *azcore.ResponseError
+	if errors.As(err, &rErr) {
+		return rErr.StatusCode == http.StatusTooManyRequests || rErr.StatusCode >= 500
+	}
+	return classify.IsThrottled(err) || classify.IsNetwork(err)
+}
+
+// stdinIngest is ingest --stdin: the target of the records, and how they are sent.
+type stdinIngest struct {
+	cluster, database, table string
+	format, mapping          string
+	header                   bool // csv/tsv: the first record is a header, dropped
+	streaming                bool
+	flush                    bool
+	batch                    int64
+	wait                     time.Duration
+	retries                  int
+	timeouts                 timeoutConfig
+}
+
+// run ingests stdin until it ends or the process is interrupted, and returns the exit status.
+func (in *stdinIngest) run() int {
+	s, err := newRecordSplitter(os.Stdin, in.format, in.header)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL ingest stdin: %s\n", errText(err))
+		return 1
+	}
+	b := &stdinBatcher{limit: in.batch, wait: in.wait, retries: in.retries, backoff: time.Second}
+	if in.streaming {
+		b.send = in.stream
+	} else {
+		if b.send, err = in.queuer(transfer.client()); err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL ingest stdin: ingest client of %s: %s\n", ingestURL(in.cluster), errText(err))
+			printRunbook(os.Stderr, "ingest", err)
+			return 1
+		}
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	start := time.Now()
+	err = b.run(s, interrupt)
+	done := fmt.Sprintf("%d records (%s) in %d batches into %s.%s in %s", b.records, formatBytes(b.bytes), b.batches, in.database, in.table, time.Since(start).Round(time.Second))
+	if !in.streaming {
+		done = fmt.Sprintf("%d records (%s) in %d batches queued for %s.%s in %s", b.records, formatBytes(b.bytes), b.batches, in.database, in.table, time.Since(start).Round(time.Second))
+	}
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "FAIL ingest stdin: %s; %s before it\n", errText(err), done)
+		printRunbook(os.Stderr, "ingest", err)
+		return 1
+	case b.interrupted:
+		fmt.Fprintf(os.Stderr, "OK ingest stdin: interrupted; %s\n", done)
+	default:
+		fmt.Fprintf(os.Stderr, "OK ingest stdin: %s\n", done)
+	}
+	return 0
+}
+
+// stream sends a batch with streaming ingestion.
+func (in *stdinIngest) stream(batch int, data []byte) error {
+	ctx, cancel := in.timeouts.callContext(context.Background(), callIngest)
+	defer cancel()
+	return streamIngest(ctx, transfer.client(), in.cluster, in.database, in.table, in.format, in.mapping, data)
+}
+
+// queuer returns a send func that queues a batch's ingestion without following it; the SDK
+// uploads it compressed. Each batch is tagged from the run and its number, so sending it again
+// after a failure can't ingest it twice. The SDK loads the ingestion resources again as they age,
+// as the pipe may stay open for days.
+func (in *stdinIngest) queuer(client *http.Client) (func(int, []byte) error, error) {
+	ingestor, err := newIngestor(in.cluster, client)
+	if err != nil {
+		return nil, err
+	}
+	run := uuid.NewString()
+	opts := ingestOptions{format: in.format, mapping: in.mapping, flush: in.flush}
+	return func(batch int, data []byte) error {
+		ctx, cancel := in.timeouts.callContext(context.Background(), callIngest)
+		defer cancel()
+		tag := ingestTag("stdin", in.database, in.table, run, strconv.Itoa(batch))
+		if _, err := ingestor.FromReader(ctx, bytes.NewReader(data), opts.fileOptions(in.database, in.table, tag, int64(len(data)), false)...); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "INGEST stdin: queued batch %d (ingest-by:%s)\n", batch, tag)
+		return nil
+	}, nil
+}
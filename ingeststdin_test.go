@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdinBatcher(t *testing.T) {
+	var sent []string
+	fail := 0 // sends that fail with a 503 before one succeeds
+	b := &stdinBatcher{limit: 12, wait: time.Hour, retries: 2, send: func(batch int, data []byte) error {
+		if fail > 0 {
+			fail--
+			return &streamIngestError{Status: 503, msg: "streaming ingestion: 503 Service Unavailable"}
+		}
+		sent = append(sent, string(data))
+		return nil
+	}}
+	s, _ := newRecordSplitter(strings.NewReader("Id,Name\n1,a\n\n2,b\n3,c\n4,d\n5,e\n"), "csv", true)
+	fail = 2
+	if err := b.run(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The header and the blank line are dropped, and batches hold whole records up to 12 bytes.
+	if strings.Join(sent, "|") != "1,a\n2,b\n3,c\n|4,d\n5,e\n" {
+		t.Errorf("batches %q", sent)
+	}
+	if b.records != 5 || b.batches != 2 {
+		t.Errorf("%d records in %d batches", b.records, b.batches)
+	}
+
+	// A permanent failure isn't retried.
+	calls := 0
+	b = &stdinBatcher{limit: 100, wait: time.Hour, retries: 5, send: func(int, []byte) error {
+		calls++
+		return &streamIngestError{Status: 400, msg: "streaming ingestion: 400 Bad Request"}
+	}}
+	s, _ = newRecordSplitter(strings.NewReader("{\"a\":1}\n"), "json", false)
+	if err := b.run(s, nil); err == nil || !strings.Contains(err.Error(), "batch 1 (1 records)") || calls != 1 {
+		t.Errorf("%v after %d sends", err, calls)
+	}
+	if !transientIngestError(errors.New("429 Too Many Requests")) || transientIngestError(&blobError{Status: 403, msg: "forbidden"}) {
+		t.Error("transientIngestError")
+	}
+
+	// A record waits at most wait for its batch to fill, and stopping sends what is held.
+	pr, pw := io.Pipe()
+	flushed := make(chan string, 2)
+	b = &stdinBatcher{limit: 1 << 20, wait: 20 * time.Millisecond, send: func(_ int, data []byte) error {
+		flushed <- string(data)
+		return nil
+	}}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error)
+	s, _ = newRecordSplitter(pr, "json", false)
+	go func() { done <- b.run(s, stop) }()
+	pw.Write([]byte("{\"a\":1}\n"))
+	if got := <-flushed; got != "{\"a\":1}\n" {
+		t.Errorf("flushed %q", got)
+	}
+	pw.Write([]byte("{\"a\":2}\n"))
+	time.Sleep(5 * time.Millisecond)
+	stop <- os.Interrupt
+	if err := <-done; err != nil || !b.interrupted {
+		t.Errorf("stop: %v", err)
+	}
+	if b.records != 2 {
+		t.Errorf("%d records sent by the stop", b.records)
+	}
+	pw.Close()
+}
+
+func TestStdinQueuer(t *testing.T) {
+	svc := newFakeIngestService(t)
+	in := &stdinIngest{cluster: "https://unused.kusto.windows.net", database: "db", table: "Events", format: "json", timeouts: resolveTimeouts(nil, nil, time.Minute)}
+	send, err := in.queuer(svc.srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for batch, data := range []string{"{\"a\":1}\n", "{\"a\":2}\n"} {
+		if err := send(batch+1, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(svc.messages) != 2 {
+		t.Fatalf("%d batches queued", len(svc.messages))
+	}
+	// Each batch has a tag of its own, and nothing follows it.
+	m1, m2 := svc.messages[0], svc.messages[1]
+	if got := svc.blob(t, m2); got != "{\"a\":2}\n" {
+		t.Errorf("batch 2 uploaded %q", got)
+	}
+	if m1.Properties["tags"] == m2.Properties["tags"] || m1.Properties["format"] != "json" || m1.RawDataSize != 8 || len(svc.records) != 0 {
+		t.Errorf("messages %+v and %+v", m1, m2)
+	}
+}
+
+func TestStdinStreamToken(t *testing.T) {
+	defer func(r *refreshingCredential) { tokenRefresh = r }(tokenRefresh)
+	cred := &countingCredential{ttl: time.Hour}
+	tokenRefresh = newRefreshingCredential(cred, 5*time.Minute)
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	// Every batch is sent with the token acquired for the first.
+	in := &stdinIngest{cluster: srv.URL, database: "db", table: "Events", format: "json", streaming: true, timeouts: resolveTimeouts(nil, nil, time.Minute)}
+	for batch := 1; batch <= 3; batch++ {
+		if err := in.stream(batch, []byte("{\"a\":1}\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cred.calls != 1 || strings.Join(auth, ",") != "Bearer t,Bearer t,Bearer t" {
+		t.Errorf("%d tokens acquired for requests with %q", cred.calls, auth)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// ingestField is where one table column's values come from: a CSV field by ordinal, a JSON
+// property by path, or a constant.
+type ingestField struct {
+	column   string
+	typ      string // the column's Kusto type, e.g. long
+	ordinal  int    // csv: the field, -1 for none
+	path     []string
+	constant *string
+}
+
+// mappingEntry is one element of an ingestion mapping as .show ingestion mapping returns it.
+type mappingEntry struct {
+	Column     string                 `json:"column"`
+	DataType   string                 `json:"datatype"`
+	Properties map[string]interface{} `json:"Properties"`
+}
+
+// ingestFields matches the table's columns to the file: through the mapping when there is one,
+// and otherwise as ingestion does without one, CSV fields by position and JSON properties by
+// column name.
+func ingestFields(columns []inferredColumn, mapping []mappingEntry, csvKind bool) ([]ingestField, error) {
+	types := make(map[string]string, len(columns))
+	for _, c := range columns {
+		types[c.Name] = c.Type
+	}
+	var fields []ingestField
+	if mapping == nil {
+		for i, c := range columns {
+			f := ingestField{column: c.Name, typ: c.Type, ordinal: -1}
+			if csvKind {
+				f.ordinal = i
+			} else {
+				f.path = []string{c.Name}
+			}
+			fields = append(fields, f)
+		}
+		return fields, nil
+	}
+	for _, m := range mapping {
+		typ, ok := types[m.Column]
+		if !ok {
+			return nil, fmt.Errorf("the mapping's column %s isn't in the table", m.Column)
+		}
+		f := ingestField{column: m.Column, typ: typ, ordinal: -1}
+		prop := func(name string) (string, bool) {
+			for k, v := range m.Properties {
+				if strings.EqualFold(k, name) && v != nil {
+					return fmt.Sprint(v), true
+				}
+			}
+			return "", false
+		}
+		if v, ok := prop("ConstValue"); ok {
+			f.constant = &v
+		} else if csvKind {
+			v, _ := prop("Ordinal")
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("the mapping of column %s has no valid Ordinal (%q)", m.Column, v)
+			}
+			f.ordinal = n
+		} else {
+			v, _ := prop("Path")
+			path, err := parseJSONPath(v)
+			if err != nil {
+				return nil, fmt.Errorf("the mapping of column %s: %v", m.Column, err)
+			}
+			f.path = path
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+var jsonPathStep = regexp.MustCompile(`^(?:\.([A-Za-z_][A-Za-z0-9_]*)|\['((?:[^'\\]|\\.)*)'\]|\["((?:[^"\\]|\\.)*)"\]|\[(\d+)\])`)
+
+// parseJSONPath splits a mapping path, such as $.a.b, $['a b'] or $.items[0], into property
+// names and array indexes.
+func parseJSONPath(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("path %q doesn't start with $", p)
+	}
+	var steps []string
+	for rest := p[1:]; rest != ""; {
+		m := jsonPathStep.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("can't read path %q at %q", p, rest)
+		}
+		switch {
+		case m[1] != "":
+			steps = append(steps, m[1])
+		case m[4] != "":
+			steps = append(steps, "["+m[4]+"]")
+		default:
+			steps = append(steps, strings.NewReplacer(`\'`, `'`, `\"`, `"`, `\\`, `\`).Replace(m[2]+m[3]))
+		}
+		rest = rest[len(m[0]):]
+	}
+	return steps, nil
+}
+
+// jsonAt is the value at path in doc, and whether it is there.
+func jsonAt(doc interface{}, path []string) (interface{}, bool) {
+	for _, step := range path {
+		if strings.HasPrefix(step, "[") && strings.HasSuffix(step, "]") {
+			if arr, ok := doc.([]interface{}); ok {
+				i, _ := strconv.Atoi(step[1 : len(step)-1])
+				if i >= len(arr) {
+					return nil, false
+				}
+				doc = arr[i]
+				continue
+			}
+		}
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[step]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// timespanClock matches timespans as [-][d.]hh:mm[:ss[.fffffff]], e.g. 1.02:03:04.5.
+var timespanClock = regexp.MustCompile(`^-?(\d+\.)?\d{1,2}:\d{2}(:\d{2}(\.\d{1,7})?)?$`)
+
+// coerceText checks that text reads as a value of a Kusto type the way ingestion reads it. Text
+// that doesn't is ingested as null, which is what the error says.
+func coerceText(typ, s string) error {
+	s = strings.TrimSpace(s)
+	var ok bool
+	switch typ {
+	case "string", "dynamic":
+		return nil
+	case "bool":
+		ok = strings.EqualFold(s, "true") || strings.EqualFold(s, "false") || s == "0" || s == "1"
+	case "int":
+		_, err := strconv.ParseInt(s, 10, 32)
+		ok = err == nil
+	case "long":
+		_, err := strconv.ParseInt(s, 10, 64)
+		ok = err == nil
+	case "real":
+		_, err := strconv.ParseFloat(s, 64)
+		ok = err == nil
+	case "decimal":
+		_, err := decimal.NewFromString(s)
+		ok = err == nil
+	case "datetime":
+		ok = inferDateTime(s)
+		for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", time.RFC1123, time.RFC1123Z} {
+			if _, err := time.Parse(layout, s); err == nil {
+				ok = true
+			}
+		}
+	case "timespan":
+		ok = timespanClock.MatchString(s) || timespanLiteral.MatchString(strings.TrimPrefix(s, "-"))
+	case "guid":
+		_, err := uuid.Parse(s)
+		ok = err == nil
+	default:
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("%q isn't a %s", cutCell(s, 40), typ)
+	}
+	return nil
+}
+
+// coerceJSON is coerceText for a JSON value.
+func coerceJSON(typ string, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return coerceText(typ, x)
+	case json.Number:
+		switch typ {
+		case "bool", "int", "long", "real", "decimal", "string", "dynamic":
+			return coerceText(typ, x.String())
+		}
+		return fmt.Errorf("the number %s isn't a %s", x, typ)
+	case bool:
+		switch typ {
+		case "bool", "string", "dynamic":
+			return nil
+		}
+		return fmt.Errorf("%v isn't a %s", x, typ)
+	}
+	switch typ {
+	case "dynamic", "string":
+		return nil
+	}
+	return fmt.Errorf("an object or array isn't a %s", typ)
+}
+
+// ingestValidation is what validating a file found: its rows, the rows with problems and the
+// first few problems, each with its line or record.
+type ingestValidation struct {
+	rows      int64
+	bad       int64
+	problems  []string
+	found     int // problems, including the ones past max
+	max       int
+	missing   map[string]int64 // json: rows without a value for the column
+	rowFailed bool
+}
+
+func (v *ingestValidation) problem(where, format string, args ...interface{}) {
+	if !v.rowFailed {
+		v.rowFailed = true
+		v.bad++
+	}
+	v.found++
+	if len(v.problems) < v.max {
+		v.problems = append(v.problems, where+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (v *ingestValidation) endRow() {
+	v.rows++
+	v.rowFailed = false
+}
+
+// validateCSV reads every record of a CSV or TSV file and checks its field count and values
+// against fields.
+func validateCSV(r io.Reader, tsv, header bool, fields []ingestField, v *ingestValidation) error {
+	cr := csv.NewReader(bufio.NewReaderSize(r, 1<<20))
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	if tsv {
+		cr.Comma = '\t'
+	}
+	want := 0
+	for _, f := range fields {
+		want = max(want, f.ordinal+1)
+	}
+	first := true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			v.problem(fmt.Sprintf("line %d", perr.StartLine), "%v", perr.Err)
+			v.endRow()
+			first = false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if first && header {
+			first = false
+			continue
+		}
+		first = false
+		line, _ := cr.FieldPos(0)
+		where := fmt.Sprintf("line %d", line)
+		if len(rec) < want {
+			v.problem(where, "%d fields, where %d are read; the missing ones would be null", len(rec), want)
+		} else if len(rec) > want && want > 0 {
+			v.problem(where, "%d fields, where %d are read; the extra ones would be dropped", len(rec), want)
+		}
+		for _, f := range fields {
+			if f.ordinal < 0 || f.ordinal >= len(rec) || rec[f.ordinal] == "" {
+				continue
+			}
+			if err := coerceText(f.typ, rec[f.ordinal]); err != nil {
+				v.problem(where, "column %s: %v; it would be ingested as null", f.column, err)
+			}
+		}
+		v.endRow()
+	}
+}
+
+// validateJSON reads every object of a json (one per line) or multijson file and checks the
+// values at the fields' paths.
+func validateJSON(r io.Reader, multi bool, fields []ingestField, v *ingestValidation) error {
+	check := func(where string, doc interface{}) {
+		defer v.endRow()
+		if _, ok := doc.(map[string]interface{}); !ok {
+			v.problem(where, "not a JSON object")
+			return
+		}
+		for _, f := range fields {
+			if f.path == nil {
+				continue
+			}
+			val, ok := jsonAt(doc, f.path)
+			if !ok {
+				v.missing[f.column]++
+				continue
+			}
+			if err := coerceJSON(f.typ, val); err != nil {
+				v.problem(where, "column %s: %v; it would be ingested as null", f.column, err)
+			}
+		}
+	}
+	br := bufio.NewReaderSize(r, 1<<20)
+	if !multi {
+		for line := 1; ; line++ {
+			b, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(b)) > 0 {
+				dec := json.NewDecoder(bytes.NewReader(b))
+				dec.UseNumber()
+				var doc interface{}
+				if derr := dec.Decode(&doc); derr != nil {
+					v.problem(fmt.Sprintf("line %d", line), "%v", derr)
+					v.endRow()
+				} else {
+					check(fmt.Sprintf("line %d", line), doc)
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// multijson is objects one after another, or an array of them.
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+	if first, err := firstNonSpace(br); err != nil {
+		return nil
+	} else if first == '[' {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	for n := 1; dec.More(); n++ {
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			return fmt.Errorf("record %d (byte %d): %w; the rest of the file can't be read", n, dec.InputOffset(), err)
+		}
+		check(fmt.Sprintf("record %d", n), doc)
+	}
+	return nil
+}
+
+// firstNonSpace is the first byte of br that isn't white space, left unread.
+func firstNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			return b, br.UnreadByte()
+		}
+	}
+}
+
+// ingestTarget is the columns of database.table and the entries of its mapping (nil without one).
+// When the table doesn't exist it is the schema ingest would infer and offer to create, which is
+// printed.
+func ingestTarget(ctx context.Context, client *azkustodata.Client, database, table, mapping, format string, f *os.File, header bool) ([]inferredColumn, []mappingEntry, error) {
+	exists, err := tableExists(ctx, client, database, table)
+	if err != nil {
+		return nil, nil, fmt.Errorf("looking for table %s: %w", table, err)
+	}
+	if !exists {
+		if mapping != "" {
+			return nil, nil, fmt.Errorf("table %s.%s doesn't exist, so neither does mapping %s", database, table, mapping)
+		}
+		cols, rows, err := inferSchema(f, format, header, 1000)
+		if err != nil {
+			return nil, nil, fmt.Errorf("table %s doesn't exist, and its schema can't be inferred: %v", table, err)
+		}
+		fmt.Printf("Table %s.%s doesn't exist; ingest would offer to create it:\n", database, table)
+		printSchema(os.Stdout, table, cols, rows)
+		fmt.Printf("  %s\n", createTableCommand(table, cols))
+		return cols, nil, nil
+	}
+	sec, err := mgmtSection(ctx, client, database, "", ".show table "+kqlquote.Ident(table)+" schema as json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("schema of %s: %w", table, err)
+	}
+	var schema struct {
+		OrderedColumns []struct{ Name, CslType string }
+	}
+	if i := columnIndex(sec.Columns, "Schema"); i < 0 || len(sec.Rows) == 0 {
+		return nil, nil, fmt.Errorf("schema of %s: none returned", table)
+	} else if err := json.Unmarshal([]byte(sec.Rows[0][i]), &schema); err != nil {
+		return nil, nil, fmt.Errorf("schema of %s: %v", table, err)
+	}
+	var cols []inferredColumn
+	for _, c := range schema.OrderedColumns {
+		cols = append(cols, inferredColumn{Name: c.Name, Type: c.CslType})
+	}
+	if mapping == "" {
+		return cols, nil, nil
+	}
+	kind := strings.ToLower(ingestMappingKind(format))
+	sec, err = mgmtSection(ctx, client, database, "", fmt.Sprintf(".show table %s ingestion %s mapping %s", kqlquote.Ident(table), kind, kqlquote.String(mapping)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("mapping %s: %w", mapping, err)
+	}
+	entries := []mappingEntry{}
+	if i := columnIndex(sec.Columns, "Mapping"); i < 0 || len(sec.Rows) == 0 {
+		return nil, nil, fmt.Errorf("table %s has no %s mapping named %s", table, kind, mapping)
+	} else if err := json.Unmarshal([]byte(sec.Rows[0][i]), &entries); err != nil {
+		return nil, nil, fmt.Errorf("mapping %s: %v", mapping, err)
+	}
+	return cols, entries, nil
+}
+
+// validateIngest checks a local file against database.table without uploading anything: that it
+// parses, that its records have the fields the table or mapping reads, and that the values convert
+// to the columns' types. It prints what it found and reports whether every row would ingest as
+// is; the error is for failing to check at all.
+func validateIngest(cluster, database, table, mapping, format string, header bool, f *os.File, size int64, maxProblems int, timeouts timeoutConfig) (bool, error) {
+	client, err := newClient(cluster)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	ctx, cancel := timeouts.callContext(context.Background(), callMgmt)
+	defer cancel()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	columns, entries, err := ingestTarget(ctx, client, database, table, mapping, format, f, header)
+	if err != nil {
+		return false, err
+	}
+	fields, err := ingestFields(columns, entries, ingestMappingKind(format) == "Csv")
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	v := &ingestValidation{max: maxProblems, missing: map[string]int64{}}
+	if ingestMappingKind(format) == "Csv" {
+		err = validateCSV(f, format == "tsv", header, fields, v)
+	} else {
+		err = validateJSON(f, format == "multijson", fields, v)
+	}
+	if err != nil {
+		v.problem("reading the file", "%v", err)
+	}
+	printIngestValidation(os.Stdout, v, fields, size)
+	return v.bad == 0, nil
+}
+
+// printIngestValidation writes the rows and size a validation found, the columns some rows have
+// no value for, and the first problems.
+func printIngestValidation(w io.Writer, v *ingestValidation, fields []ingestField, size int64) {
+	perRow := int64(0)
+	if v.rows > 0 {
+		perRow = size / v.rows
+	}
+	fmt.Fprintf(w, "%d rows, %s (%s per row)\n", v.rows, formatBytes(size), formatBytes(perRow))
+	for _, f := range fields {
+		if n := v.missing[f.column]; n > 0 {
+			fmt.Fprintf(w, "  column %s: no value in %d rows, which would be null\n", f.column, n)
+		}
+	}
+	if v.bad == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d rows with problems:\n", v.bad)
+	for _, p := range v.problems {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	if v.found > len(v.problems) {
+		fmt.Fprintf(w, "  (the first %d of %d problems; --validate-errors shows more)\n", len(v.problems), v.found)
+	}
+}
+
+// columnIndex is the index of name in columns, or -1.
+func columnIndex(columns []string, name string) int {
+	for i, c := range columns {
+		if c == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCoerceText(t *testing.T) {
+	for _, c := range []struct {
+		typ, s string
+		ok     bool
+	}{
+		{"long", "42", true},
+		{"long", "4.2", false},
+		{"int", "3000000000", false},
+		{"real", "NaN", true},
+		{"real", "1,5", false},
+		{"decimal", "0.10", true},
+		{"bool", "True", true},
+		{"bool", "yes", false},
+		{"datetime", "2024-03-01 12:00", true},
+		{"datetime", "03/01/2024", false},
+		{"timespan", "1.02:03:04.5", true},
+		{"timespan", "-30m", true},
+		{"timespan", "soon", false},
+		{"guid", "6ba7b810-9dad-11d1-80b4-00c04fd430c8", true},
+		{"guid", "6ba7b810", false},
+		{"dynamic", "{not json", true},
+	} {
+		if err := coerceText(c.typ, c.s); (err == nil) != c.ok {
+			t.Errorf("coerceText(%s, %q) = %v", c.typ, c.s, err)
+		}
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	for p, want := range map[string]string{
+		"$.a.b":           "a|b",
+		"$['a b'].c":      "a b|c",
+		`$["x"].items[1]`: "x|items|[1]",
+		"$":               "",
+	} {
+		got, err := parseJSONPath(p)
+		if err != nil || strings.Join(got, "|") != want {
+			t.Errorf("parseJSONPath(%q) = %q, %v", p, got, err)
+		}
+	}
+	for _, p := range []string{"a.b", "$.a..b", "$[x]"} {
+		if _, err := parseJSONPath(p); err == nil {
+			t.Errorf("parseJSONPath(%q): no error", p)
+		}
+	}
+}
+
+var validateColumns = []inferredColumn{{Name: "State", Type: "string"}, {Name: "Events", Type: "long"}, {Name: "Start", Type: "datetime"}}
+
+func TestValidateCSV(t *testing.T) {
+	fields, err := ingestFields(validateColumns, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := "State,Events,Start\nTEXAS,3,2024-03-01\nOHIO,many,2024-03-02\nIOWA,2\n\"NEW\nYORK\",7,later,x\nUTAH,1,\n"
+	v := &ingestValidation{max: 2, missing: map[string]int64{}}
+	if err := validateCSV(strings.NewReader(data), false, true, fields, v); err != nil {
+		t.Fatal(err)
+	}
+	if v.rows != 5 || v.bad != 3 || v.found != 4 {
+		t.Errorf("%d rows, %d bad, %d problems", v.rows, v.bad, v.found)
+	}
+	want := []string{`line 3: column Events: "many" isn't a long; it would be ingested as null`, "line 4: 2 fields, where 3 are read; the missing ones would be null"}
+	if strings.Join(v.problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems:\n%s", strings.Join(v.problems, "\n"))
+	}
+
+	// A mapping reads the fields it names, wherever they are.
+	fields, err = ingestFields(validateColumns, []mappingEntry{
+		{Column: "Events", Properties: map[string]interface{}{"Ordinal": "0"}},
+		{Column: "State", Properties: map[string]interface{}{"ConstValue": "TEXAS"}},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = &ingestValidation{max: 10, missing: map[string]int64{}}
+	validateCSV(strings.NewReader("1\n2\nthree\n"), false, false, fields, v)
+	if v.rows != 3 || v.bad != 1 || !strings.HasPrefix(v.problems[0], "line 3: column Events") {
+		t.Errorf("mapped: %d rows, %d bad, %q", v.rows, v.bad, v.problems)
+	}
+	if _, err := ingestFields(validateColumns, []mappingEntry{{Column: "Nope", Properties: map[string]interface{}{"Ordinal": "0"}}}, true); err == nil {
+		t.Error("a mapping of a column the table doesn't have: no error")
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	fields, err := ingestFields(validateColumns, []mappingEntry{
+		{Column: "State", Properties: map[string]interface{}{"Path": "$.where.state"}},
+		{Column: "Events", Properties: map[string]interface{}{"Path": "$.events"}},
+		{Column: "Start", Properties: map[string]interface{}{"Path": "$['start']"}},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := `{"where":{"state":"TEXAS"},"events":3,"start":"2024-03-01T00:00:00Z"}
+{"where":{"state":"OHIO"},"events":1.5}
+
+{"events":"2","start":true}
+{broken
+`
+	v := &ingestValidation{max: 10, missing: map[string]int64{}}
+	if err := validateJSON(strings.NewReader(lines), false, fields, v); err != nil {
+		t.Fatal(err)
+	}
+	if v.rows != 4 || v.bad != 3 || v.missing["State"] != 1 || v.missing["Start"] != 1 {
+		t.Errorf("%d rows, %d bad, missing %v", v.rows, v.bad, v.missing)
+	}
+	if got := strings.Join(v.problems, "\n"); !strings.Contains(got, `line 2: column Events: "1.5" isn't a long`) ||
+		!strings.Contains(got, "line 4: column Start: true isn't a datetime") || !strings.Contains(got, "line 5: ") {
+		t.Errorf("problems:\n%s", got)
+	}
+
+	// multijson is an array of objects, or objects one after another, numbered by record.
+	for _, data := range []string{`[{"events":1}, {"events":"x"}]`, "{\"events\":1}\n{\n\"events\":\"x\"}"} {
+		v = &ingestValidation{max: 10, missing: map[string]int64{}}
+		if err := validateJSON(strings.NewReader(data), true, fields, v); err != nil {
+			t.Fatal(err)
+		}
+		if v.rows != 2 || v.bad != 1 || !strings.HasPrefix(v.problems[0], "record 2: column Events") {
+			t.Errorf("multijson %s: %d rows, %q", data, v.rows, v.problems)
+		}
+	}
+}
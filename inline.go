@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// maxInlineBytes bounds --inline-data. The datatable travels inside the query text, and larger
+// reference data belongs in a table.
+const maxInlineBytes = 1 << 20
+
+// inlineDataTable reads a small CSV or TSV file and returns a let statement binding it as a
+// datatable named name, to prepend to a query. Column names and types come from columnSchema.
+// Empty cells are nulls, except in string columns.
+func inlineDataTable(path, name string) (string, error) {
+	f, r, header, err := openDelimited(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxInlineBytes {
+		return "", fmt.Errorf("%s is %s; inline data is limited to %s, ingest larger files into a table or use --external-data", path, formatBytes(fi.Size()), formatBytes(maxInlineBytes))
+	}
+	rows, err := readDelimited(path, r, -1)
+	if err != nil {
+		return "", err
+	}
+	names, typs, err := columnSchema(path, header, rows)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "let %s = datatable(", kqlquote.Ident(name))
+	for i := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s:%s", kqlquote.Ident(names[i]), typs[i])
+	}
+	b.WriteString(") [")
+	for n, rec := range rows {
+		lits := make([]string, len(names))
+		for i := range names {
+			cell := ""
+			if i < len(rec) {
+				cell = rec[i]
+			}
+			if lits[i], err = inlineLiteral(typs[i], cell); err != nil {
+				return "", fmt.Errorf("%s: row %d, column %s: %v", path, n+2, names[i], err)
+			}
+		}
+		sep := ","
+		if n == len(rows)-1 {
+			sep = ""
+		}
+		b.WriteString("\n    " + strings.Join(lits, ", ") + sep)
+	}
+	b.WriteString("\n];\n")
+	return b.String(), nil
+}
+
+// openDelimited opens a CSV or TSV file (tab-separated for .tsv/.tab files) and reads its header
+// row.
+func openDelimited(path string) (*os.File, *csv.Reader, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r := csv.NewReader(f)
+	if delimitedFormat(path) == "tsv" {
+		r.Comma = '\t'
+		r.LazyQuotes = true
+	}
+	header, err := r.Read()
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("%s: no header row: %v", path, err)
+	}
+	return f, r, header, nil
+}
+
+// delimitedFormat is "tsv" for .tsv/.tab files and "csv" otherwise.
+func delimitedFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tsv", ".tab":
+		return "tsv"
+	}
+	return "csv"
+}
+
+// readDelimited reads up to max records after the header (all of them if max < 0).
+func readDelimited(path string, r *csv.Reader, max int) ([][]string, error) {
+	var rows [][]string
+	for max < 0 || len(rows) < max {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		rows = append(rows, rec)
+	}
+	return rows, nil
+}
+
+// columnSchema returns the column names and KQL types of a delimited file. "Name:type" in the
+// header pins a column's type; otherwise it is inferred from rows: long, real, bool or datetime
+// (RFC 3339) when every non-empty value parses as one, else string.
+func columnSchema(path string, header []string, rows [][]string) (names, typs []string, err error) {
+	names = make([]string, len(header))
+	typs = make([]string, len(header))
+	for i, h := range header {
+		names[i] = strings.TrimSpace(h)
+		if n, t, ok := strings.Cut(names[i], ":"); ok {
+			switch t = strings.ToLower(strings.TrimSpace(t)); t {
+			case "string", "long", "int", "real", "double", "bool", "datetime":
+			default:
+				return nil, nil, fmt.Errorf("%s: column %q: unsupported type %q", path, n, t)
+			}
+			names[i], typs[i] = strings.TrimSpace(n), t
+		} else {
+			typs[i] = inferInlineType(rows, i)
+		}
+	}
+	return names, typs, nil
+}
+
+// inferInlineType picks the narrowest type all non-empty values of column i parse as.
+func inferInlineType(rows [][]string, i int) string {
+	for _, t := range []string{"long", "real", "bool", "datetime"} {
+		fits, seen := true, false
+		for _, rec := range rows {
+			if i >= len(rec) || strings.TrimSpace(rec[i]) == "" {
+				continue
+			}
+			seen = true
+			if _, err := inlineLiteral(t, rec[i]); err != nil {
+				fits = false
+				break
+			}
+		}
+		if fits && seen {
+			return t
+		}
+	}
+	return "string"
+}
+
+// inlineLiteral renders one cell as a literal of type t.
+func inlineLiteral(t, cell string) (string, error) {
+	if t == "string" {
+		return kqlquote.String(cell), nil
+	}
+	v := strings.TrimSpace(cell)
+	if v == "" {
+		return t + "(null)", nil
+	}
+	switch t {
+	case "long", "int":
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return "", fmt.Errorf("%q is not an integer", v)
+		}
+		return v, nil
+	case "real", "double":
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return "", fmt.Errorf("%q is not a number", v)
+		}
+		return "real(" + strconv.FormatFloat(f, 'g', -1, 64) + ")", nil
+	case "bool":
+		bv, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a bool", v)
+		}
+		return strconv.FormatBool(bv), nil
+	case "datetime":
+		tv, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return "", fmt.Errorf("%q is not an RFC 3339 datetime", v)
+		}
+		return "datetime(" + tv.UTC().Format(time.RFC3339Nano) + ")", nil
+	}
+	return "", fmt.Errorf("unsupported type %q", t)
+}
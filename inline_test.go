@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInlineDataTable(t *testing.T) {
+	tests := []struct {
+		file, data string
+		want       string
+		err        string
+	}{
+		{file: "regions.csv", data: "Region,Weight,Active,Since,Code:string\nwest,1.5,true,2024-06-01T00:00:00+02:00,01\n\"it's \"\"east\"\"\",,false,,\n",
+			want: "let ['Regions'] = datatable(['Region']:string, ['Weight']:real, ['Active']:bool, ['Since']:datetime, ['Code']:string) [" +
+				"\n    \"west\", real(1.5), true, datetime(2024-05-31T22:00:00Z), \"01\"," +
+				"\n    \"it\\'s \\\"east\\\"\", real(null), false, datetime(null), \"\"" +
+				"\n];\n"},
+		{file: "counts.tsv", data: "Id\tName\n1\ta \"b\"\n2\t\n",
+			want: "let ['Regions'] = datatable(['Id']:long, ['Name']:string) [" +
+				"\n    1, \"a \\\"b\\\"\"," +
+				"\n    2, \"\"" +
+				"\n];\n"},
+		{file: "empty.csv", data: "Id:long\n",
+			want: "let ['Regions'] = datatable(['Id']:long) [\n];\n"},
+		{file: "pinned.csv", data: "Id:long\n7\nx\n", err: "pinned.csv: row 3, column Id: \"x\" is not an integer"},
+		{file: "bad.csv", data: "Id:uuid\n1\n", err: `column "Id": unsupported type "uuid"`},
+		{file: "none.csv", data: "", err: "no header row"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.file)
+		if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := inlineDataTable(path, "Regions")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.file, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: (%v)\n%s\nwant\n%s", tt.file, err, got, tt.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "big.csv")
+	os.WriteFile(path, []byte("Id\n"+strings.Repeat("1\n", maxInlineBytes/2)), 0o644)
+	if _, err := inlineDataTable(path, "Big"); err == nil || !strings.Contains(err.Error(), "inline data is limited to 1.0 MiB") {
+		t.Errorf("file over the limit: %v", err)
+	}
+}
+
+func TestInferInlineType(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"1", "-20", ""}, "long"},
+		{[]string{"1", "2.5"}, "real"},
+		{[]string{"1e3", "NaN"}, "string"},
+		{[]string{"true", "FALSE", "0"}, "bool"},
+		{[]string{"2024-06-01T00:00:00Z", "2024-06-01T00:00:00.5+01:00"}, "datetime"},
+		{[]string{"2024-06-01"}, "string"},
+		{[]string{"", " "}, "string"},
+	}
+	for _, tt := range tests {
+		var rows [][]string
+		for _, v := range tt.values {
+			rows = append(rows, []string{v})
+		}
+		if got := inferInlineType(rows, 0); got != tt.want {
+			t.Errorf("inferInlineType(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
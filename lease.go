@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// leaseDuration is how long a lease lasts without renewal (the blob service allows 15s to 60s).
+// A replica that dies holding it blocks the others for at most this long.
+const leaseDuration = 60 * time.Second
+
+// errLeaseHeld is returned by acquireLease when another replica holds the lease.
+var errLeaseHeld = errors.New("the lease is held by another replica")
+
+// leaderLease is an Azure Blob lease that elects one of several replicas running the same job
+// as its leader: the others find the lease taken and stand by, so two replicas deployed for
+// availability don't both deliver the same rows downstream. The leader renews the lease in the
+// background; if a renewal fails for long enough that the lease may have passed to another
+// replica, the context from acquireLease is cancelled, so the leader stops before it commits
+// anything.
+type leaderLease struct {
+	c      *scratchContainer
+	name   string
+	id     string
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// acquireLease takes the lease on blob name in c, creating the blob if needed. The returned
+// context is ctx, cancelled when the lease is lost; release ends it.
+func acquireLease(ctx context.Context, c *scratchContainer, name string) (*leaderLease, context.Context, error) {
+	l := &leaderLease{c: c, name: name, id: uuid.NewString(), done: make(chan struct{})}
+	err := l.call(ctx, "acquire")
+	var be *blobError
+	if errors.As(err, &be) && be.Code == "BlobNotFound" {
+		if err = l.create(ctx); err == nil {
+			err = l.call(ctx, "acquire")
+		}
+	}
+	if errors.As(err, &be) && be.Code == "LeaseAlreadyPresent" {
+		return nil, nil, errLeaseHeld
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	leaderCtx, cancel := context.WithCancel(ctx)
+	l.cancel = cancel
+	go l.renew()
+	return l, leaderCtx, nil
+}
+
+// renew renews the lease three times per period. A refused renewal means another replica has
+// it; other failures are retried until two thirds of the period have passed since the last
+// renewal, leaving the rest as a margin before the lease can expire.
+func (l *leaderLease) renew() {
+	t := time.NewTicker(leaseDuration / 3)
+	defer t.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), leaseDuration/6)
+		err := l.call(ctx, "renew")
+		cancel()
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+		var be *blobError
+		if (errors.As(err, &be) && be.Status == http.StatusConflict) || time.Since(renewed) > 2*leaseDuration/3 {
+			fmt.Fprintf(os.Stderr, "FAIL lease %s: lost: %v\n", l.name, err)
+			l.cancel()
+			return
+		}
+		fmt.Fprintf(os.Stderr, "WARN lease %s: renewal failed, retrying: %v\n", l.name, err)
+	}
+}
+
+// release gives the lease up, so a standby can take over without waiting for it to expire.
+func (l *leaderLease) release(ctx context.Context) error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		l.cancel()
+		err = l.call(ctx, "release")
+	})
+	return err
+}
+
+// call runs a lease action on the blob.
+func (l *leaderLease) call(ctx context.Context, action string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, l.c.blobURL(l.name)+"?comp=lease", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-lease-action", action)
+	if action == "acquire" {
+		req.Header.Set("x-ms-lease-duration", strconv.Itoa(int(leaseDuration/time.Second)))
+		req.Header.Set("x-ms-proposed-lease-id", l.id)
+	} else {
+		req.Header.Set("x-ms-lease-id", l.id)
+	}
+	return l.c.do(req, l.name, "w")
+}
+
+// create writes the empty blob the lease is taken on. Replicas racing to create it all succeed,
+// and the acquire that follows picks one of them.
+func (l *leaderLease) create(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, l.c.blobURL(l.name), bytes.NewReader(nil))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = 0
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	err = l.c.do(req, l.name, "cw")
+	var be *blobError
+	if errors.As(err, &be) && be.Status == http.StatusPreconditionFailed {
+		return nil // it exists and is leased: the acquire will say by whom
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeLeaseService answers Put Blob and Lease Blob like the blob service, for one account.
+type fakeLeaseService struct {
+	mu     sync.Mutex
+	blobs  map[string]string // blob path -> lease id ("" when not leased)
+	leases int
+}
+
+func (f *fakeLeaseService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Query().Get("sig") == "" {
+		http.Error(w, "bad SAS", http.StatusForbidden)
+		return
+	}
+	holder, exists := f.blobs[r.URL.Path]
+	fail := func(status int, code string) {
+		w.Header().Set("x-ms-error-code", code)
+		w.WriteHeader(status)
+	}
+	if r.URL.Query().Get("comp") != "lease" {
+		f.blobs[r.URL.Path] = holder
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	id := r.Header.Get("x-ms-lease-id")
+	switch {
+	case !exists:
+		fail(http.StatusNotFound, "BlobNotFound")
+	case r.Header.Get("x-ms-lease-action") == "acquire" && holder != "":
+		fail(http.StatusConflict, "LeaseAlreadyPresent")
+	case r.Header.Get("x-ms-lease-action") == "acquire":
+		f.blobs[r.URL.Path] = r.Header.Get("x-ms-proposed-lease-id")
+		f.leases++
+		w.WriteHeader(http.StatusCreated)
+	case id != holder:
+		fail(http.StatusConflict, "LeaseIdMismatchWithLeaseOperation")
+	case r.Header.Get("x-ms-lease-action") == "release":
+		f.blobs[r.URL.Path] = ""
+	}
+}
+
+func TestLeaderLease(t *testing.T) {
+	svc := &fakeLeaseService{blobs: map[string]string{}}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	c := &scratchContainer{base: srv.URL, account: "acct", container: "locks", key: []byte("secret"), client: srv.Client()}
+	ctx := context.Background()
+
+	leader, leaderCtx, err := acquireLease(ctx, c, "leases/cursor-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := acquireLease(ctx, c, "leases/cursor-events"); !errors.Is(err, errLeaseHeld) {
+		t.Fatalf("second replica: err = %v, want errLeaseHeld", err)
+	}
+	if err := leader.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if leaderCtx.Err() == nil {
+		t.Error("the leader's context is still live after release")
+	}
+	next, _, err := acquireLease(ctx, c, "leases/cursor-events")
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	next.release(ctx)
+	if svc.leases != 2 {
+		t.Errorf("%d leases taken, want 2", svc.leases)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is returned by readLine when ^C is pressed.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines with readline-style editing when stdin is a terminal: arrows, Home/End,
+// ^A ^E ^B ^F, Backspace/Delete, ^K ^U ^W, ^L to clear the screen, and Up/Down (^P ^N) through
+// the history. Elsewhere (a pipe, or a platform without raw mode) it reads plain lines, so a
+// script can be fed to it.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       uintptr
+	terminal bool
+	history  []string
+}
+
+func newLineEditor(in *os.File, out io.Writer) *lineEditor {
+	fi, err := in.Stat()
+	return &lineEditor{
+		in:       bufio.NewReader(in),
+		out:      out,
+		fd:       in.Fd(),
+		terminal: err == nil && fi.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+// readLine shows prompt and returns the line entered, without its newline. It returns io.EOF at
+// the end of input or on ^D at an empty line, and errInterrupted on ^C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if e.terminal {
+		if restore, err := makeRaw(e.fd); err == nil {
+			defer restore()
+			return e.edit(prompt)
+		}
+	}
+	if e.terminal {
+		fmt.Fprint(e.out, prompt)
+	}
+	line, err := e.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (e *lineEditor) edit(prompt string) (string, error) {
+	var line []rune
+	pos := 0
+	hist := len(e.history)
+	draft := "" // the line being typed, kept while browsing the history
+	show := func(s string) {
+		line, pos = []rune(s), len([]rune(s))
+	}
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	redraw()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			fmt.Fprint(e.out, "\n")
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			return string(line), nil
+		case 3: // ^C
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupted
+		case 4: // ^D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case 1: // ^A
+			pos = 0
+		case 5: // ^E
+			pos = len(line)
+		case 2: // ^B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // ^F
+			if pos < len(line) {
+				pos++
+			}
+		case 11: // ^K
+			line = line[:pos]
+		case 21: // ^U
+			line, pos = line[pos:], 0
+		case 23: // ^W
+			start := pos
+			for start > 0 && unicode.IsSpace(line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(line[start-1]) {
+				start--
+			}
+			line, pos = append(line[:start], line[pos:]...), start
+		case 12: // ^L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16, 14: // ^P, ^N
+			hist, draft = e.browse(r == 16, hist, draft, string(line), show)
+		case '\t':
+			line = append(line[:pos], append([]rune("  "), line[pos:]...)...)
+			pos += 2
+		case 27: // escape sequence
+			switch e.escape() {
+			case "up":
+				hist, draft = e.browse(true, hist, draft, string(line), show)
+			case "down":
+				hist, draft = e.browse(false, hist, draft, string(line), show)
+			case "right":
+				if pos < len(line) {
+					pos++
+				}
+			case "left":
+				if pos > 0 {
+					pos--
+				}
+			case "home":
+				pos = 0
+			case "end":
+				pos = len(line)
+			case "delete":
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+// browse moves through the history, older when up is set. The line being typed comes back after
+// the newest entry.
+func (e *lineEditor) browse(up bool, hist int, draft, current string, show func(string)) (int, string) {
+	if hist == len(e.history) {
+		draft = current
+	}
+	switch {
+	case up && hist > 0:
+		hist--
+	case !up && hist < len(e.history):
+		hist++
+	default:
+		return hist, draft
+	}
+	if hist == len(e.history) {
+		show(draft)
+	} else {
+		show(e.history[hist])
+	}
+	return hist, draft
+}
+
+// escape reads the rest of an escape sequence and names the key, or returns "" for keys the
+// editor ignores.
+func (e *lineEditor) escape() string {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return ""
+	}
+	var seq []byte
+	for {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7e {
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return "up"
+	case "B":
+		return "down"
+	case "C":
+		return "right"
+	case "D":
+		return "left"
+	case "H", "1~", "7~":
+		return "home"
+	case "F", "4~", "8~":
+		return "end"
+	case "3~":
+		return "delete"
+	}
+	return ""
+}
+
+// remember adds a line to the history, skipping blanks and repeats of the previous line.
+func (e *lineEditor) remember(line string) bool {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return false
+	}
+	e.history = append(e.history, line)
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/classify"
+	"github.com/harche/kusto-example/pkg/probe"
+)
+
+// latencies collects the durations of one step in one phase.
+type latencies struct {
+	d      []time.Duration
+	failed int
+}
+
+func (l *latencies) pct(p float64) time.Duration {
+	if len(l.d) == 0 {
+		return 0
+	}
+	s := append([]time.Duration(nil), l.d...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[int(p*float64(len(s)-1)+0.5)]
+}
+
+// degradation is a step's p95 under load as a multiple of its idle p95 (0 without idle
+// samples), and whether that fails max: a larger multiple, or more failures under load. A zero
+// max never fails.
+func degradation(idle, loaded *latencies, max float64) (ratio float64, failed bool) {
+	if idle.pct(0.95) > 0 {
+		ratio = float64(loaded.pct(0.95)) / float64(idle.pct(0.95))
+	}
+	return ratio, max > 0 && (ratio > max || loaded.failed > idle.failed)
+}
+
+// runProbeLoad implements "probe-load [cluster-name]": it samples the probe's steps (.show
+// version, print 1 and the sample-table read) on an idle connection, then again while
+// --concurrency workers keep running --load-query, and reports how latency degrades. Tagging
+// the two sides with different application names (--probe-app, --load-app) lets a request
+// classification policy put them in different workload groups, which is the isolation this
+// measures. With --max-degradation the run fails if a step's p95 grows by more than that factor.
+func runProbeLoad(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("probe-load", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	concurrency := fs.Int("concurrency", 8, "background queries kept in flight")
+	loadQuery := fs.String("load-query", "print now()", "query the background workers run in a loop")
+	samples := fs.Int("samples", 10, "probe runs per phase")
+	interval := fs.Duration("interval", 500*time.Millisecond, "pause between probe runs")
+	ramp := fs.Duration("ramp", 2*time.Second, "how long the load runs before the loaded phase starts")
+	probeApp := fs.String("probe-app", "kusto-example-probe", "application name sent with probe queries")
+	loadApp := fs.String("load-app", "kusto-example-load", "application name sent with load queries")
+	maxDegradation := fs.Float64("max-degradation", 0, "fail if a step's p95 under load exceeds this multiple of its idle p95 (0: report only)")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	database := getenv("KUSTO_DATABASE", "sampledb")
+	sampleTable := getenv("KUSTO_SAMPLE_TABLE", "ProbeTest")
+	if *concurrency <= 0 || *samples <= 0 {
+		log.Fatalf("probe-load: --concurrency and --samples must be positive")
+	}
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, getDurationEnv("KUSTO_PROBE_TIMEOUT", 3*time.Second))
+
+	client, err := newClient(cluster)
+	if err != nil {
+		fail("auth/client", "failed to create Kusto client", err, suggestionForAuth(err))
+	}
+	defer client.Close()
+	hb := startHeartbeat("probe-load")
+
+	cfg := probe.Config{
+		Database:      database,
+		SampleTable:   sampleTable,
+		ExpectMessage: getenv("KUSTO_PROBE_EXPECT_MESSAGE", "kusto-sample-ok"),
+		Timeout:       timeouts.forCall,
+		Options:       []azkustodata.QueryOption{azkustodata.Application(*probeApp)},
+	}
+	sample := func(phase string) map[string]*latencies {
+		out := map[string]*latencies{}
+		for i := 0; i < *samples; i++ {
+			for _, step := range probe.Steps {
+				if !step.Enabled(cfg) {
+					continue
+				}
+				if out[step.Name] == nil {
+					out[step.Name] = &latencies{}
+				}
+				r := probe.RunStep(context.Background(), client, cfg, step.Name)
+				if !r.OK() {
+					out[step.Name].failed++
+					fmt.Fprintf(os.Stderr, "WARN %s %s: %s\n", phase, step.Name, errText(r.Err))
+					hb.moved()
+					continue
+				}
+				hb.beat(phase + " " + step.Name)
+				out[step.Name].d = append(out[step.Name].d, r.Duration)
+			}
+			time.Sleep(*interval)
+		}
+		return out
+	}
+
+	idle := sample("idle")
+
+	// Background load: each worker runs the load query back to back until stopped.
+	var done, failed, throttled atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	loadStart := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+				_, err := client.Query(ctx, database, (&kql.Builder{}).AddUnsafe(*loadQuery), azkustodata.Application(*loadApp))
+				cancel()
+				switch {
+				case err == nil:
+					done.Add(1)
+					hb.beat("load query")
+				case classify.IsThrottled(err):
+					throttled.Add(1)
+					hb.moved()
+				default:
+					failed.Add(1)
+					hb.moved()
+				}
+			}
+		}()
+	}
+	time.Sleep(*ramp)
+	loaded := sample("loaded")
+	close(stop)
+	wg.Wait()
+	elapsed := time.Since(loadStart)
+
+	fmt.Printf("LOAD %d workers running %q for %s: %d ok (%.1f/s), %d throttled, %d failed\n",
+		*concurrency, *loadQuery, elapsed.Round(time.Millisecond), done.Load(), float64(done.Load())/elapsed.Seconds(), throttled.Load(), failed.Load())
+	exceeded := false
+	for _, step := range probe.Steps {
+		if !step.Enabled(cfg) {
+			continue
+		}
+		a, b := idle[step.Name], loaded[step.Name]
+		ratio, degraded := degradation(a, b, *maxDegradation)
+		status := "OK"
+		if degraded {
+			status, exceeded = "FAIL", true
+		}
+		fmt.Printf("%s %s: idle p50=%dms p95=%dms max=%dms failed=%d | loaded p50=%dms p95=%dms max=%dms failed=%d | p95 x%.2f\n",
+			status, step.Name,
+			a.pct(0.5).Milliseconds(), a.pct(0.95).Milliseconds(), a.pct(1).Milliseconds(), a.failed,
+			b.pct(0.5).Milliseconds(), b.pct(0.95).Milliseconds(), b.pct(1).Milliseconds(), b.failed, ratio)
+	}
+	if exceeded {
+		hb.stop("failed")
+		fmt.Printf("FAIL probe-load: latency under load degraded by more than x%.2f\n", *maxDegradation)
+		os.Exit(1)
+	}
+	hb.stop("done")
+}
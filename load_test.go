@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func ms(ds ...int) []time.Duration {
+	out := make([]time.Duration, len(ds))
+	for i, d := range ds {
+		out[i] = time.Duration(d) * time.Millisecond
+	}
+	return out
+}
+
+func TestLatenciesPct(t *testing.T) {
+	l := &latencies{d: ms(50, 10, 40, 20, 30, 100, 60, 70, 80, 90, 200)}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{0.5, 60 * time.Millisecond},
+		{0.95, 200 * time.Millisecond},
+		{0.9, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := l.pct(tt.p); got != tt.want {
+			t.Errorf("pct(%g) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := (&latencies{failed: 3}).pct(0.95); got != 0 {
+		t.Errorf("pct of no samples = %v", got)
+	}
+	if l.d[0] != 50*time.Millisecond {
+		t.Error("pct sorted the samples in place")
+	}
+}
+
+func TestDegradation(t *testing.T) {
+	idle := &latencies{d: ms(10, 10, 20)}
+	tests := []struct {
+		name     string
+		idle     *latencies
+		loaded   *latencies
+		max      float64
+		ratio    float64
+		degraded bool
+	}{
+		{name: "within the limit", idle: idle, loaded: &latencies{d: ms(20, 30, 40)}, max: 3, ratio: 2},
+		{name: "over the limit", idle: idle, loaded: &latencies{d: ms(20, 30, 80)}, max: 3, ratio: 4, degraded: true},
+		{name: "report only", idle: idle, loaded: &latencies{d: ms(20, 30, 80)}, ratio: 4},
+		{name: "more failures under load", idle: idle, loaded: &latencies{d: ms(10, 10, 20), failed: 1}, max: 3, ratio: 1, degraded: true},
+		{name: "no idle samples", idle: &latencies{failed: 3}, loaded: &latencies{d: ms(10), failed: 3}, max: 3},
+	}
+	for _, tt := range tests {
+		ratio, degraded := degradation(tt.idle, tt.loaded, tt.max)
+		if ratio != tt.ratio || degraded != tt.degraded {
+			t.Errorf("%s: x%.2f degraded %t, want x%.2f %t", tt.name, ratio, degraded, tt.ratio, tt.degraded)
+		}
+	}
+}
@@ -2,139 +2,610 @@ package main
 
 import (
     "context"
-    "encoding/json"
-    "errors"
+    "flag"
     "fmt"
+    "io"
     "log"
-    "net"
     "os"
+    "strconv"
     "strings"
     "time"
 
     "github.com/Azure/azure-kusto-go/azkustodata"
     "github.com/Azure/azure-kusto-go/azkustodata/kql"
-    "github.com/Azure/azure-kusto-go/azkustodata/types"
+
+    "github.com/harche/kusto-example/pkg/classify"
+    "github.com/harche/kusto-example/pkg/encode"
+    _ "github.com/harche/kusto-example/pkg/encode/arrow"
+    "github.com/harche/kusto-example/pkg/kqlquote"
+    "github.com/harche/kusto-example/pkg/probe"
+    "github.com/harche/kusto-example/pkg/rowexpr"
+    "github.com/harche/kusto-example/pkg/sink"
+    "github.com/harche/kusto-example/pkg/stream"
 )
 
 // This sample demonstrates a minimal query using the Azure Data Explorer (Kusto) Go SDK v1+ packages.
 // It authenticates with DefaultAzureCredential and runs a simple KQL against the given database.
 func main() {
-    if len(os.Args) > 1 {
-        switch os.Args[1] {
+    globalTimeouts := registerTimeoutFlags(flag.CommandLine)
+    authName := flag.String("auth", getenv("KUSTO_AUTH", "default"), "authentication provider: "+strings.Join(authNames(), "|"))
+    globalErrorPolicy = registerErrorPolicyFlag(flag.CommandLine)
+    globalWatchdog = registerWatchdogFlags(flag.CommandLine)
+    globalRequest = registerRequestFlags(flag.CommandLine)
+    events := flag.Bool("events", false, "print progress events (query_started, table_started, rows_emitted, completed, failed) as JSON lines on stderr")
+    progressive := flag.Bool("progressive", false, "run the query in progressive mode: write rows as the cluster sends them and show rows so far and % complete on stderr")
+    flag.BoolVar(&transfer.compress, "compress", true, "ask the cluster for compressed responses (--compress=false requests them uncompressed)")
+    var maxBandwidth byteSize
+    if v := os.Getenv("KUSTO_MAX_BANDWIDTH"); v != "" {
+        if err := maxBandwidth.Set(v); err != nil {
+            log.Fatalf("KUSTO_MAX_BANDWIDTH: %v", err)
+        }
+    }
+    flag.Var(&maxBandwidth, "max-bandwidth", "read responses from the cluster at most this fast, in bytes per second: 512K, 10M, 1G (0: no limit)")
+    transferStats := flag.Bool("transfer-stats", false, "print whether responses came compressed and the bytes received, on the wire and decompressed, in the summary")
+    execStats := flag.Bool("stats", false, "print the cluster's execution statistics in the summary: execution time, CPU, memory peak, extents scanned and cache hit ratio")
+    hashResult := flag.Bool("hash", false, "print a deterministic content hash of the primary result in the summary")
+    var aggregates aggregateSpecs
+    flag.Var(&aggregates, "aggregate", "compute functions over primary result columns into the summary, e.g. sum,avg=Amount,Count (repeatable; sum|avg|min|max)")
+    inlineData := flag.String("inline-data", "", "prepend a small local CSV/TSV file to the query as a datatable named by --as")
+    externalData := flag.String("external-data", "", "upload a local CSV/TSV file to KUSTO_SCRATCH_CONTAINER and prepend it to the query as externaldata() named by --as")
+    externalTTL := flag.Duration("external-ttl", time.Hour, "with --external-data: how long the read-only SAS in the query stays valid (at most 7 days)")
+    inlineAs := flag.String("as", "", "with --inline-data or --external-data: the name the query uses for the file's rows")
+    sessionName := flag.String("session", os.Getenv("KUSTO_SESSION"), "run in a saved session: its database, parameters and let prelude (see 'session save')")
+    var params queryParams
+    flag.Var(&params, "param", "bind a query parameter, sent apart from the query text: name=value or name=type:value (repeatable; overrides the session's default)")
+    cacheTTL := flag.Duration("cache", getDurationEnv("KUSTO_RESULT_CACHE_TTL", 0), "serve an identical query run within this long from the local result cache (0 disables; see 'cache list|clear')")
+    refresh := flag.Bool("refresh", false, "with --cache: run the query even if a cached result exists, and replace it")
+    filterText := flag.String("filter", "", "keep only the primary result rows this client-side expression is true for, e.g. '.State == \"TEXAS\" and .Payload.size > 1000' (see README)")
+    columns := flag.String("columns", "", "keep only these primary result columns, in this order (comma-separated); Col.key.key or Col[0] picks part of a dynamic column")
+    profile := flag.Bool("profile", false, "print per-column statistics of the primary result (nulls, min/max, distinct estimate, top strings) on stderr")
+    format := flag.String("format", getenv("KUSTO_FORMAT", "ndjson"), "output format: "+strings.Join(encode.Names(), "|"))
+    pretty := flag.Bool("pretty", false, "json: pretty-print the array elements")
+    csvNull := flag.String("csv-null", os.Getenv("KUSTO_CSV_NULL"), "csv: text written for null cells (default empty)")
+    maxColWidth := flag.Int("max-col-width", 0, "table: cut cells to this many characters (0: only dynamic columns, at 40)")
+    tableStyle := flag.String("table-style", getenv("KUSTO_TABLE_STYLE", "unicode"), "table: border characters, unicode|ascii")
+    groupBy := flag.String("group-by", "", "emit one JSON document per distinct value of this column with the other columns nested under rows")
+    groupSorted := flag.Bool("group-sorted", false, "with --group-by: the result is ordered by the key, so emit each group as soon as it ends")
+    schemaHeader := flag.Bool("schema-header", false, "ndjson: emit a schema line (column names, types, ordinals) before each table's rows")
+    encodeWorkers := flag.Int("encode-workers", 1, "encode rows on this many goroutines, keeping their order, so CPU-heavy formats don't hold up reading the result (0: one per CPU)")
+    sinkCfg := sink.RegisterFlags(flag.CommandLine)
+    var rotateSize byteSize
+    flag.Var(&rotateSize, "rotate-size", "with --out: start a new file (name-0001.ext, name-0002.ext, ...) once the current one holds this many bytes, e.g. 1G")
+    clusters := flag.String("clusters", "", "run the query on each of these clusters (comma-separated names or URIs) and tag every row with a _cluster column")
+    databases := flag.String("databases", "", "run the query on each of these databases (comma-separated; *, ? and [...] patterns match .show databases) and tag every row with a _database column")
+    clusterWorkers := flag.Int("cluster-workers", 4, "with --clusters or --databases: how many queries to run at once")
+    useDaemon := flag.Bool("daemon", false, "run the query through 'daemon', on the socket of KUSTO_DAEMON (default daemon.sock in the config directory), reusing its signed-in client")
+    dryRun := flag.Bool("dry-run", false, "validate the query on the cluster without running it: print the result's columns, or the error with its line and column")
+    pageSize := flag.Int("page-size", 0, "return one page of this many rows (wraps the query with serialize + row_number())")
+    page := flag.Int("page", 1, "with --page-size: 1-based page number")
+    guard := &queryGuard{ttl: getDurationEnv("KUSTO_STATS_TTL", 24*time.Hour)}
+    flag.BoolVar(&guard.yes, "yes", false, "don't ask before large unfiltered scans or destructive operations (protected clusters still ask)")
+    flag.Int64Var(&guard.threshold, "large-query-bytes", 100<<30, "tables at least this large (compressed) need a time filter or confirmation; 0 disables the check")
+    flag.Parse()
+    qf := &queryFlags{}
+    if flag.Arg(0) == "query" {
+        qf = parseQueryArgs(flag.Args()[1:])
+    }
+    gate = newConfirmGate(guard.yes)
+    if maxBandwidth > 0 {
+        transfer.limit = newRateLimiter(int64(maxBandwidth))
+    }
+    if err := selectAuth(*authName); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if c, err := loadSuggestions(os.Getenv("KUSTO_SUGGESTIONS")); err != nil {
+        log.Fatalf("KUSTO_SUGGESTIONS: %v", err)
+    } else {
+        suggestions = c
+    }
+    if m, err := loadRunbooks(); err != nil {
+        log.Fatalf("%v", err)
+    } else {
+        runbooks = m
+    }
+    args := flag.Args()
+    if len(args) > 0 {
+        switch args[0] {
         case "probe":
-            var clusterArg string
-            if len(os.Args) > 2 {
-                clusterArg = os.Args[2]
-            }
-            runProbe(clusterArg)
+            runProbe(args[1:], globalTimeouts)
             return
         case "init-sample":
-            var clusterArg string
-            if len(os.Args) > 2 {
-                clusterArg = os.Args[2]
-            }
-            runInitSample(clusterArg)
+            runInitSample(args[1:], globalTimeouts)
+            return
+        case "snapshot":
+            runSnapshot(args[1:], globalTimeouts)
+            return
+        case "probe-load":
+            runProbeLoad(args[1:], globalTimeouts)
+            return
+        case "cursor":
+            runCursor(args[1:], globalTimeouts)
+            return
+        case "report":
+            runReport(args[1:], globalTimeouts)
+            return
+        case "session":
+            runSession(args[1:])
+            return
+        case "cache":
+            runCache(args[1:])
+            return
+        case "repl":
+            runRepl(args[1:], globalTimeouts, guard)
+            return
+        case "ingest":
+            runIngest(args[1:], globalTimeouts)
+            return
+        case "daemon":
+            runDaemon(args[1:], globalTimeouts, guard)
+            return
+        case "bench":
+            runBench(args[1:], globalTimeouts)
+            return
+        case "run-script":
+            runScript(args[1:], globalTimeouts, guard)
+            return
+        case "queue-worker":
+            runQueueWorker(args[1:], globalTimeouts)
+            return
+        case "ingest-events":
+            runIngestEvents(args[1:], globalTimeouts)
+            return
+        case "serve":
+            runServe(args[1:], globalTimeouts)
+            return
+        case "export":
+            runExport(args[1:], globalTimeouts)
+            return
+        case "watch":
+            runWatch(args[1:], globalTimeouts)
+            return
+        case "tail":
+            runTail(args[1:], globalTimeouts)
+            return
+        case "check":
+            runCheck(args[1:], globalTimeouts)
+            return
+        case "serve-metrics":
+            runServeMetrics(args[1:], globalTimeouts)
             return
         }
     }
-    cluster := getenvOrExit("KUSTO_CLUSTER", "https://<cluster>.<region>.kusto.windows.net")
-    database := getenvOrExit("KUSTO_DATABASE", "<database>")
-    queryText := getenv("KUSTO_QUERY", "cluster('help').database('Samples').StormEvents | take 5")
-
-	// Build connection string and client using DefaultAzureCredential.
-	kcsb := azkustodata.NewConnectionStringBuilder(cluster).WithDefaultAzureCredential()
+    timeouts := resolveTimeouts(globalTimeouts, nil, 2*time.Minute)
+    var out encode.Encoder
+    var rotator *rotatingEncoder
+    var err error
+    var dest io.Writer = os.Stdout
+    var upload sink.Upload
+    if *dryRun && (sinkCfg.Type != "" || sinkCfg.Out != "" || *externalData != "" || *clusters != "" || *databases != "") {
+        log.Fatalf("--dry-run checks one query on one database and writes nothing, so it can't be combined with --sink, --out, --external-data, --clusters or --databases")
+    }
+    if sinkCfg.Gzip && (sinkCfg.Type != "" || sinkCfg.Out == "") {
+        log.Fatalf("--gzip needs an --out file or object, and no --sink")
+    }
+    if rotateSize > 0 && (sinkCfg.Type != "" || sinkCfg.Out == "" || *cacheTTL > 0 || *groupBy != "" || sinkCfg.Opt("bq-table", "") != "") {
+        log.Fatalf("--rotate-size needs an --out file or object, and can't be combined with --sink, --cache, --group-by or bq-table")
+    }
+    if sinkCfg.Type == "" && sinkCfg.Out != "" && rotateSize == 0 {
+        if upload, err = sink.OpenUpload(sinkCfg, *format); err != nil {
+            log.Fatalf("%v", err)
+        }
+        dest = upload
+    }
+    var results *resultCache
+    var tee *cacheTee
+    if *cacheTTL > 0 {
+        if sinkCfg.Type != "" || *externalData != "" || *clusters != "" || *databases != "" {
+            log.Fatalf("--cache cannot be combined with --sink, --external-data, --clusters or --databases")
+        }
+        results = newResultCache()
+        tee = results.tee(dest)
+        dest = tee
+    }
+    if *tableStyle != "unicode" && *tableStyle != "ascii" {
+        log.Fatalf("--table-style must be unicode or ascii")
+    }
+    var filter *rowexpr.Expr
+    if *filterText != "" {
+        if filter, err = rowexpr.Parse(*filterText); err != nil {
+            log.Fatalf("--filter: %v", err)
+        }
+    }
+    if sinkCfg.Type != "" {
+        if *groupBy != "" {
+            log.Fatalf("--group-by cannot be combined with --sink")
+        }
+        out, err = sink.New(sinkCfg)
+    } else if *groupBy != "" {
+        out, err = newGroupWriter(dest, *groupBy, *groupSorted, *format, *pretty)
+    } else {
+        if *encodeWorkers < 0 {
+            log.Fatalf("--encode-workers must not be negative")
+        }
+        newEncoder := func(w io.Writer) (encode.Encoder, error) {
+            enc, err := encode.New(*format, w, encode.Options{SchemaHeader: *schemaHeader, Pretty: *pretty, Null: *csvNull,
+                MaxColWidth: *maxColWidth, TableStyle: *tableStyle, Workers: *encodeWorkers})
+            if err != nil {
+                return nil, err
+            }
+            return encode.Parallel(enc, *encodeWorkers), nil
+        }
+        if rotateSize > 0 {
+            rotator, err = newRotatingEncoder(int64(rotateSize), func(part int) (sink.Upload, error) {
+                return sink.OpenUploadPart(sinkCfg, *format, part)
+            }, newEncoder)
+            out = rotator
+        } else {
+            out, err = newEncoder(dest)
+        }
+    }
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    var requery *sinkRequery
+    if sinkCfg.Opt("requery-column", "") != "" {
+        if *clusters != "" || *databases != "" || *hashResult || len(aggregates) > 0 || *profile || *pageSize > 0 {
+            log.Fatalf("requery-column cannot be combined with --clusters, --databases, --hash, --aggregate, --profile or --page-size")
+        }
+        if requery, err = newSinkRequery(sinkCfg, out); err != nil {
+            log.Fatalf("%v", err)
+        }
+    }
+    if sinkCfg.Opt("bq-table", "") != "" {
+        // A load job wants rows of one table only: drop the @ExtendedProperties/completion tables.
+        if *schemaHeader || *groupBy != "" {
+            log.Fatalf("bq-table cannot be combined with --schema-header or --group-by")
+        }
+        out = encode.PrimaryOnly{Encoder: out}
+    }
+    cluster := qf.cluster
+    var fleet []clusterTarget
+    if (*clusters != "" || *databases != "") && *clusterWorkers < 1 {
+        log.Fatalf("--cluster-workers must be at least 1")
+    }
+    if *clusters != "" {
+        if cluster != "" {
+            log.Fatalf("--cluster and --clusters are mutually exclusive")
+        }
+        if fleet, err = openClusters(*clusters); err != nil {
+            log.Fatalf("failed creating Kusto client: %v", err)
+        }
+        defer closeClusters(fleet)
+        cluster = fleet[0].url
+    }
+    if cluster == "" {
+        cluster = getenvOrExit("KUSTO_CLUSTER", "https://<cluster>.<region>.kusto.windows.net")
+    }
+    session := &sessionState{}
+    if *sessionName != "" {
+        if session, err = loadSession(getenv("KUSTO_STATE", defaultStateDir()), *sessionName); err != nil {
+            log.Fatalf("--session: %v", err)
+        }
+    }
+    database := qf.database
+    if *databases != "" && database != "" {
+        log.Fatalf("--database and --databases are mutually exclusive")
+    }
+    if database == "" {
+        database = session.Database
+    }
+    if database == "" && *databases == "" {
+        database = getenvOrExit("KUSTO_DATABASE", "<database>")
+    }
+    queryText := qf.query
+    if queryText == "" {
+        queryText = getenv("KUSTO_QUERY", "cluster('help').database('Samples').StormEvents | take 5")
+    }
+    userQuery := queryText
+    prelude, bound, err := session.prelude(params)
+    if err != nil {
+        log.Fatalf("--session: %v", err)
+    }
 
-	client, err := azkustodata.New(kcsb)
-	if err != nil {
-		log.Fatalf("failed creating Kusto client: %v", err)
+	// Build connection string and client with the --auth provider (DefaultAzureCredential by default).
+	var client *azkustodata.Client
+	if *useDaemon && (*clusters != "" || *databases != "" || *dryRun || *progressive || requery != nil) {
+		log.Fatalf("--daemon runs a single query, without --clusters, --databases, --dry-run, --progressive or --sink-opt requery-column")
+	}
+	// With --daemon, the daemon's client runs the query, so this process doesn't sign in.
+	if fleet != nil {
+		client = fleet[0].client
+	} else if !*useDaemon {
+		if client, err = newClient(cluster); err != nil {
+			log.Fatalf("failed creating Kusto client: %v", err)
+		}
+		defer client.Close()
 	}
-	defer client.Close()
 
 	// Build the KQL query.
 	// kql.New requires a compile-time string literal or a string built via safe builders.
 	// When the query comes from env, use a builder and AddUnsafe explicitly.
+	if *inlineData != "" || (*inlineAs != "" && *externalData == "") {
+		if *inlineData == "" || *inlineAs == "" {
+			log.Fatalf("--inline-data and --as go together")
+		}
+		let, err := inlineDataTable(*inlineData, *inlineAs)
+		if err != nil {
+			log.Fatalf("--inline-data: %v", err)
+		}
+		queryText = let + queryText
+	}
+	var scratch *scratchContainer
+	var scratchBlob string
+	if *externalData != "" {
+		if *inlineAs == "" || *inlineData != "" {
+			log.Fatalf("--external-data needs --as, and can't be combined with --inline-data")
+		}
+		if *externalTTL <= 0 || *externalTTL > 7*24*time.Hour {
+			log.Fatalf("--external-ttl must be between 0 and 7 days")
+		}
+		if scratch, err = newScratchContainer(getenvOrExit("KUSTO_SCRATCH_CONTAINER", "https://<account>.blob.core.windows.net/<container>")); err != nil {
+			log.Fatalf("--external-data: %v", err)
+		}
+		uploadCtx, uploadCancel := timeouts.callContext(context.Background(), callIngest)
+		let, blob, err := externalDataTable(uploadCtx, scratch, *externalData, *inlineAs, *externalTTL)
+		uploadCancel()
+		if err != nil {
+			log.Fatalf("--external-data: %v", err)
+		}
+		queryText, scratchBlob = let+queryText, blob
+	}
+	queryText = prelude + queryText
 	var q *kql.Builder
-	if os.Getenv("KUSTO_QUERY") == "" {
+	if qf.query == "" && os.Getenv("KUSTO_QUERY") == "" && prelude == "" && *inlineData == "" && *externalData == "" {
 		q = kql.New("cluster('help').database('Samples').StormEvents | take 5")
 	} else {
 		q = (&kql.Builder{}).AddUnsafe(queryText)
 	}
+	// The queries of a run share one client request ID, printed in the summary and with errors.
+	requestID, opts := globalRequest.callOptions("query")
+	if bound != nil {
+		opts = append(opts, azkustodata.QueryParameters(bound))
+	}
+	if *progressive && (bound != nil || *clusters != "" || *databases != "" || requery != nil || *dryRun) {
+		log.Fatalf("--progressive runs a single query, without --param, --clusters, --databases, --requery-column or --dry-run")
+	}
+	globalRequest.checkServerTimeout(timeouts, callQuery)
+	// With --dry-run the cluster only checks the query; nothing runs and nothing is written.
+	if *dryRun {
+		runDryRun(client, database, strings.TrimSuffix(queryText, userQuery), userQuery, timeouts, opts)
+		return
+	}
+	if *page != 1 && *pageSize <= 0 {
+		log.Fatalf("--page needs --page-size")
+	}
+	if *pageSize > 0 {
+		paged, ordered, err := pageQuery(queryText, *pageSize, *page)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if !ordered {
+			fmt.Fprintln(os.Stderr, "WARN --page: the query has no final order by/sort by/top, so pages may overlap or skip rows between calls")
+		}
+		q = (&kql.Builder{}).AddUnsafe(paged)
+	}
 
-	// Use a timeout to avoid hanging.
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
-
-	// Execute query and stream tables/rows iteratively (lower memory footprint for large results).
-	dataset, err := client.IterativeQuery(ctx, database, q)
-	if err != nil {
-		log.Fatalf("query submission failed: %v", err)
+	// Serve a repeated query from the result cache; the key covers everything that shapes the output.
+	var key string
+	if results != nil {
+		key = cacheKey(cluster, database, q.String(), "params="+session.params(params).String(), "format="+*format, fmt.Sprint("pretty=", *pretty), "csv-null="+*csvNull, fmt.Sprint("max-col-width=", *maxColWidth), "table-style="+*tableStyle,
+			fmt.Sprint("schema-header=", *schemaHeader), "group-by="+*groupBy, fmt.Sprint("group-sorted=", *groupSorted),
+			fmt.Sprint("hash=", *hashResult), "aggregate="+aggregates.String(), fmt.Sprint("profile=", *profile),
+			"filter="+*filterText, "columns="+*columns, "request="+globalRequest.options.String(), fmt.Sprint("no-truncation=", globalRequest.noTruncation))
+		if e := results.lookup(key); e != nil && !*refresh {
+			if err := results.replay(e, tee.w); err != nil {
+				log.Fatalf("--cache: %v", err)
+			}
+			finishRun(upload, append([]string{"cache=hit", "cache_key=" + key[:12], "cached_at=" + e.Created.Format(time.RFC3339)}, e.Summary...), e.Profile)
+			return
+		}
 	}
-	defer dataset.Close()
 
-	tables := dataset.Tables()
-	for tableResult := range tables {
-		if tableResult.Err() != nil {
-			log.Fatalf("table error: %v", tableResult.Err())
+	// Ask before accidental full scans of large tables.
+	targets := []fanOutTarget{{cluster: cluster, client: client, database: database}}
+	if *clusters != "" || *databases != "" {
+		if fleet == nil {
+			fleet = []clusterTarget{{url: cluster, client: client}}
+		}
+		if targets, err = fanOutTargets(fleet, database, *databases, timeouts); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	for _, t := range targets {
+		// With --daemon, the daemon checks, with its client (see daemonRequest).
+		if t.err != nil || *useDaemon {
+			continue
+		}
+		guardCtx, guardCancel := timeouts.callContext(context.Background(), callMgmt)
+		if err := guard.check(guardCtx, t.client, t.cluster, t.database, queryText); err != nil {
+			log.Fatalf("%s", errText(err))
 		}
+		guardCancel()
+	}
 
-		table := tableResult.Table()
-		cols := table.Columns()
+	var hasher *hashingEncoder
+	if *hashResult {
+		hasher = &hashingEncoder{Encoder: out}
+		out = hasher
+	}
+	var aggregator *aggregatingEncoder
+	if len(aggregates) > 0 {
+		aggregator = &aggregatingEncoder{Encoder: out, specs: aggregates}
+		out = aggregator
+	}
+	var profiler *profilingEncoder
+	if *profile {
+		profiler = &profilingEncoder{Encoder: out}
+		out = profiler
+	}
+	var statsReader *statsEncoder
+	if *execStats {
+		statsReader = &statsEncoder{Encoder: out}
+		out = statsReader
+	}
+	// Filtering comes first, so the hash, aggregates and profile describe the rows written.
+	var filtering *filteringEncoder
+	if filter != nil || *columns != "" {
+		var keep []string
+		if *columns != "" {
+			keep = splitCSV(*columns)
+		}
+		filtering = newFilteringEncoder(out, filter, keep)
+		out = filtering
+	}
 
-		for rowResult := range table.Rows() {
-			if rowResult.Err() != nil {
-				log.Fatalf("row error: %v", rowResult.Err())
-			}
-			row := rowResult.Row()
-			vals := row.Values()
-
-			obj := make(map[string]interface{}, len(cols)+3)
-			obj["_table"] = table.Name()
-			obj["_kind"] = table.Kind()
-			obj["_rowIndex"] = row.Index()
-
-			for i, c := range cols {
-				if i >= len(vals) {
-					continue
-				}
-				v := vals[i]
-				if v == nil {
-					obj[c.Name()] = nil
-					continue
-				}
-				if c.Type() == types.Dynamic {
-					if b, ok := v.GetValue().([]byte); ok {
-						var any interface{}
-						if err := json.Unmarshal(b, &any); err == nil {
-							obj[c.Name()] = any
-							continue
-						}
-						obj[c.Name()] = string(b)
-						continue
-					}
-					if pb, ok := v.GetValue().(*[]byte); ok {
-						if pb == nil {
-							obj[c.Name()] = nil
-							continue
-						}
-						var any interface{}
-						if err := json.Unmarshal(*pb, &any); err == nil {
-							obj[c.Name()] = any
-							continue
-						}
-						obj[c.Name()] = string(*pb)
-						continue
-					}
-				}
-				obj[c.Name()] = v.GetValue()
+	// Use a timeout to avoid hanging (see --timeout / --call-timeout).
+	ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+	defer cancel()
+	hb := startHeartbeat("query")
+	var handlers []func(stream.Event)
+	if *events {
+		handlers = append(handlers, eventPrinter(os.Stderr))
+	}
+	if hb != nil {
+		handlers = append(handlers, hb.observe)
+	}
+	withEvents := func(ctx context.Context) context.Context {
+		if len(handlers) == 0 {
+			return ctx
+		}
+		return stream.WithEvents(ctx, func(e stream.Event) {
+			for _, h := range handlers {
+				h(e)
 			}
+		})
+	}
+	ctx = withEvents(ctx)
 
-			enc, err := json.Marshal(obj)
-			if err != nil {
-				log.Fatalf("failed to marshal row as JSON: %v", err)
-			}
-			fmt.Println(string(enc))
+	// Execute query and stream tables/rows iteratively (lower memory footprint for large results).
+	var fanOutErr error
+	if *clusters != "" || *databases != "" {
+		var fields []string
+		if *clusters != "" {
+			fields = append(fields, clusterField)
+		}
+		if *databases != "" {
+			fields = append(fields, databaseField)
+		}
+		// Each query gets the whole timeout, however long it waited for a worker.
+		fanOutErr = queryFanOut(targets, fields, *clusterWorkers, resolveErrorPolicy(nil, policyContinue), out, func(t fanOutTarget, enc encode.Encoder) (int64, error) {
+			ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+			defer cancel()
+			rows, err := stream.Query(withEvents(ctx), t.client, t.database, q, enc, opts...)
+			return rows, withRequestID(err, requestID)
+		})
+	} else if requery != nil {
+		// Each query, the first and the requeries, gets the whole timeout.
+		err = requery.run(queryText, func(q *kql.Builder) error {
+			ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+			defer cancel()
+			_, err := stream.Query(withEvents(ctx), client, database, q, out, opts...)
+			return withRequestID(err, requestID)
+		})
+	} else if *progressive {
+		// The SDK can't read progressive results, so this call goes to the REST API directly.
+		_, err = progressiveQuery(ctx, transfer.client(), cluster, database, q.String(), requestID, out, newProgressLine())
+		err = withRequestID(err, requestID)
+	} else if *useDaemon {
+		// The rows come back as frames, so only this side encodes them, in --format.
+		socket := getenv("KUSTO_DAEMON", defaultDaemonSocket())
+		_, err = daemonQuery(ctx, socket, daemonRequest{Database: database, Query: q.String(), Params: session.params(params),
+			RequestID: requestID, Timeout: timeouts.forCall(callQuery).String(), LargeQueryBytes: guard.bytes()}.withProperties(globalRequest), out)
+		err = withRequestID(err, requestID)
+	} else {
+		_, err = stream.Query(ctx, client, database, q, out, opts...)
+		err = withRequestID(err, requestID)
+	}
+	if scratchBlob != "" {
+		// The SAS expires on its own; removing the blob keeps the scratch container small.
+		rmCtx, rmCancel := timeouts.callContext(context.Background(), callIngest)
+		if rmErr := scratch.remove(rmCtx, scratchBlob); rmErr != nil {
+			fmt.Fprintf(os.Stderr, "WARN --external-data: %v\n", rmErr)
+		}
+		rmCancel()
+	}
+	if err != nil {
+		printRunbook(os.Stderr, "query", err)
+		if truncated(err) && !globalRequest.noTruncation {
+			fmt.Fprintln(os.Stderr, "SUGGEST query: the result is over the cluster's truncation limit; rerun with --no-truncation (or KUSTO_NO_TRUNCATION=true), ideally with --out or a --sink")
+		}
+		hb.stop("failed")
+		log.Fatalf("%s", errText(err))
+	}
+
+	// Facts about the result itself; a cache hit reproduces them without the rows.
+	var result runSummary
+	if *pageSize > 0 {
+		result.add("page", *page)
+		result.add("page_size", *pageSize)
+	}
+	if hasher != nil && hasher.hasher != nil {
+		result.add("rows", hasher.hasher.rows)
+		result.add("hash", hasher.hasher.sum())
+	}
+	if aggregator != nil {
+		aggregator.addTo(&result)
+	}
+	if filtering != nil {
+		filtering.addTo(&result)
+	}
+	var profileText strings.Builder
+	if profiler != nil && profiler.profile != nil {
+		printSection(&profileText, profiler.profile.section(profiler.table.Name))
+	}
+	var fields []string
+	if tee != nil {
+		state := "miss"
+		if *refresh {
+			state = "refresh"
+		}
+		now := time.Now().UTC()
+		if !tee.commit(&cacheEntry{Key: key, Cluster: cluster, Database: database, Query: q.String(), Format: *format,
+			Created: now, Expires: now.Add(*cacheTTL), Summary: result.fields, Profile: profileText.String()}) {
+			state += "-not-stored"
 		}
+		fields = []string{"cache=" + state, "cache_key=" + key[:12]}
+	}
+	if rotator != nil {
+		var parts runSummary
+		rotator.addTo(&parts)
+		fields = append(parts.fields, fields...)
+	}
+	if requery != nil {
+		fields = append(fields, fmt.Sprintf("requeries=%d", requery.runs))
+	}
+	fields = append(fields, "client_request_id="+requestID)
+	if statsReader != nil {
+		var cost runSummary
+		statsReader.stats.addTo(&cost)
+		fields = append(fields, cost.fields...)
+	}
+	if *transferStats {
+		var stats runSummary
+		transfer.addTo(&stats)
+		fields = append(fields, stats.fields...)
+	}
+	finishRun(upload, append(fields, result.fields...), profileText.String())
+	if fanOutErr != nil {
+		hb.stop("failed")
+		log.Fatalf("fan-out: %v", fanOutErr)
 	}
+	hb.stop("done")
+}
+
+// finishRun completes an --out upload and prints the profile and the summary line on stderr.
+func finishRun(upload sink.Upload, fields []string, profile string) {
+    var summary runSummary
+    if upload != nil {
+        if err := upload.Close(); err != nil {
+            log.Fatalf("upload failed: %v", err)
+        }
+        summary.add("uploaded", upload.URL())
+        summary.add("bytes", upload.Size())
+    }
+    summary.fields = append(summary.fields, fields...)
+    fmt.Fprint(os.Stderr, profile)
+    summary.print(os.Stderr)
 }
 
 // runProbe validates endpoint reachability, database access, and basic data permissions.
@@ -143,71 +614,51 @@ func main() {
 //  2) Database probe (query-level): print 1
 //  3) Data probe (query-level): take 1 from a known table (configurable)
 // Output: concise status lines and remediation suggestions. Non-zero exit on failure.
-func runProbe(clusterArg string) {
-    cluster := resolveClusterURL(clusterArg)
+func runProbe(args []string, globalTimeouts *timeoutFlags) {
+    fs := flag.NewFlagSet("probe", flag.ExitOnError)
+    cmdTimeouts := registerTimeoutFlags(fs)
+    cmdPolicy := registerErrorPolicyFlag(fs)
+    withIngest := fs.Bool("with-ingest", false, "also append a row to KUSTO_PROBE_INGEST_TABLE (default ProbeIngest) and read it back")
+    printSuggestions := fs.Bool("print-suggestions", false, "print the suggestion catalog as a KUSTO_SUGGESTIONS file and exit")
+    cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+    if *printSuggestions {
+        suggestions.print(os.Stdout)
+        return
+    }
     database := getenv("KUSTO_DATABASE", "sampledb")
     sampleTable := getenv("KUSTO_SAMPLE_TABLE", "ProbeTest")
     expectMsg := getenv("KUSTO_PROBE_EXPECT_MESSAGE", "kusto-sample-ok")
 
-    // Small overall timeout per step to keep latency low for healthy contexts.
-    stepTimeout := getDurationEnv("KUSTO_PROBE_TIMEOUT", 3*time.Second)
+    // Small timeout per step to keep latency low for healthy contexts.
+    timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, getDurationEnv("KUSTO_PROBE_TIMEOUT", 3*time.Second))
 
-    kcsb := azkustodata.NewConnectionStringBuilder(cluster).WithDefaultAzureCredential()
-    client, err := azkustodata.New(kcsb)
+    client, err := newClient(cluster)
     if err != nil {
         fail("auth/client", "failed to create Kusto client", err, suggestionForAuth(err))
     }
     defer client.Close()
 
-    // Step 1: Management probe (cluster-level)
-    {
-        ctx, cancel := context.WithTimeout(context.Background(), stepTimeout)
-        start := time.Now()
-        _, mgmtErr := client.Mgmt(ctx, "", kql.New(".show version"))
-        cancel()
-        if mgmtErr != nil {
-            failTimed("mgmt", time.Since(start), ".show version failed", mgmtErr, suggestionForEndpointOrAuth(mgmtErr))
+    policy := resolveErrorPolicy(cmdPolicy, policyContinue)
+    cfg := probe.Config{Database: database, SampleTable: sampleTable, ExpectMessage: expectMsg, Timeout: timeouts.forCall,
+        Ingest: *withIngest, IngestTable: getenv("KUSTO_PROBE_INGEST_TABLE", "ProbeIngest"), MaxFailures: policy.maxFailures()}
+    results := probe.Run(context.Background(), client, cfg)
+    b := newBatch("probe", policy, len(results))
+    for _, r := range results {
+        switch {
+        case r.Skipped:
+            skipped(r.Step, r.Message)
+            continue
+        case !r.OK():
+            failTimed(r.Step, r.Duration, r.Message, r.Err, suggestionForStep(r, cluster, database, sampleTable))
+        default:
+            okTimed(r.Step, r.Duration, r.Message)
         }
-        okTimed("mgmt", time.Since(start), "cluster reachable")
+        b.done(r.Step, r.Err)
     }
-
-    // Step 2: Database probe (query-level)
-    {
-        ctx, cancel := context.WithTimeout(context.Background(), stepTimeout)
-        start := time.Now()
-        _, qErr := client.Query(ctx, database, kql.New("print 1"))
-        cancel()
-        if qErr != nil {
-            failTimed("database", time.Since(start), "basic query failed", qErr, suggestionForDatabase(qErr, database))
-        }
-        okTimed("database", time.Since(start), fmt.Sprintf("db ok: %s", database))
-    }
-
-    // Step 3: Sample data probe (verify expected content exists)
-    {
-        q := (&kql.Builder{}).AddUnsafe(
-            fmt.Sprintf("%s | where Message == '%s' | take 1", sampleTable, strings.ReplaceAll(expectMsg, "'", "''")),
-        )
-        ctx, cancel := context.WithTimeout(context.Background(), stepTimeout)
-        start := time.Now()
-        has, derr := queryHasAnyRow(ctx, client, database, q)
-        cancel()
-        if derr != nil {
-            if isTableNotFound(derr) {
-                failTimed("data-sample", time.Since(start), fmt.Sprintf("sample table not found: %s", sampleTable), derr, "Run kusto.sh probe or create to initialize the sample table.")
-            }
-            if isPermissionErr(derr) {
-                failTimed("data-sample", time.Since(start), fmt.Sprintf("no access to sample table: %s", sampleTable), derr, suggestionForPermissions())
-            }
-            failTimed("data-sample", time.Since(start), "query failed for sample table", derr, suggestionForQuery(sampleTable))
-        }
-        if !has {
-            failTimed("data-sample", time.Since(start), fmt.Sprintf("expected row not found in %s (Message=='%s')", sampleTable, expectMsg), nil, "Initialize sample data via kusto.sh or verify ingestion.")
-        }
-        okTimed("data-sample", time.Since(start), fmt.Sprintf("sample table ok: %s contains expected data", sampleTable))
-        // All good; no need to probe additional tables.
-        fmt.Println("OK probe: endpoint, db, and data access validated")
-        return
+    b.summary(os.Stderr)
+    if err := b.err(); err != nil {
+        fmt.Printf("FAIL probe: %v\n", err)
+        os.Exit(1)
     }
 
     // All good
@@ -223,117 +674,47 @@ func infoTimed(step string, d time.Duration, msg string) {
 }
 
 func failTimed(step string, d time.Duration, msg string, err error, suggest string) {
-    fmt.Printf("FAIL %s (%dms): %s: %v\n", step, d.Milliseconds(), msg, err)
+    fmt.Printf("FAIL %s (%dms): %s: %s\n", step, d.Milliseconds(), msg, errText(err))
     if suggest != "" {
         fmt.Printf("SUGGEST %s: %s\n", step, suggest)
     }
-    os.Exit(1)
+    printRunbook(os.Stdout, step, err)
+}
+
+func skipped(step, reason string) {
+    fmt.Printf("SKIPPED %s: %s\n", step, reason)
 }
 
 func fail(step, msg string, err error, suggest string) {
     if err != nil {
-        fmt.Printf("FAIL %s: %s: %v\n", step, msg, err)
+        fmt.Printf("FAIL %s: %s: %s\n", step, msg, errText(err))
     } else {
         fmt.Printf("FAIL %s: %s\n", step, msg)
     }
     if suggest != "" {
         fmt.Printf("SUGGEST %s: %s\n", step, suggest)
     }
+    printRunbook(os.Stdout, step, err)
     os.Exit(1)
 }
 
-func suggestionForAuth(err error) string {
-    return "Ensure Azure auth is available: run 'az login' or configure DefaultAzureCredential (AZURE_TENANT_ID, AZURE_CLIENT_ID/SECRET)."
-}
-
-func suggestionForEndpointOrAuth(err error) string {
-    if isNetworkErr(err) {
-        return "Verify KUSTO_CLUSTER endpoint is correct (https://<cluster>.<region>.kusto.windows.net) and reachable."
-    }
-    if looksLikeAAD(err) || isAuthErr(err) {
-        return suggestionForAuth(err)
-    }
-    return "Check endpoint and authentication."
-}
-
-func suggestionForDatabase(err error, db string) string {
-    if isDatabaseNotFound(err) {
-        return fmt.Sprintf("Database '%s' not found. Verify KUSTO_DATABASE or create it (see kusto.sh).", db)
-    }
-    if isPermissionErr(err) {
-        return "You may lack database permissions. Ensure your identity has access (e.g., Admin/User role)."
+// errText is err's message followed by the service's error code, if the cluster sent one. The
+// code stays the same whatever the cluster's locale, so it is what to search for.
+func errText(err error) string {
+    if code := classify.Code(err); code != "" {
+        return fmt.Sprintf("%v [%s]", err, code)
     }
-    return "Verify KUSTO_DATABASE and your permissions."
+    return err.Error()
 }
 
-func suggestionForPermissions() string {
-    return "Grant your identity read access to the database/table (e.g., Admin/User role)."
+// suggestionForStep picks the remediation hint for a failed probe step from the suggestion catalog.
+func suggestionForStep(r probe.Result, cluster, database, sampleTable string) string {
+    return suggestions.suggest(r.Step, r.Err, suggestionData{Cluster: cluster, Database: database, Table: sampleTable})
 }
 
-func suggestionForQuery(table string) string {
-    return fmt.Sprintf("Investigate query or connectivity issues for table '%s'.", table)
-}
-
-func isNetworkErr(err error) bool {
-    var nErr net.Error
-    if errors.As(err, &nErr) {
-        return true
-    }
-    msg := strings.ToLower(err.Error())
-    return strings.Contains(msg, "no such host") || strings.Contains(msg, "connection refused") || strings.Contains(msg, "timeout")
-}
-
-func looksLikeAAD(err error) bool {
-    msg := strings.ToLower(err.Error())
-    return strings.Contains(msg, "aadsts") || strings.Contains(msg, "token") || strings.Contains(msg, "credential")
-}
-
-func isAuthErr(err error) bool {
-    msg := strings.ToLower(err.Error())
-    return strings.Contains(msg, "unauthorized") || strings.Contains(msg, "401") || strings.Contains(msg, "authorization")
-}
-
-func isPermissionErr(err error) bool {
-    msg := strings.ToLower(err.Error())
-    return strings.Contains(msg, "forbidden") || strings.Contains(msg, "403") || strings.Contains(msg, "insufficient") || strings.Contains(msg, "permission")
-}
-
-func isDatabaseNotFound(err error) bool {
-    msg := strings.ToLower(err.Error())
-    return strings.Contains(msg, "database") && strings.Contains(msg, "not found")
-}
-
-func isTableNotFound(err error) bool {
-    msg := strings.ToLower(err.Error())
-    // Heuristics for semantic errors indicating missing table
-    return strings.Contains(msg, "semantic") && (strings.Contains(msg, "table") || strings.Contains(msg, "name")) && strings.Contains(msg, "not")
-}
-
-// queryHasAnyRow runs a query and returns true if the primary result has at least one row.
-func queryHasAnyRow(ctx context.Context, client *azkustodata.Client, db string, q *kql.Builder) (bool, error) {
-    ds, err := client.IterativeQuery(ctx, db, q)
-    if err != nil {
-        return false, err
-    }
-    defer ds.Close()
-    tables := ds.Tables()
-    for tr := range tables {
-        if tr.Err() != nil {
-            return false, tr.Err()
-        }
-        t := tr.Table()
-        if t.Name() != "PrimaryResult" {
-            continue
-        }
-        for rr := range t.Rows() {
-            if rr.Err() != nil {
-                return false, rr.Err()
-            }
-            // Found at least one row
-            return true, nil
-        }
-    }
-    return false, nil
+// suggestionForAuth is the hint for a client that couldn't be created.
+func suggestionForAuth(err error) string {
+    return suggestions.suggest("client", err, suggestionData{})
 }
 
 func splitCSV(s string) []string {
@@ -359,6 +740,24 @@ func getDurationEnv(key string, def time.Duration) time.Duration {
     return def
 }
 
+func getInt64Env(key string, def int64) int64 {
+    v := strings.TrimSpace(os.Getenv(key))
+    if v == "" {
+        return def
+    }
+    if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+        return n
+    }
+    return def
+}
+
+func firstArg(args []string) string {
+    if len(args) == 0 {
+        return ""
+    }
+    return args[0]
+}
+
 func getenvOrExit(key, hint string) string {
     v := os.Getenv(key)
     if v == "" {
@@ -377,35 +776,52 @@ func getenv(key, def string) string {
 
 // runInitSample ensures a small sample table exists and contains a known row.
 // It creates/merges the table schema and appends a single row with the expected message.
-func runInitSample(clusterArg string) {
-    cluster := resolveClusterURL(clusterArg)
+// The append is tagged ingest-by:<tag> with ingestIfNotExists, so re-running never duplicates the row.
+// With --dry-run the commands are printed as a plan instead of executed.
+func runInitSample(args []string, globalTimeouts *timeoutFlags) {
+    fs := flag.NewFlagSet("init-sample", flag.ExitOnError)
+    cmdTimeouts := registerTimeoutFlags(fs)
+    cmdPolicy := registerErrorPolicyFlag(fs)
+    dryRun := fs.Bool("dry-run", false, "print the control commands in order without executing them")
+    ingestTagFlag := fs.String("ingest-tag", getenv("KUSTO_INGEST_TAG", ""), "ingest-by tag for the sample row (default: derived from table and message)")
+    cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
     database := getenv("KUSTO_DATABASE", "sampledb")
     sampleTable := getenv("KUSTO_SAMPLE_TABLE", "ProbeTest")
     expectMsg := getenv("KUSTO_PROBE_EXPECT_MESSAGE", "kusto-sample-ok")
 
-    kcsb := azkustodata.NewConnectionStringBuilder(cluster).WithDefaultAzureCredential()
-    client, err := azkustodata.New(kcsb)
+    plan := &controlPlan{Name: "init-sample", Cluster: cluster}
+    plan.add(callMgmt, database, "create or merge sample table",
+        fmt.Sprintf(".create-merge table %s (Message:string, When:datetime)", sampleTable))
+    tag := *ingestTagFlag
+    if tag == "" {
+        tag = ingestTag("init-sample", sampleTable, expectMsg)
+    }
+    plan.add(callIngest, database, fmt.Sprintf("append a single sample row (ingest-by:%s)", tag),
+        fmt.Sprintf(".set-or-append %s %s <| print Message=%s, When=now()", sampleTable, idempotentWith(tag), kqlquote.String(expectMsg)))
+    if *dryRun {
+        plan.print(os.Stdout)
+        return
+    }
+    if err := plan.confirm(gate); err != nil {
+        log.Fatalf("init-sample: %v", err)
+    }
+
+    client, err := newClient(cluster)
     if err != nil {
         log.Fatalf("failed creating Kusto client: %v", err)
     }
     defer client.Close()
 
-    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-    defer cancel()
-
-    // Create or merge table schema
-    qCreate := (&kql.Builder{}).AddUnsafe(fmt.Sprintf(".create-merge table %s (Message:string, When:datetime)", sampleTable))
-    if _, err := client.Mgmt(ctx, database, qCreate); err != nil {
-        log.Fatalf("failed to create/merge sample table: %v", err)
-    }
-
-    // Append a single sample row
-    qAppend := (&kql.Builder{}).AddUnsafe(fmt.Sprintf(".set-or-append %s <| print Message='%s', When=now()", sampleTable, strings.ReplaceAll(expectMsg, "'", "''")))
-    if _, err := client.Mgmt(ctx, database, qAppend); err != nil {
-        log.Fatalf("failed to append sample row: %v", err)
+    timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 30*time.Second)
+    b := newBatch("init-sample", resolveErrorPolicy(cmdPolicy, policyFailFast), len(plan.Steps))
+    plan.execute(client, timeouts, b)
+    b.printFailures(os.Stderr)
+    b.summary(os.Stderr)
+    if err := b.err(); err != nil {
+        log.Fatalf("failed to initialize sample table: %v", err)
     }
 
-    fmt.Printf("Initialized sample table %s with message '%s'\n", sampleTable, expectMsg)
+    fmt.Printf("Initialized sample table %s with message '%s' (ingest-by:%s)\n", sampleTable, expectMsg, tag)
 }
 
 // resolveClusterURL builds the cluster URI from a provided name, or falls back to env KUSTO_CLUSTER.
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// metricsExporter is a Prometheus scrape target (GET /metrics): each scrape runs the query and
+// exposes its rows as gauges. The query returns a row per series with these columns, matched by
+// name regardless of case:
+//
+//	name     string    the metric name
+//	value    numeric   the gauge's value; a row with a null value is left out
+//	labels   dynamic   optional, a bag of label names and values
+//
+// and any other column is a label too, named after the column. So
+//
+//	StormEvents | summarize value = count() by State | extend name = "storm_events"
+//
+// exposes storm_events{State="TEXAS"} 3 and so on. Names that aren't valid Prometheus names have
+// their other characters replaced by _. The text format is Prometheus's, or OpenMetrics when the
+// scraper asks for it.
+type metricsExporter struct {
+	mu       sync.Mutex // guards query, which a reload of --metrics-query-file replaces
+	query    string
+	database string
+	maxRows  int
+	timeouts timeoutConfig
+	run      func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error
+}
+
+// current returns the query each scrape runs.
+func (m *metricsExporter) current() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.query
+}
+
+// reload reads the query from file again and switches to it for the next scrape.
+func (m *metricsExporter) reload(file string) (string, error) {
+	q, err := readMetricsQuery("", file)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if q == m.query {
+		return "metrics query unchanged", nil
+	}
+	m.query = q
+	return "metrics query replaced", nil
+}
+
+var errTooManySeries = errors.New("the metrics query returned more rows than --max-rows")
+
+const (
+	metricsTextType        = "text/plain; version=0.0.4; charset=utf-8"
+	metricsOpenMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+func (m *metricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "scrape with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := m.timeouts.callContext(r.Context(), callQuery)
+	defer cancel()
+	// Prometheus says how long it waits; answering after that is wasted work on the cluster.
+	if s, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil && s > 0 {
+		var cancelScrape context.CancelFunc
+		ctx, cancelScrape = context.WithTimeout(ctx, time.Duration(s*float64(time.Second)))
+		defer cancelScrape()
+	}
+	start := time.Now()
+	c := &metricsCollector{max: m.maxRows, series: map[string]*metricsSeries{}}
+	if err := m.run(ctx, m.database, (&kql.Builder{}).AddUnsafe(m.current()), encode.PrimaryOnly{Encoder: c}); err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL serve metrics: %s\n", errText(err))
+		http.Error(w, "metrics query: "+errText(err), http.StatusBadGateway)
+		return
+	}
+	if c.duplicates > 0 {
+		fmt.Fprintf(os.Stderr, "WARN serve metrics: %d rows repeat the name and labels of an earlier row; kept the first\n", c.duplicates)
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	body := c.exposition(openMetrics)
+	fmt.Fprintf(os.Stderr, "OK serve metrics (%dms): %d series\n", time.Since(start).Milliseconds(), len(c.series))
+	if openMetrics {
+		w.Header().Set("Content-Type", metricsOpenMetricsType)
+	} else {
+		w.Header().Set("Content-Type", metricsTextType)
+	}
+	w.Write(body)
+}
+
+type metricsSeries struct {
+	name   string
+	labels []promLabel // sorted by name
+	value  float64
+}
+
+// metricsCollector turns the rows of a metrics query into series, one per name and labels. With
+// metric set, every row is a series of that metric, and a name column is a label like any other.
+type metricsCollector struct {
+	metric     string
+	max        int
+	rows       int
+	name       int // column indexes, -1 if missing
+	value      int
+	labels     int
+	extra      []int // the other columns, each a label
+	columns    []string
+	series     map[string]*metricsSeries
+	duplicates int
+}
+
+func (c *metricsCollector) Begin(t *encode.Table) error {
+	c.name, c.value, c.labels, c.extra, c.columns = -1, -1, -1, nil, make([]string, len(t.Columns))
+	for i, col := range t.Columns {
+		c.columns[i] = col.Name()
+		switch strings.ToLower(col.Name()) {
+		case "name":
+			if c.metric != "" {
+				c.extra = append(c.extra, i)
+				continue
+			}
+			c.name = i
+		case "value":
+			c.value = i
+		case "labels":
+			if col.Type() == types.Dynamic {
+				c.labels = i
+				continue
+			}
+			c.extra = append(c.extra, i)
+		default:
+			c.extra = append(c.extra, i)
+		}
+	}
+	if c.metric != "" && c.value < 0 {
+		return fmt.Errorf("the query of metric %s must return a value column, got %s", c.metric, strings.Join(c.columns, ", "))
+	}
+	if c.metric == "" && (c.name < 0 || c.value < 0) {
+		return fmt.Errorf("the metrics query must return name and value columns (and optionally labels), got %s", strings.Join(c.columns, ", "))
+	}
+	return nil
+}
+
+func (c *metricsCollector) WriteRow(_ *encode.Table, _ int, vals value.Values) error {
+	v, ok := promValue(encode.PlainValue(vals[c.value]))
+	name := c.metric
+	if name == "" {
+		name, _ = encode.PlainValue(vals[c.name]).(string)
+	}
+	if !ok || name == "" {
+		return nil
+	}
+	if c.rows++; c.rows > c.max {
+		return errTooManySeries
+	}
+	labels := map[string]string{}
+	if c.labels >= 0 {
+		if doc, ok := encode.PlainValue(vals[c.labels]).([]byte); ok {
+			dec := json.NewDecoder(bytes.NewReader(doc))
+			dec.UseNumber()
+			var bag map[string]interface{}
+			if dec.Decode(&bag) == nil {
+				for k, lv := range bag {
+					labels[metricsName(k, false)] = promLabelValue(lv)
+				}
+			}
+		}
+	}
+	for _, i := range c.extra {
+		labels[metricsName(c.columns[i], false)] = metricsLabelText(encode.PlainValue(vals[i]))
+	}
+	s := &metricsSeries{name: metricsName(name, true), value: v}
+	for k, lv := range labels {
+		if lv != "" { // an empty label is the same as no label
+			s.labels = append(s.labels, promLabel{k, lv})
+		}
+	}
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+	key := s.name + "\xff"
+	for _, l := range s.labels {
+		key += l.name + "\xff" + l.value + "\xff"
+	}
+	if _, ok := c.series[key]; ok {
+		c.duplicates++
+		return nil
+	}
+	c.series[key] = s
+	return nil
+}
+
+func (c *metricsCollector) End() error { return nil }
+
+// exposition writes the series in the text format, a gauge family per name, along with those of
+// the token refresh.
+func (c *metricsCollector) exposition(openMetrics bool) []byte {
+	series := make([]*metricsSeries, 0, len(c.series))
+	for _, s := range c.series {
+		series = append(series, s)
+	}
+	help := map[string]string{}
+	series = append(series, tokenMetrics(help)...)
+	return metricsExposition(series, help, openMetrics)
+}
+
+// metricsExposition writes series in the text format, a gauge family per name, with a HELP line
+// for the names in help.
+func metricsExposition(series []*metricsSeries, help map[string]string, openMetrics bool) []byte {
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return labelsLess(series[i].labels, series[j].labels)
+	})
+	var b bytes.Buffer
+	for i, s := range series {
+		if i == 0 || series[i-1].name != s.name {
+			if h := help[s.name]; h != "" {
+				fmt.Fprintf(&b, "# HELP %s %s\n", s.name, metricsHelpEscaper.Replace(h))
+			}
+			fmt.Fprintf(&b, "# TYPE %s gauge\n", s.name)
+		}
+		b.WriteString(s.name)
+		if len(s.labels) > 0 {
+			b.WriteByte('{')
+			for j, l := range s.labels {
+				if j > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%s=\"%s\"", l.name, metricsEscaper.Replace(l.value))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(metricsFloat(s.value))
+		b.WriteByte('\n')
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	return b.Bytes()
+}
+
+func labelsLess(a, b []promLabel) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i].name != b[i].name {
+				return a[i].name < b[i].name
+			}
+			return a[i].value < b[i].value
+		}
+	}
+	return len(a) < len(b)
+}
+
+var (
+	metricsEscaper     = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	metricsHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func metricsFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsName makes s a valid metric name ([a-zA-Z_:][a-zA-Z0-9_:]*), or with metric false a
+// valid label name, which can't have colons.
+func metricsName(s string, metric bool) string {
+	b := []byte(s)
+	for i, ch := range b {
+		ok := ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || (i > 0 && ch >= '0' && ch <= '9') || (metric && ch == ':')
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// metricsLabelText is a column's value as a label: datetimes in RFC 3339, the rest as text.
+func metricsLabelText(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprint(v)
+}
+
+// readMetricsQuery is --metrics-query, or the contents of --metrics-query-file.
+func readMetricsQuery(text, file string) (string, error) {
+	if file == "" {
+		return strings.TrimSpace(text), nil
+	}
+	if text != "" {
+		return "", errors.New("--metrics-query and --metrics-query-file are mutually exclusive")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	if q := strings.TrimSpace(string(data)); q != "" {
+		return q, nil
+	}
+	return "", fmt.Errorf("%s is empty", file)
+}
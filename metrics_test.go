@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestMetricsExporter(t *testing.T) {
+	var sent string
+	m := &metricsExporter{query: "Q", database: "db", maxRows: 10, timeouts: resolveTimeouts(nil, nil, time.Minute)}
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "State", types.String),
+		query.NewColumn(1, "name", types.String), query.NewColumn(2, "Labels", types.Dynamic), query.NewColumn(3, "Value", types.Long)}}
+	rows := []value.Values{
+		{value.NewString("TEXAS"), value.NewString("storm_events"), value.NewDynamic([]byte(`{"source":"noaa","note":"a \"b\"\nc"}`)), value.NewLong(3)},
+		{value.NewString("OHIO"), value.NewString("storm_events"), value.NewDynamic(nil), value.NewLong(1)},
+		{value.NewString("OHIO"), value.NewString("storm_events"), value.NewDynamic(nil), value.NewLong(7)},
+		{value.NewString(""), value.NewString("storm.states"), value.NewDynamic(nil), value.NewLong(2)},
+		{value.NewString("IOWA"), value.NewString("storm_events"), value.NewDynamic(nil), value.NewNullLong()},
+	}
+	m.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		sent = q.String()
+		if err := enc.Begin(tbl); err != nil {
+			return err
+		}
+		for i, r := range rows {
+			if err := enc.WriteRow(tbl, i, r); err != nil {
+				return err
+			}
+		}
+		return enc.End()
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	scrape := func(accept string) (int, string, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+
+	status, ctype, body := scrape("text/plain")
+	want := "# TYPE storm_events gauge\n" +
+		`storm_events{State="OHIO"} 1` + "\n" +
+		`storm_events{State="TEXAS",note="a \"b\"\nc",source="noaa"} 3` + "\n" +
+		"# TYPE storm_states gauge\n" +
+		"storm_states 2\n"
+	if status != http.StatusOK || ctype != metricsTextType || body != want || sent != "Q" {
+		t.Errorf("scrape: %d %s %q\n%s\nwant:\n%s", status, ctype, sent, body, want)
+	}
+	if _, ctype, body := scrape("application/openmetrics-text;version=1.0.0,text/plain;q=0.5"); ctype != metricsOpenMetricsType || body != want+"# EOF\n" {
+		t.Errorf("OpenMetrics scrape: %s\n%s", ctype, body)
+	}
+
+	file := filepath.Join(t.TempDir(), "metrics.kql")
+	os.WriteFile(file, []byte("Q2\n"), 0o644)
+	if changed, err := m.reload(file); err != nil || changed != "metrics query replaced" {
+		t.Errorf("reload: %q, %v", changed, err)
+	}
+	if scrape(""); sent != "Q2" {
+		t.Errorf("the scrape after a reload sent %q", sent)
+	}
+	os.WriteFile(file, nil, 0o644)
+	if _, err := m.reload(file); err == nil || m.current() != "Q2" {
+		t.Errorf("a reload from an empty file: %v, running %q", err, m.current())
+	}
+
+	m.maxRows = 3
+	if status, _, body := scrape(""); status != http.StatusBadGateway || !strings.Contains(body, "--max-rows") {
+		t.Errorf("over --max-rows: %d %s", status, body)
+	}
+	tbl.Columns = tbl.Columns[:2]
+	if status, _, body := scrape(""); status != http.StatusBadGateway || !strings.Contains(body, "name and value") {
+		t.Errorf("no value column: %d %s", status, body)
+	}
+}
+
+func TestMetricsName(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		metric bool
+		want   string
+	}{
+		{"http_requests:rate5m", true, "http_requests:rate5m"},
+		{"http_requests:rate5m", false, "http_requests_rate5m"},
+		{"5xx count", true, "_xx_count"},
+		{"", false, "_"},
+	} {
+		if got := metricsName(c.in, c.metric); got != c.want {
+			t.Errorf("metricsName(%q, %v) = %q, want %q", c.in, c.metric, got, c.want)
+		}
+	}
+}
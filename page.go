@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pageQuery wraps a query so it returns only rows (page-1)*size+1 .. page*size, numbering rows
+// with serialize + row_number(). The result is only stable across calls when the query has a
+// deterministic order, which ordered reports (see queryOrdered).
+func pageQuery(query string, size, page int) (paged string, ordered bool, err error) {
+	if size <= 0 || page <= 0 {
+		return "", false, fmt.Errorf("--page-size and --page must be positive")
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	first := int64(page-1)*int64(size) + 1
+	last := int64(page) * int64(size)
+	paged = fmt.Sprintf("%s\n| serialize __page_row = row_number()\n| where __page_row between (%d .. %d)\n| project-away __page_row", query, first, last)
+	return paged, queryOrdered(query), nil
+}
+
+// orderBreakers are tabular operators whose output order is not defined by their input.
+var orderBreakers = map[string]bool{
+	"summarize": true, "join": true, "union": true, "distinct": true, "lookup": true,
+	"make-series": true, "evaluate": true, "facet": true, "fork": true, "partition": true,
+	"sample": true, "sample-distinct": true, "reduce": true, "top-nested": true, "top-hitters": true,
+}
+
+// queryOrdered reports whether the last statement of a query ends in a sort (order by, sort by,
+// top) that no later operator discards. It is a lexical check: strings, comments and brackets are
+// skipped, but it does not know whether the sort keys are unique.
+func queryOrdered(query string) bool {
+	stmts := kqlSplit(query, ';')
+	if len(stmts) == 0 {
+		return false
+	}
+	ordered := false
+	for _, stage := range kqlSplit(stmts[len(stmts)-1], '|') {
+		fields := strings.Fields(stage)
+		if len(fields) == 0 {
+			continue
+		}
+		op := strings.ToLower(fields[0])
+		switch {
+		case op == "top" || (op == "order" || op == "sort") && len(fields) > 1 && strings.EqualFold(fields[1], "by"):
+			ordered = true
+		case orderBreakers[op]:
+			ordered = false
+		}
+	}
+	return ordered
+}
+
+// kqlSplit splits KQL text on sep where it appears outside string literals, // comments and
+// brackets. Empty pieces are dropped.
+func kqlSplit(text string, sep byte) []string {
+	var parts []string
+	var cur strings.Builder
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			cur.WriteByte('\n')
+			continue
+		case kqlStringEnd(text, i) > i:
+			j := kqlStringEnd(text, i)
+			cur.WriteString(text[i:j])
+			i = j - 1
+			continue
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case c == sep && depth == 0:
+			if s := strings.TrimSpace(cur.String()); s != "" {
+				parts = append(parts, s)
+			}
+			cur.Reset()
+			continue
+		}
+		cur.WriteByte(c)
+	}
+	if s := strings.TrimSpace(cur.String()); s != "" {
+		parts = append(parts, s)
+	}
+	return parts
+}
+
+// kqlStringEnd returns the end of the string literal starting at text[i], or i if none starts
+// there. A quoted string takes backslash escapes; a verbatim one, @"..." or @'...', doesn't, and a
+// doubled quote stands for one; a multi-line one is fenced by ```. An unterminated literal runs to
+// the end of text.
+func kqlStringEnd(text string, i int) int {
+	switch c := text[i]; {
+	case c == '"' || c == '\'':
+		j := i + 1
+		for j < len(text) && text[j] != c {
+			if text[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		return min(j+1, len(text))
+	case c == '@' && i+1 < len(text) && (text[i+1] == '"' || text[i+1] == '\''):
+		q := text[i+1]
+		for j := i + 2; j < len(text); j++ {
+			if text[j] != q {
+				continue
+			}
+			if j+1 < len(text) && text[j+1] == q {
+				j++
+				continue
+			}
+			return j + 1
+		}
+		return len(text)
+	case strings.HasPrefix(text[i:], "```"):
+		if j := strings.Index(text[i+3:], "```"); j >= 0 {
+			return i + 3 + j + 3
+		}
+		return len(text)
+	}
+	return i
+}
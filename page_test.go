@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPageQuery(t *testing.T) {
+	tests := []struct {
+		query      string
+		size, page int
+		want       string
+		ordered    bool
+		err        bool
+	}{
+		{query: "StormEvents | order by StartTime asc;", size: 100, page: 1, ordered: true,
+			want: "StormEvents | order by StartTime asc\n| serialize __page_row = row_number()\n| where __page_row between (1 .. 100)\n| project-away __page_row"},
+		{query: "StormEvents | top 1000 by DamageProperty", size: 100, page: 3, ordered: true,
+			want: "StormEvents | top 1000 by DamageProperty\n| serialize __page_row = row_number()\n| where __page_row between (201 .. 300)\n| project-away __page_row"},
+		{query: "StormEvents", size: 3000000000, page: 2,
+			want: "StormEvents\n| serialize __page_row = row_number()\n| where __page_row between (3000000001 .. 6000000000)\n| project-away __page_row"},
+		{query: "StormEvents", size: 0, page: 1, err: true},
+		{query: "StormEvents", size: 10, page: 0, err: true},
+	}
+	for _, tt := range tests {
+		got, ordered, err := pageQuery(tt.query, tt.size, tt.page)
+		if (err != nil) != tt.err {
+			t.Errorf("%q size %d page %d: error %v", tt.query, tt.size, tt.page, err)
+			continue
+		}
+		if got != tt.want || ordered != tt.ordered {
+			t.Errorf("%q size %d page %d:\n%s (ordered %t)\nwant\n%s (ordered %t)", tt.query, tt.size, tt.page, got, ordered, tt.want, tt.ordered)
+		}
+	}
+}
+
+func TestQueryOrdered(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"StormEvents | order by StartTime", true},
+		{"StormEvents | SORT BY State asc, StartTime desc", true},
+		{"StormEvents | top 10 by DamageProperty | project State", true},
+		{"StormEvents", false},
+		{"StormEvents | sort by State | summarize count() by State", false},
+		{"StormEvents | summarize n = count() by State | order by n desc", true},
+		{"StormEvents | order by State | join (Other) on State", false},
+		{"StormEvents | order by State | take 10", true},
+		// A pipe or keyword in a string, comment or subquery isn't a stage of the query.
+		{`StormEvents | where Note == "x | summarize" | order by State`, true},
+		{"StormEvents | order by State // | summarize count()", true},
+		{"StormEvents | where State in ((Other | summarize by State)) | sort by State", true},
+		{"StormEvents | where State in ((Other | order by State))", false},
+		// Only the last statement counts.
+		{"let s = StormEvents | order by State; s | distinct State", false},
+		{"let s = StormEvents | distinct State; s | order by State", true},
+		{"StormEvents | order", false},
+	}
+	for _, tt := range tests {
+		if got := queryOrdered(tt.query); got != tt.want {
+			t.Errorf("queryOrdered(%q) = %t, want %t", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestKQLSplit(t *testing.T) {
+	tests := []struct {
+		text string
+		sep  byte
+		want []string
+	}{
+		{"a | b | c", '|', []string{"a", "b", "c"}},
+		{`T | where s == 'it\'s | x' | take 1`, '|', []string{"T", `where s == 'it\'s | x'`, "take 1"}},
+		{"T | extend d = dynamic({\"a\": [1|2]}) | take 1", '|', []string{"T", "extend d = dynamic({\"a\": [1|2]})", "take 1"}},
+		{"let x = 1;\n\nT | take x;", ';', []string{"let x = 1", "T | take x"}},
+		{`T | where p == @"C:\" | take 1`, '|', []string{"T", `where p == @"C:\"`, "take 1"}},
+		{`print @'it''s | x' | take 1`, '|', []string{"print @'it''s | x'", "take 1"}},
+		{"print ```a | \"b``` | take 1", '|', []string{"print ```a | \"b```", "take 1"}},
+		{"T // a | b\n| take 1", '|', []string{"T", "take 1"}},
+		{"", '|', nil},
+	}
+	for _, tt := range tests {
+		got := kqlSplit(tt.text, tt.sep)
+		if strings.Join(got, "¦") != strings.Join(tt.want, "¦") {
+			t.Errorf("kqlSplit(%q, %q) = %q, want %q", tt.text, tt.sep, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Package classify sorts Kusto and transport errors into the few classes callers act on:
+// fix the endpoint, fix credentials, ask for permissions, create the database or table, or back off.
+// Errors answered by the cluster are classified by their HTTP status and OneAPI error code (see
+// Service), which don't depend on the cluster's locale. The rest, such as transport and token
+// errors, only have their text, so the checks fall back to heuristics over it.
+package classify
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Class is the kind of failure an error represents.
+type Class string
+
+const (
+	Network          Class = "network"
+	Auth             Class = "auth"
+	Permission       Class = "permission"
+	DatabaseNotFound Class = "database-not-found"
+	TableNotFound    Class = "table-not-found"
+	Throttled        Class = "throttled"
+	Other            Class = "other"
+)
+
+// Of returns the class of err, or "" for nil. An error with a recognized service code is
+// classified by the code alone. Otherwise the more specific classes win: a throttled
+// request is Throttled even though it was also refused, and Auth is checked last because its
+// heuristic (any mention of tokens or credentials) is the loosest.
+func Of(err error) Class {
+	if err == nil {
+		return ""
+	}
+	if c := serviceClass(err); c != "" {
+		return c
+	}
+	switch {
+	case IsThrottled(err):
+		return Throttled
+	case IsNetwork(err):
+		return Network
+	case IsDatabaseNotFound(err):
+		return DatabaseNotFound
+	case IsTableNotFound(err):
+		return TableNotFound
+	case IsPermission(err):
+		return Permission
+	case IsAuth(err) || LooksLikeAAD(err):
+		return Auth
+	}
+	return Other
+}
+
+// IsNetwork reports whether err is a transport failure: DNS, refused connections or timeouts.
+func IsNetwork(err error) bool {
+	var nErr net.Error
+	if errors.As(err, &nErr) {
+		return true
+	}
+	if _, ok := Service(err); ok {
+		return false // the cluster answered
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such host") || strings.Contains(msg, "connection refused") || strings.Contains(msg, "timeout")
+}
+
+// LooksLikeAAD reports whether err came from acquiring a token rather than from the cluster.
+func LooksLikeAAD(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "aadsts") || strings.Contains(msg, "token") || strings.Contains(msg, "credential")
+}
+
+// IsAuth reports whether the cluster rejected the caller's identity (401).
+func IsAuth(err error) bool {
+	if c := serviceClass(err); c != "" {
+		return c == Auth
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unauthorized") || strings.Contains(msg, "401") || strings.Contains(msg, "authorization")
+}
+
+// IsPermission reports whether the caller is known but lacks access (403).
+func IsPermission(err error) bool {
+	if c := serviceClass(err); c != "" {
+		return c == Permission
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "forbidden") || strings.Contains(msg, "403") || strings.Contains(msg, "insufficient") || strings.Contains(msg, "permission")
+}
+
+// IsDatabaseNotFound reports whether the database does not exist.
+func IsDatabaseNotFound(err error) bool {
+	if c := serviceClass(err); c != "" {
+		return c == DatabaseNotFound
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "database") && strings.Contains(msg, "not found")
+}
+
+// IsTableNotFound reports whether a query failed semantic analysis on an unknown table or name.
+func IsTableNotFound(err error) bool {
+	if c := serviceClass(err); c != "" {
+		return c == TableNotFound
+	}
+	msg := strings.ToLower(err.Error())
+	// Heuristics for semantic errors indicating missing table
+	return strings.Contains(msg, "semantic") && (strings.Contains(msg, "table") || strings.Contains(msg, "name")) && strings.Contains(msg, "not")
+}
+
+// IsThrottled reports whether a query was rejected by the cluster's admission control
+// (request rate limits, workload group limits or capacity).
+func IsThrottled(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if c := serviceClass(err); c != "" {
+		return c == Throttled
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "throttl") || strings.Contains(msg, "429") || strings.Contains(msg, "too many requests")
+}
@@ -0,0 +1,149 @@
+package classify
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	kerrors "github.com/Azure/azure-kusto-go/azkustodata/errors"
+)
+
+// ServiceError is the structured part of an error answered by the cluster: the HTTP status and
+// the OneAPI error payload ({"error": {"code": ..., "@type": ..., "@permanent": ...}}). Unlike
+// the message, none of these fields are localized.
+type ServiceError struct {
+	StatusCode int    // 0 if the error didn't come with an HTTP status
+	Code       string // e.g. "BadRequest_EntityNotFound"
+	ErrorCode  string // the more specific @errorCode, e.g. "SEM0100", if any
+	Type       string // the exception type, e.g. "Kusto.Data.Exceptions.EntityNotFoundException"
+	Message    string // @message, or message; may be localized
+	Permanent  bool   // @permanent: retrying the same request won't help
+}
+
+// String formats the codes for error output, e.g. "403 Forbidden" or
+// "400 General_BadRequest/SEM0100, permanent".
+func (s *ServiceError) String() string {
+	var parts []string
+	if s.StatusCode != 0 {
+		parts = append(parts, fmt.Sprint(s.StatusCode))
+	}
+	code := s.Code
+	if s.ErrorCode != "" && s.ErrorCode != s.Code {
+		code = strings.TrimPrefix(code+"/"+s.ErrorCode, "/")
+	}
+	if code != "" {
+		parts = append(parts, code)
+	}
+	out := strings.Join(parts, " ")
+	if s.Permanent {
+		out += ", permanent"
+	}
+	return out
+}
+
+// restError is implemented by the SDK's errors that carry the REST response body.
+type restError interface {
+	UnmarshalREST() map[string]interface{}
+}
+
+// Service returns the structured error in err's chain, if the cluster sent one.
+func Service(err error) (*ServiceError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	s := &ServiceError{}
+	var hErr *kerrors.HttpError
+	if errors.As(err, &hErr) {
+		s.StatusCode = hErr.StatusCode
+	}
+	var rErr restError
+	if errors.As(err, &rErr) {
+		if body, ok := rErr.UnmarshalREST()["error"].(map[string]interface{}); ok {
+			s.Code, _ = body["code"].(string)
+			s.ErrorCode, _ = body["@errorCode"].(string)
+			s.Type, _ = body["@type"].(string)
+			s.Permanent, _ = body["@permanent"].(bool)
+			if s.Message, _ = body["@message"].(string); s.Message == "" {
+				s.Message, _ = body["message"].(string)
+			}
+		}
+	}
+	if s.StatusCode == 0 && s.Code == "" && s.Type == "" {
+		return nil, false
+	}
+	return s, true
+}
+
+// Code returns the codes of the structured error in err's chain, formatted for error output
+// (see ServiceError.String), or "" if there is none.
+func Code(err error) string {
+	if s, ok := Service(err); ok {
+		return s.String()
+	}
+	return ""
+}
+
+// positionPattern matches the location Kusto appends to syntax and semantic error messages, as
+// in "... [line:position=2:14]".
+var positionPattern = regexp.MustCompile(`\[line:position=(\d+):(\d+)\]`)
+
+// Position returns where in the query text a syntax or semantic error is, as Kusto reports it:
+// a 1-based line and a 0-based position within the line. ok is false if err doesn't say.
+func Position(err error) (line, pos int, ok bool) {
+	if err == nil {
+		return 0, 0, false
+	}
+	texts := []string{err.Error()}
+	if s, found := Service(err); found {
+		texts = append([]string{s.Message}, texts...)
+	}
+	for _, t := range texts {
+		if m := positionPattern.FindStringSubmatch(t); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			pos, _ = strconv.Atoi(m[2])
+			return line, pos, true
+		}
+	}
+	return 0, 0, false
+}
+
+// classOf maps a structured error to its class, or "" when the codes don't say. Codes are
+// matched on their words, so General_BadRequest_EntityNotFound and BadRequest_EntityNotFound
+// both count.
+func (s *ServiceError) classOf() Class {
+	has := func(words ...string) bool {
+		for _, w := range words {
+			if strings.Contains(s.Code, w) || strings.Contains(s.ErrorCode, w) || strings.Contains(s.Type, w) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case s.StatusCode == 429 || has("Throttled", "TooManyRequests", "LimitsExceeded"):
+		return Throttled
+	case has("DatabaseNotFound", "DatabaseNotExist"):
+		return DatabaseNotFound
+	case has("TableNotFound", "SEM0100", "SemanticException"):
+		return TableNotFound
+	case has("EntityNotFound"):
+		// The database is the entity a query names before any table is resolved; a missing
+		// table fails semantic analysis instead.
+		return DatabaseNotFound
+	case s.StatusCode == 403 || has("Forbidden", "UnauthorizedDatabaseAccess"):
+		return Permission
+	case s.StatusCode == 401 || has("Unauthorized"):
+		return Auth
+	}
+	return ""
+}
+
+// serviceClass is the class the structured error in err's chain says, or "".
+func serviceClass(err error) Class {
+	if s, ok := Service(err); ok {
+		return s.classOf()
+	}
+	return ""
+}
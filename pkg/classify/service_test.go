@@ -0,0 +1,59 @@
+package classify
+
+import (
+	"fmt"
+	"testing"
+
+	kerrors "github.com/Azure/azure-kusto-go/azkustodata/errors"
+)
+
+// restErr is an error carrying a REST body, like the SDK's errors, with a message in a locale
+// none of the text heuristics know.
+type restErr struct {
+	body map[string]interface{}
+	msg  string
+}
+
+func (e restErr) Error() string                         { return e.msg }
+func (e restErr) UnmarshalREST() map[string]interface{} { return e.body }
+
+func oneAPI(fields map[string]interface{}) restErr {
+	return restErr{body: map[string]interface{}{"error": fields}, msg: "Die Anfrage ist ungültig"}
+}
+
+func TestServiceClass(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+		want Class
+		code string
+	}{
+		{"entity not found", oneAPI(map[string]interface{}{"code": "General_BadRequest_EntityNotFound", "@permanent": true}), DatabaseNotFound, "General_BadRequest_EntityNotFound, permanent"},
+		{"semantic error", oneAPI(map[string]interface{}{"code": "General_BadRequest", "@errorCode": "SEM0100", "@type": "Kusto.Data.Exceptions.SemanticException"}), TableNotFound, "General_BadRequest/SEM0100"},
+		{"forbidden", &kerrors.HttpError{StatusCode: 403}, Permission, "403"},
+		{"unauthorized", &kerrors.HttpError{StatusCode: 401}, Auth, "401"},
+		{"throttled", oneAPI(map[string]interface{}{"code": "LimitsExceeded"}), Throttled, "LimitsExceeded"},
+		{"wrapped", fmt.Errorf("query submission failed: %w", &kerrors.HttpError{StatusCode: 429}), Throttled, "429"},
+		{"no payload", fmt.Errorf("dial tcp: lookup x: no such host"), Network, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Of(c.err); got != c.want {
+				t.Errorf("Of = %q, want %q", got, c.want)
+			}
+			if got := Code(c.err); got != c.code {
+				t.Errorf("Code = %q, want %q", got, c.code)
+			}
+		})
+	}
+}
+
+func TestPosition(t *testing.T) {
+	semantic := oneAPI(map[string]interface{}{"code": "General_BadRequest", "@errorCode": "SEM0100",
+		"@message": "'where' operator: Failed to resolve scalar expression named 'Stat' [line:position=2:8]"})
+	if line, pos, ok := Position(fmt.Errorf("query submission failed: %w", semantic)); !ok || line != 2 || pos != 8 {
+		t.Errorf("semantic error: Position = %d, %d, %v, want 2, 8, true", line, pos, ok)
+	}
+	if _, _, ok := Position(fmt.Errorf("dial tcp: lookup x: no such host")); ok {
+		t.Error("a network error has a position")
+	}
+}
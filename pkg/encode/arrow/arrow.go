@@ -0,0 +1,477 @@
+// Package arrow is the Arrow result format. Importing it registers --format arrow with package
+// encode.
+package arrow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func init() {
+	encode.Register("arrow", func(w io.Writer, _ encode.Options) encode.Encoder { return &writer{w: w} })
+}
+
+// Record batches are sent once they hold batchRows rows or batchBytes of values, so a reader can
+// start on the first while the query is still running and the int32 string offsets can't overflow.
+const (
+	batchRows  = 65536
+	batchBytes = 64 << 20
+)
+
+// writer is --format arrow: an Arrow IPC stream (what pyarrow.ipc.open_stream, DuckDB and
+// DataFusion read) of the first primary result table, one schema message followed by record
+// batches. A stream holds a single schema, so later tables are skipped with a warning, as for
+// parquet. A result without a primary table produces a stream with no columns.
+//
+// Types: bool → Bool, int → Int32, long → Int64, real → Float64, datetime → Timestamp(µs, UTC),
+// timespan → Duration(ns), guid → FixedSizeBinary(16) tagged arrow.uuid, dynamic → Utf8 tagged
+// arrow.json, and decimal/string → Utf8 (decimals as text: their scale varies per value, which
+// Decimal128 can't hold). Every column is nullable.
+type writer struct {
+	w     io.Writer
+	table *encode.Table
+	cols  []*column
+	rows  int
+	size  int
+}
+
+func (a *writer) Begin(t *encode.Table) error {
+	if t.Kind != "PrimaryResult" {
+		return nil
+	}
+	if a.table != nil {
+		fmt.Fprintf(os.Stderr, "WARN arrow: skipping table %s; an Arrow stream holds one table\n", t.Name)
+		return nil
+	}
+	a.table = t
+	for _, c := range t.Columns {
+		a.cols = append(a.cols, &column{name: c.Name(), kusto: c.Type()})
+	}
+	return a.schema()
+}
+
+func (a *writer) WriteRow(t *encode.Table, _ int, vals value.Values) error {
+	if t != a.table {
+		return nil
+	}
+	for i, c := range a.cols {
+		var v interface{}
+		if i < len(vals) {
+			v = encode.PlainValue(vals[i])
+		}
+		a.size += c.add(a.rows, v)
+	}
+	a.rows++
+	if a.rows >= batchRows || a.size >= batchBytes {
+		return a.batch()
+	}
+	return nil
+}
+
+func (a *writer) End() error {
+	if a.table == nil {
+		if err := a.schema(); err != nil {
+			return err
+		}
+	}
+	if err := a.batch(); err != nil {
+		return err
+	}
+	_, err := a.w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}) // end of stream
+	return err
+}
+
+// Arrow enum values used by the writer.
+const (
+	metadataV5 = 4
+
+	headerSchema      = 1
+	headerRecordBatch = 3
+
+	typeInt             = 2
+	typeFloatingPoint   = 3
+	typeUtf8            = 5
+	typeBool            = 6
+	typeTimestamp       = 10
+	typeFixedSizeBinary = 15
+	typeDuration        = 18
+
+	precisionDouble = 2
+	unitMicrosecond = 2
+	unitNanosecond  = 3
+)
+
+// column buffers one column's values of the current record batch in Arrow layout.
+type column struct {
+	name  string
+	kusto types.Column
+
+	valid   []byte // validity bitmap
+	nulls   int
+	bits    []byte  // bool values
+	data    []byte  // fixed-width values, or the bytes of the strings
+	offsets []int32 // where each string starts in data, plus the end
+}
+
+// add appends row's value and returns the bytes it added. A value that doesn't fit the
+// column's type is written as null.
+func (c *column) add(row int, v interface{}) int {
+	if row%8 == 0 {
+		c.valid = append(c.valid, 0)
+		if c.kusto == types.Bool {
+			c.bits = append(c.bits, 0)
+		}
+	}
+	if c.variable() && len(c.offsets) == 0 {
+		c.offsets = append(c.offsets, 0)
+	}
+	before := len(c.data)
+	ok := v != nil
+	if ok {
+		ok = c.put(row, v)
+	}
+	if ok {
+		c.valid[row/8] |= 1 << (row % 8)
+	} else {
+		c.nulls++
+		c.data = append(c.data[:before], make([]byte, c.width())...)
+	}
+	if c.variable() {
+		c.offsets = append(c.offsets, int32(len(c.data)))
+	}
+	return len(c.data) - before
+}
+
+func (c *column) put(row int, v interface{}) bool {
+	switch c.kusto {
+	case types.Bool:
+		b, ok := v.(bool)
+		if ok && b {
+			c.bits[row/8] |= 1 << (row % 8)
+		}
+		return ok
+	case types.Int:
+		n, ok := v.(int32)
+		c.data = binary.LittleEndian.AppendUint32(c.data, uint32(n))
+		return ok
+	case types.Long:
+		n, ok := v.(int64)
+		c.data = binary.LittleEndian.AppendUint64(c.data, uint64(n))
+		return ok
+	case types.Real:
+		f, ok := v.(float64)
+		c.data = binary.LittleEndian.AppendUint64(c.data, math.Float64bits(f))
+		return ok
+	case types.DateTime:
+		t, ok := v.(time.Time)
+		c.data = binary.LittleEndian.AppendUint64(c.data, uint64(t.UnixMicro()))
+		return ok
+	case types.Timespan:
+		d, ok := v.(time.Duration)
+		c.data = binary.LittleEndian.AppendUint64(c.data, uint64(d))
+		return ok
+	case types.GUID:
+		u, ok := v.(uuid.UUID)
+		c.data = append(c.data, u[:]...)
+		return ok
+	}
+	switch x := v.(type) {
+	case string:
+		c.data = append(c.data, x...)
+	case []byte:
+		c.data = append(c.data, x...)
+	case decimal.Decimal:
+		c.data = append(c.data, x.String()...)
+	default:
+		c.data = append(c.data, fmt.Sprint(x)...)
+	}
+	return true
+}
+
+// width is the size of a fixed-width value, 0 for bool and the variable-length types.
+func (c *column) width() int {
+	switch c.kusto {
+	case types.Int:
+		return 4
+	case types.Long, types.Real, types.DateTime, types.Timespan:
+		return 8
+	case types.GUID:
+		return 16
+	}
+	return 0
+}
+
+func (c *column) variable() bool {
+	return c.kusto != types.Bool && c.width() == 0
+}
+
+// field describes the column in the schema message.
+func (c *column) field() fbTable {
+	f := fbTable{
+		0: fbString(c.name),
+		1: fbBool(true),
+		5: fbVector{},
+	}
+	var extension string
+	switch c.kusto {
+	case types.Bool:
+		f[2], f[3] = fbUint8(typeBool), fbTable{}
+	case types.Int, types.Long:
+		width := int32(32)
+		if c.kusto == types.Long {
+			width = 64
+		}
+		f[2], f[3] = fbUint8(typeInt), fbTable{0: fbInt32(width), 1: fbBool(true)}
+	case types.Real:
+		f[2], f[3] = fbUint8(typeFloatingPoint), fbTable{0: fbInt16(precisionDouble)}
+	case types.DateTime:
+		f[2], f[3] = fbUint8(typeTimestamp), fbTable{0: fbInt16(unitMicrosecond), 1: fbString("UTC")}
+	case types.Timespan:
+		f[2], f[3] = fbUint8(typeDuration), fbTable{0: fbInt16(unitNanosecond)}
+	case types.GUID:
+		f[2], f[3] = fbUint8(typeFixedSizeBinary), fbTable{0: fbInt32(16)}
+		extension = "arrow.uuid"
+	default:
+		f[2], f[3] = fbUint8(typeUtf8), fbTable{}
+		if c.kusto == types.Dynamic {
+			extension = "arrow.json"
+		}
+	}
+	if extension != "" {
+		f[6] = fbVector{
+			fbTable{0: fbString("ARROW:extension:name"), 1: fbString(extension)},
+			fbTable{0: fbString("ARROW:extension:metadata"), 1: fbString("")},
+		}
+	}
+	return f
+}
+
+// buffers returns the column's body buffers, in the order its layout lists them.
+func (c *column) buffers() [][]byte {
+	switch {
+	case c.kusto == types.Bool:
+		return [][]byte{c.valid, c.bits}
+	case c.variable():
+		offsets := make([]byte, 0, 4*len(c.offsets))
+		for _, o := range c.offsets {
+			offsets = binary.LittleEndian.AppendUint32(offsets, uint32(o))
+		}
+		return [][]byte{c.valid, offsets, c.data}
+	}
+	return [][]byte{c.valid, c.data}
+}
+
+func (c *column) reset() {
+	c.valid, c.bits, c.data, c.offsets, c.nulls = c.valid[:0], c.bits[:0], c.data[:0], c.offsets[:0], 0
+}
+
+func (a *writer) schema() error {
+	fields := make(fbVector, len(a.cols))
+	for i, c := range a.cols {
+		fields[i] = c.field()
+	}
+	return a.message(headerSchema, fbTable{0: fbInt16(0), 1: fields}, nil)
+}
+
+// batch sends the buffered rows as a record batch.
+func (a *writer) batch() error {
+	if a.rows == 0 {
+		return nil
+	}
+	var nodes, bufs []byte
+	var body [][]byte
+	var offset int64
+	for _, c := range a.cols {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(a.rows))
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(c.nulls))
+		for _, b := range c.buffers() {
+			bufs = binary.LittleEndian.AppendUint64(bufs, uint64(offset))
+			bufs = binary.LittleEndian.AppendUint64(bufs, uint64(len(b)))
+			body = append(body, b)
+			offset += pad8(int64(len(b)))
+		}
+		c.reset()
+	}
+	header := fbTable{
+		0: fbInt64(int64(a.rows)),
+		1: fbStructs{n: len(a.cols), b: nodes},
+		2: fbStructs{n: len(bufs) / 16, b: bufs},
+	}
+	a.rows, a.size = 0, 0
+	return a.message(headerRecordBatch, header, body)
+}
+
+// message writes an encapsulated IPC message: the continuation marker, the length of the
+// flatbuffer Message, the Message padded to 8 bytes, and the body buffers, each padded to 8.
+func (a *writer) message(headerType uint8, header fbTable, body [][]byte) error {
+	var bodyLength int64
+	for _, b := range body {
+		bodyLength += pad8(int64(len(b)))
+	}
+	meta := fbFinish(fbTable{
+		0: fbInt16(metadataV5),
+		1: fbUint8(headerType),
+		2: header,
+		3: fbInt64(bodyLength),
+	})
+	meta = append(meta, make([]byte, pad8(int64(len(meta)))-int64(len(meta)))...)
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:4], 0xffffffff)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	out := bytes.NewBuffer(make([]byte, 0, 8+len(meta)+int(bodyLength)))
+	out.Write(prefix[:])
+	out.Write(meta)
+	for _, b := range body {
+		out.Write(b)
+		out.Write(make([]byte, pad8(int64(len(b)))-int64(len(b))))
+	}
+	_, err := a.w.Write(out.Bytes())
+	return err
+}
+
+func pad8(n int64) int64 { return (n + 7) &^ 7 }
+
+// A flatbuffer under construction, for the IPC metadata: tables map field ids to scalars or to
+// the strings, vectors and tables they refer to. fbFinish lays it out front to back, every
+// table's vtable before it and what it refers to after it, so offsets point forward as
+// flatbuffers requires.
+type (
+	fbValue   interface{}
+	fbTable   map[int]fbValue
+	fbString  string
+	fbVector  []fbValue // of tables
+	fbStructs struct {  // a vector of 8-byte aligned structs, already encoded
+		n int
+		b []byte
+	}
+	fbBool  bool
+	fbUint8 uint8
+	fbInt16 int16
+	fbInt32 int32
+	fbInt64 int64
+)
+
+type fbBuilder struct{ b []byte }
+
+func fbFinish(root fbTable) []byte {
+	f := &fbBuilder{b: make([]byte, 4, 512)}
+	f.patch(0, f.place(root))
+	return f.b
+}
+
+func (f *fbBuilder) align(n int) {
+	for len(f.b)%n != 0 {
+		f.b = append(f.b, 0)
+	}
+}
+
+// patch points the offset at pos to target.
+func (f *fbBuilder) patch(pos, target int) {
+	binary.LittleEndian.PutUint32(f.b[pos:], uint32(target-pos))
+}
+
+// place appends a referenced value and returns its position.
+func (f *fbBuilder) place(v fbValue) int {
+	switch x := v.(type) {
+	case fbTable:
+		return f.table(x)
+	case fbString:
+		f.align(4)
+		pos := len(f.b)
+		f.b = binary.LittleEndian.AppendUint32(f.b, uint32(len(x)))
+		f.b = append(append(f.b, x...), 0)
+		return pos
+	case fbVector:
+		f.align(4)
+		pos := len(f.b)
+		f.b = binary.LittleEndian.AppendUint32(f.b, uint32(len(x)))
+		f.b = append(f.b, make([]byte, 4*len(x))...)
+		for i, e := range x {
+			f.patch(pos+4+4*i, f.place(e))
+		}
+		return pos
+	case fbStructs:
+		for (len(f.b)+4)%8 != 0 {
+			f.b = append(f.b, 0)
+		}
+		pos := len(f.b)
+		f.b = binary.LittleEndian.AppendUint32(f.b, uint32(x.n))
+		f.b = append(f.b, x.b...)
+		return pos
+	}
+	panic(fmt.Sprintf("arrow: %T is not a flatbuffer reference", v))
+}
+
+func (f *fbBuilder) table(t fbTable) int {
+	n := 0
+	for id := range t {
+		n = max(n, id+1)
+	}
+	offsets := make([]int, n)
+	size := 4 // the offset to the vtable
+	for id := 0; id < n; id++ {
+		if v, ok := t[id]; ok {
+			w := fbSize(v)
+			size = (size + w - 1) / w * w
+			offsets[id] = size
+			size += w
+		}
+	}
+	f.align(2)
+	vtable := len(f.b)
+	f.b = binary.LittleEndian.AppendUint16(f.b, uint16(4+2*n))
+	f.b = binary.LittleEndian.AppendUint16(f.b, uint16(size))
+	for _, o := range offsets {
+		f.b = binary.LittleEndian.AppendUint16(f.b, uint16(o))
+	}
+	f.align(8)
+	pos := len(f.b)
+	f.b = append(f.b, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(f.b[pos:], uint32(int32(pos-vtable)))
+	for id := 0; id < n; id++ {
+		at := f.b[pos+offsets[id]:]
+		switch x := t[id].(type) {
+		case nil:
+		case fbBool:
+			if x {
+				at[0] = 1
+			}
+		case fbUint8:
+			at[0] = byte(x)
+		case fbInt16:
+			binary.LittleEndian.PutUint16(at, uint16(x))
+		case fbInt32:
+			binary.LittleEndian.PutUint32(at, uint32(x))
+		case fbInt64:
+			binary.LittleEndian.PutUint64(at, uint64(x))
+		default:
+			f.patch(pos+offsets[id], f.place(x))
+		}
+	}
+	return pos
+}
+
+// fbSize is the inline size of a table field: the scalar, or the offset to what it refers to.
+func fbSize(v fbValue) int {
+	switch v.(type) {
+	case fbBool, fbUint8:
+		return 1
+	case fbInt16:
+		return 2
+	case fbInt64:
+		return 8
+	}
+	return 4
+}
@@ -0,0 +1,274 @@
+package encode
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// csvFlushSize is how much output the CSV writer collects before writing it out.
+const csvFlushSize = 64 << 10
+
+// csvWriter emits primary result tables as RFC 4180 CSV: CRLF line endings, a header row of
+// column names, and fields quoted when they contain commas, quotes or line breaks. Values are
+// written the way Kusto ingests them back (ISO 8601 datetimes, [d.]hh:mm:ss timespans, dynamic as
+// its JSON text); nulls are written as the configured null text, empty by default. A second
+// primary table follows the first after an empty line, with its own header row.
+//
+// Large extracts spend most of their time here, so rows are appended to one reused buffer
+// straight from the SDK's values (see Row), without formatting each field into a string first: a
+// row of scalars costs no allocations. Quoting follows encoding/csv with UseCRLF.
+type csvWriter struct {
+	out    io.Writer
+	buf    []byte
+	null   string
+	skip   bool
+	tables int
+	err    error
+}
+
+func newCSVWriter(w io.Writer, null string) *csvWriter {
+	return &csvWriter{out: w, buf: make([]byte, 0, 2*csvFlushSize), null: null}
+}
+
+func (c *csvWriter) Begin(t *Table) error {
+	c.skip = t.Kind != "PrimaryResult"
+	if c.skip {
+		return c.err
+	}
+	if c.tables > 0 {
+		c.buf = append(c.buf, '\r', '\n')
+	}
+	c.tables++
+	for i, col := range t.Columns {
+		if i > 0 {
+			c.buf = append(c.buf, ',')
+		}
+		c.buf = appendCSVField(c.buf, col.Name())
+	}
+	c.buf = append(c.buf, '\r', '\n')
+	return c.flush(csvFlushSize)
+}
+
+func (c *csvWriter) WriteRow(t *Table, index int, vals value.Values) error {
+	if c.skip {
+		return c.err
+	}
+	c.buf = c.appendRow(c.buf, t, vals)
+	return c.flush(csvFlushSize)
+}
+
+// EncodeRow appends the row's line; rows of tables other than primary results have none.
+func (c *csvWriter) EncodeRow(dst []byte, t *Table, index int, vals value.Values) ([]byte, error) {
+	if t.Kind != "PrimaryResult" {
+		return dst, nil
+	}
+	return c.appendRow(dst, t, vals), nil
+}
+
+func (c *csvWriter) WriteEncoded(_ *Table, _ int, _ value.Values, line []byte) error {
+	if c.skip {
+		return c.err
+	}
+	c.buf = append(c.buf, line...)
+	return c.flush(csvFlushSize)
+}
+
+func (c *csvWriter) appendRow(b []byte, t *Table, vals value.Values) []byte {
+	row := RowAt(vals)
+	for i, col := range t.Columns {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendCSVCell(b, row, i, col.Type(), c.null)
+	}
+	return append(b, '\r', '\n')
+}
+
+func (c *csvWriter) End() error {
+	return c.flush(0)
+}
+
+// flush writes the buffered output once it has reached size bytes.
+func (c *csvWriter) flush(size int) error {
+	if c.err != nil || len(c.buf) < size || len(c.buf) == 0 {
+		return c.err
+	}
+	_, c.err = c.out.Write(c.buf)
+	c.buf = c.buf[:0]
+	return c.err
+}
+
+// appendCSVCell appends the value in col, of column type typ, as a CSV field, or null for a null
+// value. It reads the values through Row rather than PlainValue, which would box every number
+// into an interface.
+func appendCSVCell(b []byte, r Row, col int, typ types.Column, null string) []byte {
+	switch typ {
+	case types.String:
+		if s, ok := r.String(col); ok {
+			return appendCSVField(b, s)
+		}
+	case types.Int, types.Long:
+		if n, ok := r.Long(col); ok {
+			return strconv.AppendInt(b, n, 10)
+		}
+	case types.Real:
+		if f, ok := r.Real(col); ok {
+			return strconv.AppendFloat(b, f, 'g', -1, 64)
+		}
+	case types.Bool:
+		if v, ok := r.Bool(col); ok {
+			return strconv.AppendBool(b, v)
+		}
+	case types.Decimal:
+		if d, ok := r.Decimal(col); ok {
+			return append(b, d.String()...)
+		}
+	case types.DateTime:
+		if t, ok := r.DateTime(col); ok {
+			return t.UTC().AppendFormat(b, time.RFC3339Nano)
+		}
+	case types.Timespan:
+		if d, ok := r.Timespan(col); ok {
+			return appendTimespan(b, d)
+		}
+	case types.GUID:
+		if u, ok := r.GUID(col); ok {
+			return appendUUID(b, u)
+		}
+	case types.Dynamic:
+		if d, ok := r.Dynamic(col); ok {
+			return appendCSVField(b, d)
+		}
+	}
+	if !r.Null(col) {
+		// A value whose type doesn't match its column's.
+		return appendCSVField(b, csvField(PlainValue(r[col])))
+	}
+	return appendCSVField(b, null)
+}
+
+// appendCSVField appends s, quoted if encoding/csv would quote it. Inside quotes, quotes are
+// doubled and line breaks written as CRLF.
+func appendCSVField[T string | []byte](b []byte, s T) []byte {
+	if !csvNeedsQuotes(s) {
+		return append(b, s...)
+	}
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			b = append(b, '"', '"')
+		case '\r':
+		case '\n':
+			b = append(b, '\r', '\n')
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// csvNeedsQuotes reports whether a field contains a comma, quote or line break, starts with a
+// space, or is `\.`, which PostgreSQL reads as the end of data.
+func csvNeedsQuotes[T string | []byte](s T) bool {
+	if len(s) == 0 {
+		return false
+	}
+	if len(s) == 2 && s[0] == '\\' && s[1] == '.' {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == ',' || c == '"' || c == '\r' || c == '\n' {
+			return true
+		}
+	}
+	if s[0] < utf8.RuneSelf {
+		return unicode.IsSpace(rune(s[0]))
+	}
+	var head [utf8.UTFMax]byte
+	n := copy(head[:], s[:min(len(s), utf8.UTFMax)])
+	r, _ := utf8.DecodeRune(head[:n])
+	return unicode.IsSpace(r)
+}
+
+// csvField formats a plain value (see PlainValue) as CSV text.
+func csvField(v interface{}) string {
+	switch x := v.(type) {
+	case bool:
+		return strconv.FormatBool(x)
+	case int32:
+		return strconv.FormatInt(int64(x), 10)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case decimal.Decimal:
+		return x.String()
+	case string:
+		return x
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case time.Duration:
+		return kustoTimespan(x)
+	case uuid.UUID:
+		return x.String()
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprint(v)
+}
+
+// kustoTimespan formats d like Kusto does: [-][d.]hh:mm:ss[.fffffff], to 100ns ticks.
+func kustoTimespan(d time.Duration) string {
+	return string(appendTimespan(nil, d))
+}
+
+func appendTimespan(b []byte, d time.Duration) []byte {
+	if d < 0 {
+		b, d = append(b, '-'), -d
+	}
+	ticks := int64(d / 100)
+	days := ticks / (864e9)
+	ticks %= 864e9
+	if days > 0 {
+		b = append(strconv.AppendInt(b, days, 10), '.')
+	}
+	b = appendDigits(b, ticks/36e9, 2)
+	b = appendDigits(append(b, ':'), ticks/6e8%60, 2)
+	b = appendDigits(append(b, ':'), ticks/1e7%60, 2)
+	if frac := ticks % 1e7; frac != 0 {
+		b = appendDigits(append(b, '.'), frac, 7)
+	}
+	return b
+}
+
+// appendDigits appends n, zero-padded to width digits.
+func appendDigits(b []byte, n int64, width int) []byte {
+	var d [20]byte
+	i := len(d)
+	for n > 0 || i > len(d)-width {
+		i--
+		d[i] = byte('0' + n%10)
+		n /= 10
+	}
+	return append(b, d[i:]...)
+}
+
+// appendUUID appends u in its canonical form, as uuid.UUID.String does.
+func appendUUID(b []byte, u uuid.UUID) []byte {
+	b = hex.AppendEncode(b, u[0:4])
+	b = hex.AppendEncode(append(b, '-'), u[4:6])
+	b = hex.AppendEncode(append(b, '-'), u[6:8])
+	b = hex.AppendEncode(append(b, '-'), u[8:10])
+	return hex.AppendEncode(append(b, '-'), u[10:16])
+}
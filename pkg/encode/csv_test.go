@@ -0,0 +1,65 @@
+package encode_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// csvRow is a row of every scalar type, the shape of a nightly extract.
+func csvRow() (*encode.Table, value.Values) {
+	cols := []query.Column{
+		fixtureColumn{0, "Id", types.Long}, fixtureColumn{1, "Score", types.Real}, fixtureColumn{2, "Count", types.Int},
+		fixtureColumn{3, "Ok", types.Bool}, fixtureColumn{4, "When", types.DateTime}, fixtureColumn{5, "Took", types.Timespan},
+		fixtureColumn{6, "Key", types.GUID}, fixtureColumn{7, "Name", types.String}, fixtureColumn{8, "Missing", types.Long},
+	}
+	vals := value.Values{
+		value.NewLong(9007199254740993), value.NewReal(0.1), value.NewInt(-42),
+		value.NewBool(true), value.NewDateTime(time.Date(2024, 3, 1, 12, 30, 0, 123400000, time.UTC)), value.NewTimespan(26*time.Hour + 1500*time.Millisecond),
+		value.NewGUID(uuid.MustParse("5b9a5a6c-2f34-4e2b-9d4a-0c7c3c1f0e11")), value.NewString(`say "hi", then leave`), value.NewNullLong(),
+	}
+	return &encode.Table{Name: "T", Kind: "PrimaryResult", Columns: cols}, vals
+}
+
+func TestCSVRow(t *testing.T) {
+	tbl, vals := csvRow()
+	var buf bytes.Buffer
+	enc, _ := encode.New("csv", &buf, encode.Options{})
+	enc.Begin(tbl)
+	enc.WriteRow(tbl, 0, vals)
+	enc.End()
+	want := "Id,Score,Count,Ok,When,Took,Key,Name,Missing\r\n" +
+		`9007199254740993,0.1,-42,true,2024-03-01T12:30:00.1234Z,1.02:00:01.5000000,5b9a5a6c-2f34-4e2b-9d4a-0c7c3c1f0e11,"say ""hi"", then leave",` + "\r\n"
+	if buf.String() != want {
+		t.Errorf("got\n%q\nwant\n%q", buf.String(), want)
+	}
+}
+
+// TestCSVRowAllocs guards the hot path: writing a row of scalars allocates nothing.
+func TestCSVRowAllocs(t *testing.T) {
+	tbl, vals := csvRow()
+	enc, _ := encode.New("csv", io.Discard, encode.Options{})
+	enc.Begin(tbl)
+	if n := testing.AllocsPerRun(1000, func() { enc.WriteRow(tbl, 0, vals) }); n != 0 {
+		t.Errorf("WriteRow allocates %.1f times per row, want 0", n)
+	}
+}
+
+func BenchmarkCSVWriteRow(b *testing.B) {
+	tbl, vals := csvRow()
+	enc, _ := encode.New("csv", io.Discard, encode.Options{})
+	enc.Begin(tbl)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		enc.WriteRow(tbl, i, vals)
+	}
+	enc.End()
+}
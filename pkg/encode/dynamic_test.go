@@ -0,0 +1,99 @@
+package encode_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// FuzzDynamic feeds arbitrary bytes through a dynamic column. Dynamic values arrive as whatever
+// JSON the cluster stored, so every encoder has to cope with invalid UTF-8, truncated documents
+// and trailing garbage without failing the whole result.
+func FuzzDynamic(f *testing.F) {
+	for _, s := range []string{
+		`{"a":1}`,
+		`[1,2,3]`,
+		`"str"`,
+		`null`,
+		`12345678901234567890`,
+		`{"big":12345678901234567890,"neg":-1.5e-10}`,
+		`{"a":`,
+		`[1,2`,
+		`1 x`,
+		`{} {}`,
+		"\xff\xfe",
+		`"\xff"`,
+		`{"s":"` + "\xc3" + `"}`,
+		``,
+	} {
+		f.Add([]byte(s))
+	}
+	t := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{fixtureColumn{0, "dyn", types.Dynamic}}}
+	f.Fuzz(func(tt *testing.T, b []byte) {
+		row := value.Values{value.NewDynamic(b)}
+
+		obj := encode.RowObject(t, 0, row)
+		enc, err := json.Marshal(obj)
+		if err != nil {
+			tt.Fatalf("marshal RowObject(%q): %v", b, err)
+		}
+		if utf8.Valid(b) && json.Valid(b) {
+			var got map[string]interface{}
+			if err := decodeNumbers(enc, &got); err != nil {
+				tt.Fatal(err)
+			}
+			var want interface{}
+			if err := decodeNumbers(b, &want); err != nil {
+				tt.Fatal(err)
+			}
+			if !reflect.DeepEqual(got["dyn"], want) {
+				tt.Fatalf("dynamic %q came out as %s", b, enc)
+			}
+		}
+
+		for _, name := range encode.Names() {
+			var buf bytes.Buffer
+			e, err := encode.New(name, &buf, encode.Options{})
+			if err != nil {
+				tt.Fatal(err)
+			}
+			if err := e.Begin(t); err != nil {
+				tt.Fatalf("%s: Begin: %v", name, err)
+			}
+			if err := e.WriteRow(t, 0, row); err != nil {
+				tt.Fatalf("%s: WriteRow(%q): %v", name, b, err)
+			}
+			if err := e.End(); err != nil {
+				tt.Fatalf("%s: End: %v", name, err)
+			}
+			if name == "ndjson" {
+				line := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+				if bytes.ContainsRune(line, '\n') || !json.Valid(line) {
+					tt.Fatalf("ndjson line for %q is not one JSON value: %q", b, buf.Bytes())
+				}
+			}
+		}
+	})
+}
+
+// decodeNumbers decodes exactly one JSON value, keeping numbers as json.Number.
+func decodeNumbers(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Package encode turns query result tables into the bytes of an output format. Each format is an
+// Encoder registered under its --format name; the built-in formats register themselves here, and
+// other packages (such as encode/parquet, or a third party's) add theirs with Register from an
+// init function.
+package encode
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+)
+
+// Table describes the result table rows are being written for.
+type Table struct {
+	Name    string
+	Kind    string
+	Columns []query.Column
+}
+
+// Encoder encodes the tables of a query result in one format.
+// Begin is called once per table before its rows; End flushes any buffered output.
+// Rows are passed with the same *Table that was given to Begin.
+type Encoder interface {
+	Begin(t *Table) error
+	WriteRow(t *Table, index int, vals value.Values) error
+	End() error
+}
+
+// Options are the output flags that shape what a format writes.
+type Options struct {
+	SchemaHeader bool   // ndjson: emit a schema line before each table's rows
+	Pretty       bool   // json: indent the array elements
+	Null         string // csv: text written for null cells
+	MaxColWidth  int    // table: cut cells to this many characters (0: only dynamic columns are cut)
+	TableStyle   string // table: "unicode" (default) or "ascii" borders
+	Workers      int    // parquet: compress a row group's column pages on this many goroutines
+}
+
+// Factory creates an Encoder writing to w.
+type Factory func(w io.Writer, opts Options) Encoder
+
+var (
+	mu      sync.RWMutex
+	formats = map[string]Factory{
+		"ndjson": func(w io.Writer, opts Options) Encoder {
+			return &ndjsonWriter{w: w, schema: opts.SchemaHeader}
+		},
+		"ndjson-typed": func(w io.Writer, _ Options) Encoder {
+			return &ndjsonWriter{w: w, typed: true}
+		},
+		"json":     func(w io.Writer, opts Options) Encoder { return &jsonArrayWriter{w: w, pretty: opts.Pretty} },
+		"csv":      func(w io.Writer, opts Options) Encoder { return newCSVWriter(w, opts.Null) },
+		"table":    func(w io.Writer, opts Options) Encoder { return newTableWriter(w, opts) },
+		"msgpack":  func(w io.Writer, _ Options) Encoder { return newMsgpackWriter(w) },
+		"protobuf": func(w io.Writer, _ Options) Encoder { return newProtobufWriter(w) },
+		"xlsx":     func(w io.Writer, _ Options) Encoder { return newXlsxWriter(w) },
+	}
+)
+
+// Register makes a format available to New under name. It panics if name is already taken, so
+// two packages can't silently fight over a format.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := formats[name]; dup || name == "proto" {
+		panic("encode: format " + name + " registered twice")
+	}
+	formats[name] = f
+}
+
+// New returns the Encoder for format ("proto" is accepted for protobuf).
+func New(format string, w io.Writer, opts Options) (Encoder, error) {
+	if format == "proto" {
+		format = "protobuf"
+	}
+	mu.RLock()
+	f, ok := formats[format]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q (want one of %s)", format, strings.Join(Names(), ", "))
+	}
+	return f(w, opts), nil
+}
+
+// Names lists the registered formats, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(formats))
+	for n := range formats {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PrimaryOnly passes only PrimaryResult tables through to the wrapped Encoder.
+type PrimaryOnly struct{ Encoder }
+
+func (p PrimaryOnly) Begin(t *Table) error {
+	if t.Kind != "PrimaryResult" {
+		return nil
+	}
+	return p.Encoder.Begin(t)
+}
+
+func (p PrimaryOnly) WriteRow(t *Table, index int, vals value.Values) error {
+	if t.Kind != "PrimaryResult" {
+		return nil
+	}
+	return p.Encoder.WriteRow(t, index, vals)
+}
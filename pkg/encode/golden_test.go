@@ -0,0 +1,289 @@
+package encode_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	_ "github.com/harche/kusto-example/pkg/encode/arrow"
+	_ "github.com/harche/kusto-example/pkg/encode/parquet"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files from the current encoders")
+
+// goldenCases are the encoder configurations under test. Every registered format needs at least
+// one, so a new format can't ship without a golden file.
+var goldenCases = []struct {
+	name   string
+	format string
+	opts   encode.Options
+}{
+	{"ndjson", "ndjson", encode.Options{}},
+	{"ndjson-schema", "ndjson", encode.Options{SchemaHeader: true}},
+	{"ndjson-typed", "ndjson-typed", encode.Options{}},
+	{"json", "json", encode.Options{}},
+	{"json-pretty", "json", encode.Options{Pretty: true}},
+	{"msgpack", "msgpack", encode.Options{}},
+	{"protobuf", "protobuf", encode.Options{}},
+	{"xlsx", "xlsx", encode.Options{}},
+	{"csv", "csv", encode.Options{}},
+	{"csv-null", "csv", encode.Options{Null: "NULL"}},
+	{"table", "table", encode.Options{}},
+	{"table-ascii-narrow", "table", encode.Options{TableStyle: "ascii", MaxColWidth: 12}},
+	{"parquet", "parquet", encode.Options{}},
+	{"arrow", "arrow", encode.Options{}},
+}
+
+// TestGolden feeds the v2 frames in testdata/frames.json through each encoder and compares the
+// output with testdata/golden/<case>.golden. After a deliberate format change, regenerate the files
+// with "go test ./pkg/encode -run Golden -update" and review the diff.
+func TestGolden(t *testing.T) {
+	tables := loadFrames(t, "testdata/frames.json")
+
+	covered := map[string]bool{}
+	for _, c := range goldenCases {
+		covered[c.format] = true
+	}
+	for _, name := range encode.Names() {
+		if !covered[name] {
+			t.Errorf("format %s has no golden case", name)
+		}
+	}
+
+	for _, c := range goldenCases {
+		t.Run(c.name, func(t *testing.T) { goldenCase(t, tables, c.name, c.format, c.opts, 1) })
+		// Encoding on several cores must not change a byte.
+		t.Run(c.name+"/parallel", func(t *testing.T) { goldenCase(t, tables, c.name, c.format, c.opts, 4) })
+	}
+}
+
+func goldenCase(t *testing.T, tables []fixtureTable, name, format string, opts encode.Options, workers int) {
+	var buf bytes.Buffer
+	opts.Workers = workers
+	enc, err := encode.New(format, &buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc = encode.Parallel(enc, workers)
+	for _, tbl := range tables {
+		if err := enc.Begin(tbl.info); err != nil {
+			t.Fatalf("Begin(%s): %v", tbl.info.Name, err)
+		}
+		for i, row := range tbl.rows {
+			if err := enc.WriteRow(tbl.info, i, row); err != nil {
+				t.Fatalf("WriteRow(%s, %d): %v", tbl.info.Name, i, err)
+			}
+		}
+	}
+	if err := enc.End(); err != nil {
+		t.Fatalf("End: %v", err)
+	}
+
+	path := filepath.Join("testdata", "golden", name+".golden")
+	if *update && workers == 1 {
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s at byte %d of %d (want %d bytes); if the change is intended, rerun with -update",
+			path, firstDiff(got, want), len(got), len(want))
+	}
+}
+
+func firstDiff(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
+
+// fixtureTable is one DataTable frame decoded into what the query loop hands to encoders.
+type fixtureTable struct {
+	info *encode.Table
+	rows []value.Values
+}
+
+type fixtureColumn struct {
+	index int
+	name  string
+	typ   types.Column
+}
+
+func (c fixtureColumn) Index() int         { return c.index }
+func (c fixtureColumn) Name() string       { return c.name }
+func (c fixtureColumn) Type() types.Column { return c.typ }
+
+// loadFrames reads a v2 response (a JSON array of frames) and decodes its DataTable frames the
+// way the SDK does: one typed value per cell, with JSON null as the type's null value.
+func loadFrames(t *testing.T, path string) []fixtureTable {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []struct {
+		FrameType string
+		TableKind string
+		TableName string
+		Columns   []struct{ ColumnName, ColumnType string }
+		Rows      [][]json.RawMessage
+	}
+	if err := json.Unmarshal(raw, &frames); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	var tables []fixtureTable
+	for _, f := range frames {
+		if f.FrameType != "DataTable" {
+			continue
+		}
+		tbl := fixtureTable{info: &encode.Table{Name: f.TableName, Kind: f.TableKind}}
+		for i, c := range f.Columns {
+			tbl.info.Columns = append(tbl.info.Columns, fixtureColumn{i, c.ColumnName, types.Column(c.ColumnType)})
+		}
+		for r, row := range f.Rows {
+			vals := make(value.Values, len(row))
+			for i, cell := range row {
+				v, err := fixtureValue(types.Column(f.Columns[i].ColumnType), cell)
+				if err != nil {
+					t.Fatalf("%s: table %s row %d column %s: %v", path, f.TableName, r, f.Columns[i].ColumnName, err)
+				}
+				vals[i] = v
+			}
+			tbl.rows = append(tbl.rows, vals)
+		}
+		tables = append(tables, tbl)
+	}
+	return tables
+}
+
+func fixtureValue(typ types.Column, cell json.RawMessage) (value.Kusto, error) {
+	null := string(cell) == "null"
+	var s string
+	if !null && typ != types.Dynamic && len(cell) > 0 && cell[0] == '"' {
+		if err := json.Unmarshal(cell, &s); err != nil {
+			return nil, err
+		}
+	} else {
+		s = string(cell)
+	}
+	switch typ {
+	case types.Bool:
+		if null {
+			return value.NewNullBool(), nil
+		}
+		b, err := strconv.ParseBool(s)
+		return value.NewBool(b), err
+	case types.Int:
+		if null {
+			return value.NewNullInt(), nil
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		return value.NewInt(int32(n)), err
+	case types.Long:
+		if null {
+			return value.NewNullLong(), nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		return value.NewLong(n), err
+	case types.Real:
+		if null {
+			return value.NewNullReal(), nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return value.NewReal(f), err
+	case types.Decimal:
+		if null {
+			return value.NewNullDecimal(), nil
+		}
+		d, err := decimal.NewFromString(s)
+		return value.NewDecimal(d), err
+	case types.String:
+		if null {
+			return value.NewString(""), nil
+		}
+		return value.NewString(s), nil
+	case types.DateTime:
+		if null {
+			return value.NewNullDateTime(), nil
+		}
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		return value.NewDateTime(ts), err
+	case types.Timespan:
+		if null {
+			return value.NewNullTimespan(), nil
+		}
+		d, err := parseTimespan(s)
+		return value.NewTimespan(d), err
+	case types.GUID:
+		if null {
+			return value.NewNullGUID(), nil
+		}
+		g, err := uuid.Parse(s)
+		return value.NewGUID(g), err
+	case types.Dynamic:
+		if null {
+			return value.NewNullDynamic(), nil
+		}
+		return value.NewDynamic(append([]byte(nil), cell...)), nil
+	}
+	return nil, fmt.Errorf("unknown column type %q", typ)
+}
+
+// parseTimespan parses the v2 timespan format [-][d.]hh:mm:ss[.fffffff].
+func parseTimespan(s string) (time.Duration, error) {
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	var days int64
+	if dot, colon := strings.Index(s, "."), strings.Index(s, ":"); dot >= 0 && dot < colon {
+		n, err := strconv.ParseInt(s[:dot], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		days, s = n, s[dot+1:]
+	}
+	clock, frac, _ := strings.Cut(s, ".")
+	parts := strings.Split(clock, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid timespan %q", s)
+	}
+	d := time.Duration(days) * 24 * time.Hour
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+	}
+	if frac != "" {
+		n, err := strconv.ParseInt((frac + "000000000")[:9], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n)
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,236 @@
+package encode
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+)
+
+// ndjsonWriter emits one JSON object per row (see RowObject). With schema set, each table's rows
+// are preceded by a line describing its columns, so streaming consumers can build typed decoders.
+// typed is --format ndjson-typed: the schema line is always written and the values take the
+// lossless forms of typedRowObject.
+type ndjsonWriter struct {
+	w      io.Writer
+	schema bool
+	typed  bool
+}
+
+// ndjsonSchema is the schema header line: {"_schema":true,"_table":...,"columns":[...]}.
+type ndjsonSchema struct {
+	Schema  bool                 `json:"_schema"`
+	Table   string               `json:"_table"`
+	Kind    string               `json:"_kind"`
+	Columns []ndjsonSchemaColumn `json:"columns"`
+}
+
+type ndjsonSchemaColumn struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Ordinal int    `json:"ordinal"`
+}
+
+func (n *ndjsonWriter) Begin(t *Table) error {
+	if !n.schema && !n.typed {
+		return nil
+	}
+	h := ndjsonSchema{Schema: true, Table: t.Name, Kind: t.Kind, Columns: make([]ndjsonSchemaColumn, len(t.Columns))}
+	for i, c := range t.Columns {
+		h.Columns[i] = ndjsonSchemaColumn{Name: c.Name(), Type: string(c.Type()), Ordinal: i}
+	}
+	enc, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(n.w, string(enc))
+	return err
+}
+
+func (n *ndjsonWriter) WriteRow(t *Table, index int, vals value.Values) error {
+	line, err := n.EncodeRow(nil, t, index, vals)
+	if err != nil {
+		return err
+	}
+	return n.WriteEncoded(t, index, vals, line)
+}
+
+// EncodeRow appends the row's line, newline included.
+func (n *ndjsonWriter) EncodeRow(dst []byte, t *Table, index int, vals value.Values) ([]byte, error) {
+	obj := RowObject
+	if n.typed {
+		obj = typedRowObject
+	}
+	enc, err := json.Marshal(obj(t, index, vals))
+	if err != nil {
+		return dst, fmt.Errorf("failed to marshal row as JSON: %w", err)
+	}
+	return append(append(dst, enc...), '\n'), nil
+}
+
+func (n *ndjsonWriter) WriteEncoded(_ *Table, _ int, _ value.Values, line []byte) error {
+	_, err := n.w.Write(line)
+	return err
+}
+
+func (n *ndjsonWriter) End() error { return nil }
+
+// RowObject builds the JSON object for a row: _table/_kind/_rowIndex plus one key per column.
+// Dynamic columns are parsed into JSON values when possible.
+func RowObject(t *Table, index int, vals value.Values) map[string]interface{} {
+	obj := make(map[string]interface{}, len(t.Columns)+3)
+	obj["_table"] = t.Name
+	obj["_kind"] = t.Kind
+	obj["_rowIndex"] = index
+
+	for i, c := range t.Columns {
+		if i >= len(vals) {
+			continue
+		}
+		v := vals[i]
+		if v == nil {
+			obj[c.Name()] = nil
+			continue
+		}
+		if c.Type() == types.Dynamic {
+			switch b := PlainValue(v).(type) {
+			case nil:
+				obj[c.Name()] = nil
+				continue
+			case []byte:
+				if doc, ok := decodeDynamic(b); ok {
+					obj[c.Name()] = doc
+				} else {
+					obj[c.Name()] = string(b)
+				}
+				continue
+			}
+		}
+		obj[c.Name()] = v.GetValue()
+	}
+
+	return obj
+}
+
+// typedRowObject is RowObject with every value in a form that reads back as exactly the value
+// Kusto returned, whatever the JSON parser: datetimes as RFC 3339 UTC with all seven digits of
+// their 100ns ticks, timespans as Kusto writes them ([-][d.]hh:mm:ss[.fffffff]), decimals as
+// strings of their digits, guids in canonical form, and NaN and infinite reals as "NaN",
+// "Infinity" and "-Infinity", as in Kusto's own JSON. Numbers stay numbers.
+func typedRowObject(t *Table, index int, vals value.Values) map[string]interface{} {
+	obj := make(map[string]interface{}, len(t.Columns)+3)
+	obj["_table"] = t.Name
+	obj["_kind"] = t.Kind
+	obj["_rowIndex"] = index
+
+	r := RowAt(vals)
+	for i, c := range t.Columns {
+		if i >= len(vals) {
+			continue
+		}
+		obj[c.Name()] = typedValue(r, i, c.Type())
+	}
+	return obj
+}
+
+func typedValue(r Row, col int, typ types.Column) interface{} {
+	switch typ {
+	case types.DateTime:
+		if t, ok := r.DateTime(col); ok {
+			return t.UTC().Format("2006-01-02T15:04:05.0000000Z")
+		}
+	case types.Timespan:
+		if d, ok := r.Timespan(col); ok {
+			return kustoTimespan(d)
+		}
+	case types.Decimal:
+		if d, ok := r.Decimal(col); ok {
+			return d.String()
+		}
+	case types.GUID:
+		if u, ok := r.GUID(col); ok {
+			return u.String()
+		}
+	case types.Real:
+		if f, ok := r.Real(col); ok {
+			switch {
+			case math.IsNaN(f):
+				return "NaN"
+			case math.IsInf(f, 1):
+				return "Infinity"
+			case math.IsInf(f, -1):
+				return "-Infinity"
+			}
+			return f
+		}
+	case types.Dynamic:
+		if b, ok := r.Dynamic(col); ok {
+			if doc, ok := decodeDynamic(b); ok {
+				return doc
+			}
+			return string(b)
+		}
+	}
+	if r.Null(col) {
+		return nil
+	}
+	return PlainValue(r[col])
+}
+
+// jsonArrayWriter emits the same row objects as ndjson inside a single JSON array. Elements are
+// written as they arrive, so memory stays bounded regardless of result size.
+type jsonArrayWriter struct {
+	w      io.Writer
+	pretty bool
+	n      int
+}
+
+func (j *jsonArrayWriter) Begin(*Table) error { return nil }
+
+func (j *jsonArrayWriter) WriteRow(t *Table, index int, vals value.Values) error {
+	enc, err := j.EncodeRow(nil, t, index, vals)
+	if err != nil {
+		return err
+	}
+	return j.WriteEncoded(t, index, vals, enc)
+}
+
+// EncodeRow appends the row's array element, without the separator before it.
+func (j *jsonArrayWriter) EncodeRow(dst []byte, t *Table, index int, vals value.Values) ([]byte, error) {
+	var enc []byte
+	var err error
+	if j.pretty {
+		enc, err = json.MarshalIndent(RowObject(t, index, vals), "  ", "  ")
+	} else {
+		enc, err = json.Marshal(RowObject(t, index, vals))
+	}
+	if err != nil {
+		return dst, fmt.Errorf("failed to marshal row as JSON: %w", err)
+	}
+	return append(dst, enc...), nil
+}
+
+func (j *jsonArrayWriter) WriteEncoded(_ *Table, _ int, _ value.Values, enc []byte) error {
+	sep := ",\n  "
+	if j.n == 0 {
+		sep = "[\n  "
+	}
+	j.n++
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	_, err := j.w.Write(enc)
+	return err
+}
+
+func (j *jsonArrayWriter) End() error {
+	end := "\n]\n"
+	if j.n == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
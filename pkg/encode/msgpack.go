@@ -0,0 +1,218 @@
+package encode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// msgpackWriter emits one MessagePack map per row, concatenated, with the same keys as NDJSON
+// (_table, _kind, _rowIndex, then the columns in result order). Datetimes use the timestamp
+// extension (type -1), timespans are int64 nanoseconds, decimals and guids are strings, and
+// dynamic values are decoded into native maps/arrays.
+type msgpackWriter struct {
+	bw  *bufio.Writer
+	buf []byte
+}
+
+func newMsgpackWriter(w io.Writer) *msgpackWriter {
+	return &msgpackWriter{bw: bufio.NewWriterSize(w, 64<<10)}
+}
+
+func (m *msgpackWriter) Begin(*Table) error { return nil }
+
+func (m *msgpackWriter) WriteRow(t *Table, index int, vals value.Values) error {
+	m.buf, _ = m.EncodeRow(m.buf[:0], t, index, vals)
+	return m.WriteEncoded(t, index, vals, m.buf)
+}
+
+// EncodeRow appends the row's map.
+func (m *msgpackWriter) EncodeRow(b []byte, t *Table, index int, vals value.Values) ([]byte, error) {
+	b = mpMapHeader(b, len(t.Columns)+3)
+	b = mpString(mpString(b, "_table"), t.Name)
+	b = mpString(mpString(b, "_kind"), t.Kind)
+	b = mpInt(mpString(b, "_rowIndex"), int64(index))
+	row := RowAt(vals)
+	for i, c := range t.Columns {
+		b = mpCell(mpString(b, c.Name()), row, i, c.Type())
+	}
+	return b, nil
+}
+
+func (m *msgpackWriter) WriteEncoded(_ *Table, _ int, _ value.Values, row []byte) error {
+	_, err := m.bw.Write(row)
+	return err
+}
+
+func (m *msgpackWriter) End() error { return m.bw.Flush() }
+
+// mpCell appends the value in col, of column type typ. Scalars are read through Row, so they
+// aren't boxed on the way.
+func mpCell(b []byte, r Row, col int, typ types.Column) []byte {
+	switch typ {
+	case types.String:
+		if s, ok := r.String(col); ok {
+			return mpString(b, s)
+		}
+	case types.Int, types.Long:
+		if n, ok := r.Long(col); ok {
+			return mpInt(b, n)
+		}
+	case types.Real:
+		if f, ok := r.Real(col); ok {
+			return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+		}
+	case types.Bool:
+		if v, ok := r.Bool(col); ok {
+			if v {
+				return append(b, 0xc3)
+			}
+			return append(b, 0xc2)
+		}
+	case types.DateTime:
+		if t, ok := r.DateTime(col); ok {
+			return mpTimestamp(b, t)
+		}
+	case types.Timespan:
+		if d, ok := r.Timespan(col); ok {
+			return mpInt(b, int64(d))
+		}
+	}
+	if col >= len(r) {
+		return append(b, 0xc0)
+	}
+	return mpValue(b, PlainValue(r[col]))
+}
+
+// mpValue appends a plain Kusto value (see PlainValue) or a decoded JSON value.
+func mpValue(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if x {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int32:
+		return mpInt(b, int64(x))
+	case int64:
+		return mpInt(b, x)
+	case float64:
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(x))
+	case decimal.Decimal:
+		return mpString(b, x.String())
+	case string:
+		return mpString(b, x)
+	case time.Time:
+		return mpTimestamp(b, x)
+	case time.Duration:
+		return mpInt(b, int64(x))
+	case uuid.UUID:
+		return mpString(b, x.String())
+	case []byte:
+		doc, ok := decodeDynamic(x)
+		if !ok {
+			return mpString(b, string(x))
+		}
+		return mpValue(b, doc)
+	case json.Number:
+		if i, err := strconv.ParseInt(string(x), 10, 64); err == nil {
+			return mpInt(b, i)
+		}
+		f, _ := x.Float64()
+		return mpValue(b, f)
+	case []interface{}:
+		b = mpArrayHeader(b, len(x))
+		for _, e := range x {
+			b = mpValue(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = mpMapHeader(b, len(x))
+		for _, k := range keys {
+			b = mpValue(mpString(b, k), x[k])
+		}
+		return b
+	default:
+		return mpString(b, fmt.Sprint(x))
+	}
+}
+
+func mpInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(int16(i)))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(int32(i)))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+	}
+}
+
+func mpString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func mpArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func mpMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+// mpTimestamp appends the timestamp extension in its 96-bit form (nanoseconds + signed seconds).
+func mpTimestamp(b []byte, t time.Time) []byte {
+	b = append(b, 0xc7, 12, 0xff)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+}
@@ -0,0 +1,176 @@
+package encode
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+)
+
+// RowEncoder is implemented by formats whose per-row work can be spread over several cores (see
+// Parallel). The work is split in two: EncodeRow turns a row into bytes, and WriteEncoded writes
+// those bytes out.
+type RowEncoder interface {
+	Encoder
+	// EncodeRow appends the encoding of a row to dst. It is called from several goroutines at
+	// once, so it may read the encoder's settings but not its per-table state.
+	EncodeRow(dst []byte, t *Table, index int, vals value.Values) ([]byte, error)
+	// WriteEncoded writes a row EncodeRow returned. Rows arrive in order, on one goroutine,
+	// between the Begin and End calls that surround them.
+	WriteEncoded(t *Table, index int, vals value.Values, row []byte) error
+}
+
+// parallelBatch is how many rows a worker encodes at a time, which keeps the channel traffic
+// per row small.
+const parallelBatch = 256
+
+// Parallel returns an Encoder that encodes rows on workers goroutines and writes them in their
+// original order, so the query's network reads don't wait on a CPU-heavy format. Encoders that
+// aren't a RowEncoder, and workers below 2, get enc back unchanged. A value of 0 means one
+// worker per CPU.
+//
+// WriteRow returns before the row is written, so a write error shows up on a later call or on
+// End. Rows' values must not change after WriteRow; the SDK's don't.
+func Parallel(enc Encoder, workers int) Encoder {
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	re, ok := enc.(RowEncoder)
+	if !ok || workers < 2 {
+		return enc
+	}
+	p := &parallelEncoder{
+		enc:   re,
+		jobs:  make(chan *encodeJob, 2*workers),
+		queue: make(chan *encodeJob, 2*workers),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.write()
+	return p
+}
+
+type parallelEncoder struct {
+	enc   RowEncoder
+	jobs  chan *encodeJob // to the workers
+	queue chan *encodeJob // to the writer, in row order
+	cur   *encodeJob
+	done  chan struct{} // closed once the writer has written everything queued
+
+	mu  sync.Mutex
+	err error // the first error, which stops the writing
+}
+
+// encodeJob is a batch of rows, or a table's Begin, which the writer runs in its place in the
+// order.
+type encodeJob struct {
+	begin *Table
+	rows  []parallelRow
+	buf   []byte
+	ends  []int // where each row's encoding ends in buf
+	err   error
+	ready chan struct{} // closed once the rows are encoded
+}
+
+type parallelRow struct {
+	t     *Table
+	index int
+	vals  value.Values
+}
+
+func (p *parallelEncoder) Begin(t *Table) error {
+	p.submit()
+	ready := make(chan struct{})
+	close(ready)
+	p.queue <- &encodeJob{begin: t, ready: ready}
+	return p.failed()
+}
+
+func (p *parallelEncoder) WriteRow(t *Table, index int, vals value.Values) error {
+	if err := p.failed(); err != nil {
+		return err
+	}
+	if p.cur == nil {
+		p.cur = &encodeJob{rows: make([]parallelRow, 0, parallelBatch)}
+	}
+	p.cur.rows = append(p.cur.rows, parallelRow{t, index, vals})
+	if len(p.cur.rows) == parallelBatch {
+		p.submit()
+	}
+	return nil
+}
+
+func (p *parallelEncoder) End() error {
+	p.submit()
+	close(p.queue)
+	close(p.jobs)
+	<-p.done
+	if err := p.failed(); err != nil {
+		return err
+	}
+	return p.enc.End()
+}
+
+// submit hands the rows collected so far to the workers, and their place in the order to the
+// writer.
+func (p *parallelEncoder) submit() {
+	j := p.cur
+	if j == nil || len(j.rows) == 0 {
+		return
+	}
+	p.cur = nil
+	j.ready = make(chan struct{})
+	p.queue <- j
+	p.jobs <- j
+}
+
+func (p *parallelEncoder) work() {
+	for j := range p.jobs {
+		for _, r := range j.rows {
+			if j.buf, j.err = p.enc.EncodeRow(j.buf, r.t, r.index, r.vals); j.err != nil {
+				break
+			}
+			j.ends = append(j.ends, len(j.buf))
+		}
+		close(j.ready)
+	}
+}
+
+func (p *parallelEncoder) write() {
+	defer close(p.done)
+	for j := range p.queue {
+		<-j.ready
+		if p.failed() != nil {
+			continue // drain, so the producer never blocks
+		}
+		var err error
+		if j.begin != nil {
+			err = p.enc.Begin(j.begin)
+		}
+		start := 0
+		for i, end := range j.ends {
+			if err != nil {
+				break
+			}
+			r := j.rows[i]
+			err = p.enc.WriteEncoded(r.t, r.index, r.vals, j.buf[start:end])
+			start = end
+		}
+		if err == nil {
+			err = j.err // the rows before the one that failed to encode are written
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *parallelEncoder) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
@@ -0,0 +1,44 @@
+package encode_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// TestParallelOrder writes enough rows to span many batches, over two tables and a table the
+// format skips, and expects the parallel output to match the sequential one byte for byte.
+func TestParallelOrder(t *testing.T) {
+	tbl, vals := csvRow()
+	second := &encode.Table{Name: "T2", Kind: "PrimaryResult", Columns: tbl.Columns}
+	props := &encode.Table{Name: "@ExtendedProperties", Kind: "QueryProperties", Columns: tbl.Columns}
+	run := func(format string, workers int) []byte {
+		var buf bytes.Buffer
+		enc, _ := encode.New(format, &buf, encode.Options{})
+		enc = encode.Parallel(enc, workers)
+		for _, table := range []*encode.Table{tbl, props, second} {
+			if err := enc.Begin(table); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 1000; i++ {
+				row := append(value.Values{value.NewLong(int64(i))}, vals[1:]...)
+				if err := enc.WriteRow(table, i, row); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := enc.End(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for _, format := range []string{"csv", "ndjson", "json", "msgpack", "xlsx"} {
+		want, got := run(format, 1), run(format, 8)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: parallel output differs at byte %d of %d (want %d bytes)", format, firstDiff(got, want), len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,538 @@
+// Package parquet is the parquet result format. Importing it registers --format parquet with
+// package encode; NewFile writes a single table for callers that manage files themselves, such as
+// the table sinks.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func init() {
+	encode.Register("parquet", func(w io.Writer, opts encode.Options) encode.Encoder { return &writer{w: w, workers: opts.Workers} })
+}
+
+// writer is --format parquet. A Parquet file holds a single schema, so only the first
+// primary result table is written; later tables are skipped with a warning. A result without a
+// primary table produces a file with no columns.
+type writer struct {
+	w       io.Writer
+	workers int
+	file    *File
+	table   *encode.Table
+}
+
+func (p *writer) Begin(t *encode.Table) error {
+	if t.Kind != "PrimaryResult" {
+		return nil
+	}
+	if p.file != nil {
+		fmt.Fprintf(os.Stderr, "WARN parquet: skipping table %s; a Parquet file holds one table\n", t.Name)
+		return nil
+	}
+	f, err := NewFile(p.w, t.Columns, CodecGzip, 0)
+	if err != nil {
+		return err
+	}
+	f.Workers = p.workers
+	p.file, p.table = f, t
+	return nil
+}
+
+func (p *writer) WriteRow(t *encode.Table, _ int, vals value.Values) error {
+	if t != p.table {
+		return nil
+	}
+	return p.file.WriteRow(vals)
+}
+
+func (p *writer) End() error {
+	if p.file == nil {
+		f, err := NewFile(p.w, nil, CodecGzip, 0)
+		if err != nil {
+			return err
+		}
+		p.file = f
+	}
+	return p.file.Close()
+}
+
+// File writes one result table as a Parquet file: every column optional, one data page
+// (v1, PLAIN values, RLE definition levels) per column per row group, and the Thrift
+// compact-encoded footer at the end. Rows are buffered column-wise until rowGroupRows is reached,
+// so memory is bounded by one row group.
+//
+// Types: bool → BOOLEAN, int → INT32, long → INT64, real → DOUBLE, datetime → INT64
+// TIMESTAMP(MICROS, UTC), timespan → INT64 nanoseconds, dynamic → BYTE_ARRAY annotated JSON,
+// and decimal/string/guid → UTF-8 BYTE_ARRAY (decimals as text, so no digits are lost). Guids
+// stay text rather than the UUID type, which Spark can't read.
+type File struct {
+	// Workers is how many column pages of a row group are compressed at once; below 2, one at
+	// a time. Compression is most of the CPU a file costs.
+	Workers int
+
+	w            *countingWriter
+	cols         []*column
+	codec        int32
+	rowGroupRows int
+
+	rows   int
+	total  int64
+	groups [][]byte // encoded RowGroup structs
+}
+
+type column struct {
+	name  string
+	kusto types.Column
+	ptype int32 // Parquet physical type
+
+	defs   []bool
+	bools  []bool
+	values bytes.Buffer
+	count  int
+}
+
+// Parquet enum values used by the writer. CodecNone and CodecGzip are the codecs NewFile accepts.
+const (
+	pqBoolean   = 0
+	pqInt32     = 1
+	pqInt64     = 2
+	pqDouble    = 5
+	pqByteArray = 6
+
+	CodecNone = 0
+	CodecGzip = 2
+)
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Codec maps a compression option (gzip, none) to its Parquet codec.
+func Codec(name string) (int32, error) {
+	switch name {
+	case "gzip", "":
+		return CodecGzip, nil
+	case "none", "uncompressed":
+		return CodecNone, nil
+	}
+	return 0, fmt.Errorf("parquet compression must be gzip or none, not %q", name)
+}
+
+func NewFile(w io.Writer, cols []query.Column, codec int32, rowGroupRows int) (*File, error) {
+	p := &File{w: &countingWriter{w: w}, codec: codec, rowGroupRows: rowGroupRows}
+	if p.rowGroupRows <= 0 {
+		p.rowGroupRows = 100000
+	}
+	for _, c := range cols {
+		pc := &column{name: c.Name(), kusto: c.Type()}
+		switch c.Type() {
+		case types.Bool:
+			pc.ptype = pqBoolean
+		case types.Int:
+			pc.ptype = pqInt32
+		case types.Long, types.DateTime, types.Timespan:
+			pc.ptype = pqInt64
+		case types.Real:
+			pc.ptype = pqDouble
+		default:
+			pc.ptype = pqByteArray
+		}
+		p.cols = append(p.cols, pc)
+	}
+	if _, err := io.WriteString(p.w, "PAR1"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *File) WriteRow(vals value.Values) error {
+	for i, c := range p.cols {
+		var v interface{}
+		if i < len(vals) {
+			v = encode.PlainValue(vals[i])
+		}
+		c.add(v)
+	}
+	p.rows++
+	p.total++
+	if p.rows >= p.rowGroupRows {
+		return p.flushRowGroup()
+	}
+	return nil
+}
+
+func (c *column) add(v interface{}) {
+	c.count++
+	if v == nil {
+		c.defs = append(c.defs, false)
+		return
+	}
+	c.defs = append(c.defs, true)
+	var b [8]byte
+	switch x := v.(type) {
+	case bool:
+		c.bools = append(c.bools, x)
+	case int32:
+		binary.LittleEndian.PutUint32(b[:4], uint32(x))
+		c.values.Write(b[:4])
+	case int64:
+		binary.LittleEndian.PutUint64(b[:], uint64(x))
+		c.values.Write(b[:])
+	case float64:
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(x))
+		c.values.Write(b[:])
+	case time.Time:
+		binary.LittleEndian.PutUint64(b[:], uint64(x.UnixMicro()))
+		c.values.Write(b[:])
+	case time.Duration:
+		binary.LittleEndian.PutUint64(b[:], uint64(x))
+		c.values.Write(b[:])
+	default:
+		s := parquetText(x)
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(s)))
+		c.values.Write(b[:4])
+		c.values.WriteString(s)
+	}
+}
+
+func parquetText(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case fmt.Stringer:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func (p *File) flushRowGroup() error {
+	if p.rows == 0 {
+		return nil
+	}
+	pages, raws, err := p.pages()
+	if err != nil {
+		return err
+	}
+	var chunks []byte
+	var groupBytes int64
+	for i, c := range p.cols {
+		offset := p.w.n
+		page, raw := pages[i], raws[i]
+		var hdr thriftWriter
+		hdr.i32(1, 0) // DATA_PAGE
+		hdr.i32(2, int32(raw))
+		hdr.i32(3, int32(len(page)))
+		hdr.structBegin(5)
+		hdr.i32(1, int32(c.count))
+		hdr.i32(2, 0) // PLAIN
+		hdr.i32(3, 3) // RLE
+		hdr.i32(4, 3)
+		hdr.structEnd()
+		hdr.stop()
+		if _, err := p.w.Write(hdr.b); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(page); err != nil {
+			return err
+		}
+		size := p.w.n - offset
+		uncompressed := int64(len(hdr.b) + raw)
+		groupBytes += uncompressed
+
+		var cc thriftWriter
+		cc.i64(2, offset)
+		cc.structBegin(3)
+		cc.i32(1, c.ptype)
+		cc.listField(2, thriftI32, 2)
+		cc.varint(0) // PLAIN
+		cc.varint(zigzag(3))
+		cc.listField(3, thriftBinary, 1)
+		cc.bytes([]byte(c.name))
+		cc.i32(4, p.codec)
+		cc.i64(5, int64(c.count))
+		cc.i64(6, uncompressed)
+		cc.i64(7, size)
+		cc.i64(9, offset)
+		cc.structEnd()
+		cc.stop()
+		chunks = append(chunks, cc.b...)
+
+		c.defs, c.bools, c.count = c.defs[:0], c.bools[:0], 0
+		c.values.Reset()
+	}
+	var rg thriftWriter
+	rg.listField(1, thriftStruct, len(p.cols))
+	rg.raw(chunks)
+	rg.i64(2, groupBytes)
+	rg.i64(3, int64(p.rows))
+	rg.stop()
+	p.groups = append(p.groups, rg.b)
+	p.rows = 0
+	return nil
+}
+
+// pages encodes every column's page, on up to Workers goroutines.
+func (p *File) pages() ([][]byte, []int, error) {
+	pages, raws, errs := make([][]byte, len(p.cols)), make([]int, len(p.cols)), make([]error, len(p.cols))
+	if p.Workers < 2 {
+		for i, c := range p.cols {
+			if pages[i], raws[i], errs[i] = c.page(p.codec); errs[i] != nil {
+				return nil, nil, errs[i]
+			}
+		}
+		return pages, raws, nil
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, p.Workers)
+	for i, c := range p.cols {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			pages[i], raws[i], errs[i] = c.page(p.codec)
+			<-sem
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pages, raws, nil
+}
+
+// page encodes the column's buffered values as a v1 data page body and compresses it.
+// It returns the stored bytes and the uncompressed size.
+func (c *column) page(codec int32) ([]byte, int, error) {
+	var body bytes.Buffer
+	levels := rleBitPacked(c.defs)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(levels)))
+	body.Write(n[:])
+	body.Write(levels)
+	if c.ptype == pqBoolean {
+		body.Write(packBits(c.bools))
+	} else {
+		body.Write(c.values.Bytes())
+	}
+	raw := body.Len()
+	if codec == CodecNone {
+		return body.Bytes(), raw, nil
+	}
+	var z bytes.Buffer
+	gz := gzip.NewWriter(&z)
+	if _, err := gz.Write(body.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	return z.Bytes(), raw, nil
+}
+
+// rleBitPacked encodes 1-bit levels as a single bit-packed run of the RLE/bit-packing hybrid.
+func rleBitPacked(levels []bool) []byte {
+	groups := (len(levels) + 7) / 8
+	b := binary.AppendUvarint(nil, uint64(groups)<<1|1)
+	return append(b, packBits(levels)...)
+}
+
+func packBits(bits []bool) []byte {
+	out := make([]byte, (len(bits)+7)/8)
+	for i, v := range bits {
+		if v {
+			out[i/8] |= 1 << (i % 8)
+		}
+	}
+	return out
+}
+
+func (p *File) Close() error {
+	if err := p.flushRowGroup(); err != nil {
+		return err
+	}
+	var m thriftWriter
+	m.i32(1, 1)
+	m.listField(2, thriftStruct, len(p.cols)+1)
+	var root thriftWriter
+	root.binary(4, "schema")
+	root.i32(5, int32(len(p.cols)))
+	root.stop()
+	m.raw(root.b)
+	for _, c := range p.cols {
+		var e thriftWriter
+		c.schemaElement(&e)
+		m.raw(e.b)
+	}
+	m.i64(3, p.total)
+	m.listField(4, thriftStruct, len(p.groups))
+	for _, g := range p.groups {
+		m.raw(g)
+	}
+	m.binary(6, "kusto-example")
+	m.stop()
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(m.b)))
+	for _, b := range [][]byte{m.b, n[:], []byte("PAR1")} {
+		if _, err := p.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *column) schemaElement(m *thriftWriter) {
+	m.i32(1, c.ptype)
+	m.i32(3, 1) // OPTIONAL
+	m.binary(4, c.name)
+	switch c.ptype {
+	case pqByteArray:
+		if c.kusto == types.Dynamic {
+			m.i32(6, 19) // converted type JSON
+			m.structBegin(10)
+			m.structBegin(12) // LogicalType.JSON
+			m.structEnd()
+			m.structEnd()
+			break
+		}
+		m.i32(6, 0) // converted type UTF8
+		m.structBegin(10)
+		m.structBegin(1) // LogicalType.STRING
+		m.structEnd()
+		m.structEnd()
+	case pqInt64:
+		if c.kusto == types.DateTime {
+			m.i32(6, 10) // TIMESTAMP_MICROS
+			m.structBegin(10)
+			m.structBegin(8) // LogicalType.TIMESTAMP
+			m.boolField(1, true)
+			m.structBegin(2)
+			m.structBegin(2) // TimeUnit.MICROS
+			m.structEnd()
+			m.structEnd()
+			m.structEnd()
+			m.structEnd()
+		}
+	}
+	m.stop()
+}
+
+// thriftWriter appends Thrift compact protocol fields. Field ids are delta-encoded against the
+// previous field of the current struct, hence the stack of enclosing structs' last ids.
+type thriftWriter struct {
+	b    []byte
+	last []int16
+	id   int16
+}
+
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if d := id - t.id; d > 0 && d <= 15 {
+		t.b = append(t.b, byte(d)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.id = id
+}
+
+func (t *thriftWriter) varint(v uint64) { t.b = binary.AppendUvarint(t.b, v) }
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) boolField(id int16, v bool) {
+	if v {
+		t.fieldHeader(id, thriftTrue)
+	} else {
+		t.fieldHeader(id, thriftFalse)
+	}
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.bytes([]byte(s))
+}
+
+func (t *thriftWriter) bytes(b []byte) {
+	t.varint(uint64(len(b)))
+	t.b = append(t.b, b...)
+}
+
+func (t *thriftWriter) listHeader(elem byte, n int) {
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|elem)
+		return
+	}
+	t.b = append(t.b, 0xf0|elem)
+	t.varint(uint64(n))
+}
+
+// listField starts a list field. Struct elements are encoded with their own thriftWriter (each
+// ends with stop) and appended with raw, which leaves this struct's field id state untouched.
+func (t *thriftWriter) listField(id int16, elem byte, n int) {
+	t.fieldHeader(id, thriftList)
+	t.listHeader(elem, n)
+}
+
+func (t *thriftWriter) raw(b []byte) { t.b = append(t.b, b...) }
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.last = append(t.last, t.id)
+	t.id = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.b = append(t.b, 0)
+	t.id = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+// stop ends the top-level struct.
+func (t *thriftWriter) stop() { t.b = append(t.b, 0) }
+
+// zigzag maps signed integers to unsigned ones for the compact protocol's varints.
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
@@ -0,0 +1,136 @@
+package encode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// protobufWriter emits the self-describing stream defined in proto/result.proto: a Schema frame
+// per table followed by Row frames, each frame prefixed with its varint length.
+type protobufWriter struct {
+	bw    *bufio.Writer
+	frame []byte
+	msg   []byte
+	val   []byte
+}
+
+func newProtobufWriter(w io.Writer) *protobufWriter {
+	return &protobufWriter{bw: bufio.NewWriterSize(w, 64<<10)}
+}
+
+func (p *protobufWriter) Begin(t *Table) error {
+	m := p.msg[:0]
+	m = pbString(m, 1, t.Name)
+	m = pbString(m, 2, t.Kind)
+	for _, c := range t.Columns {
+		col := pbString(pbString(p.val[:0], 1, c.Name()), 2, string(c.Type()))
+		m = pbBytes(m, 3, col)
+		p.val = col
+	}
+	p.msg = m
+	return p.writeFrame(1, m)
+}
+
+func (p *protobufWriter) WriteRow(t *Table, index int, vals value.Values) error {
+	m := pbVarint(pbTag(p.msg[:0], 1, 0), uint64(index))
+	for i := range t.Columns {
+		var v interface{}
+		if i < len(vals) {
+			v = PlainValue(vals[i])
+		}
+		p.val = pbValue(p.val[:0], v)
+		m = pbBytes(m, 2, p.val)
+	}
+	p.msg = m
+	return p.writeFrame(2, m)
+}
+
+func (p *protobufWriter) End() error { return p.bw.Flush() }
+
+func (p *protobufWriter) writeFrame(field int, msg []byte) error {
+	f := pbBytes(p.frame[:0], field, msg)
+	p.frame = f
+	var n [binary.MaxVarintLen64]byte
+	if _, err := p.bw.Write(n[:binary.PutUvarint(n[:], uint64(len(f)))]); err != nil {
+		return err
+	}
+	_, err := p.bw.Write(f)
+	return err
+}
+
+// pbValue encodes one Value message (see proto/result.proto).
+func pbValue(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return pbVarint(pbTag(b, 1, 0), 1)
+	case bool:
+		n := uint64(0)
+		if x {
+			n = 1
+		}
+		return pbVarint(pbTag(b, 2, 0), n)
+	case int32:
+		return pbVarint(pbTag(b, 3, 0), zigzag(int64(x)))
+	case int64:
+		return pbVarint(pbTag(b, 3, 0), zigzag(x))
+	case float64:
+		return binary.LittleEndian.AppendUint64(pbTag(b, 4, 1), math.Float64bits(x))
+	case decimal.Decimal:
+		return pbString(b, 5, x.String())
+	case string:
+		return pbString(b, 5, x)
+	case uuid.UUID:
+		return pbString(b, 5, x.String())
+	case time.Time:
+		return pbBytes(b, 9, pbTimestamp(x))
+	case time.Duration:
+		return pbVarint(pbTag(b, 7, 0), uint64(x))
+	case []byte:
+		return pbBytes(b, 8, x)
+	default:
+		return pbString(b, 5, fmt.Sprint(x))
+	}
+}
+
+// pbTimestamp encodes x as a google.protobuf.Timestamp: seconds since the Unix epoch and the
+// nanoseconds into that second, which covers every datetime Kusto has, unlike int64 nanoseconds.
+func pbTimestamp(x time.Time) []byte {
+	var ts []byte
+	if s := x.Unix(); s != 0 {
+		ts = pbVarint(pbTag(ts, 1, 0), uint64(s))
+	}
+	if n := x.Nanosecond(); n != 0 {
+		ts = pbVarint(pbTag(ts, 2, 0), uint64(n))
+	}
+	return ts
+}
+
+func pbTag(b []byte, field, wireType int) []byte {
+	return pbVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func pbVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = pbVarint(pbTag(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
+
+func pbString(b []byte, field int, s string) []byte {
+	b = pbVarint(pbTag(b, field, 2), uint64(len(s)))
+	return append(b, s...)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
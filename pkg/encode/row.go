@@ -0,0 +1,148 @@
+package encode
+
+import (
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Row reads the values of a row by column index as their Go types: RowAt(vals).Long(col). Each
+// accessor returns ok false for a null, a missing column or a value of another type, and none of
+// them allocates, unlike PlainValue, which boxes every value into an interface. Use it in code
+// that runs once per cell.
+type Row value.Values
+
+// RowAt returns the accessors for a row's values.
+func RowAt(vals value.Values) Row { return Row(vals) }
+
+// Null reports whether the value in col is null or missing.
+func (r Row) Null(col int) bool {
+	if col >= len(r) || r[col] == nil {
+		return true
+	}
+	switch x := r[col].(type) {
+	case *value.String:
+		return false
+	case *value.Dynamic:
+		return x.Value == nil
+	case *value.Bool:
+		return x.Ptr() == nil
+	case *value.Int:
+		return x.Ptr() == nil
+	case *value.Long:
+		return x.Ptr() == nil
+	case *value.Real:
+		return x.Ptr() == nil
+	case *value.Decimal:
+		return x.Ptr() == nil
+	case *value.DateTime:
+		return x.Ptr() == nil
+	case *value.Timespan:
+		return x.Ptr() == nil
+	case *value.GUID:
+		return x.Ptr() == nil
+	}
+	return PlainValue(r[col]) == nil
+}
+
+func (r Row) Bool(col int) (bool, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.Bool); ok && x.Ptr() != nil {
+			return *x.Ptr(), true
+		}
+	}
+	return false, false
+}
+
+func (r Row) Int(col int) (int32, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.Int); ok && x.Ptr() != nil {
+			return *x.Ptr(), true
+		}
+	}
+	return 0, false
+}
+
+// Long returns a long value, or an int one widened to int64.
+func (r Row) Long(col int) (int64, bool) {
+	if col < len(r) {
+		switch x := r[col].(type) {
+		case *value.Long:
+			if x.Ptr() != nil {
+				return *x.Ptr(), true
+			}
+		case *value.Int:
+			if x.Ptr() != nil {
+				return int64(*x.Ptr()), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (r Row) Real(col int) (float64, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.Real); ok && x.Ptr() != nil {
+			return *x.Ptr(), true
+		}
+	}
+	return 0, false
+}
+
+func (r Row) Decimal(col int) (decimal.Decimal, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.Decimal); ok && x.Ptr() != nil {
+			return *x.Ptr(), true
+		}
+	}
+	return decimal.Decimal{}, false
+}
+
+// String returns a string value. Kusto strings are never null, only empty.
+func (r Row) String(col int) (string, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.String); ok {
+			return x.Value, true
+		}
+	}
+	return "", false
+}
+
+func (r Row) DateTime(col int) (time.Time, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.DateTime); ok && x.Ptr() != nil {
+			return *x.Ptr(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (r Row) Timespan(col int) (time.Duration, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.Timespan); ok && x.Ptr() != nil {
+			return *x.Ptr(), true
+		}
+	}
+	return 0, false
+}
+
+func (r Row) GUID(col int) (uuid.UUID, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.GUID); ok && x.Ptr() != nil {
+			return *x.Ptr(), true
+		}
+	}
+	return uuid.UUID{}, false
+}
+
+// Dynamic returns the JSON text of a dynamic value. The slice is the SDK's; don't modify it.
+func (r Row) Dynamic(col int) ([]byte, bool) {
+	if col < len(r) {
+		if x, ok := r[col].(*value.Dynamic); ok && x.Value != nil {
+			return x.Value, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,53 @@
+package encode_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestRowAccessors(t *testing.T) {
+	_, vals := csvRow()
+	r := encode.RowAt(vals)
+	if n, ok := r.Long(0); !ok || n != 9007199254740993 {
+		t.Errorf("Long(0) = %d, %v", n, ok)
+	}
+	if n, ok := r.Long(2); !ok || n != -42 {
+		t.Errorf("Long of an int = %d, %v, want it widened", n, ok)
+	}
+	if d, ok := r.Timespan(5); !ok || d != 26*time.Hour+1500*time.Millisecond {
+		t.Errorf("Timespan(5) = %v, %v", d, ok)
+	}
+	if s, ok := r.String(7); !ok || s != `say "hi", then leave` {
+		t.Errorf("String(7) = %q, %v", s, ok)
+	}
+	if _, ok := r.Real(0); ok {
+		t.Error("Real of a long: ok")
+	}
+	if _, ok := r.Long(8); ok || !r.Null(8) || r.Null(0) {
+		t.Error("null long not reported as null")
+	}
+	if _, ok := r.Long(len(vals)); ok || !r.Null(len(vals)) {
+		t.Error("missing column not reported as null")
+	}
+	if !encode.RowAt(value.Values{value.NewNullDynamic()}).Null(0) {
+		t.Error("null dynamic not reported as null")
+	}
+
+	n := testing.AllocsPerRun(1000, func() {
+		r.Long(0)
+		r.Real(1)
+		r.Bool(3)
+		r.DateTime(4)
+		r.Timespan(5)
+		r.GUID(6)
+		r.String(7)
+		r.Null(8)
+	})
+	if n != 0 {
+		t.Errorf("accessors allocate %.1f times, want 0", n)
+	}
+}
@@ -0,0 +1,219 @@
+package encode
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+)
+
+// tableBufferRows is how many rows of a table are read before its column widths are fixed.
+// Later rows are printed as they arrive, truncated to those widths.
+const tableBufferRows = 1000
+
+// tableDynamicWidth is the width dynamic columns are cut to when --max-col-width isn't set.
+const tableDynamicWidth = 40
+
+// tableBorders are the characters of one table style: the corners and joints of the top,
+// header separator and bottom lines (left, middle, right), and the horizontal and vertical rules.
+type tableBorders struct {
+	top, mid, bottom [3]string
+	h, v             string
+}
+
+var tableStyles = map[string]tableBorders{
+	"unicode": {top: [3]string{"┌", "┬", "┐"}, mid: [3]string{"├", "┼", "┤"}, bottom: [3]string{"└", "┴", "┘"}, h: "─", v: "│"},
+	"ascii":   {top: [3]string{"+", "+", "+"}, mid: [3]string{"+", "+", "+"}, bottom: [3]string{"+", "+", "+"}, h: "-", v: "|"},
+}
+
+// tableWriter renders primary result tables as aligned text tables for terminals: a header of
+// column names, numbers right-aligned, line breaks and tabs shown escaped, and cells longer than
+// the column's width cut with "…". Each table ends with its row count.
+type tableWriter struct {
+	w        io.Writer
+	style    tableBorders
+	maxWidth int
+
+	skip     bool
+	tables   int
+	cols     []tableColumn
+	buffered [][]string
+	rows     int
+	started  bool // the header is out and widths are fixed
+	err      error
+}
+
+type tableColumn struct {
+	name  string
+	width int
+	limit int // 0: no limit
+	right bool
+}
+
+func newTableWriter(w io.Writer, opts Options) *tableWriter {
+	style, ok := tableStyles[opts.TableStyle]
+	if !ok {
+		style = tableStyles["unicode"]
+	}
+	return &tableWriter{w: w, style: style, maxWidth: opts.MaxColWidth}
+}
+
+func (t *tableWriter) Begin(tbl *Table) error {
+	t.finish()
+	t.skip = tbl.Kind != "PrimaryResult"
+	if t.skip {
+		return t.err
+	}
+	if t.tables > 0 {
+		t.printf("\n")
+	}
+	t.tables++
+	t.cols = make([]tableColumn, len(tbl.Columns))
+	for i, c := range tbl.Columns {
+		col := tableColumn{name: c.Name(), limit: t.maxWidth}
+		switch c.Type() {
+		case types.Int, types.Long, types.Real, types.Decimal:
+			col.right = true
+		case types.Dynamic:
+			if col.limit == 0 {
+				col.limit = tableDynamicWidth
+			}
+		}
+		col.width = col.fit(col.name)
+		t.cols[i] = col
+	}
+	t.buffered, t.rows, t.started = nil, 0, false
+	return t.err
+}
+
+func (t *tableWriter) WriteRow(tbl *Table, index int, vals value.Values) error {
+	if t.skip {
+		return nil
+	}
+	cells := make([]string, len(t.cols))
+	for i := range t.cols {
+		if i < len(vals) {
+			if v := PlainValue(vals[i]); v != nil {
+				cells[i] = tableCell(csvField(v))
+			}
+		}
+	}
+	t.rows++
+	if t.started {
+		t.row(cells)
+		return t.err
+	}
+	for i, c := range cells {
+		if w := t.cols[i].fit(c); w > t.cols[i].width {
+			t.cols[i].width = w
+		}
+	}
+	t.buffered = append(t.buffered, cells)
+	if len(t.buffered) == tableBufferRows {
+		t.start()
+	}
+	return t.err
+}
+
+func (t *tableWriter) End() error {
+	t.finish()
+	return t.err
+}
+
+// start prints the header and the buffered rows.
+func (t *tableWriter) start() {
+	t.started = true
+	t.rule(t.style.top)
+	names := make([]string, len(t.cols))
+	for i, c := range t.cols {
+		names[i] = c.name
+	}
+	t.line(names, false)
+	t.rule(t.style.mid)
+	for _, cells := range t.buffered {
+		t.row(cells)
+	}
+	t.buffered = nil
+}
+
+// finish closes the current table, if one is open.
+func (t *tableWriter) finish() {
+	if t.skip || t.cols == nil {
+		return
+	}
+	if !t.started {
+		t.start()
+	}
+	t.rule(t.style.bottom)
+	plural := "s"
+	if t.rows == 1 {
+		plural = ""
+	}
+	t.printf("(%d row%s)\n", t.rows, plural)
+	t.cols = nil
+}
+
+func (t *tableWriter) row(cells []string) { t.line(cells, true) }
+
+func (t *tableWriter) line(cells []string, align bool) {
+	var b strings.Builder
+	b.WriteString(t.style.v)
+	for i, c := range t.cols {
+		text := c.cut(cells[i])
+		pad := strings.Repeat(" ", c.width-utf8.RuneCountInString(text))
+		if align && c.right {
+			b.WriteString(" " + pad + text + " ")
+		} else {
+			b.WriteString(" " + text + pad + " ")
+		}
+		b.WriteString(t.style.v)
+	}
+	t.printf("%s\n", b.String())
+}
+
+func (t *tableWriter) rule(joints [3]string) {
+	var b strings.Builder
+	b.WriteString(joints[0])
+	for i, c := range t.cols {
+		if i > 0 {
+			b.WriteString(joints[1])
+		}
+		b.WriteString(strings.Repeat(t.style.h, c.width+2))
+	}
+	b.WriteString(joints[2])
+	t.printf("%s\n", b.String())
+}
+
+func (t *tableWriter) printf(format string, args ...interface{}) {
+	if t.err != nil {
+		return
+	}
+	_, t.err = fmt.Fprintf(t.w, format, args...)
+}
+
+// fit is the width s needs in the column, at most its limit.
+func (c tableColumn) fit(s string) int {
+	n := utf8.RuneCountInString(s)
+	if c.limit > 0 && n > c.limit {
+		return c.limit
+	}
+	return n
+}
+
+// cut shortens s to the column's width, marking the cut with "…".
+func (c tableColumn) cut(s string) string {
+	r := []rune(s)
+	if len(r) <= c.width {
+		return s
+	}
+	if c.width == 0 {
+		return ""
+	}
+	return string(r[:c.width-1]) + "…"
+}
+
+// tableCell escapes the characters that would break a table's lines.
+var tableCell = strings.NewReplacer("\r", `\r`, "\n", `\n`, "\t", `\t`).Replace
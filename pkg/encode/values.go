@@ -0,0 +1,98 @@
+package encode
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// PlainValue unwraps a Kusto value into a plain Go value: nil for nulls, otherwise one of
+// bool, int32, int64, float64, decimal.Decimal, string, time.Time, time.Duration, uuid.UUID
+// or []byte (dynamic). The SDK returns typed pointers from GetValue, which is awkward for encoders.
+func PlainValue(v value.Kusto) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch x := v.GetValue().(type) {
+	case nil:
+		return nil
+	case *bool:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *int32:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *int64:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *float64:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *decimal.Decimal:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *string:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *time.Time:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *time.Duration:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *uuid.UUID:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *[]byte:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case []byte:
+		if x == nil {
+			return nil
+		}
+		return x
+	default:
+		return x
+	}
+}
+
+// decodeDynamic parses the JSON of a dynamic value. Numbers are kept as json.Number so large
+// integers keep all their digits. ok is false unless b holds exactly one JSON value; callers
+// then fall back to the raw text.
+func decodeDynamic(b []byte) (interface{}, bool) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	return v, true
+}
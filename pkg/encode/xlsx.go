@@ -0,0 +1,405 @@
+package encode
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Cell style indexes into the cellXfs of xlsxStyles.
+const (
+	xlsxStyleDefault  = 0
+	xlsxStyleDateTime = 1
+	xlsxStyleTimespan = 2
+	xlsxStyleHeader   = 3
+)
+
+// xlsxMaxCellText is Excel's limit on characters in a single cell.
+const xlsxMaxCellText = 32767
+
+// xlsxMaxRows is Excel's limit on rows in a sheet, the header included.
+const xlsxMaxRows = 1048576
+
+// xlsxWriter streams an Excel workbook with one sheet per primary result table. Cells are typed:
+// numbers and booleans as values, datetimes/timespans as date serials with a display format, and
+// everything else as inline strings. The header row is bold, frozen and carries an autofilter.
+// Sheets are written to the zip as rows arrive; the workbook parts that list them are written on close.
+// A table with more rows than a sheet holds continues on sheets named after its own with _2, _3, ...
+type xlsxWriter struct {
+	zw      *zip.Writer
+	sheet   *bufio.Writer
+	sheets  []string
+	filters []string // autofilter range per sheet, "" when the sheet has no columns
+	cols    int
+	row     int
+	maxRows int    // rows per sheet, the header included
+	name    string // sheet name of the table's first sheet
+	part    int    // sheet of the table being written, from 1
+	buf     []byte
+	skip    bool
+	err     error
+}
+
+func newXlsxWriter(w io.Writer) *xlsxWriter {
+	return &xlsxWriter{zw: zip.NewWriter(w), maxRows: xlsxMaxRows}
+}
+
+func (x *xlsxWriter) Begin(t *Table) error {
+	if err := x.endSheet(); err != nil {
+		return err
+	}
+	x.skip = t.Kind != "PrimaryResult"
+	if x.skip {
+		return nil
+	}
+	x.name, x.part = xlsxSheetName(t.Name, x.sheets), 1
+	return x.beginSheet(t, x.name)
+}
+
+// beginSheet starts a sheet for t's rows with its header row.
+func (x *xlsxWriter) beginSheet(t *Table, name string) error {
+	x.sheets = append(x.sheets, name)
+	f, err := x.zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", len(x.sheets)))
+	if err != nil {
+		return err
+	}
+	x.sheet = bufio.NewWriterSize(f, 64<<10)
+	x.cols, x.row = len(t.Columns), 1
+	x.printf(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>` +
+		`<sheetData><row r="1">`)
+	var b []byte
+	for i, c := range t.Columns {
+		b = appendXlsxInlineString(b, i, 1, c.Name(), xlsxStyleHeader)
+	}
+	x.write(append(b, `</row>`...))
+	return x.err
+}
+
+// nextSheet continues t on a new sheet once the current one is full.
+func (x *xlsxWriter) nextSheet(t *Table) error {
+	if x.row < x.maxRows {
+		return nil
+	}
+	if err := x.endSheet(); err != nil {
+		return err
+	}
+	x.part++
+	suffix := fmt.Sprintf("_%d", x.part)
+	base := []rune(x.name)
+	if len(base)+len(suffix) > 31 {
+		base = base[:31-len(suffix)]
+	}
+	return x.beginSheet(t, xlsxSheetName(string(base)+suffix, x.sheets))
+}
+
+func (x *xlsxWriter) WriteRow(t *Table, index int, vals value.Values) error {
+	if x.skip {
+		return nil
+	}
+	if err := x.nextSheet(t); err != nil {
+		return err
+	}
+	x.row++
+	x.buf = appendXlsxRow(x.buf[:0], x.row, t, vals)
+	x.write(x.buf)
+	return x.err
+}
+
+// EncodeRow appends the row's XML, numbered as the sheet row after the header for index. Rows
+// of tables other than primary results have none. A row that goes on a continuation sheet is
+// numbered again by WriteEncoded.
+func (x *xlsxWriter) EncodeRow(dst []byte, t *Table, index int, vals value.Values) ([]byte, error) {
+	if t.Kind != "PrimaryResult" {
+		return dst, nil
+	}
+	return appendXlsxRow(dst, index+2, t, vals), nil
+}
+
+func (x *xlsxWriter) WriteEncoded(t *Table, index int, vals value.Values, row []byte) error {
+	if x.skip {
+		return nil
+	}
+	if err := x.nextSheet(t); err != nil {
+		return err
+	}
+	if x.row++; x.row != index+2 {
+		// The rows' indexes have a gap, so their cell references are off: number it again.
+		row = appendXlsxRow(nil, x.row, t, vals)
+	}
+	x.write(row)
+	return x.err
+}
+
+func (x *xlsxWriter) End() error {
+	if err := x.endSheet(); err != nil {
+		return err
+	}
+	if len(x.sheets) == 0 {
+		// A workbook needs at least one sheet to open.
+		if err := x.Begin(&Table{Name: "PrimaryResult", Kind: "PrimaryResult"}); err != nil {
+			return err
+		}
+		if err := x.endSheet(); err != nil {
+			return err
+		}
+	}
+	var types, sheets, rels, names strings.Builder
+	for i, name := range x.sheets {
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&sheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(name), i+1, i+1)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+		if x.filters[i] != "" {
+			fmt.Fprintf(&names, `<definedName name="_xlnm._FilterDatabase" localSheetId="%d" hidden="1">'%s'!%s</definedName>`, i, strings.ReplaceAll(xmlEscape(name), "'", "''"), x.filters[i])
+		}
+	}
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+			`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			types.String() + `</Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+			`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + sheets.String() + `</sheets>` + xlsxDefinedNames(names.String()) + `</workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + rels.String() +
+			fmt.Sprintf(`<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(x.sheets)+1) +
+			`</Relationships>`},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, p := range parts {
+		f, err := x.zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, p.body); err != nil {
+			return err
+		}
+	}
+	return x.zw.Close()
+}
+
+// endSheet closes the current sheet, adding the autofilter over the header and data rows.
+func (x *xlsxWriter) endSheet() error {
+	if x.sheet == nil {
+		return x.err
+	}
+	x.printf(`</sheetData>`)
+	filter := ""
+	if x.cols > 0 {
+		x.printf(`<autoFilter ref="A1:%s%d"/>`, xlsxColumn(x.cols-1), x.row)
+		filter = fmt.Sprintf("$A$1:$%s$%d", xlsxColumn(x.cols-1), x.row)
+	}
+	x.filters = append(x.filters, filter)
+	x.printf(`</worksheet>`)
+	if x.err == nil {
+		x.err = x.sheet.Flush()
+	}
+	x.sheet = nil
+	return x.err
+}
+
+// appendXlsxRow appends a sheet row numbered row (1-based; the header is row 1).
+func appendXlsxRow(b []byte, row int, t *Table, vals value.Values) []byte {
+	b = append(b, `<row r="`...)
+	b = append(strconv.AppendInt(b, int64(row), 10), `">`...)
+	for i := range t.Columns {
+		if i >= len(vals) {
+			continue
+		}
+		b = appendXlsxCell(b, i, row, PlainValue(vals[i]))
+	}
+	return append(b, `</row>`...)
+}
+
+func appendXlsxCell(b []byte, col, row int, v interface{}) []byte {
+	switch t := v.(type) {
+	case nil:
+		return b
+	case bool:
+		if t {
+			return appendXlsxValue(b, col, row, "b", xlsxStyleDefault, "1")
+		}
+		return appendXlsxValue(b, col, row, "b", xlsxStyleDefault, "0")
+	case int32:
+		return appendXlsxValue(b, col, row, "", xlsxStyleDefault, strconv.FormatInt(int64(t), 10))
+	case int64:
+		// Excel stores doubles; keep integers beyond 2^53 exact as text.
+		if t > 1<<53 || t < -(1<<53) {
+			return appendXlsxInlineString(b, col, row, strconv.FormatInt(t, 10), xlsxStyleDefault)
+		}
+		return appendXlsxValue(b, col, row, "", xlsxStyleDefault, strconv.FormatInt(t, 10))
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return appendXlsxInlineString(b, col, row, strconv.FormatFloat(t, 'g', -1, 64), xlsxStyleDefault)
+		}
+		return appendXlsxValue(b, col, row, "", xlsxStyleDefault, strconv.FormatFloat(t, 'g', -1, 64))
+	case decimal.Decimal:
+		if f, exact := t.Float64(); exact {
+			return appendXlsxValue(b, col, row, "", xlsxStyleDefault, strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		return appendXlsxInlineString(b, col, row, t.String(), xlsxStyleDefault)
+	case time.Time:
+		// Excel's dates run from 1900-01-01 to 9999-12-31; outside them a serial shows as #####,
+		// and the last tenth of a microsecond of 9999 rounds to a serial past the end.
+		if serial := xlsxSerial(t); serial >= 1 && serial < 2958466 {
+			return appendXlsxValue(b, col, row, "", xlsxStyleDateTime, strconv.FormatFloat(serial, 'f', -1, 64))
+		}
+		return appendXlsxInlineString(b, col, row, t.UTC().Format(time.RFC3339Nano), xlsxStyleDefault)
+	case time.Duration:
+		return appendXlsxValue(b, col, row, "", xlsxStyleTimespan, strconv.FormatFloat(t.Hours()/24, 'f', -1, 64))
+	case uuid.UUID:
+		return appendXlsxInlineString(b, col, row, t.String(), xlsxStyleDefault)
+	case []byte:
+		return appendXlsxInlineString(b, col, row, string(t), xlsxStyleDefault)
+	default:
+		return appendXlsxInlineString(b, col, row, fmt.Sprint(t), xlsxStyleDefault)
+	}
+}
+
+// appendXlsxValue appends a cell holding v, with a cell type (t="b") and a style if they are set.
+func appendXlsxValue(b []byte, col, row int, typ string, style int, v string) []byte {
+	b = appendXlsxRef(b, col, row)
+	if typ != "" {
+		b = append(append(append(b, ` t="`...), typ...), '"')
+	}
+	b = appendXlsxStyle(b, style)
+	b = append(b, "><v>"...)
+	return append(append(b, v...), "</v></c>"...)
+}
+
+func appendXlsxInlineString(b []byte, col, row int, s string, style int) []byte {
+	if len(s) > xlsxMaxCellText {
+		s = s[:xlsxMaxCellText]
+	}
+	b = append(appendXlsxRef(b, col, row), ` t="inlineStr"`...)
+	b = appendXlsxStyle(b, style)
+	b = append(b, `><is><t xml:space="preserve">`...)
+	return append(append(b, xmlEscape(s)...), `</t></is></c>`...)
+}
+
+// appendXlsxRef opens a cell element: <c r="B7".
+func appendXlsxRef(b []byte, col, row int) []byte {
+	b = append(append(b, `<c r="`...), xlsxColumn(col)...)
+	return append(strconv.AppendInt(b, int64(row), 10), '"')
+}
+
+func appendXlsxStyle(b []byte, style int) []byte {
+	if style == xlsxStyleDefault {
+		return b
+	}
+	return append(strconv.AppendInt(append(b, ` s="`...), int64(style), 10), '"')
+}
+
+func (x *xlsxWriter) write(b []byte) {
+	if x.err != nil {
+		return
+	}
+	_, x.err = x.sheet.Write(b)
+}
+
+func (x *xlsxWriter) printf(format string, args ...interface{}) {
+	if x.err != nil {
+		return
+	}
+	_, x.err = fmt.Fprintf(x.sheet, format, args...)
+}
+
+// xlsxSerial converts a time to an Excel date serial (days since 1899-12-30, UTC).
+// It counts seconds rather than taking a time.Duration, which only spans 292 years.
+func xlsxSerial(t time.Time) float64 {
+	const epoch = -2209161600 // 1899-12-30, in Unix seconds
+	return (float64(t.Unix()-epoch) + float64(t.Nanosecond())/1e9) / 86400
+}
+
+// xlsxColumn returns the column letters for a zero-based index (0 -> A, 26 -> AA).
+func xlsxColumn(i int) string {
+	var b []byte
+	for i++; i > 0; i = (i - 1) / 26 {
+		b = append([]byte{byte('A' + (i-1)%26)}, b...)
+	}
+	return string(b)
+}
+
+// xlsxSheetName makes a valid, unique sheet name: at most 31 characters and none of []:*?/\.
+func xlsxSheetName(name string, taken []string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "Sheet"
+	}
+	base := []rune(name)
+	if len(base) > 31 {
+		base = base[:31]
+	}
+	candidate := string(base)
+	for n := 2; containsFold(taken, candidate); n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		r := base
+		if len(r)+len(suffix) > 31 {
+			r = r[:31-len(suffix)]
+		}
+		candidate = string(r) + suffix
+	}
+	return candidate
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func xlsxDefinedNames(names string) string {
+	if names == "" {
+		return ""
+	}
+	return "<definedNames>" + names + "</definedNames>"
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/><numFmt numFmtId="165" formatCode="[h]:mm:ss"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="4">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`</cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`
@@ -0,0 +1,91 @@
+package encode
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+)
+
+func TestXlsxSheetRollover(t *testing.T) {
+	tbl := &Table{Name: "StormEvents", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "Id", types.Long)}}
+	tests := []struct {
+		name    string
+		encoded bool // rows go through EncodeRow/WriteEncoded, as with --encode-workers
+	}{
+		{name: "WriteRow"},
+		{name: "WriteEncoded", encoded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			x := newXlsxWriter(&buf)
+			x.maxRows = 3 // the header and two rows
+			x.Begin(tbl)
+			for i := 0; i < 5; i++ {
+				vals := value.Values{value.NewLong(int64(i))}
+				var err error
+				if tt.encoded {
+					row, _ := x.EncodeRow(nil, tbl, i, vals)
+					err = x.WriteEncoded(tbl, i, vals, row)
+				} else {
+					err = x.WriteRow(tbl, i, vals)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := x.End(); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := map[string]string{}
+			for _, f := range zr.File {
+				rc, _ := f.Open()
+				b, _ := io.ReadAll(rc)
+				rc.Close()
+				parts[f.Name] = string(b)
+			}
+			names := regexp.MustCompile(`<sheet name="([^"]*)"`).FindAllStringSubmatch(parts["xl/workbook.xml"], -1)
+			var got []string
+			for _, n := range names {
+				got = append(got, n[1])
+			}
+			if strings.Join(got, ",") != "StormEvents,StormEvents_2,StormEvents_3" {
+				t.Errorf("sheets %v", got)
+			}
+			// Each sheet starts with the header, and its rows are numbered from 2.
+			wantRows := []string{`r="1" r="2" r="3"`, `r="1" r="2" r="3"`, `r="1" r="2"`}
+			for i, want := range wantRows {
+				sheet := parts[fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1)]
+				rows := strings.Join(regexp.MustCompile(`<row r="\d+"`).FindAllString(sheet, -1), " ")
+				if strings.ReplaceAll(rows, "<row ", "") != want {
+					t.Errorf("sheet %d rows %s, want %s", i+1, rows, want)
+				}
+				if !strings.Contains(sheet, `<t xml:space="preserve">Id</t>`) {
+					t.Errorf("sheet %d has no header", i+1)
+				}
+			}
+			if !strings.Contains(parts["xl/worksheets/sheet3.xml"], `<autoFilter ref="A1:A2"/>`) {
+				t.Error("autofilter of the last sheet")
+			}
+		})
+	}
+}
+
+func TestXlsxMaxRows(t *testing.T) {
+	if x := newXlsxWriter(io.Discard); x.maxRows != 1048576 {
+		t.Errorf("maxRows %d", x.maxRows)
+	}
+}
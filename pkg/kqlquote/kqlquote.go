@@ -0,0 +1,70 @@
+// Package kqlquote builds KQL string literals and bracketed names from untrusted text, and reads
+// them back. KQL has no parameter binding for control commands, so every value spliced into a
+// query or command goes through String or Ident.
+package kqlquote
+
+import (
+	"fmt"
+	"strings"
+)
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// String returns s as a double-quoted KQL string literal. Backslashes, quotes and line breaks
+// are escaped, so the literal stays on one line and can't end early.
+func String(s string) string {
+	return `"` + escaper.Replace(s) + `"`
+}
+
+// Ident returns name as a bracketed KQL name, ['name'], which is valid for any table, column or
+// database name, including ones with spaces or that collide with keywords.
+func Ident(name string) string {
+	return `['` + escaper.Replace(name) + `']`
+}
+
+// Unquote returns the value of a single- or double-quoted KQL string literal. The whole of lit
+// must be the literal.
+func Unquote(lit string) (string, error) {
+	if len(lit) < 2 || (lit[0] != '"' && lit[0] != '\'') || lit[len(lit)-1] != lit[0] {
+		return "", fmt.Errorf("not a quoted string: %q", lit)
+	}
+	q := lit[0]
+	var b strings.Builder
+	for i := 1; i < len(lit)-1; i++ {
+		c := lit[i]
+		switch {
+		case c == q:
+			return "", fmt.Errorf("unescaped quote at offset %d in %q", i, lit)
+		case c == '\n' || c == '\r':
+			return "", fmt.Errorf("line break in string literal %q", lit)
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(lit)-1 {
+			return "", fmt.Errorf("string literal %q ends in a backslash", lit)
+		}
+		switch lit[i] {
+		case '\\', '"', '\'':
+			b.WriteByte(lit[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		default:
+			return "", fmt.Errorf("unknown escape \\%c in %q", lit[i], lit)
+		}
+	}
+	return b.String(), nil
+}
+
+// UnquoteIdent returns the name in a bracketed KQL name such as ['name'] or ["name"].
+func UnquoteIdent(ident string) (string, error) {
+	if len(ident) < 4 || ident[0] != '[' || ident[len(ident)-1] != ']' {
+		return "", fmt.Errorf("not a bracketed name: %q", ident)
+	}
+	return Unquote(ident[1 : len(ident)-1])
+}
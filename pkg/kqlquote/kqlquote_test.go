@@ -0,0 +1,73 @@
+package kqlquote
+
+import (
+	"strings"
+	"testing"
+)
+
+var seeds = []string{
+	"",
+	"plain",
+	"it's",
+	`say "hi"`,
+	`C:\temp\`,
+	`\'`,
+	"two\nlines\r\n",
+	"tab\there",
+	"']; .drop table T; //",
+	"\xff\xfe invalid utf-8",
+	"ü\x00",
+}
+
+func FuzzString(f *testing.F) {
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		lit := String(s)
+		if strings.ContainsAny(lit, "\n\r") {
+			t.Fatalf("String(%q) = %q spans lines", s, lit)
+		}
+		got, err := Unquote(lit)
+		if err != nil {
+			t.Fatalf("Unquote(String(%q)): %v", s, err)
+		}
+		if got != s {
+			t.Fatalf("Unquote(String(%q)) = %q", s, got)
+		}
+	})
+}
+
+func FuzzIdent(f *testing.F) {
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		id := Ident(s)
+		got, err := UnquoteIdent(id)
+		if err != nil {
+			t.Fatalf("UnquoteIdent(Ident(%q)): %v", s, err)
+		}
+		if got != s {
+			t.Fatalf("UnquoteIdent(Ident(%q)) = %q", s, got)
+		}
+	})
+}
+
+// FuzzUnquote feeds arbitrary text to Unquote: it must not panic, and whatever it accepts must
+// survive a round trip through String.
+func FuzzUnquote(f *testing.F) {
+	for _, s := range []string{`""`, `''`, `"a\"b"`, `'a\'b'`, `"\\"`, `"\"`, `"a"b"`, `"\q"`, `'`, "\"\n\"", `["x"]`} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, lit string) {
+		v, err := Unquote(lit)
+		if err != nil {
+			return
+		}
+		again, err := Unquote(String(v))
+		if err != nil || again != v {
+			t.Fatalf("Unquote(%q) = %q does not round-trip: %q, %v", lit, v, again, err)
+		}
+	})
+}
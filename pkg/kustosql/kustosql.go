@@ -0,0 +1,314 @@
+// Package kustosql is a read-only database/sql driver for Kusto queries, so Go tooling that
+// speaks database/sql can query a cluster:
+//
+//	db := sql.OpenDB(kustosql.NewConnector(client, "Samples"))
+//	rows, err := db.QueryContext(ctx, "StormEvents | where State == state | take n",
+//		sql.Named("state", "TEXAS"), sql.Named("n", 10))
+//
+// or by name, with DefaultAzureCredential, as sql.Open("kusto", "https://<cluster>/<database>").
+//
+// Arguments become KQL query parameters, declared ahead of the query: named ones under their
+// name, positional ones as p1, p2 and so on. Their KQL type follows the Go type: string, int64
+// (and the other integers) as long, float64 as real, bool, time.Time as datetime, time.Duration
+// as timespan, uuid.UUID as guid, decimal.Decimal as decimal, and []byte (JSON) as dynamic.
+//
+// Rows are the query's first primary result, streamed. Columns scan as: string, long and int as
+// int64, real as float64, bool, datetime as time.Time, timespan as int64 nanoseconds (scan into a
+// time.Duration), guid and decimal as their text, and dynamic as its JSON. Exec, transactions and
+// control commands are refused; every query is sent with request_readonly.
+package kustosql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// ErrReadOnly is returned for Exec, Begin and control commands.
+var ErrReadOnly = errors.New("kustosql: read-only; only queries are supported")
+
+func init() {
+	sql.Register("kusto", Driver{})
+}
+
+// queryFunc runs a query; it is the client's IterativeQuery.
+type queryFunc func(ctx context.Context, database string, q *kql.Builder, opts ...azkustodata.QueryOption) (query.IterativeDataset, error)
+
+// Connector connects to one database of a cluster through a client.
+type Connector struct {
+	database string
+	query    queryFunc
+	closer   io.Closer // the client, when the connector created it
+}
+
+// NewConnector returns a connector querying database through client. The caller keeps
+// ownership of the client.
+func NewConnector(client *azkustodata.Client, database string) *Connector {
+	return &Connector{database: database, query: func(ctx context.Context, database string, q *kql.Builder, opts ...azkustodata.QueryOption) (query.IterativeDataset, error) {
+		return client.IterativeQuery(ctx, database, q, opts...)
+	}}
+}
+
+func (c *Connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{database: c.database, query: c.query}, nil
+}
+
+func (c *Connector) Driver() driver.Driver { return Driver{} }
+
+// Close closes the client if the connector created it from a DSN; sql.DB.Close calls it.
+func (c *Connector) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// Driver opens connections from a DSN, https://<cluster>/<database>, signing in with
+// DefaultAzureCredential.
+type Driver struct{}
+
+func (d Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+func (Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("kustosql: DSN %q: want https://<cluster>/<database>", dsn)
+	}
+	database := strings.Trim(u.Path, "/")
+	if database == "" || strings.Contains(database, "/") {
+		return nil, fmt.Errorf("kustosql: DSN %q: want https://<cluster>/<database>", dsn)
+	}
+	client, err := azkustodata.New(azkustodata.NewConnectionStringBuilder("https://" + u.Host).WithDefaultAzureCredential())
+	if err != nil {
+		return nil, fmt.Errorf("kustosql: %w", err)
+	}
+	c := NewConnector(client, database)
+	c.closer = client
+	return c, nil
+}
+
+type conn struct {
+	database string
+	query    queryFunc
+}
+
+func (c *conn) Prepare(text string) (driver.Stmt, error) { return &stmt{c: c, text: text}, nil }
+func (c *conn) Close() error                             { return nil }
+func (c *conn) Begin() (driver.Tx, error)                { return nil, ErrReadOnly }
+
+func (c *conn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return nil, ErrReadOnly
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	rows, err := c.QueryContext(ctx, "print 1", nil)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// CheckNamedValue lets the KQL-typed arguments through as they are; the rest go through the
+// default conversion.
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch nv.Value.(type) {
+	case time.Duration, uuid.UUID, decimal.Decimal:
+		return nil
+	}
+	v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	nv.Value = v
+	return err
+}
+
+func (c *conn) QueryContext(ctx context.Context, text string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasPrefix(strings.TrimSpace(text), ".") {
+		return nil, ErrReadOnly
+	}
+	text, params, err := Bind(text, args)
+	if err != nil {
+		return nil, err
+	}
+	opts := []azkustodata.QueryOption{azkustodata.RequestReadonly()}
+	if params != nil {
+		opts = append(opts, azkustodata.QueryParameters(params))
+	}
+	ds, err := c.query(ctx, c.database, (&kql.Builder{}).AddUnsafe(text), opts...)
+	if err != nil {
+		return nil, err
+	}
+	r := &rows{ds: ds}
+	if err := r.start(); err != nil {
+		ds.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Bind declares the arguments as query parameters ahead of text and returns their values. It
+// returns nil parameters when there are no arguments.
+func Bind(text string, args []driver.NamedValue) (string, *kql.Parameters, error) {
+	if len(args) == 0 {
+		return text, nil, nil
+	}
+	params := kql.NewParameters()
+	decls := make([]string, len(args))
+	for i, a := range args {
+		name := a.Name
+		if name == "" {
+			name = fmt.Sprintf("p%d", a.Ordinal)
+		}
+		var t string
+		switch v := a.Value.(type) {
+		case string:
+			t = "string"
+			params.AddString(name, v)
+		case int64:
+			t = "long"
+			params.AddLong(name, v)
+		case float64:
+			t = "real"
+			params.AddReal(name, v)
+		case bool:
+			t = "bool"
+			params.AddBool(name, v)
+		case time.Time:
+			t = "datetime"
+			params.AddDateTime(name, v.UTC())
+		case time.Duration:
+			t = "timespan"
+			params.AddTimespan(name, v)
+		case uuid.UUID:
+			t = "guid"
+			params.AddGUID(name, v)
+		case decimal.Decimal:
+			t = "decimal"
+			params.AddDecimal(name, v)
+		case []byte:
+			var doc interface{}
+			if err := json.Unmarshal(v, &doc); err != nil {
+				return "", nil, fmt.Errorf("kustosql: argument %s: []byte must be JSON, for a dynamic parameter: %v", name, err)
+			}
+			t = "dynamic"
+			params.AddDynamic(name, doc)
+		case nil:
+			return "", nil, fmt.Errorf("kustosql: argument %s is nil; query parameters need a value to have a type", name)
+		default:
+			return "", nil, fmt.Errorf("kustosql: argument %s: unsupported type %T", name, v)
+		}
+		decls[i] = name + ":" + t
+	}
+	return fmt.Sprintf("declare query_parameters(%s);\n%s", strings.Join(decls, ", "), text), params, nil
+}
+
+type stmt struct {
+	c    *conn
+	text string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec([]driver.Value) (driver.Result, error) { return nil, ErrReadOnly }
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return s.QueryContext(context.Background(), named)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.c.QueryContext(ctx, s.text, args)
+}
+
+// rows reads the first primary result of a dataset as it streams in.
+type rows struct {
+	ds    query.IterativeDataset
+	table query.IterativeTable
+	next  <-chan query.RowResult
+}
+
+// start waits for the first primary result, so its columns are known.
+func (r *rows) start() error {
+	for tr := range r.ds.Tables() {
+		if err := tr.Err(); err != nil {
+			return err
+		}
+		if t := tr.Table(); t.Kind() == "PrimaryResult" {
+			r.table, r.next = t, t.Rows()
+			return nil
+		}
+		for range tr.Table().Rows() {
+		}
+	}
+	return errors.New("kustosql: the query returned no primary result")
+}
+
+func (r *rows) Columns() []string {
+	cols := r.table.Columns()
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// ColumnTypeDatabaseTypeName is the column's KQL type, e.g. "DATETIME".
+func (r *rows) ColumnTypeDatabaseTypeName(i int) string {
+	return strings.ToUpper(string(r.table.Columns()[i].Type()))
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	rr, ok := <-r.next
+	if !ok {
+		return io.EOF
+	}
+	if err := rr.Err(); err != nil {
+		return err
+	}
+	for i, v := range rr.Row().Values() {
+		if i < len(dest) {
+			dest[i] = driverValue(encode.PlainValue(v))
+		}
+	}
+	return nil
+}
+
+func (r *rows) Close() error { return r.ds.Close() }
+
+// driverValue is a cell as one of the types database/sql scans from.
+func driverValue(v interface{}) driver.Value {
+	switch x := v.(type) {
+	case int32:
+		return int64(x)
+	case time.Duration:
+		return int64(x)
+	case uuid.UUID:
+		return x.String()
+	case decimal.Decimal:
+		return x.String()
+	}
+	return v
+}
@@ -0,0 +1,172 @@
+package kustosql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+)
+
+type fakeDataset struct {
+	query.IterativeDataset
+	tables chan query.TableResult
+	closed bool
+}
+
+func (d *fakeDataset) Tables() <-chan query.TableResult { return d.tables }
+func (d *fakeDataset) Close() error                     { d.closed = true; return nil }
+
+type fakeTable struct {
+	query.IterativeTable
+	kind    string
+	columns []query.Column
+	rows    chan query.RowResult
+}
+
+func (t *fakeTable) Kind() string                 { return t.kind }
+func (t *fakeTable) Columns() []query.Column      { return t.columns }
+func (t *fakeTable) Rows() <-chan query.RowResult { return t.rows }
+func (t *fakeTable) SkipToEnd() []error           { return nil }
+
+type tableResult struct{ t query.IterativeTable }
+
+func (r tableResult) Table() query.IterativeTable { return r.t }
+func (r tableResult) Err() error                  { return nil }
+
+type fakeRow struct {
+	query.Row
+	values value.Values
+}
+
+func (r fakeRow) Values() value.Values { return r.values }
+
+type rowResult struct{ r query.Row }
+
+func (r rowResult) Row() query.Row { return r.r }
+func (r rowResult) Err() error     { return nil }
+
+// newDataset is a dataset of a QueryProperties table and a primary result holding rows.
+func newDataset(columns []query.Column, rows ...value.Values) *fakeDataset {
+	props := &fakeTable{kind: "QueryProperties", rows: make(chan query.RowResult)}
+	close(props.rows)
+	primary := &fakeTable{kind: "PrimaryResult", columns: columns, rows: make(chan query.RowResult, len(rows))}
+	for _, r := range rows {
+		primary.rows <- rowResult{fakeRow{values: r}}
+	}
+	close(primary.rows)
+	ds := &fakeDataset{tables: make(chan query.TableResult, 2)}
+	ds.tables <- tableResult{props}
+	ds.tables <- tableResult{primary}
+	close(ds.tables)
+	return ds
+}
+
+func TestBind(t *testing.T) {
+	when := time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	text, params, err := Bind("StormEvents | where State == state and StartTime > p2", []driver.NamedValue{
+		{Name: "state", Ordinal: 1, Value: "TEXAS"},
+		{Ordinal: 2, Value: when},
+		{Ordinal: 3, Value: int64(10)},
+		{Ordinal: 4, Value: 2.5},
+		{Ordinal: 5, Value: true},
+		{Ordinal: 6, Value: time.Hour},
+		{Ordinal: 7, Value: uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")},
+		{Ordinal: 8, Value: []byte(`{"a":1}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "declare query_parameters(state:string, p2:datetime, p3:long, p4:real, p5:bool, p6:timespan, p7:guid, p8:dynamic);\nStormEvents | where State == state and StartTime > p2"
+	if text != want || params == nil {
+		t.Errorf("Bind:\n%s\nwant:\n%s", text, want)
+	}
+
+	if text, params, err := Bind("print 1", nil); text != "print 1" || params != nil || err != nil {
+		t.Errorf("no arguments: %q %v %v", text, params, err)
+	}
+	for _, v := range []interface{}{nil, []byte("not json"), struct{}{}} {
+		if _, _, err := Bind("print p1", []driver.NamedValue{{Ordinal: 1, Value: v}}); err == nil {
+			t.Errorf("Bind(%#v) accepted", v)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	var gotText string
+	var gotOpts int
+	ds := newDataset([]query.Column{
+		query.NewColumn(0, "State", types.String),
+		query.NewColumn(1, "Events", types.Long),
+		query.NewColumn(2, "Duration", types.Timespan),
+	},
+		value.Values{value.NewString("TEXAS"), value.NewLong(3), value.NewTimespan(90 * time.Second)},
+		value.Values{value.NewString("OHIO"), value.NewNullLong(), value.NewTimespan(time.Minute)},
+	)
+	c := &Connector{database: "Samples", query: func(ctx context.Context, database string, q *kql.Builder, opts ...azkustodata.QueryOption) (query.IterativeDataset, error) {
+		gotText, gotOpts = q.String(), len(opts)
+		return ds, nil
+	}}
+	db := sql.OpenDB(c)
+	defer db.Close()
+
+	rows, err := db.Query("StormEvents | where Events > ? | take n", int32(1), sql.Named("n", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(gotText, "declare query_parameters(p1:long, n:long);\n") || gotOpts != 2 {
+		t.Errorf("sent %q with %d options", gotText, gotOpts)
+	}
+	if cols, _ := rows.Columns(); strings.Join(cols, ",") != "State,Events,Duration" {
+		t.Errorf("columns %q", cols)
+	}
+	if types, _ := rows.ColumnTypes(); types[2].DatabaseTypeName() != "TIMESPAN" {
+		t.Errorf("type %q", types[2].DatabaseTypeName())
+	}
+	var got []string
+	for rows.Next() {
+		var state string
+		var events sql.NullInt64
+		var d time.Duration
+		if err := rows.Scan(&state, &events, &d); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, state, d.String())
+		if events.Valid {
+			got = append(got, "3")
+		}
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "TEXAS 1m30s 3 OHIO 1m0s" || !ds.closed {
+		t.Errorf("rows %q, closed %v", got, ds.closed)
+	}
+
+	if _, err := db.Exec("StormEvents | take 1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Exec: %v", err)
+	}
+	if _, err := db.Begin(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Begin: %v", err)
+	}
+	if _, err := db.Query(".drop table StormEvents"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("control command: %v", err)
+	}
+}
+
+func TestOpenConnector(t *testing.T) {
+	for _, dsn := range []string{"https://help.kusto.windows.net", "http://help.kusto.windows.net/Samples", "https://help.kusto.windows.net/a/b"} {
+		if _, err := (Driver{}).OpenConnector(dsn); err == nil {
+			t.Errorf("OpenConnector(%q) accepted", dsn)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Package probe checks that a cluster is usable: the endpoint answers, the database accepts
+// queries and a known sample row can be read. It is the logic behind the "probe" and
+// "probe-load" subcommands, for callers that want the results rather than the printed lines.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/classify"
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// The probe's steps, in the order Run executes them.
+const (
+	StepMgmt       = "mgmt"        // .show version (cluster-level)
+	StepDatabase   = "database"    // print 1 (query-level)
+	StepDataSample = "data-sample" // the expected row of the sample table
+	StepIngest     = "ingest"      // append a row to the ingest table and read it back
+)
+
+// Step is one node of the probe's dependency graph.
+type Step struct {
+	Name      string
+	DependsOn []string          // steps that must pass first; otherwise this one is skipped
+	When      func(Config) bool // whether the step applies to cfg; nil means always
+}
+
+// Enabled reports whether the step applies to cfg.
+func (s Step) Enabled(cfg Config) bool { return s.When == nil || s.When(cfg) }
+
+// Steps lists the steps in order. Each step only depends on steps before it.
+var Steps = []Step{
+	{Name: StepMgmt},
+	{Name: StepDatabase, DependsOn: []string{StepMgmt}},
+	{Name: StepDataSample, DependsOn: []string{StepDatabase}},
+	{Name: StepIngest, DependsOn: []string{StepDatabase}, When: func(cfg Config) bool { return cfg.Ingest }},
+}
+
+// ErrSampleMissing is the error of a data-sample step whose query succeeded without finding
+// the expected row.
+var ErrSampleMissing = errors.New("expected row not found")
+
+// Config says what to probe.
+type Config struct {
+	Database      string
+	SampleTable   string
+	ExpectMessage string // the Message value the sample table must contain
+	Ingest        bool   // run the ingest step, which writes to IngestTable
+	IngestTable   string // created on first use with the sample table's schema
+
+	// Timeout returns the timeout of one call of the given kind ("mgmt", "query" or "ingest"). Nil or a
+	// non-positive result leaves the call bounded only by the context passed to Run.
+	Timeout func(kind string) time.Duration
+	// Options are sent with every call, e.g. azkustodata.Application to tag probe traffic.
+	Options []azkustodata.QueryOption
+	// MaxFailures stops Run once this many steps failed; the remaining steps are skipped. Zero
+	// runs every step.
+	MaxFailures int
+}
+
+// Result is the outcome of one step.
+type Result struct {
+	Step     string
+	Duration time.Duration
+	Message  string // what was checked, what went wrong, or why the step was skipped
+	Err      error
+	Class    classify.Class // the class of Err
+	Code     string         // the service's error code for Err, see classify.Code
+	Skipped  bool           // the step didn't run: it doesn't apply, or a dependency didn't pass
+}
+
+// OK reports whether the step passed.
+func (r Result) OK() bool { return r.Err == nil && !r.Skipped }
+
+// Run executes every step in order and returns one result per step. A step whose dependencies
+// didn't all pass is skipped rather than run, so a failure is reported once, by the step that
+// failed, instead of cascading into misleading failures further down.
+func Run(ctx context.Context, client *azkustodata.Client, cfg Config) []Result {
+	var results []Result
+	passed := map[string]bool{}
+	failed := 0
+	for _, step := range Steps {
+		var r Result
+		if cfg.MaxFailures > 0 && failed >= cfg.MaxFailures {
+			r = Result{Step: step.Name, Skipped: true, Message: fmt.Sprintf("stopped after %d failed step(s)", failed)}
+		} else if !step.Enabled(cfg) {
+			r = Result{Step: step.Name, Skipped: true, Message: "not enabled"}
+		} else if dep := firstUnpassed(step.DependsOn, passed); dep != "" {
+			r = Result{Step: step.Name, Skipped: true, Message: fmt.Sprintf("depends on %s, which did not pass", dep)}
+		} else {
+			r = RunStep(ctx, client, cfg, step.Name)
+		}
+		passed[step.Name] = r.OK()
+		if !r.OK() && !r.Skipped {
+			failed++
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func firstUnpassed(deps []string, passed map[string]bool) string {
+	for _, d := range deps {
+		if !passed[d] {
+			return d
+		}
+	}
+	return ""
+}
+
+// RunStep executes a single step.
+func RunStep(ctx context.Context, client *azkustodata.Client, cfg Config, step string) Result {
+	kind := "query"
+	switch step {
+	case StepMgmt:
+		kind = "mgmt"
+	case StepIngest:
+		kind = "ingest"
+	}
+	if cfg.Timeout != nil {
+		if d := cfg.Timeout(kind); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+	}
+
+	r := Result{Step: step}
+	start := time.Now()
+	switch step {
+	case StepMgmt:
+		_, r.Err = client.Mgmt(ctx, "", kql.New(".show version"), cfg.Options...)
+		r.Message = "cluster reachable"
+		if r.Err != nil {
+			r.Message = ".show version failed"
+		}
+	case StepDatabase:
+		_, r.Err = client.Query(ctx, cfg.Database, kql.New("print 1"), cfg.Options...)
+		r.Message = fmt.Sprintf("db ok: %s", cfg.Database)
+		if r.Err != nil {
+			r.Message = "basic query failed"
+		}
+	case StepDataSample:
+		q := (&kql.Builder{}).AddUnsafe(
+			fmt.Sprintf("%s | where Message == %s | take 1", cfg.SampleTable, kqlquote.String(cfg.ExpectMessage)),
+		)
+		var has bool
+		has, r.Err = HasAnyRow(ctx, client, cfg.Database, q, cfg.Options...)
+		switch {
+		case r.Err != nil && classify.IsTableNotFound(r.Err):
+			r.Message = fmt.Sprintf("sample table not found: %s", cfg.SampleTable)
+		case r.Err != nil && classify.IsPermission(r.Err):
+			r.Message = fmt.Sprintf("no access to sample table: %s", cfg.SampleTable)
+		case r.Err != nil:
+			r.Message = "query failed for sample table"
+		case !has:
+			r.Err = ErrSampleMissing
+			r.Message = fmt.Sprintf("expected row not found in %s (Message=='%s')", cfg.SampleTable, cfg.ExpectMessage)
+		default:
+			r.Message = fmt.Sprintf("sample table ok: %s contains expected data", cfg.SampleTable)
+		}
+	case StepIngest:
+		r.Err = ingest(ctx, client, cfg)
+		r.Message = fmt.Sprintf("ingested and read back a row in %s", cfg.IngestTable)
+		switch {
+		case r.Err != nil && classify.IsPermission(r.Err):
+			r.Message = fmt.Sprintf("no ingest access to %s", cfg.IngestTable)
+		case r.Err != nil:
+			r.Message = fmt.Sprintf("ingestion into %s failed", cfg.IngestTable)
+		}
+	default:
+		r.Err = fmt.Errorf("unknown probe step %q", step)
+	}
+	r.Duration = time.Since(start)
+	if r.Err != nil && !errors.Is(r.Err, ErrSampleMissing) {
+		r.Class = classify.Of(r.Err)
+		r.Code = classify.Code(r.Err)
+	}
+	return r
+}
+
+// ingest appends a row with a unique Message to cfg.IngestTable and checks that a query sees it.
+func ingest(ctx context.Context, client *azkustodata.Client, cfg Config) error {
+	if cfg.IngestTable == "" {
+		return errors.New("no ingest table configured")
+	}
+	table := kqlquote.Ident(cfg.IngestTable)
+	msg := kqlquote.String(fmt.Sprintf("probe-ingest-%d", time.Now().UnixNano()))
+	cmd := (&kql.Builder{}).AddUnsafe(fmt.Sprintf(".set-or-append %s <| print Message=%s, When=now()", table, msg))
+	if _, err := client.Mgmt(ctx, cfg.Database, cmd, cfg.Options...); err != nil {
+		return err
+	}
+	q := (&kql.Builder{}).AddUnsafe(fmt.Sprintf("%s | where Message == %s | take 1", table, msg))
+	has, err := HasAnyRow(ctx, client, cfg.Database, q, cfg.Options...)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return errors.New("ingested row not visible to queries")
+	}
+	return nil
+}
+
+// HasAnyRow runs a query and returns true if the primary result has at least one row.
+func HasAnyRow(ctx context.Context, client *azkustodata.Client, db string, q *kql.Builder, opts ...azkustodata.QueryOption) (bool, error) {
+	ds, err := client.IterativeQuery(ctx, db, q, opts...)
+	if err != nil {
+		return false, err
+	}
+	defer ds.Close()
+	tables := ds.Tables()
+	for tr := range tables {
+		if tr.Err() != nil {
+			return false, tr.Err()
+		}
+		t := tr.Table()
+		if t.Name() != "PrimaryResult" {
+			continue
+		}
+		for rr := range t.Rows() {
+			if rr.Err() != nil {
+				return false, rr.Err()
+			}
+			// Found at least one row
+			return true, nil
+		}
+	}
+	return false, nil
+}
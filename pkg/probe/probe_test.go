@@ -0,0 +1,143 @@
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+)
+
+// fakeCluster answers control commands (v1 REST) and queries (v2 frames) with the rows reply
+// returns for the text as one "Message" column; a false ok fails the call with a 400.
+func fakeCluster(t *testing.T, reply func(csl string) (rows []string, ok bool)) (*azkustodata.Client, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/rest/mgmt" && r.URL.Path != "/v2/rest/query" {
+			http.NotFound(w, r) // the cloud metadata: the public cloud
+			return
+		}
+		var req struct {
+			CSL string `json:"csl"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		calls = append(calls, req.CSL)
+		mu.Unlock()
+		rows, ok := reply(req.CSL)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":{"code":"BadRequest","message":"Request is invalid and cannot be executed.","@message":"fake: %s"}}`, req.CSL)
+			return
+		}
+		values := [][]string{}
+		for _, v := range rows {
+			values = append(values, []string{v})
+		}
+		data, _ := json.Marshal(values)
+		cols := `[{"ColumnName":"Message","ColumnType":"string"}]`
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/rest/mgmt" {
+			fmt.Fprintf(w, `{"Tables":[{"TableName":"Table_0","Columns":%s,"Rows":%s}]}`, cols, data)
+			return
+		}
+		fmt.Fprintf(w, "[%s\n,%s\n,%s\n,%s\n,%s\n,%s\n]\n",
+			`{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0","IsFragmented":true,"ErrorReportingPlacement":"EndOfTable"}`,
+			`{"FrameType":"DataTable","TableId":0,"TableKind":"QueryProperties","TableName":"@ExtendedProperties","Columns":[{"ColumnName":"TableId","ColumnType":"int"},{"ColumnName":"Key","ColumnType":"string"},{"ColumnName":"Value","ColumnType":"dynamic"}],"Rows":[]}`,
+			`{"FrameType":"TableHeader","TableId":1,"TableKind":"PrimaryResult","TableName":"PrimaryResult","Columns":`+cols+`}`,
+			`{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":1,"Rows":`+string(data)+`}`,
+			fmt.Sprintf(`{"FrameType":"TableCompletion","TableId":1,"RowCount":%d}`, len(rows)),
+			`{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}`)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := azkustodata.New(azkustodata.NewConnectionStringBuilder(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, &calls
+}
+
+func TestRun(t *testing.T) {
+	cfg := Config{Database: "Samples", SampleTable: "ProbeTest", ExpectMessage: "kusto-sample-ok", IngestTable: "ProbeIngest"}
+	tests := []struct {
+		name   string
+		fail   string // calls starting with this fail
+		empty  string // queries starting with this return no rows
+		ingest bool
+		max    int
+		want   []string // step: outcome, where the outcome is ok, failed or the reason for skipping
+	}{
+		{name: "all pass, ingest not enabled", want: []string{
+			"mgmt: ok", "database: ok", "data-sample: ok", "ingest: not enabled"}},
+		{name: "unreachable cluster", fail: ".show version", ingest: true, want: []string{
+			"mgmt: failed",
+			"database: depends on mgmt, which did not pass",
+			"data-sample: depends on database, which did not pass",
+			"ingest: depends on database, which did not pass"}},
+		// The sample row missing doesn't stop the ingest step, which only needs the database.
+		{name: "sample row missing", empty: "ProbeTest", ingest: true, want: []string{
+			"mgmt: ok", "database: ok", "data-sample: failed", "ingest: ok"}},
+		{name: "ingest refused", fail: ".set-or-append", ingest: true, want: []string{
+			"mgmt: ok", "database: ok", "data-sample: ok", "ingest: failed"}},
+		{name: "stop after the first failure", fail: "print 1", ingest: true, max: 1, want: []string{
+			"mgmt: ok", "database: failed",
+			"data-sample: stopped after 1 failed step(s)",
+			"ingest: stopped after 1 failed step(s)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, calls := fakeCluster(t, func(csl string) ([]string, bool) {
+				if tt.fail != "" && strings.HasPrefix(csl, tt.fail) {
+					return nil, false
+				}
+				if tt.empty != "" && strings.HasPrefix(csl, tt.empty) {
+					return nil, true
+				}
+				return []string{"kusto-sample-ok"}, true
+			})
+			cfg := cfg
+			cfg.Ingest, cfg.MaxFailures = tt.ingest, tt.max
+			var got []string
+			for _, r := range Run(context.Background(), client, cfg) {
+				outcome := "ok"
+				switch {
+				case r.Skipped:
+					outcome = r.Message
+				case !r.OK():
+					outcome = "failed"
+				}
+				got = append(got, r.Step+": "+outcome)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("results:\n%s\nwant:\n%s\ncalls: %q", strings.Join(got, "\n"), strings.Join(tt.want, "\n"), *calls)
+			}
+		})
+	}
+}
+
+func TestRunStep(t *testing.T) {
+	client, calls := fakeCluster(t, func(csl string) ([]string, bool) { return nil, true })
+	cfg := Config{Database: "Samples", SampleTable: "ProbeTest", ExpectMessage: "it's-ok"}
+	r := RunStep(context.Background(), client, cfg, StepDataSample)
+	if !errors.Is(r.Err, ErrSampleMissing) || r.Step != StepDataSample {
+		t.Errorf("data-sample without the row: %+v", r)
+	}
+	if want := `ProbeTest | where Message == "it\'s-ok" | take 1`; (*calls)[0] != want {
+		t.Errorf("sample query %s, want %s", (*calls)[0], want)
+	}
+	if r := RunStep(context.Background(), client, cfg, StepIngest); r.Err == nil || r.Err.Error() != "no ingest table configured" {
+		t.Errorf("ingest without a table: %v", r.Err)
+	}
+	if r := RunStep(context.Background(), client, cfg, "nope"); r.Err == nil {
+		t.Error("unknown step passed")
+	}
+}
@@ -0,0 +1,616 @@
+// Package rowexpr evaluates the small jq-style expressions --filter keeps rows with, over a row
+// as a map from column name to value (dynamic columns decoded into maps, slices and
+// json.Numbers).
+//
+//	.State == "TEXAS" and (.Payload.size > 1000 or not .Payload.cached)
+//	.Tags[0] != null and startswith(.Source, "edge-")
+//	.Timestamp >= "2024-03-01" and test(.Message, "time(d )?out")
+//
+// A path (.col, .col.key, .col[0], .["odd name"]) that doesn't exist is null. Comparisons
+// between values that can't be ordered, such as a string and a number, are false. Numbers of
+// any type compare exactly; datetimes compare with strings in RFC 3339 form (or a bare date),
+// timespans with Go duration strings (90s, 1h30m) and guids with their text. null and false are
+// false; every other value is true. The functions are contains(a, b) (substring, or array
+// element), startswith(s, prefix), endswith(s, suffix), test(s, regexp) and length(v).
+package rowexpr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Expr is a parsed expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses src.
+func Parse(src string) (*Expr, error) {
+	p := &parser{src: src}
+	n, err := p.or()
+	if err == nil {
+		p.space()
+		if p.pos < len(p.src) {
+			err = p.errorf("unexpected %q", p.rest(10))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src: src, root: n}, nil
+}
+
+func (e *Expr) String() string { return e.src }
+
+// Match reports whether the expression is true for row.
+func (e *Expr) Match(row map[string]interface{}) bool {
+	return truthy(e.root.eval(row))
+}
+
+// Path is a parsed path, such as .Payload.user.id or .Tags[0].
+type Path []step
+
+type step struct {
+	key   string
+	index int
+	isIdx bool
+}
+
+// ParsePath parses a path on its own.
+func ParsePath(src string) (Path, error) {
+	p := &parser{src: src}
+	path, err := p.path()
+	if err == nil && p.pos < len(p.src) {
+		err = p.errorf("unexpected %q", p.rest(10))
+	}
+	return path, err
+}
+
+// Lookup follows the path from v; ok is false if a step is missing.
+func (path Path) Lookup(v interface{}) (interface{}, bool) {
+	for _, s := range path {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if s.isIdx {
+				return nil, false
+			}
+			var ok bool
+			if v, ok = x[s.key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i := s.index
+			if i < 0 {
+				i += len(x)
+			}
+			if !s.isIdx || i < 0 || i >= len(x) {
+				return nil, false
+			}
+			v = x[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+type node interface {
+	eval(row map[string]interface{}) interface{}
+}
+
+type literal struct{ v interface{} }
+
+func (l literal) eval(map[string]interface{}) interface{} { return l.v }
+
+type pathNode struct{ path Path }
+
+func (p pathNode) eval(row map[string]interface{}) interface{} {
+	v, _ := p.path.Lookup(row)
+	return v
+}
+
+type notNode struct{ x node }
+
+func (n notNode) eval(row map[string]interface{}) interface{} { return !truthy(n.x.eval(row)) }
+
+type logicNode struct {
+	and  bool
+	l, r node
+}
+
+func (n logicNode) eval(row map[string]interface{}) interface{} {
+	if truthy(n.l.eval(row)) != n.and {
+		return !n.and
+	}
+	return truthy(n.r.eval(row))
+}
+
+type cmpNode struct {
+	op   string
+	l, r node
+}
+
+func (n cmpNode) eval(row map[string]interface{}) interface{} {
+	c, ok := compare(n.l.eval(row), n.r.eval(row))
+	switch n.op {
+	case "==":
+		return ok && c == 0
+	case "!=":
+		return !ok || c != 0
+	case "<":
+		return ok && c < 0
+	case "<=":
+		return ok && c <= 0
+	case ">":
+		return ok && c > 0
+	default:
+		return ok && c >= 0
+	}
+}
+
+type callNode struct {
+	name string
+	args []node
+	re   *regexp.Regexp // test
+}
+
+// functions maps each function to its number of arguments.
+var functions = map[string]int{"contains": 2, "startswith": 2, "endswith": 2, "test": 2, "length": 1}
+
+func (n callNode) eval(row map[string]interface{}) interface{} {
+	a := n.args[0].eval(row)
+	switch n.name {
+	case "length":
+		switch x := a.(type) {
+		case string:
+			return int64(utf8.RuneCountInString(x))
+		case []interface{}:
+			return int64(len(x))
+		case map[string]interface{}:
+			return int64(len(x))
+		}
+		return int64(0)
+	case "contains":
+		b := n.args[1].eval(row)
+		if list, ok := a.([]interface{}); ok {
+			for _, e := range list {
+				if c, ok := compare(e, b); ok && c == 0 {
+					return true
+				}
+			}
+			return false
+		}
+		s, ok1 := text(a)
+		sub, ok2 := text(b)
+		return ok1 && ok2 && strings.Contains(s, sub)
+	}
+	s, ok := text(a)
+	if !ok {
+		return false
+	}
+	if n.name == "test" {
+		return n.re.MatchString(s)
+	}
+	arg, ok := text(n.args[1].eval(row))
+	if !ok {
+		return false
+	}
+	if n.name == "startswith" {
+		return strings.HasPrefix(s, arg)
+	}
+	return strings.HasSuffix(s, arg)
+}
+
+func truthy(v interface{}) bool {
+	b, isBool := v.(bool)
+	return v != nil && (!isBool || b)
+}
+
+// text is the string form of a string or guid value.
+func text(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case uuid.UUID:
+		return x.String(), true
+	}
+	return "", false
+}
+
+// compare orders a and b; ok is false when they can't be compared.
+func compare(a, b interface{}) (c int, ok bool) {
+	if a == nil || b == nil {
+		return 0, a == nil && b == nil
+	}
+	if ra, fa, ok := number(a); ok {
+		rb, fb, ok := number(b)
+		if !ok {
+			return 0, false
+		}
+		if ra == nil || rb == nil {
+			if ra != nil {
+				fa, _ = ra.Float64()
+			}
+			if rb != nil {
+				fb, _ = rb.Float64()
+			}
+			if math.IsNaN(fa) || math.IsNaN(fb) {
+				return 0, false
+			}
+			return cmpOrdered(fa, fb), true
+		}
+		return ra.Cmp(rb), true
+	}
+	switch x := a.(type) {
+	case string:
+		switch y := b.(type) {
+		case string:
+			return strings.Compare(x, y), true
+		case time.Time, time.Duration, uuid.UUID:
+			c, ok := compare(b, a)
+			return -c, ok
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			return cmpOrdered(boolInt(x), boolInt(y)), true
+		}
+	case time.Time:
+		y, ok := b.(time.Time)
+		if s, isStr := b.(string); isStr {
+			y, ok = parseTime(s)
+		}
+		if ok {
+			return x.Compare(y), true
+		}
+	case time.Duration:
+		y, ok := b.(time.Duration)
+		if s, isStr := b.(string); isStr {
+			d, err := time.ParseDuration(s)
+			y, ok = d, err == nil
+		}
+		if ok {
+			return cmpOrdered(x, y), true
+		}
+	case uuid.UUID:
+		if y, ok := text(b); ok {
+			return strings.Compare(x.String(), strings.ToLower(y)), true
+		}
+	case map[string]interface{}, []interface{}:
+		switch b.(type) {
+		case map[string]interface{}, []interface{}:
+			// Arrays and objects are only equal or not; compare their JSON.
+			ja, erra := json.Marshal(a)
+			jb, errb := json.Marshal(b)
+			return 0, erra == nil && errb == nil && string(ja) == string(jb)
+		}
+	}
+	return 0, false
+}
+
+// number returns a numeric value as an exact rational, or as a float for NaN and infinities.
+func number(v interface{}) (*big.Rat, float64, bool) {
+	switch x := v.(type) {
+	case int32:
+		return new(big.Rat).SetInt64(int64(x)), 0, true
+	case int64:
+		return new(big.Rat).SetInt64(x), 0, true
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, x, true
+		}
+		return new(big.Rat).SetFloat64(x), 0, true
+	case decimal.Decimal:
+		return x.Rat(), 0, true
+	case json.Number:
+		if r, ok := new(big.Rat).SetString(string(x)); ok {
+			return r, 0, true
+		}
+	}
+	return nil, 0, false
+}
+
+func parseTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func cmpOrdered[T int | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parser is a recursive descent parser over the source text:
+//
+//	or      = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | compare
+//	compare = primary [ ("==" | "!=" | "<" | "<=" | ">" | ">=") primary ]
+//	primary = path | string | number | "true" | "false" | "null" | "(" or ")" | name "(" or { "," or } ")"
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) rest(n int) string {
+	if r := p.src[p.pos:]; len(r) < n {
+		return r
+	}
+	return p.src[p.pos:p.pos+n] + "..."
+}
+
+func (p *parser) space() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// keyword consumes word if it comes next as a whole word.
+func (p *parser) keyword(word string) bool {
+	p.space()
+	if !strings.HasPrefix(p.src[p.pos:], word) {
+		return false
+	}
+	if end := p.pos + len(word); end < len(p.src) && isIdent(p.src[end]) {
+		return false
+	}
+	p.pos += len(word)
+	return true
+}
+
+func (p *parser) or() (node, error) {
+	l, err := p.and()
+	for err == nil && p.keyword("or") {
+		var r node
+		if r, err = p.and(); err == nil {
+			l = logicNode{l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) and() (node, error) {
+	l, err := p.not()
+	for err == nil && p.keyword("and") {
+		var r node
+		if r, err = p.not(); err == nil {
+			l = logicNode{and: true, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) not() (node, error) {
+	if p.keyword("not") {
+		x, err := p.not()
+		return notNode{x}, err
+	}
+	return p.compare()
+}
+
+func (p *parser) compare() (node, error) {
+	l, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			p.pos += len(op)
+			r, err := p.primary()
+			return cmpNode{op: op, l: l, r: r}, err
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) primary() (node, error) {
+	p.space()
+	if p.pos == len(p.src) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '.':
+		path, err := p.path()
+		return pathNode{path}, err
+	case c == '"':
+		s, err := p.str()
+		return literal{s}, err
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		num := p.src[start:p.pos]
+		if _, ok := new(big.Rat).SetString(num); !ok {
+			p.pos = start
+			return nil, p.errorf("bad number %q", num)
+		}
+		return literal{json.Number(num)}, nil
+	case c == '(':
+		p.pos++
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.space(); p.pos == len(p.src) || p.src[p.pos] != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return x, nil
+	case isIdent(c):
+		start := p.pos
+		for p.pos < len(p.src) && isIdent(p.src[p.pos]) {
+			p.pos++
+		}
+		switch name := p.src[start:p.pos]; name {
+		case "true", "false":
+			return literal{name == "true"}, nil
+		case "null":
+			return literal{nil}, nil
+		default:
+			return p.call(start, name)
+		}
+	}
+	return nil, p.errorf("unexpected %q", p.rest(10))
+}
+
+func (p *parser) call(start int, name string) (node, error) {
+	arity, ok := functions[name]
+	if p.space(); !ok || p.pos == len(p.src) || p.src[p.pos] != '(' {
+		p.pos = start
+		return nil, p.errorf("unknown name %q (paths start with a dot, strings are double-quoted)", name)
+	}
+	p.pos++
+	n := callNode{name: name}
+	for {
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, arg)
+		p.space()
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if p.pos == len(p.src) || p.src[p.pos] != ')' {
+			return nil, p.errorf("expected , or )")
+		}
+		p.pos++
+		break
+	}
+	if len(n.args) != arity {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name, arity, len(n.args))
+	}
+	if name == "test" {
+		lit, ok := n.args[1].(literal)
+		pattern, isStr := lit.v.(string)
+		if !ok || !isStr {
+			return nil, fmt.Errorf("test: the pattern must be a string literal")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("test: %v", err)
+		}
+		n.re = re
+	}
+	return n, nil
+}
+
+// path parses a path, which starts with a dot.
+func (p *parser) path() (Path, error) {
+	if p.pos == len(p.src) || p.src[p.pos] != '.' {
+		return nil, p.errorf("expected a path starting with .")
+	}
+	path := Path{}
+	first := true
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '.':
+			p.pos++
+			if p.pos < len(p.src) && p.src[p.pos] == '"' {
+				key, err := p.str()
+				if err != nil {
+					return nil, err
+				}
+				path = append(path, step{key: key})
+			} else if p.pos < len(p.src) && isIdent(p.src[p.pos]) {
+				start := p.pos
+				for p.pos < len(p.src) && isIdent(p.src[p.pos]) {
+					p.pos++
+				}
+				path = append(path, step{key: p.src[start:p.pos]})
+			} else if !first || (p.pos < len(p.src) && p.src[p.pos] == '.') {
+				return nil, p.errorf("expected a name after .")
+			}
+		case '[':
+			p.pos++
+			p.space()
+			if p.pos < len(p.src) && p.src[p.pos] == '"' {
+				key, err := p.str()
+				if err != nil {
+					return nil, err
+				}
+				path = append(path, step{key: key})
+			} else {
+				start := p.pos
+				if p.pos < len(p.src) && p.src[p.pos] == '-' {
+					p.pos++
+				}
+				for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+					p.pos++
+				}
+				i, err := strconv.Atoi(p.src[start:p.pos])
+				if err != nil {
+					p.pos = start
+					return nil, p.errorf("expected an index or a quoted key in [ ]")
+				}
+				path = append(path, step{index: i, isIdx: true})
+			}
+			if p.space(); p.pos == len(p.src) || p.src[p.pos] != ']' {
+				return nil, p.errorf("expected ]")
+			}
+			p.pos++
+		default:
+			return path, nil
+		}
+		first = false
+	}
+	return path, nil
+}
+
+// str parses a double-quoted string with JSON escapes.
+func (p *parser) str() (string, error) {
+	start := p.pos
+	for i := p.pos + 1; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case '"':
+			var s string
+			if err := json.Unmarshal([]byte(p.src[start:i+1]), &s); err != nil {
+				return "", p.errorf("bad string: %v", err)
+			}
+			p.pos = i + 1
+			return s, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
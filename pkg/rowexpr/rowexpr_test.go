@@ -0,0 +1,64 @@
+package rowexpr
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestMatch(t *testing.T) {
+	row := map[string]interface{}{
+		"State":     "TEXAS",
+		"Count":     int64(9007199254740993),
+		"Ratio":     0.5,
+		"Amount":    decimal.RequireFromString("12.50"),
+		"When":      time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		"Took":      90 * time.Second,
+		"Odd name":  true,
+		"Payload":   map[string]interface{}{"size": json.Number("1200"), "tags": []interface{}{"edge", "hot"}, "cached": false},
+		"Message":   "request timed out",
+		"NullValue": nil,
+	}
+	for _, c := range []struct {
+		expr string
+		want bool
+	}{
+		{`.State == "TEXAS"`, true},
+		{`.State != "TEXAS"`, false},
+		{`.Count == 9007199254740993`, true},
+		{`.Count > 9007199254740992`, true},
+		{`.Ratio < 1 and .Amount == 12.5`, true},
+		{`.Payload.size > 1000 and not .Payload.cached`, true},
+		{`.Payload.tags[0] == "edge" and .Payload.tags[-1] == "hot"`, true},
+		{`.Payload.tags[5] == null and .Missing.deeper == null`, true},
+		{`contains(.Payload.tags, "hot") and length(.Payload.tags) == 2`, true},
+		{`.["Odd name"] and ."Odd name"`, true},
+		{`.When >= "2024-03-01" and .When < "2024-03-01T12:00:01Z"`, true},
+		{`.Took > "1m" and .Took <= "90s"`, true},
+		{`test(.Message, "time(d )?out") and startswith(.Message, "req") and endswith(.Message, "out")`, true},
+		{`.State > 3 or .State == 3`, false},
+		{`.NullValue`, false},
+		{`.NullValue != null`, false},
+		{`(.State == "OHIO" or .Count > 0) and .Payload`, true},
+		{`.Payload == .Payload and .Payload.tags != .Payload`, true},
+	} {
+		e, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := e.Match(row); got != c.want {
+			t.Errorf("%s = %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{``, `.State ==`, `State == "x"`, `.a..b`, `.a[x]`, `(.a`, `"open`, `length(.a, .b)`, `test(.a, "(")`, `test(.a, .b)`, `.a == 1 2`} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%s: parsed", expr)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// Package rowframe is the binary framing the daemon streams query results to thin clients in: a
+// frame describing each table, then a frame per row, so rows cross the socket once, in their Kusto
+// types, and only the client encodes them, in its --format. Re-encoding to JSON and back on
+// each side would cost more than the daemon's warm connection saves on a large result.
+//
+// A frame is a type byte, the payload's length as a uvarint, and the payload:
+//
+//	'Q'  request: the client's query, as JSON (see the daemon)
+//	'T'  table: name, kind, column count, then each column's name and type
+//	'R'  row: its index, then a cell per column
+//	'E'  end: the result is complete
+//	'X'  error: its text
+//
+// Strings are a uvarint length and their bytes. A cell is a byte, 0 for null and 1 for a value,
+// then the value in its column's type: bool a byte; int and long zigzag varints; real 8 bytes of
+// IEEE 754, little endian; datetime the zigzag varint seconds since the Unix epoch, then the
+// nanoseconds into that second as a uvarint, which covers Kusto's years 1 to 9999 where int64
+// nanoseconds stop at 1678 and 2262; timespan zigzag varint nanoseconds; guid its 16 bytes;
+// decimal, string and dynamic strings.
+package rowframe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// Frame types.
+const (
+	Request = 'Q'
+	Table   = 'T'
+	Row     = 'R'
+	End     = 'E'
+	Error   = 'X'
+)
+
+// maxFrame bounds a frame's payload, so a corrupt length can't make a reader allocate the
+// machine's memory.
+const maxFrame = 256 << 20
+
+// WriteFrame writes one frame.
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	head := binary.AppendUvarint([]byte{typ}, uint64(len(payload)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame reads one frame. The payload is only valid until the next call with buf, which it
+// reuses.
+func ReadFrame(r *bufio.Reader, buf []byte) (typ byte, payload []byte, err error) {
+	if typ, err = r.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, unexpected(err)
+	}
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes is over the %d byte limit", n, maxFrame)
+	}
+	if uint64(cap(buf)) < n {
+		buf = make([]byte, n)
+	}
+	payload = buf[:n]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, unexpected(err)
+	}
+	return typ, payload, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer is an encode.Encoder that writes a result as frames. End writes the end frame; a
+// result that failed is closed with Fail instead.
+type Writer struct {
+	bw  *bufio.Writer
+	buf []byte
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{bw: bufio.NewWriterSize(w, 64<<10)}
+}
+
+func (f *Writer) Begin(t *encode.Table) error {
+	b := appendString(appendString(f.buf[:0], t.Name), t.Kind)
+	b = binary.AppendUvarint(b, uint64(len(t.Columns)))
+	for _, c := range t.Columns {
+		b = appendString(appendString(b, c.Name()), string(c.Type()))
+	}
+	f.buf = b
+	if err := WriteFrame(f.bw, Table, b); err != nil {
+		return err
+	}
+	// The first rows of a table shouldn't wait for a full buffer.
+	return f.bw.Flush()
+}
+
+func (f *Writer) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	b := binary.AppendUvarint(f.buf[:0], uint64(index))
+	row := encode.RowAt(vals)
+	for i, c := range t.Columns {
+		var err error
+		if b, err = appendCell(b, row, i, c.Type()); err != nil {
+			return fmt.Errorf("column %s: %w", c.Name(), err)
+		}
+	}
+	f.buf = b
+	return WriteFrame(f.bw, Row, b)
+}
+
+func (f *Writer) End() error {
+	if err := WriteFrame(f.bw, End, nil); err != nil {
+		return err
+	}
+	return f.bw.Flush()
+}
+
+// Fail ends the result with an error frame.
+func (f *Writer) Fail(err error) error {
+	if werr := WriteFrame(f.bw, Error, []byte(err.Error())); werr != nil {
+		return werr
+	}
+	return f.bw.Flush()
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendCell(b []byte, r encode.Row, col int, typ types.Column) ([]byte, error) {
+	if r.Null(col) {
+		return append(b, 0), nil
+	}
+	b = append(b, 1)
+	switch typ {
+	case types.Bool:
+		v, _ := r.Bool(col)
+		if v {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case types.Int, types.Long:
+		v, _ := r.Long(col)
+		return binary.AppendVarint(b, v), nil
+	case types.Real:
+		v, _ := r.Real(col)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v)), nil
+	case types.DateTime:
+		v, _ := r.DateTime(col)
+		return binary.AppendUvarint(binary.AppendVarint(b, v.Unix()), uint64(v.Nanosecond())), nil
+	case types.Timespan:
+		v, _ := r.Timespan(col)
+		return binary.AppendVarint(b, int64(v)), nil
+	case types.GUID:
+		v, _ := r.GUID(col)
+		return append(b, v[:]...), nil
+	case types.Decimal:
+		v, _ := r.Decimal(col)
+		return appendString(b, v.String()), nil
+	case types.String:
+		v, _ := r.String(col)
+		return appendString(b, v), nil
+	case types.Dynamic:
+		v, _ := r.Dynamic(col)
+		return appendString(b, string(v)), nil
+	}
+	return nil, fmt.Errorf("type %s has no frame encoding", typ)
+}
+
+// RemoteError is the error an error frame carries.
+type RemoteError struct{ Text string }
+
+func (e *RemoteError) Error() string { return e.Text }
+
+// Copy reads the frames of a result from r and replays them into enc, up to and including the
+// end frame, and returns the number of rows. An error frame is returned as a *RemoteError.
+func Copy(r *bufio.Reader, enc encode.Encoder) (int64, error) {
+	var rows int64
+	var t *encode.Table
+	var buf []byte
+	for {
+		typ, payload, err := ReadFrame(r, buf)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return rows, fmt.Errorf("reading the result: %w", err)
+		}
+		buf = payload[:0]
+		d := decoder{b: payload}
+		switch typ {
+		case Table:
+			t = &encode.Table{Name: d.string(), Kind: d.string()}
+			n := d.uvarint()
+			for i := 0; i < int(n) && d.err == nil; i++ {
+				t.Columns = append(t.Columns, query.NewColumn(i, d.string(), types.Column(d.string())))
+			}
+			if d.err != nil {
+				return rows, fmt.Errorf("table frame: %w", d.err)
+			}
+			if err := enc.Begin(t); err != nil {
+				return rows, err
+			}
+		case Row:
+			if t == nil {
+				return rows, errors.New("row frame before any table frame")
+			}
+			index := int(d.uvarint())
+			vals := make(value.Values, len(t.Columns))
+			for i, c := range t.Columns {
+				vals[i] = d.cell(c.Type())
+			}
+			if d.err != nil {
+				return rows, fmt.Errorf("row frame %d: %w", index, d.err)
+			}
+			if err := enc.WriteRow(t, index, vals); err != nil {
+				return rows, err
+			}
+			rows++
+		case End:
+			return rows, enc.End()
+		case Error:
+			return rows, &RemoteError{Text: string(payload)}
+		default:
+			return rows, fmt.Errorf("unknown frame type %q", typ)
+		}
+	}
+}
+
+// decoder reads the fields of a payload, keeping the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+var errShort = errors.New("payload ends early")
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if uint64(len(d.b)) < n {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string { return string(d.bytes(d.uvarint())) }
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errShort
+	}
+	d.b = nil
+}
+
+func (d *decoder) cell(typ types.Column) value.Kusto {
+	flag := d.bytes(1)
+	null := flag == nil || flag[0] == 0
+	switch typ {
+	case types.Bool:
+		if null {
+			return value.NewNullBool()
+		}
+		v := d.bytes(1)
+		return value.NewBool(v != nil && v[0] == 1)
+	case types.Int:
+		if null {
+			return value.NewNullInt()
+		}
+		return value.NewInt(int32(d.varint()))
+	case types.Long:
+		if null {
+			return value.NewNullLong()
+		}
+		return value.NewLong(d.varint())
+	case types.Real:
+		if null {
+			return value.NewNullReal()
+		}
+		var bits uint64
+		if v := d.bytes(8); v != nil {
+			bits = binary.LittleEndian.Uint64(v)
+		}
+		return value.NewReal(math.Float64frombits(bits))
+	case types.DateTime:
+		if null {
+			return value.NewNullDateTime()
+		}
+		sec := d.varint()
+		return value.NewDateTime(time.Unix(sec, int64(d.uvarint())).UTC())
+	case types.Timespan:
+		if null {
+			return value.NewNullTimespan()
+		}
+		return value.NewTimespan(time.Duration(d.varint()))
+	case types.GUID:
+		if null {
+			return value.NewNullGUID()
+		}
+		var g uuid.UUID
+		copy(g[:], d.bytes(16))
+		return value.NewGUID(g)
+	case types.Decimal:
+		if null {
+			return value.NewNullDecimal()
+		}
+		v, err := decimal.NewFromString(d.string())
+		if err != nil && d.err == nil {
+			d.err = err
+		}
+		return value.NewDecimal(v)
+	case types.String:
+		if null {
+			return value.NewString("")
+		}
+		return value.NewString(d.string())
+	case types.Dynamic:
+		if null {
+			return value.NewNullDynamic()
+		}
+		return value.NewDynamic([]byte(d.string()))
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("type %s has no frame encoding", typ)
+	}
+	return nil
+}
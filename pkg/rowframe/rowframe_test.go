@@ -0,0 +1,137 @@
+package rowframe_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/rowframe"
+)
+
+func allTypes() (*encode.Table, []value.Values) {
+	names := []string{"B", "I", "L", "R", "D", "S", "T", "TS", "G", "Dyn"}
+	typs := []types.Column{types.Bool, types.Int, types.Long, types.Real, types.Decimal, types.String, types.DateTime, types.Timespan, types.GUID, types.Dynamic}
+	t := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult"}
+	for i, n := range names {
+		t.Columns = append(t.Columns, query.NewColumn(i, n, typs[i]))
+	}
+	rows := []value.Values{
+		{value.NewBool(true), value.NewInt(-42), value.NewLong(9007199254740993), value.NewReal(2.5),
+			value.NewDecimal(decimal.RequireFromString("0.1000000000000000000001")), value.NewString("say \"hi\"\n"),
+			value.NewDateTime(time.Date(2024, 2, 29, 23, 59, 59, 123456700, time.UTC)), value.NewTimespan(-26*time.Hour - 1500*time.Millisecond),
+			value.NewGUID(uuid.MustParse("6f1d2a4e-9c3b-4f7a-8e2d-1b5c6a7d8e9f")), value.NewDynamic([]byte(`{"a":[1,2]}`))},
+		{value.NewNullBool(), value.NewNullInt(), value.NewNullLong(), value.NewNullReal(), value.NewNullDecimal(), value.NewString(""),
+			value.NewNullDateTime(), value.NewNullTimespan(), value.NewNullGUID(), value.NewNullDynamic()},
+	}
+	// Kusto's first and last datetimes, outside what int64 nanoseconds since 1970 can hold.
+	for _, dt := range []time.Time{time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(9999, 12, 31, 23, 59, 59, 999999900, time.UTC)} {
+		row := append(value.Values(nil), rows[1]...)
+		row[6] = value.NewDateTime(dt)
+		rows = append(rows, row)
+	}
+	return t, rows
+}
+
+// plain is the rows as their plain values, with their Go types, which keeps every value and type
+// distinct.
+func plain(rows []value.Values) string {
+	var b strings.Builder
+	for _, r := range rows {
+		for _, v := range r {
+			x := encode.PlainValue(v)
+			fmt.Fprintf(&b, "%T %v\n", x, x)
+		}
+	}
+	return b.String()
+}
+
+// collect keeps the rows written to it.
+type collect struct {
+	tables []*encode.Table
+	rows   []value.Values
+}
+
+func (c *collect) Begin(t *encode.Table) error { c.tables = append(c.tables, t); return nil }
+
+func (c *collect) WriteRow(_ *encode.Table, _ int, vals value.Values) error {
+	c.rows = append(c.rows, vals)
+	return nil
+}
+
+func (c *collect) End() error { return nil }
+
+func TestRoundTrip(t *testing.T) {
+	tbl, rows := allTypes()
+	var frames bytes.Buffer
+	w := rowframe.NewWriter(&frames)
+	w.Begin(tbl)
+	for i, r := range rows {
+		if err := w.WriteRow(tbl, i, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got collect
+	n, err := rowframe.Copy(bufio.NewReader(&frames), &got)
+	if err != nil || n != int64(len(rows)) {
+		t.Fatalf("%d rows: %v", n, err)
+	}
+	if len(got.tables) != 1 || got.tables[0].Name != tbl.Name || got.tables[0].Kind != tbl.Kind {
+		t.Errorf("tables: %+v", got.tables)
+	}
+	for i, c := range got.tables[0].Columns {
+		if c.Name() != tbl.Columns[i].Name() || c.Type() != tbl.Columns[i].Type() {
+			t.Errorf("column %d: %s %s", i, c.Name(), c.Type())
+		}
+	}
+	if g, want := plain(got.rows), plain(rows); g != want {
+		t.Errorf("got\n%s\nwant\n%s", g, want)
+	}
+}
+
+func TestCopyErrors(t *testing.T) {
+	tbl, rows := allTypes()
+	var frames bytes.Buffer
+	w := rowframe.NewWriter(&frames)
+	w.Begin(tbl)
+	w.WriteRow(tbl, 0, rows[0])
+	w.Fail(errors.New("Query execution has exceeded the allowed limits"))
+	enc, _ := encode.New("ndjson", io.Discard, encode.Options{})
+	var remote *rowframe.RemoteError
+	if n, err := rowframe.Copy(bufio.NewReader(bytes.NewReader(frames.Bytes())), enc); n != 1 || !errors.As(err, &remote) || !strings.Contains(remote.Text, "limits") {
+		t.Errorf("%d rows: %v", n, err)
+	}
+
+	// A connection that drops mid-result, and a frame that doesn't parse.
+	cut := frames.Bytes()[:frames.Len()-20]
+	if _, err := rowframe.Copy(bufio.NewReader(bytes.NewReader(cut)), enc); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("cut short: %v", err)
+	}
+	var bad bytes.Buffer
+	rowframe.WriteFrame(&bad, rowframe.Row, []byte{0})
+	if _, err := rowframe.Copy(bufio.NewReader(&bad), enc); err == nil || !strings.Contains(err.Error(), "before any table") {
+		t.Errorf("row without a table: %v", err)
+	}
+	bad.Reset()
+	w = rowframe.NewWriter(&bad)
+	w.Begin(tbl)
+	rowframe.WriteFrame(&bad, rowframe.Row, []byte{0, 1})
+	if _, err := rowframe.Copy(bufio.NewReader(&bad), enc); err == nil || !strings.Contains(err.Error(), "ends early") {
+		t.Errorf("short row: %v", err)
+	}
+}
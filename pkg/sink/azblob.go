@@ -0,0 +1,341 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// azureBlobVersion is the Blob service REST API version requests are made with.
+const azureBlobVersion = "2021-08-06"
+
+// azureBlobClient talks to one Azure Storage account's blob service. It implements Store for
+// --out https://<account>.blob.core.windows.net/<container>/<object-or-prefix/>, with keys that
+// start with the container. Create streams an object as a block blob, staging block-size bytes
+// per block (default 8MiB) and committing the block list on Close, so nothing is visible before
+// then; results smaller than one block are sent with a single Put Blob. The blocks of a failed
+// run are never committed, and the service discards them after a week.
+//
+// Options (--sink-opt):
+//
+//	sas=<token>               a container or account SAS (default AZURE_STORAGE_SAS_TOKEN)
+//	block-size=<bytes>
+//
+// Without a SAS, requests are signed with AZURE_STORAGE_KEY (Shared Key) if it is set, or carry
+// a DefaultAzureCredential token, which needs Storage Blob Data Contributor.
+type azureBlobClient struct {
+	account   string
+	base      string // https://<account>.blob.core.windows.net
+	sas       string
+	key       []byte
+	cred      azcore.TokenCredential
+	blockSize int
+	timeout   time.Duration
+	retries   int
+	client    *http.Client
+}
+
+func newAzureBlobClient(cfg *Config, host string) (Store, error) {
+	if !strings.HasSuffix(host, ".blob.core.windows.net") && !strings.HasSuffix(host, ".dfs.core.windows.net") {
+		return nil, fmt.Errorf("https://%s: only Azure Blob Storage URLs (https://<account>.blob.core.windows.net/<container>/...) are object URLs", host)
+	}
+	host = strings.Replace(host, ".dfs.", ".blob.", 1)
+	c := &azureBlobClient{
+		account: strings.Split(host, ".")[0],
+		base:    "https://" + host,
+		sas:     strings.TrimPrefix(cfg.Opt("sas", os.Getenv("AZURE_STORAGE_SAS_TOKEN")), "?"),
+		client:  &http.Client{},
+	}
+	var err error
+	if c.blockSize, err = cfg.intOpt("block-size", 8<<20); err != nil {
+		return nil, err
+	}
+	if c.blockSize <= 0 || c.blockSize > 4000<<20 {
+		return nil, fmt.Errorf("block-size must be between 1 byte and 4000MiB")
+	}
+	if c.timeout, err = cfg.durationOpt("timeout", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if c.retries, err = cfg.intOpt("retries", 5); err != nil {
+		return nil, err
+	}
+	if c.sas != "" {
+		return c, nil
+	}
+	if k := os.Getenv("AZURE_STORAGE_KEY"); k != "" {
+		if c.key, err = base64.StdEncoding.DecodeString(k); err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY is not base64: %v", err)
+		}
+		return c, nil
+	}
+	if c.cred, err = azidentity.NewDefaultAzureCredential(nil); err != nil {
+		return nil, fmt.Errorf("azure blob: %v (or set AZURE_STORAGE_KEY, or a SAS with --sink-opt sas=)", err)
+	}
+	return c, nil
+}
+
+func (c *azureBlobClient) Create(key, format string) (Upload, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, err
+	}
+	return &azureBlobUpload{azureBlobClient: c, key: key, ctype: FormatContentType(format)}, nil
+}
+
+func (c *azureBlobClient) List(prefix string) ([]string, error) {
+	container, blobPrefix, _ := strings.Cut(prefix, "/")
+	if container == "" {
+		return nil, fmt.Errorf("azure blob: list %s: no container", c.URL(prefix))
+	}
+	var keys []string
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {blobPrefix}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		raw, _, err := c.request(http.MethodGet, container, q, nil, nil)
+		var he *httpError
+		if errors.As(err, &he) && he.Status == http.StatusNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("azure blob: list %s: %w", c.URL(prefix), err)
+		}
+		var page struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		if err := xml.Unmarshal(raw, &page); err != nil {
+			return nil, fmt.Errorf("azure blob: list %s: %v", c.URL(prefix), err)
+		}
+		for _, b := range page.Blobs {
+			keys = append(keys, container+"/"+b.Name)
+		}
+		if page.NextMarker == "" {
+			return keys, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func (c *azureBlobClient) Get(key string) ([]byte, error) {
+	data, _, err := c.request(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("azure blob: get %s: %w", c.URL(key), err)
+	}
+	return data, nil
+}
+
+// PutIfAbsent uses a conditional Put Blob (If-None-Match: *), which the service answers with
+// 409 BlobAlreadyExists when the blob exists.
+func (c *azureBlobClient) PutIfAbsent(key string, data []byte) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	_, _, err := c.request(http.MethodPut, key, nil, data, map[string]string{
+		"x-ms-blob-type": "BlockBlob", "Content-Type": "application/json", "If-None-Match": "*"})
+	var he *httpError
+	if errors.As(err, &he) && (he.Status == http.StatusConflict || he.Status == http.StatusPreconditionFailed) {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("azure blob: put %s: %w", c.URL(key), err)
+	}
+	return nil
+}
+
+// URL is the blob's URL, without the SAS.
+func (c *azureBlobClient) URL(key string) string {
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return c.base + "/" + strings.Join(segs, "/")
+}
+
+// checkBlobKey rejects a key that names no blob inside a container.
+func checkBlobKey(key string) error {
+	if container, name, _ := strings.Cut(key, "/"); container == "" || name == "" {
+		return fmt.Errorf("azure blob: %q: expected <container>/<blob>", key)
+	}
+	return nil
+}
+
+// request sends an authorized request with retries and returns the body and headers of a 2xx
+// answer.
+func (c *azureBlobClient) request(method, key string, query url.Values, body []byte, headers map[string]string) ([]byte, http.Header, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var out []byte
+	var header http.Header
+	err := retrySend(ctx, c.retries, func() error {
+		u := c.URL(key)
+		q := query.Encode()
+		if c.sas != "" {
+			q = strings.TrimPrefix(q+"&"+c.sas, "&")
+		}
+		if q != "" {
+			u += "?" + q
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set("x-ms-version", azureBlobVersion)
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		switch {
+		case c.sas != "":
+		case c.key != nil:
+			req.Header.Set("Authorization", "SharedKey "+c.account+":"+azureSharedKey(req, c.account, c.key))
+		default:
+			tok, err := c.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://storage.azure.com/.default"}})
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+tok.Token)
+		}
+		resp, err := httpDo(c.client, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return httpStatusError(resp)
+		}
+		header = resp.Header
+		out, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return out, header, err
+}
+
+// azureSharedKey signs a request with the account key, the Shared Key scheme of the storage
+// services: the verb, the standard headers, the x-ms- headers and the resource with its query
+// parameters, one per line.
+func azureSharedKey(req *http.Request, account string, key []byte) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	lines := []string{req.Method}
+	for _, h := range []string{"Content-Encoding", "Content-Language", "", "Content-MD5", "Content-Type", "Date",
+		"If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		if h == "" {
+			lines = append(lines, length)
+			continue
+		}
+		lines = append(lines, req.Header.Get(h))
+	}
+	var names []string
+	for name := range req.Header {
+		if n := strings.ToLower(name); strings.HasPrefix(n, "x-ms-") {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		lines = append(lines, n+":"+strings.TrimSpace(req.Header.Get(n)))
+	}
+	resource := "/" + account + req.URL.EscapedPath()
+	q := req.URL.Query()
+	params := make([]string, 0, len(q))
+	for p := range q {
+		params = append(params, p)
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		vals := append([]string(nil), q[p]...)
+		sort.Strings(vals)
+		resource += "\n" + strings.ToLower(p) + ":" + strings.Join(vals, ",")
+	}
+	lines = append(lines, resource)
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(strings.Join(lines, "\n")))
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+// azureBlobUpload is one blob being written, staged as blocks once it outgrows one.
+type azureBlobUpload struct {
+	*azureBlobClient
+	key   string
+	ctype string
+
+	blocks []string
+	buf    []byte
+	size   int64
+}
+
+func (u *azureBlobUpload) URL() string { return u.azureBlobClient.URL(u.key) }
+
+func (u *azureBlobUpload) Size() int64 { return u.size }
+
+func (u *azureBlobUpload) Write(p []byte) (int, error) {
+	u.buf = append(u.buf, p...)
+	u.size += int64(len(p))
+	for len(u.buf) >= u.blockSize {
+		if err := u.putBlock(u.buf[:u.blockSize]); err != nil {
+			return 0, err
+		}
+		u.buf = append(u.buf[:0], u.buf[u.blockSize:]...)
+	}
+	return len(p), nil
+}
+
+func (u *azureBlobUpload) Close() error {
+	if len(u.blocks) == 0 {
+		// Everything fit in one block: Put Blob is one request instead of two.
+		if _, _, err := u.request(http.MethodPut, u.key, nil, u.buf, map[string]string{"x-ms-blob-type": "BlockBlob", "Content-Type": u.ctype}); err != nil {
+			return fmt.Errorf("azure blob: put %s: %w", u.URL(), err)
+		}
+		return nil
+	}
+	if len(u.buf) > 0 {
+		if err := u.putBlock(u.buf); err != nil {
+			return err
+		}
+		u.buf = nil
+	}
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range u.blocks {
+		body.WriteString("<Latest>" + id + "</Latest>")
+	}
+	body.WriteString("</BlockList>")
+	if _, _, err := u.request(http.MethodPut, u.key, url.Values{"comp": {"blocklist"}}, body.Bytes(), map[string]string{"x-ms-blob-content-type": u.ctype}); err != nil {
+		return fmt.Errorf("azure blob: commit %s: %w", u.URL(), err)
+	}
+	return nil
+}
+
+func (u *azureBlobUpload) putBlock(data []byte) error {
+	// Block ids of one blob must all be the same length.
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(u.blocks))))
+	if _, _, err := u.request(http.MethodPut, u.key, url.Values{"comp": {"block"}, "blockid": {id}}, data, nil); err != nil {
+		return fmt.Errorf("azure blob: put block %d of %s: %w", len(u.blocks), u.URL(), err)
+	}
+	u.blocks = append(u.blocks, id)
+	return nil
+}
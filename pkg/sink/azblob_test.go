@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBlobService stores block blobs: Put Blob, Put Block and Put Block List, Get Blob and
+// List Blobs, for SAS-authorized requests.
+type fakeBlobService struct {
+	mu     sync.Mutex
+	blobs  map[string]string
+	blocks map[string]string
+	puts   int
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := r.URL.Query()
+	if q.Get("sig") != "s" || r.Header.Get("x-ms-version") == "" {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case q.Get("comp") == "list":
+		var names []string
+		for n := range f.blobs {
+			if strings.HasPrefix(n, name+"/"+q.Get("prefix")) {
+				names = append(names, strings.TrimPrefix(n, name+"/"))
+			}
+		}
+		sort.Strings(names)
+		io.WriteString(w, "<EnumerationResults><Blobs>")
+		for _, n := range names {
+			io.WriteString(w, "<Blob><Name>"+n+"</Name></Blob>")
+		}
+		io.WriteString(w, "</Blobs><NextMarker/></EnumerationResults>")
+	case q.Get("comp") == "block":
+		f.blocks[q.Get("blockid")] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case q.Get("comp") == "blocklist":
+		var data strings.Builder
+		for _, part := range strings.Split(string(body), "<Latest>")[1:] {
+			id, _, _ := strings.Cut(part, "</Latest>")
+			data.WriteString(f.blocks[id])
+		}
+		f.blobs[name] = data.String()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if _, ok := f.blobs[name]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.Header().Set("x-ms-error-code", "BlobAlreadyExists")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.puts++
+		f.blobs[name] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet:
+		data, ok := f.blobs[name]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, data)
+	}
+}
+
+func TestAzureBlobClient(t *testing.T) {
+	svc := &fakeBlobService{blobs: map[string]string{}, blocks: map[string]string{}}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	c := &azureBlobClient{account: "acct", base: srv.URL, sas: "sig=s", blockSize: 4, timeout: time.Minute, retries: 1, client: srv.Client()}
+
+	u, _ := c.Create("exports/storms/a b.csv", "csv")
+	io.WriteString(u, "0123456789")
+	if len(svc.blobs) != 0 {
+		t.Error("the blob is visible before Close")
+	}
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.blobs["exports/storms/a b.csv"]; got != "0123456789" || len(svc.blocks) != 3 {
+		t.Errorf("blob %q from %d blocks, want 0123456789 from 3", got, len(svc.blocks))
+	}
+
+	u, _ = c.Create("exports/small.csv", "csv")
+	io.WriteString(u, "abc")
+	if err := u.Close(); err != nil || svc.puts != 1 {
+		t.Errorf("a blob under one block: %v, %d Put Blob", err, svc.puts)
+	}
+
+	if err := c.PutIfAbsent("exports/_log/1.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutIfAbsent("exports/_log/1.json", []byte("{}")); err != ErrExists {
+		t.Errorf("second PutIfAbsent: %v, want ErrExists", err)
+	}
+	keys, err := c.List("exports/storms/")
+	if err != nil || len(keys) != 1 || keys[0] != "exports/storms/a b.csv" {
+		t.Errorf("List = %q, %v", keys, err)
+	}
+	if data, err := c.Get("exports/small.csv"); err != nil || string(data) != "abc" {
+		t.Errorf("Get = %q, %v", data, err)
+	}
+	if _, err := c.Get("exports/missing"); !notFound(err) {
+		t.Errorf("Get of a missing blob: %v, want not found", err)
+	}
+	if _, _, err := OpenStore(&Config{Opts: Opts{"sas": "sig=s"}}, "https://example.com/x", false); err == nil {
+		t.Error("a non-blob https URL was accepted")
+	}
+}
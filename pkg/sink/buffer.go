@@ -0,0 +1,178 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// diskQueue is the on-disk buffer --sink-opt buffer=<dir> puts between the query and a slow
+// sink. Rows are appended to a spool file and a sender goroutine reads them back and sends them
+// at the sink's pace, so the query ends, and the cluster releases it, as fast as the disk takes
+// the rows instead of as fast as the sink does. Options:
+//
+//	buffer=<dir>           where the spool file goes; it is removed once drained
+//	buffer-max-bytes=<n>   unsent bytes the spool holds before the query waits (default 1GiB)
+//	buffer-report=<d>      how often the queue depth is printed on stderr (default 10s, 0 never)
+type diskQueue struct {
+	f   *os.File
+	max int64
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	written, read int64 // spool offsets: appended so far, and read back by the sender
+	queued, peak  int   // rows appended but not read back yet, and the most there were
+	closed        bool  // no more rows will be appended
+	err           error // why the sender stopped; it fails the run
+	done          chan struct{}
+}
+
+// spooledRow is a row's line in the spool file.
+type spooledRow struct {
+	Table string          `json:"t"`
+	Index int             `json:"i"`
+	Row   json.RawMessage `json:"r"`
+}
+
+func newDiskQueue(dir string, max int64) (*diskQueue, error) {
+	f, err := os.CreateTemp(dir, "sink-buffer-*.ndjson")
+	if err != nil {
+		return nil, fmt.Errorf("buffer: %w", err)
+	}
+	q := &diskQueue{f: f, max: max, done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+// push appends a row, waiting while the spool holds max unsent bytes.
+func (q *diskQueue) push(table string, index int, body []byte) error {
+	line, err := json.Marshal(spooledRow{Table: table, Index: index, Row: body})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.err == nil && q.written > q.read && q.written-q.read+int64(len(line)) > q.max {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return q.err
+	}
+	if _, err := q.f.WriteAt(line, q.written); err != nil {
+		return fmt.Errorf("buffer: %w", err)
+	}
+	q.written += int64(len(line))
+	if q.queued++; q.queued > q.peak {
+		q.peak = q.queued
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// drain reads the rows back in order and hands them to send until the queue is closed and
+// empty, or send fails. Once everything appended has been read, the spool is truncated.
+func (q *diskQueue) drain(send func(spooledRow) error) {
+	defer close(q.done)
+	buf := make([]byte, 1<<20)
+	for {
+		q.mu.Lock()
+		for q.read == q.written && !q.closed && q.err == nil {
+			q.cond.Wait()
+		}
+		start, end, stopped := q.read, q.written, q.err != nil
+		q.mu.Unlock()
+		if start == end || stopped {
+			return
+		}
+		if end-start > int64(len(buf)) {
+			end = start + int64(len(buf))
+		}
+		chunk := buf[:end-start]
+		if _, err := q.f.ReadAt(chunk, start); err != nil {
+			q.fail(fmt.Errorf("buffer: %w", err))
+			return
+		}
+		n := bytes.LastIndexByte(chunk, '\n') + 1
+		if n == 0 {
+			buf = make([]byte, 2*len(buf)) // a row longer than the buffer
+			continue
+		}
+		rows := 0
+		for _, line := range bytes.SplitAfter(chunk[:n], []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var r spooledRow
+			if err := json.Unmarshal(line, &r); err != nil {
+				q.fail(fmt.Errorf("buffer: %w", err))
+				return
+			}
+			if err := send(r); err != nil {
+				q.fail(err)
+				return
+			}
+			rows++
+		}
+		q.mu.Lock()
+		q.read += int64(n)
+		q.queued -= rows
+		if q.read == q.written {
+			q.f.Truncate(0)
+			q.read, q.written = 0, 0
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+func (q *diskQueue) fail(err error) {
+	q.mu.Lock()
+	if q.err == nil {
+		q.err = err
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// close waits for the sender to finish the queue, removes the spool and returns the sender's
+// error, if any.
+func (q *diskQueue) close() error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	<-q.done
+	q.f.Close()
+	os.Remove(q.f.Name())
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// discard drops the rows not sent yet and removes the spool.
+func (q *diskQueue) discard() {
+	q.fail(errors.New("buffer discarded"))
+	q.close()
+}
+
+// report prints the queue depth every interval until the queue is done.
+func (q *diskQueue) report(name string, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-t.C:
+			q.mu.Lock()
+			rows, size := q.queued, q.written-q.read
+			q.mu.Unlock()
+			fmt.Fprintf(os.Stderr, "SINK %s buffer: %d rows (%d bytes) queued\n", name, rows, size)
+		}
+	}
+}
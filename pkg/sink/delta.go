@@ -0,0 +1,347 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/encode/parquet"
+)
+
+// deltaSink appends the primary result to a Delta Lake table: the rows are written as one
+// Parquet data file next to the table's other files, then an add action is committed to
+// _delta_log as the next version. --out is the table location: a local directory (or file://),
+// gs://bucket/path or s3://bucket/path. A table that does not exist yet is created with the
+// result's schema; an existing table must have exactly the result's columns and types.
+//
+// Commits use put-if-absent on the version file, so concurrent appends (from other runs or
+// Spark) never overwrite each other; on a conflict the log is re-read and the next version is
+// tried. Tables needing a writer protocol above 2 (column mapping, deletion vectors, ...) are
+// refused rather than risk writing files their readers would misinterpret.
+//
+// Options (--sink-opt):
+//
+//	compression=gzip|none     Parquet page compression (default gzip)
+//	row-group-rows=<n>        rows per Parquet row group (default 100000)
+//
+// Timespans are stored as long nanoseconds; decimals, guids and dynamic values as strings.
+type deltaSink struct {
+	out          string
+	store        Store
+	prefix       string // table location inside the store, "" or ending in '/'
+	codec        int32
+	rowGroupRows int
+
+	table  *encode.Table
+	schema []deltaField
+	log    *deltaLog
+	name   string
+	upload Upload
+	file   *parquet.File
+	rows   int64
+}
+
+type deltaField struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Nullable bool              `json:"nullable"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// deltaLog is what an append needs to know about the table's current state.
+type deltaLog struct {
+	version  int64        // latest committed version, -1 for a new table
+	schema   []deltaField // from the latest metaData action, nil if only checkpoints remain
+	protocol int          // minWriterVersion
+}
+
+const deltaMaxCommitAttempts = 10
+
+func newDeltaSink(cfg *Config) (encode.Encoder, error) {
+	if cfg.Out == "" {
+		return nil, fmt.Errorf("--out must be the table location (a directory, gs://bucket/path or s3://bucket/path)")
+	}
+	store, key, err := OpenStore(cfg, cfg.Out, true)
+	if err != nil {
+		return nil, fmt.Errorf("--out %w", err)
+	}
+	d := &deltaSink{out: cfg.Out, store: store, prefix: strings.TrimSuffix(key, "/")}
+	if d.prefix != "" {
+		d.prefix += "/"
+	}
+	if d.codec, err = parquet.Codec(cfg.Opt("compression", "gzip")); err != nil {
+		return nil, err
+	}
+	if d.rowGroupRows, err = cfg.intOpt("row-group-rows", 100000); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *deltaSink) Begin(t *encode.Table) error {
+	if t.Kind != "PrimaryResult" {
+		return nil
+	}
+	if d.table != nil {
+		fmt.Fprintf(os.Stderr, "WARN delta: skipping table %s; only the first primary result is appended\n", t.Name)
+		return nil
+	}
+	d.table = t
+	for _, c := range t.Columns {
+		d.schema = append(d.schema, deltaFieldFor(c.Name(), c.Type()))
+	}
+	// Check the table before uploading anything, so a mismatch fails fast.
+	var err error
+	if d.log, err = d.readLog(); err != nil {
+		return err
+	}
+	return d.compatible(d.log)
+}
+
+func (d *deltaSink) WriteRow(t *encode.Table, _ int, vals value.Values) error {
+	if t != d.table {
+		return nil
+	}
+	if d.file == nil {
+		ext := ".parquet"
+		if d.codec == parquet.CodecGzip {
+			ext = ".gz.parquet"
+		}
+		d.name = "part-00000-" + uuid.NewString() + "-c000" + ext
+		var err error
+		if d.upload, err = d.store.Create(d.prefix+d.name, "parquet"); err != nil {
+			return err
+		}
+		if d.file, err = parquet.NewFile(d.upload, t.Columns, d.codec, d.rowGroupRows); err != nil {
+			return err
+		}
+	}
+	d.rows++
+	return d.file.WriteRow(vals)
+}
+
+func (d *deltaSink) End() error {
+	if d.file == nil {
+		fmt.Fprintf(os.Stderr, "DELTA %s: no rows, nothing committed\n", d.out)
+		return nil
+	}
+	if err := d.file.Close(); err != nil {
+		return fmt.Errorf("delta: write %s: %w", d.name, err)
+	}
+	if err := d.upload.Close(); err != nil {
+		return fmt.Errorf("delta: write %s: %w", d.name, err)
+	}
+	add := map[string]interface{}{
+		"path":             d.name,
+		"partitionValues":  map[string]string{},
+		"size":             d.upload.Size(),
+		"modificationTime": time.Now().UnixMilli(),
+		"dataChange":       true,
+		"stats":            fmt.Sprintf(`{"numRecords":%d}`, d.rows),
+	}
+	for attempt := 1; ; attempt++ {
+		version := d.log.version + 1
+		err := d.store.PutIfAbsent(d.logKey(version), d.commit(add))
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "DELTA %s: committed version %d (%d rows in %s)\n", d.out, version, d.rows, d.name)
+			return nil
+		}
+		if !errors.Is(err, ErrExists) {
+			return fmt.Errorf("delta: commit version %d: %w", version, err)
+		}
+		if attempt == deltaMaxCommitAttempts {
+			return fmt.Errorf("delta: version %d already exists after %d attempts; %s is left uncommitted", version, attempt, d.name)
+		}
+		// Someone else committed first: re-read the log and check the table still matches.
+		if d.log, err = d.readLog(); err != nil {
+			return err
+		}
+		if err := d.compatible(d.log); err != nil {
+			return err
+		}
+	}
+}
+
+// commit renders the version file: protocol and metaData when creating the table, then the add
+// action and commitInfo, one JSON action per line.
+func (d *deltaSink) commit(add map[string]interface{}) []byte {
+	now := time.Now().UnixMilli()
+	var actions []map[string]interface{}
+	if d.log.version < 0 {
+		schema, _ := json.Marshal(map[string]interface{}{"type": "struct", "fields": d.schema})
+		actions = append(actions,
+			map[string]interface{}{"protocol": map[string]int{"minReaderVersion": 1, "minWriterVersion": 2}},
+			map[string]interface{}{"metaData": map[string]interface{}{
+				"id":               uuid.NewString(),
+				"format":           map[string]interface{}{"provider": "parquet", "options": map[string]string{}},
+				"schemaString":     string(schema),
+				"partitionColumns": []string{},
+				"configuration":    map[string]string{},
+				"createdTime":      now,
+			}})
+	}
+	actions = append(actions,
+		map[string]interface{}{"add": add},
+		map[string]interface{}{"commitInfo": map[string]interface{}{
+			"timestamp":           now,
+			"operation":           "WRITE",
+			"operationParameters": map[string]string{"mode": "Append", "partitionBy": "[]"},
+			"isBlindAppend":       true,
+			"engineInfo":          "kusto-example",
+		}})
+	var b []byte
+	for _, a := range actions {
+		line, _ := json.Marshal(a)
+		b = append(append(b, line...), '\n')
+	}
+	return b
+}
+
+func (d *deltaSink) logKey(version int64) string {
+	return fmt.Sprintf("%s_delta_log/%020d.json", d.prefix, version)
+}
+
+// readLog finds the latest version and walks the JSON commits backwards to the most recent
+// metaData and protocol actions.
+func (d *deltaSink) readLog() (*deltaLog, error) {
+	keys, err := d.store.List(d.prefix + "_delta_log/")
+	if err != nil {
+		return nil, fmt.Errorf("delta: list log: %w", err)
+	}
+	l := &deltaLog{version: -1}
+	var commits []int64
+	for _, k := range keys {
+		name := path.Base(k)
+		num, rest, _ := strings.Cut(name, ".")
+		v, err := strconv.ParseInt(num, 10, 64)
+		if err != nil || len(num) != 20 {
+			continue // _last_checkpoint, temp files, ...
+		}
+		if v > l.version {
+			l.version = v
+		}
+		if rest == "json" {
+			commits = append(commits, v)
+		}
+	}
+	sort.Slice(commits, func(i, j int) bool { return commits[i] > commits[j] })
+	for _, v := range commits {
+		data, err := d.store.Get(d.logKey(v))
+		if err != nil {
+			return nil, fmt.Errorf("delta: read log version %d: %w", v, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			var a struct {
+				Protocol *struct {
+					MinWriterVersion int `json:"minWriterVersion"`
+				} `json:"protocol"`
+				MetaData *struct {
+					SchemaString string `json:"schemaString"`
+				} `json:"metaData"`
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if err := json.Unmarshal([]byte(line), &a); err != nil {
+				return nil, fmt.Errorf("delta: log version %d: %w", v, err)
+			}
+			if a.Protocol != nil && l.protocol == 0 {
+				l.protocol = a.Protocol.MinWriterVersion
+			}
+			if a.MetaData != nil && l.schema == nil {
+				var s struct {
+					Fields []deltaField `json:"fields"`
+				}
+				if err := json.Unmarshal([]byte(a.MetaData.SchemaString), &s); err != nil {
+					return nil, fmt.Errorf("delta: log version %d: schemaString: %w", v, err)
+				}
+				l.schema = s.Fields
+			}
+		}
+		if l.schema != nil && l.protocol != 0 {
+			break
+		}
+	}
+	return l, nil
+}
+
+// compatible checks that the result can be appended to the table as it stands in l.
+func (d *deltaSink) compatible(l *deltaLog) error {
+	if l.version < 0 {
+		return nil
+	}
+	if l.protocol > 2 {
+		return fmt.Errorf("delta: table needs writer protocol %d; only 2 is supported", l.protocol)
+	}
+	if l.schema == nil {
+		fmt.Fprintf(os.Stderr, "WARN delta: no metaData in the JSON log (checkpointed table); schema not checked\n")
+		return nil
+	}
+	table := map[string]string{}
+	for _, f := range l.schema {
+		table[f.Name] = f.Type
+	}
+	for _, f := range d.schema {
+		typ, ok := table[f.Name]
+		if !ok {
+			return fmt.Errorf("delta: column %s is not in the table", f.Name)
+		}
+		if typ != f.Type {
+			return fmt.Errorf("delta: column %s is %s in the table but %s in the result", f.Name, typ, f.Type)
+		}
+	}
+	if len(l.schema) != len(d.schema) {
+		var missing []string
+		for _, f := range l.schema {
+			if !d.hasColumn(f.Name) {
+				missing = append(missing, f.Name)
+			}
+		}
+		return fmt.Errorf("delta: result is missing table columns %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (d *deltaSink) hasColumn(name string) bool {
+	for _, f := range d.schema {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// deltaFieldFor maps a Kusto column to the Delta type of the Parquet column parquet.File writes.
+func deltaFieldFor(name string, t types.Column) deltaField {
+	f := deltaField{Name: name, Nullable: true, Metadata: map[string]string{}}
+	switch t {
+	case types.Bool:
+		f.Type = "boolean"
+	case types.Int:
+		f.Type = "integer"
+	case types.Long:
+		f.Type = "long"
+	case types.Real:
+		f.Type = "double"
+	case types.DateTime:
+		f.Type = "timestamp"
+	case types.Timespan:
+		f.Type = "long"
+		f.Metadata["kusto.type"] = "timespan"
+		f.Metadata["unit"] = "ns"
+	default:
+		f.Type = "string"
+	}
+	return f
+}
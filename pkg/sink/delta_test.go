@@ -0,0 +1,150 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func deltaAppend(t *testing.T, dir string, cols []query.Column, rows ...value.Values) error {
+	t.Helper()
+	enc, err := newDeltaSink(&Config{Out: dir, Opts: Opts{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: cols}
+	if err := enc.Begin(tbl); err != nil {
+		return err
+	}
+	for i, r := range rows {
+		if err := enc.WriteRow(tbl, i, r); err != nil {
+			return err
+		}
+	}
+	return enc.End()
+}
+
+// deltaActions reads a commit of the log as its actions, keyed by action name.
+func deltaActions(t *testing.T, dir string, version string) map[string]map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "_delta_log", version+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var a map[string]map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &a); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		for k, v := range a {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func TestDeltaCommit(t *testing.T) {
+	dir := t.TempDir()
+	cols := []query.Column{query.NewColumn(0, "State", types.String), query.NewColumn(1, "Count", types.Long),
+		query.NewColumn(2, "When", types.DateTime), query.NewColumn(3, "Took", types.Timespan)}
+	row := func(state string, n int64) value.Values {
+		return value.Values{value.NewString(state), value.NewLong(n), value.NewDateTime(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)), value.NewTimespan(time.Second)}
+	}
+	if err := deltaAppend(t, dir, cols, row("TEXAS", 3), row("OHIO", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first commit creates the table: protocol, metaData with the schema, the add and commitInfo.
+	v0 := deltaActions(t, dir, "00000000000000000000")
+	if p := v0["protocol"]; p["minReaderVersion"] != 1.0 || p["minWriterVersion"] != 2.0 {
+		t.Errorf("protocol %v", p)
+	}
+	var schema struct {
+		Type   string       `json:"type"`
+		Fields []deltaField `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(v0["metaData"]["schemaString"].(string)), &schema); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, f := range schema.Fields {
+		fields = append(fields, f.Name+":"+f.Type)
+	}
+	if schema.Type != "struct" || strings.Join(fields, " ") != "State:string Count:long When:timestamp Took:long" || schema.Fields[3].Metadata["unit"] != "ns" {
+		t.Errorf("schema %+v", schema)
+	}
+	if f := v0["metaData"]["format"].(map[string]interface{}); f["provider"] != "parquet" {
+		t.Errorf("format %v", f)
+	}
+	add := v0["add"]
+	name := add["path"].(string)
+	info, err := os.Stat(filepath.Join(dir, name))
+	if err != nil || !strings.HasPrefix(name, "part-00000-") || !strings.HasSuffix(name, "-c000.gz.parquet") {
+		t.Fatalf("data file %s: %v", name, err)
+	}
+	if add["size"] != float64(info.Size()) || add["dataChange"] != true || add["stats"] != `{"numRecords":2}` {
+		t.Errorf("add %v", add)
+	}
+	if c := v0["commitInfo"]; c["operation"] != "WRITE" || c["isBlindAppend"] != true {
+		t.Errorf("commitInfo %v", c)
+	}
+
+	// An append is the next version with only the add and commitInfo.
+	if err := deltaAppend(t, dir, cols, row("IOWA", 7)); err != nil {
+		t.Fatal(err)
+	}
+	v1 := deltaActions(t, dir, "00000000000000000001")
+	if _, ok := v1["metaData"]; ok || v1["add"]["stats"] != `{"numRecords":1}` {
+		t.Errorf("version 1: %v", v1)
+	}
+
+	// A result whose columns differ from the table's is refused before anything is written.
+	err = deltaAppend(t, dir, []query.Column{query.NewColumn(0, "State", types.String), query.NewColumn(1, "Count", types.Int)})
+	if err == nil || !strings.Contains(err.Error(), "column Count is long in the table but integer in the result") {
+		t.Errorf("mismatched append: %v", err)
+	}
+	err = deltaAppend(t, dir, cols[:2])
+	if err == nil || !strings.Contains(err.Error(), "missing table columns When, Took") {
+		t.Errorf("narrower append: %v", err)
+	}
+}
+
+// TestDeltaCommitConflict commits while another writer takes the next version first.
+func TestDeltaCommitConflict(t *testing.T) {
+	dir := t.TempDir()
+	cols := []query.Column{query.NewColumn(0, "Id", types.Long)}
+	if err := deltaAppend(t, dir, cols, value.Values{value.NewLong(1)}); err != nil {
+		t.Fatal(err)
+	}
+	enc, _ := newDeltaSink(&Config{Out: dir, Opts: Opts{}})
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: cols}
+	enc.Begin(tbl)
+	enc.WriteRow(tbl, 0, value.Values{value.NewLong(2)})
+	other := `{"commitInfo":{"operation":"WRITE","engineInfo":"spark"}}` + "\n"
+	os.WriteFile(filepath.Join(dir, "_delta_log", "00000000000000000001.json"), []byte(other), 0o644)
+	if err := enc.End(); err != nil {
+		t.Fatal(err)
+	}
+	if v2 := deltaActions(t, dir, "00000000000000000002"); v2["add"]["stats"] != `{"numRecords":1}` {
+		t.Errorf("version 2: %v", v2)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "_delta_log", "00000000000000000001.json")); string(b) != other {
+		t.Error("the other writer's commit was overwritten")
+	}
+
+	// A table needing a newer writer protocol is refused.
+	os.WriteFile(filepath.Join(dir, "_delta_log", "00000000000000000003.json"), []byte(`{"protocol":{"minReaderVersion":3,"minWriterVersion":7}}`+"\n"), 0o644)
+	if err := deltaAppend(t, dir, cols, value.Values{value.NewLong(3)}); err == nil || !strings.Contains(err.Error(), "writer protocol 7") {
+		t.Errorf("protocol 7: %v", err)
+	}
+}
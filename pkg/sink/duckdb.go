@@ -0,0 +1,148 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/encode/parquet"
+)
+
+// duckdbSink loads the first primary result table into a DuckDB database file (--out). The rows
+// are staged as an uncompressed Parquet file, which keeps their types, and loaded by the duckdb
+// CLI in one transaction, so the table is either fully written or untouched.
+//
+// Options (--sink-opt):
+//
+//	table=<name>              destination table (default results)
+//	mode=append|replace       append to an existing table (default) or replace it
+//	duckdb=<path>             duckdb binary (default duckdb on PATH)
+//
+// Column types: bool → BOOLEAN, int → INTEGER, long → BIGINT, real → DOUBLE, decimal →
+// DECIMAL(38,18), datetime → TIMESTAMPTZ, timespan → INTERVAL, guid → UUID, dynamic → JSON,
+// string → VARCHAR.
+type duckdbSink struct {
+	db      string
+	table   string
+	replace bool
+	bin     string
+
+	result  *encode.Table
+	staging *os.File
+	file    *parquet.File
+	rows    int
+}
+
+func newDuckDBSink(cfg *Config) (encode.Encoder, error) {
+	if cfg.Out == "" {
+		return nil, fmt.Errorf("--out must be the database file, e.g. analysis.duckdb")
+	}
+	d := &duckdbSink{db: cfg.Out, table: cfg.Opt("table", "results"), bin: cfg.Opt("duckdb", "duckdb")}
+	switch mode := cfg.Opt("mode", "append"); mode {
+	case "append":
+	case "replace":
+		d.replace = true
+	default:
+		return nil, fmt.Errorf("mode must be append or replace, not %q", mode)
+	}
+	// Fail before the query runs rather than after.
+	if _, err := exec.LookPath(d.bin); err != nil {
+		return nil, fmt.Errorf("%v (install the DuckDB CLI or set --sink-opt duckdb=<path>)", err)
+	}
+	return d, nil
+}
+
+func (d *duckdbSink) Begin(t *encode.Table) error {
+	if t.Kind != "PrimaryResult" {
+		return nil
+	}
+	if d.result != nil {
+		fmt.Fprintf(os.Stderr, "WARN duckdb: skipping table %s; only the first primary result is loaded\n", t.Name)
+		return nil
+	}
+	f, err := os.CreateTemp("", "kusto-duckdb-*.parquet")
+	if err != nil {
+		return err
+	}
+	d.result, d.staging = t, f
+	d.file, err = parquet.NewFile(f, t.Columns, parquet.CodecNone, 0)
+	return err
+}
+
+func (d *duckdbSink) WriteRow(t *encode.Table, _ int, vals value.Values) error {
+	if t != d.result {
+		return nil
+	}
+	d.rows++
+	return d.file.WriteRow(vals)
+}
+
+func (d *duckdbSink) End() error {
+	if d.result == nil {
+		fmt.Fprintf(os.Stderr, "DUCKDB %s: no primary result, nothing loaded\n", d.db)
+		return nil
+	}
+	defer os.Remove(d.staging.Name())
+	if err := d.file.Close(); err != nil {
+		d.staging.Close()
+		return fmt.Errorf("duckdb: stage rows: %w", err)
+	}
+	if err := d.staging.Close(); err != nil {
+		return fmt.Errorf("duckdb: stage rows: %w", err)
+	}
+	cmd := exec.Command(d.bin, "-bail", d.db)
+	cmd.Stdin = strings.NewReader(d.script())
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("duckdb: load %s into %s: %v: %s", d.table, d.db, err, strings.TrimSpace(out.String()))
+	}
+	fmt.Fprintf(os.Stderr, "DUCKDB %s: loaded %d rows into %s\n", d.db, d.rows, d.table)
+	return nil
+}
+
+// script is the SQL run by the duckdb CLI: the select converts the staged Parquet columns to
+// their DuckDB types, and the table is created from it when missing.
+func (d *duckdbSink) script() string {
+	cols := make([]string, len(d.result.Columns))
+	for i, c := range d.result.Columns {
+		cols[i] = duckdbColumn(duckdbIdent(c.Name()), c.Type()) + " AS " + duckdbIdent(c.Name())
+	}
+	sel := "SELECT " + strings.Join(cols, ", ") + " FROM read_parquet(" + duckdbString(d.staging.Name()) + ")"
+	table := duckdbIdent(d.table)
+	var b strings.Builder
+	b.WriteString("BEGIN TRANSACTION;\n")
+	if d.replace {
+		fmt.Fprintf(&b, "CREATE OR REPLACE TABLE %s AS %s;\n", table, sel)
+	} else {
+		fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s AS %s LIMIT 0;\n", table, sel)
+		fmt.Fprintf(&b, "INSERT INTO %s BY NAME %s;\n", table, sel)
+	}
+	b.WriteString("COMMIT;\n")
+	return b.String()
+}
+
+// duckdbColumn converts a staged column (see parquet.File) to the DuckDB type for its Kusto type.
+func duckdbColumn(col string, t types.Column) string {
+	switch t {
+	case types.Decimal:
+		return "CAST(" + col + " AS DECIMAL(38,18))"
+	case types.Timespan:
+		return "to_microseconds(" + col + " // 1000)"
+	case types.GUID:
+		return "CAST(" + col + " AS UUID)"
+	case types.Dynamic:
+		return "CAST(" + col + " AS JSON)"
+	}
+	return col
+}
+
+func duckdbIdent(s string) string { return `"` + strings.ReplaceAll(s, `"`, `""`) + `"` }
+
+func duckdbString(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
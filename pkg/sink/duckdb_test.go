@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// sqlUnquote reads one SQL quoted token (doubled quotes inside) from the start of s and returns
+// its value and the rest of s.
+func sqlUnquote(s string) (val, rest string, ok bool) {
+	if s == "" {
+		return "", "", false
+	}
+	q := s[0]
+	var b []byte
+	for i := 1; i < len(s); i++ {
+		if s[i] != q {
+			b = append(b, s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == q {
+			b = append(b, q)
+			i++
+			continue
+		}
+		return string(b), s[i+1:], true
+	}
+	return "", "", false
+}
+
+func FuzzDuckDBQuoting(f *testing.F) {
+	for _, s := range []string{"", "t", `a"b`, "it's", `""`, "''", `x"; DROP TABLE t; --`, "\xff"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, quoted := range []string{duckdbIdent(s), duckdbString(s)} {
+			v, rest, ok := sqlUnquote(quoted)
+			if !ok || rest != "" || v != s {
+				t.Fatalf("%q does not read back as one token for %q: %q, rest %q", quoted, s, v, rest)
+			}
+		}
+	})
+}
+
+// fakeDuckDB is a duckdb CLI that saves the script it reads next to the database file, and fails
+// when the database name contains "fail".
+func fakeDuckDB(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "duckdb")
+	script := "#!/bin/sh\ncase \"$2\" in *fail*) echo 'Catalog Error: Table does not exist' >&2; exit 1;; esac\ncat > \"$2.sql\"\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+func TestDuckDBLoad(t *testing.T) {
+	bin := fakeDuckDB(t)
+	cols := []query.Column{query.NewColumn(0, "State", types.String), query.NewColumn(1, "Took", types.Timespan), query.NewColumn(2, `Odd "name"`, types.Dynamic)}
+	tests := []struct {
+		name string
+		opts Opts
+		want []string
+	}{
+		{name: "append", opts: Opts{}, want: []string{
+			"BEGIN TRANSACTION;",
+			`CREATE TABLE IF NOT EXISTS "results" AS SELECT "State" AS "State", to_microseconds("Took" // 1000) AS "Took", CAST("Odd ""name""" AS JSON) AS "Odd ""name""" FROM read_parquet('<staged>') LIMIT 0;`,
+			`INSERT INTO "results" BY NAME SELECT "State" AS "State", to_microseconds("Took" // 1000) AS "Took", CAST("Odd ""name""" AS JSON) AS "Odd ""name""" FROM read_parquet('<staged>');`,
+			"COMMIT;"}},
+		{name: "replace", opts: Opts{"mode": "replace", "table": "storms"}, want: []string{
+			"BEGIN TRANSACTION;",
+			`CREATE OR REPLACE TABLE "storms" AS SELECT "State" AS "State", to_microseconds("Took" // 1000) AS "Took", CAST("Odd ""name""" AS JSON) AS "Odd ""name""" FROM read_parquet('<staged>');`,
+			"COMMIT;"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := filepath.Join(t.TempDir(), "analysis.duckdb")
+			tt.opts["duckdb"] = bin
+			enc, err := newDuckDBSink(&Config{Out: db, Opts: tt.opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: cols}
+			enc.Begin(tbl)
+			staged := enc.(*duckdbSink).staging.Name()
+			enc.WriteRow(tbl, 0, value.Values{value.NewString("TEXAS"), value.NewTimespan(0), value.NewDynamic([]byte(`{}`))})
+			if err := enc.End(); err != nil {
+				t.Fatal(err)
+			}
+			script, err := os.ReadFile(db + ".sql")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.ReplaceAll(strings.TrimSpace(string(script)), staged, "<staged>")
+			if got != strings.Join(tt.want, "\n") {
+				t.Errorf("script:\n%s\nwant:\n%s", got, strings.Join(tt.want, "\n"))
+			}
+			if _, err := os.Stat(staged); !os.IsNotExist(err) {
+				t.Errorf("staged file %s left behind", staged)
+			}
+		})
+	}
+
+	enc, _ := newDuckDBSink(&Config{Out: filepath.Join(t.TempDir(), "fail.duckdb"), Opts: Opts{"duckdb": bin}})
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: cols[:1]}
+	enc.Begin(tbl)
+	if err := enc.End(); err == nil || !strings.Contains(err.Error(), "Catalog Error") {
+		t.Errorf("failed load: %v", err)
+	}
+	if _, err := newDuckDBSink(&Config{Out: "a.duckdb", Opts: Opts{"mode": "merge", "duckdb": bin}}); err == nil {
+		t.Error("mode=merge accepted")
+	}
+	if _, err := newDuckDBSink(&Config{Out: "a.duckdb", Opts: Opts{"duckdb": filepath.Join(t.TempDir(), "none")}}); err == nil {
+		t.Error("missing duckdb binary accepted")
+	}
+}
@@ -0,0 +1,582 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsClient talks to one Google Cloud Storage bucket through the JSON API. It implements
+// Store: create streams an object with the resumable upload API, sending chunk-size bytes
+// at a time (default 8MiB) so memory stays bounded; the object only appears once the final chunk
+// is accepted.
+//
+// Options (--sink-opt):
+//
+//	chunk-size=<bytes>        rounded down to a multiple of 256KiB
+//	credentials=<file>        service account or authorized_user JSON; defaults to
+//	                          GOOGLE_APPLICATION_CREDENTIALS, then the gcloud application default
+//	                          credentials, then the GCE metadata server. GOOGLE_OAUTH_ACCESS_TOKEN
+//	                          skips all of these.
+//	bq-table=[project.]dataset.table   after an upload, run a BigQuery load job from the object
+//	bq-write=append|truncate  write disposition for the load job (default append)
+//	bq-location=<location>    BigQuery job location, e.g. EU
+type gcsClient struct {
+	bucket  string
+	creds   *gcpCredentials
+	client  *http.Client
+	chunk   int
+	timeout time.Duration
+	retries int
+	cfg     *Config
+}
+
+const gcsChunkUnit = 256 << 10
+
+func newGCSClient(cfg *Config, bucket string) (Store, error) {
+	g := &gcsClient{bucket: bucket, client: &http.Client{}, cfg: cfg}
+	var err error
+	if g.chunk, err = cfg.intOpt("chunk-size", 8<<20); err != nil {
+		return nil, err
+	}
+	if g.chunk -= g.chunk % gcsChunkUnit; g.chunk <= 0 {
+		g.chunk = gcsChunkUnit
+	}
+	if g.timeout, err = cfg.durationOpt("timeout", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if g.retries, err = cfg.intOpt("retries", 5); err != nil {
+		return nil, err
+	}
+	if g.creds, err = newGCPCredentials(cfg.Opt("credentials", "")); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// call sends an authorized request with retries and returns the body of a 2xx answer.
+func (g *gcsClient) call(method, u string, body []byte, headers map[string]string, onOK func(*http.Response)) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	var out []byte
+	err := retrySend(ctx, g.retries, func() error {
+		tok, err := g.creds.token(ctx)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := httpDo(g.client, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return httpStatusError(resp)
+		}
+		if onOK != nil {
+			onOK(resp)
+		}
+		out, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return out, err
+}
+
+func (g *gcsClient) objectURL(key string) string {
+	return "https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (g *gcsClient) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		u := "https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(g.bucket) +
+			"/o?fields=items(name),nextPageToken&prefix=" + url.QueryEscape(prefix)
+		if token != "" {
+			u += "&pageToken=" + url.QueryEscape(token)
+		}
+		raw, err := g.call(http.MethodGet, u, nil, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("gcs: list gs://%s/%s: %w", g.bucket, prefix, err)
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return nil, err
+		}
+		for _, it := range page.Items {
+			keys = append(keys, it.Name)
+		}
+		if token = page.NextPageToken; token == "" {
+			return keys, nil
+		}
+	}
+}
+
+func (g *gcsClient) Get(key string) ([]byte, error) {
+	data, err := g.call(http.MethodGet, g.objectURL(key)+"?alt=media", nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: get gs://%s/%s: %w", g.bucket, key, err)
+	}
+	return data, nil
+}
+
+func (g *gcsClient) PutIfAbsent(key string, data []byte) error {
+	u := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(g.bucket) +
+		"/o?uploadType=media&ifGenerationMatch=0&name=" + url.QueryEscape(key)
+	_, err := g.call(http.MethodPost, u, data, map[string]string{"Content-Type": "application/json"}, nil)
+	var he *httpError
+	if errors.As(err, &he) && he.Status == http.StatusPreconditionFailed {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("gcs: put gs://%s/%s: %w", g.bucket, key, err)
+	}
+	return nil
+}
+
+func (g *gcsClient) Create(key, format string) (Upload, error) {
+	up := &gcsUpload{gcsClient: g, key: key, contentType: FormatContentType(format)}
+	if table := g.cfg.Opt("bq-table", ""); table != "" {
+		if format != "ndjson" {
+			return nil, fmt.Errorf("bq-table needs --format ndjson, not %q", format)
+		}
+		var err error
+		if up.bq, err = newBigQueryLoad(g.cfg, table, g.creds); err != nil {
+			return nil, err
+		}
+	}
+	return up, nil
+}
+
+// gcsUpload is one resumable upload session.
+type gcsUpload struct {
+	*gcsClient
+	key         string
+	contentType string
+	bq          *bigQueryLoad
+
+	session string
+	buf     []byte
+	off     int64
+	size    int64
+}
+
+func (g *gcsUpload) URL() string { return "gs://" + g.bucket + "/" + g.key }
+
+func (g *gcsUpload) Size() int64 { return g.size }
+
+func (g *gcsUpload) Write(p []byte) (int, error) {
+	g.buf = append(g.buf, p...)
+	g.size += int64(len(p))
+	for len(g.buf) >= g.chunk {
+		if err := g.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (g *gcsUpload) Close() error {
+	if err := g.flush(true); err != nil {
+		return err
+	}
+	if g.bq == nil {
+		return nil
+	}
+	return g.bq.run(g.URL(), g.timeout)
+}
+
+// flush sends the buffered bytes (whole 256KiB units unless final) and drops what the service
+// reports as persisted; a short write leaves the rest buffered for the next call.
+func (g *gcsUpload) flush(final bool) error {
+	if g.session == "" {
+		u := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(g.bucket) +
+			"/o?uploadType=resumable&name=" + url.QueryEscape(g.key)
+		meta, _ := json.Marshal(map[string]string{"name": g.key, "contentType": g.contentType})
+		headers := map[string]string{"Content-Type": "application/json; charset=UTF-8", "X-Upload-Content-Type": g.contentType}
+		_, err := g.call(http.MethodPost, u, meta, headers, func(resp *http.Response) { g.session = resp.Header.Get("Location") })
+		if err == nil && g.session == "" {
+			err = fmt.Errorf("no upload session in response")
+		}
+		if err != nil {
+			return fmt.Errorf("gcs: start upload %s: %w", g.URL(), err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	return retrySend(ctx, g.retries, func() error {
+		n := len(g.buf)
+		if !final {
+			n -= n % gcsChunkUnit
+		}
+		total := "*"
+		if final {
+			total = strconv.FormatInt(g.off+int64(n), 10)
+		}
+		rng := "bytes */" + total
+		if n > 0 {
+			rng = fmt.Sprintf("bytes %d-%d/%s", g.off, g.off+int64(n)-1, total)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, g.session, bytes.NewReader(g.buf[:n]))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Range", rng)
+		resp, err := httpDo(g.client, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			g.buf, g.off = g.buf[:0], g.off+int64(n)
+			return nil
+		case http.StatusPermanentRedirect:
+			persisted := int64(0)
+			if r := resp.Header.Get("Range"); r != "" {
+				_, end, _ := strings.Cut(r, "-")
+				last, err := strconv.ParseInt(end, 10, 64)
+				if err != nil {
+					return fmt.Errorf("gcs: bad Range %q", r)
+				}
+				persisted = last + 1
+			}
+			g.buf = g.buf[persisted-g.off:]
+			g.off = persisted
+			if final {
+				return retryableSinkErr{fmt.Errorf("gcs: upload incomplete at %d bytes", persisted)}
+			}
+			return nil
+		}
+		return httpStatusError(resp)
+	})
+}
+
+// bigQueryLoad runs a load job from an uploaded NDJSON object into a table, detecting the schema
+// from the data, and waits for it to finish.
+type bigQueryLoad struct {
+	project, dataset, table string
+	disposition             string
+	location                string
+	creds                   *gcpCredentials
+	client                  *http.Client
+}
+
+func newBigQueryLoad(cfg *Config, spec string, creds *gcpCredentials) (*bigQueryLoad, error) {
+	b := &bigQueryLoad{location: cfg.Opt("bq-location", ""), creds: creds, client: &http.Client{}}
+	parts := strings.Split(spec, ".")
+	switch len(parts) {
+	case 3:
+		b.project, b.dataset, b.table = parts[0], parts[1], parts[2]
+	case 2:
+		b.project, b.dataset, b.table = cfg.Opt("bq-project", os.Getenv("GOOGLE_CLOUD_PROJECT")), parts[0], parts[1]
+		if b.project == "" {
+			return nil, fmt.Errorf("bq-table %q has no project: use project.dataset.table or set GOOGLE_CLOUD_PROJECT", spec)
+		}
+	default:
+		return nil, fmt.Errorf("bq-table must be [project.]dataset.table, got %q", spec)
+	}
+	switch cfg.Opt("bq-write", "append") {
+	case "append":
+		b.disposition = "WRITE_APPEND"
+	case "truncate":
+		b.disposition = "WRITE_TRUNCATE"
+	default:
+		return nil, fmt.Errorf("bq-write must be append or truncate")
+	}
+	return b, nil
+}
+
+func (b *bigQueryLoad) run(source string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	job := map[string]interface{}{
+		"configuration": map[string]interface{}{
+			"load": map[string]interface{}{
+				"sourceUris":        []string{source},
+				"sourceFormat":      "NEWLINE_DELIMITED_JSON",
+				"autodetect":        true,
+				"writeDisposition":  b.disposition,
+				"createDisposition": "CREATE_IF_NEEDED",
+				"destinationTable":  map[string]string{"projectId": b.project, "datasetId": b.dataset, "tableId": b.table},
+			},
+		},
+	}
+	if b.location != "" {
+		job["jobReference"] = map[string]string{"projectId": b.project, "location": b.location}
+	}
+	base := "https://bigquery.googleapis.com/bigquery/v2/projects/" + url.PathEscape(b.project) + "/jobs"
+	var status bigQueryJob
+	if err := b.call(ctx, http.MethodPost, base, job, &status); err != nil {
+		return fmt.Errorf("bigquery: submit load job: %w", err)
+	}
+	for status.Status.State != "DONE" {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("bigquery: load job %s still %s: %w", status.JobReference.JobID, status.Status.State, ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+		u := base + "/" + url.PathEscape(status.JobReference.JobID)
+		if loc := status.JobReference.Location; loc != "" {
+			u += "?location=" + url.QueryEscape(loc)
+		}
+		if err := b.call(ctx, http.MethodGet, u, nil, &status); err != nil {
+			return fmt.Errorf("bigquery: poll load job: %w", err)
+		}
+	}
+	if e := status.Status.ErrorResult; e != nil {
+		return fmt.Errorf("bigquery: load job %s failed: %s", status.JobReference.JobID, e.Message)
+	}
+	fmt.Fprintf(os.Stderr, "BIGQUERY loaded %s rows into %s.%s.%s (job %s)\n",
+		status.Statistics.Load.OutputRows, b.project, b.dataset, b.table, status.JobReference.JobID)
+	return nil
+}
+
+type bigQueryJob struct {
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	Status struct {
+		State       string `json:"state"`
+		ErrorResult *struct {
+			Message string `json:"message"`
+		} `json:"errorResult"`
+	} `json:"status"`
+	Statistics struct {
+		Load struct {
+			OutputRows string `json:"outputRows"`
+		} `json:"load"`
+	} `json:"statistics"`
+}
+
+func (b *bigQueryLoad) call(ctx context.Context, method, u string, in, out interface{}) error {
+	tok, err := b.creds.token(ctx)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		enc, _ := json.Marshal(in)
+		body = bytes.NewReader(enc)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpDo(b.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpStatusError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// gcpCredentials hands out cached OAuth access tokens for the cloud-platform scope.
+type gcpCredentials struct {
+	mu     sync.Mutex
+	fetch  func(ctx context.Context) (string, time.Duration, error)
+	tok    string
+	expiry time.Time
+}
+
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+func newGCPCredentials(path string) (*gcpCredentials, error) {
+	c := &gcpCredentials{}
+	if tok := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); tok != "" && path == "" {
+		c.tok, c.expiry = tok, time.Now().Add(24*time.Hour)
+		return c, nil
+	}
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			adc := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(adc); err == nil {
+				path = adc
+			}
+		}
+	}
+	if path == "" {
+		c.fetch = gcpMetadataToken
+		return c, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("gcp credentials: %w", err)
+	}
+	var f struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("gcp credentials %s: %w", path, err)
+	}
+	if f.TokenURI == "" {
+		f.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	switch f.Type {
+	case "service_account":
+		key, err := parseRSAKey(f.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("gcp credentials %s: %w", path, err)
+		}
+		c.fetch = func(ctx context.Context) (string, time.Duration, error) {
+			assertion, err := signJWT(key, map[string]interface{}{
+				"iss": f.ClientEmail, "scope": gcpScope, "aud": f.TokenURI,
+				"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+			})
+			if err != nil {
+				return "", 0, err
+			}
+			return gcpTokenRequest(ctx, f.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	case "authorized_user":
+		c.fetch = func(ctx context.Context) (string, time.Duration, error) {
+			return gcpTokenRequest(ctx, f.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {f.ClientID},
+				"client_secret": {f.ClientSecret},
+				"refresh_token": {f.RefreshToken},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("gcp credentials %s: unsupported type %q", path, f.Type)
+	}
+	return c, nil
+}
+
+func (c *gcpCredentials) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tok != "" && time.Until(c.expiry) > 5*time.Minute {
+		return c.tok, nil
+	}
+	if c.fetch == nil {
+		return c.tok, nil
+	}
+	tok, ttl, err := c.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("gcp token: %w", err)
+	}
+	c.tok, c.expiry = tok, time.Now().Add(ttl)
+	return tok, nil
+}
+
+func gcpTokenRequest(ctx context.Context, tokenURI string, form url.Values) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return gcpTokenResponse(req)
+}
+
+func gcpMetadataToken(ctx context.Context) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return gcpTokenResponse(req)
+}
+
+func gcpTokenResponse(req *http.Request) (string, time.Duration, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, httpStatusError(resp)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", 0, err
+	}
+	return t.AccessToken, time.Duration(t.ExpiresIn) * time.Second, nil
+}
+
+func parseRSAKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("private_key is not PEM")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private_key is not an RSA key")
+	}
+	return rk, nil
+}
+
+// signJWT returns an RS256-signed JWT with the given claims.
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + enc.EncodeToString(body)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
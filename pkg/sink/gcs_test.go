@@ -0,0 +1,122 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// redirectTransport sends every request to srv, whatever host it was for, keeping the original
+// host in the X-Original-Host header.
+type redirectTransport struct{ srv *httptest.Server }
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, _ := url.Parse(t.srv.URL)
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Original-Host", req.URL.Host)
+	req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+	return t.srv.Client().Transport.RoundTrip(req)
+}
+
+// TestGCSUpload checks the requests of a resumable upload: the session start with the object's
+// metadata, then chunks in whole 256KiB units with their Content-Range, resuming from what the
+// service reports as persisted, and the final chunk with the total size.
+func TestGCSUpload(t *testing.T) {
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "ya29.test")
+	var mu sync.Mutex
+	var got []string
+	var object []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		switch r.Method {
+		case http.MethodPost:
+			var meta map[string]string
+			json.Unmarshal(body, &meta)
+			got = append(got, fmt.Sprintf("POST %s%s?%s auth=%s type=%s meta=%s/%s", r.Header.Get("X-Original-Host"), r.URL.Path, r.URL.RawQuery,
+				r.Header.Get("Authorization"), r.Header.Get("X-Upload-Content-Type"), meta["name"], meta["contentType"]))
+			w.Header().Set("Location", "https://storage.googleapis.com/upload/session/1")
+		case http.MethodPut:
+			got = append(got, fmt.Sprintf("PUT %s %s (%d bytes)", r.URL.Path, r.Header.Get("Content-Range"), len(body)))
+			if len(object) == 0 {
+				// Only half of the first chunk made it.
+				object = append(object, body[:128<<10]...)
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(object)-1))
+				w.WriteHeader(http.StatusPermanentRedirect)
+				return
+			}
+			object = append(object, body...)
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	store, err := newGCSClient(&Config{Opts: Opts{"chunk-size": "300000"}}, "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := store.(*gcsClient)
+	g.client = &http.Client{Transport: redirectTransport{srv}}
+	up, err := g.Create("storms/2024 06.ndjson", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("x", 256<<10+10)
+	if _, err := io.WriteString(up, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST storage.googleapis.com/upload/storage/v1/b/reports/o?uploadType=resumable&name=storms%2F2024+06.ndjson auth=Bearer ya29.test type=application/x-ndjson meta=storms/2024 06.ndjson/application/x-ndjson",
+		"PUT /upload/session/1 bytes 0-262143/* (262144 bytes)",
+		"PUT /upload/session/1 bytes 131072-262153/262154 (131082 bytes)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if string(object) != data || up.URL() != "gs://reports/storms/2024 06.ndjson" || up.Size() != int64(len(data)) {
+		t.Errorf("object of %d bytes at %s", len(object), up.URL())
+	}
+}
+
+func TestBigQueryLoadConfig(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+	tests := []struct {
+		spec, write string
+		want        string
+		err         string
+	}{
+		{spec: "proj.storms.events", want: "proj/storms/events WRITE_APPEND"},
+		{spec: "storms.events", write: "truncate", err: "has no project"},
+		{spec: "events", err: "must be [project.]dataset.table"},
+		{spec: "p.d.t", write: "merge", err: "bq-write must be append or truncate"},
+	}
+	for _, tt := range tests {
+		opts := Opts{}
+		if tt.write != "" {
+			opts["bq-write"] = tt.write
+		}
+		b, err := newBigQueryLoad(&Config{Opts: opts}, tt.spec, nil)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.project + "/" + b.dataset + "/" + b.table + " " + b.disposition; got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
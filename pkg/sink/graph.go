@@ -0,0 +1,262 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// graphSimpleUploadLimit is the largest file Microsoft Graph takes in a single PUT; larger ones
+// go through an upload session.
+const graphSimpleUploadLimit = 4 << 20
+
+// graphDrive talks to a OneDrive or a SharePoint document library through Microsoft Graph. It
+// implements Store for --out onedrive://<drive-id>/<path>, where the drive id is the one Graph
+// gives the library (GET /sites/<host>:/sites/<site>:/drives). Graph can't take a file of
+// unknown size in pieces, so Create spools the output to a temporary file and uploads it on
+// Close: in one PUT up to 4MiB, or in chunk-size pieces (default 10MiB, a multiple of 320KiB)
+// through an upload session. Either way the file is replaced only once it is complete. List
+// returns the files directly in the prefix's folder, like a local directory's.
+//
+// Options (--sink-opt):
+//
+//	chunk-size=<bytes>
+//	endpoint=<url>            Graph endpoint (default https://graph.microsoft.com/v1.0), for
+//	                          national clouds
+//
+// GRAPH_ACCESS_TOKEN, if set, is sent as is; otherwise DefaultAzureCredential signs in, and
+// needs Files.ReadWrite.All or Sites.ReadWrite.All (or Sites.Selected with write access to the
+// site) as an application permission.
+type graphDrive struct {
+	drive     string
+	base      string // <endpoint>/drives/<drive-id>
+	scope     string
+	token     string
+	cred      azcore.TokenCredential
+	chunkSize int
+	timeout   time.Duration
+	retries   int
+	client    *http.Client
+}
+
+func newGraphDrive(cfg *Config, drive string) (Store, error) {
+	endpoint := strings.TrimSuffix(cfg.Opt("endpoint", "https://graph.microsoft.com/v1.0"), "/")
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be a URL, got %q", endpoint)
+	}
+	g := &graphDrive{
+		drive:  drive,
+		base:   endpoint + "/drives/" + url.PathEscape(drive),
+		scope:  u.Scheme + "://" + u.Host + "/.default",
+		token:  os.Getenv("GRAPH_ACCESS_TOKEN"),
+		client: &http.Client{},
+	}
+	if g.chunkSize, err = cfg.intOpt("chunk-size", 32*320<<10); err != nil {
+		return nil, err
+	}
+	if g.chunkSize <= 0 || g.chunkSize%(320<<10) != 0 || g.chunkSize > 60<<20 {
+		return nil, fmt.Errorf("chunk-size must be a multiple of 320KiB, up to 60MiB")
+	}
+	if g.timeout, err = cfg.durationOpt("timeout", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if g.retries, err = cfg.intOpt("retries", 5); err != nil {
+		return nil, err
+	}
+	if g.token == "" {
+		if g.cred, err = azidentity.NewDefaultAzureCredential(nil); err != nil {
+			return nil, fmt.Errorf("onedrive: %v (or set GRAPH_ACCESS_TOKEN)", err)
+		}
+	}
+	return g, nil
+}
+
+// item is the Graph path of the drive item at key: <base>/root:/<key>:<suffix>.
+func (g *graphDrive) item(key, suffix string) string {
+	segs := strings.Split(strings.Trim(key, "/"), "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	if len(segs) == 1 && segs[0] == "" {
+		return g.base + "/root" + strings.TrimPrefix(suffix, ":")
+	}
+	return g.base + "/root:/" + strings.Join(segs, "/") + ":" + suffix
+}
+
+func (g *graphDrive) Create(key, _ string) (Upload, error) {
+	f, err := os.CreateTemp("", "onedrive-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &graphUpload{graphDrive: g, key: key, f: f}, nil
+}
+
+func (g *graphDrive) List(prefix string) ([]string, error) {
+	dir, _ := path.Split(prefix)
+	var keys []string
+	next := g.item(dir, ":/children") + "?$select=name,file&$top=999"
+	for next != "" {
+		raw, err := g.request(http.MethodGet, next, nil, nil, true)
+		var he *httpError
+		if errors.As(err, &he) && he.Status == http.StatusNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("onedrive: list %s: %w", g.URL(dir), err)
+		}
+		var page struct {
+			Value []struct {
+				Name string           `json:"name"`
+				File *json.RawMessage `json:"file"`
+			} `json:"value"`
+			Next string `json:"@odata.nextLink"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return nil, fmt.Errorf("onedrive: list %s: %v", g.URL(dir), err)
+		}
+		for _, it := range page.Value {
+			if key := dir + it.Name; it.File != nil && strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		next = page.Next
+	}
+	return keys, nil
+}
+
+func (g *graphDrive) Get(key string) ([]byte, error) {
+	data, err := g.request(http.MethodGet, g.item(key, "/content"), nil, nil, true)
+	if err != nil {
+		return nil, fmt.Errorf("onedrive: get %s: %w", g.URL(key), err)
+	}
+	return data, nil
+}
+
+// PutIfAbsent uploads with conflictBehavior=fail, which Graph answers with 409 when the file
+// exists.
+func (g *graphDrive) PutIfAbsent(key string, data []byte) error {
+	_, err := g.request(http.MethodPut, g.item(key, "/content")+"?@microsoft.graph.conflictBehavior=fail", data,
+		map[string]string{"Content-Type": "application/json"}, true)
+	var he *httpError
+	if errors.As(err, &he) && he.Status == http.StatusConflict {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("onedrive: put %s: %w", g.URL(key), err)
+	}
+	return nil
+}
+
+// URL names a file for messages.
+func (g *graphDrive) URL(key string) string { return "onedrive://" + g.drive + "/" + key }
+
+// request sends a request with retries and returns the body of a 2xx answer. Upload session
+// URLs are pre-authorized, and get no token (auth false).
+func (g *graphDrive) request(method, uri string, body []byte, headers map[string]string, auth bool) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	var out []byte
+	err := retrySend(ctx, g.retries, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if auth {
+			tok := g.token
+			if tok == "" {
+				t, err := g.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{g.scope}})
+				if err != nil {
+					return err
+				}
+				tok = t.Token
+			}
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		resp, err := httpDo(g.client, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return httpStatusError(resp)
+		}
+		out, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return out, err
+}
+
+// graphUpload spools a file to disk and uploads it on Close.
+type graphUpload struct {
+	*graphDrive
+	key  string
+	f    *os.File
+	size int64
+}
+
+func (u *graphUpload) URL() string { return u.graphDrive.URL(u.key) }
+
+func (u *graphUpload) Size() int64 { return u.size }
+
+func (u *graphUpload) Write(p []byte) (int, error) {
+	n, err := u.f.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *graphUpload) Close() error {
+	defer os.Remove(u.f.Name())
+	defer u.f.Close()
+	if u.size <= graphSimpleUploadLimit {
+		data := make([]byte, u.size)
+		if _, err := u.f.ReadAt(data, 0); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := u.request(http.MethodPut, u.item(u.key, "/content"), data, nil, true); err != nil {
+			return fmt.Errorf("onedrive: put %s: %w", u.URL(), err)
+		}
+		return nil
+	}
+	body, _ := json.Marshal(map[string]interface{}{"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"}})
+	raw, err := u.request(http.MethodPost, u.item(u.key, ":/createUploadSession"), body, map[string]string{"Content-Type": "application/json"}, true)
+	if err != nil {
+		return fmt.Errorf("onedrive: start upload %s: %w", u.URL(), err)
+	}
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	if err := json.Unmarshal(raw, &session); err != nil || session.UploadURL == "" {
+		return fmt.Errorf("onedrive: start upload %s: no uploadUrl in %q", u.URL(), raw)
+	}
+	chunk := make([]byte, u.chunkSize)
+	for off := int64(0); off < u.size; off += int64(u.chunkSize) {
+		n, err := u.f.ReadAt(chunk, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		rng := fmt.Sprintf("bytes %d-%d/%d", off, off+int64(n)-1, u.size)
+		if _, err := u.request(http.MethodPut, session.UploadURL, chunk[:n], map[string]string{"Content-Range": rng}, false); err != nil {
+			u.request(http.MethodDelete, session.UploadURL, nil, nil, false)
+			return fmt.Errorf("onedrive: upload %s (%s): %w", u.URL(), rng, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// mqttSink publishes each row to an MQTT 3.1.1 broker. The topic is a template over the row's
+// columns taken from --out, e.g. mqtts://broker:8883/edge/{State}/storms publishes a TEXAS row to
+// edge/TEXAS/storms; '+', '#' and '/' in values are replaced with '_' so a value can't add levels.
+//
+// Options (--sink-opt):
+//
+//	qos=0|1|2                 delivery guarantee (default 1); a batch completes once every
+//	                          message is acknowledged
+//	retain=true               set the retain flag, so new subscribers get the last row per topic
+//	client-id=<id>            default kusto-example-<pid>
+//	username=/password=       credentials (also MQTT_USERNAME / MQTT_PASSWORD)
+//	keepalive=<duration>      default 60s
+//	ca-file=, cert-file=, key-file=, insecure-skip-verify=true   TLS settings for mqtts://
+//
+// On a connection error the batch is republished on a new connection, so with qos 1 consumers
+// may see duplicates.
+type mqttSink struct {
+	addr      string
+	tls       *tls.Config
+	topic     string
+	qos       byte
+	retain    bool
+	clientID  string
+	username  string
+	password  string
+	keepalive time.Duration
+	retries   int
+
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID uint16
+}
+
+func newMQTTSink(cfg *Config) (rowSink, error) {
+	scheme, rest, ok := strings.Cut(cfg.Out, "://")
+	host, topic, _ := strings.Cut(rest, "/")
+	if !ok || (scheme != "mqtt" && scheme != "mqtts") || host == "" || topic == "" {
+		return nil, fmt.Errorf("--out must be mqtt[s]://<host>[:port]/<topic-template>, got %q", cfg.Out)
+	}
+	m := &mqttSink{
+		topic:    topic,
+		retain:   cfg.Opt("retain", "false") == "true",
+		clientID: cfg.Opt("client-id", fmt.Sprintf("kusto-example-%d", os.Getpid())),
+		username: cfg.Opt("username", os.Getenv("MQTT_USERNAME")),
+		password: cfg.Opt("password", os.Getenv("MQTT_PASSWORD")),
+	}
+	port := "1883"
+	if scheme == "mqtts" {
+		port = "8883"
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, port)
+	}
+	m.addr = host
+	if scheme == "mqtts" {
+		name, _, _ := net.SplitHostPort(host)
+		conf, err := cfg.tlsConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		m.tls = conf
+	}
+	qos, err := cfg.intOpt("qos", 1)
+	if err != nil {
+		return nil, err
+	}
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("qos must be 0, 1 or 2, not %d", qos)
+	}
+	m.qos = byte(qos)
+	if m.keepalive, err = cfg.durationOpt("keepalive", time.Minute); err != nil {
+		return nil, err
+	}
+	if m.retries, err = cfg.intOpt("retries", 3); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mqttSink) maxBatchBytes() int { return 0 }
+
+func (m *mqttSink) close() error {
+	if m.conn == nil {
+		return nil
+	}
+	_, err := m.conn.Write([]byte{0xe0, 0x00}) // DISCONNECT
+	m.conn.Close()
+	m.conn = nil
+	return err
+}
+
+func (m *mqttSink) send(ctx context.Context, batch []sinkRecord) error {
+	topics := make([]string, len(batch))
+	for i, r := range batch {
+		t, err := expandTemplate(m.topic, r.Doc, mqttTopicLevel)
+		if err != nil {
+			return err
+		}
+		topics[i] = t
+	}
+	return retrySend(ctx, m.retries, func() error {
+		err := m.publish(ctx, batch, topics)
+		if err != nil && m.conn != nil {
+			m.conn.Close()
+			m.conn = nil
+		}
+		var ne net.Error
+		if errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return retryableSinkErr{err}
+		}
+		return err
+	})
+}
+
+func (m *mqttSink) publish(ctx context.Context, batch []sinkRecord, topics []string) error {
+	if m.conn == nil {
+		if err := m.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		m.conn.SetDeadline(dl)
+		defer m.conn.SetDeadline(time.Time{})
+	}
+	pending := map[uint16]bool{}
+	w := bufio.NewWriter(m.conn)
+	for i, r := range batch {
+		var vh []byte
+		vh = mqttString(vh, topics[i])
+		if m.qos > 0 {
+			m.nextID++
+			if m.nextID == 0 {
+				m.nextID = 1
+			}
+			vh = binary.BigEndian.AppendUint16(vh, m.nextID)
+			pending[m.nextID] = true
+		}
+		flags := 0x30 | m.qos<<1
+		if m.retain {
+			flags |= 0x01
+		}
+		if _, err := w.Write(mqttPacket(flags, vh, r.Body)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for len(pending) > 0 {
+		typ, body, err := mqttRead(m.r)
+		if err != nil {
+			return err
+		}
+		if len(body) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(body)
+		switch typ >> 4 {
+		case 4, 7: // PUBACK (qos 1), PUBCOMP (qos 2)
+			delete(pending, id)
+		case 5: // PUBREC: release the message
+			if _, err := m.conn.Write(mqttPacket(0x62, binary.BigEndian.AppendUint16(nil, id), nil)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mqttSink) connect(ctx context.Context) error {
+	d := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if m.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: m.tls}).DialContext(ctx, "tcp", m.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", m.addr)
+	}
+	if err != nil {
+		return err
+	}
+	flags := byte(0x02) // clean session
+	payload := mqttString(nil, m.clientID)
+	if m.username != "" {
+		flags |= 0x80
+		payload = mqttString(payload, m.username)
+		if m.password != "" {
+			flags |= 0x40
+			payload = mqttString(payload, m.password)
+		}
+	}
+	vh := mqttString(nil, "MQTT")
+	vh = append(vh, 4, flags)
+	vh = binary.BigEndian.AppendUint16(vh, uint16(m.keepalive/time.Second))
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(mqttPacket(0x10, vh, payload)); err != nil {
+		conn.Close()
+		return err
+	}
+	r := bufio.NewReader(conn)
+	typ, body, err := mqttRead(r)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("connect %s: %w", m.addr, err)
+	}
+	if typ>>4 != 2 || len(body) < 2 {
+		conn.Close()
+		return fmt.Errorf("connect %s: unexpected packet type %d", m.addr, typ>>4)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return fmt.Errorf("connect %s: refused (%s)", m.addr, mqttConnackReason(body[1]))
+	}
+	conn.SetDeadline(time.Time{})
+	m.conn, m.r = conn, r
+	return nil
+}
+
+func mqttConnackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("code %d", code)
+}
+
+// mqttTopicLevel keeps a row value inside a single topic level.
+func mqttTopicLevel(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+// mqttPacket frames a control packet: fixed header byte, remaining length, variable header, payload.
+func mqttPacket(header byte, vh, payload []byte) []byte {
+	n := len(vh) + len(payload)
+	b := []byte{header}
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	b = append(b, vh...)
+	return append(b, payload...)
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttRead(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(c&0x7f) * mult
+		if c&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+		mult *= 128
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return typ, body, err
+}
@@ -0,0 +1,135 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacket(t *testing.T) {
+	tests := []struct {
+		size   int
+		length []byte // encoded remaining length
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		p := mqttPacket(0x30, nil, make([]byte, tt.size))
+		if p[0] != 0x30 || !bytes.Equal(p[1:1+len(tt.length)], tt.length) || len(p) != 1+len(tt.length)+tt.size {
+			t.Errorf("%d bytes: header % x", tt.size, p[:1+len(tt.length)])
+		}
+		typ, body, err := mqttRead(bufio.NewReader(bytes.NewReader(p)))
+		if err != nil || typ != 0x30 || len(body) != tt.size {
+			t.Errorf("%d bytes read back as type %x, %d bytes: %v", tt.size, typ, len(body), err)
+		}
+	}
+}
+
+// TestMQTTPublish runs a batch against a broker that checks the CONNECT and PUBLISH packets
+// byte for byte and acknowledges each message.
+func TestMQTTPublish(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type packet struct {
+		typ  byte
+		body []byte
+	}
+	got := make(chan packet, 8)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			typ, body, err := mqttRead(r)
+			if err != nil {
+				close(got)
+				return
+			}
+			got <- packet{typ, body}
+			switch typ >> 4 {
+			case 1:
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00}) // CONNACK, accepted
+			case 3:
+				topic := int(binary.BigEndian.Uint16(body))
+				conn.Write(mqttPacket(0x40, body[2+topic:4+topic], nil)) // PUBACK with the packet id
+			}
+		}
+	}()
+
+	m, err := newMQTTSink(&Config{Out: "mqtt://" + ln.Addr().String() + "/edge/{State}/storms",
+		Opts: Opts{"client-id": "c1", "username": "u", "password": "p", "keepalive": "30s", "retain": "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batch := []sinkRecord{
+		{Doc: map[string]interface{}{"State": "TEXAS"}, Body: []byte(`{"n":1}`)},
+		{Doc: map[string]interface{}{"State": "a/b+#"}, Body: []byte(`{"n":2}`)},
+	}
+	if err := m.send(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	wantConnect := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 4, 0xc2, 0x00, 30,
+		0x00, 0x02, 'c', '1', 0x00, 0x01, 'u', 0x00, 0x01, 'p'}
+	wantPublish := [][]byte{
+		append([]byte("\x00\x11edge/TEXAS/storms\x00\x01"), `{"n":1}`...),
+		append([]byte("\x00\x11edge/a_b__/storms\x00\x02"), `{"n":2}`...),
+	}
+	p := <-got
+	if p.typ != 0x10 || !bytes.Equal(p.body, wantConnect) {
+		t.Errorf("CONNECT %x % x\nwant    10 % x", p.typ, p.body, wantConnect)
+	}
+	for i, want := range wantPublish {
+		p := <-got
+		// PUBLISH, qos 1, retain
+		if p.typ != 0x33 || !bytes.Equal(p.body, want) {
+			t.Errorf("PUBLISH %d: %x %q, want 33 %q", i, p.typ, p.body, want)
+		}
+	}
+	if p := <-got; p.typ != 0xe0 {
+		t.Errorf("DISCONNECT: %x", p.typ)
+	}
+}
+
+func TestMQTTConfig(t *testing.T) {
+	tests := []struct {
+		out, qos string
+		addr     string
+		ok       bool
+	}{
+		{"mqtt://broker/t", "1", "broker:1883", true},
+		{"mqtts://broker/t", "0", "broker:8883", true},
+		{"mqtt://broker:1884/t/{x}", "2", "broker:1884", true},
+		{"mqtt://broker", "1", "", false},
+		{"http://broker/t", "1", "", false},
+		{"mqtt://broker/t", "3", "", false},
+	}
+	for _, tt := range tests {
+		s, err := newMQTTSink(&Config{Out: tt.out, Opts: Opts{"qos": tt.qos}})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s qos %s: %v", tt.out, tt.qos, err)
+			continue
+		}
+		if err == nil && s.(*mqttSink).addr != tt.addr {
+			t.Errorf("%s: addr %s, want %s", tt.out, s.(*mqttSink).addr, tt.addr)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNATS is a server speaking enough of the client protocol for one connection: it records
+// every line and payload the client sends, answers PING, and acks HPUBs the way JetStream does,
+// with an error for payloads containing "big".
+func fakeNATS(t *testing.T, headers bool) (addr string, wire chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	wire = make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"x\",\"headers\":%t,\"max_payload\":1048576}\r\n", headers)
+		r := bufio.NewReader(conn)
+		var got strings.Builder
+		defer func() { wire <- got.String() }()
+		for {
+			line, err := natsLine(r)
+			if err != nil {
+				return
+			}
+			f := strings.Fields(line)
+			switch {
+			case line == "PING":
+				got.WriteString("PING\n")
+				io.WriteString(conn, "PONG\r\n")
+			case strings.HasPrefix(line, "CONNECT "):
+				var opts map[string]interface{}
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &opts)
+				fmt.Fprintf(&got, "CONNECT user=%v pass=%v headers=%v\n", opts["user"], opts["pass"], opts["headers"])
+			case f[0] == "PUB" || f[0] == "HPUB":
+				n, _ := strconv.Atoi(f[len(f)-1])
+				buf := make([]byte, n+2)
+				io.ReadFull(r, buf)
+				if f[0] == "HPUB" {
+					f[2] = "<inbox>"
+				}
+				fmt.Fprintf(&got, "%s\n%q\n", strings.Join(f, " "), buf)
+				if f[0] == "HPUB" {
+					ack := `{"stream":"STORMS","seq":1}`
+					if strings.Contains(string(buf), "big") {
+						ack = `{"error":{"code":400,"description":"message size exceeds maximum allowed"}}`
+					}
+					fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", strings.Fields(line)[2], len(ack), ack)
+				}
+			default:
+				got.WriteString(line + "\n")
+			}
+		}
+	}()
+	return ln.Addr().String(), wire
+}
+
+func TestNATSPublish(t *testing.T) {
+	addr, wire := fakeNATS(t, false)
+	n, err := newNATSSink(&Config{Out: "nats://u:p%40ss@" + addr + "/storms.{State}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = n.send(ctx, []sinkRecord{
+		{Doc: map[string]interface{}{"State": "TEXAS"}, Body: []byte(`{"n":1}`)},
+		{Doc: map[string]interface{}{"State": "NEW YORK.*"}, Body: []byte(`{"n":22}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.close()
+	want := "CONNECT user=u pass=p@ss headers=false\nPING\n" +
+		"PUB storms.TEXAS 7\n\"{\\\"n\\\":1}\\r\\n\"\n" +
+		"PUB storms.NEW_YORK__ 8\n\"{\\\"n\\\":22}\\r\\n\"\n" +
+		"PING\n"
+	if got := <-wire; got != want {
+		t.Errorf("wire:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestNATSJetStream(t *testing.T) {
+	addr, wire := fakeNATS(t, true)
+	n, err := newNATSSink(&Config{Out: "nats://" + addr + "/storms", Opts: Opts{"jetstream": "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = n.send(ctx, []sinkRecord{{Body: []byte(`"ok"`)}, {Body: []byte(`"big"`)}})
+	var rej *sinkRejected
+	if !errors.As(err, &rej) || len(rej.Records) != 1 || string(rej.Records[0].Body) != `"big"` || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Fatalf("send: %v", err)
+	}
+	n.close()
+	got := <-wire
+	// The header block carries a Nats-Msg-Id from the body: 59 bytes of header, 63 in all for "ok".
+	for _, want := range []string{"CONNECT user=<nil> pass=<nil> headers=true\n", "SUB _INBOX.", "HPUB storms <inbox> 59 63\n\"NATS/1.0\\r\\nNats-Msg-Id: "} {
+		if !strings.Contains(got, want) {
+			t.Errorf("wire lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestNATSConfig(t *testing.T) {
+	tests := []struct {
+		out  string
+		addr string
+		ok   bool
+	}{
+		{"nats://host/s", "host:4222", true},
+		{"tls://host:4443/s.{x}", "host:4443", true},
+		{"nats://host", "", false},
+		{"mqtt://host/s", "", false},
+	}
+	for _, tt := range tests {
+		s, err := newNATSSink(&Config{Out: tt.out})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.out, err)
+			continue
+		}
+		if err == nil && s.(*natsSink).addr != tt.addr {
+			t.Errorf("%s: addr %s, want %s", tt.out, s.(*natsSink).addr, tt.addr)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package sink
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Upload receives the formatted result (any --format) and streams it to an object store.
+// Close completes the upload; nothing is visible at the destination before it returns.
+type Upload interface {
+	io.Writer
+	Close() error
+	URL() string
+	Size() int64
+}
+
+// Store is one bucket (or local directory). Keys are relative to it.
+type Store interface {
+	Create(key, format string) (Upload, error)
+	List(prefix string) ([]string, error)
+	Get(key string) ([]byte, error)
+	// PutIfAbsent writes a small object unless key exists, in which case it returns
+	// ErrExists. Table logs and cursors rely on it to serialize commits.
+	PutIfAbsent(key string, data []byte) error
+}
+
+// ErrExists is returned by PutIfAbsent when the key is taken.
+var ErrExists = errors.New("object already exists")
+
+// stores maps --out URL schemes to bucket clients. For https (Azure Blob Storage) the bucket is
+// the account's host and keys start with the container; for onedrive it is the drive id.
+var stores = map[string]func(cfg *Config, bucket string) (Store, error){
+	"gs":       newGCSClient,
+	"s3":       newS3Client,
+	"https":    newAzureBlobClient,
+	"onedrive": newGraphDrive,
+}
+
+// OpenUpload opens the upload for an --out URL such as gs://bucket/path/result.ndjson, or a local
+// file such as results.parquet, which appears only once the output is complete. A URL ending in
+// '/' (or an existing local directory) is a prefix; the object is named after the current time.
+// With --gzip, or a name ending in .gz, the output is gzip-compressed and .gz is added to the
+// name if it isn't there.
+func OpenUpload(cfg *Config, format string) (Upload, error) {
+	return OpenUploadPart(cfg, format, 0)
+}
+
+// OpenUploadPart opens part n of an output split over several files: the --out name with -0001,
+// -0002, ... before its extension, as in results-0002.ndjson.gz. Part 0 is the name itself.
+// Parts named after a prefix share the time of the first one.
+func OpenUploadPart(cfg *Config, format string, part int) (Upload, error) {
+	store, key, err := OpenStore(cfg, cfg.Out, true)
+	if err != nil {
+		return nil, fmt.Errorf("--out %w", err)
+	}
+	if l, ok := store.(localStore); ok {
+		if fi, err := os.Stat(l.dir); !strings.HasSuffix(cfg.Out, "/") && (err != nil || !fi.IsDir()) {
+			store, key = localStore{dir: filepath.Dir(l.dir)}, filepath.Base(l.dir)
+		}
+	}
+	gz := cfg.Gzip || strings.HasSuffix(key, ".gz")
+	if key == "" || strings.HasSuffix(key, "/") {
+		// A prefix: name the object after the run so scheduled runs don't overwrite each other.
+		if cfg.stamp == "" {
+			cfg.stamp = time.Now().UTC().Format("20060102T150405Z")
+		}
+		key += cfg.stamp + "." + FormatExt(format)
+	}
+	if gz && !strings.HasSuffix(key, ".gz") {
+		key += ".gz"
+	}
+	if part > 0 {
+		key = partKey(key, part)
+	}
+	if !gz {
+		return store.Create(key, format)
+	}
+	u, err := store.Create(key, "gzip")
+	if err != nil {
+		return nil, err
+	}
+	return &gzipUpload{Upload: u, gz: gzip.NewWriter(u)}, nil
+}
+
+// partKey inserts -NNNN before the extensions of key's last element.
+func partKey(key string, part int) string {
+	dir, name := path.Split(filepath.ToSlash(key))
+	ext := ""
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name, ext = name[:i], name[i:]
+	}
+	return filepath.FromSlash(fmt.Sprintf("%s%s-%04d%s", dir, name, part, ext))
+}
+
+// gzipUpload compresses what is written to it into an upload. Size counts compressed bytes.
+type gzipUpload struct {
+	Upload
+	gz *gzip.Writer
+}
+
+func (g *gzipUpload) Write(p []byte) (int, error) { return g.gz.Write(p) }
+
+func (g *gzipUpload) Close() error {
+	if err := g.gz.Close(); err != nil {
+		return err
+	}
+	return g.Upload.Close()
+}
+
+// OpenStore splits an object URL into its bucket client and the key or prefix inside it.
+// With local set, a URL without a scheme (or file://) is a directory on the local filesystem.
+func OpenStore(cfg *Config, location string, local bool) (Store, string, error) {
+	scheme, rest, ok := strings.Cut(location, "://")
+	if local && (!ok || scheme == "file") {
+		dir := location
+		if ok {
+			dir = rest
+		}
+		return localStore{dir: dir}, "", nil
+	}
+	f, known := stores[scheme]
+	if !ok || !known {
+		schemes := make([]string, 0, len(stores))
+		for s := range stores {
+			schemes = append(schemes, s+"://")
+		}
+		sort.Strings(schemes)
+		return nil, "", fmt.Errorf("%q is not an object URL (%s)", location, strings.Join(schemes, ", "))
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, "", fmt.Errorf("%q: expected %s://<bucket>/<object> or %s://<bucket>/<prefix>/", location, scheme, scheme)
+	}
+	store, err := f(cfg, bucket)
+	if err != nil {
+		return nil, "", err
+	}
+	return store, key, nil
+}
+
+// FormatExt is the file extension for objects named after a prefix.
+func FormatExt(format string) string {
+	switch format {
+	case "protobuf", "proto":
+		return "pb"
+	case "arrow":
+		return "arrows"
+	case "ndjson-typed", "":
+		return "ndjson"
+	}
+	return format
+}
+
+// FormatContentType is the Content-Type stored with uploaded objects.
+func FormatContentType(format string) string {
+	switch format {
+	case "ndjson", "ndjson-typed":
+		return "application/x-ndjson"
+	case "json":
+		return "application/json"
+	case "msgpack":
+		return "application/msgpack"
+	case "protobuf", "proto":
+		return "application/x-protobuf"
+	case "xlsx":
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case "csv":
+		return "text/csv"
+	case "parquet":
+		return "application/vnd.apache.parquet"
+	case "arrow":
+		return "application/vnd.apache.arrow.stream"
+	case "gzip":
+		return "application/gzip"
+	}
+	return "application/octet-stream"
+}
+
+// httpError is a non-2xx answer from an object store API.
+type httpError struct {
+	Status int
+	msg    string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+// httpDo sends req, marking network failures as retryable.
+func httpDo(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	var ne net.Error
+	if err != nil && errors.As(err, &ne) && req.Context().Err() == nil {
+		return nil, retryableSinkErr{err}
+	}
+	return resp, err
+}
+
+// httpStatusError reads an error answer; throttling and 5xx are retryable.
+func httpStatusError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	err := &httpError{Status: resp.StatusCode, msg: fmt.Sprintf("%s %s: %s %s",
+		resp.Request.Method, resp.Request.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return retryableSinkErr{err}
+	}
+	return err
+}
+
+// localStore is an Store over a local directory, for table outputs written to disk or to a
+// mounted share. Objects are written to a temporary name and renamed into place on Close.
+type localStore struct {
+	dir string
+}
+
+func (l localStore) path(key string) string { return filepath.Join(l.dir, filepath.FromSlash(key)) }
+
+func (l localStore) Create(key, _ string) (Upload, error) {
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &fileUpload{f: f, path: path}, nil
+}
+
+func (l localStore) List(prefix string) ([]string, error) {
+	dir, _ := filepath.Split(filepath.FromSlash(prefix))
+	entries, err := os.ReadDir(filepath.Join(l.dir, dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		key := filepath.ToSlash(filepath.Join(dir, e.Name()))
+		if !e.IsDir() && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (l localStore) Get(key string) ([]byte, error) { return os.ReadFile(l.path(key)) }
+
+func (l localStore) PutIfAbsent(key string, data []byte) error {
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if os.IsExist(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+type fileUpload struct {
+	f    *os.File
+	path string
+	size int64
+}
+
+func (u *fileUpload) Write(p []byte) (int, error) {
+	n, err := u.f.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *fileUpload) Close() error {
+	if err := u.f.Close(); err != nil {
+		os.Remove(u.f.Name())
+		return err
+	}
+	return os.Rename(u.f.Name(), u.path)
+}
+
+func (u *fileUpload) URL() string { return u.path }
+
+func (u *fileUpload) Size() int64 { return u.size }
@@ -0,0 +1,74 @@
+package sink
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenUploadLocal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out", "results.parquet")
+	u, err := OpenUpload(&Config{Out: path, Opts: Opts{}}, "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Write([]byte("PAR1"))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s exists before Close", path)
+	}
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "PAR1" || u.URL() != path {
+		t.Errorf("after Close: %q, %v (URL %s)", b, err, u.URL())
+	}
+
+	// An existing directory gets a file named after the run.
+	u, err = OpenUpload(&Config{Out: dir, Opts: Opts{}}, "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Close()
+	if filepath.Dir(u.URL()) != dir || !strings.HasSuffix(u.URL(), ".csv") {
+		t.Errorf("directory upload written to %s", u.URL())
+	}
+}
+
+func TestOpenUploadGzipParts(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Out: filepath.Join(dir, "results.ndjson"), Opts: Opts{}, Gzip: true}
+	u, err := OpenUploadPart(cfg, "ndjson", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Write([]byte(`{"a":1}` + "\n"))
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "results-0002.ndjson.gz"); u.URL() != want {
+		t.Fatalf("URL = %s, want %s", u.URL(), want)
+	}
+	f, _ := os.Open(u.URL())
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(gz); err != nil || string(b) != `{"a":1}`+"\n" {
+		t.Errorf("decompressed %q, %v", b, err)
+	}
+
+	// Parts under a prefix share the first part's time.
+	cfg = &Config{Out: dir + "/", Opts: Opts{}}
+	a, _ := OpenUploadPart(cfg, "csv", 1)
+	a.Close()
+	b, _ := OpenUploadPart(cfg, "csv", 2)
+	b.Close()
+	if strings.TrimSuffix(a.URL(), "-0001.csv") != strings.TrimSuffix(b.URL(), "-0002.csv") {
+		t.Errorf("parts %s and %s differ in more than the part number", a.URL(), b.URL())
+	}
+}
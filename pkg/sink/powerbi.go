@@ -0,0 +1,217 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// powerBISink writes the primary result into a folder laid out for Power BI: a CSV file per
+// entity, a Common Data Model manifest describing them, and a refresh marker per entity.
+//
+//	<out>/model.json                    the entities, their columns and types, and their files
+//	<out>/<entity>/<entity>.csv         the rows, with a header row; replaced on each run
+//	<out>/<entity>/_last_refresh.json   when the entity was last written, with its row count
+//
+// --out is the folder: a local directory (or file://), https://<account>.blob.core.windows.net/
+// <container>/<path>, onedrive://<drive-id>/<path>, gs://bucket/path or s3://bucket/path. The CSV
+// file keeps its name, so a report's source doesn't change between refreshes, and appears only
+// once complete; model.json and the marker are updated after it, so a failed run leaves the
+// previous refresh in place. An empty result still replaces the file, with just the header.
+//
+// Several entities can share a folder, one scheduled query each: a run replaces its own entity
+// in model.json and keeps the others, along with anything else in the manifest. Runs writing
+// to the same folder must not overlap, since model.json is read, changed and written back.
+//
+// Options (--sink-opt):
+//
+//	entity=<name>             the entity's name, its table in Power BI (default Result)
+//	model=<name>              the model's name in a new model.json (default kusto-export)
+//
+// Column types: bool → boolean, int and long → int64, real → double, decimal → decimal,
+// datetime → dateTime, guid → guid; string, timespan and dynamic → string.
+type powerBISink struct {
+	out    string
+	store  Store
+	prefix string // folder inside the store, "" or ending in '/'
+	entity string
+	model  string
+
+	table  *encode.Table
+	upload Upload
+	csv    encode.Encoder
+	rows   int64
+}
+
+func newPowerBISink(cfg *Config) (encode.Encoder, error) {
+	if cfg.Out == "" {
+		return nil, fmt.Errorf("--out must be the folder (a directory, https://<account>.blob.core.windows.net/<container>/<path>, onedrive://<drive-id>/<path>, gs:// or s3://)")
+	}
+	store, key, err := OpenStore(cfg, cfg.Out, true)
+	if err != nil {
+		return nil, fmt.Errorf("--out %w", err)
+	}
+	p := &powerBISink{out: cfg.Out, store: store, prefix: strings.TrimSuffix(key, "/"),
+		entity: cfg.Opt("entity", "Result"), model: cfg.Opt("model", "kusto-export")}
+	if p.prefix != "" {
+		p.prefix += "/"
+	}
+	if p.entity == "" || strings.ContainsAny(p.entity, `/\."`) || strings.HasPrefix(p.entity, "_") {
+		return nil, fmt.Errorf("entity %q: want a name without / \\ . or \" that doesn't start with _", p.entity)
+	}
+	return p, nil
+}
+
+func (p *powerBISink) Begin(t *encode.Table) error {
+	if t.Kind != "PrimaryResult" {
+		return nil
+	}
+	if p.table != nil {
+		fmt.Fprintf(os.Stderr, "WARN powerbi: skipping table %s; only the first primary result is written\n", t.Name)
+		return nil
+	}
+	p.table = t
+	var err error
+	if p.upload, err = p.store.Create(p.entityKey(p.entity+".csv"), "csv"); err != nil {
+		return err
+	}
+	if p.csv, err = encode.New("csv", p.upload, encode.Options{}); err != nil {
+		return err
+	}
+	return p.csv.Begin(t)
+}
+
+func (p *powerBISink) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if t != p.table {
+		return nil
+	}
+	p.rows++
+	return p.csv.WriteRow(t, index, vals)
+}
+
+func (p *powerBISink) End() error {
+	if p.table == nil {
+		fmt.Fprintf(os.Stderr, "POWERBI %s: no primary result, nothing written\n", p.out)
+		return nil
+	}
+	if err := p.csv.End(); err != nil {
+		return fmt.Errorf("powerbi: write %s: %w", p.upload.URL(), err)
+	}
+	if err := p.upload.Close(); err != nil {
+		return fmt.Errorf("powerbi: write %s: %w", p.upload.URL(), err)
+	}
+	refreshed := time.Now().UTC().Format(time.RFC3339)
+	model, err := p.manifest(refreshed)
+	if err != nil {
+		return err
+	}
+	if err := p.put(p.prefix+"model.json", model); err != nil {
+		return fmt.Errorf("powerbi: write model.json: %w", err)
+	}
+	marker, _ := json.MarshalIndent(map[string]interface{}{
+		"entity":      p.entity,
+		"refreshTime": refreshed,
+		"rows":        p.rows,
+		"bytes":       p.upload.Size(),
+		"location":    p.upload.URL(),
+	}, "", "  ")
+	if err := p.put(p.entityKey("_last_refresh.json"), marker); err != nil {
+		return fmt.Errorf("powerbi: write refresh marker: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "POWERBI %s: refreshed entity %s (%d rows in %s)\n", p.out, p.entity, p.rows, p.upload.URL())
+	return nil
+}
+
+func (p *powerBISink) entityKey(name string) string { return p.prefix + p.entity + "/" + name }
+
+// manifest is model.json with this run's entity in it, replacing an entity of the same name.
+func (p *powerBISink) manifest(refreshed string) ([]byte, error) {
+	model := map[string]interface{}{"name": p.model, "version": "1.0"}
+	data, err := p.store.Get(p.prefix + "model.json")
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &model); err != nil {
+			return nil, fmt.Errorf("powerbi: the folder's model.json isn't JSON: %v", err)
+		}
+	case !notFound(err):
+		return nil, fmt.Errorf("powerbi: read model.json: %w", err)
+	}
+	attrs := make([]map[string]string, len(p.table.Columns))
+	for i, c := range p.table.Columns {
+		attrs[i] = map[string]string{"name": c.Name(), "dataType": cdmDataType(c.Type())}
+	}
+	entity := map[string]interface{}{
+		"$type":      "LocalEntity",
+		"name":       p.entity,
+		"attributes": attrs,
+		"partitions": []interface{}{map[string]interface{}{
+			"name":        p.entity,
+			"refreshTime": refreshed,
+			"location":    p.upload.URL(),
+			"fileFormatSettings": map[string]interface{}{
+				"$type":         "CsvFormatSettings",
+				"columnHeaders": true,
+				"delimiter":     ",",
+				"quoteStyle":    "QuoteStyle.Csv",
+				"csvStyle":      "CsvStyle.QuoteAfterDelimiter",
+			},
+		}},
+	}
+	entities, _ := model["entities"].([]interface{})
+	kept := []interface{}{}
+	for _, e := range entities {
+		if m, ok := e.(map[string]interface{}); !ok || m["name"] != p.entity {
+			kept = append(kept, e)
+		}
+	}
+	model["entities"] = append(kept, entity)
+	model["modifiedTime"] = refreshed
+	return json.MarshalIndent(model, "", "  ")
+}
+
+// put writes a small object, replacing what is there.
+func (p *powerBISink) put(key string, data []byte) error {
+	u, err := p.store.Create(key, "json")
+	if err != nil {
+		return err
+	}
+	if _, err := u.Write(data); err != nil {
+		return err
+	}
+	return u.Close()
+}
+
+// notFound reports whether a Store's Get failed because the object doesn't exist.
+func notFound(err error) bool {
+	var he *httpError
+	return errors.Is(err, fs.ErrNotExist) || (errors.As(err, &he) && he.Status == http.StatusNotFound)
+}
+
+// cdmDataType is the Common Data Model type of a column.
+func cdmDataType(t types.Column) string {
+	switch t {
+	case types.Bool:
+		return "boolean"
+	case types.Int, types.Long:
+		return "int64"
+	case types.Real:
+		return "double"
+	case types.Decimal:
+		return "decimal"
+	case types.DateTime:
+		return "dateTime"
+	case types.GUID:
+		return "guid"
+	}
+	return "string"
+}
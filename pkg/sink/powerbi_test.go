@@ -0,0 +1,76 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestPowerBISink(t *testing.T) {
+	dir := t.TempDir()
+	write := func(entity string, rows ...value.Values) {
+		t.Helper()
+		enc, err := New(&Config{Type: "powerbi", Out: dir, Opts: Opts{"entity": entity}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+			query.NewColumn(0, "State", types.String), query.NewColumn(1, "Count", types.Long)}}
+		if err := enc.Begin(table); err != nil {
+			t.Fatal(err)
+		}
+		for i, r := range rows {
+			if err := enc.WriteRow(table, i, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.End(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Storms", value.Values{value.NewString("TEXAS"), value.NewLong(3)})
+	write("Floods")
+	write("Storms", value.Values{value.NewString("OHIO"), value.NewLong(1)}, value.Values{value.NewString("UTAH"), value.NewLong(2)})
+
+	if b, _ := os.ReadFile(filepath.Join(dir, "Storms", "Storms.csv")); string(b) != "State,Count\r\nOHIO,1\r\nUTAH,2\r\n" {
+		t.Errorf("Storms.csv = %q", b)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "Floods", "Floods.csv")); string(b) != "State,Count\r\n" {
+		t.Errorf("Floods.csv = %q, want just the header", b)
+	}
+	var model struct {
+		Name     string
+		Entities []struct {
+			Name       string
+			Attributes []struct{ Name, DataType string }
+			Partitions []struct{ Location string }
+		}
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "model.json"))
+	if err := json.Unmarshal(b, &model); err != nil {
+		t.Fatal(err)
+	}
+	if model.Name != "kusto-export" || len(model.Entities) != 2 || model.Entities[0].Name != "Floods" || model.Entities[1].Name != "Storms" {
+		t.Fatalf("model.json: %s", b)
+	}
+	storms := model.Entities[1]
+	if len(storms.Attributes) != 2 || storms.Attributes[1].DataType != "int64" || storms.Partitions[0].Location != filepath.Join(dir, "Storms", "Storms.csv") {
+		t.Errorf("Storms entity: %+v", storms)
+	}
+	var marker struct{ Rows int64 }
+	b, _ = os.ReadFile(filepath.Join(dir, "Storms", "_last_refresh.json"))
+	if json.Unmarshal(b, &marker); marker.Rows != 2 {
+		t.Errorf("refresh marker: %s", b)
+	}
+
+	if _, err := New(&Config{Type: "powerbi", Out: dir, Opts: Opts{"entity": "../x"}}); err == nil {
+		t.Error("an entity name with a path was accepted")
+	}
+}
@@ -0,0 +1,162 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers RESP2 commands on every connection and records the data commands it got,
+// one line each, with MULTI/EXEC around a transaction.
+type fakeRedis struct {
+	mu   sync.Mutex
+	cmds []string
+}
+
+func (f *fakeRedis) serve(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.conn(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (f *fakeRedis) conn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued []string
+	multi := false
+	for {
+		args, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		reply := "+OK\r\n"
+		switch cmd {
+		case "HELLO":
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		case "XADD":
+			reply = "$3\r\n1-0\r\n"
+		case "DEL", "HSET", "EXPIRE":
+			reply = ":1\r\n"
+		}
+		if cmd != "HELLO" && cmd != "CLIENT" {
+			f.mu.Lock()
+			f.cmds = append(f.cmds, strings.Join(append([]string{cmd}, args[1:]...), " "))
+			f.mu.Unlock()
+		}
+		switch {
+		case cmd == "MULTI":
+			multi = true
+		case cmd == "EXEC":
+			reply = fmt.Sprintf("*%d\r\n%s", len(queued), strings.Join(queued, ""))
+			multi, queued = false, nil
+		case multi:
+			queued = append(queued, reply)
+			reply = "+QUEUED\r\n"
+		}
+		io.WriteString(conn, reply)
+	}
+}
+
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("not an array: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisSink(t *testing.T) {
+	batch := []sinkRecord{
+		{Table: "PrimaryResult", Doc: map[string]interface{}{"_kind": "row", "_rowIndex": 0, "_table": "PrimaryResult", "Id": 7, "State": "TEXAS"}, Body: []byte(`{"Id":7,"State":"TEXAS"}`)},
+	}
+	tests := []struct {
+		name string
+		opts Opts
+		want []string
+	}{
+		{name: "stream of JSON rows", opts: Opts{}, want: []string{`XADD kusto:PrimaryResult * row {"Id":7,"State":"TEXAS"}`}},
+		{name: "stream of columns, trimmed", opts: Opts{"key": "storms", "fields": "columns", "maxlen": "1000"},
+			want: []string{"XADD storms maxlen ~ 1000 * Id 7 State TEXAS _table PrimaryResult"}},
+		{name: "keyed JSON with a TTL", opts: Opts{"mode": "set", "key": "storm:{Id}", "ttl": "1h"},
+			want: []string{`SET storm:7 {"Id":7,"State":"TEXAS"} ex 3600`}},
+		{name: "hash replaced in a transaction", opts: Opts{"mode": "hash", "key": "storm:{Id}", "ttl": "90s"},
+			want: []string{"MULTI", "DEL storm:7", "HSET storm:7 Id 7 State TEXAS _table PrimaryResult", "EXPIRE storm:7 90", "EXEC"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeRedis{}
+			s, err := newRedisSink(&Config{Out: "redis://" + f.serve(t) + "/0", Opts: tt.opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.send(ctx, batch); err != nil {
+				t.Fatal(err)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if strings.Join(f.cmds, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.cmds, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestRedisConfig(t *testing.T) {
+	tests := []struct {
+		opts Opts
+		err  string
+	}{
+		{Opts{"mode": "set"}, "needs --sink-opt key"},
+		{Opts{"mode": "list"}, "mode must be stream, set or hash"},
+		{Opts{"fields": "xml"}, "fields must be json or columns"},
+		{Opts{"ttl": "soon"}, "sink option ttl"},
+	}
+	for _, tt := range tests {
+		if _, err := newRedisSink(&Config{Out: "redis://localhost:6379", Opts: tt.opts}); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: error %v, want %q", tt.opts, err, tt.err)
+		}
+	}
+	if _, err := newRedisSink(&Config{Out: "http://localhost"}); err == nil {
+		t.Error("http URL accepted")
+	}
+}
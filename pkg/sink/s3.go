@@ -0,0 +1,532 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Client talks to one S3 bucket. It implements Store: create streams an object with a
+// multipart upload, sending part-size bytes per part (default 8MiB, at least the 5MiB S3
+// minimum). Results smaller than one part are sent with a single PUT. A failed run aborts the
+// multipart upload, so no parts linger.
+//
+// Options (--sink-opt):
+//
+//	region=<region>           default AWS_REGION, AWS_DEFAULT_REGION, then us-east-1
+//	profile=<name>            shared credentials profile (default AWS_PROFILE or "default")
+//	sse=AES256|aws:kms        server-side encryption
+//	sse-kms-key-id=<key>      KMS key for sse=aws:kms (default: the account's aws/s3 key)
+//	endpoint=<url>            S3-compatible endpoint (e.g. MinIO); uses path-style addressing
+//	part-size=<bytes>
+//
+// Credentials come from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY (and AWS_SESSION_TOKEN), then the
+// shared credentials file (~/.aws/credentials or AWS_SHARED_CREDENTIALS_FILE), then the EC2
+// instance role via IMDSv2.
+type s3Client struct {
+	bucket   string
+	region   string
+	base     string // bucket URL, ending in '/'
+	creds    *awsCredentials
+	sse      string
+	kmsKey   string
+	partSize int
+	timeout  time.Duration
+	retries  int
+	client   *http.Client
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func newS3Client(cfg *Config, bucket string) (Store, error) {
+	s := &s3Client{
+		bucket: bucket,
+		region: cfg.Opt("region", firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")),
+		sse:    cfg.Opt("sse", ""),
+		kmsKey: cfg.Opt("sse-kms-key-id", ""),
+		client: &http.Client{},
+	}
+	switch s.sse {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, fmt.Errorf("sse must be AES256 or aws:kms, not %q", s.sse)
+	}
+	if s.kmsKey != "" && s.sse != "aws:kms" {
+		return nil, fmt.Errorf("sse-kms-key-id needs sse=aws:kms")
+	}
+	var err error
+	if s.partSize, err = cfg.intOpt("part-size", 8<<20); err != nil {
+		return nil, err
+	}
+	if s.partSize < 5<<20 {
+		return nil, fmt.Errorf("part-size must be at least 5MiB (S3 minimum)")
+	}
+	if s.timeout, err = cfg.durationOpt("timeout", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if s.retries, err = cfg.intOpt("retries", 5); err != nil {
+		return nil, err
+	}
+	if s.creds, err = newAWSCredentials(cfg.Opt("profile", os.Getenv("AWS_PROFILE"))); err != nil {
+		return nil, err
+	}
+	if ep := cfg.Opt("endpoint", ""); ep != "" {
+		u, err := url.Parse(ep)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("endpoint must be a URL, got %q", ep)
+		}
+		s.base = u.Scheme + "://" + u.Host + "/" + awsURIEncode(bucket, true) + "/"
+	} else {
+		s.base = "https://" + bucket + ".s3." + s.region + ".amazonaws.com/"
+	}
+	return s, nil
+}
+
+func (s *s3Client) Create(key, format string) (Upload, error) {
+	return &s3Upload{s3Client: s, key: key, ctype: FormatContentType(format)}, nil
+}
+
+func (s *s3Client) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := "list-type=2&prefix=" + awsURIEncode(prefix, true)
+		if token != "" {
+			q = "continuation-token=" + awsURIEncode(token, true) + "&" + q
+		}
+		raw, err := s.request(http.MethodGet, "", q, nil, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("s3: list s3://%s/%s: %w", s.bucket, prefix, err)
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(raw, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !page.IsTruncated {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3Client) Get(key string) ([]byte, error) {
+	data, err := s.request(http.MethodGet, key, "", nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("s3: get s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return data, nil
+}
+
+// PutIfAbsent uses a conditional write (If-None-Match: *), which S3 answers with 412 when the
+// key exists.
+func (s *s3Client) PutIfAbsent(key string, data []byte) error {
+	headers := s.sseHeaders("application/json")
+	headers["If-None-Match"] = "*"
+	_, err := s.request(http.MethodPut, key, "", data, headers, nil)
+	var he *httpError
+	if errors.As(err, &he) && (he.Status == http.StatusPreconditionFailed || he.Status == http.StatusConflict) {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("s3: put s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return nil
+}
+
+func (s *s3Client) sseHeaders(ctype string) map[string]string {
+	h := map[string]string{"Content-Type": ctype}
+	if s.sse != "" {
+		h["X-Amz-Server-Side-Encryption"] = s.sse
+	}
+	if s.kmsKey != "" {
+		h["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = s.kmsKey
+	}
+	return h
+}
+
+// request sends a signed request with retries and returns the response body of a 2xx answer.
+func (s *s3Client) request(method, key, query string, body []byte, headers map[string]string, onOK func(*http.Response)) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	var out []byte
+	err := retrySend(ctx, s.retries, func() error {
+		u := s.base + awsURIEncode(key, false)
+		if query != "" {
+			u += "?" + query
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		creds, err := s.creds.get(ctx)
+		if err != nil {
+			return err
+		}
+		awsSign(req, body, creds, s.region, "s3", time.Now())
+		resp, err := httpDo(s.client, req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return httpStatusError(resp)
+		}
+		if onOK != nil {
+			onOK(resp)
+		}
+		out, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return out, err
+}
+
+// s3Upload is one object being written, as a multipart upload once it outgrows a part.
+type s3Upload struct {
+	*s3Client
+	key   string
+	ctype string
+
+	uploadID string
+	parts    []s3Part
+	buf      []byte
+	size     int64
+}
+
+func (s *s3Upload) URL() string { return "s3://" + s.bucket + "/" + s.key }
+
+func (s *s3Upload) Size() int64 { return s.size }
+
+func (s *s3Upload) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	s.size += int64(len(p))
+	for len(s.buf) >= s.partSize {
+		if err := s.uploadPart(s.buf[:s.partSize]); err != nil {
+			s.abort()
+			return 0, err
+		}
+		s.buf = append(s.buf[:0], s.buf[s.partSize:]...)
+	}
+	return len(p), nil
+}
+
+func (s *s3Upload) Close() error {
+	if s.uploadID == "" {
+		// Everything fit in one part: a plain PUT is one request instead of three.
+		if _, err := s.request(http.MethodPut, s.key, "", s.buf, s.sseHeaders(s.ctype), nil); err != nil {
+			return fmt.Errorf("s3: put %s: %w", s.URL(), err)
+		}
+		return nil
+	}
+	if len(s.buf) > 0 {
+		if err := s.uploadPart(s.buf); err != nil {
+			s.abort()
+			return err
+		}
+		s.buf = nil
+	}
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: s.parts})
+	resp, err := s.request(http.MethodPost, s.key, "uploadId="+url.QueryEscape(s.uploadID), body, nil, nil)
+	if err == nil && bytes.Contains(resp, []byte("<Error>")) {
+		// CompleteMultipartUpload can fail after answering 200.
+		err = fmt.Errorf("%s", bytes.TrimSpace(resp))
+	}
+	if err != nil {
+		s.abort()
+		return fmt.Errorf("s3: complete upload %s: %w", s.URL(), err)
+	}
+	return nil
+}
+
+func (s *s3Upload) uploadPart(data []byte) error {
+	if s.uploadID == "" {
+		resp, err := s.request(http.MethodPost, s.key, "uploads=", nil, s.sseHeaders(s.ctype), nil)
+		if err != nil {
+			return fmt.Errorf("s3: start upload %s: %w", s.URL(), err)
+		}
+		var r struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(resp, &r); err != nil || r.UploadID == "" {
+			return fmt.Errorf("s3: start upload %s: no UploadId in %q", s.URL(), resp)
+		}
+		s.uploadID = r.UploadID
+	}
+	n := len(s.parts) + 1
+	var etag string
+	_, err := s.request(http.MethodPut, s.key, fmt.Sprintf("partNumber=%d&uploadId=%s", n, url.QueryEscape(s.uploadID)), data, nil,
+		func(resp *http.Response) { etag = resp.Header.Get("ETag") })
+	if err != nil {
+		return fmt.Errorf("s3: upload part %d of %s: %w", n, s.URL(), err)
+	}
+	s.parts = append(s.parts, s3Part{PartNumber: n, ETag: etag})
+	return nil
+}
+
+func (s *s3Upload) abort() {
+	if s.uploadID == "" {
+		return
+	}
+	if _, err := s.request(http.MethodDelete, s.key, "uploadId="+url.QueryEscape(s.uploadID), nil, nil, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN s3: abort multipart upload %s: %v\n", s.uploadID, err)
+	}
+	s.uploadID = ""
+}
+
+// awsCreds is one set of AWS access keys.
+type awsCreds struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// awsCredentials resolves and caches credentials; instance role keys are refreshed before expiry.
+type awsCredentials struct {
+	mu     sync.Mutex
+	static *awsCreds
+	cur    *awsCreds
+}
+
+func newAWSCredentials(profile string) (*awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" && profile == "" {
+		return &awsCredentials{static: &awsCreds{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}}, nil
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".aws", "credentials")
+		}
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	if c, err := readAWSProfile(path, profile); err == nil {
+		return &awsCredentials{static: c}, nil
+	} else if !os.IsNotExist(err) || os.Getenv("AWS_PROFILE") != "" {
+		return nil, fmt.Errorf("aws credentials: %w", err)
+	}
+	return &awsCredentials{}, nil // instance role, fetched on first use
+}
+
+func (a *awsCredentials) get(ctx context.Context) (*awsCreds, error) {
+	if a.static != nil {
+		return a.static, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cur != nil && time.Until(a.cur.Expiration) > 5*time.Minute {
+		return a.cur, nil
+	}
+	c, err := imdsCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("aws credentials: no AWS_ACCESS_KEY_ID, shared credentials file or instance role: %w", err)
+	}
+	a.cur = c
+	return c, nil
+}
+
+// readAWSProfile reads aws_access_key_id/aws_secret_access_key/aws_session_token from an INI file.
+func readAWSProfile(path, profile string) (*awsCreds, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c awsCreds
+	in := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			in = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !in || !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			c.AccessKeyID = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			c.SecretAccessKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			c.SessionToken = strings.TrimSpace(v)
+		}
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("%s: profile %q has no access keys", path, profile)
+	}
+	return &c, sc.Err()
+}
+
+// imdsCredentials fetches the instance role's keys from the EC2 metadata service (IMDSv2).
+func imdsCredentials(ctx context.Context) (*awsCreds, error) {
+	const base = "http://169.254.169.254/latest"
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	call := func(method, path, token string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, method, base+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		} else {
+			req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	token, err := call(http.MethodPut, "/api/token", "")
+	if err != nil {
+		return nil, err
+	}
+	role, err := call(http.MethodGet, "/meta-data/iam/security-credentials/", string(token))
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	raw, err := call(http.MethodGet, "/meta-data/iam/security-credentials/"+name, string(token))
+	if err != nil {
+		return nil, err
+	}
+	var r struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, err
+	}
+	return &awsCreds{AccessKeyID: r.AccessKeyID, SecretAccessKey: r.SecretAccessKey, SessionToken: r.Token, Expiration: r.Expiration}, nil
+}
+
+// awsSign adds Signature Version 4 headers to req. All headers already set on req are signed,
+// plus host, x-amz-date, x-amz-content-sha256 and x-amz-security-token.
+func awsSign(req *http.Request, body []byte, c *awsCreds, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path, strings.Join(pairs, "&"), canonHeaders.String(), signed, payload}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	creq := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(creq[:])
+
+	key := []byte("AWS4" + c.SecretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.AccessKeyID, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters (and '/' unless encodeSlash).
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
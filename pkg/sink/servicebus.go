@@ -0,0 +1,262 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// serviceBusSink sends rows to a Service Bus queue or topic through the REST batch API
+// (POST https://<ns>.servicebus.windows.net/<entity>/messages). Each row becomes one message
+// whose body is the NDJSON row object.
+//
+// Options (--sink-opt):
+//
+//	session-column=<col>      set SessionId from this column (required for session-enabled entities)
+//	message-id=hash|none      hash (default) derives MessageId from the body, for duplicate detection
+//	ttl=<duration>            message TimeToLive; expired messages are dead-lettered by the broker
+//	                          when the entity has dead-lettering on expiration enabled
+//	max-batch-bytes=<n>       cap on a send request (default 256000, the standard tier limit)
+//	retries=<n>               attempts for throttled/5xx sends (default 5)
+//	connection-string=<cs>    use a SAS connection string instead of Azure AD (also
+//	                          SERVICEBUS_CONNECTION_STRING)
+//
+// Messages the broker refuses (oversized or malformed) are isolated by splitting the batch and
+// handed back as rejected, so --sink-opt dead-letter=<file> keeps them instead of failing the run.
+type serviceBusSink struct {
+	endpoint   string
+	auth       func(ctx context.Context) (string, error)
+	sessionCol string
+	messageID  string
+	ttl        time.Duration
+	maxBytes   int
+	retries    int
+	client     *http.Client
+}
+
+func newServiceBusSink(cfg *Config) (rowSink, error) {
+	s := &serviceBusSink{
+		sessionCol: cfg.Opt("session-column", ""),
+		messageID:  cfg.Opt("message-id", "hash"),
+		client:     &http.Client{},
+	}
+	var err error
+	if s.ttl, err = cfg.durationOpt("ttl", 0); err != nil {
+		return nil, err
+	}
+	if s.maxBytes, err = cfg.intOpt("max-batch-bytes", 256000); err != nil {
+		return nil, err
+	}
+	if s.retries, err = cfg.intOpt("retries", 5); err != nil {
+		return nil, err
+	}
+	if s.messageID != "hash" && s.messageID != "none" {
+		return nil, fmt.Errorf("message-id must be hash or none, not %q", s.messageID)
+	}
+
+	cs := cfg.Opt("connection-string", os.Getenv("SERVICEBUS_CONNECTION_STRING"))
+	var host, entity string
+	if cfg.Out != "" {
+		u, err := url.Parse(cfg.Out)
+		if err != nil || u.Scheme != "sb" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return nil, fmt.Errorf("--out must be sb://<namespace>/<queue-or-topic>, got %q", cfg.Out)
+		}
+		host, entity = u.Host, strings.Trim(u.Path, "/")
+		if !strings.Contains(host, ".") {
+			host += ".servicebus.windows.net"
+		}
+	}
+
+	if cs != "" {
+		parts := parseConnectionString(cs)
+		if host == "" {
+			ep, err := url.Parse(parts["endpoint"])
+			if err != nil || ep.Host == "" {
+				return nil, fmt.Errorf("connection string has no Endpoint")
+			}
+			host = ep.Host
+		}
+		if entity == "" {
+			entity = parts["entitypath"]
+		}
+		keyName, key := parts["sharedaccesskeyname"], parts["sharedaccesskey"]
+		if keyName == "" || key == "" {
+			return nil, fmt.Errorf("connection string needs SharedAccessKeyName and SharedAccessKey")
+		}
+		resource := "https://" + host + "/" + entity
+		s.auth = func(context.Context) (string, error) {
+			return serviceBusSAS(resource, keyName, key, time.Hour), nil
+		}
+	} else {
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create credential: %w", err)
+		}
+		s.auth = func(ctx context.Context) (string, error) {
+			tok, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://servicebus.azure.net/.default"}})
+			if err != nil {
+				return "", err
+			}
+			return "Bearer " + tok.Token, nil
+		}
+	}
+	if host == "" || entity == "" {
+		return nil, fmt.Errorf("set --out sb://<namespace>/<entity> (or an EntityPath in the connection string)")
+	}
+	s.endpoint = "https://" + host + "/" + entity + "/messages"
+	return s, nil
+}
+
+func (s *serviceBusSink) maxBatchBytes() int { return s.maxBytes }
+
+func (s *serviceBusSink) close() error { return nil }
+
+// serviceBusMessage is one element of the application/vnd.microsoft.servicebus.json batch body.
+type serviceBusMessage struct {
+	Body             string                 `json:"Body"`
+	BrokerProperties map[string]interface{} `json:"BrokerProperties,omitempty"`
+	UserProperties   map[string]interface{} `json:"UserProperties,omitempty"`
+}
+
+func (s *serviceBusSink) send(ctx context.Context, batch []sinkRecord) error {
+	err := retrySend(ctx, s.retries, func() error { return s.post(ctx, batch) })
+	var bad badBatchErr
+	if !errors.As(err, &bad) {
+		return err
+	}
+	if len(batch) == 1 {
+		return &sinkRejected{Records: batch, Err: bad}
+	}
+	// Split to find the offending messages; the rest still get delivered.
+	mid := len(batch) / 2
+	var rejected []sinkRecord
+	for _, half := range [][]sinkRecord{batch[:mid], batch[mid:]} {
+		err := s.send(ctx, half)
+		var rej *sinkRejected
+		if errors.As(err, &rej) {
+			rejected = append(rejected, rej.Records...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+	return &sinkRejected{Records: rejected, Err: bad}
+}
+
+// encodeRecord returns the record's element of the batch body with its trailing comma, so the
+// writer cuts batches by the size of the request.
+func (s *serviceBusSink) encodeRecord(r sinkRecord) ([]byte, error) {
+	props := map[string]interface{}{}
+	if s.sessionCol != "" {
+		props["SessionId"] = docString(r.Doc, s.sessionCol)
+	}
+	if s.messageID == "hash" {
+		sum := sha256.Sum256(r.Body)
+		props["MessageId"] = hex.EncodeToString(sum[:16])
+	}
+	if s.ttl > 0 {
+		props["TimeToLive"] = s.ttl.Seconds()
+	}
+	b, err := json.Marshal(serviceBusMessage{
+		Body:             string(r.Body),
+		BrokerProperties: props,
+		UserProperties:   map[string]interface{}{"table": r.Table, "rowIndex": r.Index},
+	})
+	return append(b, ','), err
+}
+
+func (s *serviceBusSink) post(ctx context.Context, batch []sinkRecord) error {
+	body := []byte{'['}
+	for _, r := range batch {
+		msg := r.Wire
+		if msg == nil {
+			var err error
+			if msg, err = s.encodeRecord(r); err != nil {
+				return err
+			}
+		}
+		body = append(body, msg...)
+	}
+	if len(batch) == 0 {
+		body = append(body, ']')
+	} else {
+		body[len(body)-1] = ']'
+	}
+	auth, err := s.auth(ctx)
+	if err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", "application/vnd.microsoft.servicebus.json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return retryableSinkErr{err}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	status := fmt.Errorf("POST %s: %s %s", s.endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	switch {
+	case resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryableSinkErr{status}
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return badBatchErr{status}
+	default:
+		return status
+	}
+}
+
+// badBatchErr is a 400/413 answer: something in the batch is unacceptable, the entity is fine.
+type badBatchErr struct{ err error }
+
+func (e badBatchErr) Error() string { return e.err.Error() }
+
+// parseConnectionString splits "Endpoint=sb://...;SharedAccessKeyName=...;..." into lower-cased keys.
+func parseConnectionString(cs string) map[string]string {
+	out := map[string]string{}
+	for _, part := range strings.Split(cs, ";") {
+		k, v, ok := strings.Cut(part, "=")
+		if ok {
+			out[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	return out
+}
+
+// serviceBusSAS builds a SharedAccessSignature token for resource valid for ttl.
+func serviceBusSAS(resource, keyName, key string, ttl time.Duration) string {
+	enc := url.QueryEscape(resource)
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(enc + "\n" + expiry))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", enc, url.QueryEscape(sig), expiry, url.QueryEscape(keyName))
+}
@@ -0,0 +1,125 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceBusConfig(t *testing.T) {
+	cs := "Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=a2V5;EntityPath=events"
+	tests := []struct {
+		name     string
+		out      string
+		opts     Opts
+		endpoint string
+		err      string
+	}{
+		{name: "entity from the connection string", opts: Opts{"connection-string": cs}, endpoint: "https://ns.servicebus.windows.net/events/messages"},
+		{name: "--out overrides the entity", out: "sb://other/alerts", opts: Opts{"connection-string": cs}, endpoint: "https://other.servicebus.windows.net/alerts/messages"},
+		{name: "no entity", out: "sb://ns", opts: Opts{"connection-string": cs}, err: "--out must be sb://"},
+		{name: "no key", opts: Opts{"connection-string": "Endpoint=sb://ns.servicebus.windows.net/;EntityPath=e"}, err: "SharedAccessKey"},
+		{name: "bad message-id", opts: Opts{"connection-string": cs, "message-id": "uuid"}, err: "message-id must be hash or none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newServiceBusSink(&Config{Type: "servicebus", Out: tt.out, Opts: tt.opts})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.(*serviceBusSink).endpoint; got != tt.endpoint {
+				t.Errorf("endpoint %s, want %s", got, tt.endpoint)
+			}
+		})
+	}
+}
+
+func TestServiceBusSAS(t *testing.T) {
+	sas := serviceBusSAS("https://ns.servicebus.windows.net/events", "send", "a2V5", time.Hour)
+	q, err := url.ParseQuery(strings.TrimPrefix(sas, "SharedAccessSignature "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Get("sr") != "https://ns.servicebus.windows.net/events" || q.Get("skn") != "send" || q.Get("sig") == "" || q.Get("se") == "" {
+		t.Errorf("token %s", sas)
+	}
+}
+
+func TestServiceBusEncodeRecord(t *testing.T) {
+	s := &serviceBusSink{sessionCol: "State", messageID: "hash", ttl: time.Minute}
+	r := sinkRecord{Table: "PrimaryResult", Index: 3, Doc: map[string]interface{}{"State": "TEXAS"}, Body: []byte(`{"State":"TEXAS"}`)}
+	b, err := s.encodeRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(b), ",") {
+		t.Errorf("no separator: %s", b)
+	}
+	var msg serviceBusMessage
+	if err := json.Unmarshal(b[:len(b)-1], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Body != string(r.Body) || msg.BrokerProperties["SessionId"] != "TEXAS" || msg.BrokerProperties["TimeToLive"] != 60.0 || len(msg.BrokerProperties["MessageId"].(string)) != 32 {
+		t.Errorf("message %+v", msg)
+	}
+	if again, _ := s.encodeRecord(r); string(again) != string(b) {
+		t.Error("the MessageId of a row changes between sends, so duplicate detection can't work")
+	}
+}
+
+// TestServiceBusSend checks that a refused message is isolated by splitting the batch and handed
+// back as rejected, while the rest are delivered.
+func TestServiceBusSend(t *testing.T) {
+	var delivered []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/vnd.microsoft.servicebus.json" || r.Header.Get("Authorization") != "SharedAccessSignature test" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		var msgs []serviceBusMessage
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, m := range msgs {
+			if strings.Contains(m.Body, "bad") {
+				http.Error(w, "message too large", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, m := range msgs {
+			delivered = append(delivered, m.Body)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	s := &serviceBusSink{endpoint: srv.URL, messageID: "none", retries: 1, client: srv.Client(),
+		auth: func(context.Context) (string, error) { return "SharedAccessSignature test", nil }}
+	var batch []sinkRecord
+	for _, body := range []string{`"a"`, `"bad"`, `"b"`, `"c"`} {
+		batch = append(batch, sinkRecord{Body: []byte(body)})
+	}
+	err := s.send(context.Background(), batch)
+	var rej *sinkRejected
+	if !errors.As(err, &rej) || len(rej.Records) != 1 || string(rej.Records[0].Body) != `"bad"` {
+		t.Fatalf("send: %v", err)
+	}
+	if strings.Join(delivered, " ") != `"a" "b" "c"` {
+		t.Errorf("delivered %v", delivered)
+	}
+}
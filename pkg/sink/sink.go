@@ -0,0 +1,594 @@
+// Package sink delivers query results somewhere other than stdout: row sinks (message brokers and
+// caches) that receive each primary result row as a JSON document, table sinks (Delta Lake,
+// DuckDB, Power BI folders) that receive the typed table, and object stores that receive a formatted result file.
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// Config holds the --sink/--out/--sink-opt flags shared by all sinks.
+type Config struct {
+	Type      string
+	Out       string
+	Opts      Opts
+	BatchSize int
+	Gzip      bool
+
+	stamp string // time in the names of objects written under a prefix, fixed by the first
+}
+
+// RegisterFlags adds the sink flags to fs.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	cfg := &Config{Opts: Opts{}}
+	fs.StringVar(&cfg.Type, "sink", "", "deliver primary result rows to a sink instead of stdout: "+strings.Join(Names(), "|"))
+	fs.StringVar(&cfg.Out, "out", "", "sink destination (sb://, mqtt[s]://, nats://, redis[s]://, a Delta table or Power BI folder directory or URL, a DuckDB file), or without --sink an object URL (gs:// or s3://<bucket>/<object>, https://<account>.blob.core.windows.net/<container>/<object>, onedrive://<drive-id>/<path>) or local file to write the --format output to")
+	fs.Var(cfg.Opts, "sink-opt", "sink-specific option as key=value (repeatable)")
+	fs.BoolVar(&cfg.Gzip, "gzip", false, "gzip the --out file or object, adding .gz to its name (implied by an --out ending in .gz)")
+	fs.IntVar(&cfg.BatchSize, "batch-size", 0, "rows per sink batch; 0 fills each batch up to the sink's payload limit, or 100 rows for sinks without one")
+	return cfg
+}
+
+// Opts implements flag.Value for repeatable key=value options.
+type Opts map[string]string
+
+func (o Opts) String() string {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + o[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+func (o Opts) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(k) == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	o[strings.TrimSpace(k)] = v
+	return nil
+}
+
+// Opt returns the --sink-opt value for key, or def when it is not set.
+func (c *Config) Opt(key, def string) string {
+	if v, ok := c.Opts[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (c *Config) intOpt(key string, def int) (int, error) {
+	v, ok := c.Opts[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("sink option %s: %v", key, err)
+	}
+	return n, nil
+}
+
+func (c *Config) durationOpt(key string, def time.Duration) (time.Duration, error) {
+	v, ok := c.Opts[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("sink option %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// sinkRecord is one primary result row on its way to a sink.
+type sinkRecord struct {
+	Table string
+	Index int
+	Doc   map[string]interface{} // row object as emitted by ndjson (see encode.RowObject)
+	Body  []byte                 // JSON encoding of Doc
+	Wire  []byte                 // the record as the sink sends it, for a recordEncoder sink
+}
+
+// rowSink delivers batches of records to an external system. send returns a *sinkRejected for
+// records the destination refused permanently; they are routed to the dead-letter file (if any)
+// instead of failing the run. Any other error aborts the run.
+type rowSink interface {
+	send(ctx context.Context, batch []sinkRecord) error
+	// maxBatchBytes bounds the summed Body size of a batch; 0 means no limit.
+	maxBatchBytes() int
+	close() error
+}
+
+// recordEncoder is implemented by sinks that wrap each record in an envelope of their own. The
+// writer encodes records as they arrive, so batches are cut by the size of the real request
+// rather than of the row bodies.
+type recordEncoder interface {
+	// encodeRecord returns the record as it goes into a send request, including any separator.
+	encodeRecord(r sinkRecord) ([]byte, error)
+}
+
+type sinkRejected struct {
+	Records []sinkRecord
+	Err     error
+}
+
+func (r *sinkRejected) Error() string {
+	return fmt.Sprintf("%d records rejected: %v", len(r.Records), r.Err)
+}
+
+var sinkFactories = map[string]func(cfg *Config) (rowSink, error){
+	"mqtt":       newMQTTSink,
+	"nats":       newNATSSink,
+	"redis":      newRedisSink,
+	"servicebus": newServiceBusSink,
+}
+
+// tableSinks need the typed result rather than JSON rows, so they are Encoders themselves.
+var tableSinks = map[string]func(cfg *Config) (encode.Encoder, error){
+	"delta":   newDeltaSink,
+	"duckdb":  newDuckDBSink,
+	"powerbi": newPowerBISink,
+}
+
+// Names lists the sinks --sink accepts, sorted.
+func Names() []string {
+	names := make([]string, 0, len(sinkFactories)+len(tableSinks))
+	for n := range sinkFactories {
+		names = append(names, n)
+	}
+	for n := range tableSinks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Batch sizes for --batch-size 0: a sink with a payload limit gets as many rows as fit, up to
+// maxAutoBatchRows so tiny rows don't pile up in memory; others get defaultBatchRows.
+const (
+	defaultBatchRows = 100
+	maxAutoBatchRows = 10000
+)
+
+// sinkWriter adapts a rowSink to the encode.Encoder interface: it batches primary result rows,
+// sends each batch with a per-send timeout and dead-letters rejected records. Each row's encoded
+// size is measured as it arrives and a batch is sent before the next row would take it over the
+// sink's maxBatchBytes, so wide rows make small batches and narrow rows large ones.
+// Common options: timeout=30s (per send), dead-letter=<file> (NDJSON of rejected rows),
+// buffer=<dir> to queue the rows on disk for a sink slower than the query (see diskQueue), and
+// requery-column=<col> to keep the watermark a requery of the undelivered rows starts at (see Requery).
+type sinkWriter struct {
+	name       string
+	open       func() (rowSink, error)
+	sink       rowSink
+	batchSize  int
+	timeout    time.Duration
+	deadLetter string
+
+	buffer       string // buffer=<dir>, with buffer-max-bytes and buffer-report
+	bufferMax    int64
+	bufferReport time.Duration
+
+	active  bool
+	batch   []sinkRecord
+	bytes   int
+	sent    int
+	batches int
+	largest int // rows in the largest batch, to show how the batches were cut
+	dead    int
+	queue   *diskQueue // buffer=<dir>; its sender goroutine then does the batching
+
+	requeryColumn string
+	mu            sync.Mutex // guards the fields below, which the buffer's sender sets
+	markType      string     // the requery column's type
+	mark          string     // its value in the last row delivered
+	failed        bool       // a batch failed to send
+}
+
+// Requery is implemented by the writers of row sinks given --sink-opt requery-column=<col>. When
+// the sink fails part way, the rows it hasn't delivered can be queried again, ordered by the
+// column, from Watermark on, and delivered after Reopen.
+type Requery interface {
+	// Watermark returns the column's value in the last row the sink delivered (sent or
+	// dead-lettered), as text, and the column's type; ok is false until a non-null one was.
+	Watermark() (value, typ string, ok bool)
+	// Failed reports whether the run failed because the sink couldn't send a batch, rather
+	// than for a reason another query wouldn't fix.
+	Failed() bool
+	// Reopen drops the rows not delivered yet and connects to the sink again.
+	Reopen() error
+}
+
+// requeryTypes are the column types a requery can start from, those with ordered literals.
+var requeryTypes = map[types.Column]bool{types.Int: true, types.Long: true, types.Real: true, types.DateTime: true, types.String: true}
+
+// New opens the --sink named in cfg.
+func New(cfg *Config) (encode.Encoder, error) {
+	if f, ok := tableSinks[cfg.Type]; ok {
+		if cfg.Opt("requery-column", "") != "" {
+			return nil, fmt.Errorf("%s sink: requery-column needs a row sink", cfg.Type)
+		}
+		w, err := f(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s sink: %w", cfg.Type, err)
+		}
+		return w, nil
+	}
+	return newSinkWriter(cfg)
+}
+
+func newSinkWriter(cfg *Config) (*sinkWriter, error) {
+	f, ok := sinkFactories[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q (want one of %s)", cfg.Type, strings.Join(Names(), ", "))
+	}
+	timeout, err := cfg.durationOpt("timeout", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s := &sinkWriter{name: cfg.Type, timeout: timeout, deadLetter: cfg.Opt("dead-letter", ""), requeryColumn: cfg.Opt("requery-column", "")}
+	s.open = func() (rowSink, error) {
+		sink, err := f(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s sink: %w", cfg.Type, err)
+		}
+		return sink, nil
+	}
+	if s.sink, err = s.open(); err != nil {
+		return nil, err
+	}
+	size := cfg.BatchSize
+	switch {
+	case size < 0:
+		return nil, fmt.Errorf("--batch-size must not be negative")
+	case size == 0 && s.sink.maxBatchBytes() > 0:
+		size = maxAutoBatchRows
+	case size == 0:
+		size = defaultBatchRows
+	}
+	s.batchSize = size
+	if s.buffer = cfg.Opt("buffer", ""); s.buffer != "" {
+		max, err := cfg.intOpt("buffer-max-bytes", 1<<30)
+		if err != nil {
+			return nil, err
+		}
+		if s.bufferReport, err = cfg.durationOpt("buffer-report", 10*time.Second); err != nil {
+			return nil, err
+		}
+		s.bufferMax = int64(max)
+		if err := s.startQueue(); err != nil {
+			s.sink.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// startQueue opens the disk queue and starts its sender.
+func (s *sinkWriter) startQueue() error {
+	q, err := newDiskQueue(s.buffer, s.bufferMax)
+	if err != nil {
+		return err
+	}
+	s.queue = q
+	go q.drain(s.unspool)
+	if s.bufferReport > 0 {
+		go q.report(s.name, s.bufferReport)
+	}
+	return nil
+}
+
+func (s *sinkWriter) Begin(t *encode.Table) error {
+	s.active = t.Kind == "PrimaryResult"
+	if !s.active || s.requeryColumn == "" {
+		return nil
+	}
+	for _, c := range t.Columns {
+		if c.Name() == s.requeryColumn {
+			if !requeryTypes[c.Type()] {
+				return fmt.Errorf("requery-column %s is of type %s; it must be int, long, real, datetime or string", c.Name(), c.Type())
+			}
+			s.mu.Lock()
+			s.markType = string(c.Type())
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("requery-column %s is not in the result", s.requeryColumn)
+}
+
+func (s *sinkWriter) Watermark() (string, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mark, s.markType, s.mark != ""
+}
+
+func (s *sinkWriter) Failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
+
+func (s *sinkWriter) Reopen() error {
+	if s.queue != nil {
+		s.queue.discard()
+		s.queue = nil
+	}
+	s.sink.close()
+	s.batch, s.bytes = nil, 0
+	s.mu.Lock()
+	s.failed = false
+	s.mu.Unlock()
+	sink, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.sink = sink
+	if s.buffer != "" {
+		return s.startQueue()
+	}
+	return nil
+}
+
+func (s *sinkWriter) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if !s.active {
+		return nil
+	}
+	doc := encode.RowObject(t, index, vals)
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal row as JSON: %w", err)
+	}
+	if s.queue != nil {
+		return s.queue.push(t.Name, index, body)
+	}
+	return s.add(sinkRecord{Table: t.Name, Index: index, Doc: doc, Body: body})
+}
+
+// unspool sends a row read back from the disk queue.
+func (s *sinkWriter) unspool(r spooledRow) error {
+	dec := json.NewDecoder(bytes.NewReader(r.Row))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("buffer: %w", err)
+	}
+	return s.add(sinkRecord{Table: r.Table, Index: r.Index, Doc: doc, Body: r.Row})
+}
+
+// add puts a record in the batch, sending the batch when it is full.
+func (s *sinkWriter) add(rec sinkRecord) error {
+	var err error
+	size := len(rec.Body)
+	if enc, ok := s.sink.(recordEncoder); ok {
+		if rec.Wire, err = enc.encodeRecord(rec); err != nil {
+			return fmt.Errorf("%s sink: %w", s.name, err)
+		}
+		size = len(rec.Wire)
+	}
+	if max := s.sink.maxBatchBytes(); max > 0 && len(s.batch) > 0 && s.bytes+size > max {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	s.batch = append(s.batch, rec)
+	s.bytes += size
+	if len(s.batch) >= s.batchSize {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *sinkWriter) End() error {
+	var err error
+	if s.queue != nil {
+		err = s.queue.close()
+	}
+	if err == nil {
+		err = s.flush()
+	}
+	if cerr := s.sink.close(); err == nil {
+		err = cerr
+	}
+	buffered := ""
+	if s.queue != nil {
+		buffered = fmt.Sprintf(", buffered up to %d rows", s.queue.peak)
+	}
+	fmt.Fprintf(os.Stderr, "SINK %s: sent %d rows in %d batches (largest %d rows), dead-lettered %d%s\n", s.name, s.sent, s.batches, s.largest, s.dead, buffered)
+	return err
+}
+
+func (s *sinkWriter) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	batch := s.batch
+	s.batch, s.bytes = nil, 0
+	if len(batch) > s.largest {
+		s.largest = len(batch)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	err := s.sink.send(ctx, batch)
+	cancel()
+	s.batches++
+	var rej *sinkRejected
+	if errors.As(err, &rej) {
+		if s.deadLetter == "" {
+			return fmt.Errorf("%s sink: %w (set --sink-opt dead-letter=<file> to continue past rejected rows)", s.name, err)
+		}
+		if derr := appendDeadLetters(s.deadLetter, rej); derr != nil {
+			return derr
+		}
+		s.dead += len(rej.Records)
+		s.sent += len(batch) - len(rej.Records)
+		s.delivered(batch)
+		return nil
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.failed = true
+		s.mu.Unlock()
+		return fmt.Errorf("%s sink: %w", s.name, err)
+	}
+	s.sent += len(batch)
+	s.delivered(batch)
+	return nil
+}
+
+// delivered moves the watermark to the last row of a batch the sink has taken.
+func (s *sinkWriter) delivered(batch []sinkRecord) {
+	if s.requeryColumn == "" {
+		return
+	}
+	if v := docString(batch[len(batch)-1].Doc, s.requeryColumn); v != "" {
+		s.mu.Lock()
+		s.mark = v
+		s.mu.Unlock()
+	}
+}
+
+// appendDeadLetters appends rejected rows to an NDJSON file together with the rejection reason.
+func appendDeadLetters(path string, rej *sinkRejected) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("dead-letter file: %w", err)
+	}
+	defer f.Close()
+	for _, r := range rej.Records {
+		line, _ := json.Marshal(map[string]interface{}{
+			"_deadLetterReason": rej.Err.Error(),
+			"_deadLetteredAt":   time.Now().UTC().Format(time.RFC3339),
+			"row":               json.RawMessage(r.Body),
+		})
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("dead-letter file: %w", err)
+		}
+	}
+	return nil
+}
+
+// docString renders a row column as text for keys, session ids and templates.
+func docString(doc map[string]interface{}, col string) string {
+	v, ok := doc[col]
+	if !ok || v == nil {
+		return ""
+	}
+	switch x := v.(type) {
+	case string:
+		return x
+	case *string:
+		if x == nil {
+			return ""
+		}
+		return *x
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.Trim(string(b), `"`)
+}
+
+// tlsConfig builds the client TLS settings from the ca-file, cert-file, key-file and
+// insecure-skip-verify options.
+func (c *Config) tlsConfig(serverName string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if ca := c.Opt("ca-file", ""); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("ca-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca-file %s: no certificates found", ca)
+		}
+		conf.RootCAs = pool
+	}
+	if cert := c.Opt("cert-file", ""); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, c.Opt("key-file", cert))
+		if err != nil {
+			return nil, fmt.Errorf("cert-file: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	conf.InsecureSkipVerify = c.Opt("insecure-skip-verify", "false") == "true"
+	return conf, nil
+}
+
+// expandTemplate replaces {Column} placeholders in tpl with the row's values passed through clean,
+// which strips characters that would change the structure of a topic or subject.
+func expandTemplate(tpl string, doc map[string]interface{}, clean func(string) string) (string, error) {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(tpl, '{')
+		if open < 0 {
+			b.WriteString(tpl)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(tpl[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated {column} in template")
+		}
+		col := tpl[open+1 : open+end]
+		if _, ok := doc[col]; !ok {
+			return "", fmt.Errorf("template column %q is not in the result", col)
+		}
+		b.WriteString(tpl[:open])
+		b.WriteString(clean(docString(doc, col)))
+		tpl = tpl[open+end+1:]
+	}
+}
+
+// retrySend runs send up to attempts times with exponential backoff while it returns a
+// retryable error (see isRetryableSinkErr).
+func retrySend(ctx context.Context, attempts int, send func() error) error {
+	backoff := 500 * time.Millisecond
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = send(); err == nil || !isRetryableSinkErr(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// retryableSinkErr marks transient failures (throttling, 5xx, network) worth retrying.
+type retryableSinkErr struct{ err error }
+
+func (e retryableSinkErr) Error() string { return e.err.Error() }
+func (e retryableSinkErr) Unwrap() error { return e.err }
+
+func isRetryableSinkErr(err error) bool {
+	var r retryableSinkErr
+	return errors.As(err, &r)
+}
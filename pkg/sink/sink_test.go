@@ -0,0 +1,196 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// fakeSink records the request size of every batch, counting each record as its Body plus an
+// envelope, the way Service Bus does.
+type fakeSink struct {
+	maxBytes int
+	envelope int
+	sizes    []int
+	rows     []int
+}
+
+func (f *fakeSink) send(_ context.Context, batch []sinkRecord) error {
+	n := 0
+	for _, r := range batch {
+		n += len(r.Wire)
+	}
+	f.sizes = append(f.sizes, n)
+	f.rows = append(f.rows, len(batch))
+	return nil
+}
+
+func (f *fakeSink) maxBatchBytes() int { return f.maxBytes }
+func (f *fakeSink) close() error       { return nil }
+
+func (f *fakeSink) encodeRecord(r sinkRecord) ([]byte, error) {
+	return append(make([]byte, f.envelope), r.Body...), nil
+}
+
+func TestSinkWriterBatchesBySize(t *testing.T) {
+	fake := &fakeSink{maxBytes: 4000, envelope: 150}
+	w := &sinkWriter{name: "fake", sink: fake, batchSize: maxAutoBatchRows, timeout: time.Second}
+	table := &encode.Table{Name: "T", Kind: "PrimaryResult"}
+	if err := w.Begin(table); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.WriteRow(table, i, value.Values{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.End(); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for i, n := range fake.sizes {
+		if n > fake.maxBytes {
+			t.Errorf("batch %d is %d bytes, over the %d limit", i, n, fake.maxBytes)
+		}
+		total += fake.rows[i]
+	}
+	if total != 100 {
+		t.Fatalf("sent %d rows, want 100", total)
+	}
+	// Every batch but the last is full: one more row would not have fit.
+	row := fake.sizes[0] / fake.rows[0]
+	for i, n := range fake.sizes[:len(fake.sizes)-1] {
+		if n+row <= fake.maxBytes {
+			t.Errorf("batch %d is %d bytes with room for another %d-byte row", i, n, row)
+		}
+	}
+}
+
+// slowSink takes its time over every batch and records the rows it got.
+type slowSink struct {
+	delay time.Duration
+	docs  []map[string]interface{}
+}
+
+func (s *slowSink) send(_ context.Context, batch []sinkRecord) error {
+	time.Sleep(s.delay)
+	for _, r := range batch {
+		s.docs = append(s.docs, r.Doc)
+	}
+	return nil
+}
+
+func (s *slowSink) maxBatchBytes() int { return 0 }
+func (s *slowSink) close() error       { return nil }
+
+func TestSinkWriterDiskBuffer(t *testing.T) {
+	dir := t.TempDir()
+	slow := &slowSink{delay: 5 * time.Millisecond}
+	sinkFactories["slow"] = func(*Config) (rowSink, error) { return slow, nil }
+	defer delete(sinkFactories, "slow")
+	cfg := &Config{Type: "slow", BatchSize: 10, Opts: Opts{"buffer": dir, "buffer-max-bytes": "4096", "buffer-report": "0"}}
+	w, err := newSinkWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &encode.Table{Name: "T", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "N", types.Long)}}
+	w.Begin(table)
+	for i := 0; i < 500; i++ {
+		if err := w.WriteRow(table, i, value.Values{value.NewLong(int64(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.End(); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow.docs) != 500 {
+		t.Fatalf("sent %d rows, want 500", len(slow.docs))
+	}
+	for i, doc := range slow.docs {
+		if docString(doc, "N") != strconv.Itoa(i) {
+			t.Fatalf("row %d is %v", i, doc)
+		}
+	}
+	// The queue was bounded, so the query waited for the sink, and the spool is gone.
+	if w.queue.peak >= 500 {
+		t.Errorf("queue held %d rows, want fewer under buffer-max-bytes", w.queue.peak)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spool left behind: %v", files)
+	}
+}
+
+// flakySink fails every send after the first ok ones.
+type flakySink struct {
+	ok   int
+	sent int
+}
+
+func (f *flakySink) send(_ context.Context, batch []sinkRecord) error {
+	if f.ok == 0 {
+		return errors.New("broker unavailable")
+	}
+	f.ok--
+	f.sent += len(batch)
+	return nil
+}
+
+func (f *flakySink) maxBatchBytes() int { return 0 }
+func (f *flakySink) close() error       { return nil }
+
+func TestSinkWriterWatermark(t *testing.T) {
+	opened := []*flakySink{{ok: 2}, {ok: 100}}
+	sinkFactories["flaky"] = func(*Config) (rowSink, error) {
+		f := opened[0]
+		opened = opened[1:]
+		return f, nil
+	}
+	defer delete(sinkFactories, "flaky")
+	w, err := newSinkWriter(&Config{Type: "flaky", BatchSize: 10, Opts: Opts{"requery-column": "N"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &encode.Table{Name: "T", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "N", types.Long)}}
+	if err := w.Begin(table); err != nil {
+		t.Fatal(err)
+	}
+	var werr error
+	for i := 0; i < 50 && werr == nil; i++ {
+		werr = w.WriteRow(table, i, value.Values{value.NewLong(int64(i))})
+	}
+	if werr == nil || !w.Failed() {
+		t.Fatalf("err = %v, failed = %v; want the third batch to fail", werr, w.Failed())
+	}
+	if v, typ, ok := w.Watermark(); v != "19" || typ != "long" || !ok {
+		t.Fatalf("watermark = %q %q %v, want the last row of the second batch", v, typ, ok)
+	}
+	if err := w.Reopen(); err != nil || w.Failed() {
+		t.Fatalf("Reopen: %v", err)
+	}
+	for i := 19; i < 50; i++ {
+		if err := w.WriteRow(table, i, value.Values{value.NewLong(int64(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.End(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := w.Watermark(); v != "49" || w.sent != 51 {
+		t.Errorf("watermark %s after %d rows sent, want 49 after 51", v, w.sent)
+	}
+
+	// The column must be in the result, with an ordered type.
+	w.requeryColumn = "Missing"
+	if err := w.Begin(table); err == nil {
+		t.Error("Begin accepted a requery-column that isn't in the result")
+	}
+}
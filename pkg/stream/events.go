@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/classify"
+)
+
+// Event is a progress event of a query run: QueryStarted, then per table TableStarted and
+// RowsEmitted, and finally Completed or Failed. Name is the event's snake_case name, for logs.
+type Event interface {
+	Name() string
+}
+
+// QueryStarted is sent before the query is submitted.
+type QueryStarted struct {
+	Database string `json:"database"`
+	Query    string `json:"query"`
+}
+
+// TableStarted is sent when a result table begins, before its rows.
+type TableStarted struct {
+	Table   string `json:"table"`
+	Kind    string `json:"kind"`
+	Columns int    `json:"columns"`
+}
+
+// RowsEmitted reports N more rows of Table written to the encoder. It is sent every
+// RowsBatch rows and once more for the rest when the table ends.
+type RowsEmitted struct {
+	Table string `json:"table"`
+	N     int64  `json:"n"`
+	Total int64  `json:"total"` // rows of this table so far
+}
+
+// Completed is sent once the encoder has been ended successfully.
+type Completed struct {
+	Tables  int           `json:"tables"`
+	Rows    int64         `json:"rows"` // primary result rows
+	Elapsed time.Duration `json:"elapsed_ns"`
+}
+
+// Failed is sent instead of Completed. Stage is "submit", "read" or "write".
+type Failed struct {
+	Stage   string         `json:"stage"`
+	Class   classify.Class `json:"class"`
+	Code    string         `json:"code,omitempty"` // the service's error code, see classify.Code
+	Error   string         `json:"error"`
+	Err     error          `json:"-"`
+	Elapsed time.Duration  `json:"elapsed_ns"`
+}
+
+func (QueryStarted) Name() string { return "query_started" }
+func (TableStarted) Name() string { return "table_started" }
+func (RowsEmitted) Name() string  { return "rows_emitted" }
+func (Completed) Name() string    { return "completed" }
+func (Failed) Name() string       { return "failed" }
+
+// RowsBatch is how many rows a RowsEmitted event covers at most.
+const RowsBatch = 1000
+
+type handlerKey struct{}
+
+// WithEvents returns a context whose queries report their progress to fn. fn is called on the
+// goroutine running the query, so it should return quickly.
+func WithEvents(ctx context.Context, fn func(Event)) context.Context {
+	return context.WithValue(ctx, handlerKey{}, fn)
+}
+
+// WithEventChannel is WithEvents delivering to ch. A send blocks until ch has room or ctx is
+// done; events that can't be delivered before then are dropped.
+func WithEventChannel(ctx context.Context, ch chan<- Event) context.Context {
+	return WithEvents(ctx, func(e Event) {
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// emit sends e to the handler in ctx, if any.
+func emit(ctx context.Context, e Event) {
+	if fn, ok := ctx.Value(handlerKey{}).(func(Event)); ok {
+		fn(e)
+	}
+}
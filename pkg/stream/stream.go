@@ -0,0 +1,76 @@
+// Package stream runs a query and feeds its result, table by table and row by row, into an
+// encode.Encoder without holding the result in memory. The encoder can be an output format, a
+// sink, or a wrapper that inspects rows on their way to either.
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/classify"
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// Query runs q against database, writes every table of the result to enc and ends it. It
+// returns the number of primary result rows written. Errors say which stage failed: submitting
+// the query, reading the result or writing the output. Progress is reported to the handler set
+// with WithEvents, if any.
+func Query(ctx context.Context, client *azkustodata.Client, database string, q *kql.Builder, enc encode.Encoder, opts ...azkustodata.QueryOption) (int64, error) {
+	start := time.Now()
+	var tables int
+	var rows int64
+	fail := func(stage, msg string, err error) (int64, error) {
+		emit(ctx, Failed{Stage: stage, Class: classify.Of(err), Code: classify.Code(err), Error: err.Error(), Err: err, Elapsed: time.Since(start)})
+		return rows, fmt.Errorf("%s: %w", msg, err)
+	}
+
+	emit(ctx, QueryStarted{Database: database, Query: q.String()})
+	ds, err := client.IterativeQuery(ctx, database, q, opts...)
+	if err != nil {
+		return fail("submit", "query submission failed", err)
+	}
+	defer ds.Close()
+
+	for tr := range ds.Tables() {
+		if tr.Err() != nil {
+			return fail("read", "table error", tr.Err())
+		}
+		t := tr.Table()
+		info := &encode.Table{Name: t.Name(), Kind: t.Kind(), Columns: t.Columns()}
+		tables++
+		emit(ctx, TableStarted{Table: info.Name, Kind: info.Kind, Columns: len(info.Columns)})
+		if err := enc.Begin(info); err != nil {
+			return fail("write", "failed to write output", err)
+		}
+		var total, pending int64
+		for rr := range t.Rows() {
+			if rr.Err() != nil {
+				return fail("read", "row error", rr.Err())
+			}
+			row := rr.Row()
+			if err := enc.WriteRow(info, row.Index(), row.Values()); err != nil {
+				return fail("write", "failed to write output", err)
+			}
+			if info.Kind == "PrimaryResult" {
+				rows++
+			}
+			total++
+			if pending++; pending == RowsBatch {
+				emit(ctx, RowsEmitted{Table: info.Name, N: pending, Total: total})
+				pending = 0
+			}
+		}
+		if pending > 0 {
+			emit(ctx, RowsEmitted{Table: info.Name, N: pending, Total: total})
+		}
+	}
+	if err := enc.End(); err != nil {
+		return fail("write", "failed to write output", err)
+	}
+	emit(ctx, Completed{Tables: tables, Rows: rows, Elapsed: time.Since(start)})
+	return rows, nil
+}
@@ -0,0 +1,197 @@
+package stream_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// fakeCluster answers v2 queries: "rows N" with a primary result of N longs and a completion
+// information table, "broken" with a primary result that fails after its first row, and anything
+// else with a 400.
+func fakeCluster(t *testing.T) *azkustodata.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/rest/query" {
+			http.NotFound(w, r) // the cloud metadata: the public cloud
+			return
+		}
+		var req struct {
+			CSL string `json:"csl"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		n, err := strconv.Atoi(strings.TrimPrefix(req.CSL, "rows "))
+		completion := fmt.Sprintf(`{"FrameType":"TableCompletion","TableId":1,"RowCount":%d}`, n)
+		switch {
+		case req.CSL == "broken":
+			n, completion = 1, `{"FrameType":"TableCompletion","TableId":1,"RowCount":1,"OneApiErrors":[{"error":{"code":"LimitsExceeded","message":"Request is invalid and cannot be executed.","@type":"Kusto.Data.Exceptions.KustoServicePartialQueryFailureLimitsExceededException","@message":"Query execution has exceeded the allowed limits","@permanent":false}}]}`
+		case err != nil:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":{"code":"BadRequest","message":"Request is invalid and cannot be executed.","@message":"Syntax error: %s"}}`, req.CSL)
+			return
+		}
+		rows := make([][]int, n)
+		for i := range rows {
+			rows[i] = []int{i}
+		}
+		data, _ := json.Marshal(rows)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "[%s\n,%s\n,%s\n,%s\n,%s\n,%s\n,%s\n]\n",
+			`{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0","IsFragmented":true,"ErrorReportingPlacement":"EndOfTable"}`,
+			`{"FrameType":"DataTable","TableId":0,"TableKind":"QueryProperties","TableName":"@ExtendedProperties","Columns":[{"ColumnName":"TableId","ColumnType":"int"},{"ColumnName":"Key","ColumnType":"string"},{"ColumnName":"Value","ColumnType":"dynamic"}],"Rows":[]}`,
+			`{"FrameType":"TableHeader","TableId":1,"TableKind":"PrimaryResult","TableName":"PrimaryResult","Columns":[{"ColumnName":"N","ColumnType":"long"}]}`,
+			`{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":1,"Rows":`+string(data)+`}`,
+			completion,
+			`{"FrameType":"DataTable","TableId":2,"TableKind":"QueryCompletionInformation","TableName":"QueryCompletionInformation","Columns":[{"ColumnName":"EventTypeName","ColumnType":"string"}],"Rows":[["QueryInfo"]]}`,
+			`{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}`)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := azkustodata.New(azkustodata.NewConnectionStringBuilder(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// failingEncoder discards the result, failing on the row failRow.
+type failingEncoder struct{ failRow int }
+
+func (failingEncoder) Begin(*encode.Table) error { return nil }
+
+func (f failingEncoder) WriteRow(_ *encode.Table, index int, _ value.Values) error {
+	if index == f.failRow {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func (failingEncoder) End() error { return nil }
+
+// eventLine shortens an event for comparing, leaving out times and error texts.
+func eventLine(e stream.Event) string {
+	switch e := e.(type) {
+	case stream.QueryStarted:
+		return fmt.Sprintf("%s %s %s", e.Name(), e.Database, e.Query)
+	case stream.TableStarted:
+		return fmt.Sprintf("%s %s %s %d", e.Name(), e.Table, e.Kind, e.Columns)
+	case stream.RowsEmitted:
+		return fmt.Sprintf("%s %s %d %d", e.Name(), e.Table, e.N, e.Total)
+	case stream.Completed:
+		return fmt.Sprintf("%s %d %d", e.Name(), e.Tables, e.Rows)
+	case stream.Failed:
+		return fmt.Sprintf("%s %s", e.Name(), e.Stage)
+	}
+	return e.Name()
+}
+
+func TestQuery(t *testing.T) {
+	client := fakeCluster(t)
+	tests := []struct {
+		name    string
+		query   string
+		enc     encode.Encoder
+		rows    int64
+		err     string
+		events  []string
+		errCode string
+	}{
+		// Rows go out in batches of RowsBatch and the rest; only the primary result's count.
+		{name: "batches", query: "rows 2500", enc: failingEncoder{failRow: -1}, rows: 2500, events: []string{
+			"query_started Samples rows 2500",
+			"table_started PrimaryResult PrimaryResult 1",
+			"rows_emitted PrimaryResult 1000 1000",
+			"rows_emitted PrimaryResult 1000 2000",
+			"rows_emitted PrimaryResult 500 2500",
+			"table_started @ExtendedProperties QueryProperties 3",
+			"table_started QueryCompletionInformation QueryCompletionInformation 1",
+			"rows_emitted QueryCompletionInformation 1 1",
+			"completed 3 2500"}},
+		{name: "a whole batch and no rest", query: "rows 1000", enc: failingEncoder{failRow: -1}, rows: 1000, events: []string{
+			"query_started Samples rows 1000",
+			"table_started PrimaryResult PrimaryResult 1",
+			"rows_emitted PrimaryResult 1000 1000",
+			"table_started @ExtendedProperties QueryProperties 3",
+			"table_started QueryCompletionInformation QueryCompletionInformation 1",
+			"rows_emitted QueryCompletionInformation 1 1",
+			"completed 3 1000"}},
+		{name: "submit", query: "nope", enc: failingEncoder{failRow: -1}, err: "query submission failed", errCode: "400 BadRequest", events: []string{
+			"query_started Samples nope",
+			"failed submit"}},
+		{name: "read", query: "broken", enc: failingEncoder{failRow: -1}, rows: 1, err: "LimitsExceeded", events: []string{
+			"query_started Samples broken",
+			"table_started PrimaryResult PrimaryResult 1",
+			"failed read"}},
+		{name: "write", query: "rows 1500", enc: failingEncoder{failRow: 1200}, rows: 1200, err: "failed to write output: disk full", events: []string{
+			"query_started Samples rows 1500",
+			"table_started PrimaryResult PrimaryResult 1",
+			"rows_emitted PrimaryResult 1000 1000",
+			"failed write"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			var failed *stream.Failed
+			ctx := stream.WithEvents(context.Background(), func(e stream.Event) {
+				events = append(events, eventLine(e))
+				if f, ok := e.(stream.Failed); ok {
+					failed = &f
+				}
+			})
+			rows, err := stream.Query(ctx, client, "Samples", (&kql.Builder{}).AddUnsafe(tt.query), tt.enc)
+			if rows != tt.rows || (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%d rows, %v; want %d rows, %q", rows, err, tt.rows, tt.err)
+			}
+			if strings.Join(events, "\n") != strings.Join(tt.events, "\n") {
+				t.Errorf("events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(tt.events, "\n"))
+			}
+			if failed != nil && (!errors.Is(err, failed.Err) || failed.Code != tt.errCode || failed.Error == "") {
+				t.Errorf("failed event %+v for %v", failed, err)
+			}
+		})
+	}
+}
+
+func TestWithEventChannel(t *testing.T) {
+	client := fakeCluster(t)
+	enc, _ := encode.New("csv", io.Discard, encode.Options{})
+	ch := make(chan stream.Event)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Query(stream.WithEventChannel(ctx, ch), client, "Samples", (&kql.Builder{}).AddUnsafe("rows 10"), enc)
+		done <- err
+	}()
+	if e := <-ch; e.Name() != "query_started" {
+		t.Errorf("first event %s", e.Name())
+	}
+	// Nobody reads ch any more: once ctx is done, the events are dropped instead of blocking the
+	// query.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the query blocked on an event nobody reads")
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("an event was sent after ctx was done: %s", e.Name())
+	default:
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+)
+
+// controlPlan is the ordered list of control commands a mutating subcommand will run.
+// Subcommands build the plan first, then either print it (--dry-run) or execute it,
+// so the preview is always exactly what would be sent to the cluster.
+type controlPlan struct {
+	Name    string
+	Cluster string
+	Steps   []planStep
+}
+
+type planStep struct {
+	Kind        string // callMgmt, callIngest, or callQuery for a query; selects the per-call timeout
+	Database    string
+	Desc        string
+	Command     string
+	Destructive bool // deletes or overwrites data, so the plan asks before running (see confirmGate)
+}
+
+func (p *controlPlan) add(kind, database, desc, command string) {
+	p.Steps = append(p.Steps, planStep{Kind: kind, Database: database, Desc: desc, Command: command})
+}
+
+// addDestructive adds a step that deletes or overwrites data, such as a drop or purge.
+func (p *controlPlan) addDestructive(kind, database, desc, command string) {
+	p.Steps = append(p.Steps, planStep{Kind: kind, Database: database, Desc: desc, Command: command, Destructive: true})
+}
+
+// print writes the plan as a KQL script with comment headers, suitable for pasting into a PR or change ticket.
+func (p *controlPlan) print(w io.Writer) {
+	fmt.Fprintf(w, "// plan: %s against %s (%d commands, not executed)\n", p.Name, p.Cluster, len(p.Steps))
+	for i, s := range p.Steps {
+		fmt.Fprintf(w, "\n// step %d/%d (%s, database %s): %s\n%s\n", i+1, len(p.Steps), s.Kind, s.Database, s.Desc, s.Command)
+	}
+}
+
+// confirm passes the plan through the confirmation gate. When the gate asks, the steps are
+// listed first, destructive ones marked, so the answer is about what will actually run.
+func (p *controlPlan) confirm(g *confirmGate) error {
+	destructive := false
+	for _, s := range p.Steps {
+		destructive = destructive || s.Destructive
+	}
+	if !g.needed(p.Cluster, destructive) {
+		return nil
+	}
+	for i, s := range p.Steps {
+		mark := ""
+		if s.Destructive {
+			mark = " (destructive)"
+		}
+		fmt.Fprintf(g.out, "  %d. %s%s\n", i+1, s.Desc, mark)
+	}
+	return g.confirm(p.Cluster, fmt.Sprintf("run %s (%d commands)", p.Name, len(p.Steps)), destructive)
+}
+
+// execute runs the steps in order, recording each outcome in b, until b's error policy stops it.
+func (p *controlPlan) execute(client *azkustodata.Client, timeouts timeoutConfig, b *batch) {
+	for i, s := range p.Steps {
+		ctx, cancel := timeouts.callContext(context.Background(), s.Kind)
+		id, opts := globalRequest.callOptions("mgmt")
+		_, err := client.Mgmt(ctx, s.Database, (&kql.Builder{}).AddUnsafe(s.Command), opts...)
+		err = withRequestID(err, id)
+		cancel()
+		if b.done(fmt.Sprintf("step %d/%d (%s)", i+1, len(p.Steps), s.Desc), err) {
+			return
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// resultProfile collects per-column statistics of a result table as it streams past: null
+// share, min/max, an estimated distinct count and, for strings, the most frequent values. Memory
+// is bounded per column whatever the row count, so it works on results too big to keep.
+type resultProfile struct {
+	rows int64
+	cols []*columnProfile
+}
+
+type columnProfile struct {
+	name     string
+	typ      types.Column
+	nulls    int64
+	distinct *hyperLogLog
+	top      *topValues // strings only
+	key      []byte     // the value being added, as hashed for distinct
+
+	// The smallest and largest value; which one is used depends on typ.
+	ints  extremes[int64] // bools, ints, longs and timespans
+	reals extremes[float64]
+	decs  extremes[decimal.Decimal]
+	strs  extremes[string]
+	times extremes[time.Time]
+	guids extremes[uuid.UUID]
+}
+
+func newResultProfile(cols []query.Column) *resultProfile {
+	p := &resultProfile{}
+	for _, c := range cols {
+		cp := &columnProfile{name: c.Name(), typ: c.Type(), distinct: newHyperLogLog()}
+		if c.Type() == types.String {
+			cp.top = newTopValues(profileTopCounters)
+		}
+		p.cols = append(p.cols, cp)
+	}
+	return p
+}
+
+// addRow adds a row's values. They are read through encode.Row, so a row of scalars other than
+// decimals costs no allocations once the top string values have settled.
+func (p *resultProfile) addRow(vals value.Values) {
+	p.rows++
+	row := encode.RowAt(vals)
+	for i, c := range p.cols {
+		c.add(row, i)
+	}
+}
+
+func (c *columnProfile) add(r encode.Row, col int) {
+	if r.Null(col) {
+		c.nulls++
+		return
+	}
+	if !c.addScalar(r, col) {
+		// Dynamic values, and values whose type doesn't match the column's, have no min or max.
+		s, _ := canonicalValue(encode.PlainValue(r[col]))
+		c.key = append(c.key[:0], s...)
+	}
+	c.distinct.addBytes(c.key)
+	if c.top != nil {
+		if s, ok := r.String(col); ok {
+			c.top.add(s)
+		}
+	}
+}
+
+// addScalar updates the min and max with a value of the column's type and sets key to bytes
+// that tell it apart from the column's other values. It reports false for other values.
+func (c *columnProfile) addScalar(r encode.Row, col int) bool {
+	k := c.key[:0]
+	switch c.typ {
+	case types.Bool:
+		v, ok := r.Bool(col)
+		if !ok {
+			return false
+		}
+		var n int64
+		if v {
+			n = 1
+		}
+		c.ints.add(n, cmp.Less[int64])
+		k = append(k, byte(n))
+	case types.Int, types.Long:
+		n, ok := r.Long(col)
+		if !ok {
+			return false
+		}
+		c.ints.add(n, cmp.Less[int64])
+		k = binary.LittleEndian.AppendUint64(k, uint64(n))
+	case types.Timespan:
+		d, ok := r.Timespan(col)
+		if !ok {
+			return false
+		}
+		c.ints.add(int64(d), cmp.Less[int64])
+		k = binary.LittleEndian.AppendUint64(k, uint64(d))
+	case types.Real:
+		f, ok := r.Real(col)
+		if !ok {
+			return false
+		}
+		c.reals.add(f, cmp.Less[float64])
+		k = binary.LittleEndian.AppendUint64(k, math.Float64bits(f))
+	case types.Decimal:
+		d, ok := r.Decimal(col)
+		if !ok {
+			return false
+		}
+		c.decs.add(d, decimal.Decimal.LessThan)
+		k = append(k, d.String()...)
+	case types.String:
+		s, ok := r.String(col)
+		if !ok {
+			return false
+		}
+		c.strs.add(s, cmp.Less[string])
+		k = append(k, s...)
+	case types.DateTime:
+		t, ok := r.DateTime(col)
+		if !ok {
+			return false
+		}
+		c.times.add(t, time.Time.Before)
+		k = binary.LittleEndian.AppendUint64(k, uint64(t.Unix()))
+		k = binary.LittleEndian.AppendUint32(k, uint32(t.Nanosecond()))
+	case types.GUID:
+		u, ok := r.GUID(col)
+		if !ok {
+			return false
+		}
+		c.guids.add(u, func(a, b uuid.UUID) bool { return bytes.Compare(a[:], b[:]) < 0 })
+		k = append(k, u[:]...)
+	default:
+		return false
+	}
+	c.key = k
+	return true
+}
+
+// extreme formats the column's min, or its max, for the profile table; "" when there is none.
+func (c *columnProfile) extreme(min bool) string {
+	var s string
+	switch c.typ {
+	case types.Bool:
+		if !c.ints.set {
+			return ""
+		}
+		s = strconv.FormatBool(c.ints.get(min) == 1)
+	case types.Int, types.Long:
+		if !c.ints.set {
+			return ""
+		}
+		s = strconv.FormatInt(c.ints.get(min), 10)
+	case types.Timespan:
+		if !c.ints.set {
+			return ""
+		}
+		s = time.Duration(c.ints.get(min)).String()
+	case types.Real:
+		if !c.reals.set {
+			return ""
+		}
+		s = strconv.FormatFloat(c.reals.get(min), 'g', -1, 64)
+	case types.Decimal:
+		if !c.decs.set {
+			return ""
+		}
+		s = c.decs.get(min).String()
+	case types.String:
+		if !c.strs.set {
+			return ""
+		}
+		s = c.strs.get(min)
+	case types.DateTime:
+		if !c.times.set {
+			return ""
+		}
+		s = c.times.get(min).UTC().Format(time.RFC3339Nano)
+	case types.GUID:
+		if !c.guids.set {
+			return ""
+		}
+		s = c.guids.get(min).String()
+	default:
+		return ""
+	}
+	return profileCell(s)
+}
+
+// profileTopCounters is how many candidate values a string column tracks; profileTop of them
+// are shown.
+const (
+	profileTopCounters = 64
+	profileTop         = 3
+)
+
+// section renders the profile as a report table, one row per column.
+func (p *resultProfile) section(table string) reportSection {
+	sec := reportSection{
+		Title:   fmt.Sprintf("Profile of %s (%d rows)", table, p.rows),
+		Columns: []string{"Column", "Type", "Nulls", "Min", "Max", "Distinct", "Top values"},
+	}
+	for _, c := range p.cols {
+		nulls := "0%"
+		if p.rows > 0 {
+			nulls = strconv.FormatFloat(100*float64(c.nulls)/float64(p.rows), 'f', 1, 64) + "%"
+		}
+		var top []string
+		if c.top != nil {
+			for _, e := range c.top.top(profileTop) {
+				top = append(top, fmt.Sprintf("%s (%d)", profileCell(e.value), e.count))
+			}
+		}
+		sec.Rows = append(sec.Rows, []string{c.name, string(c.typ), nulls, c.extreme(true), c.extreme(false),
+			"~" + strconv.FormatInt(c.distinct.estimate(), 10), strings.Join(top, ", ")})
+	}
+	return sec
+}
+
+// profileCell keeps a value on one short line of the table.
+func profileCell(s string) string {
+	s = strconv.Quote(s)
+	s = s[1 : len(s)-1]
+	if len(s) > 40 {
+		s = s[:37] + "..."
+	}
+	return s
+}
+
+// hyperLogLog estimates the number of distinct strings added, within about 1.6% (2^12
+// registers).
+type hyperLogLog struct {
+	reg [1 << hllBits]uint8
+}
+
+const hllBits = 12
+
+func newHyperLogLog() *hyperLogLog { return &hyperLogLog{} }
+
+func (h *hyperLogLog) add(s string) { h.addBytes([]byte(s)) }
+
+func (h *hyperLogLog) addBytes(b []byte) {
+	// FNV-1a, inline: hash/fnv's Hash64 would be allocated for every value.
+	x := uint64(14695981039346656037)
+	for _, c := range b {
+		x = (x ^ uint64(c)) * 1099511628211
+	}
+	x = mix64(x)
+	i := x >> (64 - hllBits)
+	rank := uint8(bits.LeadingZeros64(x<<hllBits|1<<(hllBits-1)) + 1)
+	if rank > h.reg[i] {
+		h.reg[i] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() int64 {
+	const m = float64(1 << hllBits)
+	sum, zeros := 0.0, 0
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros)) // linear counting for small cardinalities
+	}
+	return int64(e + 0.5)
+}
+
+// mix64 is the splitmix64 finalizer; FNV alone leaves the high bits of short strings too
+// similar for the register index.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// topValues finds frequent values with the space-saving algorithm: it keeps n counters, and an
+// unseen value replaces the smallest one and inherits its count. Any value more frequent than
+// rows/n is guaranteed a counter; counts are upper bounds.
+type topValues struct {
+	n      int
+	counts map[string]int64
+}
+
+type topValue struct {
+	value string
+	count int64
+}
+
+func newTopValues(n int) *topValues { return &topValues{n: n, counts: map[string]int64{}} }
+
+func (t *topValues) add(s string) {
+	if _, ok := t.counts[s]; ok || len(t.counts) < t.n {
+		t.counts[s]++
+		return
+	}
+	minKey, minCount := "", int64(math.MaxInt64)
+	for k, c := range t.counts {
+		if c < minCount || (c == minCount && k < minKey) {
+			minKey, minCount = k, c
+		}
+	}
+	delete(t.counts, minKey)
+	t.counts[s] = minCount + 1
+}
+
+// top returns the k most frequent values, most frequent first.
+func (t *topValues) top(k int) []topValue {
+	out := make([]topValue, 0, len(t.counts))
+	for v, c := range t.counts {
+		out = append(out, topValue{v, c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].count != out[j].count {
+			return out[i].count > out[j].count
+		}
+		return out[i].value < out[j].value
+	})
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+// profilingEncoder profiles the first primary result table on its way to the wrapped Encoder.
+type profilingEncoder struct {
+	encode.Encoder
+	profile *resultProfile
+	table   *encode.Table
+}
+
+func (p *profilingEncoder) Begin(t *encode.Table) error {
+	if p.profile == nil && t.Kind == "PrimaryResult" {
+		p.profile, p.table = newResultProfile(t.Columns), t
+	}
+	return p.Encoder.Begin(t)
+}
+
+func (p *profilingEncoder) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if t == p.table {
+		p.profile.addRow(vals)
+	}
+	return p.Encoder.WriteRow(t, index, vals)
+}
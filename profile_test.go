@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 5000, 200000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			s := fmt.Sprintf("value-%d", i)
+			h.add(s)
+			h.add(s) // duplicates don't count
+		}
+		got := h.estimate()
+		if diff := math.Abs(float64(got) - float64(n)); diff > 0.05*float64(n)+1 {
+			t.Errorf("%d distinct: estimate %d", n, got)
+		}
+	}
+}
+
+func TestTopValues(t *testing.T) {
+	tv := newTopValues(8)
+	// A skewed stream: "hot" is a third of the rows, the rest are mostly unique.
+	for i := 0; i < 3000; i++ {
+		switch {
+		case i%3 == 0:
+			tv.add("hot")
+		case i%5 == 0:
+			tv.add("warm")
+		default:
+			tv.add(fmt.Sprintf("cold-%d", i))
+		}
+	}
+	top := tv.top(2)
+	if len(top) != 2 || top[0].value != "hot" || top[1].value != "warm" {
+		t.Fatalf("top = %v, want hot then warm", top)
+	}
+	if top[0].count < 1000 {
+		t.Errorf("hot counted %d times, want at least 1000", top[0].count)
+	}
+}
+
+func TestResultProfileAddRow(t *testing.T) {
+	cols := []query.Column{
+		testColumn{0, "Count", types.Long}, testColumn{1, "Took", types.Timespan}, testColumn{2, "State", types.String},
+	}
+	p := newResultProfile(cols)
+	for i := 0; i < 4; i++ {
+		p.addRow(value.Values{value.NewLong(int64(10 - i)), value.NewTimespan(time.Duration(i) * time.Second), value.NewString("TX")})
+	}
+	p.addRow(value.Values{value.NewNullLong(), value.NewNullTimespan(), value.NewString("OK")})
+
+	sec := p.section("T")
+	want := [][]string{
+		{"Count", "long", "20.0%", "7", "10", "~4", ""},
+		{"Took", "timespan", "20.0%", "0s", "3s", "~4", ""},
+		{"State", "string", "0.0%", "OK", "TX", "~2", "TX (4), OK (1)"},
+	}
+	if fmt.Sprint(sec.Rows) != fmt.Sprint(want) {
+		t.Errorf("rows = %v\nwant %v", sec.Rows, want)
+	}
+
+	row := value.Values{value.NewLong(3), value.NewTimespan(time.Minute), value.NewString("TX")}
+	if n := testing.AllocsPerRun(1000, func() { p.addRow(row) }); n != 0 {
+		t.Errorf("addRow allocates %.1f times per row, want 0", n)
+	}
+}
+
+type testColumn struct {
+	index int
+	name  string
+	typ   types.Column
+}
+
+func (c testColumn) Index() int         { return c.index }
+func (c testColumn) Name() string       { return c.name }
+func (c testColumn) Type() types.Column { return c.typ }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	v2 "github.com/Azure/azure-kusto-go/azkustodata/query/v2"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// progressiveQuery runs a query with results_progressive_enabled and writes its tables to enc as
+// their frames arrive, updating progress with each table's rows so far and the cluster's estimate
+// of how complete it is. The SDK only reads non-progressive results, so this calls the v2 REST
+// endpoint itself, with the same token and request properties. It returns the number of primary
+// result rows written.
+func progressiveQuery(ctx context.Context, client *http.Client, cluster, database, text, requestID string, enc encode.Encoder, progress *progressLine) (int64, error) {
+	tok, err := clusterToken(ctx, cluster)
+	if err != nil {
+		return 0, err
+	}
+	props := globalRequest.properties()
+	props["results_progressive_enabled"] = true
+	if _, ok := props["servertimeout"]; !ok {
+		if deadline, ok := ctx.Deadline(); ok {
+			props["servertimeout"] = timespanText(time.Until(deadline))
+		}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"db": database, "csl": text, "properties": map[string]interface{}{"Options": props}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(cluster, "/")+"/v2/rest/query", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("x-ms-client-request-id", requestID)
+	globalRequest.setHeaders(req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("query submission failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 16<<10))
+		return 0, fmt.Errorf("query submission failed: %s: %s", resp.Status, oneAPIMessage(msg))
+	}
+	r := &progressiveReader{enc: enc, progress: progress, tables: map[int]*progressiveTable{}}
+	err = r.read(resp.Body)
+	progress.done()
+	return r.rows, err
+}
+
+// progressiveReader writes the tables of a progressive v2 response to an Encoder:
+//
+//	DataSetHeader                 IsProgressive
+//	DataTable                     a whole table at once (QueryProperties, QueryCompletionInformation)
+//	TableHeader                   a table's columns, before its fragments
+//	TableFragment                 rows: DataAppend adds to the table, DataReplace stands for all of it so far
+//	TableProgress                 how far along the table is, in percent
+//	TableCompletion               the table's row count, and its errors
+//	DataSetCompletion             whether the query failed or was cancelled
+//
+// Appended rows are written as they come. A table the cluster replaces as it goes (a summarize,
+// say) can't be taken back once written, so its rows are held until the table completes.
+type progressiveReader struct {
+	enc      encode.Encoder
+	progress *progressLine
+	tables   map[int]*progressiveTable
+	rows     int64 // primary result rows written
+}
+
+type progressiveTable struct {
+	info    *encode.Table
+	begun   bool
+	written int64
+	held    []query.Row // the latest DataReplace rows, written at completion
+	replace bool
+}
+
+// progressiveFrame is the part of a frame read before deciding what it is.
+type progressiveFrame struct {
+	FrameType         string
+	TableId           int
+	TableFragmentType string
+	TableProgress     float64
+	HasErrors         bool
+	Cancelled         bool
+	OneApiErrors      []json.RawMessage
+}
+
+func (r *progressiveReader) read(body io.Reader) error {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("reading the result: not a v2 frame array (%v)", err)
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("reading the result: %w", err)
+		}
+		var f progressiveFrame
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return fmt.Errorf("reading the result: %w", err)
+		}
+		if err := r.frame(f, raw); err != nil {
+			return err
+		}
+	}
+	return r.enc.End()
+}
+
+func (r *progressiveReader) frame(f progressiveFrame, raw []byte) error {
+	switch f.FrameType {
+	case "DataTable":
+		var dt v2.DataTable
+		if err := json.Unmarshal(raw, &dt); err != nil {
+			return fmt.Errorf("reading the result: %w", err)
+		}
+		t := &progressiveTable{info: &encode.Table{Name: dt.Header.TableName, Kind: dt.Header.TableKind, Columns: dt.Header.Columns}}
+		if err := r.begin(t); err != nil {
+			return err
+		}
+		return r.write(t, dt.Rows)
+	case "TableHeader":
+		var h v2.TableHeader
+		if err := json.Unmarshal(raw, &h); err != nil {
+			return fmt.Errorf("reading the result: %w", err)
+		}
+		r.tables[h.TableId] = &progressiveTable{info: &encode.Table{Name: h.TableName, Kind: h.TableKind, Columns: h.Columns}}
+		return nil
+	case "TableFragment":
+		t := r.tables[f.TableId]
+		if t == nil {
+			return fmt.Errorf("reading the result: fragment of unknown table %d", f.TableId)
+		}
+		frag := v2.TableFragment{Columns: t.info.Columns, PreviousIndex: int(t.written)}
+		if err := json.Unmarshal(raw, &frag); err != nil {
+			return fmt.Errorf("reading the result: %w", err)
+		}
+		if f.TableFragmentType == "DataReplace" {
+			if t.written > 0 {
+				return fmt.Errorf("reading the result: table %s replaced rows already written; rerun without --progressive", t.info.Name)
+			}
+			t.replace, t.held = true, frag.Rows
+			r.progress.update(t.info.Name, int64(len(t.held)), -1, true)
+			return nil
+		}
+		if t.replace {
+			t.held = append(t.held, frag.Rows...)
+			return nil
+		}
+		if err := r.begin(t); err != nil {
+			return err
+		}
+		if err := r.write(t, frag.Rows); err != nil {
+			return err
+		}
+		r.progress.update(t.info.Name, t.written, -1, false)
+		return nil
+	case "TableProgress":
+		if t := r.tables[f.TableId]; t != nil {
+			rows := t.written
+			if t.replace {
+				rows = int64(len(t.held))
+			}
+			r.progress.update(t.info.Name, rows, f.TableProgress, t.replace)
+		}
+		return nil
+	case "TableCompletion":
+		t := r.tables[f.TableId]
+		if t == nil {
+			return nil
+		}
+		delete(r.tables, f.TableId)
+		if len(f.OneApiErrors) > 0 {
+			return fmt.Errorf("table error: %s", oneAPIMessage(f.OneApiErrors[0]))
+		}
+		if err := r.begin(t); err != nil { // an empty or replaced table starts now
+			return err
+		}
+		return r.write(t, t.held)
+	case "DataSetCompletion":
+		switch {
+		case len(f.OneApiErrors) > 0:
+			return errors.New(oneAPIMessage(f.OneApiErrors[0]))
+		case f.HasErrors:
+			return errors.New("the query failed")
+		case f.Cancelled:
+			return errors.New("the query was cancelled")
+		}
+	}
+	return nil
+}
+
+// begin starts writing a table, once.
+func (r *progressiveReader) begin(t *progressiveTable) error {
+	if t.begun {
+		return nil
+	}
+	t.begun = true
+	if err := r.enc.Begin(t.info); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+func (r *progressiveReader) write(t *progressiveTable, rows []query.Row) error {
+	for _, row := range rows {
+		if err := r.enc.WriteRow(t.info, int(t.written), row.Values()); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		t.written++
+		if t.info.Kind == "PrimaryResult" {
+			r.rows++
+		}
+	}
+	return nil
+}
+
+// oneAPIMessage is the message of a OneApiError ({"error": {"code", "@message"}}), or the text.
+func oneAPIMessage(b []byte) string {
+	var e struct {
+		Error struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			AtMessage string `json:"@message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &e) != nil || (e.Error.Message == "" && e.Error.AtMessage == "") {
+		return strings.TrimSpace(string(b))
+	}
+	msg := e.Error.AtMessage
+	if msg == "" {
+		msg = e.Error.Message
+	}
+	return fmt.Sprintf("%s (%s)", msg, e.Error.Code)
+}
+
+// timespanText is d as a Kusto timespan, hh:mm:ss.
+func timespanText(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// progressLine reports a progressive query on stderr: rewritten in place on a terminal, and
+// otherwise a PROGRESS line every few seconds. A nil progressLine reports nothing.
+type progressLine struct {
+	w        io.Writer
+	tty      bool
+	start    time.Time
+	last     time.Time
+	pct      map[string]float64 // each table's last known progress
+	wrote    bool
+	interval time.Duration
+}
+
+func newProgressLine() *progressLine {
+	fi, err := os.Stderr.Stat()
+	tty := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	p := &progressLine{w: os.Stderr, tty: tty, start: time.Now(), pct: map[string]float64{}, interval: 5 * time.Second}
+	if tty {
+		p.interval = 100 * time.Millisecond
+	}
+	return p
+}
+
+// update reports a table's rows so far and, if pct isn't negative, how complete it is.
+func (p *progressLine) update(table string, rows int64, pct float64, partial bool) {
+	if p == nil {
+		return
+	}
+	if pct >= 0 {
+		p.pct[table] = pct
+	}
+	if time.Since(p.last) < p.interval {
+		return
+	}
+	p.last = time.Now()
+	text := fmt.Sprintf("PROGRESS %s: %d rows", table, rows)
+	if partial {
+		text += " so far, partial"
+	}
+	if pct, ok := p.pct[table]; ok {
+		text += fmt.Sprintf(", %.1f%%", pct)
+	}
+	text += fmt.Sprintf(" (%s)", time.Since(p.start).Round(time.Second))
+	if p.tty {
+		fmt.Fprint(p.w, "\r\033[K"+text)
+		p.wrote = true
+	} else {
+		fmt.Fprintln(p.w, text)
+	}
+}
+
+// done clears the line on a terminal, so what follows starts on a clean one.
+func (p *progressLine) done() {
+	if p != nil && p.wrote {
+		fmt.Fprint(p.w, "\r\033[K")
+		p.wrote = false
+	}
+}
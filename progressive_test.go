@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestProgressiveReader(t *testing.T) {
+	header := `{"FrameType":"DataSetHeader","IsProgressive":true,"Version":"v2.0","IsFragmented":true,"ErrorReportingPlacement":"EndOfTable"}`
+	columns := `"Columns":[{"ColumnName":"State","ColumnType":"string"},{"ColumnName":"Events","ColumnType":"long"}]`
+	completion := `{"FrameType":"DataTable","TableId":2,"TableKind":"QueryCompletionInformation","TableName":"QueryCompletionInformation","Columns":[{"ColumnName":"EventTypeName","ColumnType":"string"}],"Rows":[["QueryResourceConsumption"]]}`
+	read := func(frames ...string) (string, string, int64, error) {
+		var out, progress strings.Builder
+		enc, _ := encode.New("csv", &out, encode.Options{})
+		r := &progressiveReader{enc: enc, tables: map[int]*progressiveTable{},
+			progress: &progressLine{w: &progress, start: time.Now(), pct: map[string]float64{}}}
+		err := r.read(strings.NewReader("[" + strings.Join(frames, ",\n") + "]"))
+		return out.String(), progress.String(), r.rows, err
+	}
+
+	// Appended rows are written as they arrive, with the progress in between.
+	out, progress, rows, err := read(header,
+		`{"FrameType":"TableHeader","TableId":1,"TableKind":"PrimaryResult","TableName":"PrimaryResult",`+columns+`}`,
+		`{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":1,"Rows":[["TEXAS",3],["OHIO",1]]}`,
+		`{"FrameType":"TableProgress","TableId":1,"TableProgress":40.5}`,
+		`{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":1,"Rows":[["IOWA",null]]}`,
+		`{"FrameType":"TableCompletion","TableId":1,"RowCount":3}`,
+		completion,
+		`{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}`)
+	if err != nil || rows != 3 || out != "State,Events\r\nTEXAS,3\r\nOHIO,1\r\nIOWA,\r\n" {
+		t.Errorf("append: %d rows, %v\n%q", rows, err, out)
+	}
+	for _, want := range []string{"PROGRESS PrimaryResult: 2 rows (", "PROGRESS PrimaryResult: 2 rows, 40.5% (", "PROGRESS PrimaryResult: 3 rows, 40.5% ("} {
+		if !strings.Contains(progress, want) {
+			t.Errorf("progress %q: no %q", progress, want)
+		}
+	}
+
+	// A replaced table is written once, as it stands at completion.
+	out, progress, rows, err = read(header,
+		`{"FrameType":"TableHeader","TableId":1,"TableKind":"PrimaryResult","TableName":"PrimaryResult",`+columns+`}`,
+		`{"FrameType":"TableFragment","TableFragmentType":"DataReplace","TableId":1,"Rows":[["TEXAS",1]]}`,
+		`{"FrameType":"TableProgress","TableId":1,"TableProgress":50}`,
+		`{"FrameType":"TableFragment","TableFragmentType":"DataReplace","TableId":1,"Rows":[["TEXAS",3],["OHIO",2]]}`,
+		`{"FrameType":"TableCompletion","TableId":1,"RowCount":2}`,
+		`{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}`)
+	if err != nil || rows != 2 || out != "State,Events\r\nTEXAS,3\r\nOHIO,2\r\n" {
+		t.Errorf("replace: %d rows, %v\n%q", rows, err, out)
+	}
+	if !strings.Contains(progress, "1 rows so far, partial, 50.0%") {
+		t.Errorf("replace progress %q", progress)
+	}
+
+	// Errors at the end of a table or the dataset fail the query.
+	_, _, _, err = read(header,
+		`{"FrameType":"TableHeader","TableId":1,"TableKind":"PrimaryResult","TableName":"PrimaryResult",`+columns+`}`,
+		`{"FrameType":"TableCompletion","TableId":1,"RowCount":0,"OneApiErrors":[{"error":{"code":"LimitsExceeded","@message":"Query execution has exceeded the allowed limits"}}]}`)
+	if err == nil || err.Error() != "table error: Query execution has exceeded the allowed limits (LimitsExceeded)" {
+		t.Errorf("table error: %v", err)
+	}
+	if _, _, _, err = read(header, `{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":true}`); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("cancelled: %v", err)
+	}
+}
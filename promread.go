@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// promReadMaxBody is the largest remote-read request taken, compressed or not.
+const promReadMaxBody = 32 << 20
+
+// promReader answers Prometheus remote-read requests (POST /api/v1/read) from a metrics table
+// with a row per sample: a datetime, the metric name, the other labels as a dynamic bag, and the
+// value. Each query's label matchers become where clauses on the name and the bag's fields (=,
+// != and the anchored RE2 regexes Prometheus uses, which KQL's matches regex shares), and the
+// rows are grouped into series by name and labels.
+//
+// Only the SAMPLES response type is implemented, which is what Prometheus asks for unless told to
+// stream chunks. The response is snappy-framed as the protocol requires but stored as literals,
+// uncompressed; remote read is meant for the queries Prometheus can't answer from its own
+// retention, not for bulk transfer. This bridge is experimental: there is no pushdown of
+// read hints (functions, steps), so the whole range of raw samples is read and returned.
+type promReader struct {
+	table, timeCol, nameCol, labelsCol, valueCol string
+	database                                     string
+	maxSamples                                   int
+	timeouts                                     timeoutConfig
+	run                                          func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error
+}
+
+// Label matcher types of the remote-read protocol.
+const (
+	promMatchEqual = iota
+	promMatchNotEqual
+	promMatchRegex
+	promMatchNotRegex
+)
+
+type promMatcher struct {
+	typ         int
+	name, value string
+}
+
+// promQuery is one query of a ReadRequest: a time range in epoch ms and label matchers.
+type promQuery struct {
+	start, end int64
+	matchers   []promMatcher
+}
+
+var errTooManySamples = errors.New("the query matches more samples than --prometheus-max-samples; narrow its time range or label matchers")
+
+func (p *promReader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "remote read takes POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, promReadMaxBody+1))
+	if err == nil && len(body) > promReadMaxBody {
+		err = fmt.Errorf("request over %d bytes", promReadMaxBody)
+	}
+	if err == nil {
+		body, err = snappyDecode(body)
+	}
+	var queries []promQuery
+	if err == nil {
+		queries, err = parseReadRequest(body)
+	}
+	if err != nil {
+		http.Error(w, "remote read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var resp []byte
+	for _, q := range queries {
+		series, status, err := p.read(r.Context(), q)
+		if err != nil {
+			http.Error(w, "remote read: "+err.Error(), status)
+			return
+		}
+		resp = pbMessage(resp, 1, encodeQueryResult(series))
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(snappyEncode(resp))
+}
+
+// read runs one query and returns its series, with the HTTP status for an error.
+func (p *promReader) read(ctx context.Context, q promQuery) ([]*promSeries, int, error) {
+	text, err := p.kql(q)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	ctx, cancel := p.timeouts.callContext(ctx, callQuery)
+	defer cancel()
+	start := time.Now()
+	c := &promCollector{max: p.maxSamples, series: map[string]*promSeries{}}
+	if err := p.run(ctx, p.database, (&kql.Builder{}).AddUnsafe(text), encode.PrimaryOnly{Encoder: c}); err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL serve remote read: %s\n", errText(err))
+		if errors.Is(err, errTooManySamples) {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusBadGateway, errors.New(errText(err))
+	}
+	fmt.Fprintf(os.Stderr, "OK serve remote read (%dms): %d series, %d samples, %s to %s\n", time.Since(start).Milliseconds(), len(c.series), c.samples,
+		time.UnixMilli(q.start).UTC().Format(time.RFC3339), time.UnixMilli(q.end).UTC().Format(time.RFC3339))
+	return c.sorted(), http.StatusOK, nil
+}
+
+// kql is the query for q: the time range and a where clause per matcher over the metrics table.
+func (p *promReader) kql(q promQuery) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n| where %s between (datetime(%s) .. datetime(%s))", kqlquote.Ident(p.table), kqlquote.Ident(p.timeCol),
+		time.UnixMilli(q.start).UTC().Format(time.RFC3339Nano), time.UnixMilli(q.end).UTC().Format(time.RFC3339Nano))
+	for _, m := range q.matchers {
+		expr := fmt.Sprintf("tostring(%s[%s])", kqlquote.Ident(p.labelsCol), kqlquote.String(m.name))
+		if m.name == "__name__" {
+			expr = kqlquote.Ident(p.nameCol)
+		}
+		switch m.typ {
+		case promMatchEqual:
+			fmt.Fprintf(&b, "\n| where %s == %s", expr, kqlquote.String(m.value))
+		case promMatchNotEqual:
+			fmt.Fprintf(&b, "\n| where %s != %s", expr, kqlquote.String(m.value))
+		case promMatchRegex, promMatchNotRegex:
+			re := "^(?:" + m.value + ")$"
+			if _, err := regexp.Compile(re); err != nil {
+				return "", fmt.Errorf("matcher %s=~%q: %v", m.name, m.value, err)
+			}
+			cond := fmt.Sprintf("%s matches regex %s", expr, kqlquote.String(re))
+			if m.typ == promMatchNotRegex {
+				cond = "not(" + cond + ")"
+			}
+			fmt.Fprintf(&b, "\n| where %s", cond)
+		default:
+			return "", fmt.Errorf("matcher %s: unknown type %d", m.name, m.typ)
+		}
+	}
+	fmt.Fprintf(&b, "\n| project %s, %s, %s, %s\n| take %d", kqlquote.Ident(p.timeCol), kqlquote.Ident(p.nameCol),
+		kqlquote.Ident(p.labelsCol), kqlquote.Ident(p.valueCol), p.maxSamples+1)
+	return b.String(), nil
+}
+
+type promLabel struct{ name, value string }
+
+type promSample struct {
+	value float64
+	ms    int64
+}
+
+type promSeries struct {
+	key     string
+	labels  []promLabel // sorted by name, with __name__
+	samples []promSample
+}
+
+// promCollector groups the rows of a metrics query, projected as time, name, labels and value,
+// into series.
+type promCollector struct {
+	max     int
+	samples int
+	series  map[string]*promSeries
+}
+
+func (c *promCollector) Begin(t *encode.Table) error {
+	if len(t.Columns) != 4 {
+		return fmt.Errorf("metrics query returned %d columns, want time, name, labels and value", len(t.Columns))
+	}
+	return nil
+}
+
+func (c *promCollector) WriteRow(_ *encode.Table, _ int, vals value.Values) error {
+	at, ok := encode.PlainValue(vals[0]).(time.Time)
+	v, isNum := promValue(encode.PlainValue(vals[3]))
+	if !ok || !isNum {
+		return nil // Prometheus has no nulls
+	}
+	if c.samples++; c.samples > c.max {
+		return errTooManySamples
+	}
+	name := fmt.Sprint(encode.PlainValue(vals[1]))
+	labels := []promLabel{{"__name__", name}}
+	if doc, ok := encode.PlainValue(vals[2]).([]byte); ok {
+		dec := json.NewDecoder(bytes.NewReader(doc))
+		dec.UseNumber()
+		var bag map[string]interface{}
+		if dec.Decode(&bag) == nil {
+			for k, lv := range bag {
+				if s := promLabelValue(lv); s != "" && k != "__name__" {
+					labels = append(labels, promLabel{k, s})
+				}
+			}
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	var key strings.Builder
+	for _, l := range labels {
+		key.WriteString(l.name + "\xff" + l.value + "\xff")
+	}
+	s, ok := c.series[key.String()]
+	if !ok {
+		s = &promSeries{key: key.String(), labels: labels}
+		c.series[s.key] = s
+	}
+	s.samples = append(s.samples, promSample{v, at.UnixMilli()})
+	return nil
+}
+
+func (c *promCollector) End() error { return nil }
+
+// sorted returns the series in label order, each with its samples in time order.
+func (c *promCollector) sorted() []*promSeries {
+	out := make([]*promSeries, 0, len(c.series))
+	for _, s := range c.series {
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].ms < s.samples[j].ms })
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key < out[j].key })
+	return out
+}
+
+func promValue(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int64:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case decimal.Decimal:
+		return x.InexactFloat64(), true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// promLabelValue is a label from the bag as text: strings as they are, other values as JSON.
+func promLabelValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// parseReadRequest decodes a prometheus.ReadRequest:
+//
+//	ReadRequest { repeated Query queries = 1; repeated ResponseType accepted_response_types = 2; }
+//	Query { int64 start_timestamp_ms = 1; int64 end_timestamp_ms = 2; repeated LabelMatcher matchers = 3; }
+//	LabelMatcher { Type type = 1; string name = 2; string value = 3; }
+func parseReadRequest(b []byte) ([]promQuery, error) {
+	var queries []promQuery
+	var accepted []uint64
+	err := pbFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			var q promQuery
+			err := pbFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					q.start = int64(v)
+				case 2:
+					q.end = int64(v)
+				case 3:
+					var m promMatcher
+					err := pbFields(data, func(field int, v uint64, data []byte) error {
+						switch field {
+						case 1:
+							m.typ = int(v)
+						case 2:
+							m.name = string(data)
+						case 3:
+							m.value = string(data)
+						}
+						return nil
+					})
+					q.matchers = append(q.matchers, m)
+					return err
+				}
+				return nil
+			})
+			queries = append(queries, q)
+			return err
+		case 2:
+			if data == nil {
+				accepted = append(accepted, v)
+				return nil
+			}
+			for len(data) > 0 { // packed
+				t, n := binary.Uvarint(data)
+				if n <= 0 {
+					return errors.New("bad packed response types")
+				}
+				accepted, data = append(accepted, t), data[n:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ReadRequest: %v", err)
+	}
+	if len(accepted) > 0 && !containsUint(accepted, 0) {
+		return nil, errors.New("only the SAMPLES response type is supported; unset read_recent streaming (accepted_response_types)")
+	}
+	return queries, nil
+}
+
+func containsUint(s []uint64, v uint64) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeQueryResult encodes a prometheus.QueryResult:
+//
+//	QueryResult { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func encodeQueryResult(series []*promSeries) []byte {
+	var out []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			ts = pbMessage(ts, 1, pbMessage(pbMessage(nil, 1, []byte(l.name)), 2, []byte(l.value)))
+		}
+		for _, smp := range s.samples {
+			var b []byte
+			b = binary.AppendUvarint(b, 1<<3|1)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(smp.value))
+			b = binary.AppendUvarint(b, 2<<3|0)
+			b = binary.AppendUvarint(b, uint64(smp.ms))
+			ts = pbMessage(ts, 2, b)
+		}
+		out = pbMessage(out, 1, ts)
+	}
+	return out
+}
+
+// pbMessage appends a length-delimited field.
+func pbMessage(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// pbFields calls fn for each field of a protobuf message: with the value of a varint or fixed
+// field, or the data of a length-delimited one (non-nil, possibly empty).
+func pbFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad field tag")
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch tag & 7 {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("bad varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return io.ErrUnexpectedEOF
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+		if err := fn(int(tag>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snappyDecode decodes a snappy block (not the framed stream format), as remote read sends.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > promReadMaxBody {
+		return nil, errors.New("snappy: bad or too large length")
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0: // literal
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, io.ErrUnexpectedEOF
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if len(src) < length || len(dst)+length > int(n) {
+				return nil, errors.New("snappy: corrupt literal")
+			}
+			dst, src = append(dst, src[:length]...), src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			length, offset = 4+int(tag>>2&7), int(tag&0xe0)<<3|int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			length, offset = 1+int(tag>>2), int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			length, offset = 1+int(tag>>2), int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, errors.New("snappy: corrupt copy")
+		}
+		for i := 0; i < length; i++ { // copies may overlap their own output
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, errors.New("snappy: short block")
+	}
+	return dst, nil
+}
+
+// snappyEncode writes src as a snappy block made only of literals: valid for any decoder, and
+// cheap, at the cost of no compression.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)+len(src)/65536*3+16), uint64(len(src)))
+	for len(src) > 0 {
+		chunk := src[:min(len(src), 65536)]
+		switch n := len(chunk) - 1; {
+		case n < 60:
+			dst = append(dst, byte(n)<<2)
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst, src = append(dst, chunk...), src[len(chunk):]
+	}
+	return dst
+}
+
+// parsePromSchema reads --prometheus-schema, time,name,labels,value column names.
+func parsePromSchema(s string) (timeCol, nameCol, labelsCol, valueCol string, err error) {
+	cols := splitCSV(s)
+	if len(cols) != 4 {
+		return "", "", "", "", fmt.Errorf("want four columns, time,name,labels,value, got %q", s)
+	}
+	return cols[0], cols[1], cols[2], cols[3], nil
+}
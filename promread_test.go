@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestSnappy(t *testing.T) {
+	for _, n := range []int{0, 1, 59, 60, 255, 256, 70000} {
+		src := bytes.Repeat([]byte("metrics"), n)[:n]
+		got, err := snappyDecode(snappyEncode(src))
+		if err != nil || !bytes.Equal(got, src) {
+			t.Errorf("round trip of %d bytes: %v", n, err)
+		}
+	}
+	// "abcabcabcab": the literal "abc", then a copy of 8 bytes from 3 back, overlapping its own output.
+	block := []byte{11, 2 << 2, 'a', 'b', 'c', 1 | (8-4)<<2, 3}
+	if got, err := snappyDecode(block); err != nil || string(got) != "abcabcabcab" {
+		t.Errorf("copy: %q, %v", got, err)
+	}
+	if _, err := snappyDecode([]byte{5, 0, 'a'}); err == nil {
+		t.Error("short block: no error")
+	}
+}
+
+// readRequest encodes a ReadRequest with one query.
+func readRequest(start, end int64, matchers ...promMatcher) []byte {
+	var q []byte
+	q = binary.AppendUvarint(q, 1<<3)
+	q = binary.AppendUvarint(q, uint64(start))
+	q = binary.AppendUvarint(q, 2<<3)
+	q = binary.AppendUvarint(q, uint64(end))
+	for _, m := range matchers {
+		var b []byte
+		b = binary.AppendUvarint(b, 1<<3)
+		b = binary.AppendUvarint(b, uint64(m.typ))
+		b = pbMessage(pbMessage(b, 2, []byte(m.name)), 3, []byte(m.value))
+		q = pbMessage(q, 3, b)
+	}
+	return pbMessage(nil, 1, q)
+}
+
+func TestPromReaderKQL(t *testing.T) {
+	p := &promReader{table: "Metrics", timeCol: "Timestamp", nameCol: "Name", labelsCol: "Labels", valueCol: "Value", maxSamples: 100}
+	queries, err := parseReadRequest(readRequest(1717200000000, 1717203600000,
+		promMatcher{promMatchEqual, "__name__", "http_requests_total"},
+		promMatcher{promMatchNotEqual, "job", "canary"},
+		promMatcher{promMatchRegex, "code", "5.."},
+		promMatcher{promMatchNotRegex, "path", "/health|/ready"}))
+	if err != nil || len(queries) != 1 {
+		t.Fatalf("parseReadRequest: %v, %d queries", err, len(queries))
+	}
+	got, err := p.kql(queries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "['Metrics']\n" +
+		"| where ['Timestamp'] between (datetime(2024-06-01T00:00:00Z) .. datetime(2024-06-01T01:00:00Z))\n" +
+		`| where ['Name'] == "http_requests_total"` + "\n" +
+		`| where tostring(['Labels']["job"]) != "canary"` + "\n" +
+		`| where tostring(['Labels']["code"]) matches regex "^(?:5..)$"` + "\n" +
+		`| where not(tostring(['Labels']["path"]) matches regex "^(?:/health|/ready)$")` + "\n" +
+		"| project ['Timestamp'], ['Name'], ['Labels'], ['Value']\n" +
+		"| take 101"
+	if got != want {
+		t.Errorf("kql:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := p.kql(promQuery{matchers: []promMatcher{{promMatchRegex, "code", "(5"}}}); err == nil {
+		t.Error("bad regex: no error")
+	}
+	streamed := append(readRequest(0, 1), 2<<3, 1) // accepted_response_types: STREAMED_XOR_CHUNKS
+	if _, err := parseReadRequest(streamed); err == nil || !strings.Contains(err.Error(), "SAMPLES") {
+		t.Errorf("streamed chunks only: %v", err)
+	}
+}
+
+func TestPromReader(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	var sent string
+	p := &promReader{table: "Metrics", timeCol: "Timestamp", nameCol: "Name", labelsCol: "Labels", valueCol: "Value",
+		database: "db", maxSamples: 3, timeouts: resolveTimeouts(nil, nil, time.Minute)}
+	rows := []value.Values{
+		{value.NewDateTime(t0.Add(time.Minute)), value.NewString("up"), value.NewDynamic([]byte(`{"job":"api","instance":"b"}`)), value.NewReal(1)},
+		{value.NewDateTime(t0), value.NewString("up"), value.NewDynamic([]byte(`{"instance":"b","job":"api"}`)), value.NewReal(0)},
+		{value.NewDateTime(t0), value.NewString("up"), value.NewDynamic([]byte(`{"job":"api","instance":"a","zone":null}`)), value.NewLong(1)},
+		{value.NewDateTime(t0), value.NewString("up"), value.NewDynamic(nil), value.NewNullReal()},
+	}
+	p.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		sent = q.String()
+		tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "Timestamp", types.DateTime),
+			query.NewColumn(1, "Name", types.String), query.NewColumn(2, "Labels", types.Dynamic), query.NewColumn(3, "Value", types.Real)}}
+		enc.Begin(tbl)
+		for i, r := range rows {
+			if err := enc.WriteRow(tbl, i, r); err != nil {
+				return err
+			}
+		}
+		return enc.End()
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	post := func(body []byte) (int, []byte) {
+		t.Helper()
+		resp, err := srv.Client().Post(srv.URL, "application/x-protobuf", bytes.NewReader(snappyEncode(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	status, data := post(readRequest(t0.UnixMilli(), t0.Add(time.Hour).UnixMilli(), promMatcher{promMatchEqual, "__name__", "up"}))
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, data)
+	}
+	if !strings.Contains(sent, `| where ['Name'] == "up"`) {
+		t.Errorf("sent %q", sent)
+	}
+	data, err := snappyDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ReadResponse → QueryResult → TimeSeries, flattened to "labels: samples" per series.
+	var series []string
+	err = pbFields(data, func(_ int, _ uint64, result []byte) error {
+		return pbFields(result, func(_ int, _ uint64, ts []byte) error {
+			var labels, samples []string
+			err := pbFields(ts, func(field int, _ uint64, data []byte) error {
+				var a, b string
+				err := pbFields(data, func(f int, v uint64, data []byte) error {
+					switch {
+					case field == 1 && f == 1:
+						a = string(data)
+					case field == 1 && f == 2:
+						b = string(data)
+					case f == 1:
+						a = strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64)
+					case f == 2:
+						b = time.UnixMilli(int64(v)).UTC().Format("15:04")
+					}
+					return nil
+				})
+				if field == 1 {
+					labels = append(labels, a+"="+b)
+				} else {
+					samples = append(samples, a+"@"+b)
+				}
+				return err
+			})
+			series = append(series, strings.Join(labels, ",")+": "+strings.Join(samples, " "))
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"__name__=up,instance=a,job=api: 1@00:00",
+		"__name__=up,instance=b,job=api: 0@00:00 1@00:01",
+	}
+	if strings.Join(series, "\n") != strings.Join(want, "\n") {
+		t.Errorf("series:\n%s\nwant:\n%s", strings.Join(series, "\n"), strings.Join(want, "\n"))
+	}
+
+	p.maxSamples = 2
+	if status, data := post(readRequest(0, 1)); status != http.StatusBadRequest || !strings.Contains(string(data), "--prometheus-max-samples") {
+		t.Errorf("over max samples: %d %s", status, data)
+	}
+	if resp, err := srv.Client().Get(srv.URL); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %v %v", resp, err)
+	}
+}
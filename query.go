@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// queryFlags are the settings of the "query" subcommand. Empty fields fall back to KUSTO_CLUSTER,
+// the session's database or KUSTO_DATABASE, and KUSTO_QUERY, so running without the subcommand
+// (env only) behaves as before.
+type queryFlags struct {
+	cluster, database, query string
+}
+
+// parseQueryArgs parses "query [flags]". Besides its own flags it accepts every global flag
+// (--format, --timeout, --out, ...), so a script can put all its settings after "query".
+func parseQueryArgs(args []string) *queryFlags {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	q := &queryFlags{}
+	fs.StringVar(&q.cluster, "cluster", "", "cluster URI, or a cluster name in eastus (default KUSTO_CLUSTER)")
+	fs.StringVar(&q.database, "database", "", "database to query (default the --session's, then KUSTO_DATABASE)")
+	fs.StringVar(&q.query, "query", "", "KQL to run (default KUSTO_QUERY)")
+	queryFile := fs.String("query-file", "", "read the KQL to run from a file ('-' for stdin); a .tmpl file is rendered as a Go template")
+	vars := queryVars{}
+	fs.Var(vars, "var", "template variable as name=value, for a .tmpl --query-file (repeatable)")
+	pos := parseArgs(fs, args)
+	if len(pos) > 0 && pos[0] == "-" && *queryFile == "" {
+		// "query -" is short for --query-file -: cat q.kql | kusto-example query -
+		*queryFile, pos = "-", pos[1:]
+	}
+	if len(pos) > 0 {
+		log.Fatalf("query: unexpected argument %q (quote the KQL and pass it with --query, or pipe it to 'query -')", pos[0])
+	}
+	if *queryFile != "" {
+		if q.query != "" {
+			log.Fatalf("query: --query and --query-file are mutually exclusive")
+		}
+		var text []byte
+		var err error
+		if *queryFile == "-" {
+			text, err = io.ReadAll(os.Stdin)
+		} else {
+			text, err = os.ReadFile(*queryFile)
+		}
+		if err != nil {
+			log.Fatalf("query: --query-file: %v", err)
+		}
+		if q.query = strings.TrimSpace(string(text)); q.query == "" {
+			log.Fatalf("query: %s is empty", *queryFile)
+		}
+	}
+	if strings.HasSuffix(*queryFile, ".tmpl") || len(vars) > 0 {
+		if q.query == "" {
+			log.Fatalf("query: --var needs a --query-file or --query to render")
+		}
+		name := *queryFile
+		if name == "" || name == "-" {
+			name = "query"
+		}
+		text, unused, err := renderQueryTemplate(name, q.query, vars)
+		if err != nil {
+			log.Fatalf("query: %v", err)
+		}
+		for _, v := range unused {
+			fmt.Fprintf(os.Stderr, "WARN query: --var %s is not used by %s\n", v, name)
+		}
+		if q.query = strings.TrimSpace(text); q.query == "" {
+			log.Fatalf("query: %s renders to an empty query", name)
+		}
+	}
+	if q.cluster != "" && !strings.Contains(q.cluster, "://") {
+		q.cluster = resolveClusterURL(q.cluster)
+	}
+	return q
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseQueryArgs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "storms.kql"), []byte("\n  StormEvents | count\n\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "top.kql.tmpl"), []byte("{{ident .table}} | take {{.n}}"), 0o644)
+	tests := []struct {
+		args []string
+		want queryFlags
+	}{
+		{args: nil, want: queryFlags{}},
+		{args: []string{"--cluster", "help", "--database", "Samples", "--query", "print 1"},
+			want: queryFlags{cluster: "https://help.eastus.kusto.windows.net", database: "Samples", query: "print 1"}},
+		{args: []string{"--cluster", "https://help.kusto.windows.net/", "--query-file", filepath.Join(dir, "storms.kql")},
+			want: queryFlags{cluster: "https://help.kusto.windows.net/", query: "StormEvents | count"}},
+		// Flags may follow the query file; a .tmpl file is rendered with --var.
+		{args: []string{"--query-file", filepath.Join(dir, "top.kql.tmpl"), "--var", "table=Storm Events", "--var", "n=3"},
+			want: queryFlags{query: "['Storm Events'] | take 3"}},
+		{args: []string{"--query", "{{.t}} | count", "--var", "t=T"}, want: queryFlags{query: "T | count"}},
+	}
+	for _, tt := range tests {
+		if got := parseQueryArgs(tt.args); *got != tt.want {
+			t.Errorf("parseQueryArgs(%q) = %+v, want %+v", tt.args, *got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryArgsStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	os.Stdin = r
+	w.WriteString("StormEvents\n| take 5\n")
+	w.Close()
+
+	q := parseQueryArgs([]string{"--database", "sampledb", "-"})
+	if q.query != "StormEvents\n| take 5" || q.database != "sampledb" {
+		t.Errorf("parseQueryArgs(-) = %+v", q)
+	}
+}
+
+func TestRenderQueryTemplate(t *testing.T) {
+	const tmpl = `{{ident .table}}
+| where StartTime >= datetime({{.start}}){{with .state}} and State == {{quote .}}{{end}}
+| take {{with .limit}}{{$.limit}}{{end}}`
+	got, unused, err := renderQueryTemplate("report.kql.tmpl", tmpl,
+		queryVars{"table": "Storm Events", "start": "2024-01-01", "state": `TEX"AS`, "limit": "5", "extra": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "['Storm Events']\n| where StartTime >= datetime(2024-01-01) and State == \"TEX\\\"AS\"\n| take 5"
+	if got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+	if len(unused) != 1 || unused[0] != "extra" {
+		t.Errorf("unused = %v, want [extra]", unused)
+	}
+
+	_, _, err = renderQueryTemplate("report.kql.tmpl", tmpl, queryVars{"start": "2024-01-01"})
+	if err == nil || !strings.Contains(err.Error(), "missing --var limit, --var state, --var table") {
+		t.Errorf("missing vars: err = %v", err)
+	}
+}
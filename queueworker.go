@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/sink"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// queueRequest is a query request message. Messages are JSON, as sent or base64-encoded (the
+// storage SDKs encode by default):
+//
+//	{"id": "daily-storms", "database": "sampledb", "query": "StormEvents | take 10", "format": "csv", "out": "daily/storms.csv"}
+//
+// Only query is required. database and format default to the worker's --database and --format,
+// id to the message's id, and out, the blob the result is written to under the --container
+// prefix, to results/<id>.<ext>.
+type queueRequest struct {
+	ID       string `json:"id"`
+	Database string `json:"database"`
+	Query    string `json:"query"`
+	Format   string `json:"format"`
+	Out      string `json:"out"`
+}
+
+// parseQueueRequest decodes a message's text, filling in the defaults. An error means the
+// message can never succeed.
+func parseQueueRequest(text, messageID, database, format string) (*queueRequest, error) {
+	data := []byte(strings.TrimSpace(text))
+	if len(data) > 0 && data[0] != '{' {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("neither JSON nor base64: %v", err)
+		}
+		data = decoded
+	}
+	req := &queueRequest{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		return nil, fmt.Errorf("not a query request: %v", err)
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return nil, errors.New("no query")
+	}
+	if req.ID == "" {
+		req.ID = messageID
+	}
+	if req.Database == "" {
+		req.Database = database
+	}
+	if req.Format == "" {
+		req.Format = format
+	}
+	if _, err := encode.New(req.Format, io.Discard, encode.Options{}); err != nil {
+		return nil, err
+	}
+	if req.Out == "" {
+		req.Out = "results/" + req.ID + "." + sink.FormatExt(req.Format)
+	}
+	if p := path.Clean(req.Out); p != req.Out || path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return nil, fmt.Errorf("out %q: want a relative blob path without . or .. segments", req.Out)
+	}
+	return req, nil
+}
+
+// storageQueue is an Azure Storage queue, https://<account>.queue.core.windows.net/<queue>. A
+// URL with a SAS is used as is; without one, requests carry a DefaultAzureCredential token,
+// which needs Storage Queue Data Message Processor on the queue (Contributor for the poison
+// queue).
+type storageQueue struct {
+	url    string // with its SAS, if any
+	cred   azcore.TokenCredential
+	client *http.Client
+}
+
+// queueMessage is a message received from a queue. PopReceipt changes each time the message's
+// visibility is updated, and the latest one is needed to delete it.
+type queueMessage struct {
+	ID           string `xml:"MessageId"`
+	PopReceipt   string `xml:"PopReceipt"`
+	DequeueCount int    `xml:"DequeueCount"`
+	Text         string `xml:"MessageText"`
+}
+
+func newStorageQueue(setting, location string) (*storageQueue, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "https" || u.Host == "" || strings.Trim(u.Path, "/") == "" || strings.Contains(strings.Trim(u.Path, "/"), "/") {
+		return nil, fmt.Errorf("%s %q: expected https://<account>.queue.core.windows.net/<queue>[?<sas>]", setting, stripSAS(location))
+	}
+	q := &storageQueue{url: location, client: &http.Client{}}
+	if u.RawQuery == "" {
+		if q.cred, err = azidentity.NewDefaultAzureCredential(nil); err != nil {
+			return nil, fmt.Errorf("%s: %v (or add a SAS to the URL)", setting, err)
+		}
+	}
+	return q, nil
+}
+
+// sibling is the queue named after this one plus suffix, in the same account, with the same
+// SAS (so it must be an account SAS) or credential.
+func (q *storageQueue) sibling(suffix string) *storageQueue {
+	base, sas, _ := strings.Cut(q.url, "?")
+	uri := strings.TrimRight(base, "/") + suffix
+	if sas != "" {
+		uri += "?" + sas
+	}
+	return &storageQueue{url: uri, cred: q.cred, client: q.client}
+}
+
+// messageURL is the URL of the queue's messages, or of one message, with query parameters.
+func (q *storageQueue) messageURL(id string, params url.Values) string {
+	p := "messages"
+	if id != "" {
+		p += "/" + id
+	}
+	uri := withSASPath(q.url, p)
+	if len(params) == 0 {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + params.Encode()
+	}
+	return uri + "?" + params.Encode()
+}
+
+// receive takes the next message off the queue, hiding it from other receivers for visibility,
+// or returns nil when the queue is empty.
+func (q *storageQueue) receive(ctx context.Context, visibility time.Duration) (*queueMessage, error) {
+	uri := q.messageURL("", url.Values{"numofmessages": {"1"}, "visibilitytimeout": {visibilitySeconds(visibility)}})
+	data, _, err := q.do(ctx, http.MethodGet, uri, "")
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Messages []queueMessage `xml:"QueueMessage"`
+	}
+	if err := xml.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("get messages: %v", err)
+	}
+	if len(list.Messages) == 0 {
+		return nil, nil
+	}
+	return &list.Messages[0], nil
+}
+
+// hide makes a received message invisible for d from now, keeping its text.
+func (q *storageQueue) hide(ctx context.Context, m *queueMessage, d time.Duration) error {
+	uri := q.messageURL(m.ID, url.Values{"popreceipt": {m.PopReceipt}, "visibilitytimeout": {visibilitySeconds(d)}})
+	_, header, err := q.do(ctx, http.MethodPut, uri, "")
+	if err != nil {
+		return err
+	}
+	if pr := header.Get("x-ms-popreceipt"); pr != "" {
+		m.PopReceipt = pr
+	}
+	return nil
+}
+
+// remove deletes a received message.
+func (q *storageQueue) remove(ctx context.Context, m *queueMessage) error {
+	_, _, err := q.do(ctx, http.MethodDelete, q.messageURL(m.ID, url.Values{"popreceipt": {m.PopReceipt}}), "")
+	return err
+}
+
+// send posts a message with the given text.
+func (q *storageQueue) send(ctx context.Context, text string) error {
+	var body strings.Builder
+	body.WriteString("<QueueMessage><MessageText>")
+	xml.EscapeText(&body, []byte(text))
+	body.WriteString("</MessageText></QueueMessage>")
+	_, _, err := q.do(ctx, http.MethodPost, q.messageURL("", nil), body.String())
+	return err
+}
+
+func (q *storageQueue) do(ctx context.Context, method, uri, body string) ([]byte, http.Header, error) {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("x-ms-version", sasVersion)
+	if q.cred != nil {
+		tok, err := q.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://storage.azure.com/.default"}})
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok.Token)
+	}
+	return sendStorageHeader(q.client, req, stripSAS(uri))
+}
+
+// visibilitySeconds is d in whole seconds, as the queue service takes it.
+func visibilitySeconds(d time.Duration) string {
+	return strconv.Itoa(int(d / time.Second))
+}
+
+// queueConsumer is what the commands driven by a storage queue share: they take messages off
+// queue one at a time, keep one hidden from other consumers while it is handled, make a failed
+// one visible again after retryDelay, and move one that can never succeed, or was received more
+// than maxDequeue times, to the poison queue.
+type queueConsumer struct {
+	queue      *storageQueue
+	poison     *storageQueue
+	visibility time.Duration
+	retryDelay time.Duration
+	maxDequeue int
+	timeouts   timeoutConfig // mgmt bounds the queue calls
+}
+
+// consume hands messages to handle until interrupted, finishing the message in hand, or with
+// drain until the queue is empty. It looks again every poll while the queue is empty.
+func (c *queueConsumer) consume(poll time.Duration, drain bool, handle func(context.Context, *queueMessage)) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	for {
+		select {
+		case <-interrupt:
+			fmt.Fprintln(os.Stderr, "QUEUE interrupted, stopping")
+			return
+		default:
+		}
+		ctx, cancel := c.timeouts.callContext(context.Background(), callMgmt)
+		m, err := c.queue.receive(ctx, c.visibility)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARN queue: %v\n", err)
+		}
+		if m != nil {
+			handle(context.Background(), m)
+			continue
+		}
+		if drain && err == nil {
+			return
+		}
+		select {
+		case <-interrupt:
+			fmt.Fprintln(os.Stderr, "QUEUE interrupted, stopping")
+			return
+		case <-time.After(poll):
+		}
+	}
+}
+
+// exhausted is the error for a message received more times than maxDequeue, or nil.
+func (c *queueConsumer) exhausted(m *queueMessage) error {
+	if m.DequeueCount > c.maxDequeue {
+		return fmt.Errorf("received %d times, more than %d", m.DequeueCount, c.maxDequeue)
+	}
+	return nil
+}
+
+// done deletes a message that has been handled; what names it in warnings.
+func (c *queueConsumer) done(ctx context.Context, m *queueMessage, what string) {
+	ctx, cancel := c.timeouts.callContext(ctx, callMgmt)
+	defer cancel()
+	if err := c.queue.remove(ctx, m); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN %s: deleting the message: %v; it will be handled again\n", what, err)
+	}
+}
+
+// retry makes a message whose handling failed visible again after retryDelay.
+func (c *queueConsumer) retry(ctx context.Context, m *queueMessage, what string) {
+	ctx, cancel := c.timeouts.callContext(ctx, callMgmt)
+	defer cancel()
+	if err := c.queue.hide(ctx, m, c.retryDelay); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN %s: %v\n", what, err)
+	}
+}
+
+// reject moves a message that will never succeed to the poison queue, text unchanged.
+func (c *queueConsumer) reject(ctx context.Context, m *queueMessage, reason error) {
+	ctx, cancel := c.timeouts.callContext(ctx, callMgmt)
+	defer cancel()
+	if err := c.poison.send(ctx, m.Text); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN message %s: %v; moving it to the poison queue: %v\n", m.ID, reason, err)
+		return
+	}
+	if err := c.queue.remove(ctx, m); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN message %s: deleting it after moving it to the poison queue: %v\n", m.ID, err)
+	}
+	fmt.Fprintf(os.Stderr, "POISON message %s: %v; moved to %s\n", m.ID, reason, stripSAS(c.poison.url))
+}
+
+// keepHidden extends the message's invisibility while it is handled, so work that takes longer
+// than the visibility timeout isn't picked up by another consumer. It returns the function that
+// stops it.
+func (c *queueConsumer) keepHidden(ctx context.Context, m *queueMessage) func() {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(c.visibility / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			hctx, cancel := c.timeouts.callContext(ctx, callMgmt)
+			err := c.queue.hide(hctx, m, c.visibility)
+			cancel()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARN message %s: extending its visibility timeout: %v\n", m.ID, err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// queueWorker runs the query requests it takes off a queue and writes each result as a blob in
+// the results container. A message is deleted once its result is written; one that can't be
+// parsed goes to the poison queue.
+type queueWorker struct {
+	queueConsumer // its timeouts' query bounds the request, ingest the upload
+	results       *scratchContainer
+	database      string
+	format        string
+	// run writes the request's result to w in req.Format and returns the primary result's rows.
+	run func(ctx context.Context, req *queueRequest, w io.Writer) (int64, error)
+}
+
+// handle processes one received message.
+func (w *queueWorker) handle(ctx context.Context, m *queueMessage) {
+	req, err := parseQueueRequest(m.Text, m.ID, w.database, w.format)
+	if err == nil {
+		err = w.exhausted(m)
+	}
+	if err != nil {
+		w.reject(ctx, m, err)
+		return
+	}
+	start := time.Now()
+	stop := w.keepHidden(ctx, m)
+	rows, size, err := w.extract(ctx, req)
+	stop()
+	elapsed := time.Since(start).Milliseconds()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL request %s (%dms): %s; attempt %d of %d, retrying in %s\n",
+			req.ID, elapsed, errText(err), m.DequeueCount, w.maxDequeue, w.retryDelay)
+		w.retry(ctx, m, "request "+req.ID)
+		return
+	}
+	w.done(ctx, m, "request "+req.ID)
+	fmt.Fprintf(os.Stderr, "OK request %s (%dms): %d rows, %d bytes to %s\n", req.ID, elapsed, rows, size, w.results.blobURL(w.blobName(req)))
+}
+
+// extract runs the request into a temporary file and uploads it.
+func (w *queueWorker) extract(ctx context.Context, req *queueRequest) (rows, size int64, err error) {
+	f, err := os.CreateTemp("", "queue-result-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	qctx, cancel := w.timeouts.callContext(ctx, callQuery)
+	rows, err = w.run(qctx, req, f)
+	cancel()
+	if err != nil {
+		return rows, 0, err
+	}
+	if size, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return rows, 0, err
+	}
+	if size > maxExternalBytes {
+		return rows, size, fmt.Errorf("the result is %d bytes, more than one upload takes (%d)", size, int64(maxExternalBytes))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return rows, size, err
+	}
+	uctx, cancel := w.timeouts.callContext(ctx, callIngest)
+	defer cancel()
+	return rows, size, w.results.upload(uctx, w.blobName(req), f, size, sink.FormatContentType(req.Format))
+}
+
+func (w *queueWorker) blobName(req *queueRequest) string {
+	if w.results.prefix != "" {
+		return w.results.prefix + "/" + req.Out
+	}
+	return req.Out
+}
+
+// runQueueWorker implements "queue-worker [cluster-name]": it takes query requests off an Azure
+// Storage queue and writes each result to a blob, so extracts can be triggered by posting a
+// message, without an HTTP endpoint. It polls until interrupted, finishing the request in
+// hand, or with --drain until the queue is empty.
+func runQueueWorker(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("queue-worker", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	queueURL := fs.String("queue", os.Getenv("KUSTO_REQUEST_QUEUE"), "queue to take requests from: https://<account>.queue.core.windows.net/<queue>[?<sas>]")
+	poisonURL := fs.String("poison-queue", "", "queue requests that can't succeed are moved to (default: the queue's name plus -poison)")
+	container := fs.String("container", os.Getenv("KUSTO_RESULT_CONTAINER"), "container results are written to: https://<account>.blob.core.windows.net/<container>[/<prefix>]")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database for requests that don't name one")
+	format := fs.String("format", getenv("KUSTO_FORMAT", "ndjson"), "output format for requests that don't name one: "+strings.Join(encode.Names(), "|"))
+	visibility := fs.Duration("visibility", 5*time.Minute, "how long a received request stays hidden from other workers; extended while it runs")
+	poll := fs.Duration("poll", 10*time.Second, "how long to wait before looking again when the queue is empty")
+	retryDelay := fs.Duration("retry-delay", time.Minute, "how long a failed request waits before it is retried")
+	maxDequeue := fs.Int("max-dequeue", 5, "move a request to the poison queue once it has been received more than this many times")
+	drain := fs.Bool("drain", false, "exit once the queue is empty instead of polling")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	if *queueURL == "" || *container == "" {
+		log.Fatalf("queue-worker: --queue (or KUSTO_REQUEST_QUEUE) and --container (or KUSTO_RESULT_CONTAINER) are required")
+	}
+	if *visibility < 2*time.Second || *visibility > 7*24*time.Hour || *poll <= 0 || *retryDelay < 0 || *maxDequeue < 1 {
+		log.Fatalf("queue-worker: --visibility must be between 2s and 7 days, --poll positive, --retry-delay not negative and --max-dequeue at least 1")
+	}
+	if _, err := encode.New(*format, io.Discard, encode.Options{}); err != nil {
+		log.Fatalf("queue-worker: --format: %v", err)
+	}
+	queue, err := newStorageQueue("--queue", *queueURL)
+	if err != nil {
+		log.Fatalf("queue-worker: %v", err)
+	}
+	poison := queue.sibling("-poison")
+	if *poisonURL != "" {
+		if poison, err = newStorageQueue("--poison-queue", *poisonURL); err != nil {
+			log.Fatalf("queue-worker: %v", err)
+		}
+	}
+	results, err := newBlobContainer("--container", *container)
+	if err != nil {
+		log.Fatalf("queue-worker: %v", err)
+	}
+
+	startTokenRefresh(context.Background())
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 30*time.Minute)
+
+	w := &queueWorker{
+		queueConsumer: queueConsumer{queue: queue, poison: poison, visibility: *visibility, retryDelay: *retryDelay, maxDequeue: *maxDequeue, timeouts: timeouts},
+		results:       results,
+		database:      *database,
+		format:        *format,
+	}
+	w.run = func(ctx context.Context, req *queueRequest, out io.Writer) (int64, error) {
+		enc, err := encode.New(req.Format, out, encode.Options{})
+		if err != nil {
+			return 0, err
+		}
+		return stream.Query(ctx, client, req.Database, (&kql.Builder{}).AddUnsafe(req.Query), enc)
+	}
+
+	fmt.Fprintf(os.Stderr, "QUEUE listening on %s, writing to %s\n", stripSAS(queue.url), results.blobURL(results.prefix))
+	w.consume(*poll, *drain, w.handle)
+}
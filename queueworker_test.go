@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseQueueRequest(t *testing.T) {
+	req, err := parseQueueRequest(base64.StdEncoding.EncodeToString([]byte(`{"query":"T | take 1"}`)), "m1", "sampledb", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ID != "m1" || req.Database != "sampledb" || req.Format != "csv" || req.Out != "results/m1.csv" {
+		t.Errorf("defaults: got %+v", req)
+	}
+	for _, text := range []string{
+		`{"query":""}`,
+		`{"query":"T","out":"../elsewhere.csv"}`,
+		`{"query":"T","out":"/abs.csv"}`,
+		`{"query":"T","format":"nope"}`,
+		`{"query":"T","cluster":"other"}`,
+		`not json`,
+	} {
+		if _, err := parseQueueRequest(text, "m1", "sampledb", "csv"); err == nil {
+			t.Errorf("%s: accepted", text)
+		}
+	}
+}
+
+// fakeRequestQueue answers the queue service's message calls, for one queue and its poison queue,
+// and Put Blob for the results container. Update Message hands out a new pop receipt.
+type fakeRequestQueue struct {
+	mu       sync.Mutex
+	messages map[string]*queueMessage // by id, in the queue
+	poisoned []string
+	blobs    map[string]string
+	hidden   map[string]string // id -> last visibilitytimeout
+	receipts int
+}
+
+func (f *fakeRequestQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := r.URL.Query()
+	if q.Get("sig") == "" {
+		http.Error(w, "bad SAS", http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/results/"):
+		f.blobs[strings.TrimPrefix(r.URL.Path, "/results/")] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/requests-poison/messages" && r.Method == http.MethodPost:
+		var m struct{ MessageText string }
+		xml.Unmarshal(body, &m)
+		f.poisoned = append(f.poisoned, m.MessageText)
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, "/requests/messages/"):
+		m := f.messages[strings.TrimPrefix(r.URL.Path, "/requests/messages/")]
+		if m == nil || q.Get("popreceipt") != m.PopReceipt {
+			w.Header().Set("x-ms-error-code", "PopReceiptMismatch")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.messages, m.ID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f.receipts++
+		m.PopReceipt = fmt.Sprintf("r%d", f.receipts)
+		f.hidden[m.ID] = q.Get("visibilitytimeout")
+		w.Header().Set("x-ms-popreceipt", m.PopReceipt)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusNotFound)
+	}
+}
+
+func TestQueueWorker(t *testing.T) {
+	svc := &fakeRequestQueue{messages: map[string]*queueMessage{}, blobs: map[string]string{}, hidden: map[string]string{}}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	queue := &storageQueue{url: srv.URL + "/requests?sig=s", client: srv.Client()}
+	w := &queueWorker{
+		queueConsumer: queueConsumer{
+			queue:      queue,
+			poison:     queue.sibling("-poison"),
+			visibility: time.Minute,
+			retryDelay: 30 * time.Second,
+			maxDequeue: 2,
+			timeouts:   resolveTimeouts(nil, nil, time.Minute),
+		},
+		results:  &scratchContainer{base: srv.URL, account: "acct", container: "results", prefix: "extracts", key: []byte("secret"), client: srv.Client()},
+		database: "sampledb",
+		format:   "csv",
+		run: func(_ context.Context, req *queueRequest, out io.Writer) (int64, error) {
+			if strings.Contains(req.Query, "fail") {
+				return 0, errors.New("query failed")
+			}
+			fmt.Fprintf(out, "%s,%s\n", req.Database, req.Query)
+			return 1, nil
+		},
+	}
+	receive := func(id, text string, count int) *queueMessage {
+		m := &queueMessage{ID: id, PopReceipt: "r0-" + id, DequeueCount: count, Text: text}
+		svc.messages[id] = &queueMessage{ID: id, PopReceipt: m.PopReceipt}
+		return m
+	}
+	ctx := context.Background()
+
+	w.handle(ctx, receive("ok", `{"query":"T | take 1","out":"daily/t.csv"}`, 1))
+	if got := svc.blobs["extracts/daily/t.csv"]; got != "sampledb,T | take 1\n" {
+		t.Errorf("result blob = %q", got)
+	}
+	if _, ok := svc.messages["ok"]; ok {
+		t.Error("a completed request's message was not deleted")
+	}
+
+	w.handle(ctx, receive("retry", `{"query":"fail"}`, 1))
+	if _, ok := svc.messages["retry"]; !ok || svc.hidden["retry"] != "30" {
+		t.Errorf("a failed request: in queue %v, hidden for %q, want kept and hidden for 30s", ok, svc.hidden["retry"])
+	}
+
+	w.handle(ctx, receive("bad", `{"query":"T","out":"../x"}`, 1))
+	w.handle(ctx, receive("again", `{"query":"fail"}`, 3))
+	if len(svc.poisoned) != 2 || svc.poisoned[0] != `{"query":"T","out":"../x"}` {
+		t.Errorf("poison queue = %q, want the two requests that can't succeed", svc.poisoned)
+	}
+	if _, ok := svc.messages["bad"]; ok {
+		t.Error("a poisoned message was not deleted")
+	}
+}
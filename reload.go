@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// configWatcher reloads the config of a long-running mode without a restart: on SIGHUP, and every
+// check (unless it is 0) when one of the files the running config was read from has changed. A
+// config that doesn't load is reported and the running one is kept; reload only switches over
+// once the new config is good, and drains what it replaces (see the mode's reload).
+type configWatcher struct {
+	mode  string        // for the log lines
+	path  string        // the config file, or directory
+	check time.Duration // how often to look for changes; 0 reloads on SIGHUP only
+	files []string      // what the running config was read from
+
+	// reload loads the config and switches the mode to it, returning the files it read and what
+	// changed, for the RELOAD line. An error leaves the running config as it was.
+	reload func(ctx context.Context) (files []string, changed string, err error)
+}
+
+// watch reloads on SIGHUP and on changes until ctx is done.
+func (w *configWatcher) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if w.check > 0 {
+		t := time.NewTicker(w.check)
+		defer t.Stop()
+		tick = t.C
+	}
+	w.poll(ctx, hup, tick)
+}
+
+func (w *configWatcher) poll(ctx context.Context, hup <-chan os.Signal, tick <-chan time.Time) {
+	loaded := fingerprint(w.files)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			// A config that failed to load is only tried again once it has changed again.
+			if fingerprint(w.files) == loaded {
+				continue
+			}
+		}
+		// Taken before loading, so an edit made while it loads is picked up by the next check.
+		now := fingerprint(w.files)
+		files, changed, err := w.reload(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s reload: %v; kept the running config\n", w.mode, err)
+			loaded = now
+			continue
+		}
+		if !slices.Equal(files, w.files) {
+			w.files, now = files, fingerprint(files)
+		}
+		loaded = now
+		fmt.Fprintf(os.Stderr, "RELOAD %s %s: %s\n", w.mode, w.path, changed)
+	}
+}
+
+// fingerprint hashes the names and contents of files, so a change to any of them, including one
+// appearing or going away, changes it. Reading small config files costs less than a stat-based
+// check gets wrong when an edit keeps the size and lands within the file system's time resolution.
+// A directory counts by the names of its entries, so a file added to it or removed changes it too.
+func fingerprint(files []string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, name := range files {
+		fmt.Fprintf(h, "%s\x00", name)
+		if entries, err := os.ReadDir(name); err == nil {
+			for _, e := range entries {
+				fmt.Fprintf(h, "%s/\x00", e.Name())
+			}
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(h, "error: %v\x00", err)
+			continue
+		}
+		n, _ := io.Copy(h, f)
+		f.Close()
+		fmt.Fprintf(h, "\x00%d\x00", n)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcher(t *testing.T) {
+	dir := t.TempDir()
+	config, query := filepath.Join(dir, "config.json"), filepath.Join(dir, "q.kql")
+	write := func(name, text string) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config, `{"v": 1}`)
+	write(query, "print 1")
+
+	reloads, fail := 0, false
+	w := &configWatcher{mode: "test", path: config, files: []string{config}}
+	w.reload = func(context.Context) ([]string, string, error) {
+		reloads++
+		if fail {
+			return nil, "", errors.New("bad config")
+		}
+		return []string{config, query}, "reloaded", nil
+	}
+	hup, tick := make(chan os.Signal), make(chan time.Time)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.poll(ctx, hup, tick)
+		close(done)
+	}()
+	// A send is only taken once the previous one was handled, so a second tick waits for the first.
+	check := func(want int, what string) {
+		t.Helper()
+		tick <- time.Now()
+		tick <- time.Now()
+		if reloads != want {
+			t.Fatalf("%s: %d reloads, want %d", what, reloads, want)
+		}
+	}
+
+	check(0, "unchanged")
+	write(config, `{"v": 2}`)
+	check(1, "config edited")
+	check(1, "unchanged after the reload")
+	write(query, "print 2")
+	check(2, "a file the reload read edited")
+
+	fail = true
+	write(config, `{"v": `)
+	check(3, "broken config")
+	check(3, "a broken config isn't retried until it changes")
+	hup <- os.Interrupt
+	check(4, "SIGHUP")
+
+	fail = false
+	write(config, `{"v": 3}`)
+	check(5, "fixed config")
+	cancel()
+	<-done
+}
+
+func TestFingerprintDirectory(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.kql")
+	os.WriteFile(a, []byte("print 1"), 0o644)
+	files := []string{dir, a}
+	before := fingerprint(files)
+	if fingerprint(files) != before {
+		t.Fatal("the fingerprint of unchanged files changed")
+	}
+	// A new file isn't among files yet; only the directory's entries show it.
+	os.WriteFile(filepath.Join(dir, "b.kql"), []byte("print 2"), 0o644)
+	added := fingerprint(files)
+	if added == before {
+		t.Error("a file added to the directory didn't change the fingerprint")
+	}
+	os.Remove(filepath.Join(dir, "b.kql"))
+	if fingerprint(files) != before {
+		t.Error("removing the added file didn't restore the fingerprint")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// replHistoryLines is how many lines of history the REPL keeps.
+const replHistoryLines = 1000
+
+const replHelp = `Enter KQL, ending it with a blank line or a ';' after the query (let statements
+ending in ';' continue it). Lines starting with '.' are control commands, e.g. .show tables;
+^C cancels the statement being typed or the running query, ^D exits.
+  .use <database>    run the following statements against another database
+  .format <format>   switch the output format (%s)
+  .help              show this text
+  .quit, .exit       leave
+`
+
+// runRepl implements "repl [cluster-name]": an interactive prompt for ad-hoc KQL, printing
+// results as tables by default. Input lines are kept in ~/.kusto-example_history (or
+// KUSTO_HISTORY) and recalled with the arrow keys.
+func runRepl(args []string, globalTimeouts *timeoutFlags, guard *queryGuard) {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database to start in (switch with .use)")
+	format := fs.String("format", "table", "output format: "+strings.Join(encode.Names(), "|"))
+	historyPath := fs.String("history", getenv("KUSTO_HISTORY", defaultHistoryPath()), "history file ('' keeps no history)")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	if _, err := encode.New(*format, io.Discard, encode.Options{}); err != nil {
+		log.Fatalf("repl: %v", err)
+	}
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+
+	ed := newLineEditor(os.Stdin, os.Stderr)
+	ed.history = loadHistory(*historyPath)
+	var history *os.File
+	if *historyPath != "" {
+		if history, err = os.OpenFile(*historyPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+			fmt.Fprintf(os.Stderr, "WARN repl: history not saved: %v\n", err)
+		} else {
+			defer history.Close()
+		}
+	}
+	if ed.terminal {
+		fmt.Fprintf(os.Stderr, "Connected to %s. Type .help for help.\n", cluster)
+	}
+
+	var stmt strings.Builder
+	for {
+		prompt := *database + "> "
+		if stmt.Len() > 0 {
+			prompt = strings.Repeat(" ", max(len(prompt)-5, 0)) + "...> "
+		}
+		line, err := ed.readLine(prompt)
+		if errors.Is(err, errInterrupted) {
+			stmt.Reset()
+			continue
+		}
+		if err == io.EOF {
+			if stmt.Len() > 0 {
+				runReplStatement(client, timeouts, guard, cluster, *database, *format, stmt.String())
+			}
+			return
+		}
+		if err != nil {
+			log.Fatalf("repl: %v", err)
+		}
+		if ed.remember(line) && history != nil {
+			fmt.Fprintln(history, line)
+		}
+		text := strings.TrimSpace(line)
+		if stmt.Len() == 0 {
+			if text == "" {
+				continue
+			}
+			if done := replCommand(text, database, format); done != nil {
+				if *done {
+					return
+				}
+				continue
+			}
+		}
+		if text != "" {
+			stmt.WriteString(line + "\n")
+			if !replStatementEnds(stmt.String()) {
+				continue
+			}
+		}
+		runReplStatement(client, timeouts, guard, cluster, *database, *format, stmt.String())
+		stmt.Reset()
+	}
+}
+
+// replCommand handles the REPL's own dot commands. It returns nil when text is not one of them
+// (so it is KQL or a control command), otherwise whether the REPL should exit.
+func replCommand(text string, database, format *string) *bool {
+	fields := strings.Fields(strings.TrimSuffix(text, ";"))
+	exit := false
+	switch strings.ToLower(fields[0]) {
+	case ".quit", ".exit":
+		exit = true
+	case ".help":
+		fmt.Fprintf(os.Stderr, replHelp, strings.Join(encode.Names(), ", "))
+	case ".use":
+		if len(fields) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: .use <database>")
+			break
+		}
+		*database = strings.Trim(fields[1], `'"[]`)
+	case ".format":
+		if len(fields) != 2 {
+			fmt.Fprintf(os.Stderr, "usage: .format %s\n", strings.Join(encode.Names(), "|"))
+			break
+		}
+		if _, err := encode.New(fields[1], io.Discard, encode.Options{}); err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %v\n", err)
+			break
+		}
+		*format = fields[1]
+	default:
+		return nil
+	}
+	return &exit
+}
+
+// replStatementEnds reports whether the text typed so far is a complete statement: it ends in
+// ';' and the last statement is a query or a control command rather than a let, declare, set
+// or alias statement, which the query that follows still needs.
+func replStatementEnds(text string) bool {
+	text = strings.TrimSpace(text)
+	if !strings.HasSuffix(text, ";") {
+		return false
+	}
+	if strings.HasPrefix(text, ".") {
+		return true
+	}
+	stmts := kqlSplit(text, ';')
+	if len(stmts) == 0 {
+		return false
+	}
+	return !continuesQuery(stmts[len(stmts)-1])
+}
+
+// runReplStatement runs one statement and prints its result on stdout. ^C cancels it and returns
+// to the prompt.
+func runReplStatement(client *azkustodata.Client, timeouts timeoutConfig, guard *queryGuard, cluster, database, format, text string) {
+	text = strings.TrimSuffix(strings.TrimSpace(text), ";")
+	call := callQuery
+	if strings.HasPrefix(text, ".") {
+		call = callMgmt
+	}
+	ctx, cancel := timeouts.callContext(context.Background(), call)
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enc, err := encode.New(format, out, encode.Options{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL %v\n", err)
+		return
+	}
+	start := time.Now()
+	var rows int64
+	if call == callMgmt {
+		if err = gate.confirm(cluster, text, destructiveCommand(text)); err == nil {
+			rows, err = mgmtToEncoder(ctx, client, database, text, enc)
+		}
+	} else if err = guard.check(ctx, client, cluster, database, text); err == nil {
+		id, opts := globalRequest.callOptions("repl")
+		rows, err = stream.Query(ctx, client, database, (&kql.Builder{}).AddUnsafe(text), enc, opts...)
+		err = withRequestID(err, id)
+	}
+	if err != nil {
+		out.Flush()
+		if ctx.Err() == context.Canceled {
+			fmt.Fprintln(os.Stderr, "FAIL cancelled")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "FAIL %s\n", errText(err))
+		printRunbook(os.Stderr, "query", err)
+		return
+	}
+	out.Flush()
+	fmt.Fprintf(os.Stderr, "OK %d rows in %s\n", rows, time.Since(start).Round(time.Millisecond))
+}
+
+// mgmtToEncoder runs a control command and writes its first table to enc as the primary result.
+func mgmtToEncoder(ctx context.Context, client *azkustodata.Client, database, command string, enc encode.Encoder) (int64, error) {
+	id, opts := globalRequest.callOptions("repl")
+	ds, err := client.Mgmt(ctx, database, (&kql.Builder{}).AddUnsafe(command), opts...)
+	if err != nil {
+		return 0, withRequestID(err, id)
+	}
+	var rows int64
+	if tables := ds.Tables(); len(tables) > 0 {
+		t := &encode.Table{Name: tables[0].Name(), Kind: "PrimaryResult", Columns: tables[0].Columns()}
+		if err := enc.Begin(t); err != nil {
+			return 0, err
+		}
+		for i, row := range tables[0].Rows() {
+			if err := enc.WriteRow(t, i, row.Values()); err != nil {
+				return rows, err
+			}
+			rows++
+		}
+	}
+	return rows, enc.End()
+}
+
+// destructiveCommand reports whether a control command deletes or replaces data, so it needs
+// confirming (see confirmGate).
+func destructiveCommand(command string) bool {
+	verb := strings.ToLower(strings.Fields(command)[0])
+	for _, d := range []string{".drop", ".purge", ".clear", ".delete", ".replace", ".set-or-replace", ".move"} {
+		if verb == d || strings.HasPrefix(verb, d+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kusto-example_history")
+}
+
+// loadHistory reads the last replHistoryLines lines of the history file, rewriting the file when
+// it has grown to twice that, so it stays small.
+func loadHistory(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > 2*replHistoryLines {
+		lines = lines[len(lines)-replHistoryLines:]
+		os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	} else if len(lines) > replHistoryLines {
+		lines = lines[len(lines)-replHistoryLines:]
+	}
+	return lines
+}
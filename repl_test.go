@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+	for _, c := range []struct {
+		keys, want string
+	}{
+		{"print 1\r", "print 1"},
+		{"abc\x1b[D\x1b[DX\r", "aXbc"},             // left arrow twice, insert
+		{"abc\x01X\x05Y\r", "XabcY"},               // ^A, ^E
+		{"hello world\x17there\r", "hello there"},  // ^W
+		{"abc\x7f\x7fz\r", "az"},                   // backspace
+		{"abc\x1b[H\x1b[3~\r", "bc"},               // Home, Delete
+		{"\x1b[A\x1b[A\r", "StormEvents | take 5"}, // up twice: the older entry
+		{"draft\x1b[A\x1b[B\r", "draft"},           // down returns to the line being typed
+		{"x\x1b[A\x15T | count\r", "T | count"},    // ^U after recalling
+	} {
+		e := &lineEditor{in: bufio.NewReader(strings.NewReader(c.keys)), out: io.Discard,
+			history: []string{"StormEvents | take 5", "print now()"}}
+		got, err := e.edit("> ")
+		if err != nil || got != c.want {
+			t.Errorf("keys %q: got %q, %v; want %q", c.keys, got, err, c.want)
+		}
+	}
+	e := &lineEditor{in: bufio.NewReader(strings.NewReader("\x04")), out: io.Discard}
+	if _, err := e.edit("> "); err != io.EOF {
+		t.Errorf("^D on an empty line: %v, want io.EOF", err)
+	}
+}
+
+func TestReplStatementEnds(t *testing.T) {
+	for text, want := range map[string]bool{
+		"StormEvents\n| take 5":                 false,
+		"StormEvents | take 5;":                 true,
+		"let n = 5;":                            false,
+		"let n = 5;\nStormEvents | take n;":     true,
+		"print s = 'a;b'":                       false,
+		".show tables;":                         true,
+		"declare query_parameters(n:long = 5);": false,
+	} {
+		if got := replStatementEnds(text); got != want {
+			t.Errorf("replStatementEnds(%q) = %v, want %v", text, got, want)
+		}
+	}
+	for cmd, want := range map[string]bool{".drop table T": true, ".set-or-replace T <| print 1": true, ".show tables": false, ".drop-pretend x": true} {
+		if got := destructiveCommand(cmd); got != want {
+			t.Errorf("destructiveCommand(%q) = %v, want %v", cmd, got, want)
+		}
+	}
+}
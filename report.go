@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// reportSection is one table of a report.
+type reportSection struct {
+	Title   string     `json:"title"`
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+}
+
+// clusterReport is the output of one report subcommand.
+type clusterReport struct {
+	Report   string            `json:"report"`
+	Cluster  string            `json:"cluster"`
+	Database string            `json:"database"`
+	Window   string            `json:"window"`
+	Sections []reportSection   `json:"sections"`
+	Warnings []string          `json:"warnings,omitempty"`
+	Errors   []string          `json:"errors,omitempty"`   // steps that failed under --error-policy continue or threshold
+	Runbooks map[string]string `json:"runbooks,omitempty"` // runbook URL by failed step (see KUSTO_RUNBOOKS)
+}
+
+// reportRun holds what the report builders share: the client, the flags and the report being
+// filled in.
+type reportRun struct {
+	client   *azkustodata.Client
+	timeouts timeoutConfig
+	report   *clusterReport
+	since    string // where clause limiting .show queries/commands to the window
+	top      string
+	batch    *batch // one step per control command
+}
+
+// runReport implements "report usage|capacity|storage [cluster-name]", printed as aligned tables
+// or, with --json, as JSON.
+//
+// usage summarizes the queries and commands that started in the last --window, from .show
+// queries and .show commands; without database admin rights those only list the caller's own
+// queries. capacity lists .show capacity with saturated resources flagged, the request
+// classification policy and throttled requests in the window. storage lists every table's size,
+// hot share and extent age with its effective retention and caching, and flags policies that
+// look wrong for the table.
+func runReport(args []string, globalTimeouts *timeoutFlags) {
+	if len(args) == 0 || (args[0] != "usage" && args[0] != "capacity" && args[0] != "storage") {
+		log.Fatalf("usage: report usage|capacity|storage [--window 24h] [--top 10] [--json] [cluster-name]")
+	}
+	kind := args[0]
+	fs := flag.NewFlagSet("report "+kind, flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	cmdPolicy := registerErrorPolicyFlag(fs)
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database to report on")
+	window := fs.Duration("window", 24*time.Hour, "report on queries and commands that started within this window")
+	top := fs.Int("top", 10, "rows per section")
+	saturation := fs.Float64("saturation", 80, "capacity: flag resources at least this percent consumed")
+	largeTable := fs.Int64("large-table-bytes", 100<<30, "storage: tables at least this large (compressed) get the size-related checks")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args[1:])))
+	if *window <= 0 || *top <= 0 {
+		log.Fatalf("report %s: --window and --top must be positive", kind)
+	}
+
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+
+	r := &reportRun{
+		client:   client,
+		timeouts: resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute),
+		report:   &clusterReport{Report: kind, Cluster: cluster, Database: *database, Window: window.String()},
+		since:    fmt.Sprintf("| where StartedOn > ago(%ds)", int64(window.Seconds())),
+		top:      strconv.Itoa(*top),
+		batch:    newBatch("report-"+kind, resolveErrorPolicy(cmdPolicy, policyFailFast), 0),
+	}
+	switch kind {
+	case "usage":
+		err = r.usage(*top)
+	case "capacity":
+		err = r.capacity(*saturation)
+	case "storage":
+		err = r.storage(*largeTable)
+	}
+	if err != nil {
+		r.batch.printFailures(os.Stderr)
+		r.batch.summary(os.Stderr)
+		log.Fatalf("report %s: %s", kind, errText(err))
+	}
+
+	if *asJSON {
+		b, _ := json.MarshalIndent(r.report, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		fmt.Printf("%s report for %s/%s, last %s\n", strings.ToUpper(kind[:1])+kind[1:], cluster, *database, r.report.Window)
+		for _, w := range r.report.Warnings {
+			fmt.Printf("! %s\n", w)
+		}
+		for _, s := range r.report.Sections {
+			printSection(os.Stdout, s)
+		}
+	}
+	r.batch.printFailures(os.Stderr)
+	r.batch.summary(os.Stderr)
+	if err := r.batch.err(); err != nil {
+		log.Fatalf("report %s: %v", kind, err)
+	}
+}
+
+// section runs a control command and adds its first table to the report. A failure the error
+// policy lets pass returns an empty section and no error.
+func (r *reportRun) section(title, command string) (reportSection, error) {
+	ctx, cancel := r.timeouts.callContext(context.Background(), callMgmt)
+	defer cancel()
+	sec, err := mgmtSection(ctx, r.client, r.report.Database, title, command)
+	if err != nil {
+		return reportSection{}, r.check(title, err)
+	}
+	r.report.Sections = append(r.report.Sections, sec)
+	return sec, r.check(title, nil)
+}
+
+// check records the outcome of one step of the report. It returns the step's error, annotated
+// with the step, if the error policy stops the report; otherwise a failure is noted in the
+// report's errors and check returns nil.
+func (r *reportRun) check(step string, err error) error {
+	stop := r.batch.done(step, err)
+	if err == nil {
+		return nil
+	}
+	r.report.Errors = append(r.report.Errors, step+": "+errText(err))
+	if u := runbooks.url(err); u != "" {
+		if r.report.Runbooks == nil {
+			r.report.Runbooks = map[string]string{}
+		}
+		r.report.Runbooks[step] = u
+	}
+	if stop {
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	return nil
+}
+
+func (r *reportRun) usage(top int) error {
+	sections := []struct{ title, command string }{
+		{"Top users by queries", ".show queries " + r.since +
+			" | summarize Queries=count(), Failed=countif(State != 'Completed'), TotalCpu=sum(TotalCpu), TotalDuration=sum(Duration) by User" +
+			" | top " + r.top + " by Queries"},
+		{"Query failure rate by application", ".show queries " + r.since +
+			" | summarize Queries=count(), Failed=countif(State != 'Completed') by Application" +
+			" | extend FailurePct=round(100.0 * Failed / Queries, 1) | top " + r.top + " by Failed"},
+		{"Query failure reasons", ".show queries " + r.since + " | where State != 'Completed'" +
+			" | summarize Count=count(), Users=dcount(User) by State, FailureReason=substring(FailureReason, 0, 120)" +
+			" | top " + r.top + " by Count"},
+		{"Slowest queries", ".show queries " + r.since +
+			" | top " + r.top + " by Duration | project StartedOn, Duration, User, State, TotalCpu, Text=substring(replace_string(Text, '\\n', ' '), 0, 120)"},
+		{"Commands by type", ".show commands " + r.since +
+			" | summarize Commands=count(), Failed=countif(State != 'Completed'), TotalCpu=sum(TotalCpu), TotalDuration=sum(Duration) by CommandType" +
+			" | extend FailurePct=round(100.0 * Failed / Commands, 1) | top " + r.top + " by Commands"},
+	}
+	for _, s := range sections {
+		if _, err := r.section(s.title, s.command); err != nil {
+			return err
+		}
+	}
+
+	// .show queries does not say which tables a query read, so count the known table names that
+	// appear in the query texts.
+	ctx, cancel := r.timeouts.callContext(context.Background(), callMgmt)
+	texts, err := mgmtSection(ctx, r.client, r.report.Database, "", ".show queries "+r.since+" | summarize Count=count() by Text | top 5000 by Count")
+	cancel()
+	if err != nil {
+		return r.check("top tables: .show queries", err)
+	}
+	ctx, cancel = r.timeouts.callContext(context.Background(), callMgmt)
+	stats, err := loadTableStats(ctx, r.client, r.report.Cluster, r.report.Database, getDurationEnv("KUSTO_STATS_TTL", 24*time.Hour))
+	cancel()
+	if err != nil {
+		return r.check("top tables: .show tables details", err)
+	}
+	r.report.Sections = append(r.report.Sections, topTables(texts.Rows, stats, top))
+	return r.check("top tables", nil)
+}
+
+func (r *reportRun) capacity(saturation float64) error {
+	sec, err := r.section("Capacity", fmt.Sprintf(".show capacity"+
+		" | extend UtilizationPct=round(100.0 * Consumed / Total, 1)"+
+		" | extend Status=iff(UtilizationPct >= %g, 'SATURATED', '')"+
+		" | project Resource, Total, Consumed, Remaining, UtilizationPct, Status, Origin"+
+		" | order by UtilizationPct desc", saturation))
+	if err != nil {
+		return err
+	}
+	for _, row := range sec.Rows {
+		if len(row) > 5 && row[5] != "" {
+			r.report.Warnings = append(r.report.Warnings, fmt.Sprintf("%s capacity is %s%% consumed (%s of %s)", row[0], row[4], row[2], row[1]))
+		}
+	}
+
+	if err := r.classificationPolicy(); err != nil {
+		return err
+	}
+
+	throttled := " " + r.since + " | where State == 'Throttled' or FailureReason has 'throttl'"
+	sec, err = r.section("Throttled requests", ".show commands-and-queries"+throttled+
+		" | summarize Throttled=count(), Users=dcount(User), Last=max(StartedOn) by CommandType, Application"+
+		" | top "+r.top+" by Throttled")
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, row := range sec.Rows {
+		if len(row) > 2 {
+			n, _ := strconv.ParseInt(row[2], 10, 64)
+			total += n
+		}
+	}
+	if total > 0 {
+		r.report.Warnings = append(r.report.Warnings, fmt.Sprintf("%d throttled requests in the last %s", total, r.report.Window))
+		if _, err := r.section("Throttling by hour", ".show commands-and-queries"+throttled+
+			" | summarize Throttled=count() by Hour=bin(StartedOn, 1h) | order by Hour asc"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// classificationPolicy adds the cluster's request classification policy. The policy is a JSON
+// document; its settings are shown as one row each.
+func (r *reportRun) classificationPolicy() error {
+	ctx, cancel := r.timeouts.callContext(context.Background(), callMgmt)
+	raw, err := mgmtSection(ctx, r.client, "", "", ".show cluster policy request_classification | project Policy")
+	cancel()
+	if err != nil {
+		return r.check("request classification policy", err)
+	}
+	r.check("request classification policy", nil)
+	policy := reportSection{Title: "Request classification policy", Columns: []string{"Setting", "Value"}}
+	for _, row := range raw.Rows {
+		var doc map[string]interface{}
+		if len(row) == 0 || json.Unmarshal([]byte(row[0]), &doc) != nil {
+			continue
+		}
+		keys := make([]string, 0, len(doc))
+		for k := range doc {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, _ := json.Marshal(doc[k])
+			text := strings.Join(strings.Fields(string(v)), " ")
+			if len(text) > 120 {
+				text = text[:117] + "..."
+			}
+			policy.Rows = append(policy.Rows, []string{k, text})
+		}
+	}
+	if len(policy.Rows) == 0 {
+		r.report.Warnings = append(r.report.Warnings, "no request classification policy: all requests run in the default workload group")
+	}
+	r.report.Sections = append(r.report.Sections, policy)
+	return nil
+}
+
+// storagePolicy is a table's effective soft-delete and hot-cache periods. A zero retention is
+// unlimited; without any caching policy (hotSet false) all data is hot.
+type storagePolicy struct {
+	retention, hot       time.Duration
+	retentionSet, hotSet bool
+}
+
+func (r *reportRun) storage(largeTable int64) error {
+	db := kqlquote.Ident(r.report.Database)
+	dbPolicy := storagePolicy{}
+	for _, p := range []string{"retention", "caching"} {
+		ctx, cancel := r.timeouts.callContext(context.Background(), callMgmt)
+		sec, err := mgmtSection(ctx, r.client, r.report.Database, "", ".show database "+db+" policy "+p+" | project Policy")
+		cancel()
+		if err := r.check("database "+p+" policy", err); err != nil {
+			return err
+		}
+		if len(sec.Rows) > 0 && len(sec.Rows[0]) > 0 {
+			dbPolicy.merge(sec.Rows[0][0])
+		}
+	}
+
+	ctx, cancel := r.timeouts.callContext(context.Background(), callMgmt)
+	details, err := mgmtSection(ctx, r.client, r.report.Database, "", ".show tables details"+
+		" | project TableName, TotalRowCount, TotalExtentSize, TotalOriginalSize, HotExtentSize, TotalExtents,"+
+		" MinExtentsCreationTime, MaxExtentsCreationTime, RetentionPolicy, CachingPolicy"+
+		" | order by TotalExtentSize desc")
+	cancel()
+	if err != nil {
+		return r.check(".show tables details", err)
+	}
+	r.check(".show tables details", nil)
+
+	tables := reportSection{Title: "Tables", Columns: []string{"Table", "Rows", "Size", "Original", "Hot", "HotPct", "Extents", "Oldest", "Newest", "Retention", "HotCache"}}
+	findings := reportSection{Title: "Findings", Columns: []string{"Table", "Finding"}}
+	flag := func(table, format string, args ...interface{}) {
+		findings.Rows = append(findings.Rows, []string{table, fmt.Sprintf(format, args...)})
+	}
+	for _, row := range details.Rows {
+		if len(row) < 10 {
+			continue
+		}
+		name := row[0]
+		rows, size, original, hot, extents := reportNumber(row[1]), reportNumber(row[2]), reportNumber(row[3]), reportNumber(row[4]), reportNumber(row[5])
+		policy := dbPolicy
+		policy.merge(row[8])
+		policy.merge(row[9])
+		hotCache := "unlimited"
+		if policy.hotSet {
+			hotCache = formatPeriod(policy.hot, "none")
+		}
+		hotPct := 0.0
+		if size > 0 {
+			hotPct = 100 * float64(hot) / float64(size)
+		}
+		tables.Rows = append(tables.Rows, []string{name, strconv.FormatInt(rows, 10), formatBytes(size), formatBytes(original), formatBytes(hot),
+			strconv.FormatFloat(hotPct, 'f', 1, 64), strconv.FormatInt(extents, 10), row[6], row[7],
+			formatPeriod(policy.retention, "unlimited"), hotCache})
+
+		if policy.retention > 0 && policy.hot > policy.retention {
+			flag(name, "hot cache period %s is longer than retention %s", formatPeriod(policy.hot, ""), formatPeriod(policy.retention, ""))
+		}
+		if size < largeTable {
+			continue
+		}
+		if policy.retention == 0 {
+			flag(name, "%s with unlimited retention", formatBytes(size))
+		}
+		if !policy.hotSet {
+			flag(name, "%s with no caching policy: all of it is hot", formatBytes(size))
+		} else if hotPct >= 99 && policy.hot > 0 {
+			flag(name, "%s, all of it hot: hot cache period %s covers the table's whole history", formatBytes(size), formatPeriod(policy.hot, ""))
+		}
+		if extents > 1000 && original/extents < 64<<20 {
+			flag(name, "%d extents averaging %s of original data; check the merge and ingestion batching policies", extents, formatBytes(original/extents))
+		}
+	}
+	r.report.Sections = append(r.report.Sections, tables, findings)
+	for _, f := range findings.Rows {
+		r.report.Warnings = append(r.report.Warnings, f[0]+": "+f[1])
+	}
+	return nil
+}
+
+// merge applies a retention or caching policy document on top of p. Empty cells (no table-level
+// policy) leave the inherited values.
+func (p *storagePolicy) merge(doc string) {
+	var pol map[string]interface{}
+	if json.Unmarshal([]byte(doc), &pol) != nil || pol == nil {
+		return
+	}
+	if v, ok := pol["SoftDeletePeriod"]; ok {
+		p.retention, p.retentionSet = kustoTimespan(v), true
+	}
+	if v, ok := pol["DataHotSpan"]; ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = m["Value"]
+		}
+		p.hot, p.hotSet = kustoTimespan(v), true
+	}
+}
+
+// kustoTimespan parses a policy timespan such as "365.00:00:00" or "01:30:00".
+func kustoTimespan(v interface{}) time.Duration {
+	s, _ := v.(string)
+	days := 0
+	if d, rest, ok := strings.Cut(s, "."); ok && strings.Contains(rest, ":") {
+		days, _ = strconv.Atoi(d)
+		s = rest
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	sec, _ := strconv.ParseFloat(parts[2], 64)
+	return time.Duration(days)*24*time.Hour + time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second))
+}
+
+// formatPeriod renders a policy period in days, or zero as the given word.
+func formatPeriod(d time.Duration, zero string) string {
+	if d == 0 {
+		return zero
+	}
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func reportNumber(s string) int64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return int64(f)
+}
+
+// topTables ranks tables by the number of queries (from rows of Text, Count) whose text names
+// them.
+func topTables(texts [][]string, stats []tableStats, top int) reportSection {
+	counts := map[string]int64{}
+	for _, row := range texts {
+		if len(row) < 2 {
+			continue
+		}
+		n, _ := strconv.ParseInt(row[1], 10, 64)
+		ids := kqlIdents(row[0])
+		for _, t := range stats {
+			if ids[t.Name] {
+				counts[t.Name] += n
+			}
+		}
+	}
+	sec := reportSection{Title: "Top tables by queries", Columns: []string{"Table", "Queries", "Size"}}
+	size := map[string]int64{}
+	for _, t := range stats {
+		size[t.Name] = t.ExtentBytes
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > top {
+		names = names[:top]
+	}
+	for _, name := range names {
+		sec.Rows = append(sec.Rows, []string{name, strconv.FormatInt(counts[name], 10), formatBytes(size[name])})
+	}
+	return sec
+}
+
+// mgmtSection runs a control command and returns its first table as text cells.
+func mgmtSection(ctx context.Context, client *azkustodata.Client, database, title, command string) (reportSection, error) {
+	sec := reportSection{Title: title}
+	ds, err := client.Mgmt(ctx, database, (&kql.Builder{}).AddUnsafe(command))
+	if err != nil {
+		return sec, err
+	}
+	tables := ds.Tables()
+	if len(tables) == 0 {
+		return sec, nil
+	}
+	for _, c := range tables[0].Columns() {
+		sec.Columns = append(sec.Columns, c.Name())
+	}
+	for _, row := range tables[0].Rows() {
+		vals := row.Values()
+		cells := make([]string, len(vals))
+		for i, v := range vals {
+			cells[i] = reportCell(encode.PlainValue(v))
+		}
+		sec.Rows = append(sec.Rows, cells)
+	}
+	return sec, nil
+}
+
+func reportCell(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case time.Duration:
+		return x.Round(time.Millisecond).String()
+	case time.Time:
+		return x.UTC().Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprint(v)
+}
+
+func printSection(w io.Writer, s reportSection) {
+	fmt.Fprintf(w, "\n## %s\n", s.Title)
+	if len(s.Rows) == 0 {
+		fmt.Fprintln(w, "(none)")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(s.Columns, "\t"))
+	for _, r := range s.Rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+)
+
+// fakeTable is one result table of a fakeKusto: columns as "Name:type" and the rows' values.
+type fakeTable struct {
+	cols []string
+	rows [][]interface{}
+}
+
+// fakeKusto is a cluster answering control commands (v1 REST) and queries (v2 frames) with the
+// table reply returns for the text; a nil table fails the call with a 400. It records the
+// commands and queries it ran.
+type fakeKusto struct {
+	srv      *httptest.Server
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeKusto(t *testing.T, reply func(db, csl string) *fakeTable) (*fakeKusto, *azkustodata.Client) {
+	t.Helper()
+	f := &fakeKusto{}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/rest/mgmt" && r.URL.Path != "/v2/rest/query" {
+			http.NotFound(w, r) // the cloud metadata: the public cloud
+			return
+		}
+		var req struct {
+			DB  string `json:"db"`
+			CSL string `json:"csl"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		f.commands = append(f.commands, req.CSL)
+		f.mu.Unlock()
+		tbl := reply(req.DB, req.CSL)
+		if tbl == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{
+				"code": "BadRequest", "message": "Request is invalid and cannot be executed.", "@message": "fake: " + req.CSL}})
+			return
+		}
+		type column struct {
+			ColumnName string
+			ColumnType string
+		}
+		var cols []column
+		for _, c := range tbl.cols {
+			name, typ, _ := strings.Cut(c, ":")
+			cols = append(cols, column{name, typ})
+		}
+		rows := tbl.rows
+		if rows == nil {
+			rows = [][]interface{}{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/rest/mgmt" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"Tables": []interface{}{
+				map[string]interface{}{"TableName": "Table_0", "Columns": cols, "Rows": rows}}})
+			return
+		}
+		// One frame per line, with the fields in the order the SDK reads them.
+		colsJSON, _ := json.Marshal(cols)
+		rowsJSON, _ := json.Marshal(rows)
+		frames := []string{
+			`{"FrameType":"DataSetHeader","IsProgressive":false,"Version":"v2.0","IsFragmented":true,"ErrorReportingPlacement":"EndOfTable"}`,
+			`{"FrameType":"DataTable","TableId":0,"TableKind":"QueryProperties","TableName":"@ExtendedProperties","Columns":[{"ColumnName":"TableId","ColumnType":"int"},{"ColumnName":"Key","ColumnType":"string"},{"ColumnName":"Value","ColumnType":"dynamic"}],"Rows":[]}`,
+			`{"FrameType":"TableHeader","TableId":1,"TableKind":"PrimaryResult","TableName":"PrimaryResult","Columns":` + string(colsJSON) + `}`,
+			`{"FrameType":"TableFragment","TableFragmentType":"DataAppend","TableId":1,"Rows":` + string(rowsJSON) + `}`,
+			fmt.Sprintf(`{"FrameType":"TableCompletion","TableId":1,"RowCount":%d}`, len(rows)),
+			`{"FrameType":"DataSetCompletion","HasErrors":false,"Cancelled":false}`,
+		}
+		fmt.Fprintf(w, "[%s\n]\n", strings.Join(frames, "\n,"))
+	}))
+	t.Cleanup(f.srv.Close)
+	client, err := azkustodata.New(azkustodata.NewConnectionStringBuilder(f.srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return f, client
+}
+
+// testReportRun is a reportRun on client for the last day, with the given error policy.
+func testReportRun(client *azkustodata.Client, kind, policy string) *reportRun {
+	return &reportRun{
+		client:   client,
+		timeouts: timeoutConfig{def: 10 * time.Second, calls: callTimeouts{}},
+		report:   &clusterReport{Report: kind, Cluster: "https://help.kusto.windows.net", Database: "Samples", Window: "24h0m0s"},
+		since:    "| where StartedOn > ago(86400s)",
+		top:      "10",
+		batch:    newBatch("report-"+kind, errorPolicy{mode: policy}, 0),
+	}
+}
+
+func sectionTitles(r *clusterReport) string {
+	var titles []string
+	for _, s := range r.Sections {
+		titles = append(titles, s.Title)
+	}
+	return strings.Join(titles, ", ")
+}
+
+func TestReportUsage(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	tests := []struct {
+		name     string
+		policy   string
+		fail     string // commands starting with this fail
+		titles   string
+		errors   string
+		topTable string
+		err      bool
+	}{
+		{name: "all sections", policy: policyFailFast,
+			titles:   "Top users by queries, Query failure rate by application, Query failure reasons, Slowest queries, Commands by type, Top tables by queries",
+			topTable: "StormEvents 7 1.0 GiB"},
+		{name: "fail-fast stops at the failed section", policy: policyFailFast, fail: ".show commands", err: true,
+			titles: "Top users by queries, Query failure rate by application, Query failure reasons, Slowest queries",
+			errors: "Commands by type: "},
+		{name: "continue skips the failed section", policy: policyContinue, fail: ".show commands",
+			titles:   "Top users by queries, Query failure rate by application, Query failure reasons, Slowest queries, Top tables by queries",
+			errors:   "Commands by type: ",
+			topTable: "StormEvents 7 1.0 GiB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newFakeKusto(t, func(db, csl string) *fakeTable {
+				switch {
+				case tt.fail != "" && strings.HasPrefix(csl, tt.fail):
+					return nil
+				case strings.HasSuffix(csl, "top 5000 by Count"):
+					return &fakeTable{cols: []string{"Text:string", "Count:long"}, rows: [][]interface{}{
+						{"StormEvents | count", 5}, {"StormEvents | join (PopulationData) on State", 2}, {"print 1", 9}}}
+				case strings.HasPrefix(csl, ".show tables details"):
+					return &fakeTable{cols: []string{"TableName:string", "TotalRowCount:long", "TotalExtentSize:real", "TotalOriginalSize:real"},
+						rows: [][]interface{}{{"StormEvents", 59066, 1 << 30, 4 << 30}, {"PopulationData", 52, 4096, 8192}, {"Unused", 1, 10, 10}}}
+				}
+				return &fakeTable{cols: []string{"User:string", "Queries:long"}, rows: [][]interface{}{{"alice@contoso.com", 12}}}
+			})
+			r := testReportRun(client, "usage", tt.policy)
+			err := r.usage(10)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v", err)
+			}
+			if got := sectionTitles(r.report); got != tt.titles {
+				t.Errorf("sections %s, want %s", got, tt.titles)
+			}
+			if got := strings.Join(r.report.Errors, "; "); !strings.HasPrefix(got, tt.errors) || (tt.errors == "") != (got == "") {
+				t.Errorf("errors %q, want %q", got, tt.errors)
+			}
+			if tt.topTable != "" {
+				top := r.report.Sections[len(r.report.Sections)-1]
+				if len(top.Rows) != 2 || strings.Join(top.Rows[0], " ") != tt.topTable || strings.Join(top.Rows[1], " ") != "PopulationData 2 4.0 KiB" {
+					t.Errorf("top tables %v", top.Rows)
+				}
+			}
+		})
+	}
+}
+
+func TestTopTables(t *testing.T) {
+	stats := []tableStats{{Name: "StormEvents", ExtentBytes: 1 << 30}, {Name: "Storm", ExtentBytes: 10}, {Name: "B", ExtentBytes: 2048}, {Name: "A"}}
+	texts := [][]string{
+		{"StormEvents | where State == 'Storm'", "4"}, // a string, not the table Storm
+		{"union A, B | count", "2"},
+		{"B | take 1", "1"},
+		{"A | take 1", "1"},
+		{"bad row"},
+	}
+	tests := []struct {
+		top  int
+		want string
+	}{
+		{10, "StormEvents 4 1.0 GiB|A 3 0 B|B 3 2.0 KiB"},
+		{2, "StormEvents 4 1.0 GiB|A 3 0 B"},
+	}
+	for _, tt := range tests {
+		var rows []string
+		for _, r := range topTables(texts, stats, tt.top).Rows {
+			rows = append(rows, strings.Join(r, " "))
+		}
+		if got := strings.Join(rows, "|"); got != tt.want {
+			t.Errorf("top %d: %s, want %s", tt.top, got, tt.want)
+		}
+	}
+}
+
+func TestReportCell(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, ""},
+		{1500 * time.Microsecond, "2ms"},
+		{time.Date(2024, 6, 1, 2, 0, 0, 0, time.FixedZone("CEST", 2*3600)), "2024-06-01T00:00:00Z"},
+		{0.25, "0.25"},
+		{1e21, "1000000000000000000000"},
+		{[]byte(`{"a":1}`), `{"a":1}`},
+		{int64(42), "42"},
+		{true, "true"},
+	}
+	for _, tt := range tests {
+		if got := reportCell(tt.v); got != tt.want {
+			t.Errorf("reportCell(%#v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestPrintSection(t *testing.T) {
+	var buf bytes.Buffer
+	printSection(&buf, reportSection{Title: "Top users by queries", Columns: []string{"User", "Queries"},
+		Rows: [][]string{{"alice@contoso.com", "12"}, {"bob", "3"}}})
+	printSection(&buf, reportSection{Title: "Findings", Columns: []string{"Table", "Finding"}})
+	want := "\n## Top users by queries\nUser               Queries\nalice@contoso.com  12\nbob                3\n\n## Findings\n(none)\n"
+	if buf.String() != want {
+		t.Errorf("got\n%q\nwant\n%q", buf.String(), want)
+	}
+}
+
+func TestReportCapacity(t *testing.T) {
+	capacity := &fakeTable{cols: []string{"Resource:string", "Total:long", "Consumed:long", "Remaining:long", "UtilizationPct:real", "Status:string", "Origin:string"},
+		rows: [][]interface{}{{"Queries", 40, 38, 2, 95.0, "SATURATED", "Policy"}, {"Ingestions", 16, 1, 15, 6.3, "", "Policy"}}}
+	tests := []struct {
+		name      string
+		policy    string // the request classification policy document, or "" for none
+		throttled [][]interface{}
+		titles    string
+		warnings  []string
+		settings  string
+	}{
+		{name: "throttled requests", policy: `{"IsEnabled": true, "ClassificationFunction": "iff(current_principal_is_member_of('aadgroup=ops'), 'ops', 'default')"}`,
+			throttled: [][]interface{}{{"Query", "Dashboards", 5, 2, "2024-06-01T00:00:00Z"}, {"DataIngestPull", "Ingest", 2, 1, "2024-06-01T01:00:00Z"}},
+			titles:    "Capacity, Request classification policy, Throttled requests, Throttling by hour",
+			warnings:  []string{"Queries capacity is 95% consumed (38 of 40)", "7 throttled requests in the last 24h0m0s"},
+			settings:  `ClassificationFunction="iff(current_principal_is_member_of('aadgroup=ops'), 'ops', 'default')" IsEnabled=true`},
+		{name: "no policy, nothing throttled",
+			titles: "Capacity, Request classification policy, Throttled requests",
+			warnings: []string{"Queries capacity is 95% consumed (38 of 40)",
+				"no request classification policy: all requests run in the default workload group"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, client := newFakeKusto(t, func(db, csl string) *fakeTable {
+				switch {
+				case strings.HasPrefix(csl, ".show capacity"):
+					return capacity
+				case strings.HasPrefix(csl, ".show cluster policy request_classification"):
+					tbl := &fakeTable{cols: []string{"Policy:string"}}
+					if tt.policy != "" {
+						tbl.rows = [][]interface{}{{tt.policy}}
+					}
+					return tbl
+				case strings.Contains(csl, "by CommandType, Application"):
+					return &fakeTable{cols: []string{"CommandType:string", "Application:string", "Throttled:long", "Users:long", "Last:datetime"}, rows: tt.throttled}
+				case strings.Contains(csl, "by Hour"):
+					return &fakeTable{cols: []string{"Hour:datetime", "Throttled:long"}, rows: [][]interface{}{{"2024-06-01T00:00:00Z", 7}}}
+				}
+				return nil
+			})
+			r := testReportRun(client, "capacity", policyFailFast)
+			if err := r.capacity(80); err != nil {
+				t.Fatal(err)
+			}
+			if got := sectionTitles(r.report); got != tt.titles {
+				t.Errorf("sections %s, want %s", got, tt.titles)
+			}
+			if strings.Join(r.report.Warnings, "\n") != strings.Join(tt.warnings, "\n") {
+				t.Errorf("warnings %q, want %q", r.report.Warnings, tt.warnings)
+			}
+			var settings []string
+			for _, row := range r.report.Sections[1].Rows {
+				settings = append(settings, row[0]+"="+row[1])
+			}
+			if got := strings.Join(settings, " "); got != tt.settings {
+				t.Errorf("policy settings %s, want %s", got, tt.settings)
+			}
+			if !strings.Contains(f.commands[0], "extend Status=iff(UtilizationPct >= 80, 'SATURATED', '')") {
+				t.Errorf("capacity command %s", f.commands[0])
+			}
+		})
+	}
+}
+
+func TestReportStorage(t *testing.T) {
+	details := []string{"TableName:string", "TotalRowCount:long", "TotalExtentSize:real", "TotalOriginalSize:real", "HotExtentSize:real", "TotalExtents:long",
+		"MinExtentsCreationTime:datetime", "MaxExtentsCreationTime:datetime", "RetentionPolicy:string", "CachingPolicy:string"}
+	const gib = 1 << 30
+	_, client := newFakeKusto(t, func(db, csl string) *fakeTable {
+		switch {
+		case strings.HasPrefix(csl, ".show database ['Samples'] policy retention"):
+			return &fakeTable{cols: []string{"Policy:string"}, rows: [][]interface{}{{`{"SoftDeletePeriod": "365.00:00:00", "Recoverability": "Enabled"}`}}}
+		case strings.HasPrefix(csl, ".show database ['Samples'] policy caching"):
+			return &fakeTable{cols: []string{"Policy:string"}, rows: [][]interface{}{{""}}}
+		case strings.HasPrefix(csl, ".show tables details"):
+			return &fakeTable{cols: details, rows: [][]interface{}{
+				// Large, unlimited retention, all of it hot, many small extents.
+				{"Logs", 1e9, 200 * gib, 800 * gib, 200 * gib, 20000, "2023-01-01T00:00:00Z", "2024-06-01T00:00:00Z",
+					`{"SoftDeletePeriod": "00:00:00"}`, `{"DataHotSpan": {"Value": "3650.00:00:00"}}`},
+				// Small, but a hot cache longer than its retention.
+				{"Events", 1000, 4096, 8192, 4096, 1, "2024-05-01T00:00:00Z", "2024-06-01T00:00:00Z",
+					`{"SoftDeletePeriod": "30.00:00:00"}`, `{"DataHotSpan": "90.00:00:00"}`},
+				// Large, inheriting the database's retention and no caching policy.
+				{"Metrics", 1e8, 150 * gib, 300 * gib, 150 * gib, 10, "2024-01-01T00:00:00Z", "2024-06-01T00:00:00Z", "", ""},
+			}}
+		}
+		return nil
+	})
+	r := testReportRun(client, "storage", policyFailFast)
+	if err := r.storage(100 * gib); err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for _, row := range r.report.Sections[0].Rows {
+		tables = append(tables, strings.Join(row[:6], " ")+" | "+strings.Join(row[9:], " "))
+	}
+	want := []string{
+		"Logs 1000000000 200.0 GiB 800.0 GiB 200.0 GiB 100.0 | unlimited 3650d",
+		"Events 1000 4.0 KiB 8.0 KiB 4.0 KiB 100.0 | 30d 90d",
+		"Metrics 100000000 150.0 GiB 300.0 GiB 150.0 GiB 100.0 | 365d unlimited",
+	}
+	if strings.Join(tables, "\n") != strings.Join(want, "\n") {
+		t.Errorf("tables:\n%s\nwant:\n%s", strings.Join(tables, "\n"), strings.Join(want, "\n"))
+	}
+	wantWarnings := []string{
+		"Logs: 200.0 GiB with unlimited retention",
+		"Logs: 200.0 GiB, all of it hot: hot cache period 3650d covers the table's whole history",
+		"Logs: 20000 extents averaging 41.0 MiB of original data; check the merge and ingestion batching policies",
+		"Events: hot cache period 90d is longer than retention 30d",
+		"Metrics: 150.0 GiB with no caching policy: all of it is hot",
+	}
+	if strings.Join(r.report.Warnings, "\n") != strings.Join(wantWarnings, "\n") {
+		t.Errorf("warnings:\n%s\nwant:\n%s", strings.Join(r.report.Warnings, "\n"), strings.Join(wantWarnings, "\n"))
+	}
+}
+
+func TestStoragePolicyMerge(t *testing.T) {
+	tests := []struct {
+		docs []string
+		want storagePolicy
+	}{
+		{nil, storagePolicy{}},
+		{[]string{`{"SoftDeletePeriod": "365.00:00:00"}`}, storagePolicy{retention: 365 * 24 * time.Hour, retentionSet: true}},
+		// A table's policy overrides the database's; an empty cell keeps it.
+		{[]string{`{"SoftDeletePeriod": "365.00:00:00"}`, `{"SoftDeletePeriod": "7.00:00:00"}`, ""},
+			storagePolicy{retention: 7 * 24 * time.Hour, retentionSet: true}},
+		{[]string{`{"DataHotSpan": {"Value": "31.00:00:00"}}`}, storagePolicy{hot: 31 * 24 * time.Hour, hotSet: true}},
+		{[]string{`{"DataHotSpan": "00:00:00"}`}, storagePolicy{hotSet: true}},
+		{[]string{"not json", "null"}, storagePolicy{}},
+	}
+	for _, tt := range tests {
+		var p storagePolicy
+		for _, d := range tt.docs {
+			p.merge(d)
+		}
+		if p != tt.want {
+			t.Errorf("%q: %+v, want %+v", tt.docs, p, tt.want)
+		}
+	}
+}
+
+func TestKustoTimespan(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want time.Duration
+	}{
+		{"365.00:00:00", 365 * 24 * time.Hour},
+		{"01:30:00", 90 * time.Minute},
+		{"1.02:03:04.5", 26*time.Hour + 3*time.Minute + 4500*time.Millisecond},
+		{"forever", 0},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		if got := kustoTimespan(tt.in); got != tt.want {
+			t.Errorf("kustoTimespan(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	for d, want := range map[time.Duration]string{0: "none", 30 * 24 * time.Hour: "30d", 36 * time.Hour: "36h0m0s"} {
+		if got := formatPeriod(d, "none"); got != want {
+			t.Errorf("formatPeriod(%v) = %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+	"github.com/harche/kusto-example/pkg/sink"
+)
+
+// sinkRequery completes a --sink run whose sink failed part way (--sink-opt
+// requery-column=<col>). The query is ordered by the column, so the rows the sink delivered are
+// the first ones; when a batch fails to send, the sink is opened again and the query run again
+// for the rows from the last delivered row's value on, up to attempts times, waiting delay
+// before the first requery and twice as long before each next. Rows sharing the watermark
+// value are delivered again, so consumers see every row at least once.
+type sinkRequery struct {
+	column   string
+	attempts int
+	delay    time.Duration
+	sink     sink.Requery
+	runs     int // requeries made
+}
+
+func newSinkRequery(cfg *sink.Config, out interface{}) (*sinkRequery, error) {
+	r := &sinkRequery{column: cfg.Opt("requery-column", "")}
+	var ok bool
+	if r.sink, ok = out.(sink.Requery); !ok {
+		return nil, fmt.Errorf("requery-column needs a row sink")
+	}
+	var err error
+	if r.attempts, err = strconv.Atoi(cfg.Opt("requeries", "3")); err != nil || r.attempts < 0 {
+		return nil, fmt.Errorf("sink option requeries: want a count, got %q", cfg.Opt("requeries", ""))
+	}
+	if r.delay, err = time.ParseDuration(cfg.Opt("requery-delay", "10s")); err != nil {
+		return nil, fmt.Errorf("sink option requery-delay: %v", err)
+	}
+	return r, nil
+}
+
+// run runs query through do, and again for the undelivered rows while the sink is what failed.
+func (r *sinkRequery) run(query string, do func(q *kql.Builder) error) error {
+	err := do((&kql.Builder{}).AddUnsafe(requeryQuery(query, r.column, "")))
+	delay := r.delay
+	for err != nil && r.sink.Failed() && r.runs < r.attempts {
+		from, lit := "the start", ""
+		if v, typ, ok := r.sink.Watermark(); ok {
+			var lerr error
+			if lit, lerr = inlineLiteral(typ, v); lerr != nil {
+				return fmt.Errorf("%w (requery-column watermark: %v)", err, lerr)
+			}
+			from = r.column + " >= " + lit
+		}
+		r.runs++
+		fmt.Fprintf(os.Stderr, "WARN sink failed: %s; requery %d of %d from %s in %s\n", errText(err), r.runs, r.attempts, from, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if rerr := r.sink.Reopen(); rerr != nil {
+			return fmt.Errorf("%w (reopening the sink: %v)", err, rerr)
+		}
+		err = do((&kql.Builder{}).AddUnsafe(requeryQuery(query, r.column, lit)))
+	}
+	return err
+}
+
+// requeryQuery orders the query's result by column, nulls first, keeping only the rows with a
+// column value of at least from unless from, a KQL literal, is empty.
+func requeryQuery(query, column, from string) string {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	col := kqlquote.Ident(column)
+	if from != "" {
+		query += fmt.Sprintf("\n| where %s >= %s", col, from)
+	}
+	return query + fmt.Sprintf("\n| order by %s asc nulls first", col)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+)
+
+// fakeRequery is a sink that fails once, after delivering rows up to mark.
+type fakeRequery struct {
+	mark    string
+	failed  bool
+	reopens int
+}
+
+func (f *fakeRequery) Watermark() (string, string, bool) { return f.mark, "datetime", f.mark != "" }
+func (f *fakeRequery) Failed() bool                      { return f.failed }
+func (f *fakeRequery) Reopen() error {
+	f.reopens++
+	f.failed = false
+	return nil
+}
+
+func TestSinkRequery(t *testing.T) {
+	fake := &fakeRequery{}
+	r := &sinkRequery{column: "Timestamp", attempts: 3, sink: fake}
+	var queries []string
+	err := r.run("Events | where Level == 'Error';", func(q *kql.Builder) error {
+		queries = append(queries, q.String())
+		if len(queries) == 1 {
+			fake.mark, fake.failed = "2024-03-01T10:00:00.5Z", true
+			return errors.New("servicebus sink: 503")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 || r.runs != 1 || fake.reopens != 1 {
+		t.Fatalf("ran %d queries, %d requeries, %d reopens", len(queries), r.runs, fake.reopens)
+	}
+	if want := "Events | where Level == 'Error'\n| order by ['Timestamp'] asc nulls first"; queries[0] != want {
+		t.Errorf("first query = %q, want %q", queries[0], want)
+	}
+	if !strings.Contains(queries[1], "| where ['Timestamp'] >= datetime(2024-03-01T10:00:00.5Z)\n| order by") {
+		t.Errorf("requery = %q", queries[1])
+	}
+
+	// A failure that isn't the sink's is not requeried, nor is a sink that keeps failing past attempts.
+	r = &sinkRequery{column: "Timestamp", attempts: 2, sink: &fakeRequery{}}
+	calls := 0
+	r.run("Events", func(*kql.Builder) error { calls++; return errors.New("query timed out") })
+	if calls != 1 {
+		t.Errorf("non-sink failure ran %d queries, want 1", calls)
+	}
+	fake = &fakeRequery{}
+	r = &sinkRequery{column: "Timestamp", attempts: 2, sink: fake}
+	calls = 0
+	err = r.run("Events", func(*kql.Builder) error { calls++; fake.failed = true; return errors.New("broker down") })
+	if calls != 3 || err == nil {
+		t.Errorf("ran %d queries (err %v), want 3 and the error", calls, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/google/uuid"
+)
+
+// requestFlags are the client request properties sent with the query or control command of a
+// run: they lift the result truncation limit, set the server-side timeout, and tag the request
+// for .show queries and the cluster's logs. Each flag defaults to its KUSTO_* variable.
+type requestFlags struct {
+	noTruncation  bool
+	serverTimeout time.Duration
+	app           string
+	user          string
+	requestID     string
+	options       requestOptions
+}
+
+// globalRequest holds the flags given before the subcommand; modes add requestOptions() to
+// their calls.
+var globalRequest = &requestFlags{options: requestOptions{}}
+
+func registerRequestFlags(fs *flag.FlagSet) *requestFlags {
+	r := &requestFlags{options: requestOptions{}}
+	noTruncation, _ := strconv.ParseBool(os.Getenv("KUSTO_NO_TRUNCATION"))
+	fs.BoolVar(&r.noTruncation, "no-truncation", noTruncation, "lift the cluster's limit on result size (500000 rows or 64MB by default), for large exports")
+	fs.DurationVar(&r.serverTimeout, "server-timeout", getDurationEnv("KUSTO_SERVER_TIMEOUT", 0), "how long the cluster lets the query or command run, up to 1h (0: the cluster's default, 4m for queries and 10m for commands)")
+	fs.StringVar(&r.app, "request-app", os.Getenv("KUSTO_REQUEST_APP"), "application name the request is reported under in .show queries and .show commands")
+	fs.StringVar(&r.requestID, "client-request-id", os.Getenv("KUSTO_CLIENT_REQUEST_ID"), "client request ID to send with every call (default a new kusto-example.<mode>;<guid> per call), to find the calls in the cluster's logs")
+	fs.StringVar(&r.user, "request-user", os.Getenv("KUSTO_REQUEST_USER"), "user name the request is reported under in .show queries and .show commands")
+	if v := os.Getenv("KUSTO_OPTIONS"); v != "" {
+		for _, kv := range splitCSV(v) {
+			if err := r.options.Set(kv); err != nil {
+				fmt.Fprintf(os.Stderr, "ignoring KUSTO_OPTIONS entry: %v\n", err)
+			}
+		}
+	}
+	fs.Var(r.options, "option", "send a client request property as key=value, e.g. query_datascope=hotcache or maxmemoryconsumptionperiterator=68719476736 (repeatable)")
+	return r
+}
+
+// requestOptions implements flag.Value for repeated key=value request properties. Values that
+// read as a bool or an integer are sent as one, everything else as a string.
+type requestOptions map[string]interface{}
+
+func (o requestOptions) String() string {
+	keys := o.keys()
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", k, o[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (o requestOptions) keys() []string {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (o requestOptions) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		o[k] = b
+	} else if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		o[k] = n
+	} else {
+		o[k] = v
+	}
+	return nil
+}
+
+// requestOptions are the query options for the flags. --option comes first, so the dedicated
+// flags win over a property set both ways.
+func (r *requestFlags) requestOptions() []azkustodata.QueryOption {
+	var opts []azkustodata.QueryOption
+	for _, k := range r.options.keys() {
+		opts = append(opts, azkustodata.CustomQueryOption(k, r.options[k]))
+	}
+	if r.noTruncation {
+		opts = append(opts, azkustodata.NoTruncation())
+	}
+	if r.serverTimeout > 0 {
+		opts = append(opts, azkustodata.ServerTimeout(r.serverTimeout))
+	}
+	// The x-ms-app and x-ms-user headers fill the Application and User columns of .show queries;
+	// request_app_name and request_user the ones the cluster's own reporting uses.
+	if r.app != "" {
+		opts = append(opts, azkustodata.Application(r.app), azkustodata.RequestAppName(r.app))
+	}
+	if r.user != "" {
+		opts = append(opts, azkustodata.User(r.user), azkustodata.RequestUser(r.user))
+	}
+	return opts
+}
+
+// properties are requestOptions as the REST API's request properties, for the calls made
+// without the SDK (--progressive), which also send setHeaders.
+func (r *requestFlags) properties() map[string]interface{} {
+	props := map[string]interface{}{}
+	for k, v := range r.options {
+		props[k] = v
+	}
+	if r.noTruncation {
+		props["notruncation"] = true
+	}
+	if r.serverTimeout > 0 {
+		props["servertimeout"] = timespanText(r.serverTimeout)
+	}
+	if r.app != "" {
+		props["request_app_name"] = r.app
+	}
+	if r.user != "" {
+		props["request_user"] = r.user
+	}
+	return props
+}
+
+// setHeaders sets the x-ms-app and x-ms-user headers of requestOptions.
+func (r *requestFlags) setHeaders(h http.Header) {
+	if r.app != "" {
+		h.Set("x-ms-app", r.app)
+	}
+	if r.user != "" {
+		h.Set("x-ms-user", r.user)
+	}
+}
+
+// callOptions are requestOptions plus the client request ID of one call, which it also returns:
+// --client-request-id, or a new ID in the App.Activity;guid form Kusto's own tools use.
+func (r *requestFlags) callOptions(activity string) (string, []azkustodata.QueryOption) {
+	id := r.requestID
+	if id == "" {
+		id = "kusto-example." + activity + ";" + uuid.NewString()
+	}
+	return id, append(r.requestOptions(), azkustodata.ClientRequestID(id))
+}
+
+// withRequestID adds the client request ID of the call that failed to err, so FAIL lines carry
+// what the cluster's operators need to find it.
+func withRequestID(err error, id string) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w (client request id %s)", err, id)
+}
+
+// checkServerTimeout warns when the server-side timeout outlasts the client's, which would cut
+// the call off first.
+func (r *requestFlags) checkServerTimeout(timeouts timeoutConfig, kind string) {
+	if r.serverTimeout > time.Hour {
+		fmt.Fprintf(os.Stderr, "WARN --server-timeout %s: the cluster allows at most 1h\n", r.serverTimeout)
+	}
+	if d := timeouts.forCall(kind); r.serverTimeout > d {
+		fmt.Fprintf(os.Stderr, "WARN --server-timeout %s is longer than the %s timeout of %s; raise --timeout or --call-timeout %s= too\n", r.serverTimeout, kind, d, kind)
+	}
+}
+
+// truncated reports whether a query failed on the result truncation limit.
+func truncated(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "E_QUERY_RESULT_SET_TOO_LARGE")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestOptions(t *testing.T) {
+	o := requestOptions{}
+	for _, v := range []string{"query_datascope=hotcache", "maxmemoryconsumptionperiterator=68719476736", "request_readonly=true", "query_now=2024-06-01T00:00:00Z"} {
+		if err := o.Set(v); err != nil {
+			t.Fatalf("%s: %v", v, err)
+		}
+	}
+	if o["maxmemoryconsumptionperiterator"] != int64(68719476736) || o["request_readonly"] != true || o["query_datascope"] != "hotcache" {
+		t.Errorf("values sent with the wrong types: %#v", o)
+	}
+	want := "maxmemoryconsumptionperiterator=68719476736,query_datascope=hotcache,query_now=2024-06-01T00:00:00Z,request_readonly=true"
+	if got := o.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	for _, v := range []string{"notruncation", "=1"} {
+		if err := o.Set(v); err == nil {
+			t.Errorf("%q: accepted", v)
+		}
+	}
+	r := &requestFlags{options: o, noTruncation: true, app: "nightly-export"}
+	if n := len(r.requestOptions()); n != 7 {
+		t.Errorf("%d query options, want 4 properties, notruncation and the app name twice", n)
+	}
+
+	id, opts := r.callOptions("query")
+	other, _ := r.callOptions("query")
+	if !strings.HasPrefix(id, "kusto-example.query;") || id == other || len(opts) != 8 {
+		t.Errorf("generated IDs %q and %q, %d options", id, other, len(opts))
+	}
+	r.requestID = "incident-4711"
+	if id, _ := r.callOptions("query"); id != "incident-4711" {
+		t.Errorf("--client-request-id not used: %q", id)
+	}
+	cause := errors.New("Request is invalid")
+	if err := withRequestID(cause, "incident-4711"); !errors.Is(err, cause) || err.Error() != "Request is invalid (client request id incident-4711)" {
+		t.Errorf("withRequestID: %v", err)
+	}
+	if withRequestID(nil, "x") != nil {
+		t.Error("withRequestID turned success into an error")
+	}
+
+	if !truncated(errors.New("Query result set has exceeded the internal record count limit 500000 (E_QUERY_RESULT_SET_TOO_LARGE; see https://aka.ms/kustoquerylimits)")) {
+		t.Error("the truncation error was not recognized")
+	}
+}
+
+func TestRequestProperties(t *testing.T) {
+	r := &requestFlags{noTruncation: true, serverTimeout: 90 * time.Minute, app: "etl", options: requestOptions{"query_datascope": "hotcache", "notruncation": false}}
+	props := r.properties()
+	if props["notruncation"] != true || props["servertimeout"] != "01:30:00" || props["request_app_name"] != "etl" || props["query_datascope"] != "hotcache" {
+		t.Errorf("properties = %v", props)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/sink"
+)
+
+// rotatingEncoder writes the result to a series of --out files of about limit bytes each, so a
+// long export doesn't end up as one multi-GB file. Once the current file has reached the limit
+// it moves on between two rows: the file's encoder is ended, so every file is complete in its
+// format and appears as soon as it is done, and the table being written is begun again in the
+// next one. The size counted is the formatted output before --gzip, as it reaches the file;
+// formats that buffer (parquet row groups, xlsx) and --encode-workers, which writes a little
+// behind, go over by up to a buffer.
+type rotatingEncoder struct {
+	limit      int64
+	open       func(part int) (sink.Upload, error)
+	newEncoder func(w io.Writer) (encode.Encoder, error)
+
+	part  int
+	up    sink.Upload
+	w     *countingWriter
+	enc   encode.Encoder
+	table *encode.Table // the table being written, begun again in the next file
+	rows  int           // rows written to the current file
+	done  []sink.Upload // the closed files
+}
+
+// newRotatingEncoder opens the first file right away, so a bad --out fails before the query.
+func newRotatingEncoder(limit int64, open func(part int) (sink.Upload, error), newEncoder func(w io.Writer) (encode.Encoder, error)) (*rotatingEncoder, error) {
+	r := &rotatingEncoder{limit: limit, open: open, newEncoder: newEncoder}
+	return r, r.next()
+}
+
+func (r *rotatingEncoder) next() error {
+	r.part++
+	up, err := r.open(r.part)
+	if err != nil {
+		return err
+	}
+	w := &countingWriter{w: up}
+	enc, err := r.newEncoder(w)
+	if err != nil {
+		return err
+	}
+	r.up, r.w, r.enc, r.rows = up, w, enc, 0
+	return nil
+}
+
+func (r *rotatingEncoder) Begin(t *encode.Table) error {
+	r.table = t
+	return r.enc.Begin(t)
+}
+
+func (r *rotatingEncoder) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if r.rows > 0 && r.w.n.Load() >= r.limit {
+		if err := r.finish(); err != nil {
+			return err
+		}
+		if err := r.next(); err != nil {
+			return err
+		}
+		if err := r.enc.Begin(r.table); err != nil {
+			return err
+		}
+	}
+	r.rows++
+	return r.enc.WriteRow(t, index, vals)
+}
+
+func (r *rotatingEncoder) End() error {
+	return r.finish()
+}
+
+// finish completes the current file.
+func (r *rotatingEncoder) finish() error {
+	if err := r.enc.End(); err != nil {
+		return err
+	}
+	if err := r.up.Close(); err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	r.done = append(r.done, r.up)
+	return nil
+}
+
+// addTo puts the written files and their total size into a run summary.
+func (r *rotatingEncoder) addTo(s *runSummary) {
+	urls := make([]string, len(r.done))
+	var size int64
+	for i, u := range r.done {
+		urls[i] = u.URL()
+		size += u.Size()
+	}
+	s.add("uploaded", strings.Join(urls, ","))
+	s.add("bytes", size)
+	s.add("parts", len(r.done))
+}
+
+// countingWriter counts the bytes written through it. The count may be read while an
+// encode.Parallel writer is writing.
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
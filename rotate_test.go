@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/sink"
+)
+
+func TestRotatingEncoder(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &sink.Config{Out: filepath.Join(dir, "export.csv"), Opts: sink.Opts{}}
+	r, err := newRotatingEncoder(100<<10, func(part int) (sink.Upload, error) {
+		return sink.OpenUploadPart(cfg, "csv", part)
+	}, func(w io.Writer) (encode.Encoder, error) {
+		return encode.New("csv", w, encode.Options{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{testColumn{0, "Line", types.String}}}
+	r.Begin(table)
+	for i := 0; i < 1000; i++ {
+		if err := r.WriteRow(table, i, value.Values{value.NewString(strings.Repeat("x", 1000))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	parts, _ := filepath.Glob(filepath.Join(dir, "export-*.csv"))
+	if len(parts) < 2 || len(parts) != len(r.done) {
+		t.Fatalf("parts %v, %d closed", parts, len(r.done))
+	}
+	rows := 0
+	for _, p := range parts {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(string(b))
+		if lines[0] != "Line" {
+			t.Errorf("%s starts with %q, want the header", p, lines[0])
+		}
+		rows += len(lines) - 1
+	}
+	if rows != 1000 {
+		t.Errorf("%d rows over %d parts, want 1000", rows, len(parts))
+	}
+}
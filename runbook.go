@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/harche/kusto-example/pkg/classify"
+)
+
+// runbookMap maps error classes to runbook URLs, from KUSTO_RUNBOOKS, e.g.
+// "auth=https://wiki.example.com/kusto-auth,data-missing=https://wiki.example.com/kusto-data".
+// The URL is printed after FAIL lines and added to failed events, so whoever is on call lands on
+// the relevant page. Besides the classes (see errorClass) a key can be "data-missing" (a missing
+// database, table or sample row) or "default" (any other failure).
+type runbookMap map[string]string
+
+// runbooks is the mapping in effect, set up by main.
+var runbooks = runbookMap{}
+
+// runbookGroups are the keys that cover several classes.
+var runbookGroups = map[string][]string{
+	"data-missing": {string(classify.DatabaseNotFound), string(classify.TableNotFound), "sample-missing"},
+}
+
+func parseRunbooks(s string) (runbookMap, error) {
+	known := map[string]bool{"default": true, "sample-missing": true}
+	for _, c := range []classify.Class{classify.Network, classify.Auth, classify.Permission, classify.DatabaseNotFound,
+		classify.TableNotFound, classify.Throttled, classify.Other} {
+		known[string(c)] = true
+	}
+	for k := range runbookGroups {
+		known[k] = true
+	}
+	m := runbookMap{}
+	for _, kv := range splitCSV(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("expected class=url, got %q", kv)
+		}
+		if !known[k] {
+			names := make([]string, 0, len(known))
+			for n := range known {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown error class %q (want %s)", k, strings.Join(names, ", "))
+		}
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("%s: %q is not an http(s) URL", k, v)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// url returns the runbook for err: its class's entry, then its group's, then the default.
+func (m runbookMap) url(err error) string {
+	if err == nil {
+		return ""
+	}
+	class := errorClass(err)
+	if u, ok := m[class]; ok {
+		return u
+	}
+	for group, classes := range runbookGroups {
+		for _, c := range classes {
+			if c == class && m[group] != "" {
+				return m[group]
+			}
+		}
+	}
+	return m["default"]
+}
+
+// printRunbook prints "RUNBOOK <step>: <url>" after a FAIL line, if err's class has a runbook.
+func printRunbook(w io.Writer, step string, err error) {
+	if u := runbooks.url(err); u != "" {
+		fmt.Fprintf(w, "RUNBOOK %s: %s\n", step, u)
+	}
+}
+
+// loadRunbooks reads KUSTO_RUNBOOKS.
+func loadRunbooks() (runbookMap, error) {
+	m, err := parseRunbooks(os.Getenv("KUSTO_RUNBOOKS"))
+	if err != nil {
+		return nil, fmt.Errorf("KUSTO_RUNBOOKS: %v", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/harche/kusto-example/pkg/probe"
+)
+
+func TestRunbooks(t *testing.T) {
+	m, err := parseRunbooks("auth=https://wiki/auth, data-missing=https://wiki/data,table-not-found=https://wiki/tables,default=https://wiki/oncall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{errors.New("AADSTS70011: invalid credential"), "https://wiki/auth"},
+		{errors.New("database 'x' not found"), "https://wiki/data"},
+		{fmt.Errorf("step: %w", probe.ErrSampleMissing), "https://wiki/data"},
+		{errors.New("Semantic error: table 'T' not found"), "https://wiki/tables"}, // a class's own entry beats its group
+		{errors.New("boom"), "https://wiki/oncall"},
+		{nil, ""},
+	} {
+		if got := m.url(c.err); got != c.want {
+			t.Errorf("url(%v) = %q, want %q", c.err, got, c.want)
+		}
+	}
+	for _, bad := range []string{"auth", "authn=https://wiki", "auth=wiki/auth", "auth=ftp://wiki/auth"} {
+		if _, err := parseRunbooks(bad); err == nil {
+			t.Errorf("parseRunbooks(%q) accepted", bad)
+		}
+	}
+}
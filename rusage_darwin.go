@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// peakRSS is the largest resident set size an exited process reached, in bytes.
+func peakRSS(ps *os.ProcessState) int64 {
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		return ru.Maxrss
+	}
+	return 0
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// peakRSS is not measured here; bench reports it as unknown.
+func peakRSS(ps *os.ProcessState) int64 { return 0 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/google/uuid"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// inferredColumn is a column of a schema read off sample rows. Nulls says some rows had no
+// value for it; Kusto columns are all nullable, so it is only shown, not declared.
+type inferredColumn struct {
+	Name  string
+	Type  string
+	Nulls bool
+	seen  bool // a value was seen
+}
+
+// inferDateLayouts are the datetime forms a value is tried against, besides RFC 3339.
+var inferDateLayouts = []string{"2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999", "2006-01-02"}
+
+// inferType is the narrowest Kusto type s parses as: bool, long, real, datetime, guid or dynamic
+// (a JSON object or array), and otherwise string.
+func inferType(s string) string {
+	if strings.EqualFold(s, "true") || strings.EqualFold(s, "false") {
+		return "bool"
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return "long"
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXnN") { // not hex, Inf or NaN
+		return "real"
+	}
+	if inferDateTime(s) {
+		return "datetime"
+	}
+	if len(s) == 36 {
+		if _, err := uuid.Parse(s); err == nil {
+			return "guid"
+		}
+	}
+	if (strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[")) && json.Valid([]byte(s)) {
+		return "dynamic"
+	}
+	return "string"
+}
+
+func inferDateTime(s string) bool {
+	if _, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return true
+	}
+	for _, layout := range inferDateLayouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// widen is the type a column takes once it has held values of types a and b: long widens to
+// real, and any other mix is a string.
+func widen(a, b string) string {
+	switch {
+	case a == b:
+		return a
+	case (a == "long" && b == "real") || (a == "real" && b == "long"):
+		return "real"
+	}
+	return "string"
+}
+
+func (c *inferredColumn) add(typ string) {
+	if typ == "" {
+		c.Nulls = true
+		return
+	}
+	if !c.seen {
+		c.Type, c.seen = typ, true
+		return
+	}
+	c.Type = widen(c.Type, typ)
+}
+
+// inferSchema reads up to sample rows of a csv, tsv, json or multijson file and returns a column
+// for each field, typed by the values seen, and the number of rows read. A CSV file's first record names the columns when
+// header is set; otherwise they are Column1, Column2 and so on, as Kusto names them. JSON
+// columns are the objects' properties, in the order they first appear.
+func inferSchema(r io.Reader, format string, header bool, sample int) ([]inferredColumn, int, error) {
+	var cols []inferredColumn
+	var rows int
+	var err error
+	switch format {
+	case "csv", "tsv":
+		cols, rows, err = inferCSVSchema(r, format == "tsv", header, sample)
+	case "json", "multijson":
+		cols, rows, err = inferJSONSchema(r, sample)
+	default:
+		return nil, 0, fmt.Errorf("can't infer the schema of %s data", format)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(cols) == 0 {
+		return nil, 0, errors.New("no columns in the sampled rows")
+	}
+	for i := range cols {
+		if !cols[i].seen {
+			cols[i].Type = "string" // only nulls
+		}
+	}
+	return cols, rows, nil
+}
+
+func inferCSVSchema(r io.Reader, tsv, header bool, sample int) ([]inferredColumn, int, error) {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	if tsv {
+		cr.Comma = '\t'
+	}
+	var cols []inferredColumn
+	if header {
+		names, err := cr.Read()
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading the header: %w", err)
+		}
+		for _, n := range names {
+			cols = append(cols, inferredColumn{Name: strings.TrimSpace(n)})
+		}
+	}
+	n := 0
+	for ; n < sample; n++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		for len(cols) < len(rec) {
+			cols = append(cols, inferredColumn{})
+		}
+		for i := range cols {
+			v := ""
+			if i < len(rec) {
+				v = rec[i]
+			}
+			if v == "" {
+				cols[i].add("")
+			} else {
+				cols[i].add(inferType(v))
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for i := range cols {
+		name := cols[i].Name
+		if name == "" {
+			name = fmt.Sprintf("Column%d", i+1)
+		}
+		for base, k := name, 2; seen[name]; k++ {
+			name = fmt.Sprintf("%s_%d", base, k)
+		}
+		cols[i].Name, seen[name] = name, true
+	}
+	return cols, n, nil
+}
+
+func inferJSONSchema(r io.Reader, sample int) ([]inferredColumn, int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading the first record: %w", err)
+	}
+	array := tok == json.Delim('[') // multijson may hold one array of the objects
+	var cols []inferredColumn
+	index := map[string]int{}
+	n := 0
+	for ; n < sample; n++ {
+		if array {
+			if !dec.More() {
+				break
+			}
+			tok, err = dec.Token()
+		} else if n > 0 {
+			if tok, err = dec.Token(); err == io.EOF {
+				break
+			}
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		if tok != json.Delim('{') {
+			return nil, 0, fmt.Errorf("record %d is not an object", n+1)
+		}
+		present := map[int]bool{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, 0, fmt.Errorf("record %d: %w", n+1, err)
+			}
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return nil, 0, fmt.Errorf("record %d: %w", n+1, err)
+			}
+			name, _ := key.(string)
+			i, ok := index[name]
+			if !ok {
+				i, index[name] = len(cols), len(cols)
+				cols = append(cols, inferredColumn{Name: name, Nulls: n > 0}) // missing from the earlier records
+			}
+			present[i] = true
+			cols[i].add(inferJSONType(v))
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, 0, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		for i := range cols {
+			if !present[i] {
+				cols[i].Nulls = true
+			}
+		}
+	}
+	return cols, n, nil
+}
+
+// inferJSONType is the Kusto type of a JSON value: strings are looked at for datetimes and guids
+// only, since a JSON string holding a number is still a string.
+func inferJSONType(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return "bool"
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return "long"
+		}
+		return "real"
+	case string:
+		switch t := inferType(x); t {
+		case "datetime", "guid":
+			return t
+		}
+		return "string"
+	}
+	return "dynamic"
+}
+
+// createTableCommand is the .create table command for the inferred columns.
+func createTableCommand(table string, cols []inferredColumn) string {
+	defs := make([]string, len(cols))
+	for i, c := range cols {
+		defs[i] = kqlquote.Ident(c.Name) + ":" + c.Type
+	}
+	return fmt.Sprintf(".create table %s (%s)", kqlquote.Ident(table), strings.Join(defs, ", "))
+}
+
+// printSchema writes the inferred columns one per line, for the user to look over.
+func printSchema(w io.Writer, table string, cols []inferredColumn, sampled int) {
+	fmt.Fprintf(w, "SCHEMA %s, inferred from the first %d rows:\n", table, sampled)
+	width := 0
+	for _, c := range cols {
+		width = max(width, len(c.Name))
+	}
+	for _, c := range cols {
+		note := ""
+		if c.Nulls {
+			note = "  (empty in some rows)"
+		}
+		fmt.Fprintf(w, "  %-*s  %-8s%s\n", width, c.Name, c.Type, note)
+	}
+}
+
+// tableExists reports whether database has a table named table.
+func tableExists(ctx context.Context, client *azkustodata.Client, database, table string) (bool, error) {
+	ds, err := client.Mgmt(ctx, database, (&kql.Builder{}).AddUnsafe(".show tables | where TableName == "+kqlquote.String(table)))
+	if err != nil {
+		return false, err
+	}
+	tables := ds.Tables()
+	return len(tables) > 0 && len(tables[0].Rows()) > 0, nil
+}
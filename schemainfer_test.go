@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInferType(t *testing.T) {
+	for s, want := range map[string]string{
+		"TRUE":                                 "bool",
+		"42":                                   "long",
+		"-1.5e3":                               "real",
+		"NaN":                                  "string",
+		"0x1f":                                 "string",
+		"2024-03-01T12:00:00Z":                 "datetime",
+		"2024-03-01 12:00:00.5":                "datetime",
+		"2024-03-01":                           "datetime",
+		"6ba7b810-9dad-11d1-80b4-00c04fd430c8": "guid",
+		`{"a":[1,2]}`:                          "dynamic",
+		"{not json":                            "string",
+		"TEXAS":                                "string",
+	} {
+		if got := inferType(s); got != want {
+			t.Errorf("inferType(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func schemaText(cols []inferredColumn) string {
+	parts := make([]string, len(cols))
+	for i, c := range cols {
+		parts[i] = c.Name + ":" + c.Type
+		if c.Nulls {
+			parts[i] += "?"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func TestInferSchema(t *testing.T) {
+	csv := "State,Events,Damage,Start,Start\nTEXAS,3,1.5,2024-03-01,x\nOHIO,,2,2024-03-02,y\n\"NEW YORK\",7,3,,z\n"
+	cols, rows, err := inferSchema(strings.NewReader(csv), "csv", true, 1000)
+	if err != nil || rows != 3 {
+		t.Fatalf("csv: %d rows, %v", rows, err)
+	}
+	if got, want := schemaText(cols), "State:string, Events:long?, Damage:real, Start:datetime?, Start_2:string"; got != want {
+		t.Errorf("csv: %s\nwant %s", got, want)
+	}
+
+	// Without a header, the columns are numbered, and only the sample is read.
+	cols, rows, err = inferSchema(strings.NewReader("1\ta\n2\tb\nx\tc\n"), "tsv", false, 2)
+	if err != nil || rows != 2 || schemaText(cols) != "Column1:long, Column2:string" {
+		t.Errorf("tsv: %s, %d rows, %v", schemaText(cols), rows, err)
+	}
+
+	ndjson := `{"id":1,"name":"a","when":"2024-03-01T00:00:00Z","tags":["x"]}
+{"id":2.5,"name":"7","extra":true}
+`
+	cols, _, err = inferSchema(strings.NewReader(ndjson), "json", false, 1000)
+	if got, want := schemaText(cols), "id:real, name:string, when:datetime?, tags:dynamic?, extra:bool?"; err != nil || got != want {
+		t.Errorf("json: %s, %v\nwant %s", got, err, want)
+	}
+	cols, rows, err = inferSchema(strings.NewReader(`[{"id":1},{"id":null}]`), "multijson", false, 1000)
+	if err != nil || rows != 2 || schemaText(cols) != "id:long?" {
+		t.Errorf("multijson: %s, %d rows, %v", schemaText(cols), rows, err)
+	}
+	if _, _, err := inferSchema(strings.NewReader(`[1,2]`), "multijson", false, 1000); err == nil {
+		t.Error("multijson of numbers: no error")
+	}
+}
+
+func TestCreateTableCommand(t *testing.T) {
+	got := createTableCommand("Storm Events", []inferredColumn{{Name: "State", Type: "string"}, {Name: "Begin Time", Type: "datetime"}})
+	if want := ".create table ['Storm Events'] (['State']:string, ['Begin Time']:datetime)"; got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
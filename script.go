@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// scriptStatement is one statement of a run-script file.
+type scriptStatement struct {
+	line int // where it starts in the file, 1-based
+	text string
+}
+
+// runScript implements "run-script <file.kql> [cluster-name]": it runs the statements of a KQL
+// script one after another, control commands (a leading '.') via Mgmt and queries via Query,
+// and reports each one's status and time. Query results are printed on stdout.
+func runScript(args []string, globalTimeouts *timeoutFlags, guard *queryGuard) {
+	fs := flag.NewFlagSet("run-script", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	cmdPolicy := registerErrorPolicyFlag(fs)
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database to run the script against")
+	format := fs.String("format", "table", "output format of query results: "+strings.Join(encode.Names(), "|"))
+	dryRun := fs.Bool("dry-run", false, "print the statements in order without executing them")
+	pos := parseArgs(fs, args)
+	if len(pos) == 0 || len(pos) > 2 {
+		log.Fatalf("usage: run-script [--database db] [--dry-run] <file.kql|-> [cluster-name]")
+	}
+	if _, err := encode.New(*format, io.Discard, encode.Options{}); err != nil {
+		log.Fatalf("run-script: %v", err)
+	}
+	var text []byte
+	var err error
+	if pos[0] == "-" {
+		text, err = io.ReadAll(os.Stdin)
+	} else {
+		text, err = os.ReadFile(pos[0])
+	}
+	if err != nil {
+		log.Fatalf("run-script: %v", err)
+	}
+	stmts := scriptStatements(string(text))
+	if len(stmts) == 0 {
+		log.Fatalf("run-script: %s has no statements", pos[0])
+	}
+	cluster := resolveClusterURL(firstArg(pos[1:]))
+
+	plan := &controlPlan{Name: "run-script " + pos[0], Cluster: cluster}
+	for _, s := range stmts {
+		desc := fmt.Sprintf("line %d: %s", s.line, statementExcerpt(s.text))
+		switch {
+		case !strings.HasPrefix(s.text, "."):
+			plan.add(callQuery, *database, desc, s.text)
+		case destructiveCommand(s.text):
+			plan.addDestructive(callMgmt, *database, desc, s.text)
+		default:
+			plan.add(callMgmt, *database, desc, s.text)
+		}
+	}
+	if *dryRun {
+		plan.print(os.Stdout)
+		return
+	}
+	if err := plan.confirm(gate); err != nil {
+		log.Fatalf("run-script: %v", err)
+	}
+
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	b := newBatch("run-script", resolveErrorPolicy(cmdPolicy, policyFailFast), len(plan.Steps))
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for i, s := range plan.Steps {
+		step := fmt.Sprintf("statement %d/%d", i+1, len(plan.Steps))
+		start := time.Now()
+		msg, err := runScriptStep(client, timeouts, guard, cluster, s, *format, out)
+		out.Flush()
+		d := time.Since(start)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s (%dms): %s: %s\n", step, d.Milliseconds(), s.Desc, errText(err))
+			printRunbook(os.Stderr, step, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "OK %s (%dms): %s%s\n", step, d.Milliseconds(), s.Desc, msg)
+		}
+		if b.done(step+" ("+s.Desc+")", err) {
+			break
+		}
+	}
+	out.Flush()
+	b.summary(os.Stderr)
+	if err := b.err(); err != nil {
+		log.Fatalf("run-script: %v", err)
+	}
+}
+
+// runScriptStep runs one statement. A query's primary result is written to out in format; the
+// returned text notes how many rows it had.
+func runScriptStep(client *azkustodata.Client, timeouts timeoutConfig, guard *queryGuard, cluster string, s planStep, format string, out io.Writer) (string, error) {
+	ctx, cancel := timeouts.callContext(context.Background(), s.Kind)
+	defer cancel()
+	id, opts := globalRequest.callOptions("run-script")
+	if s.Kind == callMgmt {
+		_, err := client.Mgmt(ctx, s.Database, (&kql.Builder{}).AddUnsafe(s.Command), opts...)
+		return "", withRequestID(err, id)
+	}
+	if err := guard.check(ctx, client, cluster, s.Database, s.Command); err != nil {
+		return "", err
+	}
+	enc, err := encode.New(format, out, encode.Options{})
+	if err != nil {
+		return "", err
+	}
+	rows, err := stream.Query(ctx, client, s.Database, (&kql.Builder{}).AddUnsafe(s.Command), encode.PrimaryOnly{Encoder: enc}, opts...)
+	return fmt.Sprintf(" (%d rows)", rows), withRequestID(err, id)
+}
+
+// scriptStatements splits a script into statements. Statements end at a blank line or a ';'
+// outside strings and brackets, except that let, declare, set, alias and restrict statements
+// belong to the query that follows them, as in the REPL. Comments are dropped.
+func scriptStatements(text string) []scriptStatement {
+	var stmts []scriptStatement
+	var block strings.Builder
+	blockLine := 0
+	flush := func() {
+		src := block.String()
+		block.Reset()
+		pending, pendingLine := "", 0
+		from := 0
+		for _, part := range kqlSplit(src, ';') {
+			line := blockLine
+			first, _, _ := strings.Cut(part, "\n")
+			if i := strings.Index(src[from:], strings.TrimSpace(first)); i >= 0 {
+				line += strings.Count(src[:from+i], "\n")
+				from += i
+			}
+			if pending == "" {
+				pendingLine = line
+				pending = part
+			} else {
+				pending += ";\n" + part
+			}
+			if !continuesQuery(part) {
+				stmts = append(stmts, scriptStatement{line: pendingLine, text: pending})
+				pending = ""
+			}
+		}
+		if pending != "" {
+			stmts = append(stmts, scriptStatement{line: pendingLine, text: pending})
+		}
+	}
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if block.Len() > 0 {
+				flush()
+			}
+			continue
+		}
+		if block.Len() == 0 {
+			blockLine = i + 1
+		}
+		block.WriteString(line + "\n")
+	}
+	if block.Len() > 0 {
+		flush()
+	}
+	return stmts
+}
+
+// continuesQuery reports whether stmt is a let, declare, set, alias or restrict statement, which
+// the query after it still needs. In a command that ingests a query's results (.set T <| ...),
+// the query part counts.
+func continuesQuery(stmt string) bool {
+	if strings.HasPrefix(stmt, ".") {
+		i := strings.LastIndex(stmt, "<|")
+		if i < 0 {
+			return false
+		}
+		stmt = stmt[i+2:]
+	}
+	fields := strings.Fields(stmt)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToLower(fields[0]) {
+	case "let", "declare", "set", "alias", "restrict":
+		return true
+	}
+	return false
+}
+
+// statementExcerpt is the start of a statement on one line, for status lines.
+func statementExcerpt(text string) string {
+	s := strings.Join(strings.Fields(text), " ")
+	if r := []rune(s); len(r) > 60 {
+		s = string(r[:57]) + "..."
+	}
+	return s
+}
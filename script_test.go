@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScriptStatements(t *testing.T) {
+	const script = `// bootstrap
+.create-merge table Events (Id:long, Name:string);
+.create-merge table Totals (Name:string, N:long)
+
+.set-or-append Totals <| let since = ago(1d);
+Events | where Timestamp > since | summarize N = count() by Name
+
+let names = dynamic(["a;b", "c"]);
+Events
+| where Name in (names);
+Totals | count
+`
+	got := scriptStatements(script)
+	want := []scriptStatement{
+		{2, ".create-merge table Events (Id:long, Name:string)"},
+		{3, ".create-merge table Totals (Name:string, N:long)"},
+		{5, ".set-or-append Totals <| let since = ago(1d);\nEvents | where Timestamp > since | summarize N = count() by Name"},
+		{8, "let names = dynamic([\"a;b\", \"c\"]);\nEvents\n| where Name in (names)"},
+		{11, "Totals | count"},
+	}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("scriptStatements:\n%q\nwant\n%q", got, want)
+	}
+}
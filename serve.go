@@ -0,0 +1,733 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// grafanaServer answers Grafana's JSON datasource protocol (the SimpleJSON plugin, and the
+// Infinity plugin pointed at the same URLs):
+//
+//	GET  /             connection test
+//	POST /search       the names of the query templates, for the metric picker
+//	POST /query        runs each target's template over the panel's time range
+//	POST /annotations  runs the annotation's template and returns its rows as annotations
+//
+// A target names a template, one .kql file of the templates directory; Grafana never sends KQL.
+// The template gets the panel's range as query parameters, declared ahead of its text:
+//
+//	_from, _to        datetime   the time range
+//	_interval         timespan   Grafana's suggested bin size, for summarize ... by bin(T, _interval)
+//	_maxDataPoints    long       how many points the panel can show
+//
+// along with the target's payload ("data" in SimpleJSON), whose fields become parameters of the
+// same name: strings, numbers, booleans, and objects or arrays as dynamic.
+type grafanaServer struct {
+	mu        sync.Mutex        // guards templates, which a reload replaces
+	templates map[string]string // name → KQL
+	database  string
+	maxRows   int
+	timeouts  timeoutConfig
+	run       func(ctx context.Context, database string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error
+}
+
+func (g *grafanaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.WriteHeader(http.StatusOK)
+	case "/search":
+		g.search(w, r)
+	case "/query":
+		g.query(w, r)
+	case "/annotations":
+		g.annotations(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// current returns the templates in use. A reload replaces the map rather than changing it, so
+// queries already under way finish with the text they started with.
+func (g *grafanaServer) current() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.templates
+}
+
+// reload reads the templates of dir again and switches to them, returning what changed.
+func (g *grafanaServer) reload(dir string) (string, error) {
+	templates, err := loadGrafanaTemplates(dir)
+	if err != nil {
+		return "", err
+	}
+	g.mu.Lock()
+	old := g.templates
+	g.templates = templates
+	g.mu.Unlock()
+	var added, changed, removed int
+	for name, text := range templates {
+		if was, ok := old[name]; !ok {
+			added++
+		} else if was != text {
+			changed++
+		}
+	}
+	for name := range old {
+		if _, ok := templates[name]; !ok {
+			removed++
+		}
+	}
+	return fmt.Sprintf("%d templates, %d added, %d changed, %d removed", len(templates), added, changed, removed), nil
+}
+
+// serveAuth lets a request through to next if it carries the token, as "Authorization: Bearer
+// <token>" or as the basic auth password, which is what Grafana's and Prometheus's data source
+// settings offer.
+type serveAuth struct {
+	token string
+	next  http.Handler
+}
+
+func (a serveAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kusto-example"`)
+		grafanaError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+		return
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+func (g *grafanaServer) search(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	json.NewDecoder(r.Body).Decode(&req) // an empty body lists them all
+	names := []string{}
+	for name := range g.current() {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(req.Target)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	grafanaReply(w, names)
+}
+
+// grafanaRange is the time range of a request, with the interval Grafana suggests for it.
+type grafanaRange struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs    int64 `json:"intervalMs"`
+	MaxDataPoints int64 `json:"maxDataPoints"`
+}
+
+func (g *grafanaServer) query(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		grafanaRange
+		Targets []struct {
+			Target  string                 `json:"target"`
+			Type    string                 `json:"type"` // timeserie (the default) or table
+			Hide    bool                   `json:"hide"`
+			Data    map[string]interface{} `json:"data"`
+			Payload map[string]interface{} `json:"payload"` // the newer plugin's name for data
+		} `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		grafanaError(w, http.StatusBadRequest, fmt.Errorf("request: %v", err))
+		return
+	}
+	out := []interface{}{}
+	for _, t := range req.Targets {
+		if t.Hide || t.Target == "" {
+			continue
+		}
+		data := t.Data
+		if data == nil {
+			data = t.Payload
+		}
+		res, status, err := g.runTemplate(r.Context(), t.Target, &req.grafanaRange, data)
+		if err != nil {
+			grafanaError(w, status, fmt.Errorf("%s: %v", t.Target, err))
+			return
+		}
+		if t.Type == "table" {
+			out = append(out, res.table())
+			continue
+		}
+		series, err := res.timeSeries(t.Target)
+		if err != nil {
+			grafanaError(w, http.StatusBadRequest, fmt.Errorf("%s: %v", t.Target, err))
+			return
+		}
+		for _, s := range series {
+			out = append(out, s)
+		}
+	}
+	grafanaReply(w, out)
+}
+
+func (g *grafanaServer) annotations(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		grafanaRange
+		Annotation map[string]interface{} `json:"annotation"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		grafanaError(w, http.StatusBadRequest, fmt.Errorf("request: %v", err))
+		return
+	}
+	name, _ := req.Annotation["query"].(string)
+	res, status, err := g.runTemplate(r.Context(), strings.TrimSpace(name), &req.grafanaRange, nil)
+	if err != nil {
+		grafanaError(w, status, fmt.Errorf("annotation %s: %v", name, err))
+		return
+	}
+	out, err := res.annotations(req.Annotation)
+	if err != nil {
+		grafanaError(w, http.StatusBadRequest, fmt.Errorf("annotation %s: %v", name, err))
+		return
+	}
+	grafanaReply(w, out)
+}
+
+// runTemplate runs a template with the range and payload as parameters, and returns its primary
+// result with the HTTP status for an error.
+func (g *grafanaServer) runTemplate(ctx context.Context, name string, rng *grafanaRange, data map[string]interface{}) (*grafanaResult, int, error) {
+	text, ok := g.current()[name]
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("no such template (see /search)")
+	}
+	params := kql.NewParameters()
+	params.AddDateTime("_from", rng.Range.From.UTC())
+	params.AddDateTime("_to", rng.Range.To.UTC())
+	params.AddTimespan("_interval", time.Duration(max(rng.IntervalMs, 1))*time.Millisecond)
+	params.AddLong("_maxDataPoints", rng.MaxDataPoints)
+	decls := []string{"_from:datetime", "_to:datetime", "_interval:timespan", "_maxDataPoints:long"}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if strings.HasPrefix(k, "_") {
+			return nil, http.StatusBadRequest, fmt.Errorf("payload field %s: names starting with _ are reserved", k)
+		}
+		t, err := bindPayload(params, k, data[k])
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("payload field %v", err)
+		}
+		decls = append(decls, k+":"+t)
+	}
+	q := (&kql.Builder{}).AddUnsafe(fmt.Sprintf("declare query_parameters(%s);\n%s", strings.Join(decls, ", "), text))
+
+	ctx, cancel := g.timeouts.callContext(ctx, callQuery)
+	defer cancel()
+	start := time.Now()
+	res := &grafanaResult{max: g.maxRows}
+	if err := g.run(ctx, g.database, q, params, encode.PrimaryOnly{Encoder: res}); err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL serve %s: %s\n", name, errText(err))
+		if errors.Is(err, errTooManyRows) {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusBadGateway, errors.New(errText(err))
+	}
+	fmt.Fprintf(os.Stderr, "OK serve %s (%dms): %d rows, %s to %s\n", name, time.Since(start).Milliseconds(), len(res.rows),
+		rng.Range.From.UTC().Format(time.RFC3339), rng.Range.To.UTC().Format(time.RFC3339))
+	return res, http.StatusOK, nil
+}
+
+// bindPayload adds a payload field to params and returns its type. Strings are typed the way
+// --param types a value without one, so "2024-06-01T00:00:00Z" is a datetime and "1h" a timespan.
+func bindPayload(params *kql.Parameters, name string, v interface{}) (string, error) {
+	switch x := v.(type) {
+	case string:
+		return queryParam{Name: name, Value: x}.bind(params)
+	case bool:
+		return queryParam{Name: name, Type: "bool", Value: fmt.Sprint(x)}.bind(params)
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+			return queryParam{Name: name, Type: "long", Value: fmt.Sprint(int64(x))}.bind(params)
+		}
+		return queryParam{Name: name, Type: "real", Value: fmt.Sprint(x)}.bind(params)
+	case nil:
+		return "", fmt.Errorf("%s: null has no type", name)
+	}
+	doc, _ := json.Marshal(v)
+	return queryParam{Name: name, Type: "dynamic", Value: string(doc)}.bind(params)
+}
+
+var errTooManyRows = errors.New("the result has more rows than --max-rows; summarize it, e.g. by bin(Timestamp, _interval)")
+
+// grafanaResult collects a primary result for conversion to Grafana's shapes.
+type grafanaResult struct {
+	max     int
+	columns []query.Column
+	rows    [][]interface{} // plain values (see encode.PlainValue)
+}
+
+func (g *grafanaResult) Begin(t *encode.Table) error {
+	if g.columns == nil {
+		g.columns = t.Columns
+	}
+	return nil
+}
+
+func (g *grafanaResult) WriteRow(t *encode.Table, _ int, vals value.Values) error {
+	if len(g.rows) == g.max {
+		return errTooManyRows
+	}
+	row := make([]interface{}, len(vals))
+	for i, v := range vals {
+		row[i] = encode.PlainValue(v)
+	}
+	g.rows = append(g.rows, row)
+	return nil
+}
+
+func (g *grafanaResult) End() error { return nil }
+
+// column is the index of the first column of type t after skip columns of it, or -1.
+func (g *grafanaResult) column(t types.Column, skip int) int {
+	for i, c := range g.columns {
+		if c.Type() == t {
+			if skip == 0 {
+				return i
+			}
+			skip--
+		}
+	}
+	return -1
+}
+
+// grafanaSeries is one line of a time series panel: values with their times in epoch ms.
+type grafanaSeries struct {
+	Target     string           `json:"target"`
+	Datapoints [][2]interface{} `json:"datapoints"`
+}
+
+// timeSeries turns the result into series. The first datetime column is the time; each numeric
+// column is a series, split by the values of the string columns, so "summarize count() by
+// State, bin(Timestamp, _interval)" draws a line per state. A series is named after its string
+// values, its column, or with neither the template.
+func (g *grafanaResult) timeSeries(name string) ([]grafanaSeries, error) {
+	tc := g.column(types.DateTime, 0)
+	if tc < 0 && len(g.columns) > 0 {
+		return nil, fmt.Errorf("a time series needs a datetime column; use a table panel, or project one")
+	}
+	var nums, labels []int
+	for i, c := range g.columns {
+		switch c.Type() {
+		case types.Int, types.Long, types.Real, types.Decimal:
+			nums = append(nums, i)
+		case types.String:
+			labels = append(labels, i)
+		}
+	}
+	var series []grafanaSeries
+	index := map[string]int{}
+	for _, row := range g.rows {
+		at, ok := row[tc].(time.Time)
+		if !ok {
+			continue
+		}
+		var parts []string
+		for _, i := range labels {
+			s, _ := row[i].(string)
+			parts = append(parts, s)
+		}
+		for _, i := range nums {
+			target := strings.Join(parts, " ")
+			if len(nums) > 1 || target == "" {
+				target = strings.TrimSpace(target + " " + g.columns[i].Name())
+			}
+			if len(nums) == 1 && len(labels) == 0 {
+				target = name
+			}
+			n, ok := index[target]
+			if !ok {
+				n = len(series)
+				index[target] = n
+				series = append(series, grafanaSeries{Target: target, Datapoints: [][2]interface{}{}})
+			}
+			series[n].Datapoints = append(series[n].Datapoints, [2]interface{}{grafanaNumber(row[i]), at.UnixMilli()})
+		}
+	}
+	return series, nil
+}
+
+// grafanaTable is a result for a table panel.
+type grafanaTable struct {
+	Type    string              `json:"type"`
+	Columns []map[string]string `json:"columns"`
+	Rows    [][]interface{}     `json:"rows"`
+}
+
+func (g *grafanaResult) table() grafanaTable {
+	t := grafanaTable{Type: "table", Columns: make([]map[string]string, len(g.columns)), Rows: make([][]interface{}, len(g.rows))}
+	for i, c := range g.columns {
+		typ := "string"
+		switch c.Type() {
+		case types.DateTime:
+			typ = "time"
+		case types.Int, types.Long, types.Real, types.Decimal:
+			typ = "number"
+		case types.Bool:
+			typ = "boolean"
+		}
+		t.Columns[i] = map[string]string{"text": c.Name(), "type": typ}
+	}
+	for r, row := range g.rows {
+		cells := make([]interface{}, len(row))
+		for i, v := range row {
+			cells[i] = grafanaCell(v)
+		}
+		t.Rows[r] = cells
+	}
+	return t
+}
+
+// annotations turns the result into annotations: the first datetime column is the time and a
+// second one the end of a region; Title, Text and Tags columns (any case) fill those fields, and
+// without a Text column the first other string column does.
+func (g *grafanaResult) annotations(annotation map[string]interface{}) ([]map[string]interface{}, error) {
+	tc, ec := g.column(types.DateTime, 0), g.column(types.DateTime, 1)
+	if tc < 0 && len(g.columns) > 0 {
+		return nil, fmt.Errorf("annotations need a datetime column")
+	}
+	title, text, tags := -1, -1, -1
+	for i, c := range g.columns {
+		switch strings.ToLower(c.Name()) {
+		case "title":
+			title = i
+		case "text":
+			text = i
+		case "tags":
+			tags = i
+		}
+	}
+	for i, c := range g.columns {
+		if text < 0 && c.Type() == types.String && i != title && i != tags {
+			text = i
+		}
+	}
+	out := []map[string]interface{}{}
+	for _, row := range g.rows {
+		at, ok := row[tc].(time.Time)
+		if !ok {
+			continue
+		}
+		a := map[string]interface{}{"annotation": annotation, "time": at.UnixMilli()}
+		if end, ok := cellTime(row, ec); ok {
+			a["isRegion"], a["timeEnd"] = true, end.UnixMilli()
+		}
+		if title >= 0 {
+			a["title"] = fmt.Sprint(grafanaCell(row[title]))
+		}
+		if text >= 0 {
+			a["text"] = fmt.Sprint(grafanaCell(row[text]))
+		}
+		if tags >= 0 {
+			a["tags"] = annotationTags(row[tags])
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func cellTime(row []interface{}, i int) (time.Time, bool) {
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, ok := row[i].(time.Time)
+	return t, ok
+}
+
+// annotationTags reads a dynamic array of strings, or a comma-separated string.
+func annotationTags(v interface{}) []string {
+	var tags []string
+	switch x := v.(type) {
+	case []byte:
+		if json.Unmarshal(x, &tags) != nil {
+			tags = nil
+		}
+	case string:
+		tags = splitCSV(x)
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return tags
+}
+
+// grafanaNumber is a numeric plain value as a JSON number, or nil.
+func grafanaNumber(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int32:
+		return x
+	case int64:
+		return x
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil
+		}
+		return x
+	case decimal.Decimal:
+		return x.InexactFloat64()
+	}
+	return nil
+}
+
+// grafanaCell is a plain value as Grafana shows it in a table: times in epoch ms, numbers as
+// numbers, dynamic values as JSON and the rest as text.
+func grafanaCell(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, bool, string:
+		return x
+	case time.Time:
+		return x.UnixMilli()
+	case []byte:
+		return string(x)
+	}
+	if n := grafanaNumber(v); n != nil {
+		return n
+	}
+	return fmt.Sprint(v)
+}
+
+func grafanaReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// grafanaError answers with the message Grafana shows on the panel.
+func grafanaError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
+
+// loadGrafanaTemplates reads the .kql files of dir, each a template named after its file.
+func loadGrafanaTemplates(dir string) (map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.kql"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .kql files in %s", dir)
+	}
+	templates := map[string]string{}
+	for _, f := range files {
+		text, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(f), ".kql")
+		if templates[name] = strings.TrimSpace(string(text)); templates[name] == "" {
+			return nil, fmt.Errorf("%s is empty", f)
+		}
+	}
+	return templates, nil
+}
+
+// grafanaTemplateFiles is what the templates of dir are read from, for a configWatcher: dir
+// itself, so a template added or removed is noticed, and its .kql files.
+func grafanaTemplateFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.kql"))
+	return append([]string{dir}, files...)
+}
+
+// runServe implements "serve [cluster]": an HTTP server for Grafana's JSON datasource plugins,
+// running the query templates of --templates, with --prometheus-table for Prometheus remote read,
+// with --metrics-query as a Prometheus scrape target, and with --query-databases answering ad-hoc
+// queries on POST /api/query, with their status on /api/status (see queryAPI).
+func runServe(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	listen := fs.String("listen", getenv("KUSTO_SERVE_LISTEN", "127.0.0.1:8080"), "address to listen on")
+	templateDir := fs.String("templates", os.Getenv("KUSTO_SERVE_TEMPLATES"), "directory of .kql query templates, each a metric named after its file")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database the templates run against")
+	token := fs.String("token", os.Getenv("KUSTO_SERVE_TOKEN"), "require this token, as a bearer token or the basic auth password")
+	maxRows := fs.Int("max-rows", 100000, "fail a query whose result has more rows than this; the query API truncates it instead")
+	promTable := fs.String("prometheus-table", os.Getenv("KUSTO_PROMETHEUS_TABLE"), "experimental: answer Prometheus remote read on /api/v1/read from this metrics table")
+	promSchema := fs.String("prometheus-schema", "Timestamp,Name,Labels,Value", "the metrics table's time, metric name, labels (dynamic) and value columns")
+	promMax := fs.Int("prometheus-max-samples", 1000000, "fail a remote read query that matches more samples than this")
+	metricsText := fs.String("metrics-query", os.Getenv("KUSTO_METRICS_QUERY"), "expose this query's name, value (and labels) columns as gauges on /metrics, run on each scrape")
+	metricsFile := fs.String("metrics-query-file", "", "read --metrics-query from a file")
+	reloadCheck := fs.Duration("reload-check", 10*time.Second, "reload --templates and --metrics-query-file when they change, checking this often (0 reloads on SIGHUP only)")
+	queryDatabases := fs.String("query-databases", os.Getenv("KUSTO_SERVE_QUERY_DATABASES"), "answer read-only queries on POST /api/query against these databases (comma-separated; the first is the default), streaming NDJSON")
+	maxBytes := fs.Int64("max-bytes", 64<<20, "cut a query API response short, with a truncated trailer, before its rows take more bytes than this")
+	apiKeys := fs.String("api-keys", os.Getenv("KUSTO_SERVE_API_KEYS"), "JSON file of the query API's callers, each with its key, databases, tables and row filters; they replace --token on /api/query")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	metricsQuery, err := readMetricsQuery(*metricsText, *metricsFile)
+	if err != nil {
+		log.Fatalf("serve: %v", err)
+	}
+	var apiDatabases []string
+	for _, d := range strings.Split(*queryDatabases, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			apiDatabases = append(apiDatabases, d)
+		}
+	}
+	if *templateDir == "" && *promTable == "" && metricsQuery == "" && len(apiDatabases) == 0 {
+		log.Fatalf("serve: one of --templates (or KUSTO_SERVE_TEMPLATES), --prometheus-table, --metrics-query or --query-databases is required")
+	}
+	var keys []*apiKey
+	if *apiKeys != "" {
+		if len(apiDatabases) == 0 {
+			log.Fatalf("serve: --api-keys needs --query-databases")
+		}
+		if keys, err = loadAPIKeys(*apiKeys, apiDatabases); err != nil {
+			log.Fatalf("serve: --api-keys: %v", err)
+		}
+	}
+	if *maxRows < 1 || *promMax < 1 || *maxBytes < 1 {
+		log.Fatalf("serve: --max-rows, --max-bytes and --prometheus-max-samples must be at least 1")
+	}
+	if *reloadCheck < 0 {
+		log.Fatalf("serve: --reload-check can't be negative")
+	}
+	var templates map[string]string
+	if *templateDir != "" {
+		if templates, err = loadGrafanaTemplates(*templateDir); err != nil {
+			log.Fatalf("serve: --templates: %v", err)
+		}
+	}
+	var prom *promReader
+	if *promTable != "" {
+		prom = &promReader{table: *promTable, database: *database, maxSamples: *promMax}
+		if prom.timeCol, prom.nameCol, prom.labelsCol, prom.valueCol, err = parsePromSchema(*promSchema); err != nil {
+			log.Fatalf("serve: --prometheus-schema: %v", err)
+		}
+	}
+	onlyKeyed := keys != nil && *templateDir == "" && *promTable == "" && metricsQuery == ""
+	if host, _, err := net.SplitHostPort(*listen); *token == "" && !onlyKeyed && (err != nil || host == "" || !isLoopback(host)) {
+		fmt.Fprintf(os.Stderr, "WARN serve: listening on %s without --token; anyone who can reach it runs queries as you\n", *listen)
+	}
+
+	startTokenRefresh(context.Background())
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	run := func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder, opts ...azkustodata.QueryOption) error {
+		id, callOpts := globalRequest.callOptions("serve")
+		_, err := stream.Query(ctx, client, database, q, enc, append(callOpts, opts...)...)
+		return withRequestID(err, id)
+	}
+	mux := http.NewServeMux()
+	var serving []string
+	if templates != nil {
+		g := &grafanaServer{templates: templates, database: *database, maxRows: *maxRows, timeouts: timeouts}
+		g.run = func(ctx context.Context, database string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error {
+			return run(ctx, database, q, enc, azkustodata.QueryParameters(params))
+		}
+		mux.Handle("/", g)
+		w := &configWatcher{mode: "serve", path: *templateDir, check: *reloadCheck, files: grafanaTemplateFiles(*templateDir)}
+		w.reload = func(context.Context) ([]string, string, error) {
+			changed, err := g.reload(*templateDir)
+			return grafanaTemplateFiles(*templateDir), changed, err
+		}
+		go w.watch(context.Background())
+		names := make([]string, 0, len(templates))
+		for name := range templates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		serving = append(serving, "templates: "+strings.Join(names, ", "))
+	}
+	if prom != nil {
+		prom.timeouts = timeouts
+		prom.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+			return run(ctx, database, q, enc)
+		}
+		mux.Handle("/api/v1/read", prom)
+		serving = append(serving, "remote read: "+*promTable)
+	}
+	if metricsQuery != "" {
+		m := &metricsExporter{query: metricsQuery, database: *database, maxRows: *maxRows, timeouts: timeouts}
+		m.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+			return run(ctx, database, q, enc)
+		}
+		mux.Handle("/metrics", m)
+		// An inline --metrics-query is fixed for the life of the process; only a file is watched.
+		if *metricsFile != "" {
+			w := &configWatcher{mode: "serve", path: *metricsFile, check: *reloadCheck, files: []string{*metricsFile}}
+			w.reload = func(context.Context) ([]string, string, error) {
+				changed, err := m.reload(*metricsFile)
+				return []string{*metricsFile}, changed, err
+			}
+			go w.watch(context.Background())
+		}
+		serving = append(serving, "metrics: /metrics")
+	}
+	var api *queryAPI
+	var status queryStatus
+	if len(apiDatabases) > 0 {
+		api = &queryAPI{databases: apiDatabases, keys: keys, caps: responseCaps{rows: *maxRows, bytes: *maxBytes, timeout: timeouts.forCall(callQuery)}}
+		api.run = func(ctx context.Context, id, database string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error {
+			_, opts := globalRequest.callOptions("serve")
+			opts = append(opts, azkustodata.QueryParameters(params), azkustodata.RequestReadonly(), azkustodata.ClientRequestID(id))
+			_, err := stream.Query(ctx, client, database, q, enc, opts...)
+			return withRequestID(err, id)
+		}
+		status = queryStatus{path: "/api/status", inflight: &api.inflight, keys: keys}
+		mux.Handle("/api/query", api)
+		mux.Handle("/api/status", status)
+		mux.Handle("/api/status/", status)
+		serving = append(serving, "queries: "+strings.Join(apiDatabases, ", "))
+		if keys != nil {
+			serving = append(serving, fmt.Sprintf("%d API keys", len(keys)))
+		}
+	}
+	var handler http.Handler = mux
+	if *token != "" {
+		handler = serveAuth{token: *token, next: mux}
+	}
+	if keys != nil {
+		// The query API and its status check their callers' keys themselves, ahead of --token.
+		keyed := http.NewServeMux()
+		keyed.Handle("/api/query", api)
+		keyed.Handle("/api/status", status)
+		keyed.Handle("/api/status/", status)
+		keyed.Handle("/", handler)
+		handler = keyed
+	}
+	fmt.Fprintf(os.Stderr, "SERVE listening on %s for %s/%s, %s\n", *listen, cluster, *database, strings.Join(serving, "; "))
+	srv := &http.Server{Addr: *listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	log.Fatalf("serve: %v", srv.ListenAndServe())
+}
+
+// isLoopback reports whether host names the local machine only.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestGrafanaServer(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	var sent []string
+	g := &grafanaServer{
+		templates: map[string]string{"storms_by_state": "StormEvents | summarize Events=count() by State, bin(StartTime, _interval)", "outages": "Outages"},
+		database:  "db",
+		maxRows:   10,
+		timeouts:  resolveTimeouts(nil, nil, time.Minute),
+	}
+	g.run = func(ctx context.Context, database string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error {
+		sent = append(sent, q.String())
+		var tbl *encode.Table
+		var rows []value.Values
+		if strings.HasSuffix(q.String(), "Outages") {
+			tbl = &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "Start", types.DateTime),
+				query.NewColumn(1, "End", types.DateTime), query.NewColumn(2, "Title", types.String), query.NewColumn(3, "Tags", types.Dynamic)}}
+			rows = []value.Values{{value.NewDateTime(t0), value.NewDateTime(t0.Add(time.Hour)), value.NewString("eu-west down"), value.NewDynamic([]byte(`["sev1","eu"]`))}}
+		} else {
+			tbl = &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "State", types.String),
+				query.NewColumn(1, "StartTime", types.DateTime), query.NewColumn(2, "Events", types.Long)}}
+			rows = []value.Values{
+				{value.NewString("TEXAS"), value.NewDateTime(t0), value.NewLong(3)},
+				{value.NewString("OHIO"), value.NewDateTime(t0), value.NewLong(1)},
+				{value.NewString("TEXAS"), value.NewDateTime(t0.Add(time.Hour)), value.NewLong(5)},
+			}
+		}
+		enc.Begin(tbl)
+		for i, r := range rows {
+			if err := enc.WriteRow(tbl, i, r); err != nil {
+				return err
+			}
+		}
+		return enc.End()
+	}
+	srv := httptest.NewServer(serveAuth{token: "secret", next: g})
+	defer srv.Close()
+	post := func(path, body string, out interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		req.SetBasicAuth("grafana", "secret")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(out)
+		return resp.StatusCode
+	}
+	rng := `"range":{"from":"2024-06-01T00:00:00.000Z","to":"2024-06-01T06:00:00.000Z"},"intervalMs":3600000,"maxDataPoints":500`
+
+	var names []string
+	if post("/search", `{"target":"storm"}`, &names); len(names) != 1 || names[0] != "storms_by_state" {
+		t.Errorf("/search = %q", names)
+	}
+
+	var series []grafanaSeries
+	if status := post("/query", `{`+rng+`,"targets":[{"target":"storms_by_state","refId":"A","data":{"minEvents":2,"region":"us"}}]}`, &series); status != http.StatusOK {
+		t.Fatalf("/query: %d", status)
+	}
+	if len(series) != 2 || series[0].Target != "TEXAS" || len(series[0].Datapoints) != 2 || series[0].Datapoints[1][1] != float64(t0.Add(time.Hour).UnixMilli()) {
+		t.Errorf("series %+v", series)
+	}
+	if !strings.HasPrefix(sent[0], "declare query_parameters(_from:datetime, _to:datetime, _interval:timespan, _maxDataPoints:long, minEvents:long, region:string);\n") {
+		t.Errorf("query sent:\n%s", sent[0])
+	}
+
+	var tables []grafanaTable
+	post("/query", `{`+rng+`,"targets":[{"target":"storms_by_state","type":"table"}]}`, &tables)
+	if len(tables) != 1 || len(tables[0].Rows) != 3 || tables[0].Columns[1]["type"] != "time" || tables[0].Columns[2]["type"] != "number" {
+		t.Errorf("table %+v", tables)
+	}
+
+	var annotations []map[string]interface{}
+	post("/annotations", `{`+rng+`,"annotation":{"name":"Outages","query":"outages"}}`, &annotations)
+	if len(annotations) != 1 || annotations[0]["title"] != "eu-west down" || annotations[0]["timeEnd"] != float64(t0.Add(time.Hour).UnixMilli()) ||
+		len(annotations[0]["tags"].([]interface{})) != 2 {
+		t.Errorf("annotations %+v", annotations)
+	}
+
+	var failed map[string]string
+	if status := post("/query", `{`+rng+`,"targets":[{"target":"StormEvents | take 10"}]}`, &failed); status != http.StatusNotFound || failed["message"] == "" {
+		t.Errorf("KQL as a target: %d %v", status, failed)
+	}
+	g.maxRows = 2
+	if status := post("/query", `{`+rng+`,"targets":[{"target":"storms_by_state"}]}`, &failed); status != http.StatusBadRequest || !strings.Contains(failed["message"], "--max-rows") {
+		t.Errorf("too many rows: %d %v", status, failed)
+	}
+
+	resp, _ := srv.Client().Post(srv.URL+"/search", "application/json", strings.NewReader(`{}`))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no token: %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestGrafanaReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("outages.kql", "Outages")
+	write("storms.kql", "StormEvents")
+	g := &grafanaServer{}
+	if _, err := g.reload(dir); err != nil {
+		t.Fatal(err)
+	}
+	running := g.current()
+
+	write("storms.kql", "StormEvents | take 10")
+	write("errors.kql", "Errors")
+	os.Remove(filepath.Join(dir, "outages.kql"))
+	changed, err := g.reload(dir)
+	if want := "2 templates, 1 added, 1 changed, 1 removed"; err != nil || changed != want {
+		t.Errorf("reload = %q, %v; want %q", changed, err, want)
+	}
+	if got := g.current(); got["storms"] != "StormEvents | take 10" || got["errors"] != "Errors" || len(got) != 2 {
+		t.Errorf("templates after the reload: %v", got)
+	}
+	// A query that looked up the templates before the reload keeps the text it started with.
+	if running["outages"] != "Outages" || running["storms"] != "StormEvents" {
+		t.Errorf("the reload changed the templates it replaced: %v", running)
+	}
+
+	write("errors.kql", "  ")
+	if _, err := g.reload(dir); err == nil || len(g.current()) != 2 {
+		t.Errorf("a reload with an empty template: %v, %d templates; want an error and the running ones kept", err, len(g.current()))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/google/uuid"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// queryAPI answers POST /api/query for services that can't embed the SDK:
+//
+//	{"database": "Samples", "query": "StormEvents | where State == state | take n", "params": {"state": "TEXAS", "n": 10}}
+//
+// runs the query against one of the allowed databases (the first when database is left out), with
+// params bound as query parameters the way Grafana payloads are (see bindPayload), and streams its
+// primary result back as NDJSON, a line per row; "schema": true adds the schema line first. An
+// error before the first row is answered with its status and {"error": ...}; once rows went out,
+// the status can't change, so the stream ends with a {"_error": ...} line instead.
+//
+// A response is capped at the server's responseCaps, which a request can lower with "max_rows",
+// "max_bytes" and "timeout". Hitting a cap isn't an error: the stream stops there, the query is
+// cancelled, and a last line says why (see queryStream). A timeout before the first row is still
+// a 504.
+//
+// Each query gets its own client request ID, sent back as X-Ms-Client-Request-Id; while it runs,
+// the status endpoint lists it and can cancel it (see queryStatus). Management commands are
+// refused, as are cluster() and database() references to other databases, and queries are sent
+// with request_readonly, so the cluster refuses any that would change data too.
+//
+// With keys, each request needs one of them instead, and gets the databases of its key, and its
+// tables and filters when the key is scoped (see apiKey).
+type queryAPI struct {
+	databases []string
+	keys      []*apiKey
+	caps      responseCaps
+	run       func(ctx context.Context, id, database string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error
+	inflight  inflightQueries // for the status endpoint
+}
+
+// maxQueryRequest bounds the body of a query request.
+const maxQueryRequest = 1 << 20
+
+func (a *queryAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		queryAPIError(w, http.StatusMethodNotAllowed, errors.New("queries take POST"))
+		return
+	}
+	databases, who := a.databases, ""
+	var key *apiKey
+	if len(a.keys) > 0 {
+		if key = callerKey(r, a.keys); key == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kusto-example"`)
+			queryAPIError(w, http.StatusUnauthorized, errors.New("missing or unknown API key"))
+			return
+		}
+		databases, who = key.Databases, " by "+key.Name
+	}
+	var req struct {
+		Database string                 `json:"database"`
+		Query    string                 `json:"query"`
+		Params   map[string]interface{} `json:"params"`
+		Schema   bool                   `json:"schema"`
+		MaxRows  int                    `json:"max_rows"`
+		MaxBytes int64                  `json:"max_bytes"`
+		Timeout  string                 `json:"timeout"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryRequest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		queryAPIError(w, http.StatusBadRequest, fmt.Errorf("request: %v", err))
+		return
+	}
+	if req.Database == "" {
+		req.Database = databases[0]
+	}
+	if !hasDatabase(databases, req.Database) {
+		queryAPIError(w, http.StatusForbidden, fmt.Errorf("database %s isn't served; these are: %s", req.Database, strings.Join(databases, ", ")))
+		return
+	}
+	caps, err := a.caps.lower(req.MaxRows, req.MaxBytes, req.Timeout)
+	if err != nil {
+		queryAPIError(w, http.StatusBadRequest, fmt.Errorf("request: %v", err))
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		queryAPIError(w, http.StatusBadRequest, errors.New("request: no query"))
+		return
+	}
+	if isMgmtCommand(req.Query) {
+		queryAPIError(w, http.StatusForbidden, errors.New("management commands aren't served; only queries are"))
+		return
+	}
+	if crossDatabase(req.Query) {
+		queryAPIError(w, http.StatusForbidden, errors.New("cluster() and database() aren't served; set database instead"))
+		return
+	}
+	text := req.Query
+	if key != nil && key.scoped() {
+		prefix, err := key.scope(req.Query)
+		if err != nil {
+			queryAPIError(w, http.StatusForbidden, err)
+			return
+		}
+		text = prefix + text
+	}
+	params := kql.NewParameters()
+	var decls []string
+	names := make([]string, 0, len(req.Params))
+	for k := range req.Params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		t, err := bindPayload(params, k, req.Params[k])
+		if err != nil {
+			queryAPIError(w, http.StatusBadRequest, fmt.Errorf("param %v", err))
+			return
+		}
+		decls = append(decls, k+":"+t)
+	}
+	if len(decls) > 0 {
+		text = fmt.Sprintf("declare query_parameters(%s);\n%s", strings.Join(decls, ", "), text)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), caps.timeout)
+	defer cancel()
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	id := "kusto-example.serve;" + uuid.NewString()
+	running := &inflightQuery{id: id, database: req.Database, started: time.Now(), cancel: stop}
+	if key != nil {
+		running.caller = key.Name
+	}
+	a.inflight.add(running)
+	defer a.inflight.remove(id)
+	w.Header().Set("X-Ms-Client-Request-Id", id)
+
+	start := time.Now()
+	out := newQueryStream(w, caps, req.Schema)
+	out.progress = &running.rows
+	err = a.run(ctx, id, req.Database, (&kql.Builder{}).AddUnsafe(text), params, encode.PrimaryOnly{Encoder: out})
+	if err != nil && context.Cause(ctx) == errQueryCancelled {
+		err = fmt.Errorf("query %s: %w", id, errQueryCancelled)
+	}
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if out.end(err, timedOut, r.Context().Err() != nil) {
+		fmt.Fprintf(os.Stderr, "OK serve query%s on %s (%dms): %d rows, truncated at the %s cap\n", who, req.Database, time.Since(start).Milliseconds(), out.rows, out.truncated)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL serve query%s on %s after %d rows: %s\n", who, req.Database, out.rows, errText(err))
+		if !out.started {
+			status := http.StatusBadGateway
+			if timedOut {
+				status = http.StatusGatewayTimeout
+			}
+			queryAPIError(w, status, errors.New(errText(err)))
+			return
+		}
+		line, _ := json.Marshal(map[string]string{"_error": errText(err)})
+		w.Write(append(line, '\n'))
+		return
+	}
+	out.begin()
+	fmt.Fprintf(os.Stderr, "OK serve query%s on %s (%dms): %d rows\n", who, req.Database, time.Since(start).Milliseconds(), out.rows)
+}
+
+// isMgmtCommand reports whether text is a management command: its first statement, after
+// whitespace and // comments, starts with a dot.
+func isMgmtCommand(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		return strings.HasPrefix(line, ".")
+	}
+	return false
+}
+
+// crossRef matches a call of cluster() or database().
+var crossRef = regexp.MustCompile(`(?i)\b(cluster|database)\s*\(`)
+
+// crossDatabase reports whether text calls cluster() or database() outside string literals and
+// comments, which would reach past the database the request was allowed.
+func crossDatabase(text string) bool {
+	for _, part := range kqlSplit(text, 0) {
+		if crossRef.MatchString(stripKQLStrings(part, map[string]bool{})) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestQueryAPI(t *testing.T) {
+	var sent, database string
+	a := &queryAPI{databases: []string{"Samples", "Logs"}, caps: responseCaps{rows: 10, bytes: 1 << 20, timeout: time.Minute}}
+	a.run = func(ctx context.Context, id, db string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error {
+		sent, database = q.String(), db
+		if strings.Contains(q.String(), "Missing") {
+			return errors.New("Semantic error: 'Missing' could not be resolved")
+		}
+		tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+			query.NewColumn(0, "State", types.String), query.NewColumn(1, "Events", types.Long)}}
+		enc.Begin(tbl)
+		for i, s := range []string{"TEXAS", "OHIO", "IOWA"} {
+			if err := enc.WriteRow(tbl, i, value.Values{value.NewString(s), value.NewLong(int64(i))}); err != nil {
+				return err
+			}
+		}
+		return enc.End()
+	}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	post := func(body string) (int, string) {
+		t.Helper()
+		resp, err := srv.Client().Post(srv.URL+"/api/query", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	status, body := post(`{"query": "StormEvents | where State == state | take n", "params": {"state": "TEXAS", "n": 3}}`)
+	if status != http.StatusOK || strings.Count(body, "\n") != 3 || !strings.HasPrefix(body, `{"Events":0,"State":"TEXAS",`) {
+		t.Errorf("%d\n%s", status, body)
+	}
+	if database != "Samples" || !strings.HasPrefix(sent, "declare query_parameters(n:long, state:string);\nStormEvents") {
+		t.Errorf("sent to %s:\n%s", database, sent)
+	}
+
+	// The caps, the server's or lower ones of the request, end the stream with a trailer.
+	a.caps.rows = 2
+	for req, want := range map[string]string{
+		`{"database": "logs", "query": "StormEvents"}`:              `{"_truncated":{"bytes":183,"reason":"rows","rows":2}}`,
+		`{"query": "StormEvents", "max_rows": 1}`:                   `{"_truncated":{"bytes":92,"reason":"rows","rows":1}}`,
+		`{"query": "StormEvents", "max_rows": 5, "max_bytes": 100}`: `{"_truncated":{"bytes":92,"reason":"bytes","rows":1}}`,
+		`{"query": "StormEvents", "max_bytes": 10, "schema": true}`: `{"_truncated":{"bytes":0,"reason":"bytes","rows":0}}`,
+	} {
+		status, body = post(req)
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		if status != http.StatusOK || lines[len(lines)-1] != want {
+			t.Errorf("%s: %d\n%s", req, status, body)
+		}
+	}
+	a.caps.rows = 10
+
+	for body, want := range map[string]int{
+		`{"database": "Secrets", "query": "T"}`:              http.StatusForbidden,
+		`{"query": "// cleanup\n  .drop table StormEvents"}`: http.StatusForbidden,
+		`{"query": "database('Secrets').Keys"}`:              http.StatusForbidden,
+		`{"query": "cluster('x').database('y').T | take 1"}`: http.StatusForbidden,
+		`{"query": "T | union (Database (\"Secrets\").T)"}`:  http.StatusForbidden,
+		`{"query": "Missing"}`:                               http.StatusBadGateway,
+		`{"query": "T", "params": {"x": null}}`:              http.StatusBadRequest,
+		`{"query": "T", "timeout": "soon"}`:                  http.StatusBadRequest,
+		`{"query": "T", "max_rows": -1}`:                     http.StatusBadRequest,
+		`{"qurey": "T"}`:                                     http.StatusBadRequest,
+
+		`{"query": "print a=@\"C:\\\", n=toscalar(database('Secret').Users | count) //\""}`: http.StatusForbidden,
+	} {
+		status, text := post(body)
+		var e map[string]string
+		if json.Unmarshal([]byte(text), &e); status != want || e["error"] == "" {
+			t.Errorf("%s: %d %s", body, status, text)
+		}
+	}
+	if resp, err := srv.Client().Get(srv.URL + "/api/query"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %v", resp)
+	}
+}
+
+func TestCrossDatabase(t *testing.T) {
+	for text, want := range map[string]bool{
+		"database('Secrets').Keys":                      true,
+		"T | join (cluster('x').database('y').U) on Id": true,
+		"let d = database ( 'Secrets' );\nd.Keys":       true,
+		"T | where Note == 'database(x)'":               false,
+		"// database('Secrets')\nT":                     false,
+		"T | extend my_database = 1":                    false,
+		"T | project database_name(Id)":                 false,
+
+		// Verbatim strings take no escapes, so they can't hide a reference; multi-line ones can't
+		// make one.
+		`print a=@"C:\", n=toscalar(database('Secret').Users | count) //"`: true,
+		`print @'it''s', database('Secret').Users`:                         true,
+		`print @"database('Secret')"`:                                      false,
+		"print ```\ndatabase('Secret')\n```":                               false,
+	} {
+		if got := crossDatabase(text); got != want {
+			t.Errorf("%q: %v", text, got)
+		}
+	}
+}
+
+func TestQueryAPIKeys(t *testing.T) {
+	var sent []string
+	a := &queryAPI{databases: []string{"Samples", "Logs"}, caps: responseCaps{rows: 10, bytes: 1 << 20, timeout: time.Minute}, keys: []*apiKey{
+		{Name: "ops", Key: "ops-0123456789abcdef", Databases: []string{"Samples", "Logs"}},
+		{Name: "acme", Key: "acme-0123456789abcdef", Databases: []string{"Samples"}, Filters: map[string]string{"Orders": "TenantId == 'acme'"}},
+	}}
+	a.run = func(ctx context.Context, id, db string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error {
+		sent = append(sent, db+": "+q.String())
+		return nil
+	}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	post := func(key, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL+"/api/query", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, c := range []struct {
+		key, body string
+		want      int
+	}{
+		{"", `{"query": "Orders"}`, http.StatusUnauthorized},
+		{"acme-0123456789abcdef-x", `{"query": "Orders"}`, http.StatusUnauthorized},
+		{"acme-0123456789abcdef", `{"database": "Logs", "query": "Orders"}`, http.StatusForbidden},
+		{"acme-0123456789abcdef", `{"query": "table('Orders')"}`, http.StatusForbidden},
+		{"acme-0123456789abcdef", `{"query": "print @\"\\\" | union table('Secrets') //\""}`, http.StatusForbidden},
+		{"acme-0123456789abcdef", `{"query": "Orders | take n", "params": {"n": 5}}`, http.StatusOK},
+		{"ops-0123456789abcdef", `{"database": "Logs", "query": "Orders"}`, http.StatusOK},
+	} {
+		if got := post(c.key, c.body); got != c.want {
+			t.Errorf("%s %s: %d, want %d", c.key, c.body, got, c.want)
+		}
+	}
+	want := []string{
+		"Samples: declare query_parameters(n:long);\nlet ['Orders'] = table(\"Orders\") | where (TenantId == 'acme');\nrestrict access to (['Orders']);\nOrders | take n",
+		"Logs: Orders",
+	}
+	if strings.Join(sent, "\n--\n") != strings.Join(want, "\n--\n") {
+		t.Errorf("sent:\n%s", strings.Join(sent, "\n--\n"))
+	}
+}
+
+func TestQueryAPITimeout(t *testing.T) {
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "N", types.Long)}}
+	a := &queryAPI{databases: []string{"Samples"}, caps: responseCaps{rows: 10, bytes: 1 << 20, timeout: time.Minute}}
+	a.run = func(ctx context.Context, id, db string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error {
+		if q.String() == "Rows" {
+			enc.Begin(tbl)
+			enc.WriteRow(tbl, 0, value.Values{value.NewLong(1)})
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	for req, want := range map[string]string{
+		`{"query": "Rows", "timeout": "20ms"}`:   `{"_truncated":{"bytes":71,"reason":"duration","rows":1}}`,
+		`{"query": "NoRows", "timeout": "20ms"}`: `{"error":"context deadline exceeded"}`,
+	} {
+		resp, err := srv.Client().Post(srv.URL+"/api/query", "application/json", strings.NewReader(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if lines[len(lines)-1] != want {
+			t.Errorf("%s: %d\n%s", req, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestQueryAPIStatus(t *testing.T) {
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "N", types.Long)}}
+	a := &queryAPI{databases: []string{"Samples"}, caps: responseCaps{rows: 10, bytes: 1 << 20, timeout: time.Minute}, keys: []*apiKey{
+		{Name: "ops", Key: "ops-0123456789abcdef", Databases: []string{"Samples"}},
+		{Name: "acme", Key: "acme-0123456789abcdef", Databases: []string{"Samples"}},
+	}}
+	var sentID string
+	a.run = func(ctx context.Context, id, db string, q *kql.Builder, params *kql.Parameters, enc encode.Encoder) error {
+		sentID = id
+		enc.Begin(tbl)
+		enc.WriteRow(tbl, 0, value.Values{value.NewLong(1)})
+		enc.WriteRow(tbl, 1, value.Values{value.NewLong(2)})
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	mux := http.NewServeMux()
+	status := queryStatus{path: "/api/status", inflight: &a.inflight, keys: a.keys}
+	mux.Handle("/api/query", a)
+	mux.Handle("/api/status", status)
+	mux.Handle("/api/status/", status)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	call := func(method, path, key, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	type listing struct {
+		Queries []struct {
+			ID       string `json:"client_request_id"`
+			Caller   string `json:"caller"`
+			Database string `json:"database"`
+			Rows     int64  `json:"rows"`
+		} `json:"queries"`
+	}
+	list := func(key string) listing {
+		t.Helper()
+		_, body := call("GET", "/api/status", key, "")
+		var l listing
+		if err := json.Unmarshal([]byte(body), &l); err != nil {
+			t.Fatalf("%v: %s", err, body)
+		}
+		return l
+	}
+
+	done := make(chan string)
+	go func() {
+		resp, body := call("POST", "/api/query", "acme-0123456789abcdef", `{"query": "T"}`)
+		done <- resp.Header.Get("X-Ms-Client-Request-Id") + "\n" + body
+	}()
+	var l listing
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if l = list("acme-0123456789abcdef"); len(l.Queries) == 1 && l.Queries[0].Rows == 2 {
+			break
+		}
+	}
+	if len(l.Queries) != 1 || l.Queries[0].ID != sentID || l.Queries[0].Caller != "acme" || l.Queries[0].Database != "Samples" || l.Queries[0].Rows != 2 {
+		t.Fatalf("acme's listing: %+v", l)
+	}
+	id := l.Queries[0].ID
+
+	// Another caller neither sees nor cancels it.
+	if l := list("ops-0123456789abcdef"); len(l.Queries) != 0 {
+		t.Errorf("ops sees %+v", l)
+	}
+	for _, c := range []struct {
+		method, path, key string
+		want              int
+	}{
+		{"DELETE", "/api/status/" + id, "ops-0123456789abcdef", http.StatusNotFound},
+		{"GET", "/api/status", "", http.StatusUnauthorized},
+		{"POST", "/api/status", "acme-0123456789abcdef", http.StatusMethodNotAllowed},
+		{"DELETE", "/api/status/" + id, "acme-0123456789abcdef", http.StatusOK},
+	} {
+		if resp, body := call(c.method, c.path, c.key, ""); resp.StatusCode != c.want {
+			t.Errorf("%s %s as %q: %d %s", c.method, c.path, c.key, resp.StatusCode, body)
+		}
+	}
+	got := <-done
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	if lines[0] != id || len(lines) != 4 || !strings.Contains(lines[3], `"_error":"query `+id+`: cancelled through the status endpoint"`) {
+		t.Errorf("cancelled response:\n%s", got)
+	}
+	if l := list("acme-0123456789abcdef"); len(l.Queries) != 0 {
+		t.Errorf("still listed: %+v", l)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// responseCaps bound a query response of the HTTP server mode: its rows, the bytes of its rows,
+// and how long its query runs. A request can lower them, not raise them, so one bad query can't
+// take the proxy's memory or bandwidth.
+type responseCaps struct {
+	rows    int
+	bytes   int64
+	timeout time.Duration
+}
+
+// lower returns c with the caps a request asked for, where they are lower: max_rows, max_bytes and
+// timeout, with 0 and "" keeping the server's.
+func (c responseCaps) lower(rows int, bytes int64, timeout string) (responseCaps, error) {
+	if rows < 0 || bytes < 0 {
+		return c, errors.New("max_rows and max_bytes can't be negative")
+	}
+	if rows > 0 {
+		c.rows = min(c.rows, rows)
+	}
+	if bytes > 0 {
+		c.bytes = min(c.bytes, bytes)
+	}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return c, fmt.Errorf("timeout %q isn't a positive duration", timeout)
+		}
+		c.timeout = min(c.timeout, d)
+	}
+	return c, nil
+}
+
+// errQueryTruncated stops a query whose response hit a cap.
+var errQueryTruncated = errors.New("the response reached a cap")
+
+// queryStream writes a primary result as NDJSON, sending the response's headers with the first
+// table, so an error before it can still be answered with its status. A row that would take it
+// past the row or byte cap isn't written: truncated says which cap it hit, and the query stops
+// with errQueryTruncated. Hitting a cap isn't an error; the response ends with a trailer line
+// saying why (see end):
+//
+//	{"_truncated": {"reason": "rows", "rows": 1000, "bytes": 183421}}
+type queryStream struct {
+	w         http.ResponseWriter
+	enc       encode.Encoder // ndjson, writing to buf
+	buf       bytes.Buffer
+	caps      responseCaps
+	rows      int
+	bytes     int64
+	started   bool
+	truncated string        // rows, bytes or duration
+	progress  *atomic.Int64 // rows so far, read while the query runs; may be nil
+}
+
+// newQueryStream returns a queryStream answering w, with the schema line when schema is set.
+func newQueryStream(w http.ResponseWriter, caps responseCaps, schema bool) *queryStream {
+	s := &queryStream{w: w, caps: caps}
+	s.enc, _ = encode.New("ndjson", &s.buf, encode.Options{SchemaHeader: schema})
+	return s
+}
+
+func (s *queryStream) begin() {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+		s.w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *queryStream) Begin(t *encode.Table) error {
+	s.begin()
+	s.buf.Reset()
+	if err := s.enc.Begin(t); err != nil {
+		return err
+	}
+	_, err := s.w.Write(s.buf.Bytes())
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return err
+}
+
+func (s *queryStream) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if s.rows == s.caps.rows {
+		s.truncated = "rows"
+		return errQueryTruncated
+	}
+	s.buf.Reset()
+	if err := s.enc.WriteRow(t, index, vals); err != nil {
+		return err
+	}
+	if s.bytes+int64(s.buf.Len()) > s.caps.bytes {
+		s.truncated = "bytes"
+		return errQueryTruncated
+	}
+	s.rows++
+	s.bytes += int64(s.buf.Len())
+	if s.progress != nil {
+		s.progress.Store(int64(s.rows))
+	}
+	_, err := s.w.Write(s.buf.Bytes())
+	return err
+}
+
+func (s *queryStream) End() error { return s.enc.End() }
+
+// end finishes the response of a query that returned err, and reports whether it was cut short.
+// A query that ran out of time once rows went out was cut at the duration cap, unless the client
+// went away (gone). A cut response ends with the trailer.
+func (s *queryStream) end(err error, timedOut, gone bool) bool {
+	if err != nil && s.started && timedOut && !gone {
+		s.truncated = "duration"
+	}
+	if s.truncated == "" {
+		return false
+	}
+	s.begin()
+	line, _ := json.Marshal(map[string]interface{}{"_truncated": map[string]interface{}{"reason": s.truncated, "rows": s.rows, "bytes": s.bytes}})
+	s.w.Write(append(line, '\n'))
+	return true
+}
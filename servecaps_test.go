@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestResponseCaps(t *testing.T) {
+	server := responseCaps{rows: 100, bytes: 1000, timeout: time.Minute}
+	for _, tc := range []struct {
+		rows    int
+		bytes   int64
+		timeout string
+		want    responseCaps
+		err     string
+	}{
+		{want: server},
+		{rows: 10, bytes: 5000, timeout: "30s", want: responseCaps{10, 1000, 30 * time.Second}},
+		{rows: 500, bytes: 10, timeout: "1h", want: responseCaps{100, 10, time.Minute}},
+		{rows: -1, err: "can't be negative"},
+		{timeout: "soon", err: "isn't a positive duration"},
+		{timeout: "-1s", err: "isn't a positive duration"},
+	} {
+		got, err := server.lower(tc.rows, tc.bytes, tc.timeout)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%+v: %v, want %q", tc, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%+v: %+v, %v", tc, got, err)
+		}
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "N", types.Long)}}
+	run := func(caps responseCaps, schema bool, rows int) (*queryStream, *httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		s := newQueryStream(w, caps, schema)
+		if err := s.Begin(tbl); err != nil {
+			return s, w, err
+		}
+		for i := 0; i < rows; i++ {
+			if err := s.WriteRow(tbl, i, value.Values{value.NewLong(int64(i))}); err != nil {
+				return s, w, err
+			}
+		}
+		return s, w, s.End()
+	}
+	row := `{"N":0,"_kind":"PrimaryResult","_rowIndex":0,"_table":"PrimaryResult"}` + "\n"
+
+	s, w, err := run(responseCaps{rows: 10, bytes: 1 << 20}, false, 3)
+	if err != nil || s.end(nil, false, false) || s.rows != 3 || !strings.HasPrefix(w.Body.String(), row) || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("under the caps: %v\n%s", err, w.Body)
+	}
+
+	for _, tc := range []struct {
+		caps   responseCaps
+		schema bool
+		want   string
+	}{
+		{responseCaps{rows: 2, bytes: 1 << 20}, false, `{"_truncated":{"bytes":142,"reason":"rows","rows":2}}`},
+		{responseCaps{rows: 10, bytes: 100}, false, `{"_truncated":{"bytes":71,"reason":"bytes","rows":1}}`},
+		{responseCaps{rows: 10, bytes: 10}, true, `{"_truncated":{"bytes":0,"reason":"bytes","rows":0}}`},
+	} {
+		s, w, err := run(tc.caps, tc.schema, 5)
+		if !errors.Is(err, errQueryTruncated) || !s.end(err, false, false) {
+			t.Errorf("%+v: %v", tc.caps, err)
+		}
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if lines[len(lines)-1] != tc.want {
+			t.Errorf("%+v:\n%s", tc.caps, w.Body)
+		}
+	}
+
+	// Out of time after the first rows is the duration cap; before them, or with the client
+	// gone, it is an error.
+	s, w, _ = run(responseCaps{rows: 10, bytes: 1 << 20}, false, 1)
+	if !s.end(errors.New("deadline"), true, false) || !strings.HasSuffix(w.Body.String(), `{"_truncated":{"bytes":71,"reason":"duration","rows":1}}`+"\n") {
+		t.Errorf("duration:\n%s", w.Body)
+	}
+	s, _, _ = run(responseCaps{rows: 10, bytes: 1 << 20}, false, 1)
+	if s.end(errors.New("deadline"), true, true) {
+		t.Errorf("a client that went away got a trailer")
+	}
+	s = newQueryStream(httptest.NewRecorder(), responseCaps{rows: 10, bytes: 1 << 20}, false)
+	if s.end(errors.New("deadline"), true, false) {
+		t.Errorf("a timeout before any table got a trailer")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// apiKeysConfig is the API keys file of the HTTP server mode: its callers, each with its key and
+// what it may read.
+//
+//	{"keys": [
+//	  {"name": "ops", "key": "…"},
+//	  {"name": "acme", "key": "…", "databases": ["Samples"], "tables": ["StormEvents"],
+//	   "filters": {"Orders": "TenantId == 'acme'"}}
+//	]}
+type apiKeysConfig struct {
+	Keys []*apiKey `json:"keys"`
+}
+
+// apiKey is a caller of the HTTP server mode. Without tables and filters it reads the whole of
+// its databases; with them it is scoped: its queries only see the listed tables and, filtered, the
+// tables of filters (see scope).
+type apiKey struct {
+	Name      string            `json:"name"`
+	Key       string            `json:"key"`
+	Databases []string          `json:"databases"` // default: all the server's; the first is the caller's default
+	Tables    []string          `json:"tables"`
+	Filters   map[string]string `json:"filters"` // table: the predicate every row the caller sees matches
+}
+
+// loadAPIKeys reads and checks an API keys file. databases are the ones the server answers for;
+// a key can only be given some of them.
+func loadAPIKeys(path string, databases []string) ([]*apiKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg apiKeysConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(cfg.Keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	names, keys := map[string]bool{}, map[string]bool{}
+	for i, k := range cfg.Keys {
+		where := fmt.Sprintf("%s: key %d (%s)", path, i+1, k.Name)
+		switch {
+		case k.Name == "":
+			return nil, fmt.Errorf("%s: key %d has no name", path, i+1)
+		case names[k.Name]:
+			return nil, fmt.Errorf("%s: the name is used twice", where)
+		case len(k.Key) < 16:
+			return nil, fmt.Errorf("%s: the key must be at least 16 characters", where)
+		case keys[k.Key]:
+			return nil, fmt.Errorf("%s: the key is used twice", where)
+		}
+		names[k.Name], keys[k.Key] = true, true
+		if len(k.Databases) == 0 {
+			k.Databases = databases
+		}
+		for _, d := range k.Databases {
+			if !hasDatabase(databases, d) {
+				return nil, fmt.Errorf("%s: database %s isn't one the server answers for", where, d)
+			}
+		}
+		for t, f := range k.Filters {
+			if t == "" || strings.TrimSpace(f) == "" {
+				return nil, fmt.Errorf("%s: filters need a table and a predicate", where)
+			}
+		}
+	}
+	return cfg.Keys, nil
+}
+
+func hasDatabase(databases []string, database string) bool {
+	for _, d := range databases {
+		if strings.EqualFold(d, database) {
+			return true
+		}
+	}
+	return false
+}
+
+// callerKey returns the key the request carries (see requestToken), or nil.
+func callerKey(r *http.Request, keys []*apiKey) *apiKey {
+	got := requestToken(r)
+	var found *apiKey
+	for _, k := range keys {
+		// Every key is compared, so the time taken doesn't tell which one came close.
+		if subtle.ConstantTimeCompare([]byte(got), []byte(k.Key)) == 1 {
+			found = k
+		}
+	}
+	return found
+}
+
+// requestToken returns the token a request carries, as "Authorization: Bearer <token>" or as the
+// basic auth password, which is what Grafana's and Prometheus's data source settings offer.
+func requestToken(r *http.Request) string {
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// scoped reports whether k is limited to some tables.
+func (k *apiKey) scoped() bool {
+	return len(k.Tables) > 0 || len(k.Filters) > 0
+}
+
+// scopeEscape matches what a scoped query could use to reach past its tables: the table-naming
+// functions, and find and search, which read every table.
+var scopeEscape = regexp.MustCompile(`(?i)\b(table|materialized_view|external_table)\s*\(|(^|[|;])\s*(find|search|restrict)\b`)
+
+// scope returns the statements that go ahead of a scoped caller's query: a let for each filtered
+// table, shadowing it with its rows that match the filter, then a restrict statement, so the
+// query sees only the caller's tables and those lets. The cluster enforces the restrict, stored
+// functions included; the query is also refused outright when it names a table by string, or
+// uses find or search.
+func (k *apiKey) scope(query string) (string, error) {
+	for _, part := range kqlSplit(query, 0) {
+		if m := scopeEscape.FindString(stripKQLStrings(part, map[string]bool{})); m != "" {
+			return "", fmt.Errorf("%s isn't served to %s; name the tables", strings.Trim(m, "|; \t\n("), k.Name)
+		}
+	}
+	var b strings.Builder
+	visible := map[string]bool{}
+	for _, t := range k.Tables {
+		visible[t] = true
+	}
+	filtered := make([]string, 0, len(k.Filters))
+	for t := range k.Filters {
+		filtered = append(filtered, t)
+		visible[t] = true
+	}
+	sort.Strings(filtered)
+	for _, t := range filtered {
+		fmt.Fprintf(&b, "let %s = table(%s) | where (%s);\n", kqlquote.Ident(t), kqlquote.String(t), k.Filters[t])
+	}
+	names := make([]string, 0, len(visible))
+	for t := range visible {
+		names = append(names, kqlquote.Ident(t))
+	}
+	sort.Strings(names)
+	fmt.Fprintf(&b, "restrict access to (%s);\n", strings.Join(names, ", "))
+	return b.String(), nil
+}
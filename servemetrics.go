@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// metricsConfig is the file serve-metrics reads: the metrics it exposes, each from a query, with
+// defaults for their database, interval and labels.
+//
+//	{
+//	  "interval": "1m",
+//	  "labels": {"cluster": "prod-eus"},
+//	  "metrics": [
+//	    {"name": "storm_events", "help": "Storm events by state.",
+//	     "query": "StormEvents | summarize value = count() by State"},
+//	    {"name": "ingestion_lag_seconds", "interval": "5m", "query_file": "lag.kql"}
+//	  ]
+//	}
+type metricsConfig struct {
+	Database string               `json:"database"`
+	Interval string               `json:"interval"`
+	Labels   map[string]string    `json:"labels"`
+	Metrics  []metricsConfigEntry `json:"metrics"`
+}
+
+type metricsConfigEntry struct {
+	Name      string            `json:"name"`
+	Help      string            `json:"help"`
+	Query     string            `json:"query"`
+	QueryFile string            `json:"query_file"` // relative to the config file
+	Database  string            `json:"database"`
+	Interval  string            `json:"interval"`
+	Labels    map[string]string `json:"labels"` // added to every series, unless the query sets them
+}
+
+// bridgedMetric is one metric of the config, with the series of its last run.
+type bridgedMetric struct {
+	name      string
+	help      string
+	query     string
+	queryFile string // where query was read from, if it was
+	database  string
+	interval  time.Duration
+	labels    []promLabel // sorted by name
+
+	stop, done chan struct{} // closed to stop the loop, and by the loop as it returns
+
+	series      []*metricsSeries // nil after a failed run
+	ok          bool
+	duration    time.Duration
+	lastSuccess time.Time
+}
+
+// loadMetricsConfig reads and checks a serve-metrics config. database and interval are the
+// defaults of metrics and files that don't set them.
+func loadMetricsConfig(path, database string, interval time.Duration) ([]*bridgedMetric, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg metricsConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Database != "" {
+		database = cfg.Database
+	}
+	if cfg.Interval != "" {
+		if interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return nil, fmt.Errorf("%s: interval: %v", path, err)
+		}
+	}
+	if len(cfg.Metrics) == 0 {
+		return nil, fmt.Errorf("%s has no metrics", path)
+	}
+	var metrics []*bridgedMetric
+	seen := map[string]bool{}
+	for i, e := range cfg.Metrics {
+		m := &bridgedMetric{name: metricsName(e.Name, true), help: e.Help, query: strings.TrimSpace(e.Query), database: database, interval: interval}
+		where := fmt.Sprintf("%s: metric %d (%s)", path, i+1, e.Name)
+		switch {
+		case e.Name == "":
+			return nil, fmt.Errorf("%s: metric %d has no name", path, i+1)
+		case m.name != e.Name:
+			return nil, fmt.Errorf("%s: %q isn't a valid metric name; %s is", where, e.Name, m.name)
+		case seen[m.name]:
+			return nil, fmt.Errorf("%s: the name is used twice", where)
+		case (m.query == "") == (e.QueryFile == ""):
+			return nil, fmt.Errorf("%s: set one of query and query_file", where)
+		}
+		seen[m.name] = true
+		if e.QueryFile != "" {
+			file := e.QueryFile
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			if m.query, err = readMetricsQuery("", file); err != nil {
+				return nil, fmt.Errorf("%s: %v", where, err)
+			}
+			m.queryFile = file
+		}
+		if e.Database != "" {
+			m.database = e.Database
+		}
+		if e.Interval != "" {
+			if m.interval, err = time.ParseDuration(e.Interval); err != nil {
+				return nil, fmt.Errorf("%s: interval: %v", where, err)
+			}
+		}
+		if m.interval < time.Second {
+			return nil, fmt.Errorf("%s: the interval must be at least 1s", where)
+		}
+		labels := map[string]string{}
+		for k, v := range cfg.Labels {
+			labels[metricsName(k, false)] = v
+		}
+		for k, v := range e.Labels {
+			labels[metricsName(k, false)] = v
+		}
+		for k, v := range labels {
+			if v != "" {
+				m.labels = append(m.labels, promLabel{k, v})
+			}
+		}
+		sort.Slice(m.labels, func(i, j int) bool { return m.labels[i].name < m.labels[j].name })
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// metricsConfigFiles are the files the config at path and its metrics were read from.
+func metricsConfigFiles(path string, metrics []*bridgedMetric) []string {
+	files := []string{path}
+	for _, m := range metrics {
+		if m.queryFile != "" && !slices.Contains(files, m.queryFile) {
+			files = append(files, m.queryFile)
+		}
+	}
+	return files
+}
+
+// sameDefinition reports whether m and n come from the same config entry, so n can keep m's
+// loop and results.
+func (m *bridgedMetric) sameDefinition(n *bridgedMetric) bool {
+	return m.name == n.name && m.help == n.help && m.query == n.query && m.database == n.database &&
+		m.interval == n.interval && slices.Equal(m.labels, n.labels)
+}
+
+// metricsBridge runs the queries of bridged metrics on their intervals, at most --concurrency at
+// a time, and serves their last results on /metrics. Scrapes don't run queries: they read what
+// the last runs returned, so the load on the cluster is set by the config, not by how many
+// Prometheus servers scrape or how often.
+//
+// Besides the metrics, it exposes for each of them whether its last run worked
+// (kusto_query_up), how long it took (kusto_query_duration_seconds) and when one last worked
+// (kusto_query_last_success_timestamp_seconds). A failed run drops the metric's series until the
+// next one works, rather than exposing stale values as current.
+type metricsBridge struct {
+	metrics  []*bridgedMetric
+	maxRows  int
+	timeouts timeoutConfig
+	sem      chan struct{}
+	run      func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error
+
+	mu sync.RWMutex
+}
+
+// refresh runs m's query once and keeps its series.
+func (b *metricsBridge) refresh(ctx context.Context, m *bridgedMetric) {
+	b.sem <- struct{}{}
+	defer func() { <-b.sem }()
+	ctx, cancel := b.timeouts.callContext(ctx, callQuery)
+	defer cancel()
+	start := time.Now()
+	c := &metricsCollector{metric: m.name, max: b.maxRows, series: map[string]*metricsSeries{}}
+	err := b.run(ctx, m.database, (&kql.Builder{}).AddUnsafe(m.query), encode.PrimaryOnly{Encoder: c})
+	took := time.Since(start)
+
+	var series []*metricsSeries
+	if err == nil {
+		for _, s := range c.series {
+			for _, l := range m.labels {
+				if !hasLabel(s.labels, l.name) {
+					s.labels = append(s.labels, l)
+				}
+			}
+			sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+			series = append(series, s)
+		}
+	}
+	b.mu.Lock()
+	m.series, m.ok, m.duration = series, err == nil, took
+	if err == nil {
+		m.lastSuccess = time.Now()
+	}
+	b.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL serve-metrics %s (%dms): %s\n", m.name, took.Milliseconds(), errText(err))
+		return
+	}
+	if c.duplicates > 0 {
+		fmt.Fprintf(os.Stderr, "WARN serve-metrics %s: %d rows repeat the labels of an earlier row; kept the first\n", m.name, c.duplicates)
+	}
+	fmt.Fprintf(os.Stderr, "OK serve-metrics %s (%dms): %d series\n", m.name, took.Milliseconds(), len(series))
+}
+
+func hasLabel(labels []promLabel, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// start runs m's loop.
+func (b *metricsBridge) start(ctx context.Context, m *bridgedMetric) {
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	go b.loop(ctx, m)
+}
+
+// loop refreshes m every interval until ctx is done or m is stopped, starting at once. A run
+// that is under way when m is stopped finishes first.
+func (b *metricsBridge) loop(ctx context.Context, m *bridgedMetric) {
+	defer close(m.done)
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		b.refresh(ctx, m)
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// reload switches the bridge to the metrics of a reloaded config. Metrics whose definition didn't
+// change keep their loop and last results. Removed and changed ones stop once their run under way
+// has finished, and until then scrapes still see the old metrics; then new and changed ones start.
+func (b *metricsBridge) reload(ctx context.Context, metrics []*bridgedMetric) (kept, started, stopped int) {
+	old := map[string]*bridgedMetric{}
+	for _, m := range b.metrics {
+		old[m.name] = m
+	}
+	var next, starting []*bridgedMetric
+	for _, m := range metrics {
+		if o := old[m.name]; o != nil && o.sameDefinition(m) {
+			delete(old, m.name)
+			next = append(next, o)
+			continue
+		}
+		next = append(next, m)
+		starting = append(starting, m)
+	}
+	for _, o := range old {
+		close(o.stop)
+	}
+	for _, o := range old {
+		<-o.done
+	}
+	b.mu.Lock()
+	b.metrics = next
+	b.mu.Unlock()
+	for _, m := range starting {
+		b.start(ctx, m)
+	}
+	return len(next) - len(starting), len(starting), len(old)
+}
+
+// exposition is the metrics' last series and the bridge's own, in the text format.
+func (b *metricsBridge) exposition(openMetrics bool) []byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	help := map[string]string{
+		"kusto_query_up":                             "Whether the last run of the metric's query worked.",
+		"kusto_query_duration_seconds":               "How long the last run of the metric's query took.",
+		"kusto_query_last_success_timestamp_seconds": "When a run of the metric's query last worked, in Unix time.",
+	}
+	var series []*metricsSeries
+	for _, m := range b.metrics {
+		help[m.name] = m.help
+		series = append(series, m.series...)
+		label := []promLabel{{"metric", m.name}}
+		up := 0.0
+		if m.ok {
+			up = 1
+		}
+		series = append(series,
+			&metricsSeries{name: "kusto_query_up", labels: label, value: up},
+			&metricsSeries{name: "kusto_query_duration_seconds", labels: label, value: m.duration.Seconds()})
+		if !m.lastSuccess.IsZero() {
+			series = append(series, &metricsSeries{name: "kusto_query_last_success_timestamp_seconds", labels: label,
+				value: float64(m.lastSuccess.UnixNano()) / 1e9})
+		}
+	}
+	series = append(series, tokenMetrics(help)...)
+	return metricsExposition(series, help, openMetrics)
+}
+
+func (b *metricsBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "scrape with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", metricsOpenMetricsType)
+	} else {
+		w.Header().Set("Content-Type", metricsTextType)
+	}
+	w.Write(b.exposition(openMetrics))
+}
+
+// runServeMetrics implements "serve-metrics --config <file> [cluster]": a Prometheus exporter
+// whose metrics are the results of KQL queries, each run on its own interval. The config is
+// reloaded without a restart (see configWatcher).
+func runServeMetrics(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("serve-metrics", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	config := fs.String("config", os.Getenv("KUSTO_METRICS_CONFIG"), "JSON file of the metrics and their queries")
+	listen := fs.String("listen", getenv("KUSTO_METRICS_LISTEN", "127.0.0.1:9464"), "address to listen on")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database of the metrics whose config doesn't set one")
+	interval := fs.Duration("interval", time.Minute, "time between runs of a metric's query, for metrics whose config doesn't set one")
+	concurrency := fs.Int("concurrency", 4, "most queries running at a time")
+	maxRows := fs.Int("max-rows", 10000, "fail a metric's run when its query returns more rows than this")
+	token := fs.String("token", os.Getenv("KUSTO_SERVE_TOKEN"), "require this token, as a bearer token or the basic auth password")
+	reloadCheck := fs.Duration("reload-check", 10*time.Second, "reload the config when it or its query files change, checking this often (0 reloads on SIGHUP only)")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	switch {
+	case *config == "":
+		log.Fatalf("serve-metrics: --config (or KUSTO_METRICS_CONFIG) is required")
+	case *concurrency < 1 || *maxRows < 1:
+		log.Fatalf("serve-metrics: --concurrency and --max-rows must be at least 1")
+	case *reloadCheck < 0:
+		log.Fatalf("serve-metrics: --reload-check can't be negative")
+	}
+	metrics, err := loadMetricsConfig(*config, *database, *interval)
+	if err != nil {
+		log.Fatalf("serve-metrics: %v", err)
+	}
+	if host, _, err := net.SplitHostPort(*listen); *token == "" && (err != nil || host == "" || !isLoopback(host)) {
+		fmt.Fprintf(os.Stderr, "WARN serve-metrics: listening on %s without --token; anyone who can reach it reads the metrics\n", *listen)
+	}
+
+	startTokenRefresh(context.Background())
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	globalRequest.checkServerTimeout(timeouts, callQuery)
+	b := &metricsBridge{metrics: metrics, maxRows: *maxRows, timeouts: timeouts, sem: make(chan struct{}, *concurrency)}
+	b.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		id, opts := globalRequest.callOptions("serve-metrics")
+		_, err := stream.Query(ctx, client, database, q, enc, opts...)
+		return withRequestID(err, id)
+	}
+	for _, m := range metrics {
+		b.start(context.Background(), m)
+	}
+	w := &configWatcher{mode: "serve-metrics", path: *config, check: *reloadCheck, files: metricsConfigFiles(*config, metrics)}
+	w.reload = func(ctx context.Context) ([]string, string, error) {
+		metrics, err := loadMetricsConfig(*config, *database, *interval)
+		if err != nil {
+			return nil, "", err
+		}
+		kept, started, stopped := b.reload(ctx, metrics)
+		return metricsConfigFiles(*config, metrics), fmt.Sprintf("%d metrics kept, %d started, %d stopped", kept, started, stopped), nil
+	}
+	go w.watch(context.Background())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", b)
+	var handler http.Handler = mux
+	if *token != "" {
+		handler = serveAuth{token: *token, next: mux}
+	}
+	fmt.Fprintf(os.Stderr, "SERVE-METRICS listening on %s for %s: %d metrics from %s\n", *listen, cluster, len(metrics), *config)
+	srv := &http.Server{Addr: *listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	log.Fatalf("serve-metrics: %v", srv.ListenAndServe())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestLoadMetricsConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(text), 0o644)
+		return path
+	}
+	write("lag.kql", "Ingestions | summarize value = max(Lag) / 1s\n")
+	path := write("metrics.json", `{"interval": "2m", "labels": {"cluster": "prod", "env": "x"}, "metrics": [
+		{"name": "storm_events", "help": "Storms.", "query": "StormEvents | summarize value = count() by State", "labels": {"env": ""}},
+		{"name": "lag_seconds", "query_file": "lag.kql", "interval": "5m", "database": "Ops"}]}`)
+	metrics, err := loadMetricsConfig(path, "sampledb", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storms, lag := metrics[0], metrics[1]
+	if storms.interval != 2*time.Minute || storms.database != "sampledb" || len(storms.labels) != 1 || storms.labels[0] != (promLabel{"cluster", "prod"}) {
+		t.Errorf("storm_events: %+v", storms)
+	}
+	if lag.interval != 5*time.Minute || lag.database != "Ops" || lag.query != "Ingestions | summarize value = max(Lag) / 1s" || len(lag.labels) != 2 {
+		t.Errorf("lag_seconds: %+v", lag)
+	}
+	if files := metricsConfigFiles(path, metrics); len(files) != 2 || files[0] != path || files[1] != filepath.Join(dir, "lag.kql") {
+		t.Errorf("config files: %v", files)
+	}
+
+	for text, want := range map[string]string{
+		`{"metrics": [{"name": "a-b", "query": "T"}]}`:                            "isn't a valid metric name",
+		`{"metrics": [{"name": "a", "query": "T"}, {"name": "a", "query": "T"}]}`: "used twice",
+		`{"metrics": [{"name": "a"}]}`:                                            "one of query and query_file",
+		`{"metrics": [{"name": "a", "query": "T", "interval": "10ms"}]}`:          "at least 1s",
+		`{"metrics": [{"name": "a", "qurey": "T"}]}`:                              "unknown field",
+		`{"metrics": []}`: "no metrics",
+	} {
+		if _, err := loadMetricsConfig(write("bad.json", text), "db", time.Minute); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want %q", text, err, want)
+		}
+	}
+}
+
+func TestMetricsBridge(t *testing.T) {
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+		query.NewColumn(0, "State", types.String), query.NewColumn(1, "value", types.Long), query.NewColumn(2, "cluster", types.String)}}
+	run := func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		if strings.Contains(q.String(), "Broken") {
+			return errors.New("Table 'Broken' not found")
+		}
+		enc.Begin(tbl)
+		enc.WriteRow(tbl, 0, value.Values{value.NewString("TEXAS"), value.NewLong(3), value.NewString("")})
+		enc.WriteRow(tbl, 1, value.Values{value.NewString("OHIO"), value.NewLong(1), value.NewString("edge")})
+		return enc.End()
+	}
+	storms := &bridgedMetric{name: "storm_events", help: "Storm events by state.", query: "StormEvents", interval: time.Minute, labels: []promLabel{{"cluster", "prod"}}}
+	broken := &bridgedMetric{name: "broken", query: "Broken", interval: time.Minute}
+	b := &metricsBridge{metrics: []*bridgedMetric{storms, broken}, maxRows: 10, timeouts: resolveTimeouts(nil, nil, time.Minute), sem: make(chan struct{}, 1), run: run}
+	b.refresh(context.Background(), storms)
+	b.refresh(context.Background(), broken)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+	for _, want := range []string{
+		"# HELP storm_events Storm events by state.\n# TYPE storm_events gauge\n",
+		`storm_events{State="OHIO",cluster="edge"} 1`, // the query's label wins over the config's
+		`storm_events{State="TEXAS",cluster="prod"} 3`,
+		`kusto_query_up{metric="broken"} 0`,
+		`kusto_query_up{metric="storm_events"} 1`,
+		`kusto_query_last_success_timestamp_seconds{metric="storm_events"} `,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("no %q in\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "broken ") || strings.Contains(got, `last_success_timestamp_seconds{metric="broken"}`) {
+		t.Errorf("series of a failed run:\n%s", got)
+	}
+}
+
+func TestMetricsBridgeReload(t *testing.T) {
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, "value", types.Long)}}
+	running, release := make(chan string, 10), make(chan struct{})
+	run := func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		running <- q.String()
+		if q.String() == "Slow" {
+			<-release
+		}
+		enc.Begin(tbl)
+		enc.WriteRow(tbl, 0, value.Values{value.NewLong(1)})
+		if err := enc.End(); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+	metric := func(name, q string) *bridgedMetric {
+		return &bridgedMetric{name: name, query: q, interval: time.Hour, labels: []promLabel{{"env", "prod"}}}
+	}
+	kept, slow := metric("kept", "Kept"), metric("slow", "Slow")
+	b := &metricsBridge{metrics: []*bridgedMetric{kept, slow}, maxRows: 10, timeouts: resolveTimeouts(nil, nil, time.Minute), sem: make(chan struct{}, 2), run: run}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, m := range b.metrics {
+		b.start(ctx, m)
+	}
+	<-running
+	<-running
+
+	// slow's query changed: the reload waits for its run under way.
+	reloaded := make(chan [3]int)
+	go func() {
+		k, s, st := b.reload(ctx, []*bridgedMetric{metric("kept", "Kept"), metric("slow", "Slow | take 1"), metric("added", "Added")})
+		reloaded <- [3]int{k, s, st}
+	}()
+	select {
+	case <-reloaded:
+		t.Fatal("reloaded before the run under way finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if got := <-reloaded; got != [3]int{1, 2, 1} {
+		t.Errorf("kept, started, stopped: %v", got)
+	}
+	started := map[string]bool{<-running: true, <-running: true}
+	if !started["Slow | take 1"] || !started["Added"] {
+		t.Errorf("started %v", started)
+	}
+	if b.metrics[0] != kept || !slow.ok {
+		t.Errorf("kept metric replaced, or the drained run failed: %+v", slow)
+	}
+	select {
+	case q := <-running:
+		t.Errorf("%s ran again", q)
+	default:
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errQueryCancelled is the cause of a query cancelled through the status endpoint.
+var errQueryCancelled = errors.New("cancelled through the status endpoint")
+
+// inflightQuery is a query the server is running.
+type inflightQuery struct {
+	id       string
+	caller   string // the API key's name, if the server has keys
+	database string
+	started  time.Time
+	rows     atomic.Int64
+	cancel   context.CancelCauseFunc
+}
+
+// inflightQueries are the queries the server is running, by client request ID. The zero value is
+// empty and ready.
+type inflightQueries struct {
+	mu      sync.Mutex
+	running map[string]*inflightQuery
+}
+
+func (f *inflightQueries) add(q *inflightQuery) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.running == nil {
+		f.running = map[string]*inflightQuery{}
+	}
+	f.running[q.id] = q
+}
+
+func (f *inflightQueries) remove(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.running, id)
+}
+
+// list returns the queries of caller, or all of them when all is set, oldest first.
+func (f *inflightQueries) list(caller string, all bool) []*inflightQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var qs []*inflightQuery
+	for _, q := range f.running {
+		if all || q.caller == caller {
+			qs = append(qs, q)
+		}
+	}
+	sort.Slice(qs, func(i, j int) bool { return qs[i].started.Before(qs[j].started) })
+	return qs
+}
+
+// cancel cancels the query with the client request ID id, if it is caller's (or all is set), and
+// reports whether there was one.
+func (f *inflightQueries) cancel(id, caller string, all bool) bool {
+	f.mu.Lock()
+	q := f.running[id]
+	f.mu.Unlock()
+	if q == nil || !all && q.caller != caller {
+		return false
+	}
+	q.cancel(errQueryCancelled)
+	return true
+}
+
+// queryStatus answers the status endpoint of the HTTP server mode, for operators: GET lists the
+// running queries, with their client request ID, caller, database, elapsed time and the rows
+// streamed so far, and DELETE <path>/<client request id> cancels one. With keys, a caller sees and
+// cancels its own queries only.
+type queryStatus struct {
+	path     string // where it is mounted, e.g. /api/status
+	inflight *inflightQueries
+	keys     []*apiKey
+}
+
+func (s queryStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	caller, all := "", true
+	if len(s.keys) > 0 {
+		key := callerKey(r, s.keys)
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kusto-example"`)
+			queryAPIError(w, http.StatusUnauthorized, errors.New("missing or unknown API key"))
+			return
+		}
+		caller, all = key.Name, false
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, s.path), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		type entry struct {
+			ID       string  `json:"client_request_id"`
+			Caller   string  `json:"caller,omitempty"`
+			Database string  `json:"database"`
+			Started  string  `json:"started"`
+			Elapsed  float64 `json:"elapsed_seconds"`
+			Rows     int64   `json:"rows"`
+		}
+		queries := []entry{}
+		for _, q := range s.inflight.list(caller, all) {
+			queries = append(queries, entry{q.id, q.caller, q.database, q.started.UTC().Format(time.RFC3339), time.Since(q.started).Seconds(), q.rows.Load()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"queries": queries})
+	case r.Method == http.MethodDelete && id != "":
+		if !s.inflight.cancel(id, caller, all) {
+			queryAPIError(w, http.StatusNotFound, fmt.Errorf("no query %s is running", id))
+			return
+		}
+		fmt.Fprintf(os.Stderr, "CANCEL serve query %s\n", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"cancelled": id})
+	default:
+		queryAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("GET %s lists the queries; DELETE %s/<client request id> cancels one", s.path, s.path))
+	}
+}
+
+// queryAPIError answers with {"error": message}.
+func queryAPIError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryStatus(t *testing.T) {
+	var inflight inflightQueries
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	q := &inflightQuery{id: "kusto-example.serve;1", caller: "acme", database: "Samples", started: time.Now().Add(-time.Second), cancel: cancel}
+	q.rows.Store(2)
+	inflight.add(q)
+	inflight.add(&inflightQuery{id: "kusto-example.serve;2", caller: "ops", database: "Logs", started: time.Now(), cancel: func(error) {}})
+	s := queryStatus{path: "/status", inflight: &inflight, keys: []*apiKey{
+		{Name: "ops", Key: "ops-0123456789abcdef"},
+		{Name: "acme", Key: "acme-0123456789abcdef"},
+	}}
+	call := func(method, path, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	type listing struct {
+		Queries []struct {
+			ID       string  `json:"client_request_id"`
+			Caller   string  `json:"caller"`
+			Database string  `json:"database"`
+			Elapsed  float64 `json:"elapsed_seconds"`
+			Rows     int64   `json:"rows"`
+		} `json:"queries"`
+	}
+	list := func(key string) listing {
+		t.Helper()
+		var l listing
+		if err := json.Unmarshal(call("GET", "/status", key).Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	// A caller sees its own queries only; without keys, all of them, oldest first.
+	if l := list("acme-0123456789abcdef"); len(l.Queries) != 1 || l.Queries[0].ID != q.id || l.Queries[0].Database != "Samples" || l.Queries[0].Rows != 2 || l.Queries[0].Elapsed < 1 {
+		t.Errorf("acme's listing: %+v", l)
+	}
+	s.keys = nil
+	if l := list(""); len(l.Queries) != 2 || l.Queries[0].Caller != "acme" || l.Queries[1].Caller != "ops" {
+		t.Errorf("listing without keys: %+v", l)
+	}
+	s.keys = []*apiKey{{Name: "ops", Key: "ops-0123456789abcdef"}, {Name: "acme", Key: "acme-0123456789abcdef"}}
+
+	for _, c := range []struct {
+		method, path, key string
+		want              int
+	}{
+		{"GET", "/status", "", http.StatusUnauthorized},
+		{"DELETE", "/status/" + q.id, "ops-0123456789abcdef", http.StatusNotFound},
+		{"DELETE", "/status/nope", "acme-0123456789abcdef", http.StatusNotFound},
+		{"POST", "/status", "acme-0123456789abcdef", http.StatusMethodNotAllowed},
+		{"DELETE", "/status", "acme-0123456789abcdef", http.StatusMethodNotAllowed},
+	} {
+		if w := call(c.method, c.path, c.key); w.Code != c.want {
+			t.Errorf("%s %s as %q: %d %s", c.method, c.path, c.key, w.Code, w.Body)
+		}
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("cancelled by another caller")
+	}
+	if w := call("DELETE", "/status/"+q.id, "acme-0123456789abcdef"); w.Code != http.StatusOK || !errors.Is(context.Cause(ctx), errQueryCancelled) {
+		t.Errorf("cancel: %d %s, cause %v", w.Code, w.Body, context.Cause(ctx))
+	}
+	inflight.remove(q.id)
+	if l := list("acme-0123456789abcdef"); len(l.Queries) != 0 {
+		t.Errorf("still listed: %+v", l)
+	}
+}
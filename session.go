@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/sink"
+)
+
+// sessionState is a named session: a database, a prelude of let statements and default
+// parameters, all put in front of every query run with --session. It is stored as
+// sessions/<name>.json in the state location, next to cursors, so a team can share sessions
+// through a gs:// or s3:// state location.
+type sessionState struct {
+	Name     string       `json:"name"`
+	Database string       `json:"database"`
+	Prelude  string       `json:"prelude,omitempty"`
+	Params   []queryParam `json:"params,omitempty"`
+	Updated  time.Time    `json:"updated"`
+}
+
+// queryParam is a query parameter. Its value is sent with the request and bound by a declare
+// query_parameters statement ahead of the query, so it never becomes part of the query text. An
+// empty Type is inferred from the value like a datatable column, with timespans (1d, 30m, ...)
+// added.
+type queryParam struct {
+	Name  string `json:"name"`
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value"`
+}
+
+// queryParams implements flag.Value for repeatable "name=value", "name=type:value" or
+// "name:type=value" flags.
+type queryParams []queryParam
+
+func (p queryParams) String() string {
+	parts := make([]string, len(p))
+	for i, q := range p {
+		parts[i] = q.Name + "=" + q.Value
+		if q.Type != "" {
+			parts[i] = q.Name + "=" + q.Type + ":" + q.Value
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *queryParams) Set(v string) error {
+	name, val, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("expected name=value, name=type:value or name:type=value, got %q", v)
+	}
+	q := queryParam{Name: strings.TrimSpace(name), Value: val}
+	if n, t, ok := strings.Cut(q.Name, ":"); ok {
+		q.Name, q.Type = strings.TrimSpace(n), strings.ToLower(strings.TrimSpace(t))
+	} else if t, rest, ok := strings.Cut(val, ":"); ok && paramTypes[strings.ToLower(t)] {
+		q.Type, q.Value = strings.ToLower(t), rest
+	}
+	if q.Name == "" {
+		return fmt.Errorf("no parameter name in %q", v)
+	}
+	if _, err := q.bind(kql.NewParameters()); err != nil {
+		return err
+	}
+	*p = append(*p, q)
+	return nil
+}
+
+// paramTypes are the types a parameter can be declared with.
+var paramTypes = map[string]bool{
+	"string": true, "int": true, "long": true, "real": true, "double": true, "bool": true,
+	"datetime": true, "timespan": true, "guid": true, "decimal": true, "dynamic": true,
+}
+
+// paramName matches the names a declare statement takes without quoting.
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// timespanLiteral matches the KQL timespan literals parameters accept, e.g. 1d, 2.5h, 30m, 10s,
+// 100ms.
+var timespanLiteral = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?)(d|h|m|s|ms|microsecond|tick)$`)
+
+var timespanUnits = map[string]time.Duration{
+	"d": 24 * time.Hour, "h": time.Hour, "m": time.Minute, "s": time.Second,
+	"ms": time.Millisecond, "microsecond": time.Microsecond, "tick": 100 * time.Nanosecond,
+}
+
+// bind parses the parameter's value as its type and adds it to p with the typed kql.Parameters
+// methods. It returns the type, for the declare statement.
+func (q queryParam) bind(p *kql.Parameters) (string, error) {
+	if !paramName.MatchString(q.Name) {
+		return "", fmt.Errorf("parameter name %q: use letters, digits and '_'", q.Name)
+	}
+	t, v := q.Type, strings.TrimSpace(q.Value)
+	if t == "" {
+		if t = inferInlineType([][]string{{q.Value}}, 0); t == "string" && timespanLiteral.MatchString(v) {
+			t = "timespan"
+		}
+	}
+	var err error
+	switch t {
+	case "string":
+		p.AddString(q.Name, q.Value)
+	case "int":
+		var n int64
+		if n, err = strconv.ParseInt(v, 10, 32); err == nil {
+			p.AddInt(q.Name, int32(n))
+		}
+	case "long":
+		var n int64
+		if n, err = strconv.ParseInt(v, 10, 64); err == nil {
+			p.AddLong(q.Name, n)
+		}
+	case "real", "double":
+		var f float64
+		if f, err = strconv.ParseFloat(v, 64); err == nil {
+			t = "real"
+			p.AddReal(q.Name, f)
+		}
+	case "bool":
+		var b bool
+		if b, err = strconv.ParseBool(v); err == nil {
+			p.AddBool(q.Name, b)
+		}
+	case "datetime":
+		var tv time.Time
+		if tv, err = time.Parse(time.RFC3339Nano, v); err == nil {
+			p.AddDateTime(q.Name, tv.UTC())
+		}
+	case "timespan":
+		m := timespanLiteral.FindStringSubmatch(v)
+		if m == nil {
+			return "", fmt.Errorf("%s: %q is not a timespan such as 1d, 2h or 30m", q.Name, v)
+		}
+		n, _ := strconv.ParseFloat(m[1], 64)
+		p.AddTimespan(q.Name, time.Duration(n*float64(timespanUnits[m[3]])))
+	case "guid":
+		var g uuid.UUID
+		if g, err = uuid.Parse(v); err == nil {
+			p.AddGUID(q.Name, g)
+		}
+	case "decimal":
+		var d decimal.Decimal
+		if d, err = decimal.NewFromString(v); err == nil {
+			p.AddDecimal(q.Name, d)
+		}
+	case "dynamic":
+		var doc interface{}
+		if err = json.Unmarshal([]byte(v), &doc); err == nil {
+			p.AddDynamic(q.Name, doc)
+		}
+	default:
+		return "", fmt.Errorf("%s: unsupported type %q", q.Name, t)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %q is not a valid %s", q.Name, v, t)
+	}
+	return t, nil
+}
+
+// params returns the session's parameters with overrides replacing same-named defaults and
+// adding new ones.
+func (s *sessionState) params(overrides []queryParam) queryParams {
+	params := append(queryParams(nil), s.Params...)
+	for _, o := range overrides {
+		i := 0
+		for i < len(params) && params[i].Name != o.Name {
+			i++
+		}
+		if i == len(params) {
+			params = append(params, o)
+		} else {
+			params[i] = o
+		}
+	}
+	return params
+}
+
+// prelude returns the text to put in front of a query: a declare query_parameters statement for
+// the session's parameters and overrides (see params), then the session's let statements. The
+// values are returned separately, to send with the query; nil when there are none.
+func (s *sessionState) prelude(overrides []queryParam) (string, *kql.Parameters, error) {
+	var b strings.Builder
+	var bound *kql.Parameters
+	if params := s.params(overrides); len(params) > 0 {
+		bound = kql.NewParameters()
+		decls := make([]string, len(params))
+		for i, q := range params {
+			t, err := q.bind(bound)
+			if err != nil {
+				return "", nil, fmt.Errorf("parameter %v", err)
+			}
+			decls[i] = q.Name + ":" + t
+		}
+		fmt.Fprintf(&b, "declare query_parameters(%s);\n", strings.Join(decls, ", "))
+	}
+	if s.Prelude != "" {
+		b.WriteString(s.Prelude + "\n")
+	}
+	return b.String(), bound, nil
+}
+
+// normalizePrelude trims a prelude and makes sure it ends with a ';', so a query can follow it.
+func normalizePrelude(text string) string {
+	text = strings.TrimSpace(text)
+	if text != "" && !strings.HasSuffix(text, ";") {
+		text += ";"
+	}
+	return text
+}
+
+// runSession implements "session save|show|list [name]".
+//
+// save stores (or replaces) a session from --database, --prelude and repeatable --param flags;
+// show prints a stored session and the text it puts in front of queries; list names them.
+// Queries use a session with the global --session flag (or KUSTO_SESSION).
+func runSession(args []string) {
+	if len(args) == 0 || (args[0] != "save" && args[0] != "show" && args[0] != "list") {
+		log.Fatalf("usage: session save|show|list [name] [--database <db>] [--prelude <file|->] [--param name=[type:]value]... [--state <dir|gs://|s3://>]")
+	}
+	mode := args[0]
+	fs := flag.NewFlagSet("session "+mode, flag.ExitOnError)
+	state := fs.String("state", getenv("KUSTO_STATE", defaultStateDir()), "where sessions are kept: a directory, gs://bucket/prefix or s3://bucket/prefix")
+	database := fs.String("database", os.Getenv("KUSTO_DATABASE"), "save: database the session runs against (default KUSTO_DATABASE)")
+	preludeFile := fs.String("prelude", "", "save: file of let statements to put in front of every query ('-' for stdin)")
+	var params queryParams
+	fs.Var(&params, "param", "save: default parameter, name=value or name=type:value (repeatable)")
+	pos := parseArgs(fs, args[1:])
+	store, prefix, err := sessionStore(*state)
+	if err != nil {
+		log.Fatalf("session %s: --state %v", mode, err)
+	}
+
+	if mode == "list" {
+		keys, err := store.List(prefix)
+		if err != nil {
+			log.Fatalf("session list: %v", err)
+		}
+		var names []string
+		for _, k := range keys {
+			if strings.HasSuffix(k, ".json") {
+				names = append(names, strings.TrimSuffix(strings.TrimPrefix(k, prefix), ".json"))
+			}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return
+	}
+	if len(pos) == 0 {
+		log.Fatalf("session %s: a session name is required", mode)
+	}
+	name := pos[0]
+	if strings.ContainsAny(name, `/\`) {
+		log.Fatalf("session %s: invalid session name %q", mode, name)
+	}
+
+	if mode == "show" {
+		s, err := loadSession(*state, name)
+		if err != nil {
+			log.Fatalf("session show: %v", err)
+		}
+		fmt.Print(string(s.marshal()))
+		text, _, err := s.prelude(nil)
+		if err != nil {
+			log.Fatalf("session show: %v", err)
+		}
+		fmt.Printf("\n// prepended to queries:\n%s", text)
+		if len(s.Params) > 0 {
+			fmt.Printf("// sent as query parameters: %s\n", queryParams(s.Params).String())
+		}
+		return
+	}
+
+	if *database == "" {
+		log.Fatalf("session save: --database (or KUSTO_DATABASE) is required")
+	}
+	s := &sessionState{Name: name, Database: *database, Params: params, Updated: time.Now().UTC()}
+	if *preludeFile != "" {
+		var text []byte
+		if *preludeFile == "-" {
+			text, err = io.ReadAll(os.Stdin)
+		} else {
+			text, err = os.ReadFile(*preludeFile)
+		}
+		if err != nil {
+			log.Fatalf("session save: --prelude: %v", err)
+		}
+		s.Prelude = normalizePrelude(string(text))
+	}
+	w, err := store.Create(prefix+name+".json", "json")
+	if err == nil {
+		if _, err = w.Write(s.marshal()); err == nil {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		log.Fatalf("session save: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "SESSION %s: saved (database %s, %d parameters, %d bytes of prelude)\n", name, s.Database, len(s.Params), len(s.Prelude))
+}
+
+// marshal encodes the session as indented JSON, leaving <, > and & in the prelude readable.
+func (s *sessionState) marshal() []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(s)
+	return b.Bytes()
+}
+
+// sessionStore opens the state location and returns the key prefix sessions live under.
+func sessionStore(state string) (sink.Store, string, error) {
+	store, prefix, err := sink.OpenStore(&sink.Config{Opts: sink.Opts{}}, state, true)
+	if err != nil {
+		return nil, "", err
+	}
+	if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return store, prefix + "sessions/", nil
+}
+
+func loadSession(state, name string) (*sessionState, error) {
+	store, prefix, err := sessionStore(state)
+	if err != nil {
+		return nil, err
+	}
+	key := prefix + name + ".json"
+	b, err := store.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("no session at %s (save it with 'session save'): %v", key, err)
+	}
+	var s sessionState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("invalid session %s: %v", key, err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessionPrelude(t *testing.T) {
+	s := &sessionState{
+		Prelude: normalizePrelude("let Recent = Heartbeat | where TimeGenerated > ago(lookback)\n"),
+		Params:  []queryParam{{Name: "lookback", Value: "1d"}, {Name: "region", Value: "west"}},
+	}
+	var overrides queryParams
+	for _, v := range []string{"region=east", "limit:long=10", "since=2026-01-02T00:00:00Z", "key=guid:5b9a5a6c-2f34-4e2b-9d4a-0c7c3c1f0e11"} {
+		if err := overrides.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, bound, err := s.prelude(overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `declare query_parameters(lookback:timespan, region:string, limit:long, since:datetime, key:guid);
+let Recent = Heartbeat | where TimeGenerated > ago(lookback);
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if bound == nil || strings.Contains(got, "east") {
+		t.Errorf("values must be bound as parameters, not written into the query")
+	}
+	for _, bad := range []string{"novalue", "=1", "n:long=x", "n:timespan=soon", "n:blob=1", "n=int:3000000000", "bad-name=1", "n=dynamic:{"} {
+		if err := overrides.Set(bad); err == nil {
+			t.Errorf("Set(%q) accepted", bad)
+		}
+	}
+}
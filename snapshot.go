@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata"
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// snapshotFile is the on-disk form of a recorded query result (testdata/snapshots/<name>.json).
+// Values are stored in the canonical text form used by --hash, so diffs are stable and readable.
+type snapshotFile struct {
+	Name     string           `json:"name"`
+	Database string           `json:"database"`
+	Query    string           `json:"query"`
+	Sample   int              `json:"sample,omitempty"`
+	Round    int              `json:"round,omitempty"`
+	Sorted   bool             `json:"sorted,omitempty"`
+	Columns  []snapshotColumn `json:"columns"`
+	Rows     [][]*string      `json:"rows"`
+}
+
+type snapshotColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// runSnapshot implements "snapshot record|verify --name X [cluster-name]".
+// record runs the query and stores its primary result; verify re-runs the stored query with the
+// stored options and diffs the result against the file, exiting non-zero on any difference.
+func runSnapshot(args []string, globalTimeouts *timeoutFlags) {
+	if len(args) == 0 || (args[0] != "record" && args[0] != "verify") {
+		log.Fatalf("usage: snapshot record|verify --name <name> [--query <kql>] [cluster-name]")
+	}
+	mode := args[0]
+	fs := flag.NewFlagSet("snapshot "+mode, flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	name := fs.String("name", "", "snapshot name (file <dir>/<name>.json)")
+	dir := fs.String("dir", filepath.Join("testdata", "snapshots"), "snapshot directory")
+	queryText := fs.String("query", os.Getenv("KUSTO_QUERY"), "query to record (record only; default KUSTO_QUERY)")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database to query (record only)")
+	sample := fs.Int("sample", 0, "keep only the first N rows, after --sort (record only)")
+	round := fs.Int("round", 0, "round real/decimal values to N decimal places (record only)")
+	sorted := fs.Bool("sort", false, "sort rows before storing/comparing, for results without a stable order (record only)")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args[1:])))
+	if *name == "" {
+		log.Fatalf("snapshot %s: --name is required", mode)
+	}
+	path := filepath.Join(*dir, *name+".json")
+
+	var snap snapshotFile
+	if mode == "record" {
+		if strings.TrimSpace(*queryText) == "" {
+			log.Fatalf("snapshot record: --query (or KUSTO_QUERY) is required")
+		}
+		snap = snapshotFile{Name: *name, Database: *database, Query: *queryText, Sample: *sample, Round: *round, Sorted: *sorted}
+	} else {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("snapshot verify: %v (record it first with 'snapshot record --name %s')", err, *name)
+		}
+		if err := json.Unmarshal(b, &snap); err != nil {
+			log.Fatalf("snapshot verify: invalid snapshot %s: %v", path, err)
+		}
+	}
+
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	ctx, cancel := timeouts.callContext(context.Background(), callQuery)
+	defer cancel()
+	got, err := captureSnapshot(ctx, client, snap)
+	if err != nil {
+		log.Fatalf("snapshot %s: query failed: %s", mode, errText(err))
+	}
+
+	if mode == "record" {
+		if err := os.MkdirAll(*dir, 0o755); err != nil {
+			log.Fatalf("snapshot record: %v", err)
+		}
+		b, _ := json.MarshalIndent(got, "", "  ")
+		if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+			log.Fatalf("snapshot record: %v", err)
+		}
+		fmt.Printf("OK snapshot %s: recorded %d rows to %s\n", *name, len(got.Rows), path)
+		return
+	}
+
+	diffs := diffSnapshots(snap, got)
+	if len(diffs) == 0 {
+		fmt.Printf("OK snapshot %s: %d rows match %s\n", *name, len(got.Rows), path)
+		return
+	}
+	fmt.Printf("FAIL snapshot %s: %d differences against %s\n", *name, len(diffs), path)
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	os.Exit(1)
+}
+
+// captureSnapshot runs the snapshot's query and returns a snapshot of its primary result
+// with the snapshot's sampling, rounding and sorting applied.
+func captureSnapshot(ctx context.Context, client *azkustodata.Client, spec snapshotFile) (snapshotFile, error) {
+	out := spec
+	out.Columns, out.Rows = nil, [][]*string{}
+	ds, err := client.IterativeQuery(ctx, spec.Database, (&kql.Builder{}).AddUnsafe(spec.Query))
+	if err != nil {
+		return out, err
+	}
+	defer ds.Close()
+	seen := false
+	for tr := range ds.Tables() {
+		if tr.Err() != nil {
+			return out, tr.Err()
+		}
+		t := tr.Table()
+		if seen || t.Kind() != "PrimaryResult" {
+			continue
+		}
+		seen = true
+		cols := t.Columns()
+		for _, c := range cols {
+			out.Columns = append(out.Columns, snapshotColumn{Name: c.Name(), Type: string(c.Type())})
+		}
+		for rr := range t.Rows() {
+			if rr.Err() != nil {
+				return out, rr.Err()
+			}
+			vals := rr.Row().Values()
+			row := make([]*string, len(cols))
+			for i, c := range cols {
+				if i >= len(vals) {
+					continue
+				}
+				s, ok := canonicalValue(encode.PlainValue(vals[i]))
+				if !ok {
+					continue
+				}
+				if spec.Round > 0 && (c.Type() == types.Real || c.Type() == types.Decimal) {
+					s = roundCanonical(s, spec.Round)
+				}
+				row[i] = &s
+			}
+			out.Rows = append(out.Rows, row)
+		}
+	}
+	out.Rows = sampleRows(out.Rows, spec.Sample, spec.Sorted)
+	return out, nil
+}
+
+// sampleRows keeps the first sample rows (all with sample 0). With sorted, the rows are sorted
+// first, so the sample doesn't depend on the order the cluster returned them in.
+func sampleRows(rows [][]*string, sample int, sorted bool) [][]*string {
+	if sorted {
+		sort.Slice(rows, func(a, b int) bool { return rowKey(rows[a]) < rowKey(rows[b]) })
+	}
+	if sample > 0 && len(rows) > sample {
+		rows = rows[:sample]
+	}
+	return rows
+}
+
+func roundCanonical(s string, places int) string {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', places, 64)
+}
+
+// diffSnapshots lists schema and row differences between the recorded and current result.
+func diffSnapshots(want, got snapshotFile) []string {
+	var diffs []string
+	if fmtColumns(want.Columns) != fmtColumns(got.Columns) {
+		diffs = append(diffs, "- columns: "+fmtColumns(want.Columns), "+ columns: "+fmtColumns(got.Columns))
+	}
+	n := len(want.Rows)
+	if len(got.Rows) > n {
+		n = len(got.Rows)
+	}
+	for i := 0; i < n; i++ {
+		var w, g string
+		if i < len(want.Rows) {
+			w = rowKey(want.Rows[i])
+		}
+		if i < len(got.Rows) {
+			g = rowKey(got.Rows[i])
+		}
+		if w == g {
+			continue
+		}
+		if i < len(want.Rows) {
+			diffs = append(diffs, fmt.Sprintf("- row %d: %s", i, w))
+		}
+		if i < len(got.Rows) {
+			diffs = append(diffs, fmt.Sprintf("+ row %d: %s", i, g))
+		}
+	}
+	return diffs
+}
+
+func fmtColumns(cols []snapshotColumn) string {
+	parts := make([]string, len(cols))
+	for i, c := range cols {
+		parts[i] = c.Name + ":" + c.Type
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func rowKey(row []*string) string {
+	b, _ := json.Marshal(row)
+	return string(b)
+}
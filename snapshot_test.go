@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func snapshotRows(keys ...string) [][]*string {
+	rows := make([][]*string, len(keys))
+	for i, k := range keys {
+		k := k
+		rows[i] = []*string{&k}
+	}
+	return rows
+}
+
+func TestSampleRows(t *testing.T) {
+	tests := []struct {
+		name   string
+		rows   []string
+		sample int
+		sorted bool
+		want   string
+	}{
+		{name: "all rows", rows: []string{"c", "a", "b"}, want: "c a b"},
+		{name: "first rows as returned", rows: []string{"c", "a", "b"}, sample: 2, want: "c a"},
+		{name: "sorted before sampling", rows: []string{"c", "a", "b"}, sample: 2, sorted: true, want: "a b"},
+		{name: "sorted in another order, same sample", rows: []string{"b", "c", "a"}, sample: 2, sorted: true, want: "a b"},
+		{name: "sample over the rows", rows: []string{"b", "a"}, sample: 5, sorted: true, want: "a b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range sampleRows(snapshotRows(tt.rows...), tt.sample, tt.sorted) {
+				got = append(got, *r[0])
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("rows %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	want := snapshotFile{Columns: []snapshotColumn{{Name: "State", Type: "string"}}, Rows: snapshotRows("OHIO", "TEXAS")}
+	if d := diffSnapshots(want, want); len(d) != 0 {
+		t.Errorf("diff of the same snapshot: %v", d)
+	}
+	got := snapshotFile{Columns: want.Columns, Rows: snapshotRows("OHIO", "IOWA")}
+	if d := strings.Join(diffSnapshots(want, got), "\n"); !strings.Contains(d, `"TEXAS"`) || !strings.Contains(d, `"IOWA"`) {
+		t.Errorf("diff:\n%s", d)
+	}
+}
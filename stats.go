@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+// queryStats sums what the cluster reports about running the query: the QueryResourceConsumption
+// event of the QueryCompletionInformation table that ends every result. A run of several queries
+// (--clusters, --databases, --requery-column) adds them up, except the memory peak, which is the
+// largest.
+type queryStats struct {
+	queries        int
+	execTime       time.Duration
+	cpu            time.Duration
+	memoryPeak     int64
+	extentsScanned int64
+	extentsTotal   int64
+	rowsScanned    int64
+	cacheHits      int64 // bytes, or for older payloads hits
+	cacheMisses    int64
+}
+
+// resourceConsumption is the part of a QueryResourceConsumption payload that --stats reports.
+type resourceConsumption struct {
+	ExecutionTime float64 `json:"ExecutionTime"` // seconds
+	ResourceUsage struct {
+		Cache struct {
+			Memory cacheCounts `json:"memory"`
+			Disk   cacheCounts `json:"disk"`
+			Shards struct {
+				Hot  shardCacheBytes `json:"hot"`
+				Cold shardCacheBytes `json:"cold"`
+			} `json:"shards"`
+		} `json:"cache"`
+		CPU struct {
+			Total string `json:"total cpu"` // a timespan, e.g. 00:00:01.2500000
+		} `json:"cpu"`
+		Memory struct {
+			PeakPerNode int64 `json:"peak_per_node"`
+		} `json:"memory"`
+	} `json:"resource_usage"`
+	InputDatasetStatistics struct {
+		Extents struct {
+			Total   int64 `json:"total"`
+			Scanned int64 `json:"scanned"`
+		} `json:"extents"`
+		Rows struct {
+			Scanned int64 `json:"scanned"`
+		} `json:"rows"`
+	} `json:"input_dataset_statistics"`
+}
+
+type cacheCounts struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+type shardCacheBytes struct {
+	Hit  int64 `json:"hitbytes"`
+	Miss int64 `json:"missbytes"`
+}
+
+// add adds one QueryResourceConsumption payload.
+func (s *queryStats) add(payload string) error {
+	var rc resourceConsumption
+	if err := json.Unmarshal([]byte(payload), &rc); err != nil {
+		return err
+	}
+	s.queries++
+	s.execTime += time.Duration(rc.ExecutionTime * float64(time.Second))
+	s.cpu += kustoTimespan(rc.ResourceUsage.CPU.Total)
+	s.memoryPeak = max(s.memoryPeak, rc.ResourceUsage.Memory.PeakPerNode)
+	s.extentsScanned += rc.InputDatasetStatistics.Extents.Scanned
+	s.extentsTotal += rc.InputDatasetStatistics.Extents.Total
+	s.rowsScanned += rc.InputDatasetStatistics.Rows.Scanned
+	// The shard cache counts bytes; older clusters only report hits and misses of the memory and
+	// disk caches.
+	c := rc.ResourceUsage.Cache
+	if hits, misses := c.Shards.Hot.Hit+c.Shards.Cold.Hit, c.Shards.Hot.Miss+c.Shards.Cold.Miss; hits+misses > 0 {
+		s.cacheHits += hits
+		s.cacheMisses += misses
+	} else {
+		s.cacheHits += c.Memory.Hits + c.Disk.Hits
+		s.cacheMisses += c.Disk.Misses
+	}
+	return nil
+}
+
+// addTo puts the statistics into a run summary.
+func (s *queryStats) addTo(sum *runSummary) {
+	if s.queries == 0 {
+		sum.add("stats", "none")
+		return
+	}
+	if s.queries > 1 {
+		sum.add("stats_queries", s.queries)
+	}
+	sum.add("exec_time", s.execTime.Round(time.Millisecond))
+	sum.add("cpu", s.cpu.Round(time.Millisecond))
+	sum.add("memory_peak_bytes", s.memoryPeak)
+	sum.add("extents_scanned", fmt.Sprintf("%d/%d", s.extentsScanned, s.extentsTotal))
+	sum.add("rows_scanned", s.rowsScanned)
+	hit := "n/a"
+	if total := s.cacheHits + s.cacheMisses; total > 0 {
+		hit = strconv.FormatFloat(100*float64(s.cacheHits)/float64(total), 'f', 1, 64) + "%"
+	}
+	sum.add("cache_hit", hit)
+}
+
+// statsEncoder reads query statistics out of the QueryCompletionInformation tables on their way
+// to the wrapped Encoder, which still gets every table.
+type statsEncoder struct {
+	encode.Encoder
+	stats   queryStats
+	table   *encode.Table // the QueryCompletionInformation table being written
+	event   int           // its EventTypeName and Payload columns
+	payload int
+}
+
+func (s *statsEncoder) Begin(t *encode.Table) error {
+	s.table = nil
+	if t.Kind == "QueryCompletionInformation" {
+		s.event, s.payload = -1, -1
+		for i, c := range t.Columns {
+			switch c.Name() {
+			case "EventTypeName":
+				s.event = i
+			case "Payload":
+				s.payload = i
+			}
+		}
+		if s.event >= 0 && s.payload >= 0 {
+			s.table = t
+		}
+	}
+	return s.Encoder.Begin(t)
+}
+
+func (s *statsEncoder) WriteRow(t *encode.Table, index int, vals value.Values) error {
+	if t == s.table && s.event < len(vals) && s.payload < len(vals) {
+		event, _ := encode.PlainValue(vals[s.event]).(string)
+		payload, _ := encode.PlainValue(vals[s.payload]).(string)
+		if event == "QueryResourceConsumption" {
+			if err := s.stats.add(payload); err != nil {
+				fmt.Fprintf(os.Stderr, "WARN --stats: unreadable QueryResourceConsumption payload: %v\n", err)
+			}
+		}
+	}
+	return s.Encoder.WriteRow(t, index, vals)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestStatsEncoder(t *testing.T) {
+	var out strings.Builder
+	enc, _ := encode.New("ndjson", &out, encode.Options{})
+	s := &statsEncoder{Encoder: enc}
+	qci := &encode.Table{Name: "QueryCompletionInformation", Kind: "QueryCompletionInformation", Columns: []query.Column{
+		query.NewColumn(0, "EventTypeName", types.String), query.NewColumn(1, "Payload", types.String)}}
+	payload := func(exec, cpu string, peak, scanned, total, hit, miss int) string {
+		return fmt.Sprintf(`{"ExecutionTime":%s,"resource_usage":{"cache":{"shards":{"hot":{"hitbytes":%d,"missbytes":%d}}},`+
+			`"cpu":{"total cpu":%q},"memory":{"peak_per_node":%d}},"input_dataset_statistics":{"extents":{"total":%d,"scanned":%d},"rows":{"scanned":500}}}`,
+			exec, hit, miss, cpu, peak, total, scanned)
+	}
+	s.Begin(qci)
+	s.WriteRow(qci, 0, value.Values{value.NewString("QueryInfo"), value.NewString("not json")})
+	s.WriteRow(qci, 1, value.Values{value.NewString("QueryResourceConsumption"), value.NewString(payload("1.25", "00:00:02.5000000", 4096, 3, 10, 900, 100))})
+	s.WriteRow(qci, 2, value.Values{value.NewString("QueryResourceConsumption"), value.NewString(payload("0.25", "00:00:00.5", 1024, 1, 10, 100, 900))})
+	s.End()
+
+	var sum runSummary
+	s.stats.addTo(&sum)
+	want := "stats_queries=2 exec_time=1.5s cpu=3s memory_peak_bytes=4096 extents_scanned=4/20 rows_scanned=1000 cache_hit=50.0%"
+	if got := strings.Join(sum.fields, " "); got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+	if strings.Count(out.String(), "\n") != 3 {
+		t.Errorf("the statistics rows were not passed on:\n%s", out.String())
+	}
+
+	var none runSummary
+	(&queryStats{}).addTo(&none)
+	if strings.Join(none.fields, " ") != "stats=none" {
+		t.Errorf("no statistics: %q", none.fields)
+	}
+}
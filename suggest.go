@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/harche/kusto-example/pkg/classify"
+	"github.com/harche/kusto-example/pkg/probe"
+)
+
+// builtinSuggestions is the default remediation text printed after SUGGEST. Keys are
+// "<step>.<class>", "<class>" or "<step>", tried in that order: step is a probe step or "client"
+// (creating the Kusto client), class is a classify.Class or "sample-missing". Values are
+// text/template templates over suggestionData, and may call each other by key.
+var builtinSuggestions = map[string]string{
+	"client": `{{if .Problems}}Auth provider "{{.Auth}}": {{.Problems}}.` +
+		`{{else if ne .Auth "default"}}Check the credentials of auth provider "{{.Auth}}", or try --auth default.` +
+		`{{else}}Ensure Azure auth is available: run 'az login' or configure DefaultAzureCredential (AZURE_TENANT_ID, AZURE_CLIENT_ID/SECRET).{{end}}`,
+
+	probe.StepMgmt + ".network": "Verify KUSTO_CLUSTER endpoint is correct (https://<cluster>.<region>.kusto.windows.net) and reachable.",
+	probe.StepMgmt + ".auth":    `{{template "client" .}}`,
+	probe.StepMgmt:              "Check endpoint and authentication.",
+
+	probe.StepDatabase + ".database-not-found": "Database '{{.Database}}' not found. Verify KUSTO_DATABASE or create it (see kusto.sh).",
+	probe.StepDatabase + ".permission":         "You may lack database permissions. Ensure your identity has access (e.g., Admin/User role).",
+	probe.StepDatabase:                         "Verify KUSTO_DATABASE and your permissions.",
+
+	probe.StepDataSample + ".sample-missing":  "Initialize sample data via kusto.sh or verify ingestion.",
+	probe.StepDataSample + ".table-not-found": "Run kusto.sh probe or create to initialize the sample table.",
+	probe.StepDataSample + ".permission":      "Grant your identity read access to the database/table (e.g., Admin/User role).",
+	probe.StepDataSample:                      "Investigate query or connectivity issues for table '{{.Table}}'.",
+
+	probe.StepIngest + ".permission": "Grant your identity ingest rights on the database (e.g., Ingestor role), or drop --with-ingest.",
+	probe.StepIngest:                 "Check the ingest table's schema (Message:string, When:datetime) and the database's ingestion health.",
+}
+
+// suggestionData is what a suggestion template can refer to.
+type suggestionData struct {
+	Step     string
+	Class    string
+	Cluster  string
+	Database string
+	Table    string
+	Auth     string // --auth provider name
+	Problems string // the provider's configuration problems, "; "-separated
+	Code     string // service error code, e.g. General_BadRequest/SEM0100
+	Error    string
+}
+
+// suggestionCatalog is the built-in suggestions overlaid with a team's own from the JSON file
+// named by KUSTO_SUGGESTIONS, e.g. {"auth": "See https://wiki.example.com/kusto-access"}, so
+// remediation text can point at internal runbooks or be translated without forking the code.
+// The team's entries win over built-in ones, so a "permission" entry applies to every step; within
+// each, the most specific key wins. An entry set to "" prints no suggestion.
+type suggestionCatalog struct {
+	text   map[string]string
+	custom map[string]bool
+	t      *template.Template
+}
+
+// suggestions is the catalog used by probe and probe-load, set up by main.
+var suggestions, _ = newSuggestionCatalog(nil)
+
+func newSuggestionCatalog(overrides map[string]string) (*suggestionCatalog, error) {
+	c := &suggestionCatalog{text: map[string]string{}, custom: map[string]bool{}, t: template.New("")}
+	for k, v := range builtinSuggestions {
+		c.text[k] = v
+	}
+	for k, v := range overrides {
+		c.text[k], c.custom[k] = v, true
+	}
+	for k, v := range c.text {
+		if _, err := c.t.New(k).Parse(v); err != nil {
+			return nil, fmt.Errorf("suggestion %q: %v", k, err)
+		}
+	}
+	for k := range c.text {
+		if err := c.t.ExecuteTemplate(io.Discard, k, suggestionData{}); err != nil {
+			return nil, fmt.Errorf("suggestion %q: %v", k, err)
+		}
+	}
+	return c, nil
+}
+
+// loadSuggestions reads the KUSTO_SUGGESTIONS file, if one is set.
+func loadSuggestions(path string) (*suggestionCatalog, error) {
+	if path == "" {
+		return newSuggestionCatalog(nil)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	c, err := newSuggestionCatalog(overrides)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// suggest renders the most specific entry for step and err's class, or "" if there is none.
+func (c *suggestionCatalog) suggest(step string, err error, d suggestionData) string {
+	d.Step, d.Class = step, errorClass(err)
+	if err != nil {
+		d.Error, d.Code = err.Error(), classify.Code(err)
+	}
+	d.Auth = currentAuth.Name()
+	d.Problems = strings.Join(currentAuth.Diagnose(), "; ")
+	keys := []string{step + "." + d.Class, d.Class, step}
+	for _, custom := range []bool{true, false} {
+		for _, k := range keys {
+			if _, ok := c.text[k]; !ok || c.custom[k] != custom {
+				continue
+			}
+			var b strings.Builder
+			if err := c.t.ExecuteTemplate(&b, k, d); err != nil {
+				return fmt.Sprintf("(suggestion %q failed: %v)", k, err)
+			}
+			return strings.TrimSpace(b.String())
+		}
+	}
+	return ""
+}
+
+// errorClass is err's classify.Class, or "sample-missing" when the probe's sample row is absent.
+func errorClass(err error) string {
+	if errors.Is(err, probe.ErrSampleMissing) {
+		return "sample-missing"
+	}
+	return string(classify.Of(err))
+}
+
+// print writes the catalog as a KUSTO_SUGGESTIONS file, to start a customized one from.
+func (c *suggestionCatalog) print(w io.Writer) {
+	keys := make([]string, 0, len(c.text))
+	for k := range c.text {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "{")
+	for i, k := range keys {
+		sep := ","
+		if i == len(keys)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(w, "  %s: %s%s\n", jsonText(k), jsonText(c.text[k]), sep)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// jsonText is s as a JSON string, with <, > and & left as they are.
+func jsonText(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/harche/kusto-example/pkg/probe"
+)
+
+func TestSuggestionCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suggestions.json")
+	os.WriteFile(path, []byte(`{
+  "permission": "Request access for {{.Database}} at https://iam.example.com ({{.Step}}).",
+  "data-sample.sample-missing": "",
+  "throttled": "Cluster {{.Cluster}} is busy; retry later."
+}`), 0o644)
+	c, err := loadSuggestions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := suggestionData{Cluster: "https://c.kusto.windows.net", Database: "Logs", Table: "ProbeTest"}
+	denied := errors.New("403 Forbidden")
+	for _, tc := range []struct {
+		step string
+		err  error
+		want string
+	}{
+		// The team's class-wide entry wins over the built-in step entries.
+		{probe.StepDatabase, denied, "Request access for Logs at https://iam.example.com (database)."},
+		{probe.StepDataSample, denied, "Request access for Logs at https://iam.example.com (data-sample)."},
+		// Built-in entries still cover what the file doesn't.
+		{probe.StepDatabase, errors.New("database 'Logs' not found"), "Database 'Logs' not found. Verify KUSTO_DATABASE or create it (see kusto.sh)."},
+		{probe.StepDataSample, errors.New("boom"), "Investigate query or connectivity issues for table 'ProbeTest'."},
+		// An empty entry silences the suggestion.
+		{probe.StepDataSample, fmt.Errorf("wrapped: %w", probe.ErrSampleMissing), ""},
+		{probe.StepMgmt, errors.New("429 too many requests"), "Cluster https://c.kusto.windows.net is busy; retry later."},
+	} {
+		if got := c.suggest(tc.step, tc.err, d); got != tc.want {
+			t.Errorf("%s/%v: got %q, want %q", tc.step, tc.err, got, tc.want)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"auth": "{{.NoSuchField}}"}`), 0o644)
+	if _, err := loadSuggestions(path); err == nil {
+		t.Error("a template referring to an unknown field was accepted")
+	}
+}
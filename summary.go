@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// runSummary collects facts about a query run (row counts, hashes, ...) and prints them as a
+// single "SUMMARY k=v ..." line on stderr, keeping stdout free for result rows.
+type runSummary struct {
+	fields []string
+}
+
+func (s *runSummary) add(key string, v interface{}) {
+	s.fields = append(s.fields, fmt.Sprintf("%s=%v", key, v))
+}
+
+func (s *runSummary) print(w io.Writer) {
+	if len(s.fields) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "SUMMARY %s\n", strings.Join(s.fields, " "))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/kqlquote"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// tailMarkColumn is the column tail adds to every query for the time it tracks, and drops from
+// the rows it writes.
+const tailMarkColumn = "_tail_mark"
+
+// tailOutputError is an error writing tail's output, which ends the tail, where errors of the
+// query only skip a poll.
+type tailOutputError struct{ err error }
+
+func (e tailOutputError) Error() string { return e.err.Error() }
+func (e tailOutputError) Unwrap() error { return e.err }
+
+// tailer follows an append-only table like tail -f: each poll asks for the rows whose time
+// (ingestion_time(), or a datetime column) is at or past the latest one written, in time order.
+// Rows at exactly that time were written by an earlier poll, unless they are new; tailer keeps
+// hashes of them to tell.
+type tailer struct {
+	table    string
+	where    string
+	column   string // "" for ingestion_time()
+	database string
+	maxRows  int
+	interval time.Duration
+	timeouts timeoutConfig
+	enc      encode.Encoder
+	run      func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error
+	hb       *heartbeat
+
+	mark   time.Time       // the latest time written
+	atMark map[string]bool // hashes of the rows written with time mark; nil when all of them were
+	rows   int64
+}
+
+// source is the table with the filter and the tracked time as tailMarkColumn.
+func (t *tailer) source() string {
+	q := kqlquote.Ident(t.table)
+	if t.where != "" {
+		q += "\n| where " + t.where
+	}
+	mark := "ingestion_time()"
+	if t.column != "" {
+		mark = kqlquote.Ident(t.column)
+	}
+	return q + "\n| extend " + tailMarkColumn + " = " + mark
+}
+
+// startQuery finds where a tail with no look-back starts: the latest time in the table.
+func (t *tailer) startQuery() string {
+	return t.source() + "\n| summarize " + tailMarkColumn + " = max(" + tailMarkColumn + ")"
+}
+
+// pollQuery asks for the rows from mark on, or past it when every row at mark is old, or with a
+// look-back, from that long ago.
+func (t *tailer) pollQuery(lookback time.Duration) string {
+	op := ">="
+	if t.atMark == nil {
+		op = ">"
+	}
+	filter := fmt.Sprintf("%s %s datetime(%s)", tailMarkColumn, op, t.mark.UTC().Format(time.RFC3339Nano))
+	if lookback > 0 {
+		filter = fmt.Sprintf("%s > ago(%s)", tailMarkColumn, timespanText(lookback))
+	}
+	return fmt.Sprintf("%s\n| where %s\n| order by %s asc\n| take %d", t.source(), filter, tailMarkColumn, t.maxRows+len(t.atMark))
+}
+
+// start sets mark to the latest time in the table, so the first poll returns only newer rows.
+// Rows at that time are old too.
+func (t *tailer) start(ctx context.Context) error {
+	c := &tailStart{}
+	if err := t.run(ctx, t.database, (&kql.Builder{}).AddUnsafe(t.startQuery()), encode.PrimaryOnly{Encoder: c}); err != nil {
+		return err
+	}
+	t.mark, t.atMark = c.mark, nil
+	return nil
+}
+
+// tailStart reads the result of startQuery.
+type tailStart struct{ mark time.Time }
+
+func (s *tailStart) Begin(*encode.Table) error { return nil }
+func (s *tailStart) End() error                { return nil }
+
+func (s *tailStart) WriteRow(_ *encode.Table, _ int, vals value.Values) error {
+	if len(vals) > 0 {
+		s.mark, _ = encode.PlainValue(vals[0]).(time.Time)
+	}
+	return nil
+}
+
+// poll writes the rows since the last poll and reports whether it hit --max-rows, so the next
+// poll should follow at once.
+func (t *tailer) poll(ctx context.Context, lookback time.Duration) (bool, error) {
+	w := &tailWriter{t: t, prevMark: t.mark}
+	if err := t.run(ctx, t.database, (&kql.Builder{}).AddUnsafe(t.pollQuery(lookback)), encode.PrimaryOnly{Encoder: w}); err != nil {
+		return false, err
+	}
+	full := w.written >= t.maxRows
+	if full && !t.mark.After(w.prevMark) && lookback == 0 {
+		return false, fmt.Errorf("more than --max-rows (%d) rows have the time %s; raise --max-rows", t.maxRows, t.mark.UTC().Format(time.RFC3339Nano))
+	}
+	return full, nil
+}
+
+// tailWriter writes a poll's rows without tailMarkColumn, skipping the ones written before, and
+// moves the tailer's mark along.
+type tailWriter struct {
+	t        *tailer
+	prevMark time.Time
+	out      *encode.Table
+	col      int
+	written  int
+}
+
+func (w *tailWriter) Begin(tbl *encode.Table) error {
+	w.col = -1
+	for i, c := range tbl.Columns {
+		if c.Name() == tailMarkColumn {
+			w.col = i
+		}
+	}
+	if w.col < 0 {
+		return fmt.Errorf("the result has no %s column", tailMarkColumn)
+	}
+	cols := append(append(tbl.Columns[:0:0], tbl.Columns[:w.col]...), tbl.Columns[w.col+1:]...)
+	w.out = &encode.Table{Name: tbl.Name, Kind: tbl.Kind, Columns: cols}
+	if err := w.t.enc.Begin(w.out); err != nil {
+		return tailOutputError{err}
+	}
+	return nil
+}
+
+func (w *tailWriter) WriteRow(_ *encode.Table, _ int, vals value.Values) error {
+	t := w.t
+	mark, ok := encode.PlainValue(vals[w.col]).(time.Time)
+	if !ok {
+		return nil
+	}
+	row := append(append(vals[:0:0], vals[:w.col]...), vals[w.col+1:]...)
+	h := tailRowHash(row)
+	if mark.Equal(w.prevMark) && t.atMark[h] {
+		return nil
+	}
+	if err := t.enc.WriteRow(w.out, int(t.rows), row); err != nil {
+		return tailOutputError{err}
+	}
+	t.rows++
+	w.written++
+	if mark.After(t.mark) || t.atMark == nil {
+		t.mark, t.atMark = mark, map[string]bool{}
+	}
+	if mark.Equal(t.mark) {
+		t.atMark[h] = true
+	}
+	return nil
+}
+
+func (w *tailWriter) End() error {
+	if err := w.t.enc.End(); err != nil {
+		return tailOutputError{err}
+	}
+	return nil
+}
+
+// tailRowHash identifies a row among those with the same time.
+func tailRowHash(vals value.Values) string {
+	plain := make([]interface{}, len(vals))
+	for i, v := range vals {
+		plain[i] = encode.PlainValue(v)
+	}
+	b, _ := json.Marshal(plain)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// follow polls until ctx is done. A failed poll is reported and retried at the next interval;
+// only failing to write the output ends it.
+func (t *tailer) follow(ctx context.Context, lookback time.Duration) error {
+	started := lookback > 0
+	for {
+		callCtx, cancel := t.timeouts.callContext(ctx, callQuery)
+		var full bool
+		var err error
+		if !started {
+			if err = t.start(callCtx); err == nil {
+				started = true
+			}
+		} else {
+			before := t.rows
+			full, err = t.poll(callCtx, lookback)
+			if err == nil {
+				lookback = 0
+				t.hb.beat(fmt.Sprintf("tail: %d rows", t.rows-before))
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if errors.As(err, new(tailOutputError)) {
+				return err
+			}
+			t.hb.moved()
+			fmt.Fprintf(os.Stderr, "WARN tail %s: %s\n", t.table, errText(err))
+		}
+		wait := t.interval
+		if full {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// lead follows the table while this replica holds the lease on blob name in c, until ctx is
+// done. While another replica holds it, lead stands by, trying for it every retry. A replica
+// that takes over starts as a new tail does: from the latest time, or lookback ago.
+func (t *tailer) lead(ctx context.Context, c *scratchContainer, name string, retry, lookback time.Duration) error {
+	standing := false
+	for {
+		lease, leaderCtx, err := acquireLease(ctx, c, name)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, errLeaseHeld):
+			if !standing {
+				fmt.Fprintf(os.Stderr, "TAIL %s: standing by, another replica holds %s\n", t.table, c.blobURL(name))
+				standing = true
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retry):
+			}
+			continue
+		case err != nil:
+			return fmt.Errorf("--lease: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "TAIL %s: leading, holding %s\n", t.table, c.blobURL(name))
+		standing = false
+		err = t.follow(leaderCtx, lookback)
+		lease.release(context.Background())
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "TAIL %s: lost the lease after %d rows; standing by\n", t.table, t.rows)
+	}
+}
+
+// runTail implements "tail <table> [cluster]": new rows of the table written as NDJSON as they
+// are ingested, until interrupted.
+func runTail(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database of the table")
+	column := fs.String("column", "", "datetime column to follow instead of ingestion_time()")
+	where := fs.String("where", "", "only rows matching this KQL predicate, e.g. \"Level == 'Error'\"")
+	interval := fs.Duration("interval", 5*time.Second, "time between polls")
+	lookback := fs.Duration("lookback", 0, "start with the rows of this long ago instead of only new ones, like tail's last lines")
+	maxRows := fs.Int("max-rows", 100000, "most rows a poll returns; a full poll is followed by the next at once")
+	format := fs.String("format", "ndjson", "ndjson|ndjson-typed")
+	leaseContainer := fs.String("lease", os.Getenv("KUSTO_LEASE_CONTAINER"), "take a blob lease in this container first (https://<account>.blob.core.windows.net/<container>[/<prefix>]), so of several replicas only one tails the table and another takes over when it stops")
+	pos := parseArgs(fs, args)
+	if len(pos) == 0 {
+		log.Fatalf("usage: tail <table> [--column <datetime column>] [--where <predicate>] [--interval 5s] [--lookback 10m] [cluster-name]")
+	}
+	table, cluster := pos[0], resolveClusterURL(firstArg(pos[1:]))
+	switch {
+	case *interval < time.Second:
+		log.Fatalf("tail: --interval must be at least 1s")
+	case *maxRows < 1:
+		log.Fatalf("tail: --max-rows must be at least 1")
+	case *lookback < 0:
+		log.Fatalf("tail: --lookback can't be negative")
+	case *format != "ndjson" && *format != "ndjson-typed":
+		log.Fatalf("tail: --format must be ndjson or ndjson-typed")
+	}
+	enc, err := encode.New(*format, os.Stdout, encode.Options{})
+	if err != nil {
+		log.Fatalf("tail: %v", err)
+	}
+	var lc *scratchContainer
+	if *leaseContainer != "" {
+		if lc, err = newBlobContainer("--lease", *leaseContainer); err != nil {
+			log.Fatalf("tail: %v", err)
+		}
+	}
+
+	startTokenRefresh(context.Background())
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	globalRequest.checkServerTimeout(timeouts, callQuery)
+	t := &tailer{table: table, where: *where, column: *column, database: *database, maxRows: *maxRows, interval: *interval,
+		timeouts: timeouts, enc: enc, hb: startHeartbeat("tail")}
+	t.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		id, opts := globalRequest.callOptions("tail")
+		_, err := stream.Query(ctx, client, database, q, enc, opts...)
+		return withRequestID(err, id)
+	}
+	followed := "ingestion_time()"
+	if *column != "" {
+		followed = *column
+	}
+	fmt.Fprintf(os.Stderr, "TAIL %s.%s by %s, every %s\n", *database, table, followed, *interval)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if lc == nil {
+		err = t.follow(ctx, *lookback)
+	} else {
+		// Replicas tailing the same table elect a leader; the others stand by.
+		blob := "leases/tail-" + *database + "." + table
+		if lc.prefix != "" {
+			blob = lc.prefix + "/" + blob
+		}
+		err = t.lead(ctx, lc, blob, leaseDuration/3, *lookback)
+	}
+	if err != nil {
+		t.hb.stop("failed")
+		log.Fatalf("tail: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "TAIL %s: interrupted after %d rows\n", t.table, t.rows)
+	t.hb.stop("done")
+}
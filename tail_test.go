@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestTailer(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	type row struct {
+		at  time.Time
+		msg string
+	}
+	var table []row
+	ingest := func(sec int, msgs ...string) {
+		for _, m := range msgs {
+			table = append(table, row{base.Add(time.Duration(sec) * time.Second), m})
+		}
+	}
+	ingest(0, "old")
+
+	// The fake cluster answers startQuery and pollQuery over table.
+	run := func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		text := q.String()
+		if strings.Contains(text, "summarize") {
+			tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{query.NewColumn(0, tailMarkColumn, types.DateTime)}}
+			enc.Begin(tbl)
+			var last time.Time
+			for _, r := range table {
+				if r.at.After(last) {
+					last = r.at
+				}
+			}
+			enc.WriteRow(tbl, 0, value.Values{value.NewDateTime(last)})
+			return enc.End()
+		}
+		var since string
+		var take int
+		if _, err := fmt.Sscanf(text[strings.Index(text, "datetime("):], "datetime(%29s", &since); err != nil {
+			return err
+		}
+		fmt.Sscanf(text[strings.Index(text, "| take "):], "| take %d", &take)
+		from, err := time.Parse(time.RFC3339Nano, strings.TrimSuffix(since, ")"))
+		if err != nil {
+			return err
+		}
+		strict := strings.Contains(text, tailMarkColumn+" > datetime(")
+		var rows []row
+		for _, r := range table {
+			if r.at.After(from) || (!strict && r.at.Equal(from)) {
+				rows = append(rows, r)
+			}
+		}
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].at.Before(rows[j].at) })
+		if len(rows) > take {
+			rows = rows[:take]
+		}
+		tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+			query.NewColumn(0, "Message", types.String), query.NewColumn(1, tailMarkColumn, types.DateTime)}}
+		if err := enc.Begin(tbl); err != nil {
+			return err
+		}
+		for i, r := range rows {
+			if err := enc.WriteRow(tbl, i, value.Values{value.NewString(r.msg), value.NewDateTime(r.at)}); err != nil {
+				return err
+			}
+		}
+		return enc.End()
+	}
+
+	var out strings.Builder
+	enc, _ := encode.New("ndjson", &out, encode.Options{})
+	tl := &tailer{table: "Logs", database: "db", maxRows: 2, enc: enc, run: run}
+	if err := tl.start(context.Background()); err != nil || !tl.mark.Equal(base) {
+		t.Fatalf("start: %v at %s", err, tl.mark)
+	}
+	poll := func() bool {
+		t.Helper()
+		full, err := tl.poll(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return full
+	}
+	messages := func() string {
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if line != "" {
+				got = append(got, line[strings.Index(line, `"Message":"`)+11:][:2])
+			}
+		}
+		out.Reset()
+		return strings.Join(got, " ")
+	}
+
+	// Rows at the mark that were already written aren't written again.
+	ingest(0, "m0") // at the start, so old
+	ingest(1, "m1")
+	ingest(5, "m2")
+	if full := poll(); !full || messages() != "m1 m2" {
+		t.Errorf("first poll: full %v", full)
+	}
+	ingest(5, "m3")
+	ingest(9, "m4")
+	if full := poll(); !full || messages() != "m3 m4" {
+		t.Errorf("second poll: full %v", full)
+	}
+	if full := poll(); full || messages() != "" {
+		t.Errorf("third poll: full %v", full)
+	}
+	if !strings.Contains(tl.pollQuery(0), "extend _tail_mark = ingestion_time()\n| where _tail_mark >= datetime(2024-03-01T12:00:09Z)") {
+		t.Errorf("poll query: %s", tl.pollQuery(0))
+	}
+
+	// A whole poll of rows at one time can't move on.
+	ingest(9, "m5", "m6", "m7")
+	if _, err := tl.poll(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "--max-rows") {
+		t.Errorf("stuck poll: %v", err)
+	}
+
+	// Output errors are told apart from query errors.
+	tl.enc = failingEncoder{}
+	ingest(20, "m8")
+	if _, err := tl.poll(context.Background(), 0); !errors.As(err, new(tailOutputError)) {
+		t.Errorf("output error: %v", err)
+	}
+}
+
+func TestTailLease(t *testing.T) {
+	svc := &fakeLeaseService{blobs: map[string]string{}}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	c := &scratchContainer{base: srv.URL, account: "acct", container: "locks", key: []byte("secret"), client: srv.Client()}
+
+	// Two replicas of the same tail, counting the queries each runs.
+	var mu sync.Mutex
+	queries := map[string]int{}
+	replica := func(name string) *tailer {
+		enc, _ := encode.New("ndjson", io.Discard, encode.Options{})
+		return &tailer{table: "Logs", database: "db", maxRows: 10, interval: 10 * time.Millisecond, timeouts: timeoutConfig{def: time.Minute}, enc: enc,
+			run: func(ctx context.Context, _ string, _ *kql.Builder, enc encode.Encoder) error {
+				mu.Lock()
+				queries[name]++
+				mu.Unlock()
+				return enc.End()
+			}}
+	}
+	count := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[name]
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting until %s", what)
+			}
+		}
+	}
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	doneA := make(chan error, 1)
+	go func() { doneA <- replica("a").lead(ctxA, c, "leases/tail-db.Logs", 10*time.Millisecond, 0) }()
+	waitFor("a leads", func() bool { return count("a") > 0 })
+	ctxB, stopB := context.WithCancel(context.Background())
+	doneB := make(chan error, 1)
+	go func() { doneB <- replica("b").lead(ctxB, c, "leases/tail-db.Logs", 10*time.Millisecond, 0) }()
+
+	// b stands by while a tails, and takes over once a stops and gives the lease up.
+	time.Sleep(50 * time.Millisecond)
+	if n := count("b"); n != 0 {
+		t.Errorf("the standby ran %d queries", n)
+	}
+	stopA()
+	if err := <-doneA; err != nil {
+		t.Errorf("a: %v", err)
+	}
+	waitFor("b takes over", func() bool { return count("b") > 0 })
+	stopB()
+	if err := <-doneB; err != nil {
+		t.Errorf("b: %v", err)
+	}
+	if svc.leases != 2 || svc.blobs["/locks/leases/tail-db.Logs"] != "" {
+		t.Errorf("%d leases taken, blobs %v", svc.leases, svc.blobs)
+	}
+}
+
+type failingEncoder struct{}
+
+func (failingEncoder) Begin(*encode.Table) error { return nil }
+func (failingEncoder) WriteRow(*encode.Table, int, value.Values) error {
+	return errors.New("broken pipe")
+}
+func (failingEncoder) End() error { return nil }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/harche/kusto-example/pkg/kqlquote"
+)
+
+// queryVars holds the --var values a query template is rendered with.
+type queryVars map[string]string
+
+func (v queryVars) String() string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + v[name]
+	}
+	return strings.Join(names, ",")
+}
+
+func (v queryVars) Set(s string) error {
+	name, val, ok := strings.Cut(s, "=")
+	if name = strings.TrimSpace(name); !ok || name == "" {
+		return fmt.Errorf("want name=value, got %q", s)
+	}
+	v[name] = val
+	return nil
+}
+
+// templateFuncs quote values for the places they go in the query: {{quote .state}} as a string
+// literal, {{ident .table}} as a table or column name. A bare {{.x}} is pasted in as typed.
+var templateFuncs = template.FuncMap{
+	"quote": kqlquote.String,
+	"ident": kqlquote.Ident,
+}
+
+// renderQueryTemplate renders a query file written as a text/template with vars. Every variable
+// the template refers to must be supplied: they are all checked before rendering, so one run
+// reports every missing --var. Variables supplied but not referenced are returned as unused.
+func renderQueryTemplate(name, text string, vars queryVars) (query string, unused []string, err error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", nil, err
+	}
+	used := templateVars(t)
+	var missing []string
+	for _, v := range used {
+		if _, ok := vars[v]; !ok {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		return "", nil, fmt.Errorf("%s: missing --var %s", name, strings.Join(missing, ", --var "))
+	}
+	for v := range vars {
+		if i := sort.SearchStrings(used, v); i == len(used) || used[i] != v {
+			unused = append(unused, v)
+		}
+	}
+	sort.Strings(unused)
+	var b strings.Builder
+	if err := t.Execute(&b, map[string]string(vars)); err != nil {
+		return "", nil, err
+	}
+	return b.String(), unused, nil
+}
+
+// templateVars returns the sorted names of the variables the templates in t refer to, as .name or
+// $.name. Inside range and with blocks dot is something else, so only $.name counts there.
+func templateVars(t *template.Template) []string {
+	seen := map[string]bool{}
+	var walk func(n parse.Node, rootDot bool)
+	walk = func(n parse.Node, rootDot bool) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, c := range n.Nodes {
+					walk(c, rootDot)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, rootDot)
+		case *parse.TemplateNode:
+			walk(n.Pipe, rootDot)
+		case *parse.IfNode:
+			walk(n.Pipe, rootDot)
+			walk(n.List, rootDot)
+			walk(n.ElseList, rootDot)
+		case *parse.RangeNode:
+			walk(n.Pipe, rootDot)
+			walk(n.List, false)
+			walk(n.ElseList, rootDot)
+		case *parse.WithNode:
+			walk(n.Pipe, rootDot)
+			walk(n.List, false)
+			walk(n.ElseList, rootDot)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, c := range n.Cmds {
+					walk(c, rootDot)
+				}
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				walk(a, rootDot)
+			}
+		case *parse.ChainNode:
+			walk(n.Node, rootDot)
+		case *parse.FieldNode:
+			if rootDot {
+				seen[n.Ident[0]] = true
+			}
+		case *parse.VariableNode:
+			if len(n.Ident) > 1 && n.Ident[0] == "$" {
+				seen[n.Ident[1]] = true
+			}
+		}
+	}
+	for _, tt := range t.Templates() {
+		if tt.Tree != nil {
+			walk(tt.Tree.Root, true)
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
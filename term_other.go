@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// makeRaw is not supported here; the line editor falls back to reading whole lines.
+func makeRaw(fd uintptr) (restore func(), err error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
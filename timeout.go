@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Call kinds used for per-call timeout overrides.
+const (
+	callQuery  = "query"
+	callMgmt   = "mgmt"
+	callIngest = "ingest"
+)
+
+// timeoutFlags holds the --timeout/--call-timeout values of one flag set (global or subcommand).
+type timeoutFlags struct {
+	timeout time.Duration
+	calls   callTimeouts
+}
+
+func registerTimeoutFlags(fs *flag.FlagSet) *timeoutFlags {
+	tf := &timeoutFlags{calls: callTimeouts{}}
+	fs.DurationVar(&tf.timeout, "timeout", 0, "timeout for each Kusto call (e.g. 30s, 5m)")
+	fs.Var(tf.calls, "call-timeout", "per-call override as kind=duration, kind one of query|mgmt|ingest (repeatable, comma-separated)")
+	return tf
+}
+
+// callTimeouts implements flag.Value for "query=1m,mgmt=30s".
+type callTimeouts map[string]time.Duration
+
+func (c callTimeouts) String() string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, c[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c callTimeouts) Set(s string) error {
+	for _, p := range splitCSV(s) {
+		kind, v, ok := strings.Cut(p, "=")
+		if !ok {
+			return fmt.Errorf("expected kind=duration, got %q", p)
+		}
+		kind = strings.TrimSpace(kind)
+		switch kind {
+		case callQuery, callMgmt, callIngest:
+		default:
+			return fmt.Errorf("unknown call kind %q (want query, mgmt or ingest)", kind)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %v", kind, err)
+		}
+		c[kind] = d
+	}
+	return nil
+}
+
+// timeoutConfig resolves the timeout of a single query, mgmt or ingest call.
+// Precedence, highest first:
+//  1. per-call override (--call-timeout kind=d, subcommand over global, then KUSTO_CALL_TIMEOUTS)
+//  2. subcommand --timeout
+//  3. global --timeout (before the subcommand), then KUSTO_TIMEOUT
+//  4. built-in default of the subcommand
+type timeoutConfig struct {
+	def   time.Duration
+	calls callTimeouts
+}
+
+func resolveTimeouts(global, sub *timeoutFlags, builtin time.Duration) timeoutConfig {
+	cfg := timeoutConfig{def: builtin, calls: callTimeouts{}}
+	if d := getDurationEnv("KUSTO_TIMEOUT", 0); d > 0 {
+		cfg.def = d
+	}
+	if global != nil && global.timeout > 0 {
+		cfg.def = global.timeout
+	}
+	if sub != nil && sub.timeout > 0 {
+		cfg.def = sub.timeout
+	}
+	if v := strings.TrimSpace(os.Getenv("KUSTO_CALL_TIMEOUTS")); v != "" {
+		if err := cfg.calls.Set(v); err != nil {
+			fmt.Fprintf(os.Stderr, "ignoring KUSTO_CALL_TIMEOUTS: %v\n", err)
+		}
+	}
+	for _, tf := range []*timeoutFlags{global, sub} {
+		if tf == nil {
+			continue
+		}
+		for k, d := range tf.calls {
+			cfg.calls[k] = d
+		}
+	}
+	return cfg
+}
+
+func (t timeoutConfig) forCall(kind string) time.Duration {
+	if d, ok := t.calls[kind]; ok && d > 0 {
+		return d
+	}
+	return t.def
+}
+
+// callContext returns a context bounded by the timeout for the given call kind.
+func (t timeoutConfig) callContext(parent context.Context, kind string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, t.forCall(kind))
+}
+
+// parseArgs parses fs from args, allowing flags after positional arguments
+// (e.g. "probe mycluster --timeout 5s"), and returns the positionals in order.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var pos []string
+	for {
+		_ = fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return pos
+		}
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(pos, rest...)
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpTransfer is the HTTP side of every Kusto client of the run: it negotiates response
+// compression and counts what the responses cost, on the wire and decompressed, so a user on a
+// slow link can check that the cluster's frames arrive compressed.
+type httpTransfer struct {
+	compress bool         // ask for gzip/deflate responses, as the SDK does; off sends identity
+	limit    *rateLimiter // --max-bandwidth on the response bytes, nil for none
+
+	wire, decoded atomic.Int64
+
+	mu        sync.Mutex
+	encodings map[string]int // responses by Content-Encoding, "identity" for none
+}
+
+// transfer is set up from --compress and --max-bandwidth; newClient gives every client its transport.
+var transfer = &httpTransfer{compress: true}
+
+// client returns the HTTP client for the SDK. Like the SDK's own, it doesn't follow redirects.
+func (t *httpTransfer) client() *http.Client {
+	return &http.Client{
+		Transport: &transferTransport{base: http.DefaultTransport, t: t},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// addTo puts the transfer facts into a run summary: the response encodings seen, with their
+// counts, and the bytes received before and after decompression.
+func (t *httpTransfer) addTo(s *runSummary) {
+	t.mu.Lock()
+	encs := make([]string, 0, len(t.encodings))
+	for e, n := range t.encodings {
+		encs = append(encs, fmt.Sprintf("%s:%d", e, n))
+	}
+	t.mu.Unlock()
+	sort.Strings(encs)
+	if len(encs) == 0 {
+		encs = []string{"none"}
+	}
+	compression := "on"
+	if !t.compress {
+		compression = "off"
+	}
+	s.add("compression", compression)
+	s.add("response_encoding", strings.Join(encs, ","))
+	s.add("wire_bytes", t.wire.Load())
+	s.add("decoded_bytes", t.decoded.Load())
+}
+
+// transferTransport decompresses responses itself instead of leaving it to the SDK, so both
+// sides of the decompression can be counted. The SDK then sees an identity response.
+type transferTransport struct {
+	base http.RoundTripper
+	t    *httpTransfer
+}
+
+func (tt *transferTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !tt.t.compress {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	resp, err := tt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	tt.t.mu.Lock()
+	if tt.t.encodings == nil {
+		tt.t.encodings = map[string]int{}
+	}
+	if enc == "" {
+		tt.t.encodings["identity"]++
+	} else {
+		tt.t.encodings[enc]++
+	}
+	tt.t.mu.Unlock()
+
+	body := &transferBody{wire: countingReader{r: resp.Body, n: &tt.t.wire, limit: tt.t.limit}, closer: resp.Body}
+	switch enc {
+	case "gzip", "deflate":
+		body.encoding, body.decoded = enc, &tt.t.decoded
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	case "":
+		body.decoded = &tt.t.decoded
+	}
+	// Other encodings are left to the SDK to refuse; only their wire bytes are counted.
+	resp.Body = body
+	return resp, nil
+}
+
+// transferBody is a response body read through the byte counters, decompressing gzip and
+// deflate. The decompressor is created on the first read, so empty bodies need no header.
+type transferBody struct {
+	wire     countingReader
+	closer   io.Closer
+	encoding string        // "" to pass the body through
+	decoded  *atomic.Int64 // nil for encodings left to the SDK
+	r        io.Reader
+}
+
+func (b *transferBody) Read(p []byte) (int, error) {
+	if b.r == nil {
+		switch b.encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(&b.wire)
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, fmt.Errorf("gzip response: %w", err)
+			}
+			b.r = gz
+		case "deflate":
+			b.r = flate.NewReader(&b.wire)
+		default:
+			b.r = &b.wire
+		}
+	}
+	n, err := b.r.Read(p)
+	if b.decoded != nil {
+		b.decoded.Add(int64(n))
+	}
+	return n, err
+}
+
+func (b *transferBody) Close() error { return b.closer.Close() }
+
+// countingReader adds the bytes read from r to n, at the pace limit allows if it is set.
+type countingReader struct {
+	r     io.Reader
+	n     *atomic.Int64
+	limit *rateLimiter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.limit != nil {
+		p = p[:c.limit.chunk(len(p))]
+	}
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	if c.limit != nil {
+		c.limit.wait(n)
+	}
+	return n, err
+}
+
+// rateLimiter paces reads to rate bytes per second on average, shared by all the responses of
+// the run. A reader that stops reading leaves the data in the socket buffers, and TCP flow
+// control slows the cluster down in turn, so the link itself carries no more than the rate.
+type rateLimiter struct {
+	rate float64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time // when the bytes read so far are paid for
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSecond)}
+}
+
+// chunk bounds a read to a tenth of a second's worth of bytes, so the pace stays even.
+func (l *rateLimiter) chunk(n int) int {
+	max := int(l.rate / 10)
+	if max < 512 {
+		max = 512
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// wait accounts for n bytes read and sleeps until they fit the rate. Time spent not reading
+// isn't saved up, so an idle period doesn't allow a burst afterwards.
+func (l *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// byteSize implements flag.Value for byte counts such as --rotate-size and --max-bandwidth (per
+// second): a number with an optional K, M or G suffix (powers of 1024) and B, as in 512K, 10MB
+// or 1.5G. A rate may end in /s. 0 means no limit.
+type byteSize int64
+
+func (r byteSize) String() string {
+	return strconv.FormatInt(int64(r), 10)
+}
+
+func (r *byteSize) Set(s string) error {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "/S")
+	v = strings.TrimSuffix(v, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("want a byte count such as 512K, 10M or 1G, got %q", s)
+	}
+	*r = byteSize(n * float64(mult))
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPTransfer(t *testing.T) {
+	payload := strings.Repeat(`{"FrameType":"DataTable"}`, 200)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") == "identity" {
+			io.WriteString(w, payload)
+			return
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		io.WriteString(gz, payload)
+		gz.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	for _, compress := range []bool{true, false} {
+		tr := &httpTransfer{compress: compress}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate") // as the SDK sends it
+		resp, err := tr.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != payload {
+			t.Fatalf("compress=%v: body %.40q..., err %v", compress, body, err)
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("compress=%v: Content-Encoding %q left for the SDK", compress, resp.Header.Get("Content-Encoding"))
+		}
+		var s runSummary
+		tr.addTo(&s)
+		got := strings.Join(s.fields, " ")
+		if tr.decoded.Load() != int64(len(payload)) {
+			t.Errorf("compress=%v: %s, want decoded_bytes=%d", compress, got, len(payload))
+		}
+		if compress && (tr.wire.Load() >= tr.decoded.Load() || !strings.Contains(got, "response_encoding=gzip:1")) {
+			t.Errorf("compress=true: %s, want gzip and fewer wire than decoded bytes", got)
+		}
+		if !compress && (tr.wire.Load() != tr.decoded.Load() || !strings.Contains(got, "response_encoding=identity:1")) {
+			t.Errorf("compress=false: %s, want identity and equal byte counts", got)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for in, want := range map[string]byteSize{"0": 0, "1500": 1500, "512K": 512 << 10, "10MB": 10 << 20, "1g/s": 1 << 30, "1.5M": 3 << 19} {
+		var r byteSize
+		if err := r.Set(in); err != nil || r != want {
+			t.Errorf("Set(%q) = %d, %v; want %d", in, r, err, want)
+		}
+	}
+	for _, in := range []string{"", "fast", "-1M", "10T"} {
+		var r byteSize
+		if err := r.Set(in); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", in, r)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var n atomic.Int64
+	r := &countingReader{r: bytes.NewReader(make([]byte, 64<<10)), n: &n, limit: newRateLimiter(256 << 10)}
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	// 64K at 256K/s is a quarter of a second.
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Errorf("read 64K in %v at 256K/s, want about 250ms", d)
+	}
+	if n.Load() != 64<<10 {
+		t.Errorf("counted %d bytes, want %d", n.Load(), 64<<10)
+	}
+}
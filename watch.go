@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+	"github.com/shopspring/decimal"
+
+	"github.com/harche/kusto-example/pkg/encode"
+	"github.com/harche/kusto-example/pkg/stream"
+)
+
+// watchCellWidth is the width watch cuts table cells to.
+const watchCellWidth = 40
+
+var errWatchTooManyRows = errors.New("the query returned more rows than --max-rows")
+
+// watchSnapshot is the primary result of one run of a watched query.
+type watchSnapshot struct {
+	table *encode.Table
+	rows  []value.Values
+	at    time.Time
+}
+
+// watchCollector keeps the first primary result table of a run, up to max rows.
+type watchCollector struct {
+	max  int
+	snap *watchSnapshot
+}
+
+func (c *watchCollector) Begin(t *encode.Table) error {
+	if c.snap.table == nil {
+		c.snap.table = t
+	}
+	return nil
+}
+
+func (c *watchCollector) WriteRow(t *encode.Table, _ int, vals value.Values) error {
+	if t != c.snap.table {
+		return nil
+	}
+	if len(c.snap.rows) == c.max {
+		return errWatchTooManyRows
+	}
+	c.snap.rows = append(c.snap.rows, append(value.Values(nil), vals...))
+	return nil
+}
+
+func (c *watchCollector) End() error { return nil }
+
+// watchDiff is how a run's rows compare with the previous run's. Rows are matched by their key
+// columns, or by position when there are none.
+type watchDiff struct {
+	first   bool             // there was no previous run to compare with
+	isNew   []bool           // per row of the run: no row of the previous run had its key
+	deltas  []map[int]string // per row: the changed cells, with the change of numeric ones ("+3")
+	changed int              // rows with a changed cell
+	gone    int              // rows of the previous run whose key is missing now
+	prevLen int
+}
+
+// watchKey is the identity of row i: the text of its key columns, numbered when several rows
+// share it, or its position without key columns.
+func watchKey(vals value.Values, key []int, i int, seen map[string]int) string {
+	if len(key) == 0 {
+		return strconv.Itoa(i)
+	}
+	parts := make([]string, len(key))
+	for j, k := range key {
+		if k < len(vals) {
+			parts[j] = watchCellText(encode.PlainValue(vals[k]))
+		}
+	}
+	k := strings.Join(parts, "\x00")
+	seen[k]++
+	return fmt.Sprintf("%s\x00#%d", k, seen[k])
+}
+
+// diffWatch compares cur with prev, which is nil on the first run.
+func diffWatch(prev, cur *watchSnapshot, key []int) *watchDiff {
+	d := &watchDiff{isNew: make([]bool, len(cur.rows)), deltas: make([]map[int]string, len(cur.rows))}
+	if prev == nil || prev.table == nil || !sameColumns(prev.table, cur.table) {
+		d.first = true
+		return d
+	}
+	d.prevLen = len(prev.rows)
+	before := make(map[string]value.Values, len(prev.rows))
+	seen := map[string]int{}
+	for i, vals := range prev.rows {
+		before[watchKey(vals, key, i, seen)] = vals
+	}
+	seen = map[string]int{}
+	matched := 0
+	for i, vals := range cur.rows {
+		old, ok := before[watchKey(vals, key, i, seen)]
+		if !ok {
+			d.isNew[i] = true
+			continue
+		}
+		matched++
+		for c := range vals {
+			a, b := encode.PlainValue(old[c]), encode.PlainValue(vals[c])
+			if watchCellText(a) == watchCellText(b) {
+				continue
+			}
+			if d.deltas[i] == nil {
+				d.deltas[i] = map[int]string{}
+				d.changed++
+			}
+			d.deltas[i][c] = watchDelta(a, b)
+		}
+	}
+	d.gone = len(prev.rows) - matched
+	return d
+}
+
+func sameColumns(a, b *encode.Table) bool {
+	if len(a.Columns) != len(b.Columns) {
+		return false
+	}
+	for i := range a.Columns {
+		if a.Columns[i].Name() != b.Columns[i].Name() || a.Columns[i].Type() != b.Columns[i].Type() {
+			return false
+		}
+	}
+	return true
+}
+
+// watchDelta is the change from a to b of a number, timespan or datetime, signed ("+3", "-1.5",
+// "+1m30s"), or "" for other values and nulls.
+func watchDelta(a, b interface{}) string {
+	var d string
+	switch x := b.(type) {
+	case int32:
+		if y, ok := a.(int32); ok {
+			d = strconv.FormatInt(int64(x)-int64(y), 10)
+		}
+	case int64:
+		if y, ok := a.(int64); ok {
+			d = strconv.FormatInt(x-y, 10)
+		}
+	case float64:
+		if y, ok := a.(float64); ok {
+			d = strconv.FormatFloat(x-y, 'g', 6, 64)
+		}
+	case decimal.Decimal:
+		if y, ok := a.(decimal.Decimal); ok {
+			d = x.Sub(y).String()
+		}
+	case time.Duration:
+		if y, ok := a.(time.Duration); ok {
+			d = (x - y).String()
+		}
+	case time.Time:
+		if y, ok := a.(time.Time); ok {
+			d = x.Sub(y).String()
+		}
+	}
+	if d != "" && !strings.HasPrefix(d, "-") {
+		d = "+" + d
+	}
+	return d
+}
+
+// watchCellText is a cell as watch shows it, and compares it between runs.
+func watchCellText(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprint(v)
+}
+
+// signedCount is n with a sign, for row count changes.
+func signedCount(n int) string {
+	if n >= 0 {
+		return "+" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+// watchView writes the runs of a watched query.
+type watchView interface {
+	show(run int, snap *watchSnapshot, d *watchDiff, elapsed time.Duration) error
+	fail(run int, at time.Time, err error)
+}
+
+// watchTable redraws the result as a text table after every run, marking new rows with + and
+// changed ones with ~, and showing the change of numeric cells next to them. On a terminal the
+// screen is cleared first and the changes are highlighted.
+type watchTable struct {
+	w        io.Writer
+	tty      bool
+	title    string
+	interval time.Duration
+}
+
+func (v *watchTable) header(run int, at time.Time) {
+	if v.tty {
+		fmt.Fprint(v.w, "\033[H\033[2J")
+	} else if run > 1 {
+		fmt.Fprintln(v.w)
+	}
+	fmt.Fprintf(v.w, "Every %s: %s    %s, run %d\n", v.interval, v.title, at.UTC().Format(time.RFC3339), run)
+}
+
+func (v *watchTable) fail(run int, at time.Time, err error) {
+	v.header(run, at)
+	fmt.Fprintf(v.w, "FAIL %s\n", errText(err))
+}
+
+func (v *watchTable) show(run int, snap *watchSnapshot, d *watchDiff, elapsed time.Duration) error {
+	v.header(run, snap.at)
+	summary := fmt.Sprintf("%d rows", len(snap.rows))
+	if !d.first {
+		summary += fmt.Sprintf(" (%s)", signedCount(len(snap.rows)-d.prevLen))
+		if d.changed > 0 {
+			summary += fmt.Sprintf(", %d changed", d.changed)
+		}
+		if d.gone > 0 {
+			summary += fmt.Sprintf(", %d gone", d.gone)
+		}
+	}
+	fmt.Fprintf(v.w, "%s, %dms\n\n", v.paint(summary, !d.first && len(snap.rows) != d.prevLen), elapsed.Milliseconds())
+	if snap.table == nil {
+		return nil
+	}
+
+	cols := snap.table.Columns
+	cells := make([][]string, len(snap.rows))
+	widths := make([]int, len(cols))
+	right := make([]bool, len(cols))
+	for c, col := range cols {
+		widths[c] = utf8.RuneCountInString(col.Name())
+		switch col.Type() {
+		case types.Int, types.Long, types.Real, types.Decimal, types.Timespan:
+			right[c] = true
+		}
+	}
+	for i, vals := range snap.rows {
+		cells[i] = make([]string, len(cols))
+		for c := range cols {
+			var s string
+			if c < len(vals) {
+				s = cutCell(watchCellText(encode.PlainValue(vals[c])), watchCellWidth)
+			}
+			if delta := d.deltas[i][c]; delta != "" {
+				s += " (" + delta + ")"
+			}
+			cells[i][c] = s
+			widths[c] = max(widths[c], utf8.RuneCountInString(s))
+		}
+	}
+	line := make([]string, len(cols))
+	for c, col := range cols {
+		line[c] = pad(col.Name(), widths[c], right[c])
+	}
+	fmt.Fprintf(v.w, "  %s\n", strings.Join(line, "  "))
+	for i := range snap.rows {
+		mark := " "
+		switch {
+		case d.isNew[i] && !d.first:
+			mark = "+"
+		case d.deltas[i] != nil:
+			mark = "~"
+		}
+		for c := range cols {
+			_, changed := d.deltas[i][c]
+			line[c] = v.paint(pad(cells[i][c], widths[c], right[c]), changed || mark == "+")
+		}
+		fmt.Fprintf(v.w, "%s %s\n", mark, strings.Join(line, "  "))
+	}
+	return nil
+}
+
+// paint highlights s on a terminal.
+func (v *watchTable) paint(s string, on bool) string {
+	if !on || !v.tty {
+		return s
+	}
+	return "\033[1;33m" + s + "\033[0m"
+}
+
+func pad(s string, width int, right bool) string {
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return s
+	}
+	if right {
+		return strings.Repeat(" ", n) + s
+	}
+	return s + strings.Repeat(" ", n)
+}
+
+// cutCell shortens s to width characters, ending in "…", and shows line breaks and tabs escaped.
+func cutCell(s string, width int) string {
+	s = strings.NewReplacer("\r", `\r`, "\n", `\n`, "\t", `\t`).Replace(s)
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:width-1]) + "…"
+}
+
+// watchNDJSON appends every run's rows as JSON lines, each with the run's number and time, and
+// from the second run on, "_new" for rows the previous run didn't have and "_delta" for the
+// cells that changed: the change of numbers, timespans and datetimes, and otherwise the old value.
+type watchNDJSON struct {
+	w io.Writer
+}
+
+func (v *watchNDJSON) show(run int, snap *watchSnapshot, d *watchDiff, _ time.Duration) error {
+	if snap.table == nil {
+		return nil
+	}
+	for i, vals := range snap.rows {
+		obj := encode.RowObject(snap.table, i, vals)
+		obj["_run"] = run
+		obj["_time"] = snap.at.UTC().Format(time.RFC3339Nano)
+		if !d.first {
+			if d.isNew[i] {
+				obj["_new"] = true
+			}
+			if len(d.deltas[i]) > 0 {
+				delta := make(map[string]interface{}, len(d.deltas[i]))
+				for c, s := range d.deltas[i] {
+					delta[snap.table.Columns[c].Name()] = s
+				}
+				obj["_delta"] = delta
+			}
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := v.w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *watchNDJSON) fail(run int, _ time.Time, err error) {
+	fmt.Fprintf(os.Stderr, "FAIL watch run %d: %s\n", run, errText(err))
+}
+
+// watcher runs a query every interval and shows each result against the one before.
+type watcher struct {
+	query    string
+	database string
+	interval time.Duration
+	count    int // runs, 0 for no limit
+	maxRows  int
+	key      []string
+	timeouts timeoutConfig
+	view     watchView
+	run      func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error
+	hb       *heartbeat
+}
+
+// once runs the query and shows its result, returning the snapshot for the next comparison. A
+// failed query is shown and prev returned, to compare the next run with; the error returned is
+// one that ends the watch.
+func (w *watcher) once(n int, prev *watchSnapshot) (*watchSnapshot, error) {
+	snap := &watchSnapshot{at: time.Now()}
+	c := &watchCollector{max: w.maxRows, snap: snap}
+	ctx, cancel := w.timeouts.callContext(context.Background(), callQuery)
+	start := time.Now()
+	err := w.run(ctx, w.database, (&kql.Builder{}).AddUnsafe(w.query), encode.PrimaryOnly{Encoder: c})
+	cancel()
+	elapsed := time.Since(start)
+	if err != nil {
+		w.hb.moved()
+		w.view.fail(n, snap.at, err)
+		return prev, nil
+	}
+	key, err := w.keyColumns(snap.table)
+	if err != nil {
+		return prev, err
+	}
+	if err := w.view.show(n, snap, diffWatch(prev, snap, key), elapsed); err != nil {
+		return prev, fmt.Errorf("failed to write output: %w", err)
+	}
+	w.hb.beat(fmt.Sprintf("watch run %d", n))
+	return snap, nil
+}
+
+// keyColumns are the indexes of --key's columns in t, or without --key its string columns.
+func (w *watcher) keyColumns(t *encode.Table) ([]int, error) {
+	if t == nil {
+		return nil, nil
+	}
+	var key []int
+	if len(w.key) == 0 {
+		for i, c := range t.Columns {
+			if c.Type() == types.String {
+				key = append(key, i)
+			}
+		}
+		return key, nil
+	}
+	for _, name := range w.key {
+		i := -1
+		for j, c := range t.Columns {
+			if c.Name() == name {
+				i = j
+			}
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("--key column %s isn't in the result", name)
+		}
+		key = append(key, i)
+	}
+	return key, nil
+}
+
+// watch runs the query until interrupted or count runs are done. Failed runs are reported and
+// the next one goes ahead, so a watch outlives a blip in an incident; a run that can't be shown
+// at all (a broken pipe, a bad --key) ends it.
+func (w *watcher) watch() error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	var prev *watchSnapshot
+	for n := 1; ; n++ {
+		start := time.Now()
+		snap, err := w.once(n, prev)
+		if err != nil {
+			return err
+		}
+		prev = snap
+		if w.count > 0 && n >= w.count {
+			return nil
+		}
+		select {
+		case <-interrupt:
+			return nil
+		case <-time.After(w.interval - time.Since(start)):
+		}
+	}
+}
+
+// runWatch implements "watch [--interval 30s] [cluster]": the query run again and again, its
+// result redrawn as a table with the changes since the last run, or appended as NDJSON.
+func runWatch(args []string, globalTimeouts *timeoutFlags) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	cmdTimeouts := registerTimeoutFlags(fs)
+	queryText := fs.String("query", os.Getenv("KUSTO_QUERY"), "query to watch (default KUSTO_QUERY)")
+	database := fs.String("database", getenv("KUSTO_DATABASE", "sampledb"), "database the query runs in")
+	interval := fs.Duration("interval", 30*time.Second, "time from the start of one run to the start of the next")
+	count := fs.Int("count", 0, "stop after this many runs (0: until interrupted)")
+	format := fs.String("format", "", "table|ndjson (default table on a terminal, otherwise ndjson)")
+	keyFlag := fs.String("key", "", "columns that identify a row across runs, comma-separated (default the string columns, or the row's position without any)")
+	maxRows := fs.Int("max-rows", 1000, "most rows a run may return")
+	cluster := resolveClusterURL(firstArg(parseArgs(fs, args)))
+	query := strings.TrimRight(strings.TrimSpace(*queryText), ";")
+	fi, err := os.Stdout.Stat()
+	tty := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	if *format == "" {
+		*format = "ndjson"
+		if tty {
+			*format = "table"
+		}
+	}
+	switch {
+	case query == "":
+		log.Fatalf("watch: --query (or KUSTO_QUERY) is required")
+	case *interval < time.Second:
+		log.Fatalf("watch: --interval must be at least 1s")
+	case *maxRows < 1:
+		log.Fatalf("watch: --max-rows must be at least 1")
+	case *format != "table" && *format != "ndjson":
+		log.Fatalf("watch: --format must be table or ndjson")
+	}
+
+	startTokenRefresh(context.Background())
+	client, err := newClient(cluster)
+	if err != nil {
+		log.Fatalf("failed creating Kusto client: %v", err)
+	}
+	defer client.Close()
+	timeouts := resolveTimeouts(globalTimeouts, cmdTimeouts, 2*time.Minute)
+	globalRequest.checkServerTimeout(timeouts, callQuery)
+	w := &watcher{query: query, database: *database, interval: *interval, count: *count, maxRows: *maxRows,
+		key: splitCSV(*keyFlag), timeouts: timeouts, hb: startHeartbeat("watch")}
+	w.run = func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		id, opts := globalRequest.callOptions("watch")
+		_, err := stream.Query(ctx, client, database, q, enc, opts...)
+		return withRequestID(err, id)
+	}
+	if *format == "table" {
+		title := query
+		if i := strings.IndexByte(title, '\n'); i >= 0 {
+			title = title[:i] + " …"
+		}
+		w.view = &watchTable{w: os.Stdout, tty: tty, title: cutCell(title, 60), interval: *interval}
+	} else {
+		w.view = &watchNDJSON{w: os.Stdout}
+	}
+	if err := w.watch(); err != nil {
+		w.hb.stop("failed")
+		log.Fatalf("watch: %v", err)
+	}
+	w.hb.stop("done")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/azkustodata/kql"
+	"github.com/Azure/azure-kusto-go/azkustodata/query"
+	"github.com/Azure/azure-kusto-go/azkustodata/types"
+	"github.com/Azure/azure-kusto-go/azkustodata/value"
+
+	"github.com/harche/kusto-example/pkg/encode"
+)
+
+func TestWatch(t *testing.T) {
+	tbl := &encode.Table{Name: "PrimaryResult", Kind: "PrimaryResult", Columns: []query.Column{
+		query.NewColumn(0, "State", types.String), query.NewColumn(1, "Events", types.Long), query.NewColumn(2, "Lag", types.Timespan)}}
+	results := [][]value.Values{
+		{{value.NewString("TEXAS"), value.NewLong(3), value.NewTimespan(time.Minute)}, {value.NewString("OHIO"), value.NewLong(1), value.NewTimespan(time.Minute)}},
+		nil, // the second run fails
+		{{value.NewString("TEXAS"), value.NewLong(5), value.NewTimespan(30 * time.Second)}, {value.NewString("IOWA"), value.NewLong(2), value.NewTimespan(time.Minute)}},
+	}
+	runs := 0
+	run := func(ctx context.Context, database string, q *kql.Builder, enc encode.Encoder) error {
+		rows := results[runs]
+		runs++
+		if rows == nil {
+			return errors.New("connection reset")
+		}
+		if err := enc.Begin(tbl); err != nil {
+			return err
+		}
+		for i, r := range rows {
+			if err := enc.WriteRow(tbl, i, r); err != nil {
+				return err
+			}
+		}
+		return enc.End()
+	}
+
+	var out strings.Builder
+	w := &watcher{query: "Q", database: "db", interval: time.Millisecond, count: 3, maxRows: 10, timeouts: resolveTimeouts(nil, nil, time.Minute),
+		run: run, view: &watchTable{w: &out, title: "Q", interval: time.Second}}
+	if err := w.watch(); err != nil {
+		t.Fatal(err)
+	}
+	// The third run is compared with the first, the last that worked.
+	got := out.String()
+	for _, want := range []string{"FAIL connection reset", "2 rows (+0), 1 changed, 1 gone,", "~ TEXAS  5 (+2)  30s (-30s)", "+ IOWA        2        1m0s"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("no %q in\n%s", want, got)
+		}
+	}
+
+	var lines strings.Builder
+	runs = 0
+	results[1] = results[2]
+	w = &watcher{query: "Q", database: "db", interval: time.Millisecond, count: 2, maxRows: 10, key: []string{"State"}, timeouts: resolveTimeouts(nil, nil, time.Minute),
+		run: run, view: &watchNDJSON{w: &lines}}
+	if err := w.watch(); err != nil {
+		t.Fatal(err)
+	}
+	ndjson := strings.Split(strings.TrimSpace(lines.String()), "\n")
+	if len(ndjson) != 4 || strings.Contains(ndjson[0], "_delta") || !strings.Contains(ndjson[2], `"_delta":{"Events":"+2","Lag":"-30s"}`) ||
+		!strings.Contains(ndjson[3], `"_new":true`) || !strings.Contains(ndjson[3], `"_run":2`) {
+		t.Errorf("ndjson:\n%s", lines.String())
+	}
+
+	// A --key column missing from the result ends the watch.
+	runs = 0
+	w.key = []string{"Nope"}
+	if err := w.watch(); err == nil || !strings.Contains(err.Error(), "Nope") {
+		t.Errorf("missing key: %v", err)
+	}
+}